@@ -0,0 +1,135 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// PromptAdapter tailors the conversation to a model family's tool calling
+// conventions: extra system prompt instructions, whether tools go in the
+// native tools field or only in the prompt, and how replies are parsed
+type PromptAdapter interface {
+	Name() string
+	SystemPrompt(base string, tools []Tool) string
+	Tools(tools []Tool) []Tool
+	ContentParsers() []string
+}
+
+// templateAdapter is a PromptAdapter driven by a fixed set of instructions;
+// %s in the instructions is replaced by the tool definitions, one per line
+type templateAdapter struct {
+	name         string
+	instructions string
+	nativeTools  bool
+	parsers      []string
+}
+
+func (a *templateAdapter) Name() string {
+	return a.name
+}
+
+func (a *templateAdapter) SystemPrompt(base string, tools []Tool) string {
+	if a.instructions == "" {
+		return base
+	}
+	instructions := a.instructions
+	if strings.Contains(instructions, "%s") {
+		instructions = fmt.Sprintf(instructions, describeTools(tools))
+	}
+	return strings.TrimRight(base, "\r\n") + "\n\n" + instructions
+}
+
+func (a *templateAdapter) Tools(tools []Tool) []Tool {
+	if !a.nativeTools {
+		return nil
+	}
+	return tools
+}
+
+func (a *templateAdapter) ContentParsers() []string {
+	return a.parsers
+}
+
+// describeTools renders tool definitions for inclusion in a prompt
+func describeTools(tools []Tool) string {
+	var lines []string
+	for _, tool := range tools {
+		data, err := json.Marshal(tool.Function)
+		if err != nil {
+			continue
+		}
+		lines = append(lines, string(data))
+	}
+	return strings.Join(lines, "\n")
+}
+
+var adapters = map[string]PromptAdapter{
+	"native": &templateAdapter{
+		name:        "native",
+		nativeTools: true,
+		parsers:     []string{"json"},
+	},
+	"prompt": &templateAdapter{
+		name: "prompt",
+		instructions: "You have access to the following tools, one JSON schema per line:\n%s\n\n" +
+			"To call a tool, reply with a ```json fenced block containing " +
+			`{"name": <tool name>, "arguments": <arguments object>}` +
+			", one block per call, then wait for the results.",
+		parsers: []string{"json"},
+	},
+	"hermes": &templateAdapter{
+		name: "hermes",
+		instructions: "You are a function calling AI model. You are provided with function signatures within <tools></tools> XML tags. " +
+			"You may call one or more functions to assist with the user query. Don't make assumptions about what values to plug into functions.\n" +
+			"<tools>\n%s\n</tools>\n" +
+			"For each function call return a json object with function name and arguments within <tool_call></tool_call> XML tags:\n" +
+			"<tool_call>\n" + `{"name": <function-name>, "arguments": <args-dict>}` + "\n</tool_call>",
+		parsers: []string{"xml", "json"},
+	},
+	"qwen": &templateAdapter{
+		name: "qwen",
+		instructions: "Call tools using the native tool calling format. If you write a call in your reply instead, " +
+			"wrap it as <tool_call>" + `{"name": <function-name>, "arguments": <args-dict>}` + "</tool_call>.",
+		nativeTools: true,
+		parsers:     []string{"xml", "json"},
+	},
+	"llama3": &templateAdapter{
+		name: "llama3",
+		instructions: "When you want to call a tool, respond with only a JSON object of the form " +
+			`{"name": function name, "parameters": dictionary of argument name and its value}` +
+			". Do not use variables.",
+		nativeTools: true,
+		parsers:     []string{"json", "xml"},
+	},
+	"mistral": &templateAdapter{
+		name:        "mistral",
+		nativeTools: true,
+		parsers:     []string{"mistral", "json"},
+	},
+}
+
+// adaptersByFamily maps model families to the adapter used when none is configured
+var adaptersByFamily = map[string]string{
+	"hermes":  "hermes",
+	"qwen":    "qwen",
+	"llama":   "llama3",
+	"mistral": "mistral",
+	"mixtral": "mistral",
+}
+
+// adapterForModel returns the named adapter, or the default for the model's
+// family if name is empty
+func adapterForModel(name, model string) (PromptAdapter, error) {
+	if name == "" {
+		name = adaptersByFamily[modelFamily(model)]
+		if name == "" {
+			name = "native"
+		}
+	}
+	adapter, ok := adapters[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown prompt adapter: %s", name)
+	}
+	return adapter, nil
+}
@@ -0,0 +1,452 @@
+// Package agent is the wex engine: a session in which a model carries out a
+// request through tools for reading and writing files and running commands.
+// The wex command runs it from flags and environment variables; another
+// program, or a test, can make one with options instead:
+//
+//	engine, err := agent.New(agent.WithWorkspace(dir), agent.WithProvider(nil, url, "qwen3"),
+//		agent.WithApprover(func(string) bool { return false }))
+//	result, err := engine.Run(ctx, "Add a README")
+//
+// Settings with no option keep their zero values, which for the flags are
+// mostly their defaults too.
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Option configures an engine made by New
+type Option func(*Engine) error
+
+// New makes an engine from options. Without WithProvider it talks to Ollama
+// on localhost, using the first model installed there.
+func New(opts ...Option) (*Engine, error) {
+	e := &Engine{
+		client:    &http.Client{Timeout: 30 * time.Minute},
+		ollamaURL: "http://localhost:11434",
+		user:      currentUser(),
+
+		maxReadBytes:  defaultMaxReadBytes,
+		symlinkPolicy: symlinkWithin,
+		maxAttempts:   defaultMaxAttempts,
+		readDedup:     true,
+	}
+	if data, err := os.ReadFile("system_prompt.txt"); err == nil {
+		e.systemPrompt = string(data)
+	}
+	for _, opt := range opts {
+		if err := opt(e); err != nil {
+			return nil, err
+		}
+	}
+
+	if e.confined && !e.unconfinedCommands {
+		e.noCommands = true
+	}
+	if e.workspace == "" {
+		dir, err := os.Getwd()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get working directory: %v", err)
+		}
+		e.workspace = dir
+	}
+	if e.model == "" {
+		model, err := e.getFirstAvailableModel()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get available model: %v", err)
+		}
+		e.model = model
+	}
+	if e.adapter == nil {
+		adapter, err := adapterForModel("", e.model)
+		if err != nil {
+			return nil, err
+		}
+		e.adapter = adapter
+	}
+	parsers, err := newContentParsers("", "auto", e.adapter.ContentParsers())
+	if err != nil {
+		return nil, err
+	}
+	e.contentParsers = parsers
+	return e, nil
+}
+
+// WithWorkspace sets the directory the tools work in
+func WithWorkspace(dir string) Option {
+	return func(e *Engine) error {
+		e.workspace = dir
+		return nil
+	}
+}
+
+// WithFS sets the filesystem the file tools work on, such as a MemFS
+// holding the workspace
+func WithFS(fsys FS) Option {
+	return func(e *Engine) error {
+		e.filesystem = fsys
+		return nil
+	}
+}
+
+// WithConfinedWorkspace sets the workspace and confines the filesystem
+// set so far to it, so that no file tool can reach outside it, even through
+// a symbolic link. Use it when sessions belong to different users.
+// Commands can't be confined, so the tools that run them are refused,
+// unless WithUnconfinedCommands allows them.
+func WithConfinedWorkspace(dir string) Option {
+	return func(e *Engine) error {
+		dir, err := filepath.Abs(dir)
+		if err != nil {
+			return fmt.Errorf("failed to resolve workspace: %v", err)
+		}
+		e.workspace = dir
+		e.filesystem = rootFS{e.files(), dir}
+		e.confined = true
+		return nil
+	}
+}
+
+// WithUnconfinedCommands offers the tools that run commands in a confined
+// workspace after all. They run in the workspace, under the command
+// policy, but can reach anything the process can, so use it only where
+// there is nobody else's work to reach, such as a workspace of one's own.
+func WithUnconfinedCommands() Option {
+	return func(e *Engine) error {
+		e.unconfinedCommands = true
+		return nil
+	}
+}
+
+// WithoutCommands refuses the tools that run commands or code, such as
+// run_command, run_python and the project tools, leaving the session only
+// what the filesystem allows
+func WithoutCommands() Option {
+	return func(e *Engine) error {
+		e.noCommands = true
+		return nil
+	}
+}
+
+// WithProvider sets the Ollama server and model. A nil client keeps the
+// default, and an empty model means the first one installed.
+func WithProvider(client *http.Client, url, model string) Option {
+	return func(e *Engine) error {
+		if client != nil {
+			e.client = client
+		}
+		e.ollamaURL = url
+		e.model = model
+		return nil
+	}
+}
+
+// WithAnthropic sends requests to Anthropic's Messages API, at the URL
+// given to WithProvider, with this API key
+func WithAnthropic(apiKey string) Option {
+	return func(e *Engine) error {
+		if apiKey == "" {
+			return fmt.Errorf("no Anthropic API key")
+		}
+		e.anthropicKey = apiKey
+		return nil
+	}
+}
+
+// WithBackend sends requests to a provider other than the built-in ones,
+// such as a scripted one in tests, and uses this model, or if it is empty,
+// the first one the provider lists
+func WithBackend(provider Provider, model string) Option {
+	return func(e *Engine) error {
+		if provider == nil {
+			return fmt.Errorf("no provider")
+		}
+		e.provider = provider
+		e.model = model
+		return nil
+	}
+}
+
+// WithSystemPrompt sets the system prompt template, which otherwise comes
+// from system_prompt.txt in the current directory
+func WithSystemPrompt(prompt string) Option {
+	return func(e *Engine) error {
+		e.systemPrompt = prompt
+		return nil
+	}
+}
+
+// WithTaskType sets the type of task, whose guidance is added to the
+// system prompt, as --task-type does; by default it is guessed from the
+// request
+func WithTaskType(taskType string) Option {
+	return func(e *Engine) error {
+		var err error
+		e.taskType, err = parseTaskType(taskType)
+		return err
+	}
+}
+
+// WithTools offers only the named tools, as --tools does
+func WithTools(names ...string) Option {
+	return func(e *Engine) error {
+		e.toolFilter.Enabled = nil
+		for _, name := range names {
+			if !hasTool(e.getTools(), name) {
+				return fmt.Errorf("unknown tool: %s", name)
+			}
+			if e.toolFilter.Enabled == nil {
+				e.toolFilter.Enabled = make(map[string]bool)
+			}
+			e.toolFilter.Enabled[name] = true
+		}
+		return nil
+	}
+}
+
+func hasTool(tools []Tool, name string) bool {
+	for _, tool := range tools {
+		if tool.Function.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// WithApprover decides on actions that would otherwise be put to the user
+// at the terminal, such as installing packages
+func WithApprover(approve func(action string) bool) Option {
+	return func(e *Engine) error {
+		e.approver = approve
+		return nil
+	}
+}
+
+// WithCallApprover decides on tool calls that need approval, by the tool
+// policy or for anything they do, instead of the user at the terminal,
+// returning the arguments to call the tool with; changing them is recorded
+// in the call's result
+func WithCallApprover(approve func(tool string, args json.RawMessage) (json.RawMessage, bool)) Option {
+	return func(e *Engine) error {
+		e.callApprover = approve
+		return nil
+	}
+}
+
+// WithImages sends images with the next request, for a multimodal model to
+// look at, such as a screenshot of how a page should look. Each must be a
+// PNG, JPEG, GIF or WebP image.
+func WithImages(images ...[]byte) Option {
+	return func(e *Engine) error {
+		for i, image := range images {
+			if err := checkImage(image); err != nil {
+				return fmt.Errorf("image %d is %v", i+1, err)
+			}
+		}
+		e.images = append(e.images, images...)
+		return nil
+	}
+}
+
+// WithAnswerer answers the questions the model asks with ask_user, instead
+// of the user at the terminal. Choices, if any, are the answers a question
+// may have, such as yes and no; returning false pauses the session, to be
+// carried on by another Run with the answer.
+func WithAnswerer(answer func(question string, choices []string) (string, bool)) Option {
+	return func(e *Engine) error {
+		e.answerer = answer
+		return nil
+	}
+}
+
+// WithCheckModel has a small model on the same provider look over each
+// destructive command, sending those it doubts for approval
+func WithCheckModel(model string) Option {
+	return func(e *Engine) error {
+		e.checkModel = model
+		return nil
+	}
+}
+
+// WithToolPolicy decides on each tool call by a policy file, as for
+// TOOL_POLICY
+func WithToolPolicy(path string) Option {
+	return func(e *Engine) error {
+		policy, err := loadToolPolicy(path)
+		if err != nil {
+			return err
+		}
+		e.toolPolicy = policy
+		return nil
+	}
+}
+
+// WithUser says who a session runs for, which the tool policy can check
+func WithUser(name string) Option {
+	return func(e *Engine) error {
+		e.user = name
+		return nil
+	}
+}
+
+// WithHistory carries on from earlier messages, such as those read from a
+// session file; system messages are not allowed, as the engine adds its own
+func WithHistory(messages []Message) Option {
+	return func(e *Engine) error {
+		for _, message := range messages {
+			if message.Role == "system" {
+				return fmt.Errorf("history can't include a system message")
+			}
+		}
+		e.history = messages
+		return nil
+	}
+}
+
+// WithModelOptions sends Ollama options, such as temperature, num_ctx,
+// num_predict, top_p, seed and stop, with every request, as the sampling
+// flags and OLLAMA_OPTIONS do
+func WithModelOptions(options map[string]interface{}) Option {
+	return func(e *Engine) error {
+		e.options = options
+		return nil
+	}
+}
+
+// WithAgentPeers offers start_agent, message_agent and wait_agent, which
+// run sessions on these wex servers, named and given by URL, sending the
+// token if it is not empty
+func WithAgentPeers(peers map[string]string, token string) Option {
+	return func(e *Engine) error {
+		var pairs []string
+		for name, url := range peers {
+			pairs = append(pairs, name+"="+url)
+		}
+		sort.Strings(pairs)
+		var err error
+		e.agentPeers, err = parseAgentPeers(strings.Join(pairs, ","))
+		e.agentToken = token
+		return err
+	}
+}
+
+// WithStreaming asks for replies a piece at a time, as --stream does, so
+// assistant_delta events carry the text as it is written; only Ollama's
+// /api/chat streams, and other providers send whole replies as before
+func WithStreaming() Option {
+	return func(e *Engine) error {
+		e.stream = true
+		return nil
+	}
+}
+
+// WithMaxAttempts sets how many times a request to the model server is
+// tried when the connection fails, or the server has an error of its own;
+// 1 means it is not tried again
+func WithMaxAttempts(n int) Option {
+	return func(e *Engine) error {
+		if n < 1 {
+			return fmt.Errorf("invalid number of attempts %d", n)
+		}
+		e.maxAttempts = n
+		return nil
+	}
+}
+
+// WithOffline refuses commands that reach the network, as --offline does
+func WithOffline() Option {
+	return func(e *Engine) error {
+		e.offline = true
+		return nil
+	}
+}
+
+// WithLicensePolicy puts a license header on new source files, {year}
+// standing for the current year, and keeps a session from adding
+// dependencies unless they are licensed under one of the allowed SPDX
+// identifiers; either may be empty
+func WithLicensePolicy(header string, allowed []string) Option {
+	return func(e *Engine) error {
+		e.licenses = &licensePolicy{header: header, allowed: allowed}
+		return nil
+	}
+}
+
+// WithEnsemble has the models propose their own version of each
+// write_file, writing one most of them agree on, or else the one the judge
+// model picks; with no judge, a write they disagree on is refused
+func WithEnsemble(judge string, models ...string) Option {
+	return func(e *Engine) error {
+		e.ensembleModels = models
+		e.judgeModel = judge
+		return nil
+	}
+}
+
+// WithLogger writes the plain log to a logger rather than to stdout, a
+// line at a time, with the logger's prefix and flags
+func WithLogger(logger *log.Logger) Option {
+	return func(e *Engine) error {
+		e.renderer = &plainRenderer{&logWriter{logger: logger}}
+		return nil
+	}
+}
+
+// WithEvents calls a function with each event of a session, instead of
+// writing a log
+func WithEvents(handle func(Event)) Option {
+	return func(e *Engine) error {
+		e.renderer = RendererFunc(handle)
+		return nil
+	}
+}
+
+// RendererFunc lets a function be used as a Renderer
+type RendererFunc func(Event)
+
+func (f RendererFunc) Render(event Event) {
+	f(event)
+}
+
+// Result is the outcome of a session run with Run
+type Result struct {
+	// Reply is the assistant's last message
+	Reply string
+
+	// FinalAnswer is the structured summary, if one was required
+	FinalAnswer *FinalAnswer
+
+	// Question is what ask_user asked with no one to answer; the session
+	// is paused, and carries on with the answer given to Run as the prompt.
+	// Choices are the answers it may have, if it is not free text.
+	Question string
+	Choices  []string
+
+	Turns int
+}
+
+// Run carries out a request, stopping early if the context is cancelled.
+// If the last run paused on a question, the prompt is the answer, and the
+// conversation carries on from where it paused.
+func (e *Engine) Run(ctx context.Context, prompt string) (*Result, error) {
+	if e.question != "" {
+		e.history = e.conversation
+	}
+	e.turn = 0
+	e.reply = ""
+	e.result = nil
+	e.question, e.choices, e.answers = "", nil, nil
+	if err := e.processRequest(ctx, prompt); err != nil {
+		return nil, err
+	}
+	return &Result{Reply: e.reply, FinalAnswer: e.result, Question: e.question, Choices: e.choices, Turns: e.turn}, nil
+}
@@ -0,0 +1,399 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeProvider is an Ollama server that gives scripted replies in order,
+// recording each request, and fails once the script runs out
+type fakeProvider struct {
+	mu       sync.Mutex
+	replies  []ChatResponse
+	requests []ChatRequest
+}
+
+func (p *fakeProvider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var req ChatRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	p.requests = append(p.requests, req)
+	if len(p.replies) == 0 {
+		http.Error(w, "no more replies", http.StatusInternalServerError)
+		return
+	}
+	reply := p.replies[0]
+	p.replies = p.replies[1:]
+	json.NewEncoder(w).Encode(reply)
+}
+
+// lastMessages returns the messages of the nth request, counting from 1
+func (p *fakeProvider) lastMessages(t *testing.T, n int) []Message {
+	t.Helper()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.requests) < n {
+		t.Fatalf("got %d requests, want at least %d", len(p.requests), n)
+	}
+	return p.requests[n-1].Messages
+}
+
+func reply(content string, calls ...ToolCall) ChatResponse {
+	var resp ChatResponse
+	resp.Message.Role = "assistant"
+	resp.Message.Content = content
+	resp.Message.ToolCalls = calls
+	resp.Done = true
+	return resp
+}
+
+func call(name, args string) ToolCall {
+	var c ToolCall
+	c.Function.Name = name
+	c.Function.Arguments = json.RawMessage(args)
+	return c
+}
+
+// newTestEngine makes an engine on a temporary workspace, talking to a fake
+// provider with the given replies, and recording events
+func newTestEngine(t *testing.T, replies []ChatResponse, opts ...Option) (*Engine, *fakeProvider, *[]Event) {
+	t.Helper()
+	provider := &fakeProvider{replies: replies}
+	srv := httptest.NewServer(provider)
+	t.Cleanup(srv.Close)
+
+	var events []Event
+	opts = append([]Option{
+		WithWorkspace(t.TempDir()),
+		WithProvider(srv.Client(), srv.URL, "test-model"),
+		WithSystemPrompt("You are a test."),
+		WithEvents(func(event Event) { events = append(events, event) }),
+	}, opts...)
+	e, err := New(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e, provider, &events
+}
+
+// toolResults returns the tool messages in a conversation
+func toolResults(messages []Message) []Message {
+	var results []Message
+	for _, message := range messages {
+		if message.Role == "tool" {
+			results = append(results, message)
+		}
+	}
+	return results
+}
+
+func TestRunToolLoop(t *testing.T) {
+	e, provider, events := newTestEngine(t, []ChatResponse{
+		reply("", call("write_file", `{"path": "notes/a.txt", "content": "hello\n"}`)),
+		reply("Wrote the file."),
+	})
+
+	result, err := e.Run(context.Background(), "Write a file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Reply != "Wrote the file." || result.Turns != 2 {
+		t.Errorf("got result %+v", result)
+	}
+
+	data, err := os.ReadFile(filepath.Join(e.workspace, "notes/a.txt"))
+	if err != nil || string(data) != "hello\n" {
+		t.Errorf("file has %q, %v", data, err)
+	}
+
+	messages := provider.lastMessages(t, 2)
+	if messages[0].Role != "system" || messages[1].Role != "user" || messages[1].Content != "Write a file" {
+		t.Errorf("conversation starts %+v", messages[:2])
+	}
+	results := toolResults(messages)
+	if len(results) != 1 || results[0].ToolCallID != "call_1" || strings.HasPrefix(results[0].Content, "Error:") {
+		t.Errorf("tool results %+v", results)
+	}
+
+	var types []EventType
+	for _, event := range *events {
+		if event.Type != EventLog {
+			types = append(types, event.Type)
+		}
+	}
+	want := []EventType{
+		EventTurnStarted, EventAssistantText, EventToolStarted, EventToolFinished,
+		EventTurnStarted, EventAssistantText, EventSessionDone,
+	}
+	if strings.Join(eventNames(types), " ") != strings.Join(eventNames(want), " ") {
+		t.Errorf("events %v, want %v", types, want)
+	}
+
+	// Debugging output is only for --verbose
+	var out strings.Builder
+	plain := &plainRenderer{&out}
+	for _, event := range *events {
+		plain.Render(event)
+	}
+	if strings.Contains(out.String(), "DEBUG:") || !strings.Contains(out.String(), "Assistant: Wrote the file.") {
+		t.Errorf("plain log without --verbose:\n%s", out.String())
+	}
+}
+
+func eventNames(types []EventType) []string {
+	names := make([]string, len(types))
+	for i, t := range types {
+		names[i] = string(t)
+	}
+	return names
+}
+
+func TestRunExtractsToolCallsFromText(t *testing.T) {
+	text := "I'll create it.\n```json\n" +
+		`{"name": "write_file", "arguments": {"path": "b.txt", "content": "from text"}}` +
+		"\n```\n"
+	e, provider, _ := newTestEngine(t, []ChatResponse{
+		reply(text),
+		reply("Done."),
+	})
+
+	if _, err := e.Run(context.Background(), "Write b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(e.workspace, "b.txt"))
+	if err != nil || string(data) != "from text" {
+		t.Errorf("file has %q, %v", data, err)
+	}
+
+	// The extracted call is sent back as a tool call, with its result
+	messages := provider.lastMessages(t, 2)
+	assistant := messages[2]
+	if len(assistant.ToolCalls) != 1 || assistant.ToolCalls[0].ID == "" {
+		t.Errorf("assistant message %+v", assistant)
+	}
+	if results := toolResults(messages); len(results) != 1 || results[0].ToolCallID != assistant.ToolCalls[0].ID {
+		t.Errorf("tool results %+v", results)
+	}
+}
+
+func TestRunSkipsExampleToolCalls(t *testing.T) {
+	text := "You could call it like this, for example:\n```json\n" +
+		`{"name": "write_file", "arguments": {"path": "c.txt", "content": "x"}}` +
+		"\n```\n"
+	e, _, _ := newTestEngine(t, []ChatResponse{reply(text)})
+
+	result, err := e.Run(context.Background(), "Explain write_file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Turns != 1 {
+		t.Errorf("ran %d turns, want 1", result.Turns)
+	}
+	if _, err := os.Stat(filepath.Join(e.workspace, "c.txt")); err == nil {
+		t.Error("example call was executed")
+	}
+}
+
+func TestRunDropsDuplicateToolCalls(t *testing.T) {
+	text := "```json\n" + `{"name": "write_file", "arguments": {"content": "x", "path": "d.txt"}}` + "\n```"
+	e, provider, _ := newTestEngine(t, []ChatResponse{
+		reply(text, call("write_file", `{"path": "d.txt", "content": "x"}`)),
+		reply("Done."),
+	})
+
+	if _, err := e.Run(context.Background(), "Write d.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if results := toolResults(provider.lastMessages(t, 2)); len(results) != 1 {
+		t.Errorf("got %d tool results, want 1", len(results))
+	}
+}
+
+func TestRunRepairsArguments(t *testing.T) {
+	args, _ := json.Marshal(`{'path': 'e.txt', content: 'repaired', }`)
+	e, _, _ := newTestEngine(t, []ChatResponse{
+		reply("", call("write_file", string(args))),
+		reply("Done."),
+	})
+
+	if _, err := e.Run(context.Background(), "Write e.txt"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(e.workspace, "e.txt"))
+	if err != nil || string(data) != "repaired" {
+		t.Errorf("file has %q, %v", data, err)
+	}
+}
+
+func TestRunReportsToolErrors(t *testing.T) {
+	e, provider, events := newTestEngine(t, []ChatResponse{
+		reply("",
+			call("no_such_tool", `{}`),
+			call("read_file", `{"path": "../../etc/passwd"}`),
+			call("read_file", `{"path": "missing.txt"}`),
+			call("write_file", `{"path": 1}`),
+		),
+		reply("Giving up."),
+	})
+
+	if _, err := e.Run(context.Background(), "Do things"); err != nil {
+		t.Fatal(err)
+	}
+	results := toolResults(provider.lastMessages(t, 2))
+	if len(results) != 4 {
+		t.Fatalf("got %d tool results, want 4", len(results))
+	}
+	for _, result := range results {
+		if !strings.HasPrefix(result.Content, "Error: ") {
+			t.Errorf("result %q is not an error", result.Content)
+		}
+	}
+	if !strings.Contains(results[0].Content, "unknown tool") {
+		t.Errorf("unknown tool reported as %q", results[0].Content)
+	}
+	if !strings.Contains(results[3].Content, "invalid arguments") {
+		t.Errorf("bad arguments reported as %q", results[3].Content)
+	}
+
+	failed := 0
+	for _, event := range *events {
+		if event.Type == EventToolFinished && event.Failed {
+			failed++
+		}
+	}
+	if failed != 4 {
+		t.Errorf("%d tool_finished events marked failed, want 4", failed)
+	}
+}
+
+func TestRunProviderError(t *testing.T) {
+	e, _, events := newTestEngine(t, nil, WithMaxAttempts(1))
+
+	_, err := e.Run(context.Background(), "Hello")
+	if err == nil || !strings.Contains(err.Error(), "status 500") {
+		t.Fatalf("got error %v", err)
+	}
+	last := (*events)[len(*events)-1]
+	if last.Type != EventSessionDone || last.Error == "" {
+		t.Errorf("last event %+v", last)
+	}
+}
+
+func TestRunCancelled(t *testing.T) {
+	e, provider, _ := newTestEngine(t, []ChatResponse{reply("Hi.")})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := e.Run(ctx, "Hello"); err != context.Canceled {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+	if len(provider.requests) != 0 {
+		t.Errorf("sent %d requests after cancellation", len(provider.requests))
+	}
+}
+
+func TestRunFinalAnswer(t *testing.T) {
+	answer := `{"summary": "Nothing to do", "files_changed": [], "commands_to_run": [], "open_questions": []}`
+	e, provider, events := newTestEngine(t, []ChatResponse{
+		reply("All done."),
+		reply("", call("final_answer", answer)),
+		reply("This reply is never requested."),
+	})
+	e.requireFinalAnswer = true
+
+	result, err := e.Run(context.Background(), "Check the project")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.FinalAnswer == nil || result.FinalAnswer.Summary != "Nothing to do" {
+		t.Errorf("final answer %+v", result.FinalAnswer)
+	}
+	if len(provider.requests) != 2 {
+		t.Errorf("sent %d requests, want 2", len(provider.requests))
+	}
+	if messages := provider.lastMessages(t, 2); messages[len(messages)-1].Content != finalAnswerReminder {
+		t.Errorf("model was not reminded to call final_answer")
+	}
+
+	// The answer comes with the last event, so JSON output stays a line
+	// of JSON per event
+	done := (*events)[len(*events)-1]
+	if done.Type != EventSessionDone || done.FinalAnswer == nil || done.FinalAnswer.Summary != "Nothing to do" {
+		t.Fatalf("last event %+v", done)
+	}
+	var out strings.Builder
+	(&jsonRenderer{&out}).Render(done)
+	if lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n"); len(lines) != 1 || !strings.Contains(lines[0], `"final_answer":{"summary":"Nothing to do"`) {
+		t.Errorf("rendered as JSON:\n%s", out.String())
+	}
+	out.Reset()
+	(&plainRenderer{&out}).Render(done)
+	if !strings.HasPrefix(out.String(), "{\n  \"result\": {\n") {
+		t.Errorf("rendered plain:\n%s", out.String())
+	}
+}
+
+func TestRunFinalAnswerMissing(t *testing.T) {
+	var replies []ChatResponse
+	for i := 0; i <= maxFinalAnswerReminders; i++ {
+		replies = append(replies, reply("All done."))
+	}
+	e, provider, _ := newTestEngine(t, replies)
+	e.requireFinalAnswer = true
+
+	_, err := e.Run(context.Background(), "Check the project")
+	if err == nil || !strings.Contains(err.Error(), "final_answer") {
+		t.Errorf("got error %v", err)
+	}
+	if len(provider.requests) != maxFinalAnswerReminders+1 {
+		t.Errorf("sent %d requests, want %d", len(provider.requests), maxFinalAnswerReminders+1)
+	}
+}
+
+func TestRunToolFilter(t *testing.T) {
+	e, provider, _ := newTestEngine(t, []ChatResponse{
+		reply("", call("write_file", `{"path": "f.txt", "content": "x"}`)),
+		reply("Done."),
+	}, WithTools("read_file"))
+
+	if _, err := e.Run(context.Background(), "Write f.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if tools := provider.requests[0].Tools; len(tools) != 1 || tools[0].Function.Name != "read_file" {
+		t.Errorf("offered %d tools", len(tools))
+	}
+	results := toolResults(provider.lastMessages(t, 2))
+	if len(results) != 1 || !strings.Contains(results[0].Content, "not enabled") {
+		t.Errorf("tool results %+v", results)
+	}
+	if _, err := os.Stat(filepath.Join(e.workspace, "f.txt")); err == nil {
+		t.Error("disabled tool was run")
+	}
+
+	if _, err := New(WithProvider(nil, "http://localhost:0", "m"), WithTools("no_such_tool")); err == nil {
+		t.Error("unknown tool name accepted")
+	}
+}
+
+func TestRunApprover(t *testing.T) {
+	var asked []string
+	e, _, _ := newTestEngine(t, nil, WithApprover(func(action string) bool {
+		asked = append(asked, action)
+		return false
+	}))
+	if e.askApproval("Delete everything") || len(asked) != 1 || asked[0] != "Delete everything" {
+		t.Errorf("approver asked %v", asked)
+	}
+}
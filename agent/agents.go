@@ -0,0 +1,1052 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// A coordinator session can farm work out to agents on other machines.
+// `wex serve` runs sessions for whoever asks over HTTP, each a conversation
+// that can be sent more messages once it has replied. AGENT_PEERS names
+// the servers a session may use, and the start_agent, message_agent and
+// wait_agent tools start sessions on them, carry them on, and collect
+// their replies, so a coordinator can start several at once and then wait
+// for each.
+
+// defaultServeAddress is where wex serve listens unless told otherwise
+const defaultServeAddress = "127.0.0.1:8765"
+
+// maxAgentWait is the longest wait_agent, or a GET with wait, waits
+const maxAgentWait = time.Hour
+
+// maxAgentMessage bounds a message sent to a session, with its images
+const maxAgentMessage = 4 * maxAttachedImage
+
+// agentRequestTimeout is how long a request to a peer may take, on top of
+// any time it was asked to wait
+const agentRequestTimeout = 30 * time.Second
+
+// agentSessionExpiry is how long a server keeps a session that has
+// finished with its last message, and its workspace, before forgetting it
+var agentSessionExpiry = 24 * time.Hour
+
+// maxSessionEvents is how many of a session's latest events a server keeps
+// for GET /sessions/{id}/events
+const maxSessionEvents = 10000
+
+// The states of a served session
+const (
+	agentRunning = "running"
+	agentIdle    = "idle"
+	agentFailed  = "failed"
+)
+
+// agentPeer is a wex server a session may start agents on
+type agentPeer struct {
+	name string
+	url  string
+}
+
+// parseAgentPeers parses AGENT_PEERS: name=URL pairs separated by commas,
+// e.g. gpu1=http://10.0.0.5:8765,gpu2=http://10.0.0.6:8765
+func parseAgentPeers(s string) ([]agentPeer, error) {
+	var peers []agentPeer
+	seen := make(map[string]bool)
+	for _, field := range strings.Split(s, ",") {
+		if strings.TrimSpace(field) == "" {
+			continue
+		}
+		name, rawURL, ok := strings.Cut(field, "=")
+		name, rawURL = strings.TrimSpace(name), strings.TrimRight(strings.TrimSpace(rawURL), "/")
+		if !ok || name == "" || strings.Contains(name, "/") {
+			return nil, fmt.Errorf("invalid peer %q: expected name=URL", strings.TrimSpace(field))
+		}
+		if u, err := url.Parse(rawURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid URL for peer %s: %q", name, rawURL)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("peer %s is named twice", name)
+		}
+		seen[name] = true
+		peers = append(peers, agentPeer{name, rawURL})
+	}
+	return peers, nil
+}
+
+// agentStatus is what a server says about one of its sessions
+type agentStatus struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Reply  string `json:"reply,omitempty"`
+	Error  string `json:"error,omitempty"`
+	Turns  int    `json:"turns"`
+
+	// Question is what the session asked with ask_user, pausing until the
+	// next message answers it, and Choices the answers it may have
+	Question string   `json:"question,omitempty"`
+	Choices  []string `json:"choices,omitempty"`
+}
+
+// servedSession is a conversation a server is having for someone else
+type servedSession struct {
+	status agentStatus
+	engine *Engine
+
+	// owner is the user who started it, the only one who may see it or
+	// carry it on; "" without users
+	owner string
+
+	// source is the workspace its own was copied from, which its diff is
+	// against
+	source string
+
+	// events are the latest of its events, after the first dropped were
+	// let go to keep within maxSessionEvents
+	events  []Event
+	dropped int
+
+	// done is closed when the current message has been dealt with, at
+	// finished
+	done     chan struct{}
+	finished time.Time
+
+	// thread is the chat thread it was started from, which it reports to;
+	// nil for sessions started over the API
+	thread *chatThread
+}
+
+// reviewer is someone who may decide what served sessions ask to have
+// approved, and the token they authenticate with
+type reviewer struct {
+	name  string
+	token string
+}
+
+// loadReviewers reads a reviewers file: a name and a token on each line,
+// separated by whitespace, with blank lines and lines starting with #
+// ignored. The tokens must differ from each other and from those taken,
+// AGENT_TOKEN and the users', so that no reviewer can pass for another,
+// and neither can a client.
+func loadReviewers(path string, taken ...string) ([]reviewer, error) {
+	lines, err := loadCredentials(path, "reviewers", 0, taken)
+	if err != nil {
+		return nil, err
+	}
+	var reviewers []reviewer
+	for _, fields := range lines {
+		reviewers = append(reviewers, reviewer{fields[0], fields[1]})
+	}
+	return reviewers, nil
+}
+
+// serveUser is someone who may run sessions on a server, with the token
+// they authenticate with and the workspace their sessions start from
+type serveUser struct {
+	name      string
+	token     string
+	workspace string
+}
+
+// loadServeUsers reads a users file, like a reviewers file but with an
+// optional third field, the directory the user's sessions copy instead of
+// the server's workspace, relative to the file
+func loadServeUsers(path string, taken ...string) ([]serveUser, error) {
+	lines, err := loadCredentials(path, "users", 1, taken)
+	if err != nil {
+		return nil, err
+	}
+	var users []serveUser
+	for _, fields := range lines {
+		user := serveUser{name: fields[0], token: fields[1]}
+		if len(fields) == 3 {
+			user.workspace = fields[2]
+			if !filepath.IsAbs(user.workspace) {
+				user.workspace = filepath.Join(filepath.Dir(path), user.workspace)
+			}
+			if info, err := os.Stat(user.workspace); err != nil || !info.IsDir() {
+				return nil, fmt.Errorf("%s: the workspace for %s, %s, is not a directory", path, user.name, user.workspace)
+			}
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+// loadCredentials reads the fields of a file of names and tokens, which may
+// have extra fields after them. Names and tokens must be unique, and the
+// tokens differ from those taken.
+func loadCredentials(path, what string, extra int, taken []string) ([][]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", what, err)
+	}
+	var lines [][]string
+	names := make(map[string]bool)
+	tokens := make(map[string]bool)
+	for _, token := range taken {
+		tokens[token] = true
+	}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || len(fields) > 2+extra {
+			return nil, fmt.Errorf("%s:%d: expected a name and a token", path, i+1)
+		}
+		if names[fields[0]] {
+			return nil, fmt.Errorf("%s:%d: %s is named twice", path, i+1, fields[0])
+		}
+		if len(fields[1]) < 16 {
+			return nil, fmt.Errorf("%s:%d: the token for %s is too short; use at least 16 random characters", path, i+1, fields[0])
+		}
+		if tokens[fields[1]] {
+			return nil, fmt.Errorf("%s:%d: the token for %s is already in use", path, i+1, fields[0])
+		}
+		names[fields[0]], tokens[fields[1]] = true, true
+		lines = append(lines, fields)
+	}
+	if len(lines) == 0 {
+		return nil, fmt.Errorf("%s names no %s", path, what)
+	}
+	return lines, nil
+}
+
+// agentServer runs sessions for other wex instances, each on an engine
+// configured like the server's own
+type agentServer struct {
+	base  *Engine
+	token string
+
+	// users, if any, are who may run sessions, each with a token of their
+	// own instead of token, and each seeing only their own sessions
+	users []serveUser
+
+	// ctx stops the sessions, and their requests for approval, when the
+	// server stops
+	ctx context.Context
+
+	// reviews holds what the sessions ask to have approved, for reviewers
+	// to decide over the API; without reviewers, nothing is approved
+	reviews   *ReviewQueue
+	reviewers []reviewer
+
+	mu       sync.Mutex
+	sessions map[string]*servedSession
+	next     int
+
+	// renderMu keeps the sessions' events from being written over each
+	// other
+	renderMu sync.Mutex
+
+	// chat, if set, runs sessions for those who ask in Slack or Discord
+	chat *chatBot
+}
+
+func newAgentServer(ctx context.Context, base *Engine, token string, reviewers []reviewer) *agentServer {
+	s := &agentServer{base: base, token: token, ctx: ctx, reviewers: reviewers, sessions: make(map[string]*servedSession)}
+	if len(reviewers) > 0 {
+		var names []string
+		for _, r := range reviewers {
+			names = append(names, r.name)
+		}
+		s.reviews = NewReviewQueue(names...)
+	}
+	return s
+}
+
+// authenticate finds the user whose token a request carries, or without
+// users, checks it carries the server's token, if there is one
+func (s *agentServer) authenticate(r *http.Request) (*serveUser, bool) {
+	if len(s.users) == 0 {
+		return nil, s.token == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+s.token)) == 1
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return nil, false
+	}
+	for i := range s.users {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.users[i].token)) == 1 {
+			return &s.users[i], true
+		}
+	}
+	return nil, false
+}
+
+// identify names the reviewer whose token a request carries
+func (s *agentServer) identify(r *http.Request) (string, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return "", false
+	}
+	for _, reviewer := range s.reviewers {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(reviewer.token)) == 1 {
+			return reviewer.name, true
+		}
+	}
+	return "", false
+}
+
+// newEngine makes an engine for a served session, with the server's model,
+// prompt, tools and policies, working in a copy of the server's workspace,
+// or the user's, of its own. Its file tools are confined to the copy, and
+// what it asks to have approved waits in the review queue. The tool policy
+// sees the user, if there is one, as the user.
+func (s *agentServer) newEngine(id string, user *serveUser) (*Engine, error) {
+	base := s.base
+	source := s.source(user)
+	dir, err := os.MkdirTemp("", "wex-agent-"+id+"-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to make workspace: %v", err)
+	}
+	if err := os.CopyFS(dir, os.DirFS(source)); err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("failed to copy workspace: %v", err)
+	}
+	approver := func(string) bool { return false }
+	var callApprover func(string, json.RawMessage) (json.RawMessage, bool)
+	if s.reviews != nil {
+		approver = s.reviews.Approver(s.ctx, id)
+		callApprover = s.reviews.CallApprover(s.ctx, id)
+	}
+	var fsys FS = osFS{}
+	if _, ok := base.files().(readOnlyFS); ok {
+		fsys = readOnlyFS{fsys}
+	}
+	opts := []Option{WithFS(fsys), WithConfinedWorkspace(dir), WithBackend(base.modelProvider(), base.model),
+		WithSystemPrompt(base.systemPrompt), WithApprover(approver), WithCallApprover(callApprover),
+		WithEvents(func(event Event) {
+			event.Agent = id
+			s.record(id, event)
+			s.renderMu.Lock()
+			defer s.renderMu.Unlock()
+			base.emit(event)
+		})}
+	if !base.noCommands {
+		opts = append(opts, WithUnconfinedCommands())
+	}
+	e, err := New(opts...)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	e.client = base.client
+	e.options, e.stream = base.options, base.stream
+	e.adapter, e.contentParsers = base.adapter, base.contentParsers
+	e.generateTemplate, e.llamaCpp, e.anthropicKey = base.generateTemplate, base.llamaCpp, base.anthropicKey
+	e.requireFinalAnswer, e.taskType, e.templateUserMessage = base.requireFinalAnswer, base.taskType, base.templateUserMessage
+	e.repoMap, e.gitContextCommits = base.repoMap, base.gitContextCommits
+	e.toolFilter, e.toolExamples = base.toolFilter, base.toolExamples
+	e.persistentShell, e.pythonTool, e.projectToolsEnabled = base.persistentShell, base.pythonTool, base.projectToolsEnabled
+	e.imageTools, e.imageAPI = base.imageTools, base.imageAPI
+	e.toolPolicy, e.user = base.toolPolicy, base.user
+	e.commandPolicy, e.packagePolicy = base.commandPolicy, base.packagePolicy
+	e.commandAnswers, e.forwardInput = base.commandAnswers, base.forwardInput
+	e.checkModel, e.confirmedIntents = base.checkModel, base.confirmedIntents
+	e.ensembleModels, e.judgeModel = base.ensembleModels, base.judgeModel
+	e.quota.MaxBytes, e.quota.MaxFiles = base.quota.MaxBytes, base.quota.MaxFiles
+	e.diffBudget.MaxLines, e.diffBudget.MaxFiles = base.diffBudget.MaxLines, base.diffBudget.MaxFiles
+	e.symlinkPolicy = base.symlinkPolicy
+	e.readDedup, e.maxReadBytes = base.readDedup, base.maxReadBytes
+	if base.licenses != nil {
+		e.licenses = &licensePolicy{header: base.licenses.header, allowed: base.licenses.allowed}
+	}
+	e.notifyConfig, e.offline, e.maxAttempts = base.notifyConfig, base.offline, base.maxAttempts
+	e.verbose = base.verbose
+	e.agentPeers, e.agentToken = base.agentPeers, base.agentToken
+	if user != nil {
+		e.user = user.name
+	}
+	return e, nil
+}
+
+// source is the workspace a user's sessions are copied from
+func (s *agentServer) source(user *serveUser) string {
+	if user != nil && user.workspace != "" {
+		return user.workspace
+	}
+	return s.base.workspace
+}
+
+// record keeps an event for the session it comes from, letting the older
+// half of its events go when it has too many, and passes it on to the
+// session's chat thread
+func (s *agentServer) record(id string, event Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session := s.sessions[id]
+	if session == nil {
+		return
+	}
+	session.events = append(session.events, event)
+	if len(session.events) > maxSessionEvents {
+		n := len(session.events) / 2
+		session.events = append([]Event(nil), session.events[n:]...)
+		session.dropped += n
+	}
+	if session.thread != nil {
+		session.thread.event(event)
+	}
+}
+
+// open starts a session for a user, or without users for whoever has the
+// token, reporting to a chat thread if there is one
+func (s *agentServer) open(user *serveUser, thread *chatThread, message string, images ...[]byte) (agentStatus, error) {
+	s.mu.Lock()
+	s.prune()
+	s.next++
+	id := "s" + strconv.Itoa(s.next)
+	s.mu.Unlock()
+	e, err := s.newEngine(id, user)
+	if err != nil {
+		return agentStatus{}, err
+	}
+	session := &servedSession{status: agentStatus{ID: id}, engine: e, source: s.source(user), thread: thread}
+	if user != nil {
+		session.owner = user.name
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[id] = session
+	s.start(session, message, images...)
+	return session.status, nil
+}
+
+// start has a session deal with a message, and any images sent with it,
+// in the background
+func (s *agentServer) start(session *servedSession, message string, images ...[]byte) {
+	session.status.Status = agentRunning
+	session.status.Reply, session.status.Error = "", ""
+	session.status.Question, session.status.Choices = "", nil
+	session.done = make(chan struct{})
+	e := session.engine
+	e.history = e.conversation
+	e.images = images
+	go func() {
+		result, err := e.Run(s.ctx, message)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if err != nil {
+			session.status.Status = agentFailed
+			session.status.Error = err.Error()
+		} else {
+			session.status.Status = agentIdle
+			session.status.Reply = result.Reply
+			session.status.Question, session.status.Choices = result.Question, result.Choices
+		}
+		session.status.Turns = e.turn
+		session.finished = time.Now()
+		close(session.done)
+		if thread := session.thread; thread != nil {
+			go thread.finish(session.status, session.source, e.workspace)
+		}
+	}()
+}
+
+// prune forgets sessions that finished longer ago than the expiry, and
+// removes their workspaces; s.mu must be held
+func (s *agentServer) prune() {
+	for id, session := range s.sessions {
+		if session.status.Status != agentRunning && time.Since(session.finished) > agentSessionExpiry {
+			delete(s.sessions, id)
+			os.RemoveAll(session.engine.workspace)
+		}
+	}
+}
+
+// Handler serves the sessions API:
+//
+//	POST /sessions                 {"message": ...} starts a session,
+//	                               with "images" as base64 if any
+//	POST /sessions/{id}/messages   {"message": ...} carries one on
+//	GET  /sessions/{id}?wait=N     its status, waiting up to N seconds
+//	                               for it to finish
+//	GET  /sessions                 the statuses of all the sessions
+//	GET  /sessions/{id}/events?after=N
+//	                               its events after the first N
+//	GET  /sessions/{id}/diff       what it changed in its workspace
+//
+// The first three answer with the session's agentStatus, and with a token, every
+// request must carry it as a bearer token. With users, each uses their own
+// token instead, and sees only the sessions they started. With reviewers,
+// what sessions ask to have approved is under /reviews, as
+// ReviewQueue.Handler serves it, to each reviewer with their own token as
+// the bearer token instead. GET / is a page that does all this from a
+// browser, and needs no token itself. With a chat bot, Slack and Discord
+// send what their users ask to /slack/ and /discord/, which check the
+// services' signatures instead of a token.
+func (s *agentServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /sessions", func(w http.ResponseWriter, r *http.Request) {
+		message, images, ok := readAgentMessage(w, r)
+		if !ok {
+			return
+		}
+		status, err := s.open(requestUser(r), nil, message, images...)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeAgentStatus(w, http.StatusAccepted, status)
+	})
+	mux.HandleFunc("POST /sessions/{id}/messages", func(w http.ResponseWriter, r *http.Request) {
+		message, images, ok := readAgentMessage(w, r)
+		if !ok {
+			return
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		session := s.session(r)
+		switch {
+		case session == nil:
+			http.Error(w, "no such session", http.StatusNotFound)
+		case session.status.Status == agentRunning:
+			http.Error(w, "the session is still working on its last message", http.StatusConflict)
+		default:
+			s.start(session, message, images...)
+			writeAgentStatus(w, http.StatusAccepted, session.status)
+		}
+	})
+	mux.HandleFunc("GET /sessions/{id}", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		session := s.session(r)
+		var done chan struct{}
+		if session != nil {
+			done = session.done
+		}
+		s.mu.Unlock()
+		if session == nil {
+			http.Error(w, "no such session", http.StatusNotFound)
+			return
+		}
+		if wait, err := strconv.Atoi(r.URL.Query().Get("wait")); err == nil && wait > 0 {
+			timeout := min(time.Duration(wait)*time.Second, maxAgentWait)
+			select {
+			case <-done:
+			case <-time.After(timeout):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		s.mu.Lock()
+		status := session.status
+		s.mu.Unlock()
+		writeAgentStatus(w, http.StatusOK, status)
+	})
+	mux.HandleFunc("GET /sessions", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		statuses := []agentStatus{}
+		for _, session := range s.sessions {
+			if session.owner == requestOwner(r) {
+				statuses = append(statuses, session.status)
+			}
+		}
+		s.mu.Unlock()
+		sort.Slice(statuses, func(i, j int) bool {
+			a, _ := strconv.Atoi(statuses[i].ID[1:])
+			b, _ := strconv.Atoi(statuses[j].ID[1:])
+			return a < b
+		})
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(statuses)
+	})
+	mux.HandleFunc("GET /sessions/{id}/events", func(w http.ResponseWriter, r *http.Request) {
+		after, _ := strconv.Atoi(r.URL.Query().Get("after"))
+		s.mu.Lock()
+		session := s.session(r)
+		var body struct {
+			Events []Event `json:"events"`
+			Next   int     `json:"next"`
+		}
+		if session != nil {
+			i := min(max(after-session.dropped, 0), len(session.events))
+			body.Events = append([]Event{}, session.events[i:]...)
+			body.Next = session.dropped + len(session.events)
+		}
+		s.mu.Unlock()
+		if session == nil {
+			http.Error(w, "no such session", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(body)
+	})
+	mux.HandleFunc("GET /sessions/{id}/diff", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		session := s.session(r)
+		s.mu.Unlock()
+		if session == nil {
+			http.Error(w, "no such session", http.StatusNotFound)
+			return
+		}
+		diff, err := workspaceDiff(session.source, session.engine.workspace)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		io.WriteString(w, diff)
+	})
+
+	root := http.NewServeMux()
+	root.HandleFunc("GET /{$}", serveWebUI)
+	if s.reviews != nil {
+		root.Handle("/reviews/", http.StripPrefix("/reviews", s.reviews.Handler(s.identify)))
+	}
+	if s.chat != nil {
+		s.chat.handle(root)
+	}
+	root.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		user, ok := s.authenticate(r)
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), serveUserKey{}, user)))
+	})
+	return root
+}
+
+// serveUserKey is the context key for the user a request came from
+type serveUserKey struct{}
+
+func requestUser(r *http.Request) *serveUser {
+	user, _ := r.Context().Value(serveUserKey{}).(*serveUser)
+	return user
+}
+
+// requestOwner names the user a request came from, as sessions record
+// their owner
+func requestOwner(r *http.Request) string {
+	if user := requestUser(r); user != nil {
+		return user.name
+	}
+	return ""
+}
+
+// session finds the session a request names, if the user it came from
+// owns it; others' sessions are not found, so their IDs give nothing
+// away. s.mu must be held.
+func (s *agentServer) session(r *http.Request) *servedSession {
+	session := s.sessions[r.PathValue("id")]
+	if session == nil {
+		return nil
+	}
+	if session.owner != requestOwner(r) {
+		return nil
+	}
+	return session
+}
+
+// readAgentMessage reads a message, and any images sent with it, as
+// base64
+func readAgentMessage(w http.ResponseWriter, r *http.Request) (string, [][]byte, bool) {
+	var body struct {
+		Message string   `json:"message"`
+		Images  []string `json:"images"`
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxAgentMessage)
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || strings.TrimSpace(body.Message) == "" {
+		http.Error(w, `expected {"message": ..., "images": [...]}`, http.StatusBadRequest)
+		return "", nil, false
+	}
+	images, err := decodeImages(body.Images)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", nil, false
+	}
+	return body.Message, images, true
+}
+
+func writeAgentStatus(w http.ResponseWriter, code int, status agentStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(status)
+}
+
+// workspaceDiff compares a session's workspace with the one it was copied
+// from, as that is now, in the format of diff -u; binary files are only
+// said to differ, and .git is left out
+func workspaceDiff(source, dir string) (string, error) {
+	paths := make(map[string]bool)
+	for _, root := range []string{source, dir} {
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			switch {
+			case err != nil:
+				return err
+			case d.IsDir() && d.Name() == ".git":
+				return filepath.SkipDir
+			case d.Type().IsRegular():
+				rel, _ := filepath.Rel(root, path)
+				paths[filepath.ToSlash(rel)] = true
+			}
+			return nil
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	var sorted []string
+	for path := range paths {
+		sorted = append(sorted, path)
+	}
+	sort.Strings(sorted)
+
+	var b strings.Builder
+	for _, path := range sorted {
+		aName, bName := "a/"+path, "b/"+path
+		a, err := os.ReadFile(filepath.Join(source, filepath.FromSlash(path)))
+		if err != nil {
+			aName = "/dev/null"
+		}
+		c, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(path)))
+		if err != nil {
+			bName = "/dev/null"
+		}
+		switch {
+		case bytes.Equal(a, c) && aName != "/dev/null" && bName != "/dev/null":
+		case bytes.IndexByte(a, 0) >= 0 || bytes.IndexByte(c, 0) >= 0:
+			fmt.Fprintf(&b, "Binary files %s and %s differ\n", aName, bName)
+		default:
+			b.WriteString(unifiedDiff(aName, bName, string(a), string(c), 3))
+		}
+	}
+	return b.String(), nil
+}
+
+// runServe handles "wex serve", which runs sessions for other wex
+// instances until it is stopped
+func runServe(engine *Engine, args []string, credentials map[string]string, w io.Writer) error {
+	serveFlags := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := serveFlags.String("listen", defaultServeAddress, "Address to listen on")
+	usersFile := serveFlags.String("users", "", "File of those who may run sessions, a name, a token and optionally a workspace on each line, each seeing only their own sessions (default anyone with AGENT_TOKEN)")
+	reviewersFile := serveFlags.String("reviewers", "", "File of those who may approve what sessions ask to do, a name and a token on each line (default nobody, so nothing is approved)")
+	reviewTimeout := serveFlags.Duration("review-timeout", 0, "Deny a request for approval nobody has decided in this time (default wait)")
+	noCommands := serveFlags.Bool("no-commands", false, "Give sessions no tools that run commands, which aren't confined to their workspace (default true with --users, so one user's commands can't reach another's work)")
+	chatUsersFile := serveFlags.String("chat-users", "", "File of those who may ask in Slack or Discord, a chat user ID such as slack:U0123ABC and their name in wex on each line; needed with SLACK_BOT_TOKEN or DISCORD_BOT_TOKEN")
+	serveFlags.Usage = func() {
+		fmt.Fprintf(serveFlags.Output(), "Usage: wex [flags] serve [--listen ADDRESS] [--users FILE] [--reviewers FILE] [--review-timeout DURATION] [--no-commands] [--chat-users FILE]\n")
+		serveFlags.PrintDefaults()
+	}
+	serveFlags.Parse(args)
+	if *usersFile != "" {
+		commandsSet := false
+		serveFlags.Visit(func(f *flag.Flag) { commandsSet = commandsSet || f.Name == "no-commands" })
+		if !commandsSet {
+			*noCommands = true
+		}
+	}
+
+	host, _, err := net.SplitHostPort(*listen)
+	if err != nil {
+		return fmt.Errorf("invalid --listen %q: %v", *listen, err)
+	}
+	if ip := net.ParseIP(host); engine.agentToken == "" && *usersFile == "" && host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("set AGENT_TOKEN or --users to serve on %s, so only those with a token can run sessions", *listen)
+	}
+	var users []serveUser
+	taken := []string{engine.agentToken}
+	if *usersFile != "" {
+		if users, err = loadServeUsers(*usersFile, engine.agentToken); err != nil {
+			return err
+		}
+		for _, user := range users {
+			taken = append(taken, user.token)
+		}
+	}
+	var reviewers []reviewer
+	if *reviewersFile != "" {
+		if reviewers, err = loadReviewers(*reviewersFile, taken...); err != nil {
+			return err
+		}
+	}
+
+	// The chat services' secrets were taken out of the environment with
+	// the others at the start
+	slack := &slackService{token: credentials["SLACK_BOT_TOKEN"], secret: credentials["SLACK_SIGNING_SECRET"]}
+	discord := &discordService{token: credentials["DISCORD_BOT_TOKEN"]}
+	discordKey := credentials["DISCORD_PUBLIC_KEY"]
+	if slack.token == "" {
+		slack = nil
+	} else if slack.secret == "" {
+		return fmt.Errorf("set SLACK_SIGNING_SECRET with SLACK_BOT_TOKEN, so requests from Slack can be checked")
+	}
+	if discord.token == "" {
+		discord = nil
+	} else {
+		key, err := hex.DecodeString(discordKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return fmt.Errorf("set DISCORD_PUBLIC_KEY to the application's public key with DISCORD_BOT_TOKEN, so interactions from Discord can be checked")
+		}
+		discord.key = key
+	}
+	var chatUsers map[string]string
+	switch {
+	case *chatUsersFile != "" && slack == nil && discord == nil:
+		return fmt.Errorf("set SLACK_BOT_TOKEN or DISCORD_BOT_TOKEN to take requests from chat")
+	case *chatUsersFile == "" && (slack != nil || discord != nil):
+		return fmt.Errorf("give --chat-users, so only those named can run sessions from chat")
+	case *chatUsersFile != "":
+		if chatUsers, err = loadChatUsers(*chatUsersFile); err != nil {
+			return err
+		}
+		names := make(map[string]bool)
+		for _, user := range users {
+			names[user.name] = true
+		}
+		for id, name := range chatUsers {
+			if len(users) > 0 && !names[name] {
+				return fmt.Errorf("%s: %s, for %s, is not one of the --users", *chatUsersFile, name, id)
+			}
+		}
+	}
+
+	engine.noCommands = engine.noCommands || *noCommands
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	agents := newAgentServer(ctx, engine, engine.agentToken, reviewers)
+	agents.users = users
+	if agents.reviews != nil {
+		agents.reviews.Timeout = *reviewTimeout
+	}
+	if chatUsers != nil {
+		agents.chat = newChatBot(agents, chatUsers)
+		agents.chat.slack, agents.chat.discord = slack, discord
+	}
+	go agents.runScheduled(ctx, filepath.Join(engine.workspace, scheduleFile))
+	server := &http.Server{Addr: *listen, Handler: agents.Handler()}
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+	fmt.Fprintf(w, "Serving agent sessions on http://%s\n", *listen)
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// The tools, for the session farming work out
+
+func agentTools(peers []agentPeer) []Tool {
+	var names []string
+	for _, p := range peers {
+		names = append(names, p.name)
+	}
+	message := map[string]interface{}{
+		"type":        "string",
+		"description": "What the agent is to do, with everything it needs to know; it has none of this conversation",
+	}
+	session := map[string]interface{}{
+		"type":        "string",
+		"description": "The session, as start_agent returned it, e.g. gpu1/s1",
+	}
+	return []Tool{
+		{
+			Type: "function",
+			Function: Function{
+				Name:        "start_agent",
+				Description: "Start an agent on another wex server working on a task, returning its session at once; start several to work in parallel, then collect each reply with wait_agent",
+				Parameters: map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"peer": map[string]interface{}{
+							"type":        "string",
+							"enum":        names,
+							"description": "Server to start the agent on",
+						},
+						"message": message,
+					},
+					"required": []string{"peer", "message"},
+				},
+			},
+		},
+		{
+			Type: "function",
+			Function: Function{
+				Name:        "message_agent",
+				Description: "Send another message to an agent that has replied, carrying on its conversation, e.g. to ask for changes; collect the reply with wait_agent",
+				Parameters: map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"session": session,
+						"message": message,
+					},
+					"required": []string{"session", "message"},
+				},
+			},
+		},
+		{
+			Type: "function",
+			Function: Function{
+				Name:        "wait_agent",
+				Description: "Wait for an agent to finish with its last message, and return its reply",
+				Parameters: map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"session": session,
+						"timeout": map[string]interface{}{
+							"type":        "integer",
+							"description": "Seconds to wait before giving up for now (default 600)",
+						},
+					},
+					"required": []string{"session"},
+				},
+			},
+		},
+	}
+}
+
+// agentRequest sends a request to a peer, which may be asked to wait for
+// up to wait, and decodes the session status it answers with
+func (e *Engine) agentRequest(method, url string, body interface{}, wait time.Duration) (*agentStatus, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(e.requestContext(), method, url, reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if e.agentToken != "" {
+		req.Header.Set("Authorization", "Bearer "+e.agentToken)
+	}
+	// Not the model server's client, which may carry its credentials
+	client := &http.Client{Timeout: agentRequestTimeout + wait}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach the agent: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		data, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("agent server answered %d: %s", resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	var status agentStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, fmt.Errorf("failed to decode the agent's status: %v", err)
+	}
+	return &status, nil
+}
+
+// requestContext is the context of the request being carried out
+func (e *Engine) requestContext() context.Context {
+	if e.runCtx == nil {
+		return context.Background()
+	}
+	return e.runCtx
+}
+
+// agentSession finds the peer and ID of a session named as peer/ID
+func (e *Engine) agentSession(session string) (*agentPeer, string, error) {
+	name, id, ok := strings.Cut(session, "/")
+	if ok && id != "" {
+		for i := range e.agentPeers {
+			if e.agentPeers[i].name == name {
+				return &e.agentPeers[i], id, nil
+			}
+		}
+	}
+	return nil, "", fmt.Errorf("unknown session %q: expected a session start_agent returned, such as %s/s1", session, e.agentPeers[0].name)
+}
+
+func (e *Engine) startAgent(args json.RawMessage) (string, error) {
+	var params struct {
+		Peer    string `json:"peer"`
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return "", fmt.Errorf("invalid arguments: %v", err)
+	}
+	for _, p := range e.agentPeers {
+		if p.name == params.Peer {
+			status, err := e.agentRequest("POST", p.url+"/sessions", map[string]string{"message": params.Message}, 0)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("Started session %s/%s; collect its reply with wait_agent", p.name, status.ID), nil
+		}
+	}
+	return "", fmt.Errorf("unknown peer %q", params.Peer)
+}
+
+func (e *Engine) messageAgent(args json.RawMessage) (string, error) {
+	var params struct {
+		Session string `json:"session"`
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return "", fmt.Errorf("invalid arguments: %v", err)
+	}
+	peer, id, err := e.agentSession(params.Session)
+	if err != nil {
+		return "", err
+	}
+	if _, err := e.agentRequest("POST", peer.url+"/sessions/"+url.PathEscape(id)+"/messages", map[string]string{"message": params.Message}, 0); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Sent the message to %s; collect its reply with wait_agent", params.Session), nil
+}
+
+func (e *Engine) waitAgent(args json.RawMessage) (string, error) {
+	var params struct {
+		Session string `json:"session"`
+		Timeout int    `json:"timeout"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return "", fmt.Errorf("invalid arguments: %v", err)
+	}
+	peer, id, err := e.agentSession(params.Session)
+	if err != nil {
+		return "", err
+	}
+	if params.Timeout <= 0 {
+		params.Timeout = 600
+	}
+	wait := min(time.Duration(params.Timeout)*time.Second, maxAgentWait)
+	status, err := e.agentRequest("GET", fmt.Sprintf("%s/sessions/%s?wait=%d", peer.url, url.PathEscape(id), params.Timeout), nil, wait)
+	if err != nil {
+		return "", err
+	}
+	switch status.Status {
+	case agentRunning:
+		return fmt.Sprintf("%s is still working after %d seconds; wait again, or do something else first", params.Session, params.Timeout), nil
+	case agentFailed:
+		return "", fmt.Errorf("%s failed: %s", params.Session, status.Error)
+	}
+	if status.Question != "" {
+		question := status.Question
+		if len(status.Choices) > 0 {
+			question += " (" + strings.Join(status.Choices, ", ") + ")"
+		}
+		return fmt.Sprintf("%s is paused, asking: %s\nAnswer with message_agent, or with ask_user if only the user knows", params.Session, question), nil
+	}
+	return fmt.Sprintf("%s replied, after %s:\n%s", params.Session, plural(status.Turns, "turn"), status.Reply), nil
+}
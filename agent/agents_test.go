@@ -0,0 +1,392 @@
+package agent
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseAgentPeers(t *testing.T) {
+	peers, err := parseAgentPeers(" gpu1=http://10.0.0.5:8765/ , gpu2=https://worker.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 2 || peers[0] != (agentPeer{"gpu1", "http://10.0.0.5:8765"}) || peers[1].url != "https://worker.example.com" {
+		t.Errorf("peers %+v", peers)
+	}
+	for s, want := range map[string]string{
+		"gpu1":                  "expected name=URL",
+		"a/b=http://x":          "expected name=URL",
+		"gpu1=10.0.0.5:8765":    "invalid URL for peer gpu1",
+		"a=http://x,a=http://y": "peer a is named twice",
+	} {
+		if _, err := parseAgentPeers(s); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q gives %v, want %q", s, err, want)
+		}
+	}
+}
+
+func TestAgentMessaging(t *testing.T) {
+	worker, workerProvider, _ := newTestEngine(t, []ChatResponse{
+		reply("", call("write_file", `{"path": "page.go", "content": "package page\n"}`)),
+		reply("Wrote page.go"),
+		reply("Renamed nothing; page.go was already right"),
+	})
+	agents := newAgentServer(t.Context(), worker, "secret", nil)
+	srv := httptest.NewServer(agents.Handler())
+	t.Cleanup(srv.Close)
+
+	e, provider, _ := newTestEngine(t, []ChatResponse{
+		reply("", call("start_agent", `{"peer": "w", "message": "Write page.go"}`)),
+		reply("", call("wait_agent", `{"session": "w/s1"}`)),
+		reply("", call("message_agent", `{"session": "w/s1", "message": "Check the package name"}`)),
+		reply("", call("wait_agent", `{"session": "w/s1", "timeout": 60}`), call("wait_agent", `{"session": "w/s9"}`)),
+		reply("The worker wrote page.go"),
+	}, WithAgentPeers(map[string]string{"w": srv.URL}, "secret"))
+
+	// The model server's credentials aren't sent to peers
+	client, err := newHTTPClient(ClientConfig{BearerToken: "model-key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.client = client
+	result, err := e.Run(t.Context(), "Have a worker write page.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Reply != "The worker wrote page.go" {
+		t.Errorf("reply %q", result.Reply)
+	}
+
+	results := toolResults(provider.lastMessages(t, 5))
+	var contents []string
+	for _, r := range results {
+		contents = append(contents, r.Content)
+	}
+	want := []string{
+		"Started session w/s1; collect its reply with wait_agent",
+		"w/s1 replied, after 2 turns:\nWrote page.go",
+		"Sent the message to w/s1; collect its reply with wait_agent",
+		"w/s1 replied, after 1 turn:\nRenamed nothing; page.go was already right",
+		"Error: agent server answered 404: no such session",
+	}
+	if strings.Join(contents, "\n---\n") != strings.Join(want, "\n---\n") {
+		t.Errorf("tool results:\n%s", strings.Join(contents, "\n---\n"))
+	}
+	session := agents.sessions["s1"]
+	if data, err := os.ReadFile(filepath.Join(session.engine.workspace, "page.go")); err != nil || string(data) != "package page\n" {
+		t.Errorf("page.go has %q, %v", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(worker.workspace, "page.go")); err == nil {
+		t.Errorf("the session wrote to the server's own workspace")
+	}
+
+	// The second message carries on the worker's conversation
+	messages := workerProvider.lastMessages(t, 3)
+	if len(messages) != 6 || messages[1].Content != "Write page.go" || messages[5].Content != "Check the package name" {
+		t.Errorf("worker's second conversation: %+v", messages)
+	}
+
+	resp, err := http.Get(srv.URL + "/sessions/s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("without the token: %s", resp.Status)
+	}
+
+	// Finished sessions are forgotten after a while, with their workspaces
+	expiry := agentSessionExpiry
+	agentSessionExpiry = 0
+	t.Cleanup(func() { agentSessionExpiry = expiry })
+	agents.mu.Lock()
+	agents.prune()
+	agents.mu.Unlock()
+	if _, err := os.Stat(session.engine.workspace); err == nil || len(agents.sessions) != 0 {
+		t.Errorf("session still kept, with %d sessions, %v", len(agents.sessions), err)
+	}
+}
+
+func TestServedEngine(t *testing.T) {
+	base, _, _ := newTestEngine(t, nil)
+	writeTestFile(t, base, "go.mod", "module page\n")
+	base.filesystem = readOnlyFS{osFS{}}
+	base.checkModel = "checker"
+	base.quota.MaxFiles = 3
+	base.diffBudget.MaxLines = 10
+	base.maxReadBytes = 100
+	base.licenses = &licensePolicy{header: "// Copyright\n"}
+	alice := strings.Repeat("a", 32)
+	s := newAgentServer(t.Context(), base, "secret", []reviewer{{"alice", alice}})
+	e, err := s.newEngine("s1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(e.workspace) })
+	if e.checkModel != "checker" || e.quota.MaxFiles != 3 || e.diffBudget.MaxLines != 10 || e.maxReadBytes != 100 ||
+		e.licenses == base.licenses || e.licenses.header != "// Copyright\n" {
+		t.Errorf("policies not copied: %+v", e)
+	}
+
+	// The session works in a copy of the workspace of its own, confined to it
+	if e.workspace == base.workspace {
+		t.Errorf("the session shares the server's workspace")
+	}
+	if data, err := os.ReadFile(filepath.Join(e.workspace, "go.mod")); err != nil || string(data) != "module page\n" {
+		t.Errorf("go.mod in the session's workspace has %q, %v", data, err)
+	}
+	root, ok := e.files().(rootFS)
+	if !ok || root.root != e.workspace {
+		t.Fatalf("files %#v, want confined to the workspace", e.files())
+	}
+	if _, ok := root.FS.(readOnlyFS); !ok {
+		t.Errorf("files %#v, want read-only", root.FS)
+	}
+	if e.noCommands {
+		t.Errorf("commands refused, though the server allows them")
+	}
+
+	// What the session asks to have approved waits for a reviewer, who
+	// decides with their own token; the clients' token won't do
+	srv := httptest.NewServer(s.Handler())
+	t.Cleanup(srv.Close)
+	approved := make(chan bool)
+	go func() { approved <- e.approver("run make") }()
+	for len(s.reviews.Pending()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	decide := func(token string) int {
+		body := fmt.Sprintf(`{"id": %d, "approve": true}`, s.reviews.Pending()[0].ID)
+		req, _ := http.NewRequest("POST", srv.URL+"/reviews/decide", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("X-Reviewer", "alice")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := decide("secret"); status != http.StatusUnauthorized {
+		t.Errorf("the clients' token got %d", status)
+	}
+	if status := decide(alice); status != http.StatusOK {
+		t.Errorf("alice got %d", status)
+	}
+	if !<-approved {
+		t.Error("approved by alice, but denied")
+	}
+	if audit := s.reviews.Audit(); len(audit) != 1 || audit[0].Reviewer != "alice" {
+		t.Errorf("audit %+v", audit)
+	}
+
+	// Without reviewers, nothing is approved, and there is no review API
+	s = newAgentServer(t.Context(), base, "secret", nil)
+	e, err = s.newEngine("s1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(e.workspace) })
+	if e.approver("run make") {
+		t.Errorf("approved without reviewers")
+	}
+
+	// With --no-commands, as for a server with users, the sessions run none
+	base.noCommands = true
+	e, err = s.newEngine("s2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(e.workspace) })
+	if !e.noCommands {
+		t.Errorf("commands allowed, though the server refuses them")
+	}
+}
+
+func TestLoadReviewers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reviewers")
+	alice, bob := strings.Repeat("a", 32), strings.Repeat("b", 32)
+	os.WriteFile(path, []byte("# Reviewers\nalice "+alice+"\n\nbob\t"+bob+"\n"), 0600)
+	reviewers, err := loadReviewers(path, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reviewers) != 2 || reviewers[0] != (reviewer{"alice", alice}) || reviewers[1] != (reviewer{"bob", bob}) {
+		t.Errorf("reviewers %+v", reviewers)
+	}
+	for content, want := range map[string]string{
+		"alice\n":                           "expected a name and a token",
+		"alice short\n":                     "too short",
+		"alice " + alice + "\nbob " + alice: "already in use",
+		"alice " + strings.Repeat("s", 16):  "already in use",
+		"# nobody\n":                        "names no reviewers",
+	} {
+		os.WriteFile(path, []byte(content), 0600)
+		if _, err := loadReviewers(path, strings.Repeat("s", 16)); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q gave %v, want %q", content, err, want)
+		}
+	}
+}
+
+func TestServeUsers(t *testing.T) {
+	base, _, _ := newTestEngine(t, []ChatResponse{reply("Done")})
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "alice"), 0755)
+	os.WriteFile(filepath.Join(dir, "alice", "notes.txt"), []byte("alice's project\n"), 0644)
+	alice, bob := strings.Repeat("a", 32), strings.Repeat("b", 32)
+	path := filepath.Join(dir, "users")
+	os.WriteFile(path, []byte("alice "+alice+" alice\nbob "+bob+"\n"), 0600)
+	users, err := loadServeUsers(path, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 || users[0].workspace != filepath.Join(dir, "alice") || users[1].workspace != "" {
+		t.Errorf("users %+v", users)
+	}
+
+	s := newAgentServer(t.Context(), base, "secret", nil)
+	s.users = users
+	srv := httptest.NewServer(s.Handler())
+	t.Cleanup(srv.Close)
+	send := func(method, path, token, body string) int {
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := send("POST", "/sessions", "secret", `{"message": "hi"}`); status != http.StatusUnauthorized {
+		t.Errorf("AGENT_TOKEN got %d with users", status)
+	}
+	if status := send("POST", "/sessions", alice, `{"message": "Read notes.txt"}`); status != http.StatusAccepted {
+		t.Fatalf("alice got %d", status)
+	}
+	session := s.sessions["s1"]
+	t.Cleanup(func() { os.RemoveAll(session.engine.workspace) })
+	if data, err := os.ReadFile(filepath.Join(session.engine.workspace, "notes.txt")); err != nil || string(data) != "alice's project\n" {
+		t.Errorf("alice's session has notes.txt %q, %v", data, err)
+	}
+	if session.owner != "alice" || session.engine.user != "alice" {
+		t.Errorf("session owned by %q, with user %q", session.owner, session.engine.user)
+	}
+
+	// Only alice sees her session
+	if status := send("GET", "/sessions/s1?wait=5", alice, ""); status != http.StatusOK {
+		t.Errorf("alice got %d for her session", status)
+	}
+	if status := send("GET", "/sessions/s1", bob, ""); status != http.StatusNotFound {
+		t.Errorf("bob got %d for alice's session", status)
+	}
+	if status := send("POST", "/sessions/s1/messages", bob, `{"message": "hi"}`); status != http.StatusNotFound {
+		t.Errorf("bob got %d messaging alice's session", status)
+	}
+
+	for content, want := range map[string]string{
+		"alice " + alice + " missing\n":               "is not a directory",
+		"alice " + alice + "\nalice " + bob + "\n":    "alice is named twice",
+		"alice " + alice + " alice extra\n":           "expected a name and a token",
+		"alice " + strings.Repeat("s", 16) + " alice": "already in use",
+	} {
+		os.WriteFile(path, []byte(content), 0600)
+		if _, err := loadServeUsers(path, strings.Repeat("s", 16)); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q gave %v, want %q", content, err, want)
+		}
+	}
+}
+
+func TestServeBrowserAPI(t *testing.T) {
+	base, provider, _ := newTestEngine(t, []ChatResponse{
+		reply("", call("write_file", `{"path": "go.mod", "content": "module site\n"}`), call("write_file", `{"path": "page.go", "content": "package page\n"}`)),
+		reply("Renamed the module"),
+	})
+	writeTestFile(t, base, "go.mod", "module page\n")
+	s := newAgentServer(t.Context(), base, "secret", nil)
+	srv := httptest.NewServer(s.Handler())
+	t.Cleanup(srv.Close)
+	get := func(path, token string) (int, string) {
+		req, _ := http.NewRequest("GET", srv.URL+path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	// The page needs no token, but what it does with the API does
+	if status, body := get("/", ""); status != http.StatusOK || !strings.Contains(body, "<title>wex</title>") {
+		t.Errorf("GET / gave %d", status)
+	}
+	if status, _ := get("/sessions", ""); status != http.StatusUnauthorized {
+		t.Errorf("GET /sessions without the token gave %d", status)
+	}
+
+	post := func(body string) int {
+		req, _ := http.NewRequest("POST", srv.URL+"/sessions", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := post(`{"message": "Rename the module", "images": ["aGVsbG8="]}`); status != http.StatusBadRequest {
+		t.Errorf("POST /sessions with text for an image gave %d", status)
+	}
+	image := base64.StdEncoding.EncodeToString(testPNG(t, 2, 2))
+	if status := post(`{"message": "Rename the module", "images": ["` + image + `"]}`); status != http.StatusAccepted {
+		t.Fatalf("POST /sessions gave %d", status)
+	}
+	t.Cleanup(func() { os.RemoveAll(s.sessions["s1"].engine.workspace) })
+	if status, body := get("/sessions/s1?wait=5", "secret"); status != http.StatusOK || !strings.Contains(body, `"status":"idle"`) {
+		t.Fatalf("GET /sessions/s1 gave %d: %s", status, body)
+	}
+	if messages := provider.requests[0].Messages; len(messages[1].Images) != 1 || messages[1].Images[0] != image {
+		t.Errorf("the image wasn't sent with the message: %+v", messages[1])
+	}
+	if status, body := get("/sessions", "secret"); status != http.StatusOK || !strings.HasPrefix(body, `[{"id":"s1","status":"idle","reply":"Renamed the module"`) {
+		t.Errorf("GET /sessions gave %d: %s", status, body)
+	}
+
+	var events struct {
+		Events []Event `json:"events"`
+		Next   int     `json:"next"`
+	}
+	_, body := get("/sessions/s1/events", "secret")
+	if err := json.Unmarshal([]byte(body), &events); err != nil {
+		t.Fatal(err)
+	}
+	if len(events.Events) == 0 || events.Next != len(events.Events) || events.Events[0].Agent != "s1" {
+		t.Fatalf("events %s", body)
+	}
+	last := events.Events[len(events.Events)-1]
+	_, body = get(fmt.Sprintf("/sessions/s1/events?after=%d", events.Next-1), "secret")
+	if err := json.Unmarshal([]byte(body), &events); err != nil {
+		t.Fatal(err)
+	}
+	if len(events.Events) != 1 || events.Events[0].Type != last.Type {
+		t.Errorf("events after all but the last: %s", body)
+	}
+
+	want := "--- a/go.mod\n+++ b/go.mod\n@@ -1 +1 @@\n-module page\n+module site\n--- /dev/null\n+++ b/page.go\n@@ -0,0 +1 @@\n+package page\n"
+	if status, body := get("/sessions/s1/diff", "secret"); status != http.StatusOK || body != want {
+		t.Errorf("GET /sessions/s1/diff gave %d:\n%s", status, body)
+	}
+}
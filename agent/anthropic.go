@@ -0,0 +1,261 @@
+package agent
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Anthropic's Messages API differs from /api/chat in where things go: the
+// system prompt is a field of its own, tool calls and their results are
+// content blocks, tool_use in an assistant message and tool_result in the
+// next user message, matched by ID, and roles must alternate. Requests
+// are translated on the way out and replies on the way back, so the rest
+// of wex sees the same messages whichever server it talks to.
+
+const (
+	defaultAnthropicURL   = "https://api.anthropic.com"
+	defaultAnthropicModel = "claude-sonnet-4-5"
+	anthropicVersion      = "2023-06-01"
+
+	// defaultAnthropicMaxTokens is the reply length limit, which the API
+	// requires, unless num_predict says otherwise
+	defaultAnthropicMaxTokens = 8192
+)
+
+type anthropicRequest struct {
+	Model         string             `json:"model"`
+	System        string             `json:"system,omitempty"`
+	Messages      []anthropicMessage `json:"messages"`
+	Tools         []anthropicTool    `json:"tools,omitempty"`
+	MaxTokens     int                `json:"max_tokens"`
+	Temperature   *float64           `json:"temperature,omitempty"`
+	TopP          *float64           `json:"top_p,omitempty"`
+	TopK          *int               `json:"top_k,omitempty"`
+	StopSequences []string           `json:"stop_sequences,omitempty"`
+}
+
+type anthropicMessage struct {
+	Role    string           `json:"role"`
+	Content []anthropicBlock `json:"content"`
+}
+
+type anthropicBlock struct {
+	Type string `json:"type"`
+
+	// text
+	Text string `json:"text,omitempty"`
+
+	// tool_use
+	ID    string          `json:"id,omitempty"`
+	Name  string          `json:"name,omitempty"`
+	Input json.RawMessage `json:"input,omitempty"`
+
+	// tool_result
+	ToolUseID string `json:"tool_use_id,omitempty"`
+	Content   string `json:"content,omitempty"`
+	IsError   bool   `json:"is_error,omitempty"`
+
+	// image
+	Source *anthropicImage `json:"source,omitempty"`
+}
+
+type anthropicImage struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type"`
+	Data      string `json:"data"`
+}
+
+type anthropicTool struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description"`
+	InputSchema map[string]interface{} `json:"input_schema"`
+}
+
+type anthropicResponse struct {
+	Content    []anthropicBlock `json:"content"`
+	StopReason string           `json:"stop_reason"`
+}
+
+// anthropicMessages converts a conversation to the Messages API's form,
+// returning the system prompt separately
+func anthropicMessages(messages []Message) (string, []anthropicMessage) {
+	var system []string
+	var converted []anthropicMessage
+	add := func(role string, blocks ...anthropicBlock) {
+		if len(blocks) == 0 {
+			return
+		}
+		// Roles must alternate, so consecutive messages from one side,
+		// such as several tool results, are merged
+		if n := len(converted); n > 0 && converted[n-1].Role == role {
+			converted[n-1].Content = append(converted[n-1].Content, blocks...)
+			return
+		}
+		converted = append(converted, anthropicMessage{Role: role, Content: blocks})
+	}
+	text := func(s string) []anthropicBlock {
+		if strings.TrimSpace(s) == "" {
+			return nil
+		}
+		return []anthropicBlock{{Type: "text", Text: s}}
+	}
+
+	for _, m := range messages {
+		switch m.Role {
+		case "system":
+			system = append(system, m.Content)
+		case "assistant":
+			blocks := text(m.Content)
+			for _, call := range m.ToolCalls {
+				input := call.Function.Arguments
+				var args map[string]interface{}
+				if json.Unmarshal(input, &args) != nil || args == nil {
+					input = json.RawMessage("{}")
+				}
+				blocks = append(blocks, anthropicBlock{Type: "tool_use", ID: call.ID, Name: call.Function.Name, Input: input})
+			}
+			add("assistant", blocks...)
+		case "tool":
+			content := m.Content
+			if content == "" {
+				content = "(no output)"
+			}
+			add("user", anthropicBlock{Type: "tool_result", ToolUseID: m.ToolCallID, Content: content, IsError: strings.HasPrefix(content, "Error: ")})
+		default:
+			var blocks []anthropicBlock
+			for _, image := range m.Images {
+				mediaType := "image/png"
+				if data, err := base64.StdEncoding.DecodeString(image); err == nil {
+					mediaType = imageMediaType(data)
+				}
+				blocks = append(blocks, anthropicBlock{Type: "image", Source: &anthropicImage{Type: "base64", MediaType: mediaType, Data: image}})
+			}
+			add("user", append(blocks, text(m.Content)...)...)
+		}
+	}
+	return strings.Join(system, "\n\n"), converted
+}
+
+// anthropicRequestBody builds a Messages API request from a chat request,
+// with the sampling options the API has
+func anthropicRequestBody(reqBody ChatRequest) anthropicRequest {
+	system, messages := anthropicMessages(reqBody.Messages)
+	req := anthropicRequest{
+		Model:     reqBody.Model,
+		System:    system,
+		Messages:  messages,
+		MaxTokens: defaultAnthropicMaxTokens,
+	}
+	for _, tool := range reqBody.Tools {
+		schema := tool.Function.Parameters
+		if schema == nil {
+			schema = map[string]interface{}{"type": "object", "properties": map[string]interface{}{}}
+		}
+		req.Tools = append(req.Tools, anthropicTool{Name: tool.Function.Name, Description: tool.Function.Description, InputSchema: schema})
+	}
+	number := func(v interface{}) (float64, bool) {
+		switch n := v.(type) {
+		case float64:
+			return n, true
+		case int:
+			return float64(n), true
+		}
+		return 0, false
+	}
+	for k, v := range reqBody.Options {
+		n, isNumber := number(v)
+		switch k {
+		case "temperature":
+			if isNumber {
+				// The API allows 0 to 1, where Ollama models allow up to 2
+				n = min(n, 1)
+				req.Temperature = &n
+			}
+		case "top_p":
+			if isNumber {
+				req.TopP = &n
+			}
+		case "top_k":
+			if isNumber {
+				topK := int(n)
+				req.TopK = &topK
+			}
+		case "num_predict":
+			if isNumber && n > 0 {
+				req.MaxTokens = int(n)
+			}
+		case "stop":
+			if stop, ok := v.([]string); ok {
+				req.StopSequences = stop
+			}
+		}
+	}
+	return req
+}
+
+// anthropicProvider talks to Anthropic's Messages API
+type anthropicProvider struct {
+	client *http.Client
+	url    string
+	apiKey string
+	debugf func(format string, args ...interface{})
+}
+
+func (p *anthropicProvider) headers() map[string]string {
+	return map[string]string{"x-api-key": p.apiKey, "anthropic-version": anthropicVersion}
+}
+
+// SendChat sends a chat request to the Messages API and converts the reply
+func (p *anthropicProvider) SendChat(ctx context.Context, reqBody ChatRequest) (*ChatResponse, error) {
+	jsonBody, err := json.Marshal(anthropicRequestBody(reqBody))
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	p.debugf("Sending request to Anthropic:\n%s", string(jsonBody))
+
+	var reply anthropicResponse
+	if err := postJSON(ctx, p.client, p.url+"/v1/messages", p.headers(), jsonBody, &reply); err != nil {
+		return nil, err
+	}
+
+	var chatResp ChatResponse
+	chatResp.Message.Role = "assistant"
+	var text []string
+	for _, block := range reply.Content {
+		switch block.Type {
+		case "text":
+			text = append(text, block.Text)
+		case "tool_use":
+			var call ToolCall
+			call.ID = block.ID
+			call.Type = "function"
+			call.Function.Name = block.Name
+			call.Function.Arguments = block.Input
+			chatResp.Message.ToolCalls = append(chatResp.Message.ToolCalls, call)
+		}
+	}
+	chatResp.Message.Content = strings.Join(text, "\n\n")
+	chatResp.Done = reply.StopReason != "max_tokens"
+	return &chatResp, nil
+}
+
+func (p *anthropicProvider) ListModels(ctx context.Context) ([]Model, error) {
+	var models struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := getModels(ctx, p.client, p.url+"/v1/models", p.headers(), &models); err != nil {
+		return nil, err
+	}
+	var list []Model
+	for _, m := range models.Data {
+		list = append(list, Model{Name: m.ID})
+	}
+	return list, nil
+}
@@ -0,0 +1,102 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAnthropicMessages(t *testing.T) {
+	var write, read ToolCall
+	write.ID, write.Function.Name, write.Function.Arguments = "toolu_1", "write_file", json.RawMessage(`{"path": "a.txt", "content": "x"}`)
+	read.ID, read.Function.Name, read.Function.Arguments = "toolu_2", "read_file", json.RawMessage(`not json`)
+	system, messages := anthropicMessages([]Message{
+		{Role: "system", Content: "Be brief."},
+		{Role: "user", Content: "Copy it", Images: []string{"iVBORw0KGgoAAAANSUhEUg=="}},
+		{Role: "assistant", Content: "", ToolCalls: []ToolCall{write, read}},
+		{Role: "tool", Content: "Wrote a.txt", ToolCallID: "toolu_1"},
+		{Role: "tool", Content: "Error: no such file", ToolCallID: "toolu_2"},
+		{Role: "user", Content: "Call final_answer"},
+		{Role: "assistant", Content: "Done."},
+	})
+	if system != "Be brief." {
+		t.Errorf("system %q", system)
+	}
+	data, _ := json.Marshal(messages)
+	want := `[{"role":"user","content":[{"type":"image","source":{"type":"base64","media_type":"image/png","data":"iVBORw0KGgoAAAANSUhEUg=="}},{"type":"text","text":"Copy it"}]},` +
+		`{"role":"assistant","content":[{"type":"tool_use","id":"toolu_1","name":"write_file","input":{"path":"a.txt","content":"x"}},{"type":"tool_use","id":"toolu_2","name":"read_file","input":{}}]},` +
+		`{"role":"user","content":[{"type":"tool_result","tool_use_id":"toolu_1","content":"Wrote a.txt"},{"type":"tool_result","tool_use_id":"toolu_2","content":"Error: no such file","is_error":true},{"type":"text","text":"Call final_answer"}]},` +
+		`{"role":"assistant","content":[{"type":"text","text":"Done."}]}]`
+	if string(data) != want {
+		t.Errorf("messages:\n%s\nwant:\n%s", data, want)
+	}
+
+	req := anthropicRequestBody(ChatRequest{Model: "claude-test", Options: map[string]interface{}{"temperature": 1.5, "num_predict": 100, "seed": 1}})
+	if *req.Temperature != 1 || req.MaxTokens != 100 || req.TopP != nil {
+		t.Errorf("request %+v", req)
+	}
+}
+
+func TestAnthropicBackend(t *testing.T) {
+	var requests []anthropicRequest
+	replies := []string{
+		`{"content": [{"type": "text", "text": "Writing it."}, {"type": "tool_use", "id": "toolu_01", "name": "write_file", "input": {"path": "a.txt", "content": "hello\n"}}], "stop_reason": "tool_use"}`,
+		`{"content": [{"type": "text", "text": "Wrote the file."}], "stop_reason": "end_turn"}`,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/messages" || r.Header.Get("x-api-key") != "test-key" || r.Header.Get("anthropic-version") == "" {
+			http.Error(w, "bad request "+r.URL.Path, http.StatusBadRequest)
+			return
+		}
+		var req anthropicRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		requests = append(requests, req)
+		if len(replies) == 0 {
+			http.Error(w, "no more replies", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(replies[0]))
+		replies = replies[1:]
+	}))
+	t.Cleanup(srv.Close)
+
+	e, err := New(
+		WithWorkspace(t.TempDir()),
+		WithProvider(srv.Client(), srv.URL, "claude-test"),
+		WithAnthropic("test-key"),
+		WithSystemPrompt("You are a test."),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := e.Run(context.Background(), "Write a file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Reply != "Wrote the file." || result.Turns != 2 {
+		t.Errorf("result %+v", result)
+	}
+	if data, err := os.ReadFile(filepath.Join(e.workspace, "a.txt")); err != nil || string(data) != "hello\n" {
+		t.Errorf("a.txt has %q, %v", data, err)
+	}
+
+	if len(requests) != 2 {
+		t.Fatalf("%d requests", len(requests))
+	}
+	first := requests[0]
+	if first.Model != "claude-test" || !strings.HasPrefix(first.System, "You are a test.") || len(first.Messages) != 1 || len(first.Tools) == 0 || first.Tools[0].InputSchema["type"] != "object" {
+		t.Errorf("first request %+v", first)
+	}
+	second := requests[1].Messages
+	if len(second) != 3 || second[1].Content[1].ID != "toolu_01" || second[2].Content[0].ToolUseID != "toolu_01" || !strings.Contains(second[2].Content[0].Content, "a.txt") {
+		t.Errorf("second request %+v", second)
+	}
+}
@@ -0,0 +1,99 @@
+package agent_test
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"testing"
+
+	"wex/agent"
+)
+
+// scriptedProvider gives its replies in turn, recording the requests
+type scriptedProvider struct {
+	replies  []agent.ChatResponse
+	requests []agent.ChatRequest
+}
+
+func (p *scriptedProvider) SendChat(ctx context.Context, req agent.ChatRequest) (*agent.ChatResponse, error) {
+	p.requests = append(p.requests, req)
+	if len(p.requests) > len(p.replies) {
+		return nil, fmt.Errorf("no reply left for request %d", len(p.requests))
+	}
+	return &p.replies[len(p.requests)-1], nil
+}
+
+// scripted is a reply from the assistant
+func scripted(content string, calls ...agent.ToolCall) agent.ChatResponse {
+	var resp agent.ChatResponse
+	resp.Message.Role = "assistant"
+	resp.Message.Content = content
+	resp.Message.ToolCalls = calls
+	resp.Done = true
+	return resp
+}
+
+func (p *scriptedProvider) ListModels(ctx context.Context) ([]agent.Model, error) {
+	return []agent.Model{{Name: "scripted"}}, nil
+}
+
+func TestRunAnswersQuestion(t *testing.T) {
+	var ask agent.ToolCall
+	ask.Function.Name = "ask_user"
+	ask.Function.Arguments = []byte(`{"question": "Test or live account?"}`)
+	provider := &scriptedProvider{replies: []agent.ChatResponse{
+		scripted("", ask),
+		scripted("Configured the test account"),
+	}}
+	engine, err := agent.New(agent.WithWorkspace(t.TempDir()), agent.WithBackend(provider, "scripted"),
+		agent.WithSystemPrompt("You are a coding assistant."), agent.WithEvents(func(agent.Event) {}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := engine.Run(t.Context(), "Set up the webhook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Question != "Test or live account?" {
+		t.Fatalf("result %+v", result)
+	}
+
+	// The answer carries on the paused conversation
+	result, err = engine.Run(t.Context(), "The test account")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Question != "" || result.Reply != "Configured the test account" {
+		t.Errorf("result %+v", result)
+	}
+	messages := provider.requests[1].Messages
+	if len(messages) < 4 || messages[1].Content != "Set up the webhook" || messages[len(messages)-1].Content != "The test account" {
+		t.Errorf("conversation after the answer: %+v", messages)
+	}
+}
+
+func TestWithLogger(t *testing.T) {
+	provider := &scriptedProvider{replies: []agent.ChatResponse{scripted("All done.\nNothing was changed.")}}
+	var out strings.Builder
+	logger := log.New(&out, "wex: ", log.Lmsgprefix)
+	engine, err := agent.New(agent.WithWorkspace(t.TempDir()), agent.WithBackend(provider, "scripted"),
+		agent.WithSystemPrompt("You are a coding assistant."), agent.WithLogger(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := engine.Run(t.Context(), "Tidy up"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every line goes through the logger, with its prefix
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "wex: ") {
+			t.Errorf("line without the prefix: %q", line)
+		}
+	}
+	if !strings.Contains(out.String(), "wex: Assistant: All done.\nwex: Nothing was changed.\n") {
+		t.Errorf("log:\n%s", out.String())
+	}
+}
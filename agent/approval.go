@@ -0,0 +1,230 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Actions a command policy can take for a class of command
+const (
+	policyAllow = "allow"
+	policyAsk   = "ask"
+	policyDeny  = "deny"
+)
+
+// parseCommandPolicy parses class=action pairs separated by commas, e.g.
+// "network=ask,destructive=deny"; classes not mentioned are allowed
+func parseCommandPolicy(s string) (map[commandClass]string, error) {
+	policy := make(map[commandClass]string)
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		name, action, ok := strings.Cut(field, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid entry %q: expected class=action", field)
+		}
+		class, err := parseCommandClass(strings.TrimSpace(name))
+		if err != nil {
+			return nil, err
+		}
+		switch action = strings.TrimSpace(action); action {
+		case policyAllow, policyAsk, policyDeny:
+			policy[class] = action
+		default:
+			return nil, fmt.Errorf("invalid action %q for %s: must be allow, ask or deny", action, class)
+		}
+	}
+	return policy, nil
+}
+
+// checkCommandPolicy refuses network commands with --offline, applies the
+// package policy to a command that installs packages, then classifies it
+// and applies the policy for its class, asking the user for approval if
+// need be
+func (e *Engine) checkCommandPolicy(command string) error {
+	if err := e.checkOfflineCommand(command); err != nil {
+		return err
+	}
+	if err := e.checkCommandIntent(command); err != nil {
+		return err
+	}
+	if installers := commandInstallers(command); len(installers) > 0 {
+		if err := e.checkPackagePolicy(command, installers[0]); err != nil {
+			return err
+		}
+	}
+
+	class := classifyCommand(command)
+	switch e.commandPolicy[class] {
+	case policyDeny:
+		return fmt.Errorf("command refused: %s commands are not allowed", class)
+	case policyAsk:
+		if !e.askApproval(fmt.Sprintf("Run %s command: %s", class, command)) {
+			return fmt.Errorf("command refused: the user did not approve this %s command", class)
+		}
+	default:
+		if class == classDestructive && e.checkModel != "" {
+			return e.checkIntent(command)
+		}
+	}
+	if e.plan != nil {
+		return checkPlanCommand(command)
+	}
+	return nil
+}
+
+// checkPackagePolicy applies the package policy, which is separate from the
+// command classes since installing packages is the most common risky
+// operation. Installs still count as network commands for COMMAND_POLICY.
+func (e *Engine) checkPackagePolicy(command, installer string) error {
+	policy := e.packagePolicy
+	if policy == packageSandbox {
+		policy = policyAsk
+		if inContainer() {
+			policy = policyAllow
+		}
+	}
+
+	switch policy {
+	case policyDeny:
+		return fmt.Errorf("command refused: installing packages with %s is not allowed", installer)
+	case policyAsk:
+		if !e.askApproval(fmt.Sprintf("Install packages with %s: %s", installer, command)) {
+			return fmt.Errorf("command refused: the user did not approve installing packages with %s", installer)
+		}
+	}
+	return nil
+}
+
+// askApproval asks the user to approve an action. During a tool call, the
+// call is put to them with it, through approveToolCall, so they can change
+// its arguments first; the action is then refused and the call made again
+// with the changed arguments, which count as approved for everything the
+// call does.
+func (e *Engine) askApproval(action string) bool {
+	call := e.call
+	if call == nil {
+		return e.confirmAction(action)
+	}
+	if e.approvedArguments != nil {
+		return true
+	}
+	args, ok := e.approveToolCall(*call, action)
+	if ok && !bytes.Equal(args, call.Function.Arguments) {
+		e.rerunArguments = args
+		return false
+	}
+	return ok
+}
+
+// confirmAction asks the user to approve an action, or the approver if
+// there is one. Without a terminal to ask on, the answer is no.
+func (e *Engine) confirmAction(action string) bool {
+	if e.approver != nil {
+		return e.approver(action)
+	}
+	if !isTerminal(os.Stdin) {
+		e.logf("Refused without a terminal to ask for approval: %s", action)
+		return false
+	}
+	e.notify("needs_approval", action)
+	answer, err := readLine(fmt.Sprintf("%s\nAllow? [y/N] ", action))
+	if err != nil {
+		return false
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// approveToolCall asks the user to approve a tool call, saying why it
+// needs approval, and returns the arguments to call it with: at the
+// terminal, or with a call approver, the user can change them first, such
+// as to fix a path
+func (e *Engine) approveToolCall(toolCall ToolCall, why string) (json.RawMessage, bool) {
+	args := toolCall.Function.Arguments
+	if e.callApprover != nil {
+		return e.callApprover(toolCall.Function.Name, args)
+	}
+	prompt := func() string {
+		return fmt.Sprintf("%s\nCall %s: %s", why, toolCall.Function.Name, args)
+	}
+	action := prompt()
+	if e.approver != nil || !isTerminal(os.Stdin) {
+		return args, e.confirmAction(action)
+	}
+
+	e.notify("needs_approval", action)
+	for {
+		answer, err := readLine(fmt.Sprintf("%s\nAllow? [y/N, e to edit the arguments] ", action))
+		if err != nil {
+			return args, false
+		}
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "y", "yes":
+			return args, true
+		case "e", "edit":
+			edited, err := editArguments(args)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Arguments unchanged: %v\n", err)
+				continue
+			}
+			args = edited
+			action = prompt()
+		default:
+			return args, false
+		}
+	}
+}
+
+// editArguments has the user edit a tool call's arguments, in $EDITOR if
+// it is set, or else typed as a line of JSON, which must be an object
+func editArguments(args json.RawMessage) (json.RawMessage, error) {
+	var edited []byte
+	if editor := os.Getenv("EDITOR"); editor != "" {
+		var indented bytes.Buffer
+		if err := json.Indent(&indented, args, "", "  "); err != nil {
+			indented.Reset()
+			indented.Write(args)
+		}
+		f, err := os.CreateTemp("", "wex-arguments-*.json")
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(f.Name())
+		_, err = f.Write(append(indented.Bytes(), '\n'))
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		// EDITOR may have arguments of its own, such as code --wait
+		fields := strings.Fields(editor)
+		cmd := exec.Command(fields[0], append(fields[1:], f.Name())...)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+		if err := cmd.Run(); err != nil {
+			return nil, fmt.Errorf("%s failed: %v", editor, err)
+		}
+		if edited, err = os.ReadFile(f.Name()); err != nil {
+			return nil, err
+		}
+	} else {
+		line, err := readLine("Arguments as JSON > ")
+		if err != nil {
+			return nil, err
+		}
+		edited = []byte(line)
+	}
+
+	var object map[string]interface{}
+	if err := json.Unmarshal(edited, &object); err != nil {
+		return nil, fmt.Errorf("not a JSON object: %v", err)
+	}
+	var compact bytes.Buffer
+	json.Compact(&compact, edited)
+	return compact.Bytes(), nil
+}
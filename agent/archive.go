@@ -0,0 +1,628 @@
+package agent
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// maxExtractBytes caps what one extraction may write, whatever the quota,
+// as protection against archive bombs
+const maxExtractBytes = 1 << 30
+
+// archiveEntry is a file or directory in an archive
+type archiveEntry struct {
+	name string // as stored in the archive
+	mode os.FileMode
+	size int64
+	dir  bool
+	open func() (io.ReadCloser, error)
+}
+
+// archiveFormat picks zip, tar or tar.gz from a file name
+func archiveFormat(name string) (string, error) {
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		return "zip", nil
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return "tar.gz", nil
+	case strings.HasSuffix(lower, ".tar"):
+		return "tar", nil
+	}
+	return "", fmt.Errorf("unsupported archive %s: must end in .zip, .tar.gz, .tgz or .tar", name)
+}
+
+func archiveTools() []Tool {
+	return []Tool{
+		{
+			Type: "function",
+			Function: Function{
+				Name:        "extract_archive",
+				Description: "Extract a .zip, .tar.gz or .tar archive in the workspace. Refuses archives with entries that would land outside the destination, and does not overwrite files unless asked",
+				Parameters: map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"path": map[string]interface{}{
+							"type":        "string",
+							"description": "Archive path relative to workspace",
+						},
+						"destination": map[string]interface{}{
+							"type":        "string",
+							"description": "Directory to extract into (optional, default the archive's directory)",
+						},
+						"strip_components": map[string]interface{}{
+							"type":        "integer",
+							"description": "Leading path components to remove from entry names, as with tar --strip-components (optional)",
+						},
+						"overwrite": map[string]interface{}{
+							"type":        "boolean",
+							"description": "Replace files that already exist (optional, default false)",
+						},
+					},
+					"required": []string{"path"},
+				},
+			},
+		},
+		{
+			Type: "function",
+			Function: Function{
+				Name:        "create_archive",
+				Description: "Create a .zip, .tar.gz or .tar archive from files and directories in the workspace",
+				Parameters: map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"path": map[string]interface{}{
+							"type":        "string",
+							"description": "Archive path relative to workspace; the extension picks the format",
+						},
+						"sources": map[string]interface{}{
+							"type":        "array",
+							"items":       map[string]interface{}{"type": "string"},
+							"description": "Files and directories to include, relative to workspace",
+						},
+						"base": map[string]interface{}{
+							"type":        "string",
+							"description": "Directory entry names are relative to (optional, default the workspace root)",
+						},
+					},
+					"required": []string{"path", "sources"},
+				},
+			},
+		},
+	}
+}
+
+// readArchive lists the entries of an archive. Symbolic links, hard links
+// and special files are not extracted, and are returned as skipped.
+func readArchive(fsys FS, fullPath, format string) ([]archiveEntry, []string, func(), error) {
+	if format == "zip" {
+		f, err := fsys.Open(fullPath)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to open archive: %v", err)
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, nil, nil, fmt.Errorf("failed to open archive: %v", err)
+		}
+		r, err := zip.NewReader(f, info.Size())
+		if err != nil {
+			f.Close()
+			return nil, nil, nil, fmt.Errorf("failed to open archive: %v", err)
+		}
+		var entries []archiveEntry
+		var skipped []string
+		for _, f := range r.File {
+			mode := f.Mode()
+			if mode&(os.ModeSymlink|os.ModeDevice|os.ModeNamedPipe|os.ModeSocket) != 0 {
+				skipped = append(skipped, f.Name)
+				continue
+			}
+			entries = append(entries, archiveEntry{
+				name: f.Name,
+				mode: mode.Perm(),
+				size: int64(f.UncompressedSize64),
+				dir:  f.FileInfo().IsDir(),
+				open: f.Open,
+			})
+		}
+		return entries, skipped, func() { f.Close() }, nil
+	}
+
+	// A tar stream can only be read once, so list it, then read it again
+	// while extracting, matching entries up in order
+	list, err := openTar(fsys, fullPath, format)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer list.Close()
+	var entries []archiveEntry
+	var skipped []string
+	extract, err := openTar(fsys, fullPath, format)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for {
+		h, err := list.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			extract.Close()
+			return nil, nil, nil, fmt.Errorf("failed to read archive: %v", err)
+		}
+		if h.Typeflag != tar.TypeReg && h.Typeflag != tar.TypeDir {
+			if h.Typeflag != tar.TypeXGlobalHeader {
+				skipped = append(skipped, h.Name)
+			}
+			continue
+		}
+		name := h.Name
+		entries = append(entries, archiveEntry{
+			name: name,
+			mode: os.FileMode(h.Mode).Perm(),
+			size: h.Size,
+			dir:  h.Typeflag == tar.TypeDir,
+			open: func() (io.ReadCloser, error) {
+				for {
+					h, err := extract.Next()
+					if err != nil {
+						return nil, fmt.Errorf("failed to read archive: %v", err)
+					}
+					if h.Name == name && h.Typeflag == tar.TypeReg {
+						return io.NopCloser(extract), nil
+					}
+				}
+			},
+		})
+	}
+	return entries, skipped, func() { extract.Close() }, nil
+}
+
+type tarFile struct {
+	*tar.Reader
+	closers []io.Closer
+}
+
+func (t *tarFile) Close() error {
+	for i := len(t.closers) - 1; i >= 0; i-- {
+		t.closers[i].Close()
+	}
+	return nil
+}
+
+func openTar(fsys FS, fullPath, format string) (*tarFile, error) {
+	f, err := fsys.Open(fullPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive: %v", err)
+	}
+	t := &tarFile{closers: []io.Closer{f}}
+	var r io.Reader = f
+	if format == "tar.gz" {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to open archive: %v", err)
+		}
+		t.closers = append(t.closers, gz)
+		r = gz
+	}
+	t.Reader = tar.NewReader(r)
+	return t, nil
+}
+
+// entryPath checks an entry name and strips leading components from it,
+// returning "" for an entry stripped away entirely
+func entryPath(name string, strip int) (string, error) {
+	name = strings.ReplaceAll(name, "\\", "/")
+	if strings.HasPrefix(name, "/") || filepath.VolumeName(name) != "" || len(name) > 1 && name[1] == ':' {
+		return "", fmt.Errorf("entry %q has an absolute path", name)
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", fmt.Errorf("entry %q would be extracted outside the destination", name)
+		}
+	}
+	parts := strings.Split(strings.Trim(path.Clean(name), "/"), "/")
+	if strip >= len(parts) || parts[0] == "." {
+		return "", nil
+	}
+	return strings.Join(parts[strip:], "/"), nil
+}
+
+func (e *Engine) extractArchive(args json.RawMessage) (string, error) {
+	var params struct {
+		Path            string `json:"path"`
+		Destination     string `json:"destination"`
+		StripComponents int    `json:"strip_components"`
+		Overwrite       bool   `json:"overwrite"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return "", fmt.Errorf("invalid arguments: %v", err)
+	}
+	format, err := archiveFormat(params.Path)
+	if err != nil {
+		return "", err
+	}
+	if params.Destination == "" {
+		params.Destination = path.Dir(filepath.ToSlash(params.Path))
+	}
+	fullPath, err := e.resolvePath(params.Path)
+	if err != nil {
+		return "", err
+	}
+
+	entries, skipped, closeArchive, err := readArchive(e.files(), fullPath, format)
+	if err != nil {
+		return "", err
+	}
+	defer closeArchive()
+
+	// Check every entry before writing anything, so a bad archive leaves
+	// nothing half extracted
+	var total int64
+	var existing []string
+	targets := make([]string, len(entries))
+	for i, entry := range entries {
+		rel, err := entryPath(entry.name, params.StripComponents)
+		if err != nil {
+			return "", fmt.Errorf("not extracting %s: %v", params.Path, err)
+		}
+		if rel == "" {
+			continue
+		}
+		target, err := e.resolvePath(path.Join(params.Destination, rel))
+		if err != nil {
+			return "", fmt.Errorf("not extracting %s: entry %q: %v", params.Path, entry.name, err)
+		}
+		targets[i] = target
+		if entry.dir {
+			continue
+		}
+		total += entry.size
+		if _, err := e.files().Lstat(target); err == nil && !params.Overwrite {
+			existing = append(existing, path.Join(params.Destination, rel))
+		}
+	}
+	if total > maxExtractBytes {
+		return "", fmt.Errorf("not extracting %s: it would write %d bytes, over the limit of %d", params.Path, total, maxExtractBytes)
+	}
+	if len(existing) > 0 {
+		if len(existing) > 10 {
+			existing = append(existing[:10], fmt.Sprintf("and %d more", len(existing)-10))
+		}
+		return "", fmt.Errorf("not extracting %s, since these files already exist (pass overwrite: true to replace them): %s",
+			params.Path, strings.Join(existing, ", "))
+	}
+
+	if err := e.spendArchiveBudget(fullPath, format, targets); err != nil {
+		return "", err
+	}
+
+	var files []string
+	var written int64
+	for i, entry := range entries {
+		target := targets[i]
+		if target == "" {
+			continue
+		}
+		if entry.dir {
+			if err := e.files().MkdirAll(target, 0755); err != nil {
+				return "", fmt.Errorf("failed to create directory: %v", err)
+			}
+			continue
+		}
+		n, err := e.extractFile(entry, target, maxExtractBytes-written)
+		written += n
+		if err != nil {
+			return "", fmt.Errorf("failed to extract %s: %v", entry.name, err)
+		}
+		rel, _ := filepath.Rel(e.workspace, target)
+		files = append(files, filepath.ToSlash(rel))
+	}
+	e.invalidateCommandCache()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Extracted %d files, %d bytes, to %s", len(files), written, params.Destination)
+	if len(files) > 50 {
+		files = append(files[:50], fmt.Sprintf("and %d more", len(files)-50))
+	}
+	if len(files) > 0 {
+		fmt.Fprintf(&b, ":\n%s", strings.Join(files, "\n"))
+	}
+	if len(skipped) > 0 {
+		fmt.Fprintf(&b, "\nSkipped links and special files: %s", strings.Join(skipped, ", "))
+	}
+	return b.String(), nil
+}
+
+// spendArchiveBudget charges the diff budget for the files an extraction
+// would write, all at once before any is written. The archive is read
+// again for it, since a tar stream can only be read once; its entries come
+// in the same order, matching targets.
+func (e *Engine) spendArchiveBudget(fullPath, format string, targets []string) error {
+	if !e.diffBudget.enabled() {
+		return nil
+	}
+	entries, _, closeArchive, err := readArchive(e.files(), fullPath, format)
+	if err != nil {
+		return err
+	}
+	defer closeArchive()
+	var writes []budgetWrite
+	for i, entry := range entries {
+		if targets[i] == "" || entry.dir {
+			continue
+		}
+		r, err := entry.open()
+		if err != nil {
+			return err
+		}
+		data, err := io.ReadAll(io.LimitReader(r, maxExtractBytes))
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", entry.name, err)
+		}
+		before, _ := e.files().ReadFile(targets[i])
+		writes = append(writes, budgetWrite{targets[i], string(before), string(data)})
+	}
+	return e.spendDiffBudget(writes...)
+}
+
+// extractFile writes one entry, holding it to limit bytes, since the size
+// recorded in an archive can't be trusted
+func (e *Engine) extractFile(entry archiveEntry, target string, limit int64) (int64, error) {
+	defer e.locks.write(target)()
+	_, err := e.files().Lstat(target)
+	if err := e.quota.reserve(entry.size, err != nil); err != nil {
+		return 0, err
+	}
+	if err := e.files().MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return 0, fmt.Errorf("failed to create directory: %v", err)
+	}
+
+	r, err := entry.open()
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	mode := entry.mode | 0600
+	f, err := e.files().Create(target, mode)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(f, io.LimitReader(r, limit+1))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && n > limit {
+		err = fmt.Errorf("over the limit of %d bytes", int64(maxExtractBytes))
+	}
+	return n, err
+}
+
+func (e *Engine) createArchive(args json.RawMessage) (string, error) {
+	var params struct {
+		Path    string   `json:"path"`
+		Sources []string `json:"sources"`
+		Base    string   `json:"base"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return "", fmt.Errorf("invalid arguments: %v", err)
+	}
+	format, err := archiveFormat(params.Path)
+	if err != nil {
+		return "", err
+	}
+	if len(params.Sources) == 0 {
+		return "", fmt.Errorf("no sources given")
+	}
+	fullPath, err := e.resolvePath(params.Path)
+	if err != nil {
+		return "", err
+	}
+	base, err := e.resolvePath(params.Base)
+	if err != nil {
+		return "", err
+	}
+
+	// Collect the files first, so that nothing is written if a source is
+	// missing
+	type source struct{ path, name string }
+	var sources []source
+	var skipped []string
+	for _, s := range params.Sources {
+		root, err := e.resolvePath(s)
+		if err != nil {
+			return "", err
+		}
+		if !isWithin(base, root) {
+			return "", fmt.Errorf("%s is not within the base directory %s", s, params.Base)
+		}
+		err = walkDir(e.files(), root, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if p == fullPath {
+				return nil
+			}
+			name, _ := filepath.Rel(base, p)
+			name = filepath.ToSlash(name)
+			switch {
+			case d.IsDir():
+				if d.Name() == ".git" {
+					return filepath.SkipDir
+				}
+				if name != "." {
+					sources = append(sources, source{p, name + "/"})
+				}
+			case d.Type().IsRegular():
+				sources = append(sources, source{p, name})
+			default:
+				skipped = append(skipped, name)
+			}
+			return nil
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s: %v", s, err)
+		}
+	}
+
+	// Write to a temporary file and rename it into place, so a failure
+	// leaves no partial archive
+	defer e.locks.write(fullPath)()
+	if err := e.files().MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return "", fmt.Errorf("failed to create directory: %v", err)
+	}
+	tmpPath := filepath.Join(filepath.Dir(fullPath), fmt.Sprintf(".wex-archive-%d", time.Now().UnixNano()))
+	tmp, err := e.files().Create(tmpPath, 0644)
+	if err != nil {
+		return "", fmt.Errorf("failed to create archive: %v", err)
+	}
+	defer e.files().Remove(tmpPath)
+
+	count := 0
+	err = func() error {
+		var w archiveWriter
+		if format == "zip" {
+			w = zipWriter{zip.NewWriter(tmp), e.files()}
+		} else {
+			w = newTarWriter(tmp, e.files(), format == "tar.gz")
+		}
+		for _, s := range sources {
+			info, err := e.files().Stat(s.path)
+			if err != nil {
+				return err
+			}
+			if err := w.add(s.name, s.path, info); err != nil {
+				return fmt.Errorf("failed to add %s: %v", s.name, err)
+			}
+			if !info.IsDir() {
+				count++
+			}
+		}
+		return w.Close()
+	}()
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to create archive: %v", err)
+	}
+
+	info, err := e.files().Stat(tmpPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to create archive: %v", err)
+	}
+	if e.diffBudget.enabled() {
+		data, err := e.files().ReadFile(tmpPath)
+		if err != nil {
+			return "", fmt.Errorf("failed to create archive: %v", err)
+		}
+		before, _ := e.files().ReadFile(fullPath)
+		if err := e.spendDiffBudget(budgetWrite{fullPath, string(before), string(data)}); err != nil {
+			return "", err
+		}
+	}
+	_, err = e.files().Stat(fullPath)
+	if err := e.quota.reserve(info.Size(), err != nil); err != nil {
+		return "", err
+	}
+	if err := e.files().Rename(tmpPath, fullPath); err != nil {
+		return "", fmt.Errorf("failed to create archive: %v", err)
+	}
+	e.invalidateCommandCache()
+
+	result := fmt.Sprintf("Created %s with %d files, %d bytes", params.Path, count, info.Size())
+	if len(skipped) > 0 {
+		result += fmt.Sprintf("\nSkipped links and special files: %s", strings.Join(skipped, ", "))
+	}
+	return result, nil
+}
+
+// archiveWriter adds files to a zip or tar archive
+type archiveWriter interface {
+	add(name, path string, info os.FileInfo) error
+	Close() error
+}
+
+type zipWriter struct {
+	*zip.Writer
+	fsys FS
+}
+
+func (w zipWriter) add(name, path string, info os.FileInfo) error {
+	h, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	h.Name = name
+	if !info.IsDir() {
+		h.Method = zip.Deflate
+	}
+	out, err := w.CreateHeader(h)
+	if err != nil || info.IsDir() {
+		return err
+	}
+	return copyFile(w.fsys, out, path)
+}
+
+type tarWriter struct {
+	*tar.Writer
+	gz   *gzip.Writer
+	fsys FS
+}
+
+func newTarWriter(w io.Writer, fsys FS, compress bool) *tarWriter {
+	t := &tarWriter{fsys: fsys}
+	if compress {
+		t.gz = gzip.NewWriter(w)
+		w = t.gz
+	}
+	t.Writer = tar.NewWriter(w)
+	return t
+}
+
+func (w *tarWriter) add(name, path string, info os.FileInfo) error {
+	h, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	h.Name = name
+	// Owner names and IDs mean nothing on another machine
+	h.Uid, h.Gid, h.Uname, h.Gname = 0, 0, "", ""
+	if err := w.WriteHeader(h); err != nil || info.IsDir() {
+		return err
+	}
+	return copyFile(w.fsys, w.Writer, path)
+}
+
+func (w *tarWriter) Close() error {
+	err := w.Writer.Close()
+	if w.gz != nil {
+		if gzErr := w.gz.Close(); err == nil {
+			err = gzErr
+		}
+	}
+	return err
+}
+
+func copyFile(fsys FS, w io.Writer, path string) error {
+	f, err := fsys.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
@@ -0,0 +1,198 @@
+package agent
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testZip(t *testing.T, files map[string]string) string {
+	t.Helper()
+	var b bytes.Buffer
+	w := zip.NewWriter(&b)
+	for name, content := range files {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(content))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+func testTar(t *testing.T, headers ...*tar.Header) string {
+	t.Helper()
+	var b bytes.Buffer
+	w := tar.NewWriter(&b)
+	for _, h := range headers {
+		if err := w.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		w.Write(bytes.Repeat([]byte("x"), int(h.Size)))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+// workspaceFiles lists everything under the workspace
+func workspaceFiles(t *testing.T, e *Engine) []string {
+	t.Helper()
+	var files []string
+	filepath.WalkDir(e.workspace, func(p string, d fs.DirEntry, err error) error {
+		if p != e.workspace {
+			rel, _ := filepath.Rel(e.workspace, p)
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	return files
+}
+
+func TestEntryPath(t *testing.T) {
+	tests := []struct {
+		name  string
+		strip int
+		want  string
+		err   string
+	}{
+		{"a/b.txt", 0, "a/b.txt", ""},
+		{"./a/b.txt", 0, "a/b.txt", ""},
+		{"pkg-1.0/src/a.go", 1, "src/a.go", ""},
+		{"pkg-1.0/", 1, "", ""},
+		{"a/../../b", 0, "", "outside the destination"},
+		{"..", 0, "", "outside the destination"},
+		{`a\..\..\b`, 0, "", "outside the destination"},
+		{"/etc/passwd", 0, "", "absolute path"},
+		{`\windows\system32`, 0, "", "absolute path"},
+		{"C:/evil.txt", 0, "", "absolute path"},
+		{`C:\evil.txt`, 0, "", "absolute path"},
+		{"c:evil.txt", 0, "", "absolute path"},
+	}
+	for _, test := range tests {
+		got, err := entryPath(test.name, test.strip)
+		switch {
+		case test.err != "":
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("entryPath(%q) = %q, %v; want error %q", test.name, got, err, test.err)
+			}
+		case err != nil || got != test.want:
+			t.Errorf("entryPath(%q, %d) = %q, %v; want %q", test.name, test.strip, got, err, test.want)
+		}
+	}
+}
+
+func TestExtractArchiveRefusals(t *testing.T) {
+	// Each archive also holds a good entry, which must not be written
+	// either, since every entry is checked before any is extracted
+	big := func() string {
+		var b bytes.Buffer
+		w := zip.NewWriter(&b)
+		for _, name := range []string{"a.txt", "b.txt"} {
+			f, err := w.CreateRaw(&zip.FileHeader{Name: name, Method: zip.Store, UncompressedSize64: maxExtractBytes/2 + 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.Write([]byte("small"))
+		}
+		w.Close()
+		return b.String()
+	}
+	tests := []struct {
+		archive, content, want string
+	}{
+		{"parent.zip", testZip(t, map[string]string{"ok.txt": "ok", "../evil.txt": "evil"}), "outside the destination"},
+		{"nested.tar", testTar(t, &tar.Header{Name: "ok.txt", Mode: 0644, Size: 2}, &tar.Header{Name: "a/../../evil.txt", Mode: 0644, Size: 4}), "outside the destination"},
+		{"absolute.tar", testTar(t, &tar.Header{Name: "ok.txt", Mode: 0644, Size: 2}, &tar.Header{Name: "/tmp/evil.txt", Mode: 0644, Size: 4}), "absolute path"},
+		{"drive.zip", testZip(t, map[string]string{"ok.txt": "ok", "C:/evil.txt": "evil"}), "absolute path"},
+		{"backslash.zip", testZip(t, map[string]string{"ok.txt": "ok", `C:\evil.txt`: "evil"}), "absolute path"},
+		{"bomb.zip", big(), "over the limit"},
+	}
+	for _, test := range tests {
+		e := newToolEngine(t)
+		writeTestFile(t, e, test.archive, test.content)
+		out, err := e.extractArchive(args(t, map[string]interface{}{"path": test.archive, "destination": "out"}))
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s gave %q, %v; want error %q", test.archive, out, err, test.want)
+		}
+		if files := workspaceFiles(t, e); len(files) != 1 {
+			t.Errorf("%s wrote %v", test.archive, files)
+		}
+	}
+}
+
+func TestExtractArchiveSkipsLinks(t *testing.T) {
+	e := newToolEngine(t)
+	writeTestFile(t, e, "links.tar", testTar(t,
+		&tar.Header{Name: "passwd", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"},
+		&tar.Header{Name: "hard", Typeflag: tar.TypeLink, Linkname: "/etc/shadow"},
+		&tar.Header{Name: "ok.txt", Mode: 0644, Size: 2},
+	))
+	out, err := e.extractArchive(args(t, map[string]interface{}{"path": "links.tar", "destination": "out"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "Extracted 1 files") || !strings.Contains(out, "Skipped links and special files: passwd, hard") {
+		t.Errorf("got %q", out)
+	}
+	for _, name := range []string{"out/passwd", "out/hard"} {
+		if _, err := os.Lstat(filepath.Join(e.workspace, name)); err == nil {
+			t.Errorf("%s was extracted", name)
+		}
+	}
+}
+
+func TestExtractArchiveOverwrite(t *testing.T) {
+	e := newToolEngine(t)
+	writeTestFile(t, e, "a.zip", testZip(t, map[string]string{"a.txt": "new"}))
+	writeTestFile(t, e, "a.txt", "old")
+	if _, err := e.extractArchive(args(t, map[string]interface{}{"path": "a.zip"})); err == nil || !strings.Contains(err.Error(), "already exist") {
+		t.Errorf("got %v, want a refusal to overwrite", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(e.workspace, "a.txt")); string(data) != "old" {
+		t.Errorf("a.txt was overwritten with %q", data)
+	}
+	if _, err := e.extractArchive(args(t, map[string]interface{}{"path": "a.zip", "overwrite": true})); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(e.workspace, "a.txt")); string(data) != "new" {
+		t.Errorf("a.txt has %q after overwrite", data)
+	}
+}
+
+func TestExtractArchiveDiffBudget(t *testing.T) {
+	e := newToolEngine(t)
+	e.diffBudget.MaxFiles = 1
+	approve := false
+	e.approver = func(string) bool { return approve }
+	writeTestFile(t, e, "a.tar", testTar(t,
+		&tar.Header{Name: "out/a.txt", Mode: 0644, Size: 3, Typeflag: tar.TypeReg},
+		&tar.Header{Name: "out/b.txt", Mode: 0644, Size: 3, Typeflag: tar.TypeReg}))
+	e.diffBudget.startTurn()
+
+	// Over budget and refused, nothing is extracted
+	if _, err := e.extractArchive(args(t, map[string]interface{}{"path": "a.tar"})); err == nil || !strings.Contains(err.Error(), "smaller steps") {
+		t.Errorf("over budget gave %v", err)
+	}
+	if files := workspaceFiles(t, e); len(files) != 1 {
+		t.Errorf("workspace has %v", files)
+	}
+
+	// Approved, the tar is read again to extract it
+	approve = true
+	if _, err := e.extractArchive(args(t, map[string]interface{}{"path": "a.tar"})); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(e.workspace, "out/b.txt")); string(data) != "xxx" {
+		t.Errorf("out/b.txt has %q", data)
+	}
+}
@@ -0,0 +1,170 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// When the model is blocked on something only a person can answer, such as
+// a credential or a product decision, it calls ask_user rather than guess.
+// A question takes free text, yes or no, or one of the model's choices.
+// An answerer from WithAnswerer, or else the user at the terminal, answers
+// at once, and the answer comes to the model as a user message after the
+// turn's tool results. Otherwise the session pauses: the question is
+// recorded in the session file and the result, the user is notified, and
+// the session stops after the turn. Resuming it with --resume carries on,
+// with the answer as the next message.
+
+// The kinds of question ask_user can ask
+const (
+	questionText   = "text"
+	questionYesNo  = "yes_no"
+	questionChoice = "choice"
+)
+
+func askUserTool() Tool {
+	return Tool{
+		Type: "function",
+		Function: Function{
+			Name: "ask_user",
+			Description: "Ask the user something only they can answer, such as a credential, access to something, or a product decision, " +
+				"instead of guessing; don't ask what you can find out or decide yourself, or for permission to go on",
+			Parameters: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"question": map[string]interface{}{
+						"type":        "string",
+						"description": "The question, with what the answer is needed for",
+					},
+					"kind": map[string]interface{}{
+						"type":        "string",
+						"enum":        []string{questionText, questionYesNo, questionChoice},
+						"description": "text for a free answer (the default), yes_no, or choice to pick one of choices",
+					},
+					"choices": map[string]interface{}{
+						"type":        "array",
+						"items":       map[string]interface{}{"type": "string"},
+						"description": "For choice, the answers to pick from",
+					},
+				},
+				"required": []string{"question"},
+			},
+		},
+	}
+}
+
+// askUser answers ask_user, or pauses the session until someone can
+func (e *Engine) askUser(args json.RawMessage) (string, error) {
+	var params struct {
+		Question string   `json:"question"`
+		Kind     string   `json:"kind"`
+		Choices  []string `json:"choices"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return "", fmt.Errorf("invalid arguments: %v", err)
+	}
+	question := strings.TrimSpace(params.Question)
+	if question == "" {
+		return "", fmt.Errorf("question is required")
+	}
+	var choices []string
+	switch params.Kind {
+	case "", questionText:
+	case questionYesNo:
+		choices = []string{"yes", "no"}
+	case questionChoice:
+		for _, c := range params.Choices {
+			if c = strings.TrimSpace(c); c != "" {
+				choices = append(choices, c)
+			}
+		}
+		if len(choices) < 2 {
+			return "", fmt.Errorf("a choice question needs at least two choices")
+		}
+	default:
+		return "", fmt.Errorf("invalid kind %q: must be text, yes_no or choice", params.Kind)
+	}
+
+	// At the terminal, an empty answer pauses the session too, for when the
+	// answer has to be found first
+	notified := false
+	if e.answerer != nil {
+		if answer, ok := e.answerer(question, choices); ok {
+			return e.answered(question, answer), nil
+		}
+	} else if e.approver == nil && isTerminal(os.Stdin) {
+		e.notify("needs_answer", question)
+		notified = true
+		if answer, ok := askAtTerminal(question, choices); ok {
+			return e.answered(question, answer), nil
+		}
+	}
+
+	e.question, e.choices = question, choices
+	e.emit(Event{Type: EventQuestion, Text: question, Choices: choices})
+	if !notified {
+		e.notify("needs_answer", question)
+	}
+	return "The session is paused until the user answers. Stop here; the answer will come as the next message.", nil
+}
+
+// answered queues the answer to go to the model as a user message
+func (e *Engine) answered(question, answer string) string {
+	e.answers = append(e.answers, fmt.Sprintf("Answering %q: %s", question, answer))
+	return "The user answered; the answer follows"
+}
+
+// askAtTerminal asks a question at the terminal, with the choices as a
+// numbered list, asking again until the answer is one of them
+func askAtTerminal(question string, choices []string) (string, bool) {
+	prompt := fmt.Sprintf("The model asks: %s\n(empty to pause the session) > ", question)
+	switch {
+	case len(choices) == 2 && choices[0] == "yes" && choices[1] == "no":
+		prompt = fmt.Sprintf("The model asks: %s\n[y/n, empty to pause the session] > ", question)
+	case len(choices) > 0:
+		var b strings.Builder
+		fmt.Fprintf(&b, "The model asks: %s\n", question)
+		for i, c := range choices {
+			fmt.Fprintf(&b, "  %d. %s\n", i+1, c)
+		}
+		fmt.Fprintf(&b, "[1-%d, empty to pause the session] > ", len(choices))
+		prompt = b.String()
+	}
+	for {
+		line, err := readLine(prompt)
+		if line = strings.TrimSpace(line); err != nil || line == "" {
+			return "", false
+		}
+		if len(choices) == 0 {
+			return line, true
+		}
+		if answer, ok := pickChoice(line, choices); ok {
+			return answer, true
+		}
+		fmt.Fprintf(os.Stderr, "%q is not one of the choices\n", line)
+	}
+}
+
+// pickChoice matches what the user typed to a choice: its number, the
+// choice itself, or the start of only one choice, ignoring case
+func pickChoice(input string, choices []string) (string, bool) {
+	if n, err := strconv.Atoi(input); err == nil && n >= 1 && n <= len(choices) {
+		return choices[n-1], true
+	}
+	var matches []string
+	for _, c := range choices {
+		if strings.EqualFold(c, input) {
+			return c, true
+		}
+		if len(c) >= len(input) && strings.EqualFold(c[:len(input)], input) {
+			matches = append(matches, c)
+		}
+	}
+	if len(matches) == 1 {
+		return matches[0], true
+	}
+	return "", false
+}
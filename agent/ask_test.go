@@ -0,0 +1,125 @@
+package agent
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAskUserPauses(t *testing.T) {
+	e, provider, events := newTestEngine(t, []ChatResponse{
+		reply("I need to know which account", call("ask_user", `{"question": "Test or live Stripe account?"}`)),
+		reply("", call("write_file", `{"path": "stripe.txt", "content": "test\n"}`)),
+		reply("Configured the test account"),
+	})
+	e.sessionPath = filepath.Join(t.TempDir(), "run.json")
+	result, err := e.Run(t.Context(), "Set up the Stripe webhook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Question != "Test or live Stripe account?" || result.Turns != 1 || len(provider.requests) != 1 {
+		t.Fatalf("result %+v after %d requests", result, len(provider.requests))
+	}
+	session, err := loadSession(e.sessionPath, nil)
+	if err != nil || session.Question != "Test or live Stripe account?" {
+		t.Fatalf("session %+v, %v", session, err)
+	}
+	var asked []string
+	for _, event := range *events {
+		if event.Type == EventQuestion {
+			asked = append(asked, event.Text)
+		}
+	}
+	if len(asked) != 1 {
+		t.Errorf("question events %v", asked)
+	}
+
+	// Running again carries on with the answer as the next message
+	result, err = e.Run(t.Context(), "The test account")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Question != "" || result.Reply != "Configured the test account" {
+		t.Errorf("result %+v", result)
+	}
+	messages := provider.lastMessages(t, 2)
+	if n := len(messages); n != 5 || messages[3].Role != "tool" || !strings.Contains(messages[3].Content, "paused") || messages[4].Content != "The test account" {
+		t.Errorf("resumed conversation: %+v", messages)
+	}
+	if session, err := loadSession(e.sessionPath, nil); err != nil || session.Question != "" {
+		t.Errorf("session still paused: %+v, %v", session, err)
+	}
+}
+
+func TestAskUserAnswerer(t *testing.T) {
+	var asked []string
+	e, provider, _ := newTestEngine(t, []ChatResponse{
+		reply("", call("ask_user", `{"question": "Which port?"}`), call("ask_user", `{"question": "Which database?", "kind": "choice", "choices": ["PostgreSQL", " SQLite "]}`)),
+		reply("Using 8080 and SQLite"),
+	}, WithAnswerer(func(question string, choices []string) (string, bool) {
+		asked = append(asked, question+" "+strings.Join(choices, "|"))
+		if len(choices) > 0 {
+			return choices[1], true
+		}
+		return "8080", true
+	}))
+	result, err := e.Run(t.Context(), "Start the server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Question != "" || result.Reply != "Using 8080 and SQLite" || strings.Join(asked, ",") != "Which port? ,Which database? PostgreSQL|SQLite" {
+		t.Errorf("result %+v, asked %q", result, asked)
+	}
+
+	// The answers follow the tool results as user messages
+	messages := provider.lastMessages(t, 2)
+	var got []string
+	for _, m := range messages[3:] {
+		got = append(got, m.Role+": "+m.Content)
+	}
+	want := []string{
+		"tool: The user answered; the answer follows",
+		"tool: The user answered; the answer follows",
+		`user: Answering "Which port?": 8080`,
+		`user: Answering "Which database?": SQLite`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("messages after the reply:\n%s", strings.Join(got, "\n"))
+	}
+}
+
+func TestAskUserChoices(t *testing.T) {
+	e, _, events := newTestEngine(t, []ChatResponse{
+		reply("", call("ask_user", `{"question": "Which account?", "kind": "choice", "choices": ["test"]}`)),
+		reply("", call("ask_user", `{"question": "Remove v1?", "kind": "yes_no"}`)),
+	})
+	result, err := e.Run(t.Context(), "Clean up the API")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Question != "Remove v1?" || strings.Join(result.Choices, ",") != "yes,no" {
+		t.Errorf("result %+v", result)
+	}
+	var refused int
+	for _, event := range *events {
+		if event.Type == EventToolFinished && event.Failed && strings.Contains(event.Result, "a choice question needs at least two choices") {
+			refused++
+		}
+		if event.Type == EventQuestion && strings.Join(event.Choices, ",") != "yes,no" {
+			t.Errorf("question event %+v", event)
+		}
+	}
+	if refused != 1 {
+		t.Errorf("a choice with one choice was refused %d times", refused)
+	}
+
+	choices := []string{"PostgreSQL", "SQLite", "MySQL"}
+	for input, want := range map[string]string{"2": "SQLite", "sqlite": "SQLite", "p": "PostgreSQL", "My": "MySQL", "4": "", "s q": "", "": ""} {
+		if got, ok := pickChoice(input, choices); got != want || ok != (want != "") {
+			t.Errorf("%q picks %q, %v, want %q", input, got, ok, want)
+		}
+	}
+	if got, ok := pickChoice("y", []string{"yes", "no"}); got != "yes" || !ok {
+		t.Errorf("y picks %q", got)
+	}
+}
@@ -0,0 +1,133 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// Images can be sent with a request, for a multimodal model to look at,
+// such as a screenshot of how a page should look. They travel with the
+// user's message as Ollama's /api/chat has them, base64 in the message's
+// images, and the Anthropic provider turns them into image blocks; the
+// providers that render a prompt from a template drop them.
+
+// maxAttachedImage bounds the size of an image sent with a request
+const maxAttachedImage = 20 << 20
+
+// clipboardImage is the --image argument that pastes from the clipboard
+const clipboardImage = "clipboard"
+
+// clipboardCommands read an image from the clipboard as PNG, for each
+// platform, in the order they are tried
+var clipboardCommands = map[string][][]string{
+	"linux": {
+		{"wl-paste", "--no-newline", "--type", "image/png"},
+		{"xclip", "-selection", "clipboard", "-target", "image/png", "-out"},
+	},
+	"darwin": {
+		{"pngpaste", "-"},
+	},
+	"windows": {
+		{"powershell", "-NoProfile", "-Command", `Add-Type -AssemblyName System.Windows.Forms; $image = [Windows.Forms.Clipboard]::GetImage(); if (!$image) { exit 1 }; $stream = New-Object IO.MemoryStream; $image.Save($stream, [Drawing.Imaging.ImageFormat]::Png); $out = [Console]::OpenStandardOutput(); $out.Write($stream.ToArray(), 0, $stream.Length)`},
+	},
+}
+
+// readImageArg reads an image given to --image: a file, or the clipboard
+func readImageArg(arg string) ([]byte, error) {
+	if arg == clipboardImage {
+		return readClipboardImage()
+	}
+	info, err := os.Stat(arg)
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() > maxAttachedImage {
+		return nil, fmt.Errorf("%s is larger than %d MiB", arg, maxAttachedImage>>20)
+	}
+	data, err := os.ReadFile(arg)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkImage(data); err != nil {
+		return nil, fmt.Errorf("%s: %v", arg, err)
+	}
+	return data, nil
+}
+
+// readClipboardImage pastes an image from the clipboard, with the first
+// clipboard tool that is installed
+func readClipboardImage() ([]byte, error) {
+	var tried []string
+	for _, command := range clipboardCommands[runtime.GOOS] {
+		tried = append(tried, command[0])
+		if _, err := exec.LookPath(command[0]); err != nil {
+			continue
+		}
+		var stderr bytes.Buffer
+		cmd := exec.Command(command[0], command[1:]...)
+		cmd.Stderr = &stderr
+		data, err := cmd.Output()
+		if err != nil || len(data) == 0 {
+			return nil, fmt.Errorf("no image on the clipboard: %s", strings.TrimSpace(stderr.String()))
+		}
+		if len(data) > maxAttachedImage {
+			return nil, fmt.Errorf("the clipboard image is larger than %d MiB", maxAttachedImage>>20)
+		}
+		if err := checkImage(data); err != nil {
+			return nil, fmt.Errorf("the clipboard: %v", err)
+		}
+		return data, nil
+	}
+	if len(tried) == 0 {
+		return nil, fmt.Errorf("reading the clipboard isn't supported on %s", runtime.GOOS)
+	}
+	return nil, fmt.Errorf("reading the clipboard needs %s installed", strings.Join(tried, " or "))
+}
+
+// checkImage checks that data is an image a model can be sent
+func checkImage(data []byte) error {
+	switch imageMediaType(data) {
+	case "image/png", "image/jpeg", "image/gif", "image/webp":
+		return nil
+	}
+	return fmt.Errorf("not a PNG, JPEG, GIF or WebP image")
+}
+
+// imageMediaType says what kind of image data is, from its first bytes
+func imageMediaType(data []byte) string {
+	return http.DetectContentType(data)
+}
+
+// decodeImages decodes base64 images, as sent to wex serve, checking each
+func decodeImages(images []string) ([][]byte, error) {
+	var decoded [][]byte
+	for i, image := range images {
+		data, err := base64.StdEncoding.DecodeString(image)
+		if err != nil {
+			return nil, fmt.Errorf("image %d is not base64: %v", i+1, err)
+		}
+		if len(data) > maxAttachedImage {
+			return nil, fmt.Errorf("image %d is larger than %d MiB", i+1, maxAttachedImage>>20)
+		}
+		if err := checkImage(data); err != nil {
+			return nil, fmt.Errorf("image %d is %v", i+1, err)
+		}
+		decoded = append(decoded, data)
+	}
+	return decoded, nil
+}
+
+// encodeImages encodes images for a message
+func encodeImages(images [][]byte) []string {
+	var encoded []string
+	for _, image := range images {
+		encoded = append(encoded, base64.StdEncoding.EncodeToString(image))
+	}
+	return encoded
+}
@@ -0,0 +1,67 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestAttachedImages(t *testing.T) {
+	dir := t.TempDir()
+	png := testPNG(t, 2, 2)
+	os.WriteFile(filepath.Join(dir, "shot.png"), png, 0644)
+	os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not an image\n"), 0644)
+	if data, err := readImageArg(filepath.Join(dir, "shot.png")); err != nil || !bytes.Equal(data, png) {
+		t.Errorf("reading shot.png gave %d bytes, %v", len(data), err)
+	}
+	if _, err := readImageArg(filepath.Join(dir, "notes.txt")); err == nil || !strings.Contains(err.Error(), "not a PNG, JPEG, GIF or WebP image") {
+		t.Errorf("reading notes.txt gave %v", err)
+	}
+	if _, err := decodeImages([]string{base64.StdEncoding.EncodeToString(png), "%%%"}); err == nil || !strings.HasPrefix(err.Error(), "image 2 is not base64") {
+		t.Errorf("decoding bad base64 gave %v", err)
+	}
+	if _, err := New(WithWorkspace(dir), WithImages([]byte("hello"))); err == nil {
+		t.Errorf("WithImages took text")
+	}
+
+	// The images go with the request's message, and only that one
+	e, provider, _ := newTestEngine(t, []ChatResponse{reply("A red square"), reply("Still red")}, WithImages(png))
+	if _, err := e.Run(t.Context(), "What is this?"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Run(t.Context(), "And now?"); err != nil {
+		t.Fatal(err)
+	}
+	var images [][]string
+	for _, req := range provider.requests {
+		images = append(images, req.Messages[len(req.Messages)-1].Images)
+	}
+	if len(images) != 2 || len(images[0]) != 1 || images[0][0] != base64.StdEncoding.EncodeToString(png) || images[1] != nil {
+		t.Errorf("images sent %v", images)
+	}
+}
+
+func TestClipboardImage(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("the fake clipboard tool is a shell script")
+	}
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "shot.png"), testPNG(t, 2, 2), 0644)
+	t.Setenv("PATH", dir)
+	if _, err := readImageArg(clipboardImage); err == nil || !strings.Contains(err.Error(), "needs wl-paste or xclip installed") {
+		t.Errorf("reading the clipboard without a tool gave %v", err)
+	}
+
+	os.WriteFile(filepath.Join(dir, "xclip"), []byte("#!/bin/sh\nexec /bin/cat "+filepath.Join(dir, "shot.png")+"\n"), 0755)
+	if data, err := readImageArg(clipboardImage); err != nil || checkImage(data) != nil {
+		t.Errorf("reading the clipboard gave %d bytes, %v", len(data), err)
+	}
+	os.WriteFile(filepath.Join(dir, "wl-paste"), []byte("#!/bin/sh\necho 'No suitable type of content copied' >&2\nexit 1\n"), 0755)
+	if _, err := readImageArg(clipboardImage); err == nil || !strings.Contains(err.Error(), "no image on the clipboard: No suitable type") {
+		t.Errorf("reading an empty clipboard gave %v", err)
+	}
+}
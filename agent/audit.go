@@ -0,0 +1,792 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// wex audit runs security scanners, each asked for JSON output so that
+// findings from all of them come out in one form, and then has the model
+// fix the findings one at a time. A fix is kept only if the scanner no
+// longer reports the finding, reports nothing new, and the verification
+// command still passes; the model checks its work with run_scanner, which
+// gives it the same structured findings.
+
+// auditSeverities ranks severities, most urgent first
+var auditSeverities = map[string]int{
+	"critical": 0,
+	"high":     1,
+	"medium":   2,
+	"low":      3,
+}
+
+// auditFinding is one problem reported by a scanner
+type auditFinding struct {
+	Scanner  string `json:"scanner"`
+	Rule     string `json:"rule"`
+	Severity string `json:"severity"`
+	Title    string `json:"title"`
+	Path     string `json:"path,omitempty"`
+	Line     int    `json:"line,omitempty"`
+	Package  string `json:"package,omitempty"`
+	Version  string `json:"version,omitempty"`
+	FixedIn  string `json:"fixed_in,omitempty"`
+
+	// Status and Note say what came of trying to fix it, for the report
+	Status string `json:"status,omitempty"`
+	Note   string `json:"note,omitempty"`
+}
+
+// key identifies a finding across scans. Lines are left out, since a fix
+// elsewhere in the file moves them.
+func (f auditFinding) key() string {
+	return strings.Join([]string{f.Scanner, f.Rule, f.Path, f.Package}, "|")
+}
+
+func (f auditFinding) location() string {
+	switch {
+	case f.Package != "" && f.Version != "":
+		return fmt.Sprintf("%s %s in %s", f.Package, f.Version, f.Path)
+	case f.Package != "":
+		return fmt.Sprintf("%s in %s", f.Package, f.Path)
+	case f.Line > 0:
+		return fmt.Sprintf("%s:%d", f.Path, f.Line)
+	}
+	return f.Path
+}
+
+// auditScanner is a scanner wex knows how to run and read
+type auditScanner struct {
+	name string
+
+	// command runs the scanner from the workspace root, printing JSON
+	command string
+
+	// applies says whether the workspace has anything for it to scan
+	applies func(e *Engine) bool
+
+	parse func(output []byte, workspace string) ([]auditFinding, error)
+}
+
+var knownScanners = []*auditScanner{
+	{
+		name:    "gosec",
+		command: "gosec -fmt=json -quiet -no-fail ./...",
+		applies: func(e *Engine) bool { return e.fileExists("go.mod") },
+		parse:   parseGosec,
+	},
+	{
+		name:    "npm",
+		command: "npm audit --json",
+		applies: func(e *Engine) bool { return e.fileExists("package-lock.json") },
+		parse:   parseNpmAudit,
+	},
+	{
+		name:    "trivy",
+		command: "trivy fs --format json --quiet --scanners vuln,secret,misconfig .",
+		applies: func(e *Engine) bool { return true },
+		parse:   parseTrivy,
+	},
+}
+
+func findAuditScanner(name string) *auditScanner {
+	for _, s := range knownScanners {
+		if s.name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// installed says whether the scanner's program is on the PATH
+func (s *auditScanner) installed() bool {
+	_, err := exec.LookPath(strings.Fields(s.command)[0])
+	return err == nil
+}
+
+// scan runs the scanner and reads its findings. Scanners exit with an
+// error status when they find something, so the status only matters if
+// the output can't be read.
+func (e *Engine) scan(s *auditScanner) ([]auditFinding, error) {
+	command := s.command
+	if s.name == "trivy" && e.offline {
+		command += " --offline-scan --skip-db-update"
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), checkScriptTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Dir = e.workspace
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	runErr := cmd.Run()
+	findings, err := s.parse(stdout.Bytes(), e.workspace)
+	if err != nil {
+		if runErr != nil {
+			return nil, fmt.Errorf("%s failed: %v\n%s", s.name, runErr, lastLines(stderr.String(), 20))
+		}
+		return nil, fmt.Errorf("failed to read %s output: %v", s.name, err)
+	}
+	for i := range findings {
+		findings[i].Scanner = s.name
+		if _, ok := auditSeverities[findings[i].Severity]; !ok {
+			findings[i].Severity = "low"
+		}
+	}
+	return findings, nil
+}
+
+// scannerPath makes a path the scanner reported relative to the workspace
+func scannerPath(workspace, path string) string {
+	if filepath.IsAbs(path) {
+		if rel, err := filepath.Rel(workspace, path); err == nil && !strings.HasPrefix(rel, "..") {
+			path = rel
+		}
+	}
+	return filepath.ToSlash(filepath.Clean(path))
+}
+
+func parseGosec(output []byte, workspace string) ([]auditFinding, error) {
+	var report struct {
+		Issues []struct {
+			Severity string `json:"severity"`
+			RuleID   string `json:"rule_id"`
+			Details  string `json:"details"`
+			File     string `json:"file"`
+			Line     string `json:"line"`
+		} `json:"Issues"`
+	}
+	if err := json.Unmarshal(output, &report); err != nil {
+		return nil, err
+	}
+	var findings []auditFinding
+	for _, issue := range report.Issues {
+		// A line may be a range, such as 12-14
+		first, _, _ := strings.Cut(issue.Line, "-")
+		line, _ := strconv.Atoi(first)
+		findings = append(findings, auditFinding{
+			Rule:     issue.RuleID,
+			Severity: strings.ToLower(issue.Severity),
+			Title:    issue.Details,
+			Path:     scannerPath(workspace, issue.File),
+			Line:     line,
+		})
+	}
+	return findings, nil
+}
+
+func parseNpmAudit(output []byte, workspace string) ([]auditFinding, error) {
+	var report struct {
+		Vulnerabilities map[string]struct {
+			Name         string            `json:"name"`
+			Severity     string            `json:"severity"`
+			Range        string            `json:"range"`
+			Via          []json.RawMessage `json:"via"`
+			FixAvailable json.RawMessage   `json:"fixAvailable"`
+		} `json:"vulnerabilities"`
+	}
+	if err := json.Unmarshal(output, &report); err != nil {
+		return nil, err
+	}
+	if report.Vulnerabilities == nil {
+		// npm audit reports its own failures, such as a missing lock file,
+		// as JSON too
+		var failure struct {
+			Error struct {
+				Summary string `json:"summary"`
+			} `json:"error"`
+		}
+		if json.Unmarshal(output, &failure) == nil && failure.Error.Summary != "" {
+			return nil, fmt.Errorf("%s", failure.Error.Summary)
+		}
+	}
+	var findings []auditFinding
+	for name, v := range report.Vulnerabilities {
+		f := auditFinding{Package: name, Version: v.Range, Path: "package-lock.json"}
+		switch v.Severity {
+		case "moderate":
+			f.Severity = "medium"
+		case "info":
+			f.Severity = "low"
+		default:
+			f.Severity = v.Severity
+		}
+		// via holds the advisories for the package itself, and the names
+		// of the dependencies it is vulnerable through
+		var titles, through []string
+		for _, raw := range v.Via {
+			var advisory struct {
+				Title string `json:"title"`
+				URL   string `json:"url"`
+			}
+			var dependency string
+			if json.Unmarshal(raw, &dependency) == nil {
+				through = append(through, dependency)
+			} else if json.Unmarshal(raw, &advisory) == nil {
+				titles = append(titles, advisory.Title)
+				if f.Rule == "" && advisory.URL != "" {
+					f.Rule = advisory.URL[strings.LastIndex(advisory.URL, "/")+1:]
+				}
+			}
+		}
+		if len(titles) > 0 {
+			f.Title = strings.Join(titles, "; ")
+		} else {
+			f.Title = "Vulnerable through " + strings.Join(through, ", ")
+		}
+		if f.Rule == "" {
+			f.Rule = "npm-audit"
+		}
+		var fix struct {
+			Name          string `json:"name"`
+			Version       string `json:"version"`
+			IsSemVerMajor bool   `json:"isSemVerMajor"`
+		}
+		if json.Unmarshal(v.FixAvailable, &fix) == nil && fix.Name != "" {
+			f.FixedIn = fix.Name + "@" + fix.Version
+			if fix.IsSemVerMajor {
+				f.FixedIn += " (a major version)"
+			}
+		}
+		findings = append(findings, f)
+	}
+	sort.Slice(findings, func(i, j int) bool { return findings[i].Package < findings[j].Package })
+	return findings, nil
+}
+
+func parseTrivy(output []byte, workspace string) ([]auditFinding, error) {
+	var report struct {
+		Results []struct {
+			Target          string `json:"Target"`
+			Vulnerabilities []struct {
+				VulnerabilityID  string `json:"VulnerabilityID"`
+				PkgName          string `json:"PkgName"`
+				InstalledVersion string `json:"InstalledVersion"`
+				FixedVersion     string `json:"FixedVersion"`
+				Severity         string `json:"Severity"`
+				Title            string `json:"Title"`
+			} `json:"Vulnerabilities"`
+			Misconfigurations []struct {
+				ID            string `json:"ID"`
+				Title         string `json:"Title"`
+				Message       string `json:"Message"`
+				Severity      string `json:"Severity"`
+				CauseMetadata struct {
+					StartLine int `json:"StartLine"`
+				} `json:"CauseMetadata"`
+			} `json:"Misconfigurations"`
+			Secrets []struct {
+				RuleID    string `json:"RuleID"`
+				Title     string `json:"Title"`
+				Severity  string `json:"Severity"`
+				StartLine int    `json:"StartLine"`
+			} `json:"Secrets"`
+		} `json:"Results"`
+	}
+	if err := json.Unmarshal(output, &report); err != nil {
+		return nil, err
+	}
+	var findings []auditFinding
+	for _, r := range report.Results {
+		path := scannerPath(workspace, r.Target)
+		for _, v := range r.Vulnerabilities {
+			title := v.Title
+			if title == "" {
+				title = v.VulnerabilityID
+			}
+			findings = append(findings, auditFinding{
+				Rule:     v.VulnerabilityID,
+				Severity: strings.ToLower(v.Severity),
+				Title:    title,
+				Path:     path,
+				Package:  v.PkgName,
+				Version:  v.InstalledVersion,
+				FixedIn:  v.FixedVersion,
+			})
+		}
+		for _, m := range r.Misconfigurations {
+			title := m.Title
+			if m.Message != "" {
+				title += ": " + m.Message
+			}
+			findings = append(findings, auditFinding{
+				Rule:     m.ID,
+				Severity: strings.ToLower(m.Severity),
+				Title:    title,
+				Path:     path,
+				Line:     m.CauseMetadata.StartLine,
+			})
+		}
+		for _, s := range r.Secrets {
+			findings = append(findings, auditFinding{
+				Rule:     s.RuleID,
+				Severity: strings.ToLower(s.Severity),
+				Title:    s.Title,
+				Path:     path,
+				Line:     s.StartLine,
+			})
+		}
+	}
+	return findings, nil
+}
+
+// sortFindings puts the most severe first, then by scanner and place
+func sortFindings(findings []auditFinding) {
+	sort.SliceStable(findings, func(i, j int) bool {
+		a, b := findings[i], findings[j]
+		if auditSeverities[a.Severity] != auditSeverities[b.Severity] {
+			return auditSeverities[a.Severity] < auditSeverities[b.Severity]
+		}
+		if a.Scanner != b.Scanner {
+			return a.Scanner < b.Scanner
+		}
+		if a.Path != b.Path {
+			return a.Path < b.Path
+		}
+		return a.Line < b.Line
+	})
+}
+
+// countFindings counts the findings with each key, which is how a fix is
+// checked: its finding's count must go down, and no other count up
+func countFindings(findings []auditFinding) map[string]int {
+	counts := make(map[string]int)
+	for _, f := range findings {
+		counts[f.key()]++
+	}
+	return counts
+}
+
+func runScannerTool(scanners []*auditScanner) Tool {
+	var names []string
+	for _, s := range scanners {
+		names = append(names, s.name)
+	}
+	return Tool{
+		Type: "function",
+		Function: Function{
+			Name:        "run_scanner",
+			Description: "Run a security scanner over the workspace and return its findings as JSON, to check that a fix worked",
+			Parameters: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"scanner": map[string]interface{}{
+						"type":        "string",
+						"enum":        names,
+						"description": "Scanner to run",
+					},
+					"path": map[string]interface{}{
+						"type":        "string",
+						"description": "Only return findings in this file (optional)",
+					},
+				},
+				"required": []string{"scanner"},
+			},
+		},
+	}
+}
+
+func (e *Engine) runScanner(args json.RawMessage) (string, error) {
+	var params struct {
+		Scanner string `json:"scanner"`
+		Path    string `json:"path"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return "", fmt.Errorf("invalid arguments: %v", err)
+	}
+	var scanner *auditScanner
+	for _, s := range e.auditScanners {
+		if s.name == params.Scanner {
+			scanner = s
+		}
+	}
+	if scanner == nil {
+		return "", fmt.Errorf("unknown scanner %q", params.Scanner)
+	}
+	if err := e.checkCommandPolicy(scanner.command); err != nil {
+		return "", err
+	}
+	findings, err := e.scan(scanner)
+	if err != nil {
+		return "", err
+	}
+	if params.Path != "" {
+		path := filepath.ToSlash(filepath.Clean(params.Path))
+		var matched []auditFinding
+		for _, f := range findings {
+			if f.Path == path {
+				matched = append(matched, f)
+			}
+		}
+		findings = matched
+	}
+	sortFindings(findings)
+	if findings == nil {
+		findings = []auditFinding{}
+	}
+	data, err := json.Marshal(map[string]interface{}{"count": len(findings), "findings": findings})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal findings: %v", err)
+	}
+	return string(data), nil
+}
+
+// auditor holds what runAudit needs to check and undo each fix
+type auditor struct {
+	engine *Engine
+	verify string
+
+	// latest is each scanner's findings as of the last kept fix
+	latest map[string][]auditFinding
+
+	// checkpoint is what a rejected fix is undone back to
+	checkpoint
+}
+
+// runAudit handles "wex audit", which runs security scanners, collects
+// their findings, and has the model fix them one at a time, keeping each
+// fix that the scanner and the verification command confirm
+func runAudit(engine *Engine, args []string, w io.Writer) error {
+	auditFlags := flag.NewFlagSet("audit", flag.ExitOnError)
+	scannerList := auditFlags.String("scanners", "", "Scanners to run, comma-separated, from gosec, npm and trivy (default those installed that apply to the workspace)")
+	minSeverity := auditFlags.String("severity", "medium", "Least severe findings to fix: critical, high, medium or low")
+	maxFixes := auditFlags.Int("max", 0, "Most findings to try to fix; 0 means all")
+	verify := auditFlags.String("verify", "", "Command that must pass after each fix, e.g. \"go test ./...\"")
+	retries := auditFlags.Int("retries", 1, "Times to ask again when a fix doesn't check out")
+	reportPath := auditFlags.String("report", "", "Also write the remediation report to this Markdown file")
+	jsonPath := auditFlags.String("json", "", "Also write the findings and what came of them to this JSON file")
+	scanOnly := auditFlags.Bool("scan-only", false, "Only report the findings, without fixing them")
+	auditFlags.Usage = func() {
+		fmt.Fprintf(auditFlags.Output(), "Usage: wex [flags] audit [--scanners LIST] [--severity LEVEL] [--max N] [--verify CMD] [--retries N] [--report FILE] [--json FILE] [--scan-only] [instructions]\n")
+		auditFlags.PrintDefaults()
+	}
+	auditFlags.Parse(args)
+	if _, ok := auditSeverities[*minSeverity]; !ok {
+		return fmt.Errorf("invalid --severity %q: must be critical, high, medium or low", *minSeverity)
+	}
+
+	scanners, err := engine.selectScanners(*scannerList)
+	if err != nil {
+		return err
+	}
+	a := &auditor{engine: engine, verify: *verify, latest: make(map[string][]auditFinding)}
+	var all []auditFinding
+	for _, s := range scanners {
+		fmt.Fprintf(w, "Running %s\n", s.name)
+		findings, err := engine.scan(s)
+		if err != nil {
+			return err
+		}
+		a.latest[s.name] = findings
+		all = append(all, findings...)
+	}
+	sortFindings(all)
+	var todo []int
+	for i, f := range all {
+		if auditSeverities[f.Severity] <= auditSeverities[*minSeverity] {
+			todo = append(todo, i)
+		} else {
+			all[i].Status = "skipped"
+			all[i].Note = "below --severity"
+		}
+	}
+	fmt.Fprintf(w, "%s, %d at or above %s severity\n", plural(len(all), "finding"), len(todo), *minSeverity)
+	if *maxFixes > 0 && len(todo) > *maxFixes {
+		for _, i := range todo[*maxFixes:] {
+			all[i].Status = "skipped"
+			all[i].Note = "over --max"
+		}
+		todo = todo[:*maxFixes]
+	}
+
+	if !*scanOnly && len(todo) > 0 {
+		if err := a.fixAll(all, todo, *retries, strings.Join(auditFlags.Args(), " "), w); err != nil {
+			return err
+		}
+	}
+
+	report := auditReport(all, scanners)
+	fmt.Fprintf(w, "\n%s", report)
+	if *reportPath != "" {
+		if err := os.WriteFile(*reportPath, []byte(report), 0644); err != nil {
+			return fmt.Errorf("failed to write report: %v", err)
+		}
+	}
+	if *jsonPath != "" {
+		if all == nil {
+			all = []auditFinding{}
+		}
+		data, err := json.MarshalIndent(all, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to marshal findings: %v", err)
+		}
+		if err := os.WriteFile(*jsonPath, append(data, '\n'), 0644); err != nil {
+			return fmt.Errorf("failed to write findings: %v", err)
+		}
+	}
+	return nil
+}
+
+// selectScanners picks the scanners named in list, or by default those
+// installed that have something to scan
+func (e *Engine) selectScanners(list string) ([]*auditScanner, error) {
+	var scanners []*auditScanner
+	if list == "" {
+		for _, s := range knownScanners {
+			if s.applies(e) && s.installed() && !(e.offline && s.name == "npm") {
+				scanners = append(scanners, s)
+			}
+		}
+		if len(scanners) == 0 {
+			return nil, fmt.Errorf("no scanner is installed that applies to this workspace; install gosec, npm or trivy, or name them with --scanners")
+		}
+		return scanners, nil
+	}
+	for _, name := range strings.Split(list, ",") {
+		s := findAuditScanner(strings.TrimSpace(name))
+		if s == nil {
+			return nil, fmt.Errorf("unknown scanner %q: must be gosec, npm or trivy", name)
+		}
+		if !s.installed() {
+			return nil, fmt.Errorf("%s is not installed", strings.Fields(s.command)[0])
+		}
+		if e.offline && s.name == "npm" {
+			return nil, fmt.Errorf("npm audit needs the network, and wex is running with --offline")
+		}
+		scanners = append(scanners, s)
+	}
+	return scanners, nil
+}
+
+// fixAll works through the findings to fix, staging each fix that checks
+// out and undoing the rest, so fixes never build on one that was rejected
+func (a *auditor) fixAll(all []auditFinding, todo []int, retries int, instructions string, w io.Writer) error {
+	e := a.engine
+	// Kept fixes are staged, and rejected ones undone by going back to
+	// the index, which mustn't take the user's work with it
+	if status, err := e.git("status", "--porcelain", "--untracked-files=no"); err != nil {
+		return fmt.Errorf("fixing findings needs a git repository: %v", err)
+	} else if status != "" {
+		return fmt.Errorf("there are uncommitted changes; commit or stash them first, or use --scan-only")
+	}
+	a.checkpoint = newCheckpoint(e, false)
+	if a.verify != "" {
+		if passed, output := runCheck(e.workspace, a.verify); !passed {
+			return fmt.Errorf("the verification command fails before any change:\n%s", output)
+		}
+	}
+
+	e.auditScanners = nil
+	for name := range a.latest {
+		e.auditScanners = append(e.auditScanners, findAuditScanner(name))
+	}
+	sort.Slice(e.auditScanners, func(i, j int) bool { return e.auditScanners[i].name < e.auditScanners[j].name })
+	if e.taskType == "" || e.taskType == taskTypeAuto {
+		e.taskType = "bug-fix"
+	}
+
+	ctx := context.Background()
+	fixed := 0
+	for n, i := range todo {
+		f := &all[i]
+		fmt.Fprintf(w, "\nFinding %d of %d: %s %s at %s\n", n+1, len(todo), f.Severity, f.Rule, f.location())
+		if countFindings(a.latest[f.Scanner])[f.key()] == 0 {
+			f.Status, f.Note = "fixed", "fixed along with an earlier finding"
+			fmt.Fprintf(w, "Already fixed\n")
+			continue
+		}
+
+		message := a.message(*f, instructions)
+		var verdict string
+		for attempt := 0; ; attempt++ {
+			result, err := e.Run(ctx, message)
+			if err != nil {
+				a.revert()
+				return err
+			}
+			var findings []auditFinding
+			verdict, findings = a.check(*f)
+			if findings != nil {
+				a.latest[f.Scanner] = findings
+				f.Status, f.Note = "fixed", ""
+				break
+			}
+			if attempt >= retries {
+				f.Status, f.Note = "not fixed", verdict
+				if reply := strings.TrimSpace(result.Reply); reply != "" {
+					f.Note += "; the model said: " + firstLine(reply, "")
+				}
+				break
+			}
+			e.logf("The fix didn't check out, asking again: %s", firstLine(verdict, "no reason given"))
+			a.revert()
+			message = fmt.Sprintf("%s\n\nAn earlier attempt was undone because %s. Try again.", a.message(*f, instructions), verdict)
+		}
+
+		if f.Status != "fixed" {
+			a.revert()
+			fmt.Fprintf(w, "Not fixed: %s\n", firstLine(verdict, "no reason given"))
+			continue
+		}
+		if _, err := e.git("add", "--update"); err != nil {
+			return fmt.Errorf("failed to stage the fix: %v", err)
+		}
+		if created := a.created(); len(created) > 0 {
+			if _, err := e.git(append([]string{"add", "--"}, created...)...); err != nil {
+				return fmt.Errorf("failed to stage the fix: %v", err)
+			}
+		}
+		fmt.Fprintf(w, "Fixed\n")
+		fixed++
+	}
+	if fixed > 0 {
+		fmt.Fprintf(w, "\nStaged fixes for %s; review them with git diff --cached\n", plural(fixed, "finding"))
+	}
+	return nil
+}
+
+// check decides whether to keep a fix: something must have changed,
+// without suppressing the finding, the scanner must report it fewer times
+// and nothing new, and the verification command must pass. It returns
+// why not, or the scanner's new findings if the fix is to be kept.
+func (a *auditor) check(f auditFinding) (string, []auditFinding) {
+	e := a.engine
+	diff, _ := e.git("diff")
+	if diff == "" && len(a.created()) == 0 {
+		return "nothing was changed", nil
+	}
+	for _, line := range strings.Split(diff, "\n") {
+		if strings.HasPrefix(line, "+") && (strings.Contains(line, "nosec") || strings.Contains(line, "nolint:gosec")) {
+			return "it suppressed the finding rather than fixing it", nil
+		}
+	}
+	for _, path := range a.created() {
+		if filepath.Base(path) == ".trivyignore" {
+			return "it suppressed the finding rather than fixing it", nil
+		}
+	}
+
+	findings, err := e.scan(findAuditScanner(f.Scanner))
+	if err != nil {
+		return err.Error(), nil
+	}
+	before, after := countFindings(a.latest[f.Scanner]), countFindings(findings)
+	if after[f.key()] >= before[f.key()] {
+		return fmt.Sprintf("%s still reports it", f.Scanner), nil
+	}
+	for _, g := range findings {
+		if after[g.key()] > before[g.key()] {
+			return fmt.Sprintf("%s reports a new finding: %s %s at %s", f.Scanner, g.Rule, g.Title, g.location()), nil
+		}
+	}
+	if a.verify != "" {
+		if passed, output := runCheck(e.workspace, a.verify); !passed {
+			return strings.TrimSpace(fmt.Sprintf("`%s` failed:\n%s", a.verify, output)), nil
+		}
+	}
+	if findings == nil {
+		findings = []auditFinding{}
+	}
+	return "", findings
+}
+
+// message asks for a fix to one finding
+func (a *auditor) message(f auditFinding, instructions string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Fix this security finding from %s:\n\n", f.Scanner)
+	fmt.Fprintf(&b, "- Rule: %s\n- Severity: %s\n- Where: %s\n- Problem: %s\n", f.Rule, f.Severity, f.location(), f.Title)
+	if f.FixedIn != "" {
+		fmt.Fprintf(&b, "- Fixed in: %s\n", f.FixedIn)
+	}
+	b.WriteString("\nFix the cause with the smallest change that does it, keeping what the code does. ")
+	if f.Package != "" {
+		b.WriteString("For a vulnerable dependency, upgrade it to a fixed version, updating the lock file with the package manager rather than by hand, and adapt the code if the upgrade needs it. ")
+	}
+	b.WriteString("Don't suppress the finding with comments such as #nosec, ignore files or scanner settings. ")
+	fmt.Fprintf(&b, "Check the fix with run_scanner; it is kept only if %s no longer reports this finding and reports nothing new", f.Scanner)
+	if a.verify != "" {
+		fmt.Fprintf(&b, ", and `%s` still passes", a.verify)
+	}
+	b.WriteString(". If it is a false positive, or can't be fixed safely, change nothing and say why.\n")
+	if instructions != "" {
+		fmt.Fprintf(&b, "\n%s\n", instructions)
+	}
+	return b.String()
+}
+
+// auditReport is the remediation report: counts by severity and outcome,
+// then each finding with what came of it
+func auditReport(findings []auditFinding, scanners []*auditScanner) string {
+	var b strings.Builder
+	var names []string
+	for _, s := range scanners {
+		names = append(names, s.name)
+	}
+	fmt.Fprintf(&b, "# Security audit\n\nScanners: %s\n\n", strings.Join(names, ", "))
+	if len(findings) == 0 {
+		b.WriteString("No findings.\n")
+		return b.String()
+	}
+
+	counts := make(map[string]map[string]int)
+	statuses := []string{"fixed", "not fixed", "skipped", "open"}
+	for _, f := range findings {
+		status := f.Status
+		if status == "" {
+			status = "open"
+		}
+		if counts[f.Severity] == nil {
+			counts[f.Severity] = make(map[string]int)
+		}
+		counts[f.Severity][status]++
+	}
+	b.WriteString("| Severity | Fixed | Not fixed | Skipped | Open |\n|---|---|---|---|---|\n")
+	for _, severity := range []string{"critical", "high", "medium", "low"} {
+		if counts[severity] == nil {
+			continue
+		}
+		fmt.Fprintf(&b, "| %s |", severity)
+		for _, status := range statuses {
+			fmt.Fprintf(&b, " %d |", counts[severity][status])
+		}
+		b.WriteString("\n")
+	}
+
+	b.WriteString("\n## Findings\n\n| Severity | Scanner | Rule | Where | Problem | Outcome |\n|---|---|---|---|---|---|\n")
+	cell := func(s string) string {
+		return strings.ReplaceAll(strings.ReplaceAll(s, "|", "\\|"), "\n", " ")
+	}
+	for _, f := range findings {
+		outcome := f.Status
+		if outcome == "" {
+			outcome = "open"
+		}
+		if f.Note != "" {
+			outcome += ": " + firstLine(f.Note, "")
+		}
+		problem := f.Title
+		if f.FixedIn != "" {
+			problem += " (fixed in " + f.FixedIn + ")"
+		}
+		fmt.Fprintf(&b, "| %s | %s | %s | %s | %s | %s |\n", f.Severity, f.Scanner, cell(f.Rule), cell(f.location()), cell(problem), cell(outcome))
+	}
+	return b.String()
+}
+
+// plural counts a noun, as in "1 finding" or "3 findings"
+func plural(n int, noun string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, noun)
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
@@ -0,0 +1,132 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseScanners(t *testing.T) {
+	gosec := `{"Issues": [{"severity": "HIGH", "confidence": "HIGH", "rule_id": "G304", "details": "Potential file inclusion via variable", "file": "/work/cmd/read.go", "line": "12-14"}]}`
+	findings, err := parseGosec([]byte(gosec), "/work")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(findings) != 1 || findings[0].Path != "cmd/read.go" || findings[0].Line != 12 || findings[0].Severity != "high" || findings[0].Rule != "G304" {
+		t.Errorf("gosec: %+v", findings)
+	}
+
+	npm := `{"vulnerabilities": {
+		"lodash": {"name": "lodash", "severity": "high", "range": "<4.17.21", "via": [{"source": 1, "title": "Prototype Pollution", "url": "https://github.com/advisories/GHSA-p6mc-m468-83gw"}], "fixAvailable": {"name": "lodash", "version": "4.17.21", "isSemVerMajor": false}},
+		"wrapper": {"name": "wrapper", "severity": "moderate", "range": "1.x", "via": ["lodash"], "fixAvailable": true}
+	}}`
+	findings, err = parseNpmAudit([]byte(npm), "/work")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(findings) != 2 {
+		t.Fatalf("npm: %+v", findings)
+	}
+	if f := findings[0]; f.Rule != "GHSA-p6mc-m468-83gw" || f.Title != "Prototype Pollution" || f.FixedIn != "lodash@4.17.21" || f.location() != "lodash <4.17.21 in package-lock.json" {
+		t.Errorf("npm lodash: %+v", f)
+	}
+	if f := findings[1]; f.Severity != "medium" || f.Title != "Vulnerable through lodash" || f.FixedIn != "" {
+		t.Errorf("npm wrapper: %+v", f)
+	}
+	if _, err := parseNpmAudit([]byte(`{"error": {"code": "ENOLOCK", "summary": "This command requires an existing lockfile."}}`), "/work"); err == nil || !strings.Contains(err.Error(), "lockfile") {
+		t.Errorf("npm error: %v", err)
+	}
+
+	trivy := `{"Results": [
+		{"Target": "go.mod", "Vulnerabilities": [{"VulnerabilityID": "CVE-2023-1", "PkgName": "golang.org/x/net", "InstalledVersion": "v0.1.0", "FixedVersion": "0.17.0", "Severity": "CRITICAL", "Title": "HTTP/2 rapid reset"}]},
+		{"Target": "Dockerfile", "Misconfigurations": [{"ID": "DS002", "Title": "Image user should not be root", "Message": "Specify a USER", "Severity": "HIGH", "CauseMetadata": {"StartLine": 3}}]},
+		{"Target": "config/dev.env", "Secrets": [{"RuleID": "aws-access-key-id", "Title": "AWS Access Key ID", "Severity": "CRITICAL", "StartLine": 2}]}
+	]}`
+	findings, err = parseTrivy([]byte(trivy), "/work")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(findings) != 3 || findings[0].FixedIn != "0.17.0" || findings[1].location() != "Dockerfile:3" || findings[1].Title != "Image user should not be root: Specify a USER" || findings[2].Rule != "aws-access-key-id" {
+		t.Errorf("trivy: %+v", findings)
+	}
+}
+
+func TestAudit(t *testing.T) {
+	e, provider, _ := newTestEngine(t, []ChatResponse{
+		reply("", call("write_file", `{"path": "main.go", "content": "package main\n\nimport \"crypto/md5\" // #nosec\n"}`)),
+		reply("Suppressed it"),
+		reply("", call("write_file", `{"path": "main.go", "content": "package main\n\nimport \"crypto/sha256\"\n"}`)),
+		reply("", call("run_scanner", `{"scanner": "gosec", "path": "main.go"}`)),
+		reply("Switched to SHA-256"),
+	})
+
+	// A stand-in for gosec, reporting weak hashing while main.go uses MD5,
+	// and an unchecked error that is always there
+	bin := t.TempDir()
+	script := `#!/bin/sh
+issues='{"severity": "LOW", "rule_id": "G104", "details": "Errors unhandled", "file": "'$PWD'/other.go", "line": "3"}'
+if grep -q md5 main.go; then
+	issues=$issues', {"severity": "MEDIUM", "rule_id": "G401", "details": "Use of weak cryptographic primitive", "file": "'$PWD'/main.go", "line": "3"}'
+fi
+echo '{"Issues": ['"$issues"']}'
+`
+	if err := os.WriteFile(filepath.Join(bin, "gosec"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	git := func(args ...string) string {
+		out, err := gitIn(e.workspace, append([]string{"-c", "user.name=t", "-c", "user.email=t@t"}, args...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(out)
+	}
+	writeTestFile(t, e, "go.mod", "module demo\n")
+	writeTestFile(t, e, "main.go", "package main\n\nimport \"crypto/md5\"\n")
+	writeTestFile(t, e, "other.go", "package main\n")
+	git("init", "--quiet")
+	git("add", "--all")
+	git("commit", "--quiet", "-m", "base")
+
+	var out strings.Builder
+	reportPath := filepath.Join(t.TempDir(), "audit.md")
+	err := runAudit(e, []string{"--scanners", "gosec", "--verify", "grep -q 'package main' main.go", "--report", reportPath}, &out)
+	if err != nil {
+		t.Fatalf("%v\n%s", err, out.String())
+	}
+
+	first := provider.lastMessages(t, 1)[1].Content
+	if !strings.Contains(first, "- Rule: G401") || !strings.Contains(first, "- Where: main.go:3") || !strings.Contains(first, "`grep -q 'package main' main.go` still passes") {
+		t.Errorf("first request:\n%s", first)
+	}
+	retry := provider.lastMessages(t, 3)[1].Content
+	if !strings.Contains(retry, "undone because it suppressed the finding") {
+		t.Errorf("retry request:\n%s", retry)
+	}
+	results := toolResults(provider.lastMessages(t, 5))
+	if len(results) != 2 || results[1].Content != `{"count":0,"findings":[]}` {
+		t.Errorf("tool results: %+v", results)
+	}
+
+	if staged := git("diff", "--cached", "--name-only"); staged != "main.go" {
+		t.Errorf("staged: %q", staged)
+	}
+	report, err := os.ReadFile(reportPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"| medium | 1 | 0 | 0 | 0 |",
+		"| medium | gosec | G401 | main.go:3 | Use of weak cryptographic primitive | fixed |",
+		"| low | gosec | G104 | other.go:3 | Errors unhandled | skipped: below --severity |",
+	} {
+		if !strings.Contains(string(report), want) {
+			t.Errorf("report is missing %q:\n%s", want, report)
+		}
+	}
+	if !strings.Contains(out.String(), "Staged fixes for 1 finding") {
+		t.Errorf("output:\n%s", out.String())
+	}
+}
@@ -0,0 +1,343 @@
+package agent
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// benchTasks holds the built-in benchmark tasks. Each is a directory with
+// task.json, repo, the fixture the model works on, and check, files added
+// after the run for the check command to use, such as hidden tests or
+// pristine copies of tests the model was told not to change.
+//
+//go:embed all:benchtasks
+var benchTasks embed.FS
+
+type benchTask struct {
+	Name   string `json:"-"`
+	Prompt string `json:"prompt"`
+	Check  string `json:"check"`
+
+	// Timeout is in seconds for the whole run, default 600, and MaxTurns
+	// stops a model that goes round in circles, default 30
+	Timeout  float64 `json:"timeout"`
+	MaxTurns int     `json:"max_turns"`
+
+	files fs.FS
+}
+
+// checkScriptTimeout bounds a task's check, which may run a test suite
+const checkScriptTimeout = 10 * time.Minute
+
+type benchResult struct {
+	Task       string  `json:"task"`
+	Model      string  `json:"model"`
+	Passed     bool    `json:"passed"`
+	Turns      int     `json:"turns"`
+	ToolCalls  int     `json:"tool_calls"`
+	ToolErrors int     `json:"tool_errors"`
+	Seconds    float64 `json:"seconds"`
+
+	// Error is why the run stopped, if not by the model finishing, and
+	// Output is the end of the check's output when it failed
+	Error  string `json:"error,omitempty"`
+	Output string `json:"output,omitempty"`
+}
+
+// loadBenchTasks reads the tasks in a directory of task directories,
+// keeping those named if any are
+func loadBenchTasks(fsys fs.FS, names []string) ([]*benchTask, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tasks: %v", err)
+	}
+	wanted := make(map[string]bool)
+	for _, name := range names {
+		wanted[name] = true
+	}
+
+	var tasks []*benchTask
+	for _, entry := range entries {
+		if !entry.IsDir() || len(wanted) > 0 && !wanted[entry.Name()] {
+			continue
+		}
+		delete(wanted, entry.Name())
+		data, err := fs.ReadFile(fsys, path.Join(entry.Name(), "task.json"))
+		if err != nil {
+			return nil, fmt.Errorf("task %s: %v", entry.Name(), err)
+		}
+		task := &benchTask{Name: entry.Name(), Timeout: 600, MaxTurns: 30}
+		if err := json.Unmarshal(data, task); err != nil {
+			return nil, fmt.Errorf("task %s: invalid task.json: %v", entry.Name(), err)
+		}
+		if task.Prompt == "" || task.Check == "" {
+			return nil, fmt.Errorf("task %s: task.json needs a prompt and a check", entry.Name())
+		}
+		task.files, err = fs.Sub(fsys, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, task)
+	}
+	for name := range wanted {
+		return nil, fmt.Errorf("no task named %s", name)
+	}
+	return tasks, nil
+}
+
+// copyTaskDir copies a directory of a task, if it has one, into dir
+func copyTaskDir(task *benchTask, name, dir string) error {
+	if _, err := fs.Stat(task.files, name); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return fs.WalkDir(task.files, name, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dir, filepath.FromSlash(strings.TrimPrefix(p, name)))
+		if d.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		data, err := fs.ReadFile(task.files, p)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(target, data, 0644)
+	})
+}
+
+// runBenchTask has a model carry out a task in a fresh copy of its
+// fixture, then runs the check. The workspace is returned for inspection.
+func (e *Engine) runBenchTask(task *benchTask, model string, verbose bool) (benchResult, string, error) {
+	result := benchResult{Task: task.Name, Model: model}
+	dir, err := os.MkdirTemp("", "wex-bench-"+task.Name+"-")
+	if err != nil {
+		return result, "", fmt.Errorf("failed to make workspace: %v", err)
+	}
+	if err := copyTaskDir(task, "repo", dir); err != nil {
+		return result, dir, fmt.Errorf("failed to copy fixture: %v", err)
+	}
+	if err := e.benchSession(dir, task.Prompt, model, task.Timeout, task.MaxTurns, verbose, &result); err != nil {
+		return result, dir, err
+	}
+
+	// The outcome is what counts, even if the run ended badly
+	if err := copyTaskDir(task, "check", dir); err != nil {
+		return result, dir, fmt.Errorf("failed to copy check files: %v", err)
+	}
+	result.Passed, result.Output = runCheck(dir, task.Check)
+	return result, dir, nil
+}
+
+// benchSession has a model work on a prompt in dir, with the file tools
+// confined to it, recording how the run went in result
+func (e *Engine) benchSession(dir, prompt, model string, timeout float64, maxTurns int, verbose bool, result *benchResult) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout*float64(time.Second)))
+	defer cancel()
+	var render Renderer = RendererFunc(func(Event) {})
+	if verbose {
+		render = &plainRenderer{os.Stdout}
+	}
+	tooManyTurns := false
+	events := func(event Event) {
+		switch event.Type {
+		case EventTurnStarted:
+			if event.Turn > maxTurns {
+				tooManyTurns = true
+				cancel()
+			}
+		case EventToolFinished:
+			result.ToolCalls++
+			if event.Failed {
+				result.ToolErrors++
+			}
+		}
+		render.Render(event)
+	}
+
+	// Nobody is there to approve anything, so the answer is always no. The
+	// task's directory is its own, with nobody else's work for its commands
+	// to reach, so it can run them to build and test.
+	run, err := New(WithConfinedWorkspace(dir), WithUnconfinedCommands(), WithProvider(e.client, e.ollamaURL, model),
+		WithSystemPrompt(e.systemPrompt), WithEvents(events),
+		WithApprover(func(string) bool { return false }))
+	if err != nil {
+		return err
+	}
+	run.options = e.options
+
+	start := time.Now()
+	_, err = run.Run(ctx, prompt)
+	result.Seconds = time.Since(start).Round(time.Millisecond).Seconds()
+	result.Turns = run.turn
+	switch {
+	case tooManyTurns:
+		result.Error = fmt.Sprintf("reached the turn limit of %d", maxTurns)
+	case errors.Is(err, context.DeadlineExceeded) || ctx.Err() != nil:
+		result.Error = fmt.Sprintf("timed out after %g seconds", timeout)
+	case err != nil:
+		result.Error = err.Error()
+	}
+	return nil
+}
+
+// runCheck runs a check script in dir, returning whether it succeeded, and
+// if not, the end of its output
+func runCheck(dir, script string) (bool, string) {
+	ctx, cancel := context.WithTimeout(context.Background(), checkScriptTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "sh", "-c", script)
+	cmd.Dir = dir
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return false, lastLines(string(output), 20)
+	}
+	return true, ""
+}
+
+func lastLines(s string, n int) string {
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// runBench handles "wex bench", which runs benchmark tasks against one or
+// more models and scores them
+func runBench(engine *Engine, args []string, w io.Writer) error {
+	benchFlags := flag.NewFlagSet("bench", flag.ExitOnError)
+	models := benchFlags.String("models", "", "Models to score, comma-separated (default the configured model)")
+	tasksDir := benchFlags.String("tasks", "", "Directory of task directories to run instead of the built-in tasks")
+	jsonPath := benchFlags.String("json", "", "Also write the results to this JSON file")
+	keep := benchFlags.Bool("keep", false, "Keep the workspaces for inspection instead of deleting them")
+	verbose := benchFlags.Bool("v", false, "Show each session as it runs")
+	list := benchFlags.Bool("list", false, "List the tasks and exit")
+	benchFlags.Parse(args)
+
+	var fsys fs.FS
+	if *tasksDir != "" {
+		fsys = os.DirFS(*tasksDir)
+	} else {
+		fsys, _ = fs.Sub(benchTasks, "benchtasks")
+	}
+	tasks, err := loadBenchTasks(fsys, benchFlags.Args())
+	if err != nil {
+		return err
+	}
+	if *list {
+		for _, task := range tasks {
+			fmt.Fprintf(w, "%-20s %s\n", task.Name, task.Prompt)
+		}
+		return nil
+	}
+
+	modelList := modelsOrDefault(*models, engine.model)
+
+	var results []benchResult
+	for _, model := range modelList {
+		for _, task := range tasks {
+			result, dir, err := engine.runBenchTask(task, model, *verbose)
+			if dir != "" && !*keep {
+				os.RemoveAll(dir)
+			}
+			if err != nil {
+				return fmt.Errorf("%s on %s: %v", task.Name, model, err)
+			}
+			status := "FAIL"
+			if result.Passed {
+				status = "PASS"
+			}
+			fmt.Fprintf(w, "%s  %-20s %-24s %4d turns %4d tools %7.1fs", status, task.Name, model, result.Turns, result.ToolCalls, result.Seconds)
+			if result.Error != "" {
+				fmt.Fprintf(w, "  (%s)", result.Error)
+			}
+			if *keep {
+				fmt.Fprintf(w, "  %s", dir)
+			}
+			fmt.Fprintln(w)
+			results = append(results, result)
+		}
+	}
+
+	fmt.Fprintln(w)
+	for _, line := range benchScores(results, modelList) {
+		fmt.Fprintln(w, line)
+	}
+	if *jsonPath != "" {
+		data, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(*jsonPath, append(data, '\n'), 0644); err != nil {
+			return fmt.Errorf("failed to write results: %v", err)
+		}
+	}
+	return nil
+}
+
+// modelsOrDefault parses a comma-separated list of models, which if empty
+// means the configured one
+func modelsOrDefault(list, model string) []string {
+	var models []string
+	for _, m := range strings.Split(list, ",") {
+		if m = strings.TrimSpace(m); m != "" {
+			models = append(models, m)
+		}
+	}
+	if len(models) == 0 {
+		return []string{model}
+	}
+	return models
+}
+
+// benchScores summarizes results per model, best first
+func benchScores(results []benchResult, models []string) []string {
+	type score struct {
+		model          string
+		passed, total  int
+		turns, seconds float64
+	}
+	scores := make([]*score, len(models))
+	byModel := make(map[string]*score)
+	for i, model := range models {
+		scores[i] = &score{model: model}
+		byModel[model] = scores[i]
+	}
+	for _, result := range results {
+		s := byModel[result.Model]
+		s.total++
+		if result.Passed {
+			s.passed++
+		}
+		s.turns += float64(result.Turns)
+		s.seconds += result.Seconds
+	}
+	sort.SliceStable(scores, func(i, j int) bool {
+		return scores[i].passed > scores[j].passed
+	})
+
+	var lines []string
+	for _, s := range scores {
+		if s.total == 0 {
+			continue
+		}
+		n := float64(s.total)
+		lines = append(lines, fmt.Sprintf("%-24s %d/%d passed (%.0f%%), %.1f turns and %.1fs per task",
+			s.model, s.passed, s.total, 100*float64(s.passed)/n, s.turns/n, s.seconds/n))
+	}
+	return lines
+}
@@ -0,0 +1,96 @@
+package agent
+
+import (
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestBuiltInBenchTasks(t *testing.T) {
+	fsys, _ := fs.Sub(benchTasks, "benchtasks")
+	tasks, err := loadBenchTasks(fsys, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) < 4 {
+		t.Errorf("only %d built-in tasks", len(tasks))
+	}
+	for _, task := range tasks {
+		if _, err := fs.Stat(task.files, "repo"); err != nil {
+			t.Errorf("task %s has no fixture: %v", task.Name, err)
+		}
+	}
+	if _, err := loadBenchTasks(fsys, []string{"no-such-task"}); err == nil {
+		t.Error("unknown task accepted")
+	}
+}
+
+func writeBenchTask(t *testing.T, dir, name, task string, files map[string]string) {
+	t.Helper()
+	files["task.json"] = task
+	for path, content := range files {
+		path = filepath.Join(dir, name, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRunBench(t *testing.T) {
+	tasks := t.TempDir()
+	writeBenchTask(t, tasks, "a-greeting", `{"prompt": "Write hello to out.txt", "check": "sh check.sh"}`, map[string]string{
+		"repo/README":    "A fixture.\n",
+		"check/check.sh": `grep -q hello out.txt`,
+	})
+	writeBenchTask(t, tasks, "b-dawdle", `{"prompt": "Look around", "check": "test -f out.txt", "max_turns": 1}`, map[string]string{
+		"repo/README": "Another fixture.\n",
+	})
+
+	e, provider, _ := newTestEngine(t, []ChatResponse{
+		reply("", call("write_file", `{"path": "out.txt", "content": "hello\n"}`)),
+		reply("Done."),
+		reply("", call("read_file", `{"path": "README"}`)),
+		reply("Never asked for."),
+	})
+
+	var out strings.Builder
+	results := filepath.Join(t.TempDir(), "results.json")
+	if err := runBench(e, []string{"--tasks", tasks, "--json", results}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "PASS  a-greeting") || !strings.Contains(out.String(), "FAIL  b-dawdle") ||
+		!strings.Contains(out.String(), "test-model               1/2 passed") {
+		t.Errorf("bench printed\n%s", out.String())
+	}
+	if len(provider.requests) != 3 {
+		t.Errorf("sent %d requests, want the last turn cut off", len(provider.requests))
+	}
+	if !strings.Contains(provider.requests[0].Messages[1].Content, "Write hello") {
+		t.Errorf("first request %+v", provider.requests[0])
+	}
+	// The task's workspace is confined, and its own, so it is allowed
+	// commands explicitly, to run the tests
+	if !slices.ContainsFunc(provider.requests[0].Tools, func(tool Tool) bool { return tool.Function.Name == "run_command" }) {
+		t.Error("run_command not offered to a bench task")
+	}
+
+	data, err := os.ReadFile(results)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var recorded []benchResult
+	if err := json.Unmarshal(data, &recorded); err != nil {
+		t.Fatal(err)
+	}
+	if len(recorded) != 2 || !recorded[0].Passed || recorded[0].Turns != 2 || recorded[0].ToolCalls != 1 ||
+		recorded[1].Passed || recorded[1].Error != "reached the turn limit of 1" {
+		t.Errorf("results %+v", recorded)
+	}
+}
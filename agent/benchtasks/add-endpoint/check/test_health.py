@@ -0,0 +1,36 @@
+import json
+import threading
+import unittest
+import urllib.request
+from http.server import HTTPServer
+
+import server
+
+
+class HealthTest(unittest.TestCase):
+    def setUp(self):
+        self.httpd = HTTPServer(("127.0.0.1", 0), server.Handler)
+        threading.Thread(target=self.httpd.serve_forever, daemon=True).start()
+        self.url = "http://127.0.0.1:%d" % self.httpd.server_address[1]
+
+    def tearDown(self):
+        self.httpd.shutdown()
+        self.httpd.server_close()
+
+    def get(self, path):
+        with urllib.request.urlopen(self.url + path) as resp:
+            return resp.status, resp.headers["Content-Type"], json.load(resp)
+
+    def test_health(self):
+        server.store.clear()
+        server.store.update({"a": 1, "b": 2})
+        self.assertEqual(self.get("/health"), (200, "application/json", {"status": "ok", "items": 2}))
+
+    def test_items_still_work(self):
+        server.store.clear()
+        server.store["a"] = 1
+        self.assertEqual(self.get("/items/a")[2], {"name": "a", "value": 1})
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,46 @@
+"""A small JSON API over an in-memory item store."""
+
+import json
+from http.server import BaseHTTPRequestHandler, HTTPServer
+
+store = {}
+
+
+def list_items(handler):
+    handler.send_json(200, sorted(store))
+
+
+def get_item(handler, name):
+    if name not in store:
+        handler.send_json(404, {"error": "no such item"})
+        return
+    handler.send_json(200, {"name": name, "value": store[name]})
+
+
+class Handler(BaseHTTPRequestHandler):
+    def do_GET(self):
+        if self.path == "/items":
+            list_items(self)
+        elif self.path.startswith("/items/"):
+            get_item(self, self.path[len("/items/"):])
+        else:
+            self.send_json(404, {"error": "not found"})
+
+    def send_json(self, status, body):
+        data = json.dumps(body).encode()
+        self.send_response(status)
+        self.send_header("Content-Type", "application/json")
+        self.send_header("Content-Length", str(len(data)))
+        self.end_headers()
+        self.wfile.write(data)
+
+    def log_message(self, format, *args):
+        pass
+
+
+def serve(port=8000):
+    HTTPServer(("", port), Handler).serve_forever()
+
+
+if __name__ == "__main__":
+    serve()
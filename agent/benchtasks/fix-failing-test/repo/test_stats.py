@@ -0,0 +1,21 @@
+import unittest
+
+from stats import mean, median, spread
+
+
+class StatsTest(unittest.TestCase):
+    def test_mean(self):
+        self.assertEqual(mean([1, 2, 3, 6]), 3)
+
+    def test_median_odd(self):
+        self.assertEqual(median([5, 1, 3]), 3)
+
+    def test_median_even(self):
+        self.assertEqual(median([4, 1, 3, 2]), 2.5)
+
+    def test_spread(self):
+        self.assertEqual(spread([3, 9, 4]), 6)
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,26 @@
+import unittest
+
+from duration import parse_duration
+
+
+class DurationTest(unittest.TestCase):
+    def test_valid(self):
+        for text, seconds in [
+            ("90s", 90),
+            ("15m", 900),
+            ("2h30m", 9000),
+            ("1d12h", 129600),
+            (" 1h ", 3600),
+            ("1d2h3m4s", 93784),
+            ("0s", 0),
+        ]:
+            self.assertEqual(parse_duration(text), seconds, text)
+
+    def test_invalid(self):
+        for text in ["", "   ", "10", "h", "5x", "1m2h", "1h1h", "-5s", "1.5h", "2 h"]:
+            with self.assertRaises(ValueError, msg=text):
+                parse_duration(text)
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,13 @@
+"""Parsing of human-written durations for the scheduler's config."""
+
+
+def parse_duration(text):
+    """Return the number of seconds in a duration such as "90s", "15m",
+    "2h30m" or "1d12h".
+
+    The units are d, h, m and s. Each may appear at most once, in that
+    order, and at least one must. Surrounding whitespace is ignored.
+    Raise ValueError for anything else, including an empty string, a
+    number without a unit, or a unit without a number.
+    """
+    raise NotImplementedError
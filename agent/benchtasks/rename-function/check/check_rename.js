@@ -0,0 +1,21 @@
+const assert = require("assert");
+const fs = require("fs");
+const path = require("path");
+
+const dates = require("./src/dates");
+const { reportHeader } = require("./src/report");
+const { invoiceLine } = require("./src/invoice");
+
+assert.strictEqual(typeof dates.formatDate, "function", "formatDate is not exported");
+assert.strictEqual(dates.fmtDate, undefined, "fmtDate is still exported");
+assert.strictEqual(dates.formatDate(new Date(Date.UTC(2024, 0, 5))), "2024-01-05");
+assert.strictEqual(
+  reportHeader(new Date(Date.UTC(2024, 0, 1)), new Date(Date.UTC(2024, 0, 31))),
+  "Report from 2024-01-01 to 2024-01-31 (30 days)"
+);
+assert.strictEqual(invoiceLine({ name: "Widget", amount: 5 }, new Date(Date.UTC(2024, 1, 2))), "Widget: 5.00, due 2024-02-02");
+
+for (const file of fs.readdirSync("src")) {
+  const text = fs.readFileSync(path.join("src", file), "utf8");
+  assert(!text.includes("fmtDate"), `${file} still mentions fmtDate`);
+}
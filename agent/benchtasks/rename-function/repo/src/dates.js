@@ -0,0 +1,15 @@
+// Date helpers shared by the report and invoice pages
+
+function pad(n) {
+  return String(n).padStart(2, "0");
+}
+
+function fmtDate(date) {
+  return `${date.getUTCFullYear()}-${pad(date.getUTCMonth() + 1)}-${pad(date.getUTCDate())}`;
+}
+
+function daysBetween(a, b) {
+  return Math.round((b - a) / 86400000);
+}
+
+module.exports = { fmtDate, daysBetween };
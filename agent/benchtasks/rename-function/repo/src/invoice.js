@@ -0,0 +1,7 @@
+const dates = require("./dates");
+
+function invoiceLine(item, due) {
+  return `${item.name}: ${item.amount.toFixed(2)}, due ${dates.fmtDate(due)}`;
+}
+
+module.exports = { invoiceLine };
@@ -0,0 +1,7 @@
+const { fmtDate, daysBetween } = require("./dates");
+
+function reportHeader(start, end) {
+  return `Report from ${fmtDate(start)} to ${fmtDate(end)} (${daysBetween(start, end)} days)`;
+}
+
+module.exports = { reportHeader };
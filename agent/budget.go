@@ -0,0 +1,134 @@
+package agent
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DiffBudget limits how much the file tools may change in one turn, so a
+// misunderstood request can't rewrite half the project before anyone
+// looks. A turn that would go over needs approval; refused, the model is
+// told to work in smaller steps. Zero limits mean unlimited. Changes are
+// measured against each file as it was when the turn started, so writing
+// a file twice in a turn counts once. Every file tool that writes is
+// charged: write_file and the other text edits, replace_across_files,
+// the archive tools and the image tools. Commands are not counted, nor are
+// the dependency manifests put back after a dependency with a license
+// that isn't allowed, which undoes a change already counted.
+type DiffBudget struct {
+	MaxLines int
+	MaxFiles int
+
+	mu       sync.Mutex
+	original map[string]string
+	changed  map[string]int
+	approved bool
+}
+
+// budgetWrite is a file about to be written, with its content before and
+// after; before is empty for a new file
+type budgetWrite struct {
+	path, before, after string
+}
+
+// startTurn forgets what earlier turns changed
+func (b *DiffBudget) startTurn() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.original = nil
+	b.changed = nil
+	b.approved = false
+}
+
+// spendDiffBudget accounts for writes about to be made, asking for approval
+// if they would take the turn over budget, and rejecting them if refused
+func (e *Engine) spendDiffBudget(writes ...budgetWrite) error {
+	b := &e.diffBudget
+	if !b.enabled() {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	changed := make(map[string]int)
+	for path, n := range b.changed {
+		changed[path] = n
+	}
+	for _, w := range writes {
+		before, ok := b.original[w.path]
+		if !ok {
+			before = w.before
+		}
+		changed[w.path] = changedLineCount(before, w.after)
+	}
+	lines, files := 0, 0
+	for _, n := range changed {
+		if n > 0 {
+			lines += n
+			files++
+		}
+	}
+
+	over := (b.MaxLines > 0 && lines > b.MaxLines) || (b.MaxFiles > 0 && files > b.MaxFiles)
+	if over && !b.approved {
+		summary := fmt.Sprintf("this turn would change %d lines in %d files (%s), over the per-turn limit of %s",
+			lines, files, e.relativePaths(strings.Join(changedFiles(changed), ", ")), b.limits())
+		if !e.askApproval("Large change: " + summary) {
+			return fmt.Errorf("change refused: %s. Split the work into smaller steps, changing less in each turn", summary)
+		}
+		b.approved = true
+	}
+
+	if b.original == nil {
+		b.original = make(map[string]string)
+	}
+	for _, w := range writes {
+		if _, ok := b.original[w.path]; !ok {
+			b.original[w.path] = w.before
+		}
+	}
+	b.changed = changed
+	return nil
+}
+
+func (b *DiffBudget) enabled() bool {
+	return b.MaxLines > 0 || b.MaxFiles > 0
+}
+
+func (b *DiffBudget) limits() string {
+	var limits []string
+	if b.MaxLines > 0 {
+		limits = append(limits, fmt.Sprintf("%d lines", b.MaxLines))
+	}
+	if b.MaxFiles > 0 {
+		limits = append(limits, fmt.Sprintf("%d files", b.MaxFiles))
+	}
+	return strings.Join(limits, " and ")
+}
+
+func changedFiles(changed map[string]int) []string {
+	var paths []string
+	for path, n := range changed {
+		if n > 0 {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// changedLineCount is the number of lines added or removed
+func changedLineCount(before, after string) int {
+	if before == after {
+		return 0
+	}
+	n := 0
+	for _, op := range diffLines(splitLines(before), splitLines(after)) {
+		if op.kind != ' ' {
+			n++
+		}
+	}
+	return n
+}
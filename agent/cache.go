@@ -0,0 +1,65 @@
+package agent
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// commandCacheTurns is how many model turns a cached command result stays
+// valid for, provided nothing is written in the meantime
+const commandCacheTurns = 5
+
+// cachedCommand is the result of a read-only command and the turn it ran in
+type cachedCommand struct {
+	result CommandResult
+	turn   int
+}
+
+// volatileCommands are read-only but give a different result each time
+var volatileCommands = map[string]bool{"date": true, "ps": true, "sleep": true}
+
+// isCacheableCommand reports whether a command is read-only, so that
+// repeating it gives the same result until something is written. Programs
+// are looked for past wrappers such as env and command, as the classifier
+// does.
+func isCacheableCommand(command string) bool {
+	if classifyCommand(command) != classReadOnly {
+		return false
+	}
+	commands, _ := parseShell(command)
+	for _, c := range commands {
+		if words, _ := programWords(c.words); len(words) > 0 && volatileCommands[filepath.Base(words[0])] {
+			return false
+		}
+	}
+	return true
+}
+
+func commandCacheKey(command, input, cwd string) string {
+	return cwd + "\x00" + input + "\x00" + command
+}
+
+// cachedResult returns the earlier result of a repeated read-only command,
+// with a note saying so
+func (e *Engine) cachedResult(key string) (CommandResult, bool) {
+	cached, ok := e.commandCache[key]
+	if !ok || e.turn-cached.turn > commandCacheTurns {
+		return CommandResult{}, false
+	}
+	result := cached.result
+	result.Note = fmt.Sprintf("Cached result of the same command %d turn(s) ago; no files have been written or other commands run since", e.turn-cached.turn)
+	return result, true
+}
+
+func (e *Engine) cacheResult(key string, result CommandResult) {
+	if e.commandCache == nil {
+		e.commandCache = make(map[string]cachedCommand)
+	}
+	e.commandCache[key] = cachedCommand{result: result, turn: e.turn}
+}
+
+// invalidateCommandCache is called whenever something may have changed the
+// workspace
+func (e *Engine) invalidateCommandCache() {
+	e.commandCache = nil
+}
@@ -0,0 +1,25 @@
+package agent
+
+import "testing"
+
+func TestIsCacheableCommand(t *testing.T) {
+	for command, want := range map[string]bool{
+		"ls -la":                    true,
+		"git status":                true,
+		"cat a.txt | grep x":        true,
+		"date":                      false,
+		"env date":                  false,
+		"command ps aux":            false,
+		"/bin/date +%s":             false,
+		"TZ=UTC date":               false,
+		"echo $(date)":              false,
+		"git -c core.pager=cat log": false,
+		"sed -n 'w out' f":          false,
+		"rg --pre ./evil.sh foo":    false,
+		"touch x":                   false,
+	} {
+		if got := isCacheableCommand(command); got != want {
+			t.Errorf("%s cacheable is %v, want %v", command, got, want)
+		}
+	}
+}
@@ -0,0 +1,800 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// dimension is a quantity's exponents of length, mass, time, data and
+// temperature, e.g. speed is {1, 0, -1, 0, 0}
+type dimension [5]int
+
+var baseUnitNames = [5]string{"m", "kg", "s", "B", "K"}
+
+// calcUnit is a unit a number can be written in; a value is held in base
+// units as number*factor + offset
+type calcUnit struct {
+	factor float64
+	offset float64
+	dim    dimension
+	months int // calendar months, for month and year
+}
+
+var (
+	dimLength      = dimension{1, 0, 0, 0, 0}
+	dimMass        = dimension{0, 1, 0, 0, 0}
+	dimTime        = dimension{0, 0, 1, 0, 0}
+	dimData        = dimension{0, 0, 0, 1, 0}
+	dimTemperature = dimension{0, 0, 0, 0, 1}
+	dimVolume      = dimension{3, 0, 0, 0, 0}
+	dimSpeed       = dimension{1, 0, -1, 0, 0}
+)
+
+const secondsPerDay = 86400
+
+var calcUnits = map[string]calcUnit{
+	"m": {1, 0, dimLength, 0}, "km": {1000, 0, dimLength, 0}, "cm": {0.01, 0, dimLength, 0},
+	"mm": {0.001, 0, dimLength, 0}, "um": {1e-6, 0, dimLength, 0}, "nm": {1e-9, 0, dimLength, 0},
+	"mi": {1609.344, 0, dimLength, 0}, "yd": {0.9144, 0, dimLength, 0}, "ft": {0.3048, 0, dimLength, 0},
+	"in": {0.0254, 0, dimLength, 0}, "nmi": {1852, 0, dimLength, 0},
+
+	"g": {0.001, 0, dimMass, 0}, "kg": {1, 0, dimMass, 0}, "mg": {1e-6, 0, dimMass, 0},
+	"t": {1000, 0, dimMass, 0}, "lb": {0.45359237, 0, dimMass, 0}, "oz": {0.028349523125, 0, dimMass, 0},
+
+	"s": {1, 0, dimTime, 0}, "ms": {0.001, 0, dimTime, 0}, "us": {1e-6, 0, dimTime, 0},
+	"ns": {1e-9, 0, dimTime, 0}, "min": {60, 0, dimTime, 0}, "h": {3600, 0, dimTime, 0},
+	"day": {secondsPerDay, 0, dimTime, 0}, "week": {7 * secondsPerDay, 0, dimTime, 0},
+	"month": {365.2425 * secondsPerDay / 12, 0, dimTime, 1}, "year": {365.2425 * secondsPerDay, 0, dimTime, 12},
+
+	"B": {1, 0, dimData, 0}, "bit": {0.125, 0, dimData, 0},
+	"KB": {1e3, 0, dimData, 0}, "MB": {1e6, 0, dimData, 0}, "GB": {1e9, 0, dimData, 0},
+	"TB": {1e12, 0, dimData, 0}, "PB": {1e15, 0, dimData, 0},
+	"KiB": {1 << 10, 0, dimData, 0}, "MiB": {1 << 20, 0, dimData, 0}, "GiB": {1 << 30, 0, dimData, 0},
+	"TiB": {1 << 40, 0, dimData, 0}, "PiB": {1 << 50, 0, dimData, 0},
+
+	"K": {1, 0, dimTemperature, 0}, "C": {1, 273.15, dimTemperature, 0}, "F": {5.0 / 9, 273.15 - 32*5.0/9, dimTemperature, 0},
+
+	"L": {0.001, 0, dimVolume, 0}, "mL": {1e-6, 0, dimVolume, 0}, "gal": {0.003785411784, 0, dimVolume, 0},
+
+	"mph": {0.44704, 0, dimSpeed, 0}, "kph": {1 / 3.6, 0, dimSpeed, 0}, "knot": {1852.0 / 3600, 0, dimSpeed, 0},
+}
+
+// unitAliases maps other spellings to the names in calcUnits
+var unitAliases = map[string]string{
+	"meter": "m", "meters": "m", "metre": "m", "metres": "m", "mile": "mi", "miles": "mi",
+	"yard": "yd", "yards": "yd", "foot": "ft", "feet": "ft", "inch": "in", "inches": "in",
+	"gram": "g", "grams": "g", "kilogram": "kg", "kilograms": "kg", "tonne": "t", "tonnes": "t",
+	"lbs": "lb", "pound": "lb", "pounds": "lb", "ounce": "oz", "ounces": "oz",
+	"sec": "s", "secs": "s", "second": "s", "seconds": "s", "mins": "min", "minute": "min", "minutes": "min",
+	"hr": "h", "hrs": "h", "hour": "h", "hours": "h", "d": "day", "days": "day",
+	"wk": "week", "weeks": "week", "months": "month", "yr": "year", "yrs": "year", "years": "year",
+	"byte": "B", "bytes": "B", "bits": "bit", "kB": "KB",
+	"degC": "C", "celsius": "C", "degF": "F", "fahrenheit": "F", "kelvin": "K",
+	"l": "L", "liter": "L", "liters": "L", "litre": "L", "litres": "L", "ml": "mL",
+	"gallon": "gal", "gallons": "gal", "kmh": "kph", "knots": "knot", "kn": "knot",
+}
+
+func lookupUnit(name string) (calcUnit, bool) {
+	if alias, ok := unitAliases[name]; ok {
+		name = alias
+	}
+	unit, ok := calcUnits[name]
+	return unit, ok
+}
+
+// calcValue is a number, a quantity with a dimension, or a date
+type calcValue struct {
+	num float64 // in base units
+	dim dimension
+
+	// label and factor say how to show a quantity, in the unit it was
+	// written in; an empty label means base units
+	label  string
+	factor float64
+	offset float64
+
+	// months is set for a whole number of months or years, which are added
+	// to dates by the calendar
+	months int
+
+	date    time.Time
+	isDate  bool
+	hasTime bool
+}
+
+func (v calcValue) dimensionless() bool {
+	return v.dim == dimension{} && !v.isDate
+}
+
+var calcFunctions = map[string]func(float64) float64{
+	"sqrt": math.Sqrt, "cbrt": math.Cbrt, "abs": math.Abs, "floor": math.Floor, "ceil": math.Ceil,
+	"round": math.Round, "trunc": math.Trunc, "exp": math.Exp, "ln": math.Log, "log": math.Log10,
+	"log10": math.Log10, "log2": math.Log2, "sin": math.Sin, "cos": math.Cos, "tan": math.Tan,
+	"asin": math.Asin, "acos": math.Acos, "atan": math.Atan, "sinh": math.Sinh, "cosh": math.Cosh,
+	"tanh": math.Tanh, "deg": func(x float64) float64 { return x * 180 / math.Pi },
+	"rad": func(x float64) float64 { return x * math.Pi / 180 },
+}
+
+var calcConstants = map[string]float64{
+	"pi": math.Pi, "e": math.E, "tau": 2 * math.Pi, "phi": math.Phi,
+}
+
+// calcToken is a number, date, identifier or operator in an expression
+type calcToken struct {
+	kind string // "number", "date", "ident", "op" or "end"
+	text string
+	num  float64
+	date time.Time
+	time bool // date with a time of day
+}
+
+var (
+	dateLiteral   = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}(T\d{2}:\d{2}(:\d{2})?(Z|[+-]\d{2}:\d{2})?)?`)
+	numberLiteral = regexp.MustCompile(`^(0[xX][0-9a-fA-F_]+|0[bB][01_]+|0[oO][0-7_]+|(\d[\d_]*\.?\d*|\.\d+)([eE][+-]?\d+)?)`)
+)
+
+func tokenizeCalc(expr string) ([]calcToken, error) {
+	var tokens []calcToken
+	for i := 0; i < len(expr); {
+		c := rune(expr[i])
+		rest := expr[i:]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case dateLiteral.MatchString(rest):
+			text := dateLiteral.FindString(rest)
+			date, err := parseCalcDate(text)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, calcToken{kind: "date", text: text, date: date, time: strings.Contains(text, "T")})
+			i += len(text)
+		case unicode.IsDigit(c) || c == '.':
+			text := numberLiteral.FindString(rest)
+			if text == "" {
+				return nil, fmt.Errorf("unexpected %q", c)
+			}
+			num, err := parseCalcNumber(strings.ReplaceAll(text, "_", ""))
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %q", text)
+			}
+			tokens = append(tokens, calcToken{kind: "number", text: text, num: num})
+			i += len(text)
+		case unicode.IsLetter(c) || c == '_':
+			j := i
+			for j < len(expr) && (unicode.IsLetter(rune(expr[j])) || unicode.IsDigit(rune(expr[j])) || expr[j] == '_') {
+				j++
+			}
+			tokens = append(tokens, calcToken{kind: "ident", text: expr[i:j]})
+			i = j
+		case strings.HasPrefix(rest, "**"):
+			tokens = append(tokens, calcToken{kind: "op", text: "^"})
+			i += 2
+		case strings.ContainsRune("+-*/%^(),", c):
+			tokens = append(tokens, calcToken{kind: "op", text: string(c)})
+			i++
+		default:
+			return nil, fmt.Errorf("unexpected %q", rest[:1])
+		}
+	}
+	return append(tokens, calcToken{kind: "end"}), nil
+}
+
+func parseCalcNumber(text string) (float64, error) {
+	if len(text) > 2 && text[0] == '0' && strings.ContainsRune("xXbBoO", rune(text[1])) {
+		n, err := strconv.ParseInt(text, 0, 64)
+		return float64(n), err
+	}
+	return strconv.ParseFloat(text, 64)
+}
+
+func parseCalcDate(text string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02T15:04Z07:00", "2006-01-02T15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, text, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date %q", text)
+}
+
+// calcParser evaluates an expression as it parses it, by recursive descent
+type calcParser struct {
+	tokens []calcToken
+	pos    int
+	now    time.Time
+}
+
+func (p *calcParser) peek() calcToken {
+	return p.tokens[p.pos]
+}
+
+func (p *calcParser) next() calcToken {
+	t := p.tokens[p.pos]
+	if t.kind != "end" {
+		p.pos++
+	}
+	return t
+}
+
+func (p *calcParser) isOp(text string) bool {
+	t := p.peek()
+	return t.kind == "op" && t.text == text
+}
+
+func (p *calcParser) expect(text string) error {
+	if !p.isOp(text) {
+		return fmt.Errorf("expected %q", text)
+	}
+	p.next()
+	return nil
+}
+
+// atUnit reports whether the next token starts a unit. "in" is a unit
+// unless it is followed by one, as in "5 ft in m".
+func (p *calcParser) atUnit() bool {
+	t := p.peek()
+	if t.kind != "ident" || p.tokens[p.pos+1].kind == "op" && p.tokens[p.pos+1].text == "(" {
+		return false
+	}
+	if _, ok := lookupUnit(t.text); !ok {
+		return false
+	}
+	if t.text == "in" {
+		after := p.tokens[p.pos+1]
+		if _, ok := lookupUnit(after.text); ok && after.kind == "ident" && after.text != "in" {
+			return false
+		}
+	}
+	return true
+}
+
+// conversion: additive [("to" | "in" | "as") target]
+func (p *calcParser) conversion() (calcValue, string, error) {
+	v, err := p.additive()
+	if err != nil {
+		return v, "", err
+	}
+	t := p.peek()
+	if t.kind != "ident" || t.text != "to" && t.text != "in" && t.text != "as" {
+		return v, "", nil
+	}
+	p.next()
+
+	target := p.peek()
+	if target.kind == "ident" {
+		switch strings.ToLower(target.text) {
+		case "hex", "binary", "bin", "octal", "oct":
+			p.next()
+			s, err := formatInBase(v, strings.ToLower(target.text))
+			return v, s, err
+		}
+	}
+	unit, label, err := p.unitExpr()
+	if err != nil {
+		return v, "", err
+	}
+	if v.isDate || unit.dim != v.dim {
+		return v, "", fmt.Errorf("cannot convert %s to %s", describe(v), label)
+	}
+	v.label, v.factor, v.offset = label, unit.factor, unit.offset
+	return v, "", nil
+}
+
+// unitExpr: name ["^" int] (("*" | "/") name ["^" int])*
+func (p *calcParser) unitExpr() (calcUnit, string, error) {
+	unit := calcUnit{factor: 1}
+	var label strings.Builder
+	op := "*"
+	for {
+		t := p.next()
+		u, ok := lookupUnit(t.text)
+		if t.kind != "ident" || !ok {
+			return unit, "", fmt.Errorf("unknown unit %q", t.text)
+		}
+		label.WriteString(t.text)
+		exp := 1
+		if p.isOp("^") && p.tokens[p.pos+1].kind == "number" {
+			p.next()
+			n := p.next()
+			exp = int(n.num)
+			label.WriteString("^" + n.text)
+		}
+		if op == "/" {
+			exp = -exp
+		}
+		if u.offset != 0 && (exp != 1 || label.Len() != len(t.text)) {
+			return unit, "", fmt.Errorf("%s can only be used on its own", t.text)
+		}
+		unit.factor *= math.Pow(u.factor, float64(exp))
+		unit.offset = u.offset
+		for i := range unit.dim {
+			unit.dim[i] += u.dim[i] * exp
+		}
+		if exp == 1 || exp == -1 {
+			unit.months = u.months
+		}
+
+		if (p.isOp("/") || p.isOp("*")) && p.tokens[p.pos+1].kind == "ident" {
+			if _, ok := lookupUnit(p.tokens[p.pos+1].text); ok {
+				op = p.next().text
+				label.WriteString(op)
+				unit.months = 0
+				continue
+			}
+		}
+		return unit, label.String(), nil
+	}
+}
+
+// additive: multiplicative (("+" | "-") multiplicative)*
+func (p *calcParser) additive() (calcValue, error) {
+	v, err := p.multiplicative()
+	if err != nil {
+		return v, err
+	}
+	for p.isOp("+") || p.isOp("-") {
+		op := p.next().text
+		w, err := p.multiplicative()
+		if err != nil {
+			return v, err
+		}
+		if v, err = addValues(v, w, op == "-"); err != nil {
+			return v, err
+		}
+	}
+	return v, nil
+}
+
+// multiplicative: unary (("*" | "/" | "%") unary)*
+func (p *calcParser) multiplicative() (calcValue, error) {
+	v, err := p.unary()
+	if err != nil {
+		return v, err
+	}
+	for p.isOp("*") || p.isOp("/") || p.isOp("%") {
+		op := p.next().text
+		w, err := p.unary()
+		if err != nil {
+			return v, err
+		}
+		if v, err = multiplyValues(v, w, op); err != nil {
+			return v, err
+		}
+	}
+	return v, nil
+}
+
+// unary: ("-" | "+") unary | power
+func (p *calcParser) unary() (calcValue, error) {
+	if p.isOp("-") || p.isOp("+") {
+		op := p.next().text
+		v, err := p.unary()
+		if err != nil || op == "+" {
+			return v, err
+		}
+		if v.isDate || v.offset != 0 {
+			return v, fmt.Errorf("cannot negate %s", describe(v))
+		}
+		v.num, v.months = -v.num, -v.months
+		return v, nil
+	}
+	return p.power()
+}
+
+// power: quantity ["^" unary]
+func (p *calcParser) power() (calcValue, error) {
+	v, err := p.quantity()
+	if err != nil {
+		return v, err
+	}
+	if !p.isOp("^") {
+		return v, nil
+	}
+	p.next()
+	w, err := p.unary()
+	if err != nil {
+		return v, err
+	}
+	if !w.dimensionless() {
+		return v, fmt.Errorf("exponent must be a plain number, not %s", describe(w))
+	}
+	if v.isDate || v.offset != 0 {
+		return v, fmt.Errorf("cannot raise %s to a power", describe(v))
+	}
+	if !v.dimensionless() {
+		if w.num != math.Trunc(w.num) {
+			return v, fmt.Errorf("a quantity can only be raised to a whole power")
+		}
+		for i := range v.dim {
+			v.dim[i] *= int(w.num)
+		}
+		v.label, v.months = "", 0
+	}
+	v.num = math.Pow(v.num, w.num)
+	return v, nil
+}
+
+// quantity: primary [unitExpr]
+func (p *calcParser) quantity() (calcValue, error) {
+	v, err := p.primary()
+	if err != nil || !p.atUnit() {
+		return v, err
+	}
+	if !v.dimensionless() {
+		return v, fmt.Errorf("unexpected unit after %s", describe(v))
+	}
+	unit, label, err := p.unitExpr()
+	if err != nil {
+		return v, err
+	}
+	return applyUnit(v.num, unit, label), nil
+}
+
+func applyUnit(n float64, unit calcUnit, label string) calcValue {
+	v := calcValue{
+		num:    n*unit.factor + unit.offset,
+		dim:    unit.dim,
+		label:  label,
+		factor: unit.factor,
+		offset: unit.offset,
+	}
+	if unit.months != 0 && n == math.Trunc(n) {
+		v.months = int(n) * unit.months
+	}
+	return v
+}
+
+// primary: number | date | constant | unit | function "(" args ")" | "(" conversion ")"
+func (p *calcParser) primary() (calcValue, error) {
+	t := p.next()
+	switch t.kind {
+	case "number":
+		return calcValue{num: t.num}, nil
+	case "date":
+		return calcValue{date: t.date, isDate: true, hasTime: t.time}, nil
+	case "op":
+		if t.text != "(" {
+			return calcValue{}, fmt.Errorf("unexpected %q", t.text)
+		}
+		v, formatted, err := p.conversion()
+		if err != nil {
+			return v, err
+		}
+		if formatted != "" {
+			return v, fmt.Errorf("base conversion must come last")
+		}
+		return v, p.expect(")")
+	case "ident":
+		if p.isOp("(") {
+			return p.call(t.text)
+		}
+		switch t.text {
+		case "now":
+			return calcValue{date: p.now, isDate: true, hasTime: true}, nil
+		case "today":
+			y, m, d := p.now.Date()
+			return calcValue{date: time.Date(y, m, d, 0, 0, 0, 0, p.now.Location()), isDate: true}, nil
+		}
+		if c, ok := calcConstants[t.text]; ok {
+			return calcValue{num: c}, nil
+		}
+		if _, ok := lookupUnit(t.text); ok {
+			p.pos--
+			unit, label, err := p.unitExpr()
+			return applyUnit(1, unit, label), err
+		}
+		return calcValue{}, fmt.Errorf("unknown name %q", t.text)
+	case "end":
+		return calcValue{}, fmt.Errorf("unexpected end of expression")
+	}
+	return calcValue{}, fmt.Errorf("unexpected %q", t.text)
+}
+
+// call evaluates a function; min, max and abs work on quantities of one
+// dimension, the rest on plain numbers
+func (p *calcParser) call(name string) (calcValue, error) {
+	p.next()
+	var args []calcValue
+	for !p.isOp(")") {
+		v, formatted, err := p.conversion()
+		if err != nil {
+			return v, err
+		}
+		if formatted != "" {
+			return v, fmt.Errorf("base conversion must come last")
+		}
+		args = append(args, v)
+		if !p.isOp(",") {
+			break
+		}
+		p.next()
+	}
+	if err := p.expect(")"); err != nil {
+		return calcValue{}, err
+	}
+	if len(args) == 0 {
+		return calcValue{}, fmt.Errorf("%s needs an argument", name)
+	}
+	for _, a := range args {
+		if a.isDate || a.dim != args[0].dim {
+			return calcValue{}, fmt.Errorf("%s arguments must be numbers or quantities of one kind", name)
+		}
+	}
+
+	switch name {
+	case "min", "max":
+		v := args[0]
+		for _, a := range args[1:] {
+			if name == "min" && a.num < v.num || name == "max" && a.num > v.num {
+				v = a
+			}
+		}
+		return v, nil
+	case "abs":
+		if len(args) == 1 && args[0].offset == 0 {
+			v := args[0]
+			v.num = math.Abs(v.num)
+			return v, nil
+		}
+	case "pow", "hypot", "atan2":
+		if len(args) != 2 || !args[0].dimensionless() {
+			return calcValue{}, fmt.Errorf("%s takes two numbers", name)
+		}
+		f := map[string]func(float64, float64) float64{"pow": math.Pow, "hypot": math.Hypot, "atan2": math.Atan2}[name]
+		return calcValue{num: f(args[0].num, args[1].num)}, nil
+	}
+
+	f, ok := calcFunctions[name]
+	if !ok {
+		return calcValue{}, fmt.Errorf("unknown function %q", name)
+	}
+	if len(args) != 1 || !args[0].dimensionless() {
+		return calcValue{}, fmt.Errorf("%s takes one number", name)
+	}
+	return calcValue{num: f(args[0].num)}, nil
+}
+
+func addValues(v, w calcValue, subtract bool) (calcValue, error) {
+	sign := 1.0
+	if subtract {
+		sign = -1
+	}
+	verb := map[bool]string{false: "add", true: "subtract"}[subtract]
+
+	switch {
+	case v.isDate && w.isDate && subtract:
+		d := calcValue{num: v.date.Sub(w.date).Seconds(), dim: dimTime, label: "days", factor: secondsPerDay}
+		if v.hasTime || w.hasTime {
+			d.label, d.factor = "hours", 3600
+		}
+		return d, nil
+	case v.isDate && w.dim == dimTime, w.isDate && w.dim == dimTime && !subtract:
+		if w.isDate {
+			v, w = w, v
+		}
+		if w.months != 0 && !v.hasTime {
+			v.date = addMonths(v.date, int(sign)*w.months)
+		} else {
+			v.date = v.date.Add(time.Duration(sign * w.num * float64(time.Second)))
+			if w.num != math.Trunc(w.num/secondsPerDay)*secondsPerDay {
+				v.hasTime = true
+			}
+		}
+		return v, nil
+	case v.isDate || w.isDate:
+		return v, fmt.Errorf("cannot %s %s and %s", verb, describe(v), describe(w))
+	case v.dim != w.dim:
+		return v, fmt.Errorf("cannot %s %s and %s", verb, describe(v), describe(w))
+	case v.offset != 0 || w.offset != 0:
+		return v, fmt.Errorf("cannot %s temperatures in %s; use K", verb, v.label)
+	}
+
+	v.num += sign * w.num
+	v.months += int(sign) * w.months
+	if v.label == "" {
+		v.label, v.factor = w.label, w.factor
+	}
+	return v, nil
+}
+
+// addMonths adds calendar months, keeping to the end of a shorter month,
+// so Jan 31 + 1 month is Feb 28 or 29 rather than early March
+func addMonths(t time.Time, months int) time.Time {
+	y, m, d := t.Date()
+	first := time.Date(y, m+time.Month(months), 1, 0, 0, 0, 0, t.Location())
+	last := first.AddDate(0, 1, -1).Day()
+	return first.AddDate(0, 0, min(d, last)-1)
+}
+
+func multiplyValues(v, w calcValue, op string) (calcValue, error) {
+	if v.isDate || w.isDate || v.offset != 0 || w.offset != 0 {
+		return v, fmt.Errorf("cannot use %q on %s and %s", op, describe(v), describe(w))
+	}
+	if op == "%" {
+		if v.dim != w.dim {
+			return v, fmt.Errorf("cannot take %s modulo %s", describe(v), describe(w))
+		}
+		v.num = math.Mod(v.num, w.num)
+		v.months = 0
+		return v, nil
+	}
+
+	months := 0
+	sign := 1
+	if op == "/" {
+		sign = -1
+		if w.num == 0 {
+			return v, fmt.Errorf("division by zero")
+		}
+		v.num /= w.num
+	} else {
+		v.num *= w.num
+		switch {
+		case v.months != 0 && w.dimensionless() && w.num == math.Trunc(w.num):
+			months = v.months * int(w.num)
+		case w.months != 0 && v.dimensionless() && v.num/w.num == math.Trunc(v.num/w.num):
+			months = w.months * int(v.num/w.num)
+		}
+	}
+	v.months = months
+
+	switch {
+	case w.dimensionless():
+	case v.dimensionless() && op == "*":
+		v.label, v.factor = w.label, w.factor
+	default:
+		v.label = ""
+	}
+	for i := range v.dim {
+		v.dim[i] += sign * w.dim[i]
+	}
+	if v.dimensionless() {
+		v.label = ""
+	}
+	return v, nil
+}
+
+// describe names a value's kind for error messages
+func describe(v calcValue) string {
+	switch {
+	case v.isDate:
+		return "a date"
+	case v.dimensionless():
+		return "a number"
+	case v.label != "":
+		return v.label
+	}
+	return baseUnitLabel(v.dim)
+}
+
+// baseUnitLabel writes a dimension in base units, e.g. m/s^2
+func baseUnitLabel(dim dimension) string {
+	var num, den []string
+	for i, exp := range dim {
+		name := baseUnitNames[i]
+		switch {
+		case exp == 1:
+			num = append(num, name)
+		case exp > 1:
+			num = append(num, fmt.Sprintf("%s^%d", name, exp))
+		case exp == -1:
+			den = append(den, name)
+		case exp < -1:
+			den = append(den, fmt.Sprintf("%s^%d", name, -exp))
+		}
+	}
+	s := strings.Join(num, "*")
+	if s == "" {
+		s = "1"
+	}
+	if len(den) > 0 {
+		s += "/" + strings.Join(den, "/")
+	}
+	return s
+}
+
+// formatNumber shows a number without float noise, e.g. 0.1+0.2 as 0.3
+func formatNumber(n float64) string {
+	n, _ = strconv.ParseFloat(strconv.FormatFloat(n, 'g', 12, 64), 64)
+	if n == math.Trunc(n) && math.Abs(n) < 1e15 {
+		return strconv.FormatFloat(n, 'f', -1, 64)
+	}
+	return strconv.FormatFloat(n, 'g', -1, 64)
+}
+
+func formatValue(v calcValue) string {
+	switch {
+	case v.isDate:
+		if v.hasTime {
+			return v.date.Format(time.RFC3339) + " (" + v.date.Weekday().String() + ")"
+		}
+		return v.date.Format("2006-01-02") + " (" + v.date.Weekday().String() + ")"
+	case v.dimensionless():
+		return formatNumber(v.num)
+	case v.label != "":
+		return formatNumber((v.num-v.offset)/v.factor) + " " + v.label
+	}
+	return formatNumber(v.num) + " " + baseUnitLabel(v.dim)
+}
+
+func formatInBase(v calcValue, base string) (string, error) {
+	if !v.dimensionless() || v.num != math.Trunc(v.num) || math.Abs(v.num) >= 1<<63 {
+		return "", fmt.Errorf("only whole numbers can be shown in %s", base)
+	}
+	n := int64(v.num)
+	sign := ""
+	if n < 0 {
+		sign, n = "-", -n
+	}
+	switch base {
+	case "hex":
+		return sign + "0x" + strconv.FormatInt(n, 16), nil
+	case "binary", "bin":
+		return sign + "0b" + strconv.FormatInt(n, 2), nil
+	}
+	return sign + "0o" + strconv.FormatInt(n, 8), nil
+}
+
+// evaluate works out an expression, relative to the given time for now and
+// today
+func evaluate(expr string, now time.Time) (string, error) {
+	tokens, err := tokenizeCalc(expr)
+	if err != nil {
+		return "", err
+	}
+	p := &calcParser{tokens: tokens, now: now}
+	v, formatted, err := p.conversion()
+	if err != nil {
+		return "", err
+	}
+	if t := p.peek(); t.kind != "end" {
+		return "", fmt.Errorf("unexpected %q", t.text)
+	}
+	if formatted != "" {
+		return formatted, nil
+	}
+	if math.IsNaN(v.num) || math.IsInf(v.num, 0) {
+		return "", fmt.Errorf("result is not a finite number")
+	}
+	return formatValue(v), nil
+}
+
+func calculateTool() Tool {
+	return Tool{
+		Type: "function",
+		Function: Function{
+			Name:        "calculate",
+			Description: "Evaluate an expression exactly, instead of doing arithmetic in your head or with a command. Supports arithmetic, functions such as sqrt and log, units (\"5 mi to km\", \"100 km / 2 h to mph\", \"3 GiB in MB\", \"72 F to C\"), dates (\"2024-03-01 + 90 days\", \"2025-01-01 - today\", \"now + 3 h\") and bases (\"255 to hex\")",
+			Parameters: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"expression": map[string]interface{}{
+						"type":        "string",
+						"description": "Expression to evaluate; dates are written YYYY-MM-DD or YYYY-MM-DDTHH:MM",
+					},
+				},
+				"required": []string{"expression"},
+			},
+		},
+	}
+}
+
+func (e *Engine) calculate(args json.RawMessage) (string, error) {
+	var params struct {
+		Expression string `json:"expression"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return "", fmt.Errorf("invalid arguments: %v", err)
+	}
+	result, err := evaluate(params.Expression, time.Now())
+	if err != nil {
+		return "", fmt.Errorf("invalid expression: %v", err)
+	}
+	return result, nil
+}
@@ -0,0 +1,82 @@
+package agent
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEvaluate(t *testing.T) {
+	now := time.Date(2025, 6, 15, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		expr, want string
+	}{
+		// Precedence and associativity
+		{"1 + 2 * 3", "7"},
+		{"(1 + 2) * 3", "9"},
+		{"2 ^ 3 ^ 2", "512"},
+		{"-2 ^ 2", "-4"},
+		{"10 - 4 - 3", "3"},
+		{"7 % 4 * 2", "6"},
+		{"0.1 + 0.2", "0.3"},
+		{"sqrt(16) + 1", "5"},
+
+		// Bases
+		{"0xff", "255"},
+		{"0x10 + 0b11 + 0o7", "26"},
+		{"1_000 * 3", "3000"},
+		{"255 to hex", "0xff"},
+		{"-10 to binary", "-0b1010"},
+
+		// Units
+		{"5 mi to km", "8.04672 km"},
+		{"3 GiB in MB", "3221.225472 MB"},
+		{"212 F to C", "100 C"},
+		{"100 km / 2 h to mph", "31.0685596119 mph"},
+		{"1 ft + 6 in", "1.5 ft"},
+		{"2 h to min", "120 min"},
+
+		// Dates
+		{"2024-01-31 + 1 month", "2024-02-29 (Thursday)"},
+		{"2023-01-31 + 1 month", "2023-02-28 (Tuesday)"},
+		{"2024-03-31 - 1 month", "2024-02-29 (Thursday)"},
+		{"2024-02-29 + 1 year", "2025-02-28 (Friday)"},
+		{"2024-03-01 + 90 days", "2024-05-30 (Thursday)"},
+		{"2025-01-01 - 2024-01-01", "366 days"},
+		{"today + 1 week", "2025-06-22 (Sunday)"},
+	}
+	for _, test := range tests {
+		got, err := evaluate(test.expr, now)
+		if err != nil {
+			t.Errorf("%s: %v", test.expr, err)
+		} else if got != test.want {
+			t.Errorf("%s = %s, want %s", test.expr, got, test.want)
+		}
+	}
+}
+
+func TestEvaluateErrors(t *testing.T) {
+	tests := []struct {
+		expr, want string
+	}{
+		{"1 / 0", "division by zero"},
+		{"5 km / 0", "division by zero"},
+		{"1 % 0", "not a finite number"},
+		{"5 km + 3 kg", "cannot add km and kg"},
+		{"5 km to s", "cannot convert"},
+		{"10 C + 5 C", "cannot add temperatures in C"},
+		{"2024-01-01 + 2024-01-02", "cannot add a date and a date"},
+		{"1.5 to hex", "only whole numbers"},
+		{"(1 + 2", "expected \")\""},
+		{"1 2", "unexpected \"2\""},
+		{"5 parsecs", "unexpected \"parsecs\""},
+	}
+	for _, test := range tests {
+		got, err := evaluate(test.expr, time.Now())
+		if err == nil {
+			t.Errorf("%s = %s, want an error", test.expr, got)
+		} else if !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: got error %q, want %q", test.expr, err, test.want)
+		}
+	}
+}
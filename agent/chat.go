@@ -0,0 +1,728 @@
+package agent
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// wex serve can take requests from a team's chat as well as over its API.
+// Someone asks with /wex, or in Slack by mentioning the bot, and a session
+// starts, reporting to the thread as it goes: the tools it calls, what it
+// asks to have approved, with buttons to approve or deny, and at the end
+// its reply and its diff. Slack and Discord both deliver commands and
+// button clicks as HTTP requests, signed so the server can tell they are
+// genuine, and take messages through their HTTP APIs, so neither needs a
+// connection of its own.
+
+// chatProgressInterval is how often a thread is sent the tools a session
+// has called since last time, so a busy session doesn't flood it
+var chatProgressInterval = 10 * time.Second
+
+// maxChatRequestBytes bounds the body of a request from a chat service
+const maxChatRequestBytes = 1 << 20
+
+// maxSlackRequestAge is how old a signed request from Slack may be, so one
+// that was captured can't be sent again later
+const maxSlackRequestAge = 5 * time.Minute
+
+// chatService is a chat that sessions can be started from and report to
+type chatService interface {
+	// name prefixes the service's user IDs in the chat users file
+	name() string
+
+	// maxMessage is how long a message the service takes, in bytes
+	maxMessage() int
+
+	// carryOn says how to send a session another message
+	carryOn() string
+
+	// post sends a message to a thread, or to the channel itself if
+	// thread is "", with buttons to approve or deny the review if it is
+	// not 0, returning the message's ID
+	post(channel, thread, text string, review int) (string, error)
+}
+
+// chatBot runs sessions of a wex server for those who ask in a chat
+type chatBot struct {
+	server *agentServer
+
+	// users maps chat user IDs, such as slack:U0123ABC, to the names they
+	// have in wex, as users of the server and as reviewers
+	users map[string]string
+
+	slack   *slackService
+	discord *discordService
+
+	// threads are the sessions started from each thread
+	mu      sync.Mutex
+	threads map[string]string
+}
+
+// loadChatUsers reads a chat users file: a chat user ID, as service:ID,
+// and the name they have in wex, on each line, with blank lines and lines
+// starting with # ignored
+func loadChatUsers(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chat users: %v", err)
+	}
+	users := make(map[string]string)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a chat user ID and a name", path, i+1)
+		}
+		service, id, _ := strings.Cut(fields[0], ":")
+		if service != "slack" && service != "discord" || id == "" {
+			return nil, fmt.Errorf("%s:%d: expected slack:ID or discord:ID, not %s", path, i+1, fields[0])
+		}
+		if users[fields[0]] != "" {
+			return nil, fmt.Errorf("%s:%d: %s is named twice", path, i+1, fields[0])
+		}
+		users[fields[0]] = fields[1]
+	}
+	if len(users) == 0 {
+		return nil, fmt.Errorf("%s names no chat users", path)
+	}
+	return users, nil
+}
+
+// newChatBot makes a bot for a server, offering what the server's
+// reviewers are asked to decide in the threads of the sessions asking
+func newChatBot(server *agentServer, users map[string]string) *chatBot {
+	b := &chatBot{server: server, users: users, threads: make(map[string]string)}
+	if server.reviews != nil {
+		server.reviews.OnRequest = b.review
+	}
+	return b
+}
+
+// handle adds the endpoints of the services the bot has to a server's
+func (b *chatBot) handle(mux *http.ServeMux) {
+	if b.slack != nil {
+		mux.HandleFunc("POST /slack/commands", b.slackCommand)
+		mux.HandleFunc("POST /slack/events", b.slackEvent)
+		mux.HandleFunc("POST /slack/interactions", b.slackInteraction)
+	}
+	if b.discord != nil {
+		mux.HandleFunc("POST /discord/interactions", b.discordInteraction)
+	}
+}
+
+// request deals with a message to the bot from a chat user in a thread:
+// carrying on the thread's session, if it is waiting for another message,
+// or else starting a new one. A thread of "" is the channel itself, whose
+// session is only carried on to answer its question. It returns what to
+// tell the user.
+func (b *chatBot) request(service chatService, userID, channel, thread, message string) string {
+	name, ok := b.users[service.name()+":"+userID]
+	if !ok {
+		return "You aren't a wex user; ask whoever runs the server to add you."
+	}
+	s := b.server
+	var user *serveUser
+	if len(s.users) > 0 {
+		for i := range s.users {
+			if s.users[i].name == name {
+				user = &s.users[i]
+			}
+		}
+		if user == nil {
+			return fmt.Sprintf("%s isn't a user of the wex server.", name)
+		}
+	}
+	message = strings.TrimSpace(message)
+	if message == "" {
+		return "What would you like done?"
+	}
+
+	key := service.name() + ":" + channel + ":" + thread
+	b.mu.Lock()
+	id := b.threads[key]
+	b.mu.Unlock()
+	s.mu.Lock()
+	if session := s.sessions[id]; session != nil && (thread != "" || session.status.Question != "") {
+		defer s.mu.Unlock()
+		switch {
+		case user != nil && session.owner != user.name:
+			return fmt.Sprintf("Session %s is %s's; start another with /wex.", id, session.owner)
+		case session.status.Status == agentRunning:
+			return fmt.Sprintf("Session %s is still working on its last message.", id)
+		}
+		s.start(session, message)
+		return fmt.Sprintf("Carrying on session %s.", id)
+	}
+	s.mu.Unlock()
+
+	status, err := s.open(user, &chatThread{service: service, channel: channel, thread: thread}, message)
+	if err != nil {
+		return fmt.Sprintf("Couldn't start a session: %v", err)
+	}
+	b.mu.Lock()
+	b.threads[key] = status.ID
+	b.mu.Unlock()
+	return fmt.Sprintf("Working on it, as session %s.", status.ID)
+}
+
+// review offers a request for approval in the thread of the session that
+// made it, if it has one
+func (b *chatBot) review(request ReviewRequest) {
+	s := b.server
+	s.mu.Lock()
+	var thread *chatThread
+	if session := s.sessions[request.Session]; session != nil {
+		thread = session.thread
+	}
+	s.mu.Unlock()
+	if thread != nil {
+		go thread.ask(request)
+	}
+}
+
+// decide approves or denies a request for a chat user who clicked a button,
+// returning what to say about it
+func (b *chatBot) decide(service chatService, userID string, id int, approve bool) (string, error) {
+	name, ok := b.users[service.name()+":"+userID]
+	if !ok || b.server.reviews == nil {
+		return "", errNotReviewer
+	}
+	if err := b.server.reviews.Decide(id, name, approve); err != nil {
+		return "", err
+	}
+	if approve {
+		return "Approved by " + name, nil
+	}
+	return "Denied by " + name, nil
+}
+
+// chatThread is where a session started from a chat reports
+type chatThread struct {
+	service chatService
+	channel string
+	thread  string
+
+	// progress is what the session has done since it was last reported
+	mu       sync.Mutex
+	progress []string
+
+	// postMu keeps the thread's messages in order
+	postMu sync.Mutex
+}
+
+// event notes what a session is doing, to be reported with whatever else
+// it does in the next chatProgressInterval; it doesn't block
+func (t *chatThread) event(event Event) {
+	var line string
+	switch event.Type {
+	case EventToolStarted:
+		args := string(event.Arguments)
+		if len(args) > 100 {
+			args = args[:100] + "..."
+		}
+		line = fmt.Sprintf("▶ `%s` %s", event.Tool, args)
+	case EventToolFinished:
+		if event.Failed {
+			line = fmt.Sprintf("✗ `%s`: %s", event.Tool, firstLine(event.Result, "failed"))
+		}
+	}
+	if line == "" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.progress = append(t.progress, line)
+	if len(t.progress) == 1 {
+		time.AfterFunc(chatProgressInterval, t.flush)
+	}
+}
+
+// flush reports what the session has done since last time
+func (t *chatThread) flush() {
+	t.postMu.Lock()
+	defer t.postMu.Unlock()
+	t.mu.Lock()
+	lines := t.progress
+	t.progress = nil
+	t.mu.Unlock()
+	if len(lines) > 0 {
+		t.send(strings.Join(lines, "\n"), 0)
+	}
+}
+
+// ask offers a request for approval
+func (t *chatThread) ask(request ReviewRequest) {
+	t.flush()
+	t.postMu.Lock()
+	defer t.postMu.Unlock()
+	t.send(fmt.Sprintf("Session %s asks to: %s", request.Session, request.Action), request.ID)
+}
+
+// finish reports how the session dealt with its message: its reply, or
+// its question, and what it has changed in its workspace
+func (t *chatThread) finish(status agentStatus, source, workspace string) {
+	t.flush()
+	t.postMu.Lock()
+	defer t.postMu.Unlock()
+	switch {
+	case status.Status == agentFailed:
+		t.send(fmt.Sprintf("Session %s failed: %s", status.ID, status.Error), 0)
+		return
+	case status.Question != "":
+		text := fmt.Sprintf("Session %s asks: %s", status.ID, status.Question)
+		if len(status.Choices) > 0 {
+			text += "\nChoices: " + strings.Join(status.Choices, ", ")
+		}
+		t.send(text+"\n"+t.service.carryOn(), 0)
+	default:
+		reply := strings.TrimSpace(status.Reply)
+		if reply == "" {
+			reply = "Done."
+		}
+		t.send(fmt.Sprintf("%s\n\n(session %s, after %d turns; %s)", reply, status.ID, status.Turns, t.service.carryOn()), 0)
+	}
+	diff, err := workspaceDiff(source, workspace)
+	switch {
+	case err != nil:
+		t.send(fmt.Sprintf("Couldn't compare the workspace: %v", err), 0)
+	case diff != "":
+		t.send(chatDiff(diff, status.ID, t.service.maxMessage()), 0)
+	}
+}
+
+// send posts a message, cut to fit, to the thread; a message that can't be
+// posted is dropped, as the session is still there to be asked over the API
+func (t *chatThread) send(text string, review int) {
+	if limit := t.service.maxMessage(); len(text) > limit {
+		text = truncateUTF8(text, limit-20) + "\n... (cut short)"
+	}
+	t.service.post(t.channel, t.thread, text, review)
+}
+
+// chatDiff formats a diff as a code block, cut to fit a message, pointing
+// to the whole diff if it is cut
+func chatDiff(diff, id string, maxMessage int) string {
+	tail := "```"
+	if room := maxMessage - 100; len(diff) > room {
+		diff = truncateUTF8(diff, room)
+		if i := strings.LastIndexByte(diff, '\n'); i >= 0 {
+			diff = diff[:i+1]
+		}
+		tail = fmt.Sprintf("```\n(cut short; the whole diff is at /sessions/%s/diff)", id)
+	}
+	return "Changes:\n```diff\n" + strings.TrimSuffix(diff, "\n") + "\n" + tail
+}
+
+// truncateUTF8 cuts text to at most n bytes without splitting a character
+func truncateUTF8(text string, n int) string {
+	if len(text) <= n {
+		return text
+	}
+	for n > 0 && text[n]&0xc0 == 0x80 {
+		n--
+	}
+	return text[:n]
+}
+
+// readChatRequest reads the body of a request from a chat service
+func readChatRequest(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxChatRequestBytes))
+	if err != nil {
+		http.Error(w, "failed to read request", http.StatusBadRequest)
+		return nil, false
+	}
+	return body, true
+}
+
+func writeChatJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// chatClient is for requests to the chat services, which, like
+// notifications, must not use the Ollama client, as it may carry
+// credentials
+var chatClient = &http.Client{Timeout: 10 * time.Second}
+
+// Slack
+
+// slackAPI is where Slack's Web API is
+var slackAPI = "https://slack.com/api"
+
+// slackService posts to Slack as a bot, and checks requests from Slack
+// with the app's signing secret
+type slackService struct {
+	token  string
+	secret string
+}
+
+func (s *slackService) name() string    { return "slack" }
+func (s *slackService) maxMessage() int { return 12000 }
+func (s *slackService) carryOn() string { return "mention me in this thread to carry on" }
+
+func (s *slackService) post(channel, thread, text string, review int) (string, error) {
+	message := map[string]interface{}{"channel": channel, "text": text}
+	if thread != "" {
+		message["thread_ts"] = thread
+	}
+	if review != 0 {
+		id := strconv.Itoa(review)
+		message["blocks"] = []interface{}{
+			map[string]interface{}{"type": "section", "text": map[string]string{"type": "mrkdwn", "text": text}},
+			map[string]interface{}{"type": "actions", "elements": []interface{}{
+				map[string]interface{}{"type": "button", "action_id": "approve", "value": id, "style": "primary", "text": map[string]string{"type": "plain_text", "text": "Approve"}},
+				map[string]interface{}{"type": "button", "action_id": "deny", "value": id, "style": "danger", "text": map[string]string{"type": "plain_text", "text": "Deny"}},
+			}},
+		}
+	}
+	return s.call("chat.postMessage", message)
+}
+
+// call calls a method of the Web API, returning the ts of the message it
+// posted, if it did
+func (s *slackService) call(method string, body interface{}) (string, error) {
+	data, _ := json.Marshal(body)
+	req, err := http.NewRequest("POST", slackAPI+"/"+method, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("Authorization", "Bearer "+s.token)
+	resp, err := chatClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("slack %s failed: %v", method, err)
+	}
+	defer resp.Body.Close()
+	var result struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+		TS    string `json:"ts"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("slack %s failed: %s: %v", method, resp.Status, err)
+	}
+	if !result.OK {
+		return "", fmt.Errorf("slack %s failed: %s", method, result.Error)
+	}
+	return result.TS, nil
+}
+
+// verify checks a request was signed with the signing secret, recently
+func (s *slackService) verify(r *http.Request, body []byte) bool {
+	timestamp := r.Header.Get("X-Slack-Request-Timestamp")
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || time.Since(time.Unix(seconds, 0)).Abs() > maxSlackRequestAge {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(s.secret))
+	fmt.Fprintf(mac, "v0:%s:%s", timestamp, body)
+	want := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(r.Header.Get("X-Slack-Signature")), []byte(want))
+}
+
+// slackBody reads a request from Slack, checking its signature
+func (b *chatBot) slackBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	body, ok := readChatRequest(w, r)
+	if !ok {
+		return nil, false
+	}
+	if !b.slack.verify(r, body) {
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return nil, false
+	}
+	return body, true
+}
+
+// slackCommand handles /wex, posting the request to the channel to start a
+// thread for the session. Slack wants an answer in 3 seconds, so the
+// session is started after answering.
+func (b *chatBot) slackCommand(w http.ResponseWriter, r *http.Request) {
+	body, ok := b.slackBody(w, r)
+	if !ok {
+		return
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		http.Error(w, "invalid form", http.StatusBadRequest)
+		return
+	}
+	user, channel, text := form.Get("user_id"), form.Get("channel_id"), strings.TrimSpace(form.Get("text"))
+	if _, ok := b.users["slack:"+user]; !ok || text == "" {
+		writeChatJSON(w, map[string]string{"response_type": "ephemeral", "text": b.request(b.slack, user, channel, "", text)})
+		return
+	}
+	thread, err := b.slack.post(channel, "", fmt.Sprintf("<@%s> asked: %s", user, text), 0)
+	if err != nil {
+		writeChatJSON(w, map[string]string{"response_type": "ephemeral", "text": fmt.Sprintf("Couldn't post to the channel: %v", err)})
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	go b.slack.post(channel, thread, b.request(b.slack, user, channel, thread, text), 0)
+}
+
+// slackMention is the bot's name at the start of a message that mentions it
+var slackMention = regexp.MustCompile(`^(\s*<@\w+>)+`)
+
+// slackEvent handles the Events API: the check Slack makes of the URL, and
+// mentions of the bot, which start a session in a thread, or carry on the
+// one already there
+func (b *chatBot) slackEvent(w http.ResponseWriter, r *http.Request) {
+	body, ok := b.slackBody(w, r)
+	if !ok {
+		return
+	}
+	var payload struct {
+		Type      string `json:"type"`
+		Challenge string `json:"challenge"`
+		Event     struct {
+			Type     string `json:"type"`
+			User     string `json:"user"`
+			BotID    string `json:"bot_id"`
+			Text     string `json:"text"`
+			Channel  string `json:"channel"`
+			TS       string `json:"ts"`
+			ThreadTS string `json:"thread_ts"`
+		} `json:"event"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		http.Error(w, "invalid event", http.StatusBadRequest)
+		return
+	}
+	if payload.Type == "url_verification" {
+		writeChatJSON(w, map[string]string{"challenge": payload.Challenge})
+		return
+	}
+	// Slack sends an event again if it isn't answered in 3 seconds, which
+	// mustn't start another session
+	w.WriteHeader(http.StatusOK)
+	event := payload.Event
+	if payload.Type != "event_callback" || event.Type != "app_mention" || event.BotID != "" || r.Header.Get("X-Slack-Retry-Num") != "" {
+		return
+	}
+	thread := event.ThreadTS
+	if thread == "" {
+		thread = event.TS
+	}
+	go func() {
+		text := slackMention.ReplaceAllString(event.Text, "")
+		b.slack.post(event.Channel, thread, b.request(b.slack, event.User, event.Channel, thread, text), 0)
+	}()
+}
+
+// slackInteraction handles the approve and deny buttons, replacing them
+// with the decision
+func (b *chatBot) slackInteraction(w http.ResponseWriter, r *http.Request) {
+	body, ok := b.slackBody(w, r)
+	if !ok {
+		return
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		http.Error(w, "invalid form", http.StatusBadRequest)
+		return
+	}
+	var payload struct {
+		Type string `json:"type"`
+		User struct {
+			ID string `json:"id"`
+		} `json:"user"`
+		Channel struct {
+			ID string `json:"id"`
+		} `json:"channel"`
+		Message struct {
+			TS   string `json:"ts"`
+			Text string `json:"text"`
+		} `json:"message"`
+		Actions []struct {
+			ActionID string `json:"action_id"`
+			Value    string `json:"value"`
+		} `json:"actions"`
+	}
+	if err := json.Unmarshal([]byte(form.Get("payload")), &payload); err != nil || payload.Type != "block_actions" || len(payload.Actions) == 0 {
+		http.Error(w, "invalid interaction", http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	action := payload.Actions[0]
+	id, _ := strconv.Atoi(action.Value)
+	outcome, err := b.decide(b.slack, payload.User.ID, id, action.ActionID == "approve")
+	if err != nil {
+		b.slack.call("chat.postEphemeral", map[string]string{"channel": payload.Channel.ID, "user": payload.User.ID, "text": fmt.Sprintf("Couldn't decide: %v", err)})
+		return
+	}
+	b.slack.call("chat.update", map[string]interface{}{"channel": payload.Channel.ID, "ts": payload.Message.TS, "text": payload.Message.Text + "\n" + outcome, "blocks": []interface{}{}})
+}
+
+// Discord
+
+// discordAPI is where Discord's HTTP API is
+var discordAPI = "https://discord.com/api/v10"
+
+// The interactions Discord sends, and the responses to them
+const (
+	discordPing             = 1
+	discordCommand          = 2
+	discordComponent        = 3
+	discordPong             = 1
+	discordMessage          = 4
+	discordUpdateMessage    = 7
+	discordEphemeral        = 64
+	discordActionRow        = 1
+	discordButton           = 2
+	discordButtonSuccess    = 3
+	discordButtonDanger     = 4
+	discordMaxMessageLength = 2000
+)
+
+// discordService posts to Discord as a bot, and checks interactions from
+// Discord with the application's public key
+type discordService struct {
+	token string
+	key   ed25519.PublicKey
+}
+
+func (d *discordService) name() string    { return "discord" }
+func (d *discordService) maxMessage() int { return discordMaxMessageLength }
+func (d *discordService) carryOn() string { return "answer with /wex in this channel" }
+
+func (d *discordService) post(channel, thread, text string, review int) (string, error) {
+	message := map[string]interface{}{"content": text}
+	if review != 0 {
+		id := strconv.Itoa(review)
+		message["components"] = []interface{}{map[string]interface{}{
+			"type": discordActionRow,
+			"components": []interface{}{
+				map[string]interface{}{"type": discordButton, "style": discordButtonSuccess, "label": "Approve", "custom_id": "approve:" + id},
+				map[string]interface{}{"type": discordButton, "style": discordButtonDanger, "label": "Deny", "custom_id": "deny:" + id},
+			},
+		}}
+	}
+	data, _ := json.Marshal(message)
+	req, err := http.NewRequest("POST", discordAPI+"/channels/"+url.PathEscape(channel)+"/messages", bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bot "+d.token)
+	resp, err := chatClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("discord post failed: %v", err)
+	}
+	defer resp.Body.Close()
+	var result struct {
+		ID      string `json:"id"`
+		Message string `json:"message"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("discord post failed: %s %s", resp.Status, result.Message)
+	}
+	return result.ID, nil
+}
+
+// verify checks an interaction was signed with the application's key
+func (d *discordService) verify(r *http.Request, body []byte) bool {
+	signature, err := hex.DecodeString(r.Header.Get("X-Signature-Ed25519"))
+	if err != nil || len(signature) != ed25519.SignatureSize {
+		return false
+	}
+	return ed25519.Verify(d.key, append([]byte(r.Header.Get("X-Signature-Timestamp")), body...), signature)
+}
+
+// discordInteraction handles the interactions endpoint: Discord's check of
+// it, /wex, which starts a session in the channel, or answers the question
+// of the one already there, and the approve and deny buttons. Discord
+// wants an answer in 3 seconds, so sessions are started after answering.
+func (b *chatBot) discordInteraction(w http.ResponseWriter, r *http.Request) {
+	body, ok := readChatRequest(w, r)
+	if !ok {
+		return
+	}
+	if !b.discord.verify(r, body) {
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+	type discordUser struct {
+		ID string `json:"id"`
+	}
+	var interaction struct {
+		Type      int    `json:"type"`
+		ChannelID string `json:"channel_id"`
+		Data      struct {
+			Name    string `json:"name"`
+			Options []struct {
+				Value interface{} `json:"value"`
+			} `json:"options"`
+			CustomID string `json:"custom_id"`
+		} `json:"data"`
+		Member struct {
+			User discordUser `json:"user"`
+		} `json:"member"`
+		User    discordUser `json:"user"`
+		Message struct {
+			Content string `json:"content"`
+		} `json:"message"`
+	}
+	if err := json.Unmarshal(body, &interaction); err != nil {
+		http.Error(w, "invalid interaction", http.StatusBadRequest)
+		return
+	}
+	// In a server the user is the member; in a direct message, the user
+	user := interaction.Member.User.ID
+	if user == "" {
+		user = interaction.User.ID
+	}
+	reply := func(text string, flags int) {
+		writeChatJSON(w, map[string]interface{}{"type": discordMessage, "data": map[string]interface{}{"content": text, "flags": flags}})
+	}
+
+	switch interaction.Type {
+	case discordPing:
+		writeChatJSON(w, map[string]int{"type": discordPong})
+	case discordCommand:
+		var words []string
+		for _, option := range interaction.Data.Options {
+			if s, ok := option.Value.(string); ok {
+				words = append(words, s)
+			}
+		}
+		text := strings.Join(words, " ")
+		if _, ok := b.users["discord:"+user]; !ok || strings.TrimSpace(text) == "" {
+			reply(b.request(b.discord, user, interaction.ChannelID, "", text), discordEphemeral)
+			return
+		}
+		reply(fmt.Sprintf("<@%s> asked: %s", user, text), 0)
+		go b.discord.post(interaction.ChannelID, "", b.request(b.discord, user, interaction.ChannelID, "", text), 0)
+	case discordComponent:
+		action, value, _ := strings.Cut(interaction.Data.CustomID, ":")
+		id, _ := strconv.Atoi(value)
+		outcome, err := b.decide(b.discord, user, id, action == "approve")
+		if err != nil {
+			reply(fmt.Sprintf("Couldn't decide: %v", err), discordEphemeral)
+			return
+		}
+		writeChatJSON(w, map[string]interface{}{"type": discordUpdateMessage, "data": map[string]interface{}{
+			"content":    interaction.Message.Content + "\n" + outcome,
+			"components": []interface{}{},
+		}})
+	default:
+		http.Error(w, "unsupported interaction", http.StatusBadRequest)
+	}
+}
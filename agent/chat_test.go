@@ -0,0 +1,331 @@
+package agent
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLoadChatUsers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chat-users")
+	os.WriteFile(path, []byte("# who may ask\nslack:U0123ABC alice\n\ndiscord:80351110224678912 bob\n"), 0600)
+	users, err := loadChatUsers(path)
+	if err != nil || len(users) != 2 || users["slack:U0123ABC"] != "alice" || users["discord:80351110224678912"] != "bob" {
+		t.Errorf("users %v, %v", users, err)
+	}
+	for content, want := range map[string]string{
+		"slack:U1\n":                   "expected a chat user ID and a name",
+		"irc:alice alice\n":            "expected slack:ID or discord:ID",
+		"slack: alice\n":               "expected slack:ID or discord:ID",
+		"slack:U1 alice\nslack:U1 bob": "slack:U1 is named twice",
+		"# nobody\n":                   "names no chat users",
+	} {
+		os.WriteFile(path, []byte(content), 0600)
+		if _, err := loadChatUsers(path); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q gives %v, want %q", content, err, want)
+		}
+	}
+}
+
+// chatMessage is a message a test chat service was sent
+type chatMessage struct {
+	path string
+	body map[string]interface{}
+}
+
+// fakeChatAPI records what is sent to it, answering as Slack's Web API
+// does, which also does for Discord's
+type fakeChatAPI struct {
+	mu       sync.Mutex
+	messages []chatMessage
+}
+
+func (f *fakeChatAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body map[string]interface{}
+	json.NewDecoder(r.Body).Decode(&body)
+	f.mu.Lock()
+	f.messages = append(f.messages, chatMessage{r.URL.Path, body})
+	n := len(f.messages)
+	f.mu.Unlock()
+	json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "ts": strconv.Itoa(n), "id": strconv.Itoa(n)})
+}
+
+// wait returns the first message sent to path whose text has want, or
+// fails if none is sent in time
+func (f *fakeChatAPI) wait(t *testing.T, path, want string) chatMessage {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		f.mu.Lock()
+		for _, m := range f.messages {
+			text, _ := m.body["text"].(string)
+			if content, ok := m.body["content"].(string); ok {
+				text = content
+			}
+			if m.path == path && strings.Contains(text, want) {
+				f.mu.Unlock()
+				return m
+			}
+		}
+		f.mu.Unlock()
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t.Fatalf("nothing with %q was sent to %s; sent %+v", want, path, f.messages)
+	return chatMessage{}
+}
+
+// newChatServer serves sessions for chat users, with alice a reviewer,
+// from an engine with the replies given, through chat services whose APIs
+// are fakes. Slack's signing secret is signing-secret, and Discord's
+// private key is returned.
+func newChatServer(t *testing.T, replies []ChatResponse, configure func(*Engine)) (*agentServer, *httptest.Server, *fakeChatAPI, ed25519.PrivateKey) {
+	t.Helper()
+	api := &fakeChatAPI{}
+	apiServer := httptest.NewServer(api)
+	t.Cleanup(apiServer.Close)
+	slack, discord, interval := slackAPI, discordAPI, chatProgressInterval
+	slackAPI, discordAPI, chatProgressInterval = apiServer.URL, apiServer.URL, time.Millisecond
+	t.Cleanup(func() { slackAPI, discordAPI, chatProgressInterval = slack, discord, interval })
+
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base, _, _ := newTestEngine(t, replies)
+	configure(base)
+	agents := newAgentServer(t.Context(), base, "secret", []reviewer{{"alice", strings.Repeat("a", 32)}})
+	agents.chat = newChatBot(agents, map[string]string{"slack:U1": "alice", "slack:U2": "bob", "discord:D1": "alice"})
+	agents.chat.slack = &slackService{token: "xoxb-token", secret: "signing-secret"}
+	agents.chat.discord = &discordService{token: "bot-token", key: public}
+	srv := httptest.NewServer(agents.Handler())
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() {
+		for _, session := range agents.sessions {
+			<-session.done
+			os.RemoveAll(session.engine.workspace)
+		}
+	})
+	return agents, srv, api, private
+}
+
+func TestSlackBot(t *testing.T) {
+	agents, srv, api, _ := newChatServer(t, []ChatResponse{
+		reply("", call("write_file", `{"path": "page.go", "content": "package page\n\nfunc Page() {}\n"}`)),
+		reply("Wrote page.go"),
+		reply("It builds"),
+	}, func(base *Engine) { base.diffBudget.MaxLines = 1 })
+
+	send := func(path, contentType, body string, sign func(req *http.Request)) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest("POST", srv.URL+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		sign(req)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	signed := func(body string) func(req *http.Request) {
+		return func(req *http.Request) {
+			timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+			mac := hmac.New(sha256.New, []byte("signing-secret"))
+			fmt.Fprintf(mac, "v0:%s:%s", timestamp, body)
+			req.Header.Set("X-Slack-Request-Timestamp", timestamp)
+			req.Header.Set("X-Slack-Signature", "v0="+hex.EncodeToString(mac.Sum(nil)))
+		}
+	}
+	command := func(user, text string) string {
+		t.Helper()
+		body := url.Values{"command": {"/wex"}, "user_id": {user}, "channel_id": {"C1"}, "text": {text}}.Encode()
+		resp := send("/slack/commands", "application/x-www-form-urlencoded", body, signed(body))
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("command: %s %s", resp.Status, data)
+		}
+		return string(data)
+	}
+	interact := func(user, action string, id int) {
+		t.Helper()
+		payload, _ := json.Marshal(map[string]interface{}{
+			"type":    "block_actions",
+			"user":    map[string]string{"id": user},
+			"channel": map[string]string{"id": "C1"},
+			"message": map[string]string{"ts": "7", "text": "asks to"},
+			"actions": []map[string]string{{"action_id": action, "value": strconv.Itoa(id)}},
+		})
+		body := url.Values{"payload": {string(payload)}}.Encode()
+		resp := send("/slack/interactions", "application/x-www-form-urlencoded", body, signed(body))
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("interaction: %s", resp.Status)
+		}
+	}
+
+	// Requests must be signed with the signing secret, recently
+	body := url.Values{"user_id": {"U1"}, "channel_id": {"C1"}, "text": {"Write page.go"}}.Encode()
+	for name, sign := range map[string]func(*http.Request){
+		"unsigned": func(*http.Request) {},
+		"signed with another secret": func(req *http.Request) {
+			req.Header.Set("X-Slack-Request-Timestamp", strconv.FormatInt(time.Now().Unix(), 10))
+			req.Header.Set("X-Slack-Signature", "v0=0123")
+		},
+		"signed long ago": func(req *http.Request) {
+			signed(body)(req)
+			req.Header.Set("X-Slack-Request-Timestamp", strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10))
+		},
+	} {
+		resp := send("/slack/commands", "application/x-www-form-urlencoded", body, sign)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s: %s", name, resp.Status)
+		}
+	}
+	challenge := `{"type": "url_verification", "challenge": "abc"}`
+	resp := send("/slack/events", "application/json", challenge, signed(challenge))
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(data), `"challenge":"abc"`) {
+		t.Errorf("url verification: %s", data)
+	}
+
+	// Only chat users may ask
+	if answer := command("U9", "Write page.go"); !strings.Contains(answer, "aren't a wex user") || !strings.Contains(answer, "ephemeral") {
+		t.Errorf("an unknown user was answered %s", answer)
+	}
+	if len(agents.sessions) != 0 {
+		t.Errorf("an unknown user started a session")
+	}
+
+	// A request starts a session in a thread of its own, which reports
+	// what it does, and asks there for what needs approving
+	command("U1", "Write page.go")
+	intro := api.wait(t, "/chat.postMessage", "<@U1> asked: Write page.go")
+	thread := "1"
+	if intro.body["thread_ts"] != nil {
+		t.Errorf("the request was posted in a thread: %v", intro.body)
+	}
+	if m := api.wait(t, "/chat.postMessage", "Working on it, as session s1"); m.body["thread_ts"] != thread {
+		t.Errorf("session started outside the thread: %v", m.body)
+	}
+	api.wait(t, "/chat.postMessage", "▶ `write_file`")
+	ask := api.wait(t, "/chat.postMessage", "Session s1 asks to:")
+	if ask.body["thread_ts"] != thread || ask.body["blocks"] == nil {
+		t.Fatalf("approval asked without buttons, or outside the thread: %v", ask.body)
+	}
+	id := agents.reviews.Pending()[0].ID
+
+	// Only reviewers may decide
+	interact("U2", "approve", id)
+	api.wait(t, "/chat.postEphemeral", "not an authorized reviewer")
+	interact("U1", "approve", id)
+	if m := api.wait(t, "/chat.update", "Approved by alice"); m.body["ts"] != "7" {
+		t.Errorf("updated the wrong message: %v", m.body)
+	}
+
+	// The session's reply and diff go to the thread
+	api.wait(t, "/chat.postMessage", "Wrote page.go\n\n(session s1, after 2 turns")
+	if m := api.wait(t, "/chat.postMessage", "+func Page() {}"); !strings.HasPrefix(m.body["text"].(string), "Changes:\n```diff\n") {
+		t.Errorf("diff %q", m.body["text"])
+	}
+
+	// Mentioning the bot in the thread carries the session on
+	mention := fmt.Sprintf(`{"type": "event_callback", "event": {"type": "app_mention", "user": "U1", "text": "<@UBOT> Does it build?", "channel": "C1", "ts": "99", "thread_ts": %q}}`, thread)
+	resp = send("/slack/events", "application/json", mention, signed(mention))
+	resp.Body.Close()
+	api.wait(t, "/chat.postMessage", "Carrying on session s1")
+	api.wait(t, "/chat.postMessage", "It builds")
+	agents.mu.Lock()
+	sessions := len(agents.sessions)
+	agents.mu.Unlock()
+	if sessions != 1 {
+		t.Errorf("%d sessions, want the one carried on", sessions)
+	}
+}
+
+func TestDiscordBot(t *testing.T) {
+	agents, srv, api, private := newChatServer(t, []ChatResponse{reply("Nothing to change")}, func(*Engine) {})
+
+	interact := func(body string, key ed25519.PrivateKey) (int, map[string]interface{}) {
+		t.Helper()
+		req, _ := http.NewRequest("POST", srv.URL+"/discord/interactions", strings.NewReader(body))
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("X-Signature-Timestamp", timestamp)
+		req.Header.Set("X-Signature-Ed25519", hex.EncodeToString(ed25519.Sign(key, []byte(timestamp+body))))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var answer map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&answer)
+		return resp.StatusCode, answer
+	}
+
+	_, other, _ := ed25519.GenerateKey(nil)
+	if status, _ := interact(`{"type": 1}`, other); status != http.StatusUnauthorized {
+		t.Errorf("signed with another key: %d", status)
+	}
+	if _, answer := interact(`{"type": 1}`, private); answer["type"] != float64(discordPong) {
+		t.Errorf("ping answered %v", answer)
+	}
+
+	command := `{"type": 2, "channel_id": "CH1", "member": {"user": {"id": "D1"}}, "data": {"name": "wex", "options": [{"name": "request", "value": "Tidy up"}]}}`
+	if _, answer := interact(command, private); answer["type"] != float64(discordMessage) || !strings.Contains(fmt.Sprint(answer["data"]), "<@D1> asked: Tidy up") {
+		t.Errorf("command answered %v", answer)
+	}
+	if m := api.wait(t, "/channels/CH1/messages", "Working on it, as session s1"); m.body["content"] == nil {
+		t.Errorf("posted %v", m.body)
+	}
+	api.wait(t, "/channels/CH1/messages", "Nothing to change")
+
+	stranger := `{"type": 2, "channel_id": "CH1", "user": {"id": "D9"}, "data": {"name": "wex", "options": [{"name": "request", "value": "Tidy up"}]}}`
+	if _, answer := interact(stranger, private); !strings.Contains(fmt.Sprint(answer["data"]), "aren't a wex user") {
+		t.Errorf("a stranger was answered %v", answer)
+	}
+
+	// The buttons decide for the reviewer the user is
+	approved := make(chan bool)
+	go func() { approved <- agents.reviews.Approver(t.Context(), "s1")("run make") }()
+	for len(agents.reviews.Pending()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	api.wait(t, "/channels/CH1/messages", "Session s1 asks to: run make")
+	click := fmt.Sprintf(`{"type": 3, "channel_id": "CH1", "member": {"user": {"id": "D1"}}, "message": {"content": "Session s1 asks to: run make"}, "data": {"custom_id": "deny:%d"}}`, agents.reviews.Pending()[0].ID)
+	_, answer := interact(click, private)
+	if answer["type"] != float64(discordUpdateMessage) || !strings.Contains(fmt.Sprint(answer["data"]), "Denied by alice") {
+		t.Errorf("click answered %v", answer)
+	}
+	if <-approved {
+		t.Error("denied, but approved")
+	}
+}
+
+func TestChatDiff(t *testing.T) {
+	diff := "--- a/x\n+++ b/x\n" + strings.Repeat("+line\n", 1000)
+	message := chatDiff(diff, "s3", 500)
+	if len(message) > 500 || !strings.Contains(message, "/sessions/s3/diff") || !strings.Contains(message, "+line\n```") {
+		t.Errorf("cut diff:\n%s", message)
+	}
+	if message := chatDiff("+a\n", "s3", 500); message != "Changes:\n```diff\n+a\n```" {
+		t.Errorf("short diff %q", message)
+	}
+	if got := truncateUTF8("aé", 2); got != "a" {
+		t.Errorf("truncated to %q", got)
+	}
+}
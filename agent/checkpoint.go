@@ -0,0 +1,59 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// checkpoint is where wex optimize, audit and upgrade-deps go back to when
+// they undo a change: a workspace with no uncommitted changes, and the
+// files git didn't track at the start, which are neither kept nor removed
+type checkpoint struct {
+	engine *Engine
+
+	// head is whether changes are undone back to the last commit, for
+	// kept changes that are committed, rather than to the index, for
+	// those that are staged
+	head bool
+
+	untracked map[string]bool
+}
+
+// newCheckpoint records the files git doesn't track in the workspace as
+// it is now, which should have no uncommitted changes, as undoing a change
+// mustn't take the user's work with it
+func newCheckpoint(e *Engine, head bool) checkpoint {
+	c := checkpoint{engine: e, head: head}
+	untracked := make(map[string]bool)
+	for _, path := range c.created() {
+		untracked[path] = true
+	}
+	c.untracked = untracked
+	return c
+}
+
+// created lists the files git doesn't track that weren't there at the start
+func (c checkpoint) created() []string {
+	out, _ := c.engine.git("ls-files", "--others", "--exclude-standard")
+	var paths []string
+	for _, path := range strings.Split(out, "\n") {
+		if path != "" && !c.untracked[path] {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// revert undoes the change since the last one kept, going back to the last
+// commit or the index, and removing the files it created
+func (c checkpoint) revert() {
+	if c.head {
+		c.engine.git("checkout", "--quiet", "HEAD", "--", ".")
+	} else {
+		c.engine.git("checkout", "--quiet", "--", ".")
+	}
+	for _, path := range c.created() {
+		os.Remove(filepath.Join(c.engine.workspace, filepath.FromSlash(path)))
+	}
+}
@@ -0,0 +1,48 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckpoint(t *testing.T) {
+	e, _, _ := newTestEngine(t, nil)
+	git := func(args ...string) {
+		if _, err := gitIn(e.workspace, append([]string{"-c", "user.name=t", "-c", "user.email=t@t"}, args...)...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeTestFile(t, e, "main.go", "package main\n")
+	git("init", "--quiet")
+	git("add", "--all")
+	git("commit", "--quiet", "-m", "base")
+	writeTestFile(t, e, "notes.txt", "the user's\n")
+	read := func(path string) string {
+		data, _ := os.ReadFile(filepath.Join(e.workspace, path))
+		return string(data)
+	}
+
+	for _, head := range []bool{false, true} {
+		c := newCheckpoint(e, head)
+		writeTestFile(t, e, "main.go", "package main\n\nfunc kept() {}\n")
+		git("add", "--all", "--", "main.go")
+		writeTestFile(t, e, "main.go", "package main\n\nfunc undone() {}\n")
+		writeTestFile(t, e, "new.go", "package main\n")
+		if created := c.created(); len(created) != 1 || created[0] != "new.go" {
+			t.Errorf("head %v: created %v", head, created)
+		}
+		c.revert()
+		want := "package main\n\nfunc kept() {}\n"
+		if head {
+			want = "package main\n"
+		}
+		if got := read("main.go"); got != want {
+			t.Errorf("head %v: main.go is %q after revert, want %q", head, got, want)
+		}
+		if read("new.go") != "" || read("notes.txt") != "the user's\n" {
+			t.Errorf("head %v: a created file was kept, or one that was there removed", head)
+		}
+		git("reset", "--quiet", "--hard")
+	}
+}
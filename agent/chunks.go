@@ -0,0 +1,142 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// chunkedWrite is a file being written across several write_file_chunk
+// calls, for files too large for the model to produce in one response.
+// It is held in memory, and nothing reaches the workspace until commit.
+type chunkedWrite struct {
+	content strings.Builder
+	chunks  int
+	mode    string
+}
+
+// maxChunkedWriteBytes limits what can be staged for a single file
+const maxChunkedWriteBytes = 64 << 20
+
+func writeFileChunkTool() Tool {
+	return Tool{
+		Type: "function",
+		Function: Function{
+			Name:        "write_file_chunk",
+			Description: "Write a file too large for one response in pieces: begin, then append chunks over as many calls as needed, then commit to write it. Nothing is written until commit, and a file not committed before the session ends is lost. Use write_file for anything that fits in one call",
+			Parameters: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"path": map[string]interface{}{
+						"type":        "string",
+						"description": "Path to the file to write",
+					},
+					"action": map[string]interface{}{
+						"type":        "string",
+						"enum":        []string{"begin", "append", "commit", "abort"},
+						"description": "begin starts the file, discarding anything staged for it; append adds content; commit writes the file, adding any content first; abort discards it",
+					},
+					"content": map[string]interface{}{
+						"type":        "string",
+						"description": "The next piece of the file, continuing exactly where the last one ended",
+					},
+					"mode": map[string]interface{}{
+						"type":        "string",
+						"description": "With begin, octal permissions, e.g. \"0755\" (optional; an existing file keeps its mode)",
+					},
+				},
+				"required": []string{"path", "action"},
+			},
+		},
+	}
+}
+
+func (e *Engine) writeFileChunk(args json.RawMessage) (string, error) {
+	var params struct {
+		Path    string `json:"path"`
+		Action  string `json:"action"`
+		Content string `json:"content"`
+		Mode    string `json:"mode"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return "", fmt.Errorf("invalid arguments: %v", err)
+	}
+	if _, err := e.resolvePath(params.Path); err != nil {
+		return "", err
+	}
+	key := filepath.Clean(params.Path)
+	write := e.chunkedWrites[key]
+
+	switch params.Action {
+	case "begin":
+		note := ""
+		if write != nil {
+			note = fmt.Sprintf(" (discarded %d bytes staged earlier)", write.content.Len())
+		}
+		if e.chunkedWrites == nil {
+			e.chunkedWrites = make(map[string]*chunkedWrite)
+		}
+		write = &chunkedWrite{mode: params.Mode}
+		e.chunkedWrites[key] = write
+		if params.Content == "" {
+			return fmt.Sprintf("Began %s%s; append its content, then commit", params.Path, note), nil
+		}
+		if err := write.add(params.Content); err != nil {
+			return "", err
+		}
+		return write.progress(params.Path) + note, nil
+	case "append", "commit":
+		if write == nil {
+			return "", fmt.Errorf("nothing staged for %s; start with action begin", params.Path)
+		}
+		if params.Action == "append" && params.Content == "" {
+			return "", fmt.Errorf("no content to append")
+		}
+		if err := write.add(params.Content); err != nil {
+			return "", err
+		}
+		if params.Action == "append" {
+			return write.progress(params.Path), nil
+		}
+		if err := e.saveFile(params.Path, write.content.String(), write.mode); err != nil {
+			return "", err
+		}
+		delete(e.chunkedWrites, key)
+		return fmt.Sprintf("Successfully wrote %d bytes in %d chunks to %s", write.content.Len(), write.chunks, params.Path), nil
+	case "abort":
+		if write == nil {
+			return "", fmt.Errorf("nothing staged for %s", params.Path)
+		}
+		delete(e.chunkedWrites, key)
+		return fmt.Sprintf("Discarded %d bytes staged for %s", write.content.Len(), params.Path), nil
+	}
+	return "", fmt.Errorf("invalid action %q: must be begin, append, commit or abort", params.Action)
+}
+
+func (w *chunkedWrite) add(content string) error {
+	if content == "" {
+		return nil
+	}
+	if w.content.Len()+len(content) > maxChunkedWriteBytes {
+		return fmt.Errorf("the file would be over %d bytes; chunk not added", maxChunkedWriteBytes)
+	}
+	w.content.WriteString(content)
+	w.chunks++
+	return nil
+}
+
+// progress says how much is staged and how it ends, so the model can
+// carry on from the right place in a later turn
+func (w *chunkedWrite) progress(path string) string {
+	content := w.content.String()
+	tail := content
+	if i := strings.LastIndex(strings.TrimRight(tail, "\n"), "\n"); i >= 0 {
+		tail = tail[i+1:]
+	}
+	if len(tail) > 200 {
+		tail = "..." + tail[len(tail)-200:]
+	}
+	return fmt.Sprintf("Staged %d chunks for %s: %d bytes, %d lines, ending with %q; append more, or commit",
+		w.chunks, path, len(content), strings.Count(content, "\n"), tail)
+}
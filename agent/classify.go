@@ -0,0 +1,881 @@
+package agent
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// commandClass says what running a command may do. Classes are ordered by
+// risk, and a command line takes the class of its riskiest part.
+type commandClass int
+
+const (
+	classReadOnly commandClass = iota
+	classBuild
+	classWrite
+	classUnknown
+	classNetwork
+	classDestructive
+)
+
+var commandClassNames = []string{"read-only", "build", "write", "unknown", "network", "destructive"}
+
+func (c commandClass) String() string {
+	return commandClassNames[c]
+}
+
+func parseCommandClass(name string) (commandClass, error) {
+	for i, n := range commandClassNames {
+		if n == name {
+			return commandClass(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown command class %q: must be one of %s", name, strings.Join(commandClassNames, ", "))
+}
+
+// commandClasses classifies programs by name; those with subcommands that
+// differ, like git and go, are handled in classifyProgram
+var commandClasses = map[string]commandClass{
+	// Read-only
+	"ls": classReadOnly, "cat": classReadOnly, "head": classReadOnly, "tail": classReadOnly,
+	"wc": classReadOnly, "pwd": classReadOnly, "grep": classReadOnly, "egrep": classReadOnly,
+	"rg": classReadOnly, "tree": classReadOnly, "file": classReadOnly, "stat": classReadOnly,
+	"du": classReadOnly, "df": classReadOnly, "which": classReadOnly, "whereis": classReadOnly,
+	"type": classReadOnly, "echo": classReadOnly, "printf": classReadOnly, "true": classReadOnly,
+	"false": classReadOnly, "test": classReadOnly, "[": classReadOnly, "date": classReadOnly,
+	"whoami": classReadOnly, "uname": classReadOnly, "id": classReadOnly, "sort": classReadOnly,
+	"uniq": classReadOnly, "cut": classReadOnly, "tr": classReadOnly, "diff": classReadOnly,
+	"cmp": classReadOnly, "less": classReadOnly, "more": classReadOnly, "jq": classReadOnly,
+	"basename": classReadOnly, "dirname": classReadOnly, "realpath": classReadOnly,
+	"readlink": classReadOnly, "md5sum": classReadOnly, "sha256sum": classReadOnly,
+	"cd": classReadOnly, "sleep": classReadOnly, "ps": classReadOnly, "nl": classReadOnly,
+
+	// Build and test
+	"make": classBuild, "cmake": classBuild, "ninja": classBuild, "gcc": classBuild,
+	"g++": classBuild, "cc": classBuild, "clang": classBuild, "javac": classBuild,
+	"mvn": classBuild, "gradle": classBuild, "tsc": classBuild, "pytest": classBuild,
+	"jest": classBuild, "rustc": classBuild, "gofmt": classBuild,
+
+	// Writing files
+	"touch": classWrite, "mkdir": classWrite, "cp": classWrite, "mv": classWrite,
+	"ln": classWrite, "tee": classWrite, "chmod": classWrite, "patch": classWrite,
+	"unzip": classWrite, "tar": classWrite, "export": classWrite,
+
+	// Network
+	"curl": classNetwork, "wget": classNetwork, "ssh": classNetwork, "scp": classNetwork,
+	"rsync": classNetwork, "nc": classNetwork, "ping": classNetwork, "apt": classNetwork,
+	"apt-get": classNetwork, "yum": classNetwork, "dnf": classNetwork, "brew": classNetwork,
+	"apk": classNetwork,
+
+	// Destructive
+	"rm": classDestructive, "rmdir": classDestructive, "dd": classDestructive,
+	"shred": classDestructive, "truncate": classDestructive, "kill": classDestructive,
+	"pkill": classDestructive, "killall": classDestructive, "shutdown": classDestructive,
+	"reboot": classDestructive, "chown": classDestructive, "mkfs": classDestructive,
+	"mke2fs": classDestructive, "wipefs": classDestructive, "fdisk": classDestructive,
+}
+
+// programVariables name programs to run, or change which ones run or what
+// they do, such as git's GIT_EXTERNAL_DIFF, the pager or LD_PRELOAD, so that
+// a command setting one could do anything, whatever program it runs
+var programVariables = map[string]bool{
+	"PAGER": true, "MANPAGER": true, "SYSTEMD_PAGER": true, "EDITOR": true, "VISUAL": true, "BROWSER": true,
+	"SHELL": true, "BASH_ENV": true, "ENV": true, "PROMPT_COMMAND": true, "PS4": true, "IFS": true,
+	"PATH": true, "CDPATH": true, "HOME": true, "XDG_CONFIG_HOME": true, "GNUPGHOME": true,
+	"PYTHONSTARTUP": true, "PYTHONPATH": true, "PYTHONHOME": true, "PERL5OPT": true, "PERL5LIB": true, "PERLLIB": true,
+	"RUBYOPT": true, "RUBYLIB": true, "NODE_OPTIONS": true, "GCONV_PATH": true, "TAR_OPTIONS": true, "RSYNC_RSH": true,
+}
+
+// programVariablePrefixes start the names of whole families of them
+var programVariablePrefixes = []string{"GIT_", "LD_", "DYLD_", "LESS"}
+
+// setsProgramVariable reports whether any of the words assigns one of the
+// programVariables
+func setsProgramVariable(words []string) bool {
+	for _, word := range words {
+		name, _, ok := strings.Cut(word, "=")
+		if !ok || !isAssignment(word) {
+			continue
+		}
+		if programVariables[name] || strings.HasSuffix(name, "_ASKPASS") ||
+			slices.ContainsFunc(programVariablePrefixes, func(prefix string) bool { return strings.HasPrefix(name, prefix) }) {
+			return true
+		}
+	}
+	return false
+}
+
+// wrapperCommands run the command that follows their own options; the
+// value is the options that take the next word as their argument
+var wrapperCommands = map[string][]string{
+	"sudo":    {"-u", "-g", "-h", "-C", "-D", "-p", "-r", "-t", "-T", "-U", "--user", "--group", "--host", "--prompt", "--chdir"},
+	"doas":    {"-u", "-C"},
+	"env":     {"-u", "-C", "--unset", "--chdir"},
+	"nohup":   nil,
+	"time":    {"-f", "-o", "--format", "--output"},
+	"nice":    {"-n", "--adjustment"},
+	"ionice":  {"-c", "-n", "-p", "-P", "-u", "--class", "--classdata"},
+	"stdbuf":  {"-i", "-o", "-e", "--input", "--output", "--error"},
+	"command": nil,
+	"exec":    {"-a"},
+	"xargs":   {"-a", "-d", "-E", "-I", "-L", "-n", "-P", "-s", "--arg-file", "--delimiter", "--max-args", "--max-procs"},
+	"timeout": {"-k", "-s", "--kill-after", "--signal"},
+	"busybox": nil,
+}
+
+// classifyCommand parses a shell command line and returns its riskiest
+// class. A line that cannot be parsed is unknown.
+func classifyCommand(line string) commandClass {
+	commands, err := parseShell(line)
+	if err != nil || len(commands) == 0 {
+		return classUnknown
+	}
+	class := classReadOnly
+	for _, command := range commands {
+		class = max(class, classifySimpleCommand(command))
+	}
+	return class
+}
+
+func classifySimpleCommand(command simpleCommand) commandClass {
+	class := classReadOnly
+	if command.writesFile {
+		class = classWrite
+	}
+	words, sudo := programWords(command.words)
+	if sudo {
+		class = max(class, classUnknown)
+	}
+	// Assignments before the program, or after env, and those export and
+	// the like make, can change what runs
+	if setsProgramVariable(command.words[:len(command.words)-len(words)]) ||
+		len(words) > 0 && declarations[words[0]] && setsProgramVariable(words[1:]) {
+		class = max(class, classUnknown)
+	}
+	if len(words) > 0 {
+		class = max(class, classifyProgram(words))
+	}
+	return class
+}
+
+// declarations are the builtins that set variables given as arguments
+var declarations = map[string]bool{"export": true, "declare": true, "typeset": true, "local": true, "readonly": true}
+
+// programWords skips variable assignments and wrappers such as sudo or env,
+// along with their options, to get to the program that actually runs and
+// its arguments. It reports whether sudo was among the wrappers.
+func programWords(words []string) ([]string, bool) {
+	sudo := false
+	for len(words) > 0 {
+		word := words[0]
+		switch {
+		case isAssignment(word):
+			words = words[1:]
+		default:
+			valueOptions, ok := wrapperCommands[word]
+			if !ok {
+				return words, sudo
+			}
+			if word == "sudo" || word == "doas" {
+				sudo = true
+			}
+			words = words[1:]
+			for len(words) > 0 && (strings.HasPrefix(words[0], "-") || isAssignment(words[0])) {
+				if slices.Contains(valueOptions, words[0]) && len(words) > 1 {
+					words = words[1:]
+				}
+				words = words[1:]
+			}
+			if word == "timeout" && len(words) > 0 && isDuration(words[0]) {
+				words = words[1:]
+			}
+		}
+	}
+	return nil, sudo
+}
+
+func classifyProgram(words []string) commandClass {
+	name := filepath.Base(words[0])
+	args := words[1:]
+	sub := ""
+	if len(args) > 0 {
+		sub = args[0]
+	}
+
+	switch name {
+	case "sh", "bash", "zsh", "dash":
+		// The -c may be among other options, as in bash -lc
+		for i, arg := range args {
+			if isShortOption(arg) && strings.Contains(arg, "c") && i+1 < len(args) {
+				return classifyCommand(args[i+1])
+			}
+		}
+		return classUnknown
+	case "eval":
+		return classifyCommand(strings.Join(args, " "))
+	case "watch":
+		for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+			if slices.Contains([]string{"-n", "-d", "--interval"}, args[0]) && len(args) > 1 && isDuration(args[1]) {
+				args = args[1:]
+			}
+			args = args[1:]
+		}
+		if len(args) == 0 {
+			return classReadOnly
+		}
+		return classifyCommand(strings.Join(args, " "))
+	case "git":
+		return classifyGit(args)
+	case "go":
+		switch sub {
+		case "get", "install":
+			return classNetwork
+		case "mod":
+			if len(args) > 1 && (args[1] == "download" || args[1] == "tidy") {
+				return classNetwork
+			}
+		}
+		return classBuild
+	case "cargo":
+		switch sub {
+		case "install", "add", "update", "fetch", "publish":
+			return classNetwork
+		}
+		return classBuild
+	case "npm", "yarn", "pnpm":
+		switch sub {
+		case "install", "i", "add", "ci", "update", "upgrade", "publish":
+			return classNetwork
+		}
+		return classBuild
+	case "pip", "pip3":
+		if sub == "install" || sub == "download" {
+			return classNetwork
+		}
+		if sub == "uninstall" {
+			return classDestructive
+		}
+		return classReadOnly
+	case "python", "python3", "node", "ruby", "perl", "java":
+		return classifyInterpreter(name, args)
+	case "dotnet":
+		switch sub {
+		case "build", "test", "run", "format", "clean", "--version", "--info":
+			return classBuild
+		case "restore", "add", "tool", "nuget", "publish":
+			return classNetwork
+		}
+		return classUnknown
+	case "docker", "podman":
+		switch sub {
+		case "rm", "rmi", "prune", "kill":
+			return classDestructive
+		case "pull", "push", "login":
+			return classNetwork
+		case "ps", "images", "logs", "inspect":
+			return classReadOnly
+		}
+		return classUnknown
+	case "sed":
+		return classifySed(args)
+	case "find":
+		// The commands -exec runs are classified in their own right, up to
+		// the ; or + that ends them
+		class := classReadOnly
+		for i := 0; i < len(args); i++ {
+			arg := args[i]
+			switch {
+			case arg == "-delete":
+				class = max(class, classDestructive)
+			case arg == "-exec" || arg == "-execdir" || arg == "-ok" || arg == "-okdir":
+				end := i + 1
+				for end < len(args) && args[end] != ";" && args[end] != "+" {
+					end++
+				}
+				if end == i+1 {
+					return classUnknown
+				}
+				if command, _ := programWords(args[i+1 : end]); len(command) > 0 {
+					class = max(class, classifyProgram(command))
+				} else {
+					class = max(class, classUnknown)
+				}
+				i = end
+			case strings.HasPrefix(arg, "-fprint") || arg == "-fls":
+				class = max(class, classWrite)
+			}
+		}
+		return class
+	case "awk":
+		return classUnknown
+	case "sort", "tree", "less", "more", "file", "date", "rg":
+		// Otherwise read-only, but with options to run another program,
+		// write a file, or set the clock
+		if option, ok := runOptions[name]; ok && hasOption(args, option.letters, option.long...) {
+			return classUnknown
+		}
+		// A pager runs the commands given with +, which can run the shell
+		if (name == "less" || name == "more") && slices.ContainsFunc(args, func(arg string) bool { return strings.HasPrefix(arg, "+") }) {
+			return classUnknown
+		}
+		if option, ok := outputOptions[name]; ok && hasOption(args, option.letters, option.long...) {
+			return classWrite
+		}
+	case "uniq":
+		// A second operand is the file to write
+		operands := 0
+		for i := 0; i < len(args); i++ {
+			switch arg := args[i]; {
+			case arg == "-f" || arg == "-s" || arg == "-w":
+				i++
+			case !strings.HasPrefix(arg, "-") || arg == "-":
+				operands++
+			}
+		}
+		if operands > 1 {
+			return classWrite
+		}
+	}
+
+	if class, ok := commandClasses[name]; ok {
+		return class
+	}
+	if strings.HasPrefix(name, "mkfs.") {
+		return classDestructive
+	}
+	return classUnknown
+}
+
+// outputOptions are the options of otherwise read-only programs that write
+// a file, or set the clock, as letters that may be among other short
+// options, and as long options
+var outputOptions = map[string]struct {
+	letters string
+	long    []string
+}{
+	"sort": {"o", []string{"--output"}},
+	"tree": {"o", nil},
+	"less": {"oO", []string{"--log-file", "--LOG-FILE"}},
+	"more": {"oO", []string{"--log-file", "--LOG-FILE"}},
+	"file": {"C", []string{"--compile"}},
+	"date": {"s", []string{"--set"}},
+}
+
+// runOptions are the options of otherwise read-only programs that run a
+// program, or shell command, of the caller's choosing
+var runOptions = map[string]struct {
+	letters string
+	long    []string
+}{
+	"rg":   {"", []string{"--pre"}},
+	"sort": {"", []string{"--compress-program"}},
+}
+
+// hasOption reports whether any of the arguments is one of the letters,
+// alone or among other short options, or one of the long options, alone
+// or with its value after =
+func hasOption(args []string, letters string, long ...string) bool {
+	for _, arg := range args {
+		if arg == "--" {
+			return false
+		}
+		if isShortOption(arg) && letters != "" && strings.ContainsAny(arg[1:], letters) {
+			return true
+		}
+		if slices.Contains(long, arg) || slices.ContainsFunc(long, func(option string) bool { return strings.HasPrefix(arg, option+"=") }) {
+			return true
+		}
+	}
+	return false
+}
+
+// interpreterCode are the options that give an interpreter code to run on
+// the command line, as letters that may be among other short options, and
+// as long options
+var interpreterCode = map[string]struct {
+	letters string
+	long    []string
+}{
+	"python":  {"c", nil},
+	"python3": {"c", nil},
+	"node":    {"ep", []string{"--eval", "--print"}},
+	"ruby":    {"e", nil},
+	"perl":    {"eE", nil},
+	"java":    {"", []string{"-jar", "-m", "--module", "--source"}},
+}
+
+// interpreterValueOptions are interpreter options that take the next word
+// as their argument
+var interpreterValueOptions = []string{"-W", "-X", "-r", "--require", "-I", "-M", "-cp", "-classpath", "--class-path", "-p", "--module-path"}
+
+// pythonBuildModules are modules that build, check or test code when run
+// with python -m
+var pythonBuildModules = []string{"pytest", "unittest", "doctest", "mypy", "pyflakes", "compileall", "py_compile"}
+
+// classifyInterpreter classifies running an interpreter. By itself, or to
+// test code, it builds; but code given on the command line, or a script,
+// could do anything, and is unknown.
+func classifyInterpreter(name string, args []string) commandClass {
+	code := interpreterCode[name]
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case (name == "python" || name == "python3") && arg == "-m":
+			if i+1 >= len(args) {
+				return classUnknown
+			}
+			module := args[i+1]
+			if module == "pip" || module == "venv" {
+				return classifyProgram(args[i+1:])
+			}
+			if slices.Contains(pythonBuildModules, module) {
+				return classBuild
+			}
+			return classUnknown
+		case slices.Contains(code.long, arg) || slices.ContainsFunc(code.long, func(long string) bool { return strings.HasPrefix(arg, long+"=") }):
+			return classUnknown
+		case isShortOption(arg) && code.letters != "" && strings.ContainsAny(arg[1:], code.letters):
+			return classUnknown
+		case slices.Contains(interpreterValueOptions, arg):
+			i++
+		case arg == "-" || !strings.HasPrefix(arg, "-"):
+			// A script, or one read from standard input
+			return classUnknown
+		}
+	}
+	return classBuild
+}
+
+// isShortOption reports whether a word is one or more single-letter options
+func isShortOption(word string) bool {
+	return len(word) > 1 && word[0] == '-' && word[1] != '-'
+}
+
+// gitGlobalValueOptions are options before git's subcommand that take the
+// next word as their argument
+var gitGlobalValueOptions = []string{"-C", "-c", "--git-dir", "--work-tree", "--namespace", "--config-env", "--super-prefix"}
+
+// gitSubcommand splits git's arguments into the subcommand and what
+// follows it, skipping the global options before it and their values
+func gitSubcommand(args []string) (string, []string) {
+	for i := 0; i < len(args); i++ {
+		switch {
+		case slices.Contains(gitGlobalValueOptions, args[i]):
+			i++
+		case !strings.HasPrefix(args[i], "-"):
+			return args[i], args[i+1:]
+		}
+	}
+	return "", nil
+}
+
+// gitRunOptions are git's options that can name a program for it to run:
+// configuration, such as core.pager or diff.external, set for one
+// command, and external diff and text conversion drivers
+var (
+	gitGlobalRunOptions = []string{"-c", "--config-env", "--exec-path"}
+	gitRunOptions       = []string{"--ext-diff", "--textconv"}
+)
+
+func classifyGit(args []string) commandClass {
+	sub, rest := gitSubcommand(args)
+	class := classifyGitSubcommand(sub, rest)
+	if hasOption(args[:len(args)-len(rest)], "", gitGlobalRunOptions...) || hasOption(rest, "", gitRunOptions...) {
+		class = max(class, classUnknown)
+	}
+	return class
+}
+
+func classifyGitSubcommand(sub string, rest []string) commandClass {
+	has := func(flags ...string) bool {
+		for _, arg := range rest {
+			for _, flag := range flags {
+				if arg == flag || (strings.HasPrefix(flag, "-") && !strings.HasPrefix(flag, "--") && strings.HasPrefix(arg, "-") && !strings.HasPrefix(arg, "--") && strings.Contains(arg, flag[1:])) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	switch sub {
+	case "log", "diff", "show":
+		if hasOption(rest, "", "--output") {
+			return classWrite
+		}
+		return classReadOnly
+	case "grep":
+		// Opening the files found runs a pager of the caller's choosing
+		if hasOption(rest, "O", "--open-files-in-pager") {
+			return classUnknown
+		}
+		return classReadOnly
+	case "status", "ls-files", "rev-parse", "blame", "describe", "shortlog", "reflog":
+		return classReadOnly
+	case "branch", "tag":
+		if has("-d", "-D", "--delete") {
+			return classDestructive
+		}
+		if len(rest) == 0 || has("-l", "--list", "-a", "-r", "-v") {
+			return classReadOnly
+		}
+		return classWrite
+	case "push":
+		if has("-f", "--force", "--force-with-lease", "--delete") {
+			return classDestructive
+		}
+		return classNetwork
+	case "pull", "fetch", "clone", "submodule", "ls-remote":
+		return classNetwork
+	case "reset":
+		if has("--hard") {
+			return classDestructive
+		}
+		return classWrite
+	case "clean":
+		if has("-n", "--dry-run") {
+			return classReadOnly
+		}
+		return classDestructive
+	case "checkout", "restore":
+		if has("--", ".", "-f", "--force") {
+			return classDestructive
+		}
+		return classWrite
+	case "stash":
+		if len(rest) > 0 && (rest[0] == "drop" || rest[0] == "clear") {
+			return classDestructive
+		}
+		if len(rest) > 0 && (rest[0] == "list" || rest[0] == "show") {
+			return classReadOnly
+		}
+		return classWrite
+	case "add", "commit", "switch", "merge", "rebase", "cherry-pick", "revert", "apply", "mv", "rm", "init", "am", "config":
+		return classWrite
+	}
+	return classUnknown
+}
+
+// sedValueOptions are sed's options that take the next word as their
+// argument
+var sedValueOptions = []string{"-l", "--line-length"}
+
+// classifySed classifies sed by its options and script. Editing in place
+// writes, as do the w and W commands; the e command, and a script read
+// from a file, could run anything.
+func classifySed(args []string) commandClass {
+	class := classReadOnly
+	var scripts, operands []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			operands = append(operands, args[i+1:]...)
+			i = len(args)
+		case arg == "--in-place" || strings.HasPrefix(arg, "--in-place="):
+			class = max(class, classWrite)
+		case arg == "--expression" || arg == "--file":
+			if i+1 >= len(args) {
+				return classUnknown
+			}
+			i++
+			if arg == "--file" {
+				return classUnknown
+			}
+			scripts = append(scripts, args[i])
+		case strings.HasPrefix(arg, "--expression="):
+			scripts = append(scripts, strings.TrimPrefix(arg, "--expression="))
+		case strings.HasPrefix(arg, "--file="):
+			return classUnknown
+		case slices.Contains(sedValueOptions, arg):
+			i++
+		case isShortOption(arg):
+			// Letters up to one that takes a value, which is the rest of
+			// the word or the next word; -i takes only the rest, a suffix
+			for j := 1; j < len(arg); j++ {
+				letter := arg[j]
+				if letter == 'i' {
+					class = max(class, classWrite)
+					break
+				}
+				if letter == 'e' || letter == 'f' || letter == 'l' {
+					value := arg[j+1:]
+					if value == "" {
+						if i+1 >= len(args) {
+							return classUnknown
+						}
+						i++
+						value = args[i]
+					}
+					switch letter {
+					case 'e':
+						scripts = append(scripts, value)
+					case 'f':
+						return classUnknown
+					}
+					break
+				}
+			}
+		case strings.HasPrefix(arg, "--"):
+		default:
+			operands = append(operands, arg)
+		}
+	}
+	if len(scripts) == 0 {
+		if len(operands) == 0 {
+			return classUnknown
+		}
+		scripts = operands[:1]
+	}
+	for _, script := range scripts {
+		class = max(class, classifySedScript(script))
+	}
+	return class
+}
+
+// classifySedScript classifies a sed script by its commands: w and W, and
+// the w flag of s, write a file, and e, and the e flag of s, run a command.
+// A script that can't be parsed is unknown.
+func classifySedScript(script string) commandClass {
+	class := classReadOnly
+	i := 0
+	// delimited skips past text ended by an unescaped delimiter
+	delimited := func(delimiter byte) bool {
+		for ; i < len(script); i++ {
+			switch script[i] {
+			case '\\':
+				i++
+			case delimiter:
+				i++
+				return true
+			}
+		}
+		return false
+	}
+	toLineEnd := func() {
+		for i < len(script) && script[i] != '\n' {
+			i++
+		}
+	}
+	address := func() bool {
+		switch {
+		case i < len(script) && script[i] == '/':
+			i++
+			return delimited('/')
+		case i+1 < len(script) && script[i] == '\\':
+			i += 2
+			return delimited(script[i-1])
+		}
+		for i < len(script) && strings.IndexByte("0123456789$~+", script[i]) >= 0 {
+			i++
+		}
+		return true
+	}
+	for i < len(script) {
+		switch script[i] {
+		case ' ', '\t', '\n', ';', '{', '}', '!':
+			i++
+			continue
+		case '#':
+			toLineEnd()
+			continue
+		}
+		if !address() {
+			return classUnknown
+		}
+		for i < len(script) && (script[i] == 'I' || script[i] == 'M') {
+			i++
+		}
+		if i < len(script) && script[i] == ',' {
+			i++
+			if !address() {
+				return classUnknown
+			}
+		}
+		for i < len(script) && (script[i] == ' ' || script[i] == '!') {
+			i++
+		}
+		if i >= len(script) {
+			return classUnknown
+		}
+		command := script[i]
+		i++
+		switch command {
+		case '{', '}', '\n', ';':
+		case 'e':
+			return classUnknown
+		case 'w', 'W':
+			class = max(class, classWrite)
+			toLineEnd()
+		case 'a', 'i', 'c', 'r', 'R', ':', '#':
+			toLineEnd()
+		case 's', 'y':
+			if i >= len(script) || script[i] == '\n' || script[i] == '\\' {
+				return classUnknown
+			}
+			delimiter := script[i]
+			i++
+			if !delimited(delimiter) || !delimited(delimiter) {
+				return classUnknown
+			}
+			if command == 'y' {
+				continue
+			}
+			for ; i < len(script) && strings.IndexByte(" \t\n;}", script[i]) < 0; i++ {
+				switch script[i] {
+				case 'e':
+					return classUnknown
+				case 'w':
+					class = max(class, classWrite)
+					toLineEnd()
+				}
+			}
+		default:
+			// Commands such as p, d, q and b, with any argument, up to the
+			// end of the command
+			for i < len(script) && strings.IndexByte("\n;}", script[i]) < 0 {
+				i++
+			}
+		}
+	}
+	return class
+}
+
+func isAssignment(word string) bool {
+	name, _, ok := strings.Cut(word, "=")
+	if !ok || name == "" {
+		return false
+	}
+	for i, r := range name {
+		if !(r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || i > 0 && r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+func isDuration(word string) bool {
+	return strings.TrimRight(word, "0123456789.smhd") == ""
+}
+
+// simpleCommand is one command of a shell command line: its variable
+// assignments and words with quoting removed, and whether it redirects
+// output to a file. A compound command, such as a subshell or a loop, has
+// no words of its own, but may write a file with its redirections.
+type simpleCommand struct {
+	words      []string
+	writesFile bool
+}
+
+// parseShell parses a command line as bash does, and lists the simple
+// commands in it, including those inside command substitutions, process
+// substitutions, unquoted here-documents and compound commands, since they
+// run too
+func parseShell(line string) ([]simpleCommand, error) {
+	file, err := syntax.NewParser(syntax.Variant(syntax.LangBash)).Parse(strings.NewReader(line), "")
+	if err != nil {
+		return nil, err
+	}
+	var commands []simpleCommand
+	syntax.Walk(file, func(node syntax.Node) bool {
+		stmt, ok := node.(*syntax.Stmt)
+		if !ok {
+			return true
+		}
+		var command simpleCommand
+		for _, redirect := range stmt.Redirs {
+			command.writesFile = command.writesFile || writesFile(redirect)
+		}
+		switch cmd := stmt.Cmd.(type) {
+		case *syntax.CallExpr:
+			for _, assign := range cmd.Assigns {
+				command.words = append(command.words, assignWord(assign))
+			}
+			for _, word := range cmd.Args {
+				command.words = append(command.words, shellWord(word))
+			}
+		case *syntax.DeclClause:
+			command.words = append(command.words, cmd.Variant.Value)
+			for _, assign := range cmd.Args {
+				command.words = append(command.words, assignWord(assign))
+			}
+		case *syntax.LetClause:
+			command.words = append(command.words, "let")
+		}
+		if len(command.words) > 0 || command.writesFile {
+			commands = append(commands, command)
+		}
+		return true
+	})
+	return commands, nil
+}
+
+// writesFile reports whether a redirection opens a file for writing;
+// duplicating a descriptor, as in 2>&1, or writing to /dev/null doesn't
+// count
+func writesFile(redirect *syntax.Redirect) bool {
+	switch redirect.Op {
+	case syntax.RdrOut, syntax.AppOut, syntax.RdrInOut, syntax.ClbOut, syntax.RdrAll, syntax.AppAll:
+	case syntax.DplOut:
+		if target := shellWord(redirect.Word); target == "-" || strings.Trim(target, "0123456789") == "" {
+			return false
+		}
+	default:
+		return false
+	}
+	return shellWord(redirect.Word) != "/dev/null"
+}
+
+func assignWord(assign *syntax.Assign) string {
+	switch {
+	case assign.Name == nil:
+		return shellWord(assign.Value)
+	case assign.Array != nil:
+		return assign.Name.Value + "=(...)"
+	case assign.Naked:
+		return assign.Name.Value
+	}
+	return assign.Name.Value + "=" + shellWord(assign.Value)
+}
+
+// shellWord is a word with its quoting removed. Substitutions, whose
+// commands are listed in their own right, stand as $(...); expansions are
+// left as written.
+func shellWord(word *syntax.Word) string {
+	if word == nil {
+		return ""
+	}
+	var b strings.Builder
+	writeWordParts(&b, word.Parts, false)
+	return b.String()
+}
+
+func writeWordParts(b *strings.Builder, parts []syntax.WordPart, quoted bool) {
+	for _, part := range parts {
+		switch part := part.(type) {
+		case *syntax.Lit:
+			value := part.Value
+			for i := 0; i < len(value); i++ {
+				if value[i] == '\\' && i+1 < len(value) && (!quoted || strings.IndexByte("$`\"\\\n", value[i+1]) >= 0) {
+					i++
+					if value[i] == '\n' {
+						continue
+					}
+				}
+				b.WriteByte(value[i])
+			}
+		case *syntax.SglQuoted:
+			b.WriteString(part.Value)
+		case *syntax.DblQuoted:
+			writeWordParts(b, part.Parts, true)
+		case *syntax.CmdSubst, *syntax.ProcSubst:
+			b.WriteString("$(...)")
+		default:
+			syntax.NewPrinter().Print(b, part)
+		}
+	}
+}
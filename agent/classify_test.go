@@ -0,0 +1,120 @@
+package agent
+
+import "testing"
+
+func TestClassifyCommand(t *testing.T) {
+	for command, want := range map[string]commandClass{
+		"ls -la | grep foo":                          classReadOnly,
+		"go test ./... 2>&1":                         classBuild,
+		"echo hi > out.txt":                          classWrite,
+		"git push --force":                           classDestructive,
+		"curl https://example.com":                   classNetwork,
+		"python3 -m pytest -q":                       classBuild,
+		"python3 -m pip install requests":            classNetwork,
+		"python3 --version":                          classBuild,
+		`python3 -c "open('x','w').write('x')"`:      classUnknown,
+		"python3 -Sc 'print(1)'":                     classUnknown,
+		"python3 script.py":                          classUnknown,
+		"python3 - < script.py":                      classUnknown,
+		"python3 -m http.server":                     classUnknown,
+		"node -e 'require(\"fs\").rmSync(\"x\")'":    classUnknown,
+		"node --eval=1":                              classUnknown,
+		"node build.js":                              classUnknown,
+		"perl -pi -e 's/a/b/' f.txt":                 classUnknown,
+		"ruby -e 'puts 1'":                           classUnknown,
+		"java -jar app.jar":                          classUnknown,
+		"java -cp lib Main":                          classUnknown,
+		"dotnet test":                                classBuild,
+		"dotnet app.dll":                             classUnknown,
+		"bash -lc 'rm -rf build'":                    classDestructive,
+		"mkfs.ext4 /dev/sda1":                        classDestructive,
+		"sudo rm -rf /":                              classDestructive,
+		"sudo -u root rm -rf /":                      classDestructive,
+		"ionice -c 3 rm -rf /tmp/x":                  classDestructive,
+		"stdbuf -oL rm x":                            classDestructive,
+		"busybox rm x":                               classDestructive,
+		"watch -n 5 'rm -rf x'":                      classDestructive,
+		"watch -n 5 ls":                              classReadOnly,
+		"timeout 10s curl example.com":               classNetwork,
+		"xargs -I {} rm {}":                          classDestructive,
+		`find . -name '*.o' -exec rm {} \;`:          classDestructive,
+		"find . -exec cat {} +":                      classReadOnly,
+		"find . -exec":                               classUnknown,
+		"find . -delete":                             classDestructive,
+		"eval 'rm -rf /'":                            classDestructive,
+		"eval ls":                                    classReadOnly,
+		"git -C . push --force":                      classDestructive,
+		"git -c k=v reset --hard":                    classDestructive,
+		"git --git-dir .git --work-tree . clean -fd": classDestructive,
+		"git -C sub status":                          classReadOnly,
+		"git --namespace ns push":                    classNetwork,
+		"function f { rm -rf y; }; f":                classDestructive,
+		"function f() { ls; }; f":                    classUnknown,
+		"sort -o sorted.txt names.txt":               classWrite,
+		"sort -uo sorted.txt names.txt":              classWrite,
+		"sort --output=sorted.txt names.txt":         classWrite,
+		"sort -u names.txt":                          classReadOnly,
+		"tree -o tree.txt":                           classWrite,
+		"tree -L 2":                                  classReadOnly,
+		"git diff --output=changes.patch":            classWrite,
+		"git log --output changes.txt":               classWrite,
+		"git log --oneline":                          classReadOnly,
+		"git grep -O vim foo":                        classUnknown,
+		"date -s '2020-01-01'":                       classWrite,
+		"date +%s":                                   classReadOnly,
+		"uniq names.txt unique.txt":                  classWrite,
+		"uniq -c names.txt":                          classReadOnly,
+		"less -o log.txt file":                       classWrite,
+		"less +'!rm x' f":                            classUnknown,
+		"less -N f":                                  classReadOnly,
+		"sed -n '1,10p' f":                           classReadOnly,
+		"sed 's/a/b/g;/^#/d' f":                      classReadOnly,
+		"sed -e 's|a|b|' -e 'y/ab/cd/' f":            classReadOnly,
+		"sed -i 's/a/b/' f":                          classWrite,
+		"sed -ni.bak p f":                            classWrite,
+		"sed 'e rm -rf src' f":                       classUnknown,
+		"sed '1e ls' f":                              classUnknown,
+		"sed 's/.*/rm &/e' f":                        classUnknown,
+		"sed -n 'w out' f":                           classWrite,
+		"sed -ne '/x/W out' f":                       classWrite,
+		"sed --expression='s/a/b/w out' f":           classWrite,
+		"sed -f script.sed f":                        classUnknown,
+		"sed 's/a/b' f":                              classUnknown,
+		"find . -fls out":                            classWrite,
+		"find . -fprint0 out":                        classWrite,
+		"rg --pre ./evil.sh foo":                     classUnknown,
+		"rg --pre=./evil.sh foo":                     classUnknown,
+		"rg -n foo":                                  classReadOnly,
+		"sort --compress-program=sh names.txt":       classUnknown,
+		"sort --compress-program sh names.txt":       classUnknown,
+		"git -c core.pager='rm -rf src' log":         classUnknown,
+		"git -c core.fsmonitor=./evil.sh status":     classUnknown,
+		"git --config-env=core.pager=P log":          classUnknown,
+		"git --exec-path=/tmp status":                classUnknown,
+		"git diff --ext-diff":                        classUnknown,
+		"git log -p --textconv":                      classUnknown,
+		"git diff --no-ext-diff":                     classReadOnly,
+		"cat <<EOF\n$(rm -rf ~/x)\nEOF":              classDestructive,
+		"cat <<-EOF\n\t`rm -rf x`\n\tEOF":            classDestructive,
+		"cat <<EOF\nhello $HOME\nEOF":                classReadOnly,
+		"cat <<'EOF'\n$(rm -rf x)\nEOF":              classReadOnly,
+		"diff <(rm x) y":                             classDestructive,
+		"for f in *.o; do rm $f; done":               classDestructive,
+		"if true; then ls; fi > out.txt":             classWrite,
+		"ls 2>/dev/null >&2":                         classReadOnly,
+		"echo hi >& log.txt":                         classWrite,
+		"echo 'unterminated":                         classUnknown,
+		"GIT_EXTERNAL_DIFF='rm -rf x' git diff":      classUnknown,
+		"PAGER='rm -rf x' git log":                   classUnknown,
+		"LESSOPEN='|rm -rf x %s' less f":             classUnknown,
+		"env GIT_SSH_COMMAND=./evil.sh git status":   classUnknown,
+		"export PAGER=./evil.sh; git log":            classUnknown,
+		"PATH=/tmp/evil ls":                          classUnknown,
+		"LANG=C ls":                                  classReadOnly,
+		"CGO_ENABLED=0 go build ./...":               classBuild,
+	} {
+		if got := classifyCommand(command); got != want {
+			t.Errorf("%s is %s, want %s", command, got, want)
+		}
+	}
+}
@@ -0,0 +1,308 @@
+package agent
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Finding is a problem reported by report_finding during wex review
+type Finding struct {
+	Path       string `json:"path"`
+	Line       int    `json:"line"`
+	EndLine    int    `json:"end_line,omitempty"`
+	Severity   string `json:"severity"`
+	Category   string `json:"category,omitempty"`
+	Message    string `json:"message"`
+	Suggestion string `json:"suggestion,omitempty"`
+}
+
+// findingSeverities map to SARIF levels
+var findingSeverities = map[string]string{
+	"high":   "error",
+	"medium": "warning",
+	"low":    "note",
+}
+
+// maxReviewDiffBytes limits the diff put in the review request; past it,
+// the model is given the list of files and reads the diff itself
+const maxReviewDiffBytes = 100 << 10
+
+func reportFindingTool() Tool {
+	return Tool{
+		Type: "function",
+		Function: Function{
+			Name:        "report_finding",
+			Description: "Report one problem found in the code under review, at a line of the file as it is now; call it once for each problem",
+			Parameters: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"path": map[string]interface{}{
+						"type":        "string",
+						"description": "Path to the file, relative to the workspace",
+					},
+					"line": map[string]interface{}{
+						"type":        "number",
+						"description": "Line the problem is on, counting from 1",
+					},
+					"end_line": map[string]interface{}{
+						"type":        "number",
+						"description": "Last line of the problem, if it spans several (optional)",
+					},
+					"severity": map[string]interface{}{
+						"type":        "string",
+						"enum":        []string{"high", "medium", "low"},
+						"description": "high for bugs and security problems that must be fixed, medium for what should be fixed, low for minor matters",
+					},
+					"category": map[string]interface{}{
+						"type":        "string",
+						"description": "Kind of problem, e.g. bug, security, error-handling, concurrency, performance, tests, maintainability",
+					},
+					"message": map[string]interface{}{
+						"type":        "string",
+						"description": "What is wrong, and why it matters",
+					},
+					"suggestion": map[string]interface{}{
+						"type":        "string",
+						"description": "How to fix it, concretely (optional)",
+					},
+				},
+				"required": []string{"path", "line", "severity", "message"},
+			},
+		},
+	}
+}
+
+func (e *Engine) reportFinding(args json.RawMessage) (string, error) {
+	var finding Finding
+	if err := json.Unmarshal(args, &finding); err != nil {
+		return "", fmt.Errorf("invalid arguments: %v", err)
+	}
+	if findingSeverities[finding.Severity] == "" {
+		return "", fmt.Errorf("invalid severity %q: must be high, medium or low", finding.Severity)
+	}
+	if strings.TrimSpace(finding.Message) == "" {
+		return "", fmt.Errorf("no message")
+	}
+	fullPath, err := e.resolvePath(finding.Path)
+	if err != nil {
+		return "", err
+	}
+	data, err := e.files().ReadFile(fullPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %v", finding.Path, err)
+	}
+	text, _ := decodeText(data)
+	lines := len(splitLines(text))
+	if finding.Line < 1 || finding.Line > lines {
+		return "", fmt.Errorf("line %d is not in %s, which has %d lines", finding.Line, finding.Path, lines)
+	}
+	if finding.EndLine != 0 && (finding.EndLine < finding.Line || finding.EndLine > lines) {
+		return "", fmt.Errorf("end_line %d is not between line %d and the end of %s, line %d", finding.EndLine, finding.Line, finding.Path, lines)
+	}
+	if finding.EndLine == finding.Line {
+		finding.EndLine = 0
+	}
+	finding.Path = filepath.ToSlash(filepath.Clean(finding.Path))
+
+	for _, f := range e.findings {
+		if f.Path == finding.Path && f.Line == finding.Line && f.Message == finding.Message {
+			return "Already reported", nil
+		}
+	}
+	e.findings = append(e.findings, finding)
+	return fmt.Sprintf("Recorded finding %d", len(e.findings)), nil
+}
+
+// runCodeReview handles "wex review", which has the model look over a diff
+// or the code in the workspace without changing it, and report findings
+func runCodeReview(engine *Engine, args []string, w io.Writer) error {
+	reviewFlags := flag.NewFlagSet("review", flag.ExitOnError)
+	diffRef := reviewFlags.String("diff", "", "Review the changes since the merge base with this ref, e.g. origin/main, instead of all the code")
+	focus := reviewFlags.String("focus", "", "What to concentrate on, e.g. security")
+	sarifPath := reviewFlags.String("sarif", "", "Also write the findings to this file as SARIF, e.g. for GitHub code scanning")
+	jsonPath := reviewFlags.String("json", "", "Also write the findings to this JSON file")
+	reviewFlags.Usage = func() {
+		fmt.Fprintf(reviewFlags.Output(), "Usage: wex [flags] review [--diff REF] [--focus TEXT] [--sarif FILE] [--json FILE] [path...]\n")
+		reviewFlags.PrintDefaults()
+	}
+	reviewFlags.Parse(args)
+
+	message, err := engine.reviewMessage(*diffRef, *focus, reviewFlags.Args())
+	if err != nil {
+		return err
+	}
+
+	// Nothing the review does may change the workspace
+	engine.filesystem = readOnlyFS{engine.files()}
+	if engine.commandPolicy == nil {
+		engine.commandPolicy = make(map[commandClass]string)
+	}
+	for _, class := range []commandClass{classWrite, classUnknown, classNetwork, classDestructive} {
+		engine.commandPolicy[class] = policyDeny
+	}
+	if engine.taskType == "" || engine.taskType == taskTypeAuto {
+		engine.taskType = "review"
+	}
+	engine.reviewing = true
+
+	if err := engine.ProcessRequest(message); err != nil {
+		return err
+	}
+
+	findings := engine.findings
+	sort.SliceStable(findings, func(i, j int) bool {
+		if findings[i].Path != findings[j].Path {
+			return findings[i].Path < findings[j].Path
+		}
+		return findings[i].Line < findings[j].Line
+	})
+	fmt.Fprint(w, formatFindings(findings))
+
+	if *jsonPath != "" {
+		if findings == nil {
+			findings = []Finding{}
+		}
+		data, err := json.MarshalIndent(findings, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to marshal findings: %v", err)
+		}
+		if err := os.WriteFile(*jsonPath, append(data, '\n'), 0644); err != nil {
+			return fmt.Errorf("failed to write findings: %v", err)
+		}
+	}
+	if *sarifPath != "" {
+		data, err := json.MarshalIndent(sarifReport(findings), "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to marshal SARIF: %v", err)
+		}
+		if err := os.WriteFile(*sarifPath, append(data, '\n'), 0644); err != nil {
+			return fmt.Errorf("failed to write SARIF: %v", err)
+		}
+	}
+	return nil
+}
+
+// reviewMessage asks for a review of the diff since ref's merge base, or
+// else of the code under paths
+func (e *Engine) reviewMessage(ref, focus string, paths []string) (string, error) {
+	var b strings.Builder
+	scope := "the code in this workspace"
+	if len(paths) > 0 {
+		scope = "the code in " + strings.Join(paths, ", ")
+	}
+	if ref == "" {
+		fmt.Fprintf(&b, "Review %s.", scope)
+	} else {
+		base, err := e.git("merge-base", ref, "HEAD")
+		if err != nil {
+			return "", fmt.Errorf("failed to find the merge base with %s: %v", ref, err)
+		}
+		diffArgs := append([]string{"diff", base, "--"}, paths...)
+		diff, err := e.git(diffArgs...)
+		if err != nil {
+			return "", fmt.Errorf("failed to diff against %s: %v", ref, err)
+		}
+		if diff == "" {
+			return "", fmt.Errorf("nothing has changed since %s", ref)
+		}
+		fmt.Fprintf(&b, "Review the changes to %s since %s (commit %.12s), including uncommitted changes.", scope, ref, base)
+		if len(diff) > maxReviewDiffBytes {
+			files, _ := e.git(append([]string{"diff", "--stat", base, "--"}, paths...)...)
+			fmt.Fprintf(&b, " The diff is too large to include; these files changed, and you can see each one's changes with git diff %.12s -- FILE:\n\n%s\n", base, files)
+		} else {
+			fence := codeFence(diff)
+			fmt.Fprintf(&b, "\n\n%sdiff\n%s\n%s\n", fence, diff, fence)
+		}
+	}
+	b.WriteString("\n\nReport each problem with report_finding, at its line in the file as it is now. Then finish with a short overall assessment.")
+	if focus != "" {
+		fmt.Fprintf(&b, "\n\nConcentrate on: %s", focus)
+	}
+	return strings.TrimSpace(b.String()), nil
+}
+
+func formatFindings(findings []Finding) string {
+	var b strings.Builder
+	for _, f := range findings {
+		location := fmt.Sprintf("%s:%d", f.Path, f.Line)
+		if f.EndLine != 0 {
+			location += fmt.Sprintf("-%d", f.EndLine)
+		}
+		category := ""
+		if f.Category != "" {
+			category = " [" + f.Category + "]"
+		}
+		fmt.Fprintf(&b, "%s: %s%s: %s\n", location, f.Severity, category, f.Message)
+		if f.Suggestion != "" {
+			fmt.Fprintf(&b, "    Suggestion: %s\n", f.Suggestion)
+		}
+	}
+	switch len(findings) {
+	case 0:
+		b.WriteString("No findings\n")
+	case 1:
+		b.WriteString("1 finding\n")
+	default:
+		fmt.Fprintf(&b, "%d findings\n", len(findings))
+	}
+	return b.String()
+}
+
+// sarifReport converts findings to SARIF 2.1.0, with a rule per category
+func sarifReport(findings []Finding) map[string]interface{} {
+	var rules []map[string]interface{}
+	ruleIndex := make(map[string]int)
+	results := []map[string]interface{}{}
+	for _, f := range findings {
+		rule := "wex/" + strings.ToLower(strings.Join(strings.Fields(f.Category), "-"))
+		if f.Category == "" {
+			rule = "wex/review"
+		}
+		if _, ok := ruleIndex[rule]; !ok {
+			ruleIndex[rule] = len(rules)
+			rules = append(rules, map[string]interface{}{
+				"id":               rule,
+				"shortDescription": map[string]interface{}{"text": "wex review: " + strings.TrimPrefix(rule, "wex/")},
+			})
+		}
+		text := f.Message
+		if f.Suggestion != "" {
+			text += "\n\nSuggestion: " + f.Suggestion
+		}
+		region := map[string]interface{}{"startLine": f.Line}
+		if f.EndLine != 0 {
+			region["endLine"] = f.EndLine
+		}
+		results = append(results, map[string]interface{}{
+			"ruleId":    rule,
+			"ruleIndex": ruleIndex[rule],
+			"level":     findingSeverities[f.Severity],
+			"message":   map[string]interface{}{"text": text},
+			"locations": []map[string]interface{}{{
+				"physicalLocation": map[string]interface{}{
+					"artifactLocation": map[string]interface{}{"uri": f.Path, "uriBaseId": "%SRCROOT%"},
+					"region":           region,
+				},
+			}},
+		})
+	}
+	if rules == nil {
+		rules = []map[string]interface{}{}
+	}
+	return map[string]interface{}{
+		"$schema": "https://json.schemastore.org/sarif-2.1.0.json",
+		"version": "2.1.0",
+		"runs": []map[string]interface{}{{
+			"tool": map[string]interface{}{
+				"driver": map[string]interface{}{"name": "wex", "rules": rules},
+			},
+			"results": results,
+		}},
+	}
+}
@@ -0,0 +1,95 @@
+package agent
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCodeReview(t *testing.T) {
+	e, provider, _ := newTestEngine(t, []ChatResponse{
+		reply("", call("report_finding", `{"path": "calc.go", "line": 9, "severity": "high", "category": "bug", "message": "Divides by zero when b is 0", "suggestion": "Return an error for b == 0"}`),
+			call("report_finding", `{"path": "calc.go", "line": 40, "severity": "low", "message": "Out of range"}`),
+			call("write_file", `{"path": "calc.go", "content": ""}`)),
+		reply("", call("report_finding", `{"path": "./calc.go", "line": 5, "end_line": 7, "severity": "low", "category": "error handling", "message": "No doc comment"}`)),
+		reply("One real bug."),
+	})
+	git := func(args ...string) {
+		if _, err := gitIn(e.workspace, append([]string{"-c", "user.name=t", "-c", "user.email=t@t"}, args...)...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeTestFile(t, e, "calc.go", "package calc\n\nfunc Add(a, b int) int { return a + b }\n")
+	git("init", "--quiet", "--initial-branch=main")
+	git("add", "--all")
+	git("commit", "--quiet", "-m", "base")
+	git("checkout", "--quiet", "-b", "feature")
+	writeTestFile(t, e, "calc.go", "package calc\n\nfunc Add(a, b int) int { return a + b }\n\nfunc Div(a, b int) int {\n\t// Divide\n\treturn a /\n\t\tb\n}\n")
+
+	dir := t.TempDir()
+	sarifPath := filepath.Join(dir, "review.sarif")
+	var out strings.Builder
+	if err := runCodeReview(e, []string{"--diff", "main", "--sarif", sarifPath}, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	request := provider.lastMessages(t, 1)[1].Content
+	if !strings.Contains(request, "since main") || !strings.Contains(request, "+func Div(a, b int) int {") {
+		t.Errorf("review request:\n%s", request)
+	}
+	results := toolResults(provider.lastMessages(t, 2))
+	if len(results) != 3 || !strings.Contains(results[1].Content, "not in calc.go") || !strings.Contains(results[2].Content, "read-only") {
+		t.Errorf("tool results: %q", results)
+	}
+	if data, _ := os.ReadFile(filepath.Join(e.workspace, "calc.go")); len(data) == 0 {
+		t.Error("the review wrote a file")
+	}
+	want := "calc.go:5-7: low [error handling]: No doc comment\n" +
+		"calc.go:9: high [bug]: Divides by zero when b is 0\n    Suggestion: Return an error for b == 0\n" +
+		"2 findings\n"
+	if out.String() != want {
+		t.Errorf("output:\n%s\nwant:\n%s", out.String(), want)
+	}
+
+	data, err := os.ReadFile(sarifPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sarif struct {
+		Version string
+		Runs    []struct {
+			Tool struct {
+				Driver struct {
+					Rules []struct{ ID string }
+				}
+			}
+			Results []struct {
+				RuleID    string
+				Level     string
+				Locations []struct {
+					PhysicalLocation struct {
+						ArtifactLocation struct{ URI string }
+						Region           struct{ StartLine, EndLine int }
+					}
+				}
+			}
+		}
+	}
+	if err := json.Unmarshal(data, &sarif); err != nil {
+		t.Fatal(err)
+	}
+	run := sarif.Runs[0]
+	if sarif.Version != "2.1.0" || len(run.Tool.Driver.Rules) != 2 || len(run.Results) != 2 {
+		t.Fatalf("SARIF:\n%s", data)
+	}
+	result := run.Results[0]
+	location := result.Locations[0].PhysicalLocation
+	if result.RuleID != "wex/error-handling" || result.Level != "note" || location.ArtifactLocation.URI != "calc.go" || location.Region.EndLine != 7 {
+		t.Errorf("SARIF result: %+v", result)
+	}
+	if run.Results[1].Level != "error" {
+		t.Errorf("high severity is SARIF level %q", run.Results[1].Level)
+	}
+}
@@ -0,0 +1,246 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// maxCommandOutputBytes caps each of stdout and stderr in a command result;
+// the start and end are kept, since both tend to matter
+const maxCommandOutputBytes = 20000
+
+// CommandResult is what run_command returns to the model. A command that
+// runs and fails is a result with a non-zero exit code, not a tool error;
+// tool errors are kept for commands that could not be run at all.
+type CommandResult struct {
+	ExitCode        int     `json:"exit_code"`
+	Stdout          string  `json:"stdout"`
+	Stderr          string  `json:"stderr"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	Cwd             string  `json:"cwd"`
+	StdoutTruncated bool    `json:"stdout_truncated,omitempty"`
+	StderrTruncated bool    `json:"stderr_truncated,omitempty"`
+	TimedOut        bool    `json:"timed_out,omitempty"`
+
+	// Prompts the command stopped at, answered automatically or by the user
+	AnsweredPrompts []string `json:"answered_prompts,omitempty"`
+
+	// WaitingForInput is a prompt nothing could answer; the command got end
+	// of input instead
+	WaitingForInput string `json:"waiting_for_input,omitempty"`
+
+	Note string `json:"note,omitempty"`
+}
+
+func (e *Engine) runCommand(args json.RawMessage) (string, error) {
+	var params struct {
+		Command string  `json:"command"`
+		Timeout float64 `json:"timeout"`
+		Input   string  `json:"input"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return "", fmt.Errorf("invalid arguments: %v", err)
+	}
+
+	if params.Timeout == 0 {
+		params.Timeout = 30
+	}
+
+	timeout := time.Duration(params.Timeout * float64(time.Second))
+
+	if err := e.checkCommandPolicy(params.Command); err != nil {
+		return "", err
+	}
+
+	// Repeated read-only commands are answered from the cache; anything
+	// else may change the workspace, so it invalidates the cache
+	readOnly := isCacheableCommand(params.Command)
+	key := commandCacheKey(params.Command, params.Input, e.cwd)
+	if readOnly {
+		if result, ok := e.cachedResult(key); ok {
+			return marshalCommandResult(result)
+		}
+	} else {
+		e.invalidateCommandCache()
+	}
+
+	var result CommandResult
+	var err error
+	if e.persistentShell {
+		result, err = e.runInShell(params.Command, params.Input, timeout)
+	} else {
+		result, err = e.executeCommand(params.Command, params.Input, timeout)
+	}
+	if err != nil {
+		return "", err
+	}
+	if readOnly && result.ExitCode == 0 && !result.TimedOut {
+		e.cacheResult(key, result)
+	}
+	return marshalCommandResult(result)
+}
+
+// commandEnvNames are the environment variables commands the model runs
+// are given: those that find and set up the tools, and the locale. Nothing
+// else gets through, so no credential the environment holds can leak
+// through a command that prints it.
+var commandEnvNames = map[string]bool{
+	"PATH": true, "HOME": true, "USER": true, "LOGNAME": true, "SHELL": true, "TERM": true,
+	"LANG": true, "LANGUAGE": true, "TZ": true, "TMPDIR": true, "TEMP": true, "TMP": true,
+	"GOPATH": true, "GOROOT": true, "GOCACHE": true, "GOMODCACHE": true, "GOFLAGS": true, "GOPROXY": true,
+	"GOPRIVATE": true, "GONOSUMDB": true, "GOSUMDB": true, "GOTOOLCHAIN": true, "GO111MODULE": true, "CGO_ENABLED": true,
+	"CC": true, "CXX": true, "CFLAGS": true, "LDFLAGS": true, "PKG_CONFIG_PATH": true,
+	"PYTHONPATH": true, "VIRTUAL_ENV": true, "CONDA_PREFIX": true, "NODE_PATH": true, "NVM_DIR": true,
+	"JAVA_HOME": true, "GRADLE_USER_HOME": true, "CARGO_HOME": true, "RUSTUP_HOME": true,
+	"HTTP_PROXY": true, "HTTPS_PROXY": true, "NO_PROXY": true, "http_proxy": true, "https_proxy": true, "no_proxy": true,
+	"SSL_CERT_FILE": true, "SSL_CERT_DIR": true,
+	"SYSTEMROOT": true, "COMSPEC": true, "PATHEXT": true, "WINDIR": true, "USERPROFILE": true, "APPDATA": true, "LOCALAPPDATA": true,
+}
+
+// commandEnv is the environment for a command the model runs: the
+// variables on commandEnvNames, and the locale's LC_ ones, that are set,
+// then any extra given
+func commandEnv(extra ...string) []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		if commandEnvNames[name] || strings.HasPrefix(name, "LC_") {
+			env = append(env, kv)
+		}
+	}
+	return append(env, extra...)
+}
+
+// executeCommand runs a command in a fresh shell
+func (e *Engine) executeCommand(command, input string, timeout time.Duration) (CommandResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	dir, err := e.resolvePath(e.cwd)
+	if err != nil {
+		return CommandResult{}, fmt.Errorf("current directory is no longer usable: %v", err)
+	}
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Dir = dir
+	cmd.Env = commandEnv()
+	// Background children of the shell can hold the output pipes open after
+	// it is killed on timeout; don't wait for them indefinitely
+	cmd.WaitDelay = time.Second
+
+	var stdout, stderr bytes.Buffer
+	result := CommandResult{Cwd: e.displayCwd()}
+	start := time.Now()
+
+	if input != "" {
+		cmd.Stdin = strings.NewReader(input)
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		err = cmd.Run()
+	} else {
+		output := &outputTracker{lastWrite: start}
+		cmd.Stdout = output.writer(&stdout)
+		cmd.Stderr = output.writer(&stderr)
+		stdin, pipeErr := cmd.StdinPipe()
+		if pipeErr != nil {
+			return CommandResult{}, fmt.Errorf("failed to run command: %v", pipeErr)
+		}
+
+		if err = cmd.Start(); err == nil {
+			done := make(chan struct{})
+			watched := make(chan struct{})
+			go func() {
+				e.answerPrompts(stdin, output, &result, done)
+				close(watched)
+			}()
+			err = cmd.Wait()
+			close(done)
+			<-watched
+		}
+	}
+	result.DurationSeconds = time.Since(start).Round(time.Millisecond).Seconds()
+
+	var exitErr *exec.ExitError
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		result.TimedOut = true
+		result.ExitCode = -1
+	case errors.As(err, &exitErr):
+		result.ExitCode = exitErr.ExitCode()
+	case err != nil:
+		return CommandResult{}, fmt.Errorf("failed to run command: %v", err)
+	}
+
+	result.Stdout, result.StdoutTruncated = truncateOutput(stdout.String())
+	result.Stderr, result.StderrTruncated = truncateOutput(stderr.String())
+	return result, nil
+}
+
+func marshalCommandResult(result CommandResult) (string, error) {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal result: %v", err)
+	}
+	return string(data), nil
+}
+
+// truncateOutput keeps the start and end of output longer than the limit
+func truncateOutput(output string) (string, bool) {
+	if len(output) <= maxCommandOutputBytes {
+		return output, false
+	}
+	half := maxCommandOutputBytes / 2
+	omitted := len(output) - 2*half
+	return fmt.Sprintf("%s\n... (%d bytes omitted) ...\n%s", output[:half], omitted, output[len(output)-half:]), true
+}
+
+// changeDirectory sets the directory later commands run in. It is tracked
+// by the engine rather than a shell, since each command gets a fresh one.
+func (e *Engine) changeDirectory(args json.RawMessage) (string, error) {
+	var params struct {
+		Path string `json:"path"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return "", fmt.Errorf("invalid arguments: %v", err)
+	}
+
+	target := params.Path
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(e.cwd, target)
+	}
+	target = filepath.Clean("/" + target)
+
+	resolved, err := e.resolvePath(target)
+	if err != nil {
+		return "", err
+	}
+	info, err := e.files().Stat(resolved)
+	if err != nil {
+		return "", fmt.Errorf("no such directory: %s", params.Path)
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", params.Path)
+	}
+
+	if e.shell != nil {
+		if _, _, _, err := e.shell.run("cd "+shellQuote(resolved), "", 10*time.Second); err != nil {
+			e.closeShell()
+		}
+	}
+	e.cwd = strings.TrimPrefix(target, "/")
+	return fmt.Sprintf("Current directory: %s", e.displayCwd()), nil
+}
+
+// displayCwd shows the current directory as an absolute path from the
+// workspace root
+func (e *Engine) displayCwd() string {
+	return "/" + filepath.ToSlash(e.cwd)
+}
@@ -0,0 +1,324 @@
+package agent
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// maxCommitDiffBytes limits the diff sent for a commit message; past it,
+// the model gets the summary of changed files and the start of the diff
+const maxCommitDiffBytes = 60 << 10
+
+// emptyTree is git's hash of the empty tree, the parent of a first commit
+const emptyTree = "4b825dc642cb6eb9a060e54bf8d69288fbee4904"
+
+var conventionalSubject = regexp.MustCompile(`^(feat|fix|docs|style|refactor|perf|test|build|ci|chore|revert)(\(([^()]+)\))?(!)?: (\S.*)$`)
+
+const commitMsgPrompt = `Write a git commit message for the changes below, in the Conventional Commits format:
+
+type(scope): summary
+
+Body
+
+The type is one of feat, fix, docs, style, refactor, perf, test, build, ci, chore or revert. The scope, which is optional, names the part of the project changed. Add ! after the type or scope, and a BREAKING CHANGE: footer, if the change breaks compatibility. The summary is in the imperative mood, lower case, with no period, and the whole first line is at most 72 characters. The body, wrapped at 72 columns, says what changed and why; leave it out if the summary says everything.
+%s
+Reply with the commit message only, not in a code block.
+
+%s`
+
+// runCommitMsg handles "wex commit-msg", which writes a commit message for
+// the staged changes, and can commit with it or update CHANGELOG.md
+func runCommitMsg(engine *Engine, args []string, w io.Writer) error {
+	commitFlags := flag.NewFlagSet("commit-msg", flag.ExitOnError)
+	commit := commitFlags.Bool("commit", false, "Commit the staged changes with the message")
+	amend := commitFlags.Bool("amend", false, "Describe the last commit along with anything staged, and amend it with the message")
+	changelog := commitFlags.Bool("changelog", false, "Add an entry for a feat, fix or perf change to CHANGELOG.md, staged with the commit")
+	output := commitFlags.String("o", "", "Write the message to this file, e.g. in a prepare-commit-msg hook, instead of printing it")
+	commitFlags.Usage = func() {
+		fmt.Fprintf(commitFlags.Output(), "Usage: wex [flags] commit-msg [--commit | --amend] [--changelog] [-o FILE] [hint]\n")
+		commitFlags.PrintDefaults()
+	}
+	commitFlags.Parse(args)
+	hint := strings.Join(commitFlags.Args(), " ")
+
+	base := "HEAD"
+	if *amend {
+		base = "HEAD^"
+		if _, err := engine.git("rev-parse", "--verify", "--quiet", "HEAD^"); err != nil {
+			base = emptyTree
+		}
+	}
+	diff, err := engine.git("diff", "--cached", base)
+	if err != nil {
+		if _, headErr := engine.git("rev-parse", "--verify", "--quiet", "HEAD"); headErr != nil {
+			// Nothing committed yet
+			diff, err = engine.git("diff", "--cached", emptyTree)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get the staged changes: %v", err)
+		}
+	}
+	if diff == "" {
+		if *amend {
+			return fmt.Errorf("the last commit has no changes to describe")
+		}
+		return fmt.Errorf("nothing is staged; stage changes with git add first")
+	}
+
+	message, err := engine.commitMessage(context.Background(), diff, base, hint)
+	if err != nil {
+		return err
+	}
+
+	if *changelog {
+		if entry := changelogEntry(message); entry.section != "" {
+			if err := engine.updateChangelog(entry); err != nil {
+				return err
+			}
+			if *commit || *amend {
+				if _, err := engine.git("add", "CHANGELOG.md"); err != nil {
+					return fmt.Errorf("failed to stage CHANGELOG.md: %v", err)
+				}
+			}
+		}
+	}
+
+	switch {
+	case *commit || *amend:
+		gitArgs := []string{"commit", "--quiet", "--file", "-"}
+		if *amend {
+			gitArgs = append(gitArgs, "--amend")
+		}
+		cmd := exec.Command("git", gitArgs...)
+		cmd.Dir = engine.workspace
+		cmd.Stdin = strings.NewReader(message + "\n")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("git commit failed: %v\n%s", err, out)
+		}
+		fmt.Fprintln(w, message)
+	case *output != "":
+		// A hook's file may already hold git's comments; keep them after
+		existing, _ := os.ReadFile(*output)
+		content := message + "\n"
+		if len(existing) > 0 {
+			content += "\n" + string(existing)
+		}
+		if err := os.WriteFile(*output, []byte(content), 0644); err != nil {
+			return fmt.Errorf("failed to write message: %v", err)
+		}
+	default:
+		fmt.Fprintln(w, message)
+	}
+	return nil
+}
+
+// commitMessage asks the model for a conventional commit message, asking
+// once more if the first doesn't follow the format
+func (e *Engine) commitMessage(ctx context.Context, diff, base, hint string) (string, error) {
+	if len(diff) > maxCommitDiffBytes {
+		stat, _ := e.git("diff", "--cached", "--stat", base)
+		diff = stat + "\n\nThe start of the diff:\n\n" + diff[:maxCommitDiffBytes]
+	}
+	var notes strings.Builder
+	if subjects, err := e.git("log", "-10", "--format=%s"); err == nil && subjects != "" {
+		fmt.Fprintf(&notes, "\nRecent commit messages, for the scopes and style this project uses:\n%s\n", subjects)
+	}
+	if hint != "" {
+		fmt.Fprintf(&notes, "\nThe author says: %s\n", hint)
+	}
+	fence := codeFence(diff)
+	prompt := fmt.Sprintf(commitMsgPrompt, notes.String(), fence+"diff\n"+diff+"\n"+fence)
+
+	messages := []Message{{Role: "user", Content: prompt}}
+	for attempt := 0; ; attempt++ {
+		reply, err := e.complete(ctx, messages)
+		if err != nil {
+			return "", err
+		}
+		message := cleanCommitMessage(reply)
+		problem := checkCommitMessage(message)
+		if problem == "" {
+			return message, nil
+		}
+		if attempt == 1 {
+			return "", fmt.Errorf("the model did not write a conventional commit message (%s):\n%s", problem, message)
+		}
+		messages = append(messages,
+			Message{Role: "assistant", Content: reply},
+			Message{Role: "user", Content: fmt.Sprintf("That is not a valid commit message: %s. Write it again, with only the message.", problem)})
+	}
+}
+
+// complete asks the model for a plain reply, without offering tools where
+// the request format allows it
+func (e *Engine) complete(ctx context.Context, messages []Message) (string, error) {
+	var resp *ChatResponse
+	var err error
+	if e.llamaCpp || e.generateTemplate != nil {
+		resp, err = e.sendChatRequest(ctx, messages)
+	} else {
+		resp, err = e.postChat(ctx, ChatRequest{Model: e.model, Messages: messages, Options: e.options})
+	}
+	if err != nil {
+		return "", fmt.Errorf("chat request failed: %v", err)
+	}
+	return resp.Message.Content, nil
+}
+
+// cleanCommitMessage removes what models wrap a message in: a leading
+// label, a code fence, and trailing spaces
+func cleanCommitMessage(reply string) string {
+	reply = strings.TrimSpace(reply)
+	for _, label := range []string{"Commit message:", "commit message:"} {
+		reply = strings.TrimSpace(strings.TrimPrefix(reply, label))
+	}
+	if strings.HasPrefix(reply, "```") {
+		reply = strings.TrimPrefix(reply[strings.IndexByte(reply+"\n", '\n'):], "\n")
+		reply = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(reply), "```"))
+	}
+	lines := strings.Split(reply, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t\r")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// checkCommitMessage says what is wrong with a message, or returns ""
+func checkCommitMessage(message string) string {
+	subject, body, _ := strings.Cut(message, "\n")
+	if !conventionalSubject.MatchString(subject) {
+		return fmt.Sprintf("the first line %q is not type(scope): summary", subject)
+	}
+	if len(subject) > 72 {
+		return fmt.Sprintf("the first line is %d characters, over 72", len(subject))
+	}
+	if body != "" && !strings.HasPrefix(body, "\n") {
+		return "there must be a blank line after the first line"
+	}
+	return ""
+}
+
+type changelogItem struct {
+	section string
+	text    string
+}
+
+// changelogEntry makes a Keep a Changelog entry for a user-visible change,
+// or returns one with no section for a change users won't notice
+func changelogEntry(message string) changelogItem {
+	subject, body, _ := strings.Cut(message, "\n")
+	m := conventionalSubject.FindStringSubmatch(subject)
+	if m == nil {
+		return changelogItem{}
+	}
+	kind, scope, breaking, summary := m[1], m[3], m[4] == "!" || strings.Contains(body, "BREAKING CHANGE:"), m[5]
+	section := ""
+	switch kind {
+	case "feat":
+		section = "Added"
+	case "fix":
+		section = "Fixed"
+	case "perf":
+		section = "Changed"
+	}
+	if breaking {
+		section = "Changed"
+		summary = "**Breaking:** " + summary
+	}
+	if section == "" {
+		return changelogItem{}
+	}
+	summary = strings.ToUpper(summary[:1]) + summary[1:]
+	if scope != "" {
+		summary = fmt.Sprintf("**%s:** %s", scope, summary)
+	}
+	return changelogItem{section, summary}
+}
+
+const changelogHeader = `# Changelog
+
+All notable changes to this project are documented in this file, in the format of [Keep a Changelog](https://keepachangelog.com/).
+
+## [Unreleased]
+`
+
+// updateChangelog adds an entry under the Unreleased heading of
+// CHANGELOG.md, making the file, the heading or the subsection if need be
+func (e *Engine) updateChangelog(item changelogItem) error {
+	path := filepath.Join(e.workspace, "CHANGELOG.md")
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read CHANGELOG.md: %v", err)
+	}
+	text := strings.TrimRight(string(data), "\n")
+	if text == "" {
+		text = changelogHeader
+	}
+	lines := strings.Split(strings.TrimRight(text, "\n"), "\n")
+	insert := func(at int, added ...string) {
+		lines = append(lines[:at], append(added, lines[at:]...)...)
+	}
+
+	// The Unreleased section goes before the first release
+	unreleased := -1
+	for i, line := range lines {
+		if strings.HasPrefix(line, "## ") {
+			if strings.Contains(strings.ToLower(line), "unreleased") {
+				unreleased = i
+			} else {
+				insert(i, "## [Unreleased]", "")
+				unreleased = i
+			}
+			break
+		}
+	}
+	if unreleased < 0 {
+		insert(len(lines), "", "## [Unreleased]")
+		unreleased = len(lines) - 1
+	}
+	end := len(lines)
+	for i := unreleased + 1; i < len(lines); i++ {
+		if strings.HasPrefix(lines[i], "## ") {
+			end = i
+			break
+		}
+	}
+
+	entry := "- " + item.text
+	heading := "### " + item.section
+	for i := unreleased + 1; i < end; i++ {
+		if strings.TrimSpace(lines[i]) == heading {
+			at := i + 1
+			for at < end && lines[at] != "" && !strings.HasPrefix(lines[at], "#") {
+				at++
+			}
+			insert(at, entry)
+			return e.writeChangelog(path, lines, item)
+		}
+	}
+	at := end
+	for at > unreleased+1 && strings.TrimSpace(lines[at-1]) == "" {
+		at--
+	}
+	if at == end && end < len(lines) {
+		insert(at, "", heading, entry, "")
+	} else {
+		insert(at, "", heading, entry)
+	}
+	return e.writeChangelog(path, lines, item)
+}
+
+func (e *Engine) writeChangelog(path string, lines []string, item changelogItem) error {
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to write CHANGELOG.md: %v", err)
+	}
+	e.logf("Added to CHANGELOG.md under %s: %s", item.section, item.text)
+	return nil
+}
@@ -0,0 +1,131 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckCommitMessage(t *testing.T) {
+	tests := []struct {
+		message string
+		ok      bool
+	}{
+		{"feat(tools): add a grep tool", true},
+		{"fix!: stop deleting the workspace\n\nBREAKING CHANGE: --clean is gone", true},
+		{"docs: explain --resume\n\nWith an example.", true},
+		{"Add a grep tool", false},
+		{"feature: add a grep tool", false},
+		{"feat: add a grep tool\nwith no blank line", false},
+		{"feat: " + strings.Repeat("x", 70), false},
+	}
+	for _, test := range tests {
+		if problem := checkCommitMessage(test.message); (problem == "") != test.ok {
+			t.Errorf("checkCommitMessage(%q) = %q", test.message, problem)
+		}
+	}
+
+	if got := cleanCommitMessage("Commit message:\n```\nfix: handle EOF  \n\nBody.\n```\n"); got != "fix: handle EOF\n\nBody." {
+		t.Errorf("cleanCommitMessage = %q", got)
+	}
+}
+
+func TestChangelogEntry(t *testing.T) {
+	tests := []struct {
+		message string
+		want    changelogItem
+	}{
+		{"feat(tools): add a grep tool", changelogItem{"Added", "**tools:** Add a grep tool"}},
+		{"fix: handle EOF", changelogItem{"Fixed", "Handle EOF"}},
+		{"refactor!: rename --out to --output", changelogItem{"Changed", "**Breaking:** rename --out to --output"}},
+		{"feat: drop Python 2\n\nBREAKING CHANGE: needs Python 3", changelogItem{"Changed", "**Breaking:** drop Python 2"}},
+		{"chore: update dependencies", changelogItem{}},
+	}
+	for _, test := range tests {
+		if got := changelogEntry(test.message); got != test.want {
+			t.Errorf("changelogEntry(%q) = %+v, want %+v", test.message, got, test.want)
+		}
+	}
+}
+
+func TestUpdateChangelog(t *testing.T) {
+	e, _, _ := newTestEngine(t, nil)
+	path := filepath.Join(e.workspace, "CHANGELOG.md")
+	read := func() string {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	if err := e.updateChangelog(changelogItem{"Added", "A grep tool"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(); got != changelogHeader+"\n### Added\n- A grep tool\n" {
+		t.Errorf("new changelog:\n%s", got)
+	}
+
+	writeTestFile(t, e, "CHANGELOG.md", "# Changelog\n\n## [1.0.0] - 2026-01-01\n\n### Added\n- Everything\n")
+	if err := e.updateChangelog(changelogItem{"Fixed", "Handle EOF"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.updateChangelog(changelogItem{"Added", "A grep tool"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.updateChangelog(changelogItem{"Fixed", "Handle errors"}); err != nil {
+		t.Fatal(err)
+	}
+	want := "# Changelog\n\n## [Unreleased]\n\n### Fixed\n- Handle EOF\n- Handle errors\n\n### Added\n- A grep tool\n\n" +
+		"## [1.0.0] - 2026-01-01\n\n### Added\n- Everything\n"
+	if got := read(); got != want {
+		t.Errorf("changelog:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestCommitMsg(t *testing.T) {
+	e, provider, _ := newTestEngine(t, []ChatResponse{
+		reply("Added a greeting"),
+		reply("```\nfeat(greet): say hello\n\nPrint a greeting on startup.\n```"),
+	})
+	git := func(args ...string) string {
+		out, err := gitIn(e.workspace, append([]string{"-c", "user.name=t", "-c", "user.email=t@t"}, args...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(out)
+	}
+	git("init", "--quiet")
+	git("config", "user.name", "t")
+	git("config", "user.email", "t@t")
+	writeTestFile(t, e, "main.go", "package main\n\nfunc main() {}\n")
+	git("add", "--all")
+
+	var out strings.Builder
+	if err := runCommitMsg(e, []string{"--commit", "--changelog", "a", "hint"}, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	request := provider.lastMessages(t, 1)[0].Content
+	if !strings.Contains(request, "+func main() {}") || !strings.Contains(request, "The author says: a hint") {
+		t.Errorf("request:\n%s", request)
+	}
+	retry := provider.lastMessages(t, 2)
+	if len(retry) != 3 || !strings.Contains(retry[2].Content, "not a valid commit message") {
+		t.Errorf("retry: %q", retry)
+	}
+	want := "feat(greet): say hello\n\nPrint a greeting on startup."
+	if strings.TrimSpace(out.String()) != want {
+		t.Errorf("output: %q", out.String())
+	}
+	if got := git("log", "-1", "--format=%B"); got != want {
+		t.Errorf("committed message: %q", got)
+	}
+	if files := git("show", "--name-only", "--format=", "HEAD"); files != "CHANGELOG.md\nmain.go" {
+		t.Errorf("committed files: %q", files)
+	}
+	if status := git("status", "--porcelain"); status != "" {
+		t.Errorf("left uncommitted: %q", status)
+	}
+}
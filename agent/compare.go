@@ -0,0 +1,215 @@
+package agent
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+)
+
+// hashAlgorithms are those hash_file offers; SHA-1 and MD5 are only for
+// matching checksums published elsewhere
+var hashAlgorithms = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+	"sha1":   sha1.New,
+	"md5":    md5.New,
+}
+
+func compareTools() []Tool {
+	return []Tool{
+		{
+			Type: "function",
+			Function: Function{
+				Name:        "hash_file",
+				Description: "Compute digests of files in the workspace, in the format of sha256sum. Use this to check that a copy matches its source, or that a file matches a published checksum",
+				Parameters: map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"paths": map[string]interface{}{
+							"type":        "array",
+							"items":       map[string]interface{}{"type": "string"},
+							"description": "File paths relative to workspace",
+						},
+						"algorithm": map[string]interface{}{
+							"type":        "string",
+							"enum":        []string{"sha256", "sha512", "sha1", "md5"},
+							"description": "Hash algorithm (optional, default sha256)",
+						},
+						"expected": map[string]interface{}{
+							"type":        "string",
+							"description": "Hex digest the files should have; each is reported as matching or not (optional)",
+						},
+					},
+					"required": []string{"paths"},
+				},
+			},
+		},
+		{
+			Type: "function",
+			Function: Function{
+				Name:        "diff_files",
+				Description: "Compare two files in the workspace, returning a unified diff. Use this to check generated output against an expected file",
+				Parameters: map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"a": map[string]interface{}{
+							"type":        "string",
+							"description": "Original file path relative to workspace",
+						},
+						"b": map[string]interface{}{
+							"type":        "string",
+							"description": "New file path relative to workspace",
+						},
+						"context": map[string]interface{}{
+							"type":        "integer",
+							"description": "Lines of context around each change (optional, default 3)",
+						},
+					},
+					"required": []string{"a", "b"},
+				},
+			},
+		},
+	}
+}
+
+func (e *Engine) hashFile(args json.RawMessage) (string, error) {
+	var params struct {
+		Paths     []string `json:"paths"`
+		Algorithm string   `json:"algorithm"`
+		Expected  string   `json:"expected"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return "", fmt.Errorf("invalid arguments: %v", err)
+	}
+	if len(params.Paths) == 0 {
+		return "", fmt.Errorf("no paths given")
+	}
+	if params.Algorithm == "" {
+		params.Algorithm = "sha256"
+	}
+	newHash, ok := hashAlgorithms[params.Algorithm]
+	if !ok {
+		return "", fmt.Errorf("unknown algorithm %q", params.Algorithm)
+	}
+	expected := strings.ToLower(strings.TrimSpace(params.Expected))
+
+	var b strings.Builder
+	for _, path := range params.Paths {
+		digest, err := e.digestFile(path, newHash())
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&b, "%s  %s", digest, path)
+		if expected != "" {
+			if digest == expected {
+				b.WriteString("  (matches)")
+			} else {
+				b.WriteString("  (DOES NOT MATCH)")
+			}
+		}
+		b.WriteByte('\n')
+	}
+	return b.String(), nil
+}
+
+func (e *Engine) digestFile(path string, h hash.Hash) (string, error) {
+	fullPath, err := e.resolvePath(path)
+	if err != nil {
+		return "", err
+	}
+	defer e.locks.read(fullPath)()
+	f, err := e.files().Open(fullPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err == nil && info.IsDir() {
+		return "", fmt.Errorf("%s is a directory", path)
+	}
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (e *Engine) diffFiles(args json.RawMessage) (string, error) {
+	var params struct {
+		A       string `json:"a"`
+		B       string `json:"b"`
+		Context *int   `json:"context"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return "", fmt.Errorf("invalid arguments: %v", err)
+	}
+	context := 3
+	if params.Context != nil {
+		context = max(*params.Context, 0)
+	}
+
+	a, err := e.readRaw(params.A)
+	if err != nil {
+		return "", err
+	}
+	b, err := e.readRaw(params.B)
+	if err != nil {
+		return "", err
+	}
+	if bytes.Equal(a, b) {
+		return "Files are identical", nil
+	}
+
+	// Binary files can only be said to differ; text is compared after
+	// decoding, so a change of line endings or encoding alone is noted
+	// rather than shown as every line changing
+	if bytes.IndexByte(a, 0) >= 0 || bytes.IndexByte(b, 0) >= 0 {
+		aDigest := sha256.Sum256(a)
+		bDigest := sha256.Sum256(b)
+		return fmt.Sprintf("Binary files differ\n%x  %s (%d bytes)\n%x  %s (%d bytes)\n",
+			aDigest, params.A, len(a), bDigest, params.B, len(b)), nil
+	}
+	aText, aFormat := decodeText(a)
+	bText, bFormat := decodeText(b)
+	diff := unifiedDiff(params.A, params.B, aText, bText, context)
+	if diff == "" {
+		return fmt.Sprintf("Files have the same text but are stored differently: %s is %s, %s is %s",
+			params.A, describeFormat(aFormat), params.B, describeFormat(bFormat)), nil
+	}
+	diff, _ = truncateOutput(diff)
+	return diff, nil
+}
+
+// readRaw reads a whole file as it is stored, without decoding it as text
+func (e *Engine) readRaw(path string) ([]byte, error) {
+	fullPath, err := e.resolvePath(path)
+	if err != nil {
+		return nil, err
+	}
+	defer e.locks.read(fullPath)()
+	content, err := e.files().ReadFile(fullPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	return content, nil
+}
+
+// describeFormat names how a text file is stored, e.g. "utf-8 with BOM, CRLF"
+func describeFormat(format textFormat) string {
+	s := format.Encoding
+	if format.BOM {
+		s += " with BOM"
+	}
+	if format.CRLF {
+		s += ", CRLF"
+	} else {
+		s += ", LF"
+	}
+	return s
+}
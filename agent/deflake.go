@@ -0,0 +1,293 @@
+package agent
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxDeflakeExamples is how many failure patterns the prompt shows output
+// for; maxDeflakeOutputLines is how much of each
+const (
+	maxDeflakeExamples    = 3
+	maxDeflakeOutputLines = 40
+)
+
+// flakeRun is the outcome of one run of the test command
+type flakeRun struct {
+	passed   bool
+	timedOut bool
+	seconds  float64
+	output   string
+}
+
+// failureLines picks out the lines of test output that say what failed,
+// as opposed to logs and passing tests
+var failureLines = regexp.MustCompile(`(?i)(--- FAIL|^FAIL|panic:|fatal error:|\berror\b|\bassert|expected|\bgot\b|want|timed? ?out|deadlock|data race|Traceback|Exception|✕|✗)`)
+
+// volatile matches what differs between runs of the same failure:
+// addresses, durations, times, ids and numbers
+var volatile = regexp.MustCompile(`0x[0-9a-fA-F]+|\b\d+(\.\d+)?(ns|µs|us|ms|s|m|h)\b|\d{2}:\d{2}:\d{2}(\.\d+)?|\b[0-9a-f]{8}-[0-9a-f-]{27}\b|\b\d+\b`)
+
+// failureSignature sums up a failure so that runs failing the same way
+// share it: the lines saying what failed, with what varies between runs
+// masked, in order and without repeats
+func failureSignature(run flakeRun) string {
+	if run.timedOut {
+		return "timed out"
+	}
+	var lines []string
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(run.output, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || !failureLines.MatchString(line) {
+			continue
+		}
+		line = volatile.ReplaceAllString(line, "N")
+		if !seen[line] && len(lines) < 5 {
+			seen[line] = true
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) == 0 {
+		return "failed with no recognizable error"
+	}
+	return strings.Join(lines, "\n")
+}
+
+// failurePattern is a signature with the runs that failed with it
+type failurePattern struct {
+	signature string
+	runs      []int
+}
+
+func groupFailures(runs []flakeRun) []failurePattern {
+	index := make(map[string]int)
+	var patterns []failurePattern
+	for i, run := range runs {
+		if run.passed {
+			continue
+		}
+		signature := failureSignature(run)
+		if _, ok := index[signature]; !ok {
+			index[signature] = len(patterns)
+			patterns = append(patterns, failurePattern{signature: signature})
+		}
+		p := &patterns[index[signature]]
+		p.runs = append(p.runs, i)
+	}
+	sort.SliceStable(patterns, func(i, j int) bool {
+		return len(patterns[i].runs) > len(patterns[j].runs)
+	})
+	return patterns
+}
+
+// runFlakeCommand runs the test command once, as runCheck does, but keeps
+// the output of passing runs too and the time taken
+func runFlakeCommand(dir, command string, timeout time.Duration) flakeRun {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Dir = dir
+	start := time.Now()
+	output, err := cmd.CombinedOutput()
+	return flakeRun{
+		passed:   err == nil,
+		timedOut: ctx.Err() != nil,
+		seconds:  time.Since(start).Seconds(),
+		output:   string(output),
+	}
+}
+
+// runFlakeSeries runs the test command n times, showing progress
+func runFlakeSeries(dir, command string, n int, timeout time.Duration, w io.Writer) []flakeRun {
+	var runs []flakeRun
+	for i := 0; i < n; i++ {
+		run := runFlakeCommand(dir, command, timeout)
+		status := "pass"
+		if run.timedOut {
+			status = "TIMEOUT"
+		} else if !run.passed {
+			status = "FAIL"
+		}
+		fmt.Fprintf(w, "Run %d/%d: %s (%.1fs)\n", i+1, n, status, run.seconds)
+		runs = append(runs, run)
+	}
+	return runs
+}
+
+func countFailures(runs []flakeRun) int {
+	n := 0
+	for _, run := range runs {
+		if !run.passed {
+			n++
+		}
+	}
+	return n
+}
+
+// runDeflake handles "wex deflake", which runs a test command many times to
+// gather evidence of how it fails, and has the model fix the flakiness
+func runDeflake(engine *Engine, args []string, w io.Writer) error {
+	deflakeFlags := flag.NewFlagSet("deflake", flag.ExitOnError)
+	command := deflakeFlags.String("cmd", "", "Test command to run, e.g. \"go test ./... -run TestX -count 1\"")
+	runs := deflakeFlags.Int("runs", 20, "Times to run it")
+	timeout := deflakeFlags.Duration("timeout", checkScriptTimeout, "Time allowed for each run, after which it counts as a failure")
+	since := deflakeFlags.String("since", "30 days ago", "How far back to look for changes to the code in the failures")
+	reportOnly := deflakeFlags.Bool("report", false, "Only report the failures, without asking for a fix")
+	deflakeFlags.Usage = func() {
+		fmt.Fprintf(deflakeFlags.Output(), "Usage: wex [flags] deflake --cmd CMD [--runs N] [--timeout D] [--since DATE] [--report] [instructions]\n")
+		deflakeFlags.PrintDefaults()
+	}
+	deflakeFlags.Parse(args)
+	if *command == "" {
+		return fmt.Errorf("no test command; give it with --cmd")
+	}
+	if *runs < 2 {
+		return fmt.Errorf("--runs must be at least 2")
+	}
+
+	before := runFlakeSeries(engine.workspace, *command, *runs, *timeout, w)
+	failed := countFailures(before)
+	fmt.Fprintf(w, "%d of %d runs failed\n", failed, len(before))
+	switch failed {
+	case 0:
+		fmt.Fprintf(w, "No failures; try more --runs, or run it under load\n")
+		return nil
+	case len(before):
+		return fmt.Errorf("it failed every time, so it isn't flaky; use wex fix for a consistent failure")
+	}
+
+	message := engine.deflakeMessage(*command, before, *since, strings.Join(deflakeFlags.Args(), " "))
+	if *reportOnly {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, message)
+		return nil
+	}
+
+	if engine.taskType == "" || engine.taskType == taskTypeAuto {
+		engine.taskType = "bug-fix"
+	}
+	if err := engine.ProcessRequest(message); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "\nRunning it again %d times to check the fix\n", *runs)
+	after := runFlakeSeries(engine.workspace, *command, *runs, *timeout, w)
+	fmt.Fprintf(w, "Before the fix %d of %d runs failed; after it, %d of %d\n", failed, len(before), countFailures(after), len(after))
+	if countFailures(after) > 0 {
+		return fmt.Errorf("still flaky")
+	}
+	return nil
+}
+
+// deflakeMessage asks for a fix to a flaky test, with the evidence: how
+// often and in what ways it failed, how long runs took, and the recent
+// changes to the code the failures point at
+func (e *Engine) deflakeMessage(command string, runs []flakeRun, since, instructions string) string {
+	var b strings.Builder
+	failed := countFailures(runs)
+	fmt.Fprintf(&b, "The test command `%s` is flaky: run %d times without changes, it failed %d times and passed %d. ", command, len(runs), failed, len(runs)-failed)
+	b.WriteString("Find out what makes it fail only sometimes, such as test order, shared state, timing, randomness, concurrency or the environment, and fix that cause. " +
+		"Don't add retries or sleeps, loosen what the test checks, or skip it.\n")
+	if instructions != "" {
+		fmt.Fprintf(&b, "\n%s\n", instructions)
+	}
+
+	patterns := groupFailures(runs)
+	if len(patterns) == 1 {
+		b.WriteString("\nThe failures all look alike:\n")
+	} else {
+		fmt.Fprintf(&b, "\nThe failures fall into %d patterns:\n", len(patterns))
+	}
+	var outputs []string
+	for i, p := range patterns {
+		var numbers []string
+		for _, run := range p.runs {
+			numbers = append(numbers, fmt.Sprint(run+1))
+		}
+		fmt.Fprintf(&b, "\n%d. %d of %d failures (runs %s):\n", i+1, len(p.runs), failed, strings.Join(numbers, ", "))
+		for _, line := range strings.Split(p.signature, "\n") {
+			fmt.Fprintf(&b, "   %s\n", line)
+		}
+		if i < maxDeflakeExamples {
+			output := lastLines(runs[p.runs[0]].output, maxDeflakeOutputLines)
+			fence := codeFence(output)
+			fmt.Fprintf(&b, "\nOutput of run %d:\n%s\n%s\n%s\n", p.runs[0]+1, fence, output, fence)
+			outputs = append(outputs, runs[p.runs[0]].output)
+		}
+	}
+
+	var passTimes, failTimes []float64
+	for _, run := range runs {
+		if run.passed {
+			passTimes = append(passTimes, run.seconds)
+		} else {
+			failTimes = append(failTimes, run.seconds)
+		}
+	}
+	fmt.Fprintf(&b, "\nPassing runs took %s; failing runs took %s.\n", timeRange(passTimes), timeRange(failTimes))
+
+	if changes := e.recentChanges(strings.Join(outputs, "\n"), since); changes != "" {
+		fmt.Fprintf(&b, "\nRecent changes to the files in the failures, which may have made it flaky:\n%s\n", changes)
+	}
+	return b.String()
+}
+
+func timeRange(seconds []float64) string {
+	if len(seconds) == 0 {
+		return "no time"
+	}
+	lo, hi := seconds[0], seconds[0]
+	for _, s := range seconds {
+		lo, hi = min(lo, s), max(hi, s)
+	}
+	if hi-lo < 0.05 {
+		return fmt.Sprintf("%.1fs", lo)
+	}
+	return fmt.Sprintf("%.1f-%.1fs", lo, hi)
+}
+
+// recentChanges lists the commits since a date that touched the files
+// referenced in the output, and any uncommitted changes to them
+func (e *Engine) recentChanges(output, since string) string {
+	var files []string
+	seen := make(map[string]bool)
+	for _, loc := range parseStackTrace(output) {
+		path, ok := e.resolveTracePath(loc.Path)
+		if ok && !seen[path] && len(files) < maxTraceFiles {
+			seen[path] = true
+			files = append(files, path)
+		}
+	}
+	if len(files) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	for _, path := range files {
+		commits, err := e.git("log", "-5", "--since="+since, "--date=short", "--format=%h %ad %s", "--", path)
+		if err != nil {
+			return ""
+		}
+		uncommitted, _ := e.git("diff", "--stat", "HEAD", "--", path)
+		if commits == "" && uncommitted == "" {
+			continue
+		}
+		fmt.Fprintf(&b, "\n%s:\n", path)
+		for _, line := range strings.Split(commits, "\n") {
+			if line != "" {
+				fmt.Fprintf(&b, "  %s\n", line)
+			}
+		}
+		if uncommitted != "" {
+			b.WriteString("  (also changed since the last commit)\n")
+		}
+	}
+	return b.String()
+}
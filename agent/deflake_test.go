@@ -0,0 +1,69 @@
+package agent
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFailureSignature(t *testing.T) {
+	runs := []flakeRun{
+		{output: "=== RUN   TestCache\n    cache_test.go:41: got 3 entries, want 2\n--- FAIL: TestCache (0.02s)\nFAIL\n"},
+		{passed: true, output: "ok  \tcache\t0.01s\n"},
+		{output: "=== RUN   TestCache\n    cache_test.go:41: got 4 entries, want 2\n--- FAIL: TestCache (1.50s)\nFAIL\n"},
+		{output: "panic: send on closed channel\n\ngoroutine 7 [running]:\ncache.(*Cache).evict(0xc000010000)\n\tcache.go:88 +0x45\n"},
+		{timedOut: true},
+	}
+	patterns := groupFailures(runs)
+	if len(patterns) != 3 {
+		t.Fatalf("patterns: %q", patterns)
+	}
+	if p := patterns[0]; len(p.runs) != 2 || p.runs[1] != 2 || p.signature != "cache_test.go:N: got N entries, want N\n--- FAIL: TestCache (N)\nFAIL" {
+		t.Errorf("first pattern: %q", p)
+	}
+	if p := patterns[1]; p.signature != "panic: send on closed channel" {
+		t.Errorf("second pattern: %q", p)
+	}
+	if p := patterns[2]; p.signature != "timed out" {
+		t.Errorf("third pattern: %q", p)
+	}
+}
+
+func TestDeflake(t *testing.T) {
+	e, provider, _ := newTestEngine(t, []ChatResponse{
+		reply("", call("write_file", `{"path": "fixed", "content": "yes\n"}`)),
+		reply("The test shared a counter with another test."),
+	})
+	git := func(args ...string) {
+		if _, err := gitIn(e.workspace, append([]string{"-c", "user.name=t", "-c", "user.email=t@t"}, args...)...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeTestFile(t, e, "counter_test.go", "package counter\n\nfunc TestCount(t *testing.T) {}\n")
+	git("init", "--quiet")
+	git("add", "--all")
+	git("commit", "--quiet", "-m", "Count things in parallel")
+
+	// Fails on the second run of every three, until fixed
+	command := `[ -e fixed ] && exit 0; n=$(cat .runs 2>/dev/null || echo 0); echo $((n+1)) > .runs; ` +
+		`if [ $((n % 3)) = 1 ]; then echo "    counter_test.go:3: got $n, want 0"; echo "--- FAIL: TestCount (0.0${n}s)"; exit 1; fi`
+	var out strings.Builder
+	if err := runDeflake(e, []string{"--cmd", command, "--runs", "6"}, &out); err != nil {
+		t.Fatalf("%v\n%s", err, out.String())
+	}
+
+	request := provider.lastMessages(t, 1)[1].Content
+	for _, want := range []string{
+		"failed 2 times and passed 4",
+		"The failures all look alike:\n\n1. 2 of 2 failures (runs 2, 5):\n   counter_test.go:N: got N, want N\n",
+		"Output of run 2:\n```\n    counter_test.go:3: got 1, want 0\n",
+		"counter_test.go:\n  ",
+		"Count things in parallel",
+	} {
+		if !strings.Contains(request, want) {
+			t.Errorf("request has no %q:\n%s", want, request)
+		}
+	}
+	if !strings.Contains(out.String(), "Before the fix 2 of 6 runs failed; after it, 0 of 6") {
+		t.Errorf("output:\n%s", out.String())
+	}
+}
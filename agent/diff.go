@@ -0,0 +1,201 @@
+package agent
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxDiffEdits bounds the Myers search; past it, the differing middle of
+// the texts is shown as replaced outright
+const maxDiffEdits = 4000
+
+// diffOp is a line kept (' '), deleted ('-') or inserted ('+')
+type diffOp struct {
+	kind byte
+	line string
+}
+
+// splitLines splits text into lines, each keeping its line break, so a
+// missing final newline counts as a difference
+func splitLines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffLines finds a shortest edit script from a to b, with Myers'
+// algorithm, after setting aside any common prefix and suffix
+func diffLines(a, b []string) []diffOp {
+	var ops []diffOp
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		ops = append(ops, diffOp{' ', a[prefix]})
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	ops = append(ops, myers(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+	for _, line := range a[len(a)-suffix:] {
+		ops = append(ops, diffOp{' ', line})
+	}
+	return ops
+}
+
+func myers(a, b []string) []diffOp {
+	n, m := len(a), len(b)
+	total := n + m
+	replace := func() []diffOp {
+		var ops []diffOp
+		for _, line := range a {
+			ops = append(ops, diffOp{'-', line})
+		}
+		for _, line := range b {
+			ops = append(ops, diffOp{'+', line})
+		}
+		return ops
+	}
+	if n == 0 || m == 0 {
+		return replace()
+	}
+
+	// v[k+offset] is the furthest x reached on diagonal k. trace[d] keeps the
+	// diagonals -d-1..d+1 of v as it was before step d, for backtracking.
+	offset := total + 1
+	v := make([]int, 2*offset+1)
+	var trace [][]int
+	found := -1
+	for d := 0; d <= total && d <= maxDiffEdits && found < 0; d++ {
+		lo, hi := offset-d-1, offset+d+2
+		trace = append(trace, append([]int(nil), v[lo:hi]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || k != d && v[k-1+offset] < v[k+1+offset] {
+				x = v[k+1+offset]
+			} else {
+				x = v[k-1+offset] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[k+offset] = x
+			if x >= n && y >= m {
+				found = d
+				break
+			}
+		}
+	}
+	if found < 0 {
+		return replace()
+	}
+
+	// Walk back from the end, collecting operations in reverse
+	var reversed []diffOp
+	x, y := n, m
+	for d := found; d >= 0; d-- {
+		at := func(k int) int { return trace[d][k+d+1] }
+		k := x - y
+		var prevK int
+		if k == -d || k != d && at(k-1) < at(k+1) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := at(prevK)
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			reversed = append(reversed, diffOp{' ', a[x-1]})
+			x--
+			y--
+		}
+		if d > 0 {
+			if x == prevX {
+				reversed = append(reversed, diffOp{'+', b[y-1]})
+			} else {
+				reversed = append(reversed, diffOp{'-', a[x-1]})
+			}
+		}
+		x, y = prevX, prevY
+	}
+	ops := make([]diffOp, len(reversed))
+	for i, op := range reversed {
+		ops[len(ops)-1-i] = op
+	}
+	return ops
+}
+
+// unifiedDiff compares two texts line by line, in the format of diff -u;
+// it returns "" if they are the same
+func unifiedDiff(aName, bName, a, b string, context int) string {
+	ops := diffLines(splitLines(a), splitLines(b))
+
+	// Find the changed operations, and group those close enough to share
+	// context into hunks
+	var changes []int
+	for i, op := range ops {
+		if op.kind != ' ' {
+			changes = append(changes, i)
+		}
+	}
+	if len(changes) == 0 {
+		return ""
+	}
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", aName, bName)
+	for i := 0; i < len(changes); {
+		start := max(changes[i]-context, 0)
+		j := i
+		for j+1 < len(changes) && changes[j+1]-changes[j] <= 2*context+1 {
+			j++
+		}
+		end := min(changes[j]+context+1, len(ops))
+
+		// Line numbers where the hunk starts in each text
+		aLine, bLine := 1, 1
+		for _, op := range ops[:start] {
+			if op.kind != '+' {
+				aLine++
+			}
+			if op.kind != '-' {
+				bLine++
+			}
+		}
+		aCount, bCount := 0, 0
+		for _, op := range ops[start:end] {
+			if op.kind != '+' {
+				aCount++
+			}
+			if op.kind != '-' {
+				bCount++
+			}
+		}
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(aLine, aCount), hunkRange(bLine, bCount))
+		for _, op := range ops[start:end] {
+			out.WriteByte(op.kind)
+			out.WriteString(op.line)
+			if !strings.HasSuffix(op.line, "\n") {
+				out.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		i = j + 1
+	}
+	return out.String()
+}
+
+// hunkRange formats a hunk's start line and length; an empty range names
+// the line before it
+func hunkRange(line, count int) string {
+	switch count {
+	case 0:
+		return fmt.Sprintf("%d,0", line-1)
+	case 1:
+		return fmt.Sprintf("%d", line)
+	}
+	return fmt.Sprintf("%d,%d", line, count)
+}
@@ -0,0 +1,404 @@
+package agent
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	// envLine matches an assignment in a .env file, e.g. export KEY="value"
+	envLine = regexp.MustCompile(`^\s*(export\s+)?([A-Za-z_][A-Za-z0-9_.]*)\s*=\s*(.*)$`)
+
+	envName       = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	plainEnvValue = regexp.MustCompile(`^[A-Za-z0-9_./:@+,=-]*$`)
+)
+
+// secretName matches variable names whose values are not shown to the model
+var secretName = regexp.MustCompile(`(?i)secret|token|passw|pwd|_key|^key|apikey|auth|credential|private|cert|salt|session|cookie|dsn|signing`)
+
+// urlCredentials matches a URL with a password, e.g. postgres://u:p@host
+var urlCredentials = regexp.MustCompile(`://[^/\s:@]+:[^/\s@]+@`)
+
+// envUsages find environment variable names in source code
+var envUsages = []*regexp.Regexp{
+	// Go
+	regexp.MustCompile(`os\.(?:Getenv|LookupEnv)\("([A-Za-z_][A-Za-z0-9_]*)"\)`),
+	// JavaScript and TypeScript
+	regexp.MustCompile(`process\.env\.([A-Za-z_][A-Za-z0-9_]*)`),
+	regexp.MustCompile(`process\.env\[["']([A-Za-z_][A-Za-z0-9_]*)["']\]`),
+	regexp.MustCompile(`import\.meta\.env\.([A-Za-z_][A-Za-z0-9_]*)`),
+	// Python
+	regexp.MustCompile(`os\.(?:getenv|environ\.get|environ\.setdefault)\(\s*["']([A-Za-z_][A-Za-z0-9_]*)["']`),
+	regexp.MustCompile(`os\.environ\[["']([A-Za-z_][A-Za-z0-9_]*)["']\]`),
+	// Rust
+	regexp.MustCompile(`env::var(?:_os)?\("([A-Za-z_][A-Za-z0-9_]*)"\)`),
+	regexp.MustCompile(`env!\("([A-Za-z_][A-Za-z0-9_]*)"\)`),
+	// Ruby
+	regexp.MustCompile(`ENV(?:\.fetch\(|\[)["']([A-Za-z_][A-Za-z0-9_]*)["']`),
+	// Java, Kotlin, C and PHP
+	regexp.MustCompile(`(?:System\.getenv|getenv)\(\s*["']([A-Za-z_][A-Za-z0-9_]*)["']`),
+	// C#
+	regexp.MustCompile(`Environment\.GetEnvironmentVariable\("([A-Za-z_][A-Za-z0-9_]*)"\)`),
+}
+
+// maxEnvScanBytes skips files too big to be hand-written source
+const maxEnvScanBytes = 1 << 20
+
+// envEntry is a variable set in a .env file
+type envEntry struct {
+	name  string
+	value string
+	line  int // index in the file's lines
+}
+
+// parseEnvFile reads the assignments in a .env file
+func parseEnvFile(text string) []envEntry {
+	var entries []envEntry
+	for i, line := range strings.Split(text, "\n") {
+		m := envLine.FindStringSubmatch(line)
+		if m == nil || strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		entries = append(entries, envEntry{name: m[2], value: unquoteEnvValue(m[3]), line: i})
+	}
+	return entries
+}
+
+func unquoteEnvValue(value string) string {
+	value = strings.TrimSpace(value)
+	switch {
+	case strings.HasPrefix(value, `"`):
+		if end := strings.LastIndex(value, `"`); end > 0 {
+			if s, err := strconv.Unquote(value[:end+1]); err == nil {
+				return s
+			}
+			return value[1:end]
+		}
+	case strings.HasPrefix(value, "'"):
+		if end := strings.LastIndex(value, "'"); end > 0 {
+			return value[1:end]
+		}
+	}
+	if i := strings.Index(value, " #"); i >= 0 {
+		value = strings.TrimSpace(value[:i])
+	}
+	return value
+}
+
+func quoteEnvValue(value string) string {
+	if plainEnvValue.MatchString(value) {
+		return value
+	}
+	return strconv.Quote(value)
+}
+
+// isSecret reports whether a variable's value should be hidden
+func isSecret(name, value string) bool {
+	return secretName.MatchString(name) || urlCredentials.MatchString(value)
+}
+
+// redact shows a value, or only its length if it is a secret
+func redact(name, value string) string {
+	switch {
+	case value == "":
+		return `""`
+	case isSecret(name, value):
+		return fmt.Sprintf("<redacted, %d characters>", len(value))
+	}
+	return value
+}
+
+func envTools() []Tool {
+	return []Tool{
+		{
+			Type: "function",
+			Function: Function{
+				Name:        "read_env_file",
+				Description: "List the variables in a .env file. Values of secrets such as tokens, keys and passwords are redacted to their length",
+				Parameters: map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"path": map[string]interface{}{
+							"type":        "string",
+							"description": "File path relative to workspace (optional, default .env)",
+						},
+					},
+				},
+			},
+		},
+		{
+			Type: "function",
+			Function: Function{
+				Name:        "update_env_file",
+				Description: "Set or remove one variable in a .env file, keeping the rest of the file as it is. A new file is created readable only by its owner",
+				Parameters: map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"path": map[string]interface{}{
+							"type":        "string",
+							"description": "File path relative to workspace (optional, default .env)",
+						},
+						"name": map[string]interface{}{
+							"type":        "string",
+							"description": "Variable name",
+						},
+						"value": map[string]interface{}{
+							"type":        "string",
+							"description": "New value; quoted in the file as needed",
+						},
+						"remove": map[string]interface{}{
+							"type":        "boolean",
+							"description": "Remove the variable instead of setting it",
+						},
+					},
+					"required": []string{"name"},
+				},
+			},
+		},
+		{
+			Type: "function",
+			Function: Function{
+				Name:        "find_env_vars",
+				Description: "Find the environment variables a project expects, by scanning source code for reads such as os.Getenv, process.env and os.environ, and report where each is used and whether it is set in .env, listed in .env.example or set in the environment",
+				Parameters: map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"path": map[string]interface{}{
+							"type":        "string",
+							"description": "Directory to scan, relative to workspace (optional, default the whole workspace)",
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// loadEnvFile reads a .env file, returning "" if it does not exist
+func (e *Engine) loadEnvFile(path string) (string, bool, error) {
+	fullPath, err := e.resolvePath(path)
+	if err != nil {
+		return "", false, err
+	}
+	defer e.locks.read(fullPath)()
+	content, err := e.files().ReadFile(fullPath)
+	if os.IsNotExist(err) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("failed to read file: %v", err)
+	}
+	text, _ := decodeText(content)
+	return text, true, nil
+}
+
+func (e *Engine) readEnvFile(args json.RawMessage) (string, error) {
+	var params struct {
+		Path string `json:"path"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return "", fmt.Errorf("invalid arguments: %v", err)
+	}
+	if params.Path == "" {
+		params.Path = ".env"
+	}
+	text, exists, err := e.loadEnvFile(params.Path)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		return "", fmt.Errorf("%s does not exist", params.Path)
+	}
+
+	entries := parseEnvFile(text)
+	if len(entries) == 0 {
+		return fmt.Sprintf("%s sets no variables", params.Path), nil
+	}
+	var b strings.Builder
+	for _, entry := range entries {
+		fmt.Fprintf(&b, "%s=%s\n", entry.name, redact(entry.name, entry.value))
+	}
+	return b.String(), nil
+}
+
+func (e *Engine) updateEnvFile(args json.RawMessage) (string, error) {
+	var params struct {
+		Path   string `json:"path"`
+		Name   string `json:"name"`
+		Value  string `json:"value"`
+		Remove bool   `json:"remove"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return "", fmt.Errorf("invalid arguments: %v", err)
+	}
+	if params.Path == "" {
+		params.Path = ".env"
+	}
+	if !envName.MatchString(params.Name) {
+		return "", fmt.Errorf("invalid variable name %q", params.Name)
+	}
+	text, exists, err := e.loadEnvFile(params.Path)
+	if err != nil {
+		return "", err
+	}
+
+	// Replace or remove every assignment of the variable, or add one
+	assignment := params.Name + "=" + quoteEnvValue(params.Value)
+	lines := strings.Split(text, "\n")
+	removed := make(map[int]bool)
+	action := "Added"
+	for _, entry := range parseEnvFile(text) {
+		if entry.name != params.Name {
+			continue
+		}
+		if params.Remove {
+			removed[entry.line] = true
+			action = "Removed"
+			continue
+		}
+		line := assignment
+		if envLine.FindStringSubmatch(lines[entry.line])[1] != "" {
+			line = "export " + line
+		}
+		lines[entry.line] = line
+		action = "Set"
+	}
+
+	var kept []string
+	for i, line := range lines {
+		if !removed[i] {
+			kept = append(kept, line)
+		}
+	}
+	updated := strings.Join(kept, "\n")
+	switch {
+	case action == "Added" && params.Remove:
+		return fmt.Sprintf("%s is not set in %s", params.Name, params.Path), nil
+	case action == "Added":
+		if updated != "" && !strings.HasSuffix(updated, "\n") {
+			updated += "\n"
+		}
+		updated += assignment + "\n"
+	}
+
+	mode := ""
+	if !exists {
+		mode = "0600"
+	}
+	if err := e.saveFile(params.Path, updated, mode); err != nil {
+		return "", err
+	}
+	if params.Remove {
+		return fmt.Sprintf("%s %s from %s", action, params.Name, params.Path), nil
+	}
+	return fmt.Sprintf("%s %s=%s in %s", action, params.Name, redact(params.Name, params.Value), params.Path), nil
+}
+
+func (e *Engine) findEnvVars(args json.RawMessage) (string, error) {
+	var params struct {
+		Path string `json:"path"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return "", fmt.Errorf("invalid arguments: %v", err)
+	}
+	root, err := e.resolvePath(params.Path)
+	if err != nil {
+		return "", err
+	}
+
+	usages := make(map[string][]string)
+	walkDir(e.files(), root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			if path != root && (skippedDirs[d.Name()] || strings.HasPrefix(d.Name(), ".")) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if _, ok := languages[strings.ToLower(filepath.Ext(path))]; !ok {
+			return nil
+		}
+		if info, err := d.Info(); err != nil || info.Size() > maxEnvScanBytes {
+			return nil
+		}
+		f, err := e.files().Open(path)
+		if err != nil {
+			return nil
+		}
+		defer f.Close()
+
+		rel, _ := filepath.Rel(e.workspace, path)
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), maxEnvScanBytes)
+		for line := 1; scanner.Scan(); line++ {
+			for _, re := range envUsages {
+				for _, m := range re.FindAllStringSubmatch(scanner.Text(), -1) {
+					usages[m[1]] = append(usages[m[1]], fmt.Sprintf("%s:%d", filepath.ToSlash(rel), line))
+				}
+			}
+		}
+		return nil
+	})
+
+	// What each variable's setting is, from .env files next to the scan root
+	inFile := func(name string) map[string]bool {
+		text, _, _ := e.loadEnvFile(filepath.Join(params.Path, name))
+		set := make(map[string]bool)
+		for _, entry := range parseEnvFile(text) {
+			set[entry.name] = true
+		}
+		return set
+	}
+	dotenv, example := inFile(".env"), inFile(".env.example")
+	for name := range example {
+		if _, ok := usages[name]; !ok {
+			usages[name] = nil
+		}
+	}
+	if len(usages) == 0 {
+		return "No environment variables found", nil
+	}
+
+	var names []string
+	for name := range usages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		var status []string
+		if dotenv[name] {
+			status = append(status, "set in .env")
+		}
+		if example[name] {
+			status = append(status, "in .env.example")
+		}
+		if _, ok := os.LookupEnv(name); ok {
+			status = append(status, "set in the environment")
+		}
+		if len(status) == 0 {
+			status = append(status, "not set")
+		}
+		fmt.Fprintf(&b, "%s (%s)", name, strings.Join(status, ", "))
+
+		places := usages[name]
+		if len(places) > 3 {
+			places = append(places[:3:3], fmt.Sprintf("and %d more", len(places)-3))
+		}
+		if len(places) > 0 {
+			fmt.Fprintf(&b, ": %s", strings.Join(places, ", "))
+		}
+		b.WriteString("\n")
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,113 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"unicode/utf16"
+)
+
+// textFormat is how a text file is stored on disk. Files are shown to the
+// model as plain UTF-8 with LF line endings, and written back in their
+// original format, so that edits to Windows-style files don't turn into
+// whole-file diffs.
+type textFormat struct {
+	Encoding string // utf-8, utf-16le or utf-16be
+	BOM      bool
+	CRLF     bool
+}
+
+var (
+	utf8BOM    = []byte{0xEF, 0xBB, 0xBF}
+	utf16LEBOM = []byte{0xFF, 0xFE}
+	utf16BEBOM = []byte{0xFE, 0xFF}
+)
+
+// decodeText converts file contents to UTF-8 with LF line endings, and
+// reports the format they were in
+func decodeText(data []byte) (string, textFormat) {
+	format := textFormat{Encoding: "utf-8"}
+	var text string
+
+	switch {
+	case bytes.HasPrefix(data, utf8BOM):
+		format.BOM = true
+		text = string(data[len(utf8BOM):])
+	case bytes.HasPrefix(data, utf16LEBOM):
+		format = textFormat{Encoding: "utf-16le", BOM: true}
+		text = decodeUTF16(data[len(utf16LEBOM):], binary.LittleEndian)
+	case bytes.HasPrefix(data, utf16BEBOM):
+		format = textFormat{Encoding: "utf-16be", BOM: true}
+		text = decodeUTF16(data[len(utf16BEBOM):], binary.BigEndian)
+	default:
+		text = string(data)
+	}
+
+	// Mostly CRLF counts as CRLF; a stray LF in such a file will become CRLF
+	// when it is written back
+	crlf := strings.Count(text, "\r\n")
+	if crlf > 0 && crlf >= strings.Count(text, "\n")-crlf {
+		format.CRLF = true
+		text = strings.ReplaceAll(text, "\r\n", "\n")
+	}
+	return text, format
+}
+
+// encodeText converts UTF-8 text to the given format
+func encodeText(text string, format textFormat) []byte {
+	if format.CRLF {
+		text = strings.ReplaceAll(strings.ReplaceAll(text, "\r\n", "\n"), "\n", "\r\n")
+	}
+
+	switch format.Encoding {
+	case "utf-16le":
+		return append(bomFor(format, utf16LEBOM), encodeUTF16(text, binary.LittleEndian)...)
+	case "utf-16be":
+		return append(bomFor(format, utf16BEBOM), encodeUTF16(text, binary.BigEndian)...)
+	default:
+		return append(bomFor(format, utf8BOM), text...)
+	}
+}
+
+func bomFor(format textFormat, bom []byte) []byte {
+	if !format.BOM {
+		return nil
+	}
+	return append([]byte(nil), bom...)
+}
+
+func decodeUTF16(data []byte, order binary.ByteOrder) string {
+	units := make([]uint16, len(data)/2)
+	for i := range units {
+		units[i] = order.Uint16(data[2*i:])
+	}
+	return string(utf16.Decode(units))
+}
+
+func encodeUTF16(text string, order binary.ByteOrder) []byte {
+	units := utf16.Encode([]rune(text))
+	data := make([]byte, 2*len(units))
+	for i, unit := range units {
+		order.PutUint16(data[2*i:], unit)
+	}
+	return data
+}
+
+// isPlain reports whether the format is UTF-8 without a BOM and with LF
+// line endings, which needs no mention to the model
+func (f textFormat) isPlain() bool {
+	return f.Encoding == "utf-8" && !f.BOM && !f.CRLF
+}
+
+func (f textFormat) String() string {
+	s := strings.ToUpper(f.Encoding)
+	if f.BOM {
+		s += " with BOM"
+	}
+	if f.CRLF {
+		s += ", CRLF line endings"
+	} else {
+		s += ", LF line endings"
+	}
+	return s
+}
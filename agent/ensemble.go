@@ -0,0 +1,201 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// In ensemble mode, a write_file call is not carried out as proposed. The
+// conversation that led to it goes to the ensemble models too, and their
+// writes to the same file are compared with it: a version most of the
+// models agree on is written, and otherwise a judge model picks one, or
+// nothing is written. It costs a request to each model per write, for
+// changes that have to be right.
+
+// ensembleVersion is one proposed content for a file, with the models that
+// proposed it
+type ensembleVersion struct {
+	args    json.RawMessage
+	content string
+	models  []string
+}
+
+const judgePrompt = `A coding assistant was given this request:
+
+%s
+
+Models proposed different versions of %s. Here is each one, as a diff against the current file:
+
+%s
+Which version carries out the request correctly and best? Answer with the version number alone, or 0 if none of them is acceptable.`
+
+// callToolVoting is callTool, with writes decided by the ensemble if there
+// is one; asked is the conversation the model answered with the call
+func (e *Engine) callToolVoting(ctx context.Context, asked []Message, toolCall ToolCall) (string, error) {
+	if len(e.ensembleModels) == 0 || toolCall.Function.Name != "write_file" || !e.toolFilter.allows("write_file") {
+		return e.callTool(toolCall)
+	}
+	args, note, err := e.voteOnWrite(ctx, asked, toolCall.Function.Arguments)
+	if err != nil {
+		return "", err
+	}
+	toolCall.Function.Arguments = args
+	result, err := e.callTool(toolCall)
+	if err == nil {
+		result += "\n" + note
+	}
+	return result, err
+}
+
+// voteOnWrite returns the arguments of the write_file call to make, and a
+// note on how they were decided
+func (e *Engine) voteOnWrite(ctx context.Context, asked []Message, proposal json.RawMessage) (json.RawMessage, string, error) {
+	var params struct {
+		Path    string `json:"path"`
+		Content string `json:"content"`
+	}
+	if err := json.Unmarshal(proposal, &params); err != nil {
+		return proposal, "", nil
+	}
+	target, err := e.resolvePath(params.Path)
+	if err != nil {
+		return proposal, "", nil
+	}
+
+	versions := []*ensembleVersion{{args: proposal, content: params.Content, models: []string{e.model}}}
+	for _, model := range e.ensembleModels {
+		resp, err := e.postChat(ctx, ChatRequest{
+			Model:    model,
+			Messages: asked,
+			Tools:    e.adapter.Tools(e.getTools()),
+			Options:  e.options,
+		})
+		if err != nil {
+			e.logf("Ensemble model %s failed: %v", model, err)
+			continue
+		}
+		args, content, ok := e.findWrite(resp, target)
+		if !ok {
+			e.logf("Ensemble model %s did not write %s", model, params.Path)
+			continue
+		}
+		version := findVersion(versions, content)
+		if version == nil {
+			version = &ensembleVersion{args: args, content: content}
+			versions = append(versions, version)
+		}
+		version.models = append(version.models, model)
+	}
+
+	voters := len(e.ensembleModels) + 1
+	sort.SliceStable(versions, func(i, j int) bool {
+		return len(versions[i].models) > len(versions[j].models)
+	})
+	best := versions[0]
+	if len(best.models)*2 > voters {
+		note := fmt.Sprintf("%d of %d models agreed on this version.", len(best.models), voters)
+		if best.models[0] != e.model {
+			note += " It is not the version you proposed, so read the file before changing it further."
+		}
+		e.logf("Ensemble: %s", note)
+		return best.args, note, nil
+	}
+	if e.judgeModel == "" {
+		return nil, "", fmt.Errorf("the models did not agree on %s (%d versions from %d models), so nothing was written", params.Path, len(versions), voters)
+	}
+
+	choice, err := e.judge(ctx, params.Path, target, versions)
+	if err != nil {
+		return nil, "", err
+	}
+	if choice == 0 {
+		return nil, "", fmt.Errorf("the models did not agree on %s and the judge model accepted none of their versions, so nothing was written", params.Path)
+	}
+	chosen := versions[choice-1]
+	note := fmt.Sprintf("The models did not agree; the judge model chose the version from %s.", strings.Join(chosen.models, ", "))
+	if chosen.models[0] != e.model {
+		note += " It is not the version you proposed, so read the file before changing it further."
+	}
+	e.logf("Ensemble: %s", note)
+	return chosen.args, note, nil
+}
+
+// findWrite returns the arguments and content of a write to target in an
+// ensemble model's reply
+func (e *Engine) findWrite(resp *ChatResponse, target string) (json.RawMessage, string, bool) {
+	for _, toolCall := range e.collectToolCalls(resp.Message.ToolCalls, resp.Message.Content) {
+		if toolCall.Function.Name != "write_file" {
+			continue
+		}
+		var params struct {
+			Path    string `json:"path"`
+			Content string `json:"content"`
+		}
+		if err := json.Unmarshal(toolCall.Function.Arguments, &params); err != nil {
+			continue
+		}
+		if path, err := e.resolvePath(params.Path); err == nil && path == target {
+			return toolCall.Function.Arguments, params.Content, true
+		}
+	}
+	return nil, "", false
+}
+
+// findVersion returns the version with the same content, ignoring trailing
+// whitespace, which models vary in without meaning anything by it
+func findVersion(versions []*ensembleVersion, content string) *ensembleVersion {
+	for _, version := range versions {
+		if normalizeVersion(version.content) == normalizeVersion(content) {
+			return version
+		}
+	}
+	return nil
+}
+
+func normalizeVersion(content string) string {
+	lines := strings.Split(strings.ReplaceAll(content, "\r\n", "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t")
+	}
+	return strings.TrimRight(strings.Join(lines, "\n"), "\n")
+}
+
+var firstNumber = regexp.MustCompile(`\d+`)
+
+// judge asks the judge model to pick a version, returning its number
+// counting from 1, or 0 for none
+func (e *Engine) judge(ctx context.Context, path, target string, versions []*ensembleVersion) (int, error) {
+	current := ""
+	if data, err := e.files().ReadFile(target); err == nil {
+		current, _ = decodeText(data)
+	}
+	var b strings.Builder
+	for i, version := range versions {
+		diff := unifiedDiff(path, path, current, version.content, 3)
+		if diff == "" {
+			diff = "(no change)\n"
+		}
+		fmt.Fprintf(&b, "Version %d:\n%s\n", i+1, diff)
+	}
+
+	resp, err := e.postChat(ctx, ChatRequest{
+		Model:    e.judgeModel,
+		Messages: []Message{{Role: "user", Content: fmt.Sprintf(judgePrompt, e.request, path, b.String())}},
+		Options:  map[string]interface{}{"temperature": 0},
+	})
+	if err != nil {
+		return 0, fmt.Errorf("judge model failed: %v", err)
+	}
+	answer := firstNumber.FindString(resp.Message.Content)
+	choice, err := strconv.Atoi(answer)
+	if err != nil || choice > len(versions) {
+		return 0, fmt.Errorf("judge model gave no version number: %q", resp.Message.Content)
+	}
+	e.logf("Judge model chose version %d of %d for %s", choice, len(versions), path)
+	return choice, nil
+}
@@ -0,0 +1,86 @@
+package agent
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeCall(content string) ToolCall {
+	return call("write_file", `{"path": "version.txt", "content": `+jsonString(content)+`}`)
+}
+
+func runEnsemble(t *testing.T, replies []ChatResponse, judge string) (*Engine, *fakeProvider, string) {
+	t.Helper()
+	e, provider, _ := newTestEngine(t, replies, WithEnsemble(judge, "model-b", "model-c"))
+	if _, err := e.Run(context.Background(), "Bump the version"); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(filepath.Join(e.workspace, "version.txt"))
+	return e, provider, string(data)
+}
+
+func TestEnsembleMajority(t *testing.T) {
+	_, provider, data := runEnsemble(t, []ChatResponse{
+		reply("", writeCall("1.3\n")),
+		reply("", writeCall("1.2.1\n")),
+		reply("", writeCall("1.2.1  \n\n")),
+		reply("Bumped."),
+	}, "")
+
+	if data != "1.2.1\n" {
+		t.Errorf("wrote %q", data)
+	}
+	var models []string
+	for _, req := range provider.requests {
+		models = append(models, req.Model)
+	}
+	if got := strings.Join(models, " "); got != "test-model model-b model-c test-model" {
+		t.Errorf("asked %s", got)
+	}
+	if len(provider.requests[1].Messages) != 2 || len(provider.requests[1].Tools) == 0 {
+		t.Errorf("ensemble model was sent %+v", provider.requests[1])
+	}
+	results := toolResults(provider.lastMessages(t, 4))
+	if len(results) != 1 || !strings.Contains(results[0].Content, "2 of 3 models agreed") ||
+		!strings.Contains(results[0].Content, "not the version you proposed") {
+		t.Errorf("write gave %+v", results)
+	}
+}
+
+func TestEnsembleDisagree(t *testing.T) {
+	_, provider, data := runEnsemble(t, []ChatResponse{
+		reply("", writeCall("1.3\n")),
+		reply("", writeCall("1.2.1\n")),
+		reply("I would rather not."),
+		reply("Gave up."),
+	}, "")
+
+	if data != "" {
+		t.Errorf("wrote %q without agreement", data)
+	}
+	if results := toolResults(provider.lastMessages(t, 4)); len(results) != 1 || !strings.Contains(results[0].Content, "nothing was written") {
+		t.Errorf("write gave %+v", results)
+	}
+}
+
+func TestEnsembleJudge(t *testing.T) {
+	_, provider, data := runEnsemble(t, []ChatResponse{
+		reply("", writeCall("1.3\n")),
+		reply("", writeCall("1.2.1\n")),
+		reply("", writeCall("2.0\n")),
+		reply("Version 2"),
+		reply("Bumped."),
+	}, "judge-model")
+
+	if data != "1.2.1\n" {
+		t.Errorf("wrote %q", data)
+	}
+	judged := provider.requests[3]
+	if judged.Model != "judge-model" || !strings.Contains(judged.Messages[0].Content, "Version 3:") ||
+		!strings.Contains(judged.Messages[0].Content, "+2.0") {
+		t.Errorf("judge request %+v", judged)
+	}
+}
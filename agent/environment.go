@@ -0,0 +1,118 @@
+package agent
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// EnvironmentInfo is what get_environment returns, so that the model need
+// not guess the date or the platform
+type EnvironmentInfo struct {
+	Time          string            `json:"time"`
+	Weekday       string            `json:"weekday"`
+	TimeZone      string            `json:"time_zone"`
+	OS            string            `json:"os"`
+	OSVersion     string            `json:"os_version,omitempty"`
+	Arch          string            `json:"arch"`
+	CPUs          int               `json:"cpus"`
+	Shell         string            `json:"shell,omitempty"`
+	PathSeparator string            `json:"path_separator"`
+	Locale        string            `json:"locale,omitempty"`
+	InContainer   bool              `json:"in_container"`
+	Cwd           string            `json:"cwd"`
+	Tools         map[string]string `json:"tools"`
+}
+
+func environmentTool() Tool {
+	return Tool{
+		Type: "function",
+		Function: Function{
+			Name:        "get_environment",
+			Description: "Get the current date and time, operating system, architecture, shell, locale and installed tool versions. Use this rather than assuming the date or the platform",
+			Parameters: map[string]interface{}{
+				"type":       "object",
+				"properties": map[string]interface{}{},
+			},
+		},
+	}
+}
+
+func (e *Engine) getEnvironment(args json.RawMessage) (string, error) {
+	now := time.Now()
+	zone, offset := now.Zone()
+	info := EnvironmentInfo{
+		Time:          now.Format(time.RFC3339),
+		Weekday:       now.Weekday().String(),
+		TimeZone:      fmt.Sprintf("%s (UTC%+03d:%02d)", zone, offset/3600, abs(offset%3600)/60),
+		OS:            runtime.GOOS,
+		OSVersion:     osVersion(),
+		Arch:          runtime.GOARCH,
+		CPUs:          runtime.NumCPU(),
+		Shell:         os.Getenv("SHELL"),
+		PathSeparator: string(filepath.Separator),
+		Locale:        locale(),
+		InContainer:   inContainer(),
+		Cwd:           e.displayCwd(),
+		Tools:         toolVersions(),
+	}
+	if runtime.GOOS == "windows" {
+		info.Shell = os.Getenv("ComSpec")
+	}
+
+	data, err := json.Marshal(info)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal result: %v", err)
+	}
+	return string(data), nil
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// osVersion names the OS release, e.g. "Ubuntu 22.04.4 LTS" or "macOS 14.4"
+func osVersion() string {
+	switch runtime.GOOS {
+	case "linux":
+		f, err := os.Open("/etc/os-release")
+		if err != nil {
+			return ""
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if value, ok := strings.CutPrefix(scanner.Text(), "PRETTY_NAME="); ok {
+				return strings.Trim(value, `"`)
+			}
+		}
+	case "darwin":
+		if output, err := exec.Command("sw_vers", "-productVersion").Output(); err == nil {
+			return "macOS " + strings.TrimSpace(string(output))
+		}
+	case "windows":
+		if output, err := exec.Command("cmd", "/c", "ver").Output(); err == nil {
+			return strings.TrimSpace(string(output))
+		}
+	}
+	return ""
+}
+
+// locale is the locale from the environment, in order of precedence
+func locale() string {
+	for _, name := range []string{"LC_ALL", "LC_CTYPE", "LANG"} {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,316 @@
+package agent
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// evalTask is a task in the style of SWE-bench: a repository at a commit,
+// or a snapshot of one, with a problem statement and a script that says
+// whether the problem was resolved. Field names follow SWE-bench's where
+// they mean the same thing, so its instances need only a verify script.
+type evalTask struct {
+	InstanceID       string `json:"instance_id"`
+	Repo             string `json:"repo"`
+	BaseCommit       string `json:"base_commit"`
+	Snapshot         string `json:"snapshot"`
+	ProblemStatement string `json:"problem_statement"`
+
+	// Setup runs before the agent, e.g. to install dependencies; TestPatch
+	// is applied after it, before Verify runs
+	Setup     string `json:"setup"`
+	TestPatch string `json:"test_patch"`
+	Verify    string `json:"verify"`
+
+	Timeout  float64 `json:"timeout"`
+	MaxTurns int     `json:"max_turns"`
+}
+
+// evalPrediction is a line of a SWE-bench predictions file
+type evalPrediction struct {
+	InstanceID string `json:"instance_id"`
+	Model      string `json:"model_name_or_path"`
+	Patch      string `json:"model_patch"`
+}
+
+var githubRepo = regexp.MustCompile(`^[\w.-]+/[\w.-]+$`)
+
+// loadEvalTasks reads tasks, one JSON object per line. Local paths in repo
+// and snapshot are relative to the file.
+func loadEvalTasks(path string, ids []string) ([]*evalTask, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open tasks: %v", err)
+	}
+	defer f.Close()
+	wanted := make(map[string]bool)
+	for _, id := range ids {
+		wanted[id] = true
+	}
+
+	var tasks []*evalTask
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		task := &evalTask{Timeout: 1800, MaxTurns: 50}
+		if err := json.Unmarshal(scanner.Bytes(), task); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		switch {
+		case task.InstanceID == "" || task.ProblemStatement == "" || task.Verify == "":
+			return nil, fmt.Errorf("%s:%d: a task needs instance_id, problem_statement and verify", path, line)
+		case (task.Repo == "") == (task.Snapshot == ""):
+			return nil, fmt.Errorf("%s:%d: a task needs either repo or snapshot", path, line)
+		}
+		if len(wanted) > 0 && !wanted[task.InstanceID] {
+			continue
+		}
+		delete(wanted, task.InstanceID)
+		task.Repo = repoSource(task.Repo, filepath.Dir(path))
+		if task.Snapshot != "" && !filepath.IsAbs(task.Snapshot) {
+			task.Snapshot = filepath.Join(filepath.Dir(path), task.Snapshot)
+		}
+		tasks = append(tasks, task)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read tasks: %v", err)
+	}
+	for id := range wanted {
+		return nil, fmt.Errorf("no task with instance_id %s", id)
+	}
+	return tasks, nil
+}
+
+// repoSource turns a task's repo into something git can clone: a URL is
+// kept, a local path is made absolute, and owner/name, as in SWE-bench,
+// means the repository on GitHub
+func repoSource(repo, dir string) string {
+	if repo == "" || strings.Contains(repo, "://") || strings.HasPrefix(repo, "git@") {
+		return repo
+	}
+	local := repo
+	if !filepath.IsAbs(local) {
+		local = filepath.Join(dir, repo)
+	}
+	if _, err := os.Stat(local); err == nil || !githubRepo.MatchString(repo) {
+		return local
+	}
+	return "https://github.com/" + repo + ".git"
+}
+
+// gitIn runs git in dir, with its error output in the error
+func gitIn(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return string(output), nil
+}
+
+// prepareEvalWorkspace puts a task's starting state in dir, committed to
+// git so the agent's changes can be taken as a patch, and returns the
+// commit to diff against
+func prepareEvalWorkspace(task *evalTask, dir string) (string, error) {
+	if task.Repo != "" {
+		if _, err := gitIn(dir, "clone", "--quiet", task.Repo, "."); err != nil {
+			return "", err
+		}
+		if task.BaseCommit != "" {
+			if _, err := gitIn(dir, "checkout", "--quiet", "--detach", task.BaseCommit); err != nil {
+				return "", err
+			}
+		}
+	} else {
+		info, err := os.Stat(task.Snapshot)
+		if err != nil {
+			return "", fmt.Errorf("failed to read snapshot: %v", err)
+		}
+		if info.IsDir() {
+			err = os.CopyFS(dir, os.DirFS(task.Snapshot))
+		} else {
+			err = exec.Command("tar", "-xf", task.Snapshot, "-C", dir).Run()
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to unpack snapshot: %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err != nil {
+			if _, err := gitIn(dir, "init", "--quiet"); err != nil {
+				return "", err
+			}
+			if _, err := gitIn(dir, "add", "--all"); err != nil {
+				return "", err
+			}
+			if _, err := gitIn(dir, "-c", "user.name=wex", "-c", "user.email=wex@localhost",
+				"commit", "--quiet", "--allow-empty", "--no-verify", "-m", "Snapshot"); err != nil {
+				return "", err
+			}
+		}
+	}
+	base, err := gitIn(dir, "rev-parse", "HEAD")
+	return strings.TrimSpace(base), err
+}
+
+// modelPatch returns the agent's changes since base, including new files
+func modelPatch(dir, base string) (string, error) {
+	if _, err := gitIn(dir, "add", "--all"); err != nil {
+		return "", err
+	}
+	return gitIn(dir, "diff", "--cached", "--binary", base)
+}
+
+// runEvalTask has a model work on a task in a fresh workspace, then checks
+// the result. The workspace is returned for inspection.
+func (e *Engine) runEvalTask(task *evalTask, model string, verbose bool) (benchResult, string, string, error) {
+	result := benchResult{Task: task.InstanceID, Model: model}
+	dir, err := os.MkdirTemp("", "wex-eval-")
+	if err != nil {
+		return result, "", "", fmt.Errorf("failed to make workspace: %v", err)
+	}
+	base, err := prepareEvalWorkspace(task, dir)
+	if err != nil {
+		return result, dir, "", err
+	}
+	if task.Setup != "" {
+		if ok, output := runCheck(dir, task.Setup); !ok {
+			return result, dir, "", fmt.Errorf("setup failed:\n%s", output)
+		}
+	}
+
+	if err := e.benchSession(dir, task.ProblemStatement, model, task.Timeout, task.MaxTurns, verbose, &result); err != nil {
+		return result, dir, "", err
+	}
+	patch, err := modelPatch(dir, base)
+	if err != nil {
+		return result, dir, "", err
+	}
+
+	if task.TestPatch != "" {
+		testPatch := filepath.Join(dir, ".git", "wex-test.patch")
+		if err := os.WriteFile(testPatch, []byte(task.TestPatch), 0644); err != nil {
+			return result, dir, patch, err
+		}
+		if _, err := gitIn(dir, "apply", testPatch); err != nil {
+			result.Output = fmt.Sprintf("test patch does not apply: %v", err)
+			return result, dir, patch, nil
+		}
+	}
+	result.Passed, result.Output = runCheck(dir, task.Verify)
+	return result, dir, patch, nil
+}
+
+// runEval handles "wex eval", which runs SWE-bench style tasks and counts
+// those resolved
+func runEval(engine *Engine, args []string, w io.Writer) error {
+	evalFlags := flag.NewFlagSet("eval", flag.ExitOnError)
+	models := evalFlags.String("models", "", "Models to evaluate, comma-separated (default the configured model)")
+	jsonPath := evalFlags.String("json", "", "Also write the results to this JSON file")
+	predictions := evalFlags.String("predictions", "", "Write each model patch to this JSONL file, in SWE-bench's predictions format")
+	keep := evalFlags.Bool("keep", false, "Keep the workspaces for inspection instead of deleting them")
+	verbose := evalFlags.Bool("v", false, "Show each session as it runs")
+	evalFlags.Usage = func() {
+		fmt.Fprintf(evalFlags.Output(), "Usage: wex eval [flags] TASKS.jsonl [instance_id...]\n")
+		evalFlags.PrintDefaults()
+	}
+	evalFlags.Parse(args)
+	if evalFlags.NArg() < 1 {
+		evalFlags.Usage()
+		return fmt.Errorf("no tasks file")
+	}
+
+	tasks, err := loadEvalTasks(evalFlags.Arg(0), evalFlags.Args()[1:])
+	if err != nil {
+		return err
+	}
+	if engine.offline {
+		for _, task := range tasks {
+			if err := checkOfflineRepo(task.Repo); err != nil {
+				return fmt.Errorf("%s: %v", task.InstanceID, err)
+			}
+		}
+	}
+	modelList := modelsOrDefault(*models, engine.model)
+
+	var predictionsFile *os.File
+	if *predictions != "" {
+		if predictionsFile, err = os.Create(*predictions); err != nil {
+			return fmt.Errorf("failed to create predictions file: %v", err)
+		}
+		defer predictionsFile.Close()
+	}
+
+	var results []benchResult
+	for _, model := range modelList {
+		for _, task := range tasks {
+			result, dir, patch, err := engine.runEvalTask(task, model, *verbose)
+			if dir != "" && !*keep {
+				os.RemoveAll(dir)
+			}
+			if err != nil {
+				// A task that can't be set up says nothing about the model
+				fmt.Fprintf(w, "%-10s  %-32s %-24s %v\n", "ERROR", task.InstanceID, model, err)
+				continue
+			}
+			status := "UNRESOLVED"
+			if result.Passed {
+				status = "RESOLVED"
+			}
+			fmt.Fprintf(w, "%-10s  %-32s %-24s %4d turns %7.1fs", status, task.InstanceID, model, result.Turns, result.Seconds)
+			if result.Error != "" {
+				fmt.Fprintf(w, "  (%s)", result.Error)
+			}
+			if *keep {
+				fmt.Fprintf(w, "  %s", dir)
+			}
+			fmt.Fprintln(w)
+			results = append(results, result)
+
+			if predictionsFile != nil {
+				data, _ := json.Marshal(evalPrediction{InstanceID: task.InstanceID, Model: model, Patch: patch})
+				if _, err := predictionsFile.Write(append(data, '\n')); err != nil {
+					return fmt.Errorf("failed to write predictions: %v", err)
+				}
+			}
+		}
+	}
+
+	fmt.Fprintln(w)
+	for _, model := range modelList {
+		resolved, total := 0, 0
+		for _, result := range results {
+			if result.Model == model {
+				total++
+				if result.Passed {
+					resolved++
+				}
+			}
+		}
+		if total > 0 {
+			fmt.Fprintf(w, "%-24s %d resolved, %d unresolved (%.0f%%)\n", model, resolved, total-resolved, 100*float64(resolved)/float64(total))
+		}
+	}
+	if *jsonPath != "" {
+		data, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(*jsonPath, append(data, '\n'), 0644); err != nil {
+			return fmt.Errorf("failed to write results: %v", err)
+		}
+	}
+	return nil
+}
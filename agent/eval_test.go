@@ -0,0 +1,104 @@
+package agent
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRepoSource(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "local"), 0755)
+	for repo, want := range map[string]string{
+		"https://example.com/x.git": "https://example.com/x.git",
+		"git@example.com:x.git":     "git@example.com:x.git",
+		"local":                     filepath.Join(dir, "local"),
+		"/abs/path/repo":            "/abs/path/repo",
+		"psf/requests":              "https://github.com/psf/requests.git",
+	} {
+		if got := repoSource(repo, dir); got != want {
+			t.Errorf("repoSource(%q) = %q, want %q", repo, got, want)
+		}
+	}
+}
+
+func TestRunEval(t *testing.T) {
+	dir := t.TempDir()
+
+	// A repository whose base commit is behind its head, and a snapshot
+	repo := filepath.Join(dir, "repo")
+	os.Mkdir(repo, 0755)
+	os.WriteFile(filepath.Join(repo, "notes.txt"), []byte("broken\n"), 0644)
+	git := func(args ...string) string {
+		out, err := gitIn(repo, append([]string{"-c", "user.name=t", "-c", "user.email=t@t"}, args...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(out)
+	}
+	git("init", "--quiet")
+	git("add", "--all")
+	git("commit", "--quiet", "-m", "base")
+	base := git("rev-parse", "HEAD")
+	os.WriteFile(filepath.Join(repo, "later.txt"), []byte("later\n"), 0644)
+	git("add", "--all")
+	git("commit", "--quiet", "-m", "later")
+
+	snapshot := filepath.Join(dir, "snapshot")
+	os.Mkdir(snapshot, 0755)
+	os.WriteFile(filepath.Join(snapshot, "greet.py"), []byte("print('hi')\n"), 0644)
+
+	testPatch := "diff --git a/check.sh b/check.sh\nnew file mode 100644\n--- /dev/null\n+++ b/check.sh\n@@ -0,0 +1 @@\n+grep -q fixed notes.txt && test ! -e later.txt\n"
+	tasks := []string{
+		`{"instance_id": "repo-1", "repo": "repo", "base_commit": "` + base + `", "problem_statement": "Fix the notes", "test_patch": ` + jsonString(testPatch) + `, "verify": "sh check.sh"}`,
+		`{"instance_id": "snap-1", "snapshot": "snapshot", "problem_statement": "Say hello", "verify": "grep -q hello greet.py"}`,
+	}
+	tasksPath := filepath.Join(dir, "tasks.jsonl")
+	os.WriteFile(tasksPath, []byte(strings.Join(tasks, "\n")+"\n"), 0644)
+
+	e, _, _ := newTestEngine(t, []ChatResponse{
+		reply("", call("write_file", `{"path": "notes.txt", "content": "fixed\n"}`)),
+		reply("Fixed."),
+		reply("I don't know how."),
+	})
+	var out strings.Builder
+	predictions := filepath.Join(dir, "predictions.jsonl")
+	if err := runEval(e, []string{"--predictions", predictions, tasksPath}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "RESOLVED    repo-1") || !strings.Contains(out.String(), "UNRESOLVED  snap-1") ||
+		!strings.Contains(out.String(), "1 resolved, 1 unresolved (50%)") {
+		t.Errorf("eval printed\n%s", out.String())
+	}
+
+	f, err := os.Open(predictions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var lines []string
+	for scanner := bufio.NewScanner(f); scanner.Scan(); {
+		lines = append(lines, scanner.Text())
+	}
+	if len(lines) != 2 || !strings.Contains(lines[0], `"model_name_or_path":"test-model"`) ||
+		!strings.Contains(lines[0], `+fixed`) || strings.Contains(lines[0], "check.sh") ||
+		!strings.Contains(lines[1], `"model_patch":""`) {
+		t.Errorf("predictions\n%s", strings.Join(lines, "\n"))
+	}
+}
+
+func TestLoadEvalTasksInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tasks.jsonl")
+	for _, task := range []string{
+		`{"instance_id": "a", "repo": "x/y", "problem_statement": "p"}`,
+		`{"instance_id": "a", "problem_statement": "p", "verify": "true"}`,
+		`{"instance_id": "a", "repo": "x/y", "snapshot": "s", "problem_statement": "p", "verify": "true"}`,
+	} {
+		os.WriteFile(path, []byte(task), 0644)
+		if _, err := loadEvalTasks(path, nil); err == nil {
+			t.Errorf("accepted %s", task)
+		}
+	}
+}
@@ -0,0 +1,293 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EventType names a point in the agent loop that a renderer may show
+type EventType string
+
+const (
+	EventTurnStarted   EventType = "turn_started"
+	EventAssistantText EventType = "assistant_text"
+
+	// EventAssistantDelta is a piece of the reply's text, with --stream,
+	// before the whole of it comes in assistant_text
+	EventAssistantDelta EventType = "assistant_delta"
+
+	EventToolStarted  EventType = "tool_started"
+	EventToolFinished EventType = "tool_finished"
+	EventSessionDone  EventType = "session_done"
+
+	// EventRoleStarted is a role of wex team taking over, with what it is
+	// handed in Text
+	EventRoleStarted EventType = "role_started"
+
+	// EventQuestion is ask_user pausing the session, with the question in
+	// Text and the answers it may have in Choices
+	EventQuestion EventType = "question"
+
+	// EventLog carries diagnostics, such as the request sent to Ollama
+	EventLog EventType = "log"
+)
+
+// Event is one step of a session. Fields not relevant to the type are left
+// empty.
+type Event struct {
+	Type EventType `json:"type"`
+	Time time.Time `json:"time"`
+	Turn int       `json:"turn"`
+
+	// Text is the assistant's reply for assistant_text, the piece of it
+	// for assistant_delta, the question for question, and the message for
+	// log
+	Text string `json:"text,omitempty"`
+
+	// Streamed, for assistant_text, says the text was already sent in
+	// assistant_delta events
+	Streamed bool `json:"streamed,omitempty"`
+
+	// Tool calls: the reply's count for assistant_text, then each call in
+	// tool_started and tool_finished
+	ToolCalls int             `json:"tool_calls,omitempty"`
+	Tool      string          `json:"tool,omitempty"`
+	CallID    string          `json:"call_id,omitempty"`
+	Arguments json.RawMessage `json:"arguments,omitempty"`
+	Result    string          `json:"result,omitempty"`
+	Failed    bool            `json:"failed,omitempty"`
+	Duration  float64         `json:"duration_seconds,omitempty"`
+
+	// Edited, for tool_finished, is what the user changed the arguments
+	// to when approving the call
+	Edited json.RawMessage `json:"edited_arguments,omitempty"`
+
+	// Choices are the answers a question may have, for question, such as
+	// yes and no, for a user interface to offer as buttons
+	Choices []string `json:"choices,omitempty"`
+
+	// Role is the role taking over, for role_started
+	Role string `json:"role,omitempty"`
+
+	// Agent is the session of wex serve an event comes from
+	Agent string `json:"agent,omitempty"`
+
+	// Error is why a session failed, for session_done
+	Error string `json:"error,omitempty"`
+
+	// FinalAnswer is the session's final answer, for session_done, if one
+	// was required
+	FinalAnswer *FinalAnswer `json:"final_answer,omitempty"`
+}
+
+// Renderer presents the events of a session, decoupling the agent loop
+// from how, and whether, it is shown
+type Renderer interface {
+	Render(event Event)
+}
+
+// renderers are those --output can name
+var renderers = map[string]func(w io.Writer) Renderer{
+	"plain":  func(w io.Writer) Renderer { return &plainRenderer{w} },
+	"pretty": func(w io.Writer) Renderer { return &prettyRenderer{w: w} },
+	"json":   func(w io.Writer) Renderer { return &jsonRenderer{w} },
+	"sse":    func(w io.Writer) Renderer { return &sseRenderer{w} },
+}
+
+func (e *Engine) emit(event Event) {
+	event.Time = time.Now()
+	if event.Turn == 0 {
+		event.Turn = e.turn
+	}
+	if e.renderer == nil {
+		e.renderer = &plainRenderer{os.Stdout}
+	}
+	e.renderer.Render(event)
+}
+
+func (e *Engine) logf(format string, args ...interface{}) {
+	e.emit(Event{Type: EventLog, Text: fmt.Sprintf(format, args...)})
+}
+
+// debugf logs debugging output, only with --verbose
+func (e *Engine) debugf(format string, args ...interface{}) {
+	if e.verbose {
+		e.logf("DEBUG: "+format, args...)
+	}
+}
+
+// plainRenderer writes the engine's traditional log, with debugging
+// output if --verbose logs it
+type plainRenderer struct {
+	w io.Writer
+}
+
+func (r *plainRenderer) Render(event Event) {
+	switch event.Type {
+	case EventAssistantDelta:
+		fmt.Fprint(r.w, event.Text)
+	case EventAssistantText:
+		if event.Streamed {
+			fmt.Fprintln(r.w)
+		}
+		if event.Text != "" && !event.Streamed {
+			fmt.Fprintf(r.w, "Assistant: %s\n", event.Text)
+		}
+	case EventRoleStarted:
+		fmt.Fprintf(r.w, "=== Role: %s ===\n%s\n", event.Role, event.Text)
+	case EventQuestion:
+		fmt.Fprintf(r.w, "Question for the user: %s\n", event.Text)
+		if len(event.Choices) > 0 {
+			fmt.Fprintf(r.w, "Choices: %s\n", strings.Join(event.Choices, ", "))
+		}
+	case EventToolStarted:
+		fmt.Fprintf(r.w, "Executing tool: %s (%s)\n", event.Tool, event.CallID)
+	case EventToolFinished:
+		if event.Edited != nil {
+			fmt.Fprintf(r.w, "Arguments edited by the user: %s\n", event.Edited)
+		}
+		fmt.Fprintf(r.w, "Tool result: %s\n", event.Result)
+	case EventLog:
+		fmt.Fprintln(r.w, event.Text)
+	case EventSessionDone:
+		if event.FinalAnswer != nil {
+			output, err := json.MarshalIndent(map[string]interface{}{"result": event.FinalAnswer}, "", "  ")
+			if err == nil {
+				fmt.Fprintln(r.w, string(output))
+			}
+		}
+	}
+}
+
+// logWriter passes what is written to a logger a line at a time, so each
+// line gets the logger's prefix and flags, and streamed text that arrives
+// in pieces is logged once its line is complete
+type logWriter struct {
+	logger  *log.Logger
+	mu      sync.Mutex
+	partial []byte
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		w.logger.Print(string(w.partial[:i]))
+		w.partial = w.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+// prettyRenderer is for watching a session in a terminal: colour, no
+// debugging output, and tool results cut to a few lines
+type prettyRenderer struct {
+	w io.Writer
+}
+
+const (
+	ansiReset = "\033[0m"
+	ansiBold  = "\033[1m"
+	ansiDim   = "\033[2m"
+	ansiRed   = "\033[31m"
+	ansiGreen = "\033[32m"
+	ansiCyan  = "\033[36m"
+)
+
+// prettyResultLines is how much of each tool result the pretty renderer shows
+const prettyResultLines = 8
+
+func (r *prettyRenderer) Render(event Event) {
+	switch event.Type {
+	case EventRoleStarted:
+		fmt.Fprintf(r.w, "%s══ %s ══%s\n", ansiCyan+ansiBold, event.Role, ansiReset)
+	case EventTurnStarted:
+		fmt.Fprintf(r.w, "%s── turn %d ──%s\n", ansiDim, event.Turn, ansiReset)
+	case EventAssistantDelta:
+		fmt.Fprint(r.w, event.Text)
+	case EventAssistantText:
+		if event.Streamed {
+			fmt.Fprintln(r.w)
+		} else if text := strings.TrimSpace(event.Text); text != "" {
+			fmt.Fprintf(r.w, "%s\n", text)
+		}
+	case EventToolStarted:
+		args := string(event.Arguments)
+		if len(args) > 200 {
+			args = args[:200] + "..."
+		}
+		fmt.Fprintf(r.w, "%s▶ %s%s %s%s%s\n", ansiCyan+ansiBold, event.Tool, ansiReset, ansiDim, args, ansiReset)
+	case EventToolFinished:
+		color, mark := ansiGreen, "✓"
+		if event.Failed {
+			color, mark = ansiRed, "✗"
+		}
+		lines := strings.Split(strings.TrimRight(event.Result, "\n"), "\n")
+		fmt.Fprintf(r.w, "%s%s%s %s(%.1fs)%s\n", color, mark, ansiReset, ansiDim, event.Duration, ansiReset)
+		if event.Edited != nil {
+			fmt.Fprintf(r.w, "  %sedited by the user: %s%s\n", ansiDim, event.Edited, ansiReset)
+		}
+		for i, line := range lines {
+			if i == prettyResultLines {
+				fmt.Fprintf(r.w, "  %s... %d more lines%s\n", ansiDim, len(lines)-i, ansiReset)
+				break
+			}
+			fmt.Fprintf(r.w, "  %s\n", line)
+		}
+	case EventQuestion:
+		fmt.Fprintf(r.w, "%s? %s%s\n", ansiCyan+ansiBold, event.Text, ansiReset)
+		for i, c := range event.Choices {
+			fmt.Fprintf(r.w, "  %d. %s\n", i+1, c)
+		}
+	case EventSessionDone:
+		if event.Error != "" {
+			fmt.Fprintf(r.w, "%s✗ %s%s\n", ansiRed, event.Error, ansiReset)
+		} else {
+			fmt.Fprintf(r.w, "%s✓ done after %d turns%s\n", ansiGreen, event.Turn, ansiReset)
+		}
+		if event.FinalAnswer != nil {
+			fmt.Fprintf(r.w, "%s\n", event.FinalAnswer.Summary)
+		}
+	}
+}
+
+// jsonRenderer writes each event as a line of JSON, for other programs
+type jsonRenderer struct {
+	w io.Writer
+}
+
+func (r *jsonRenderer) Render(event Event) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(r.w, "%s\n", data)
+}
+
+// sseRenderer writes server-sent events, for relaying to a browser; the
+// writer should flush after each write if it buffers
+type sseRenderer struct {
+	w io.Writer
+}
+
+func (r *sseRenderer) Render(event Event) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(r.w, "event: %s\ndata: %s\n\n", event.Type, data)
+	if f, ok := r.w.(interface{ Flush() }); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,52 @@
+package agent_test
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+
+	"wex/agent"
+)
+
+// cannedProvider answers every request with the same reply, standing in
+// for a model server
+type cannedProvider struct {
+	reply string
+}
+
+func (p cannedProvider) SendChat(ctx context.Context, req agent.ChatRequest) (*agent.ChatResponse, error) {
+	var resp agent.ChatResponse
+	resp.Message.Role = "assistant"
+	resp.Message.Content = p.reply
+	resp.Done = true
+	return &resp, nil
+}
+
+func (p cannedProvider) ListModels(ctx context.Context) ([]agent.Model, error) {
+	return []agent.Model{{Name: "canned"}}, nil
+}
+
+func ExampleNew() {
+	dir, err := os.MkdirTemp("", "wex-example")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, err := agent.New(
+		agent.WithWorkspace(dir),
+		agent.WithBackend(cannedProvider{"There is nothing to do."}, "canned"),
+		agent.WithSystemPrompt("You are a coding assistant."),
+		agent.WithEvents(func(agent.Event) {}),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	result, err := engine.Run(context.Background(), "Tidy up the workspace")
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(result.Reply)
+	// Output: There is nothing to do.
+}
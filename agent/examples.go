@@ -0,0 +1,145 @@
+package agent
+
+import (
+	"strings"
+)
+
+// toolExamples are valid arguments for each tool, as JSON. Weaker models
+// call tools more accurately given an example or two of the exact shape
+// expected, especially for nested or optional arguments.
+var toolExamples = map[string][]string{
+	"read_file": {
+		`{"path": "src/main.go"}`,
+		`{"path": "server.log", "start_line": 100, "end_line": 150}`,
+	},
+	"read_files": {
+		`{"paths": ["src/handler.go", "src/handler_test.go", "src/routes.go"]}`,
+	},
+	"write_file": {
+		`{"path": "hello.py", "content": "print(\"hello\")\n"}`,
+		`{"path": "scripts/build.sh", "content": "#!/bin/sh\ngo build ./...\n", "mode": "0755"}`,
+	},
+	"code_outline": {
+		`{"path": "src/server.py"}`,
+	},
+	"edit_region": {
+		`{"path": "src/server.py", "name": "Server.start"}`,
+		`{"path": "src/server.py", "name": "Server.start", "action": "replace", "anchor": "3f2a9c1b7d20", "content": "    def start(self):\n        self.listen(self.port)\n"}`,
+	},
+	"replace_across_files": {
+		`{"find": "fetchUser", "replace": "loadUser", "whole_word": true, "glob": "src/**/*.ts", "dry_run": true}`,
+		`{"find": "log\\.Printf\\(\"(.*)\", ", "replace": "logger.Infof(\"$1\", ", "regex": true, "glob": "*.go"}`,
+	},
+	"write_file_chunk": {
+		`{"path": "data/cities.csv", "action": "begin", "content": "name,country,population\nTokyo,JP,37400068\n"}`,
+		`{"path": "data/cities.csv", "action": "append", "content": "Delhi,IN,28514000\n"}`,
+		`{"path": "data/cities.csv", "action": "commit"}`,
+	},
+	"run_command": {
+		`{"command": "ls -la"}`,
+		`{"command": "make test", "timeout": 300}`,
+	},
+	"change_directory": {
+		`{"path": "frontend"}`,
+	},
+	"read_json_path": {
+		`{"path": "package.json", "query": ".scripts.test"}`,
+	},
+	"update_json_path": {
+		`{"path": "config.yaml", "query": ".server.port", "value": 8080}`,
+	},
+	"read_env_file": {
+		`{"path": ".env"}`,
+	},
+	"update_env_file": {
+		`{"path": ".env", "name": "DATABASE_URL", "value": "postgres://localhost/dev"}`,
+		`{"path": ".env", "name": "DEBUG", "remove": true}`,
+	},
+	"find_env_vars": {
+		`{"path": "."}`,
+	},
+	"extract_archive": {
+		`{"path": "release.tar.gz", "destination": "vendor/lib", "strip_components": 1}`,
+	},
+	"create_archive": {
+		`{"path": "dist/site.zip", "sources": ["public"], "base": "public"}`,
+	},
+	"hash_file": {
+		`{"paths": ["build/app", "backup/app"]}`,
+	},
+	"diff_files": {
+		`{"a": "testdata/expected.txt", "b": "out/actual.txt"}`,
+	},
+	"preview_table": {
+		`{"path": "data/sales.csv", "rows": 5}`,
+	},
+	"calculate": {
+		`{"expression": "2^20 / 1000"}`,
+		`{"expression": "5 mi to km"}`,
+	},
+	"scaffold_project": {
+		`{"stack": "go", "name": "demo"}`,
+	},
+	"go_test": {
+		`{"packages": "./internal/...", "run": "TestParse"}`,
+	},
+	"npm_run": {
+		`{"script": "test"}`,
+	},
+	"pytest": {
+		`{"path": "tests/test_api.py", "keyword": "login"}`,
+	},
+	"run_python": {
+		`{"code": "import json\ndata = json.load(open('data.json'))\nlen(data)"}`,
+	},
+	"transform_image": {
+		`{"path": "logo.png", "output": "icons/logo-64.png", "width": 64, "height": 64}`,
+	},
+	"generate_image": {
+		`{"prompt": "flat blue rocket icon on a white background", "path": "assets/icon.png", "width": 128, "height": 128}`,
+	},
+	"report_finding": {
+		`{"path": "api/users.go", "line": 42, "severity": "high", "category": "security", "message": "The user ID from the URL goes into the SQL query unescaped", "suggestion": "Pass it as a query parameter: db.Query(\"... WHERE id = ?\", id)"}`,
+	},
+	"start_agent": {
+		`{"peer": "gpu1", "message": "In the repository at /src/api, add pagination to GET /users, with tests, and reply with a summary of the changes"}`,
+	},
+	"message_agent": {
+		`{"session": "gpu1/s1", "message": "Use a cursor rather than an offset"}`,
+	},
+	"wait_agent": {
+		`{"session": "gpu1/s1"}`,
+		`{"session": "gpu1/s2", "timeout": 1800}`,
+	},
+	"run_scanner": {
+		`{"scanner": "gosec", "path": "internal/files/read.go"}`,
+	},
+	"ask_user": {
+		`{"question": "What is the staging database's hostname? It isn't in the repository or the environment"}`,
+		`{"question": "Which Stripe account should the webhook use? The keys in .env.example are placeholders", "kind": "choice", "choices": ["test", "live"]}`,
+		`{"question": "Removing the v1 endpoints breaks the mobile app's old versions; remove them anyway?", "kind": "yes_no"}`,
+	},
+	"final_answer": {
+		`{"summary": "Added input validation to the signup form", "files_changed": ["src/signup.js"], "commands_to_run": ["npm test"], "open_questions": []}`,
+	},
+}
+
+// addToolExamples appends each tool's examples to its description, where
+// every model sees them, whatever its chat template does with schemas
+func addToolExamples(tools []Tool) []Tool {
+	for i, tool := range tools {
+		examples := toolExamples[tool.Function.Name]
+		if len(examples) == 0 {
+			continue
+		}
+		var b strings.Builder
+		b.WriteString(strings.TrimRight(tool.Function.Description, ". "))
+		b.WriteString(". Example arguments:")
+		for _, example := range examples {
+			b.WriteString(" ")
+			b.WriteString(example)
+		}
+		tools[i].Function.Description = b.String()
+	}
+	return tools
+}
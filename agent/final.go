@@ -0,0 +1,83 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// FinalAnswer is the structured message the model must finish with when
+// --final-answer is set; it becomes the result field of the JSON output
+type FinalAnswer struct {
+	Summary       string   `json:"summary"`
+	FilesChanged  []string `json:"files_changed"`
+	CommandsToRun []string `json:"commands_to_run"`
+	OpenQuestions []string `json:"open_questions"`
+}
+
+// maxFinalAnswerReminders is how many times the model is reminded to call
+// final_answer before the run is treated as a failure
+const maxFinalAnswerReminders = 2
+
+const finalAnswerInstructions = "When the task is complete, finish by calling the final_answer tool with a summary of what you did, " +
+	"the files you changed, any commands the user should run, and any open questions. Do not end your turn any other way."
+
+const finalAnswerReminder = "You stopped without calling the final_answer tool. " +
+	"If the task is complete, call final_answer now; otherwise continue working."
+
+func finalAnswerTool() Tool {
+	stringList := func(description string) map[string]interface{} {
+		return map[string]interface{}{
+			"type":        "array",
+			"items":       map[string]interface{}{"type": "string"},
+			"description": description,
+		}
+	}
+	return Tool{
+		Type: "function",
+		Function: Function{
+			Name:        "final_answer",
+			Description: "Report the outcome of the task; call this exactly once, as your last action",
+			Parameters: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"summary": map[string]interface{}{
+						"type":        "string",
+						"description": "What was done, in a few sentences",
+					},
+					"files_changed":   stringList("Workspace paths of files created or modified"),
+					"commands_to_run": stringList("Commands the user should run next, e.g. to test the change"),
+					"open_questions":  stringList("Anything unresolved that needs a human decision"),
+				},
+				"required": []string{"summary", "files_changed", "commands_to_run", "open_questions"},
+			},
+		},
+	}
+}
+
+// recordFinalAnswer validates a final_answer call against its schema and
+// stores it as the run's result
+func (e *Engine) recordFinalAnswer(args json.RawMessage) (string, error) {
+	decoder := json.NewDecoder(bytes.NewReader(args))
+	decoder.DisallowUnknownFields()
+
+	var answer FinalAnswer
+	if err := decoder.Decode(&answer); err != nil {
+		return "", fmt.Errorf("invalid final answer: %v", err)
+	}
+	if answer.Summary == "" {
+		return "", fmt.Errorf("invalid final answer: summary is required")
+	}
+	if answer.FilesChanged == nil {
+		answer.FilesChanged = []string{}
+	}
+	if answer.CommandsToRun == nil {
+		answer.CommandsToRun = []string{}
+	}
+	if answer.OpenQuestions == nil {
+		answer.OpenQuestions = []string{}
+	}
+
+	e.result = &answer
+	return "Final answer recorded", nil
+}
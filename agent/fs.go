@@ -0,0 +1,509 @@
+package agent
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FS is the filesystem the file tools work on, given full paths as
+// resolvePath returns them. The real disk is the default; a read-only view
+// protects a workspace, and an in-memory filesystem keeps one off the disk
+// altogether, as for tests. Commands always run on the real disk.
+type FS interface {
+	Open(name string) (File, error)
+	ReadFile(name string) ([]byte, error)
+	ReadDir(name string) ([]fs.DirEntry, error)
+	Stat(name string) (fs.FileInfo, error)
+	Lstat(name string) (fs.FileInfo, error)
+	EvalSymlinks(name string) (string, error)
+
+	WriteFile(name string, data []byte, perm fs.FileMode) error
+	Create(name string, perm fs.FileMode) (io.WriteCloser, error)
+	MkdirAll(name string, perm fs.FileMode) error
+	Chmod(name string, mode fs.FileMode) error
+	Rename(oldName, newName string) error
+	Remove(name string) error
+}
+
+// File is an open file, readable in any order, as archives and Parquet
+// files need
+type File interface {
+	fs.File
+	io.ReaderAt
+	io.Seeker
+}
+
+// files returns the filesystem file tools should use
+func (e *Engine) files() FS {
+	if e.filesystem == nil {
+		return osFS{}
+	}
+	return e.filesystem
+}
+
+// walkDir is filepath.WalkDir over an FS
+func walkDir(fsys FS, root string, fn fs.WalkDirFunc) error {
+	info, err := fsys.Lstat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = walkEntry(fsys, root, fs.FileInfoToDirEntry(info), fn)
+	}
+	if err == filepath.SkipDir || err == filepath.SkipAll {
+		return nil
+	}
+	return err
+}
+
+func walkEntry(fsys FS, path string, d fs.DirEntry, fn fs.WalkDirFunc) error {
+	if err := fn(path, d, nil); err != nil || !d.IsDir() {
+		if err == filepath.SkipDir && d.IsDir() {
+			err = nil
+		}
+		return err
+	}
+	entries, err := fsys.ReadDir(path)
+	if err != nil {
+		if err = fn(path, d, err); err != nil {
+			if err == filepath.SkipDir && d.IsDir() {
+				err = nil
+			}
+			return err
+		}
+	}
+	for _, entry := range entries {
+		if err := walkEntry(fsys, filepath.Join(path, entry.Name()), entry, fn); err != nil {
+			if err == filepath.SkipDir {
+				break
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// osFS is the real disk
+type osFS struct{}
+
+func (osFS) Open(name string) (File, error)             { return os.Open(name) }
+func (osFS) ReadFile(name string) ([]byte, error)       { return os.ReadFile(name) }
+func (osFS) ReadDir(name string) ([]fs.DirEntry, error) { return os.ReadDir(name) }
+func (osFS) Stat(name string) (fs.FileInfo, error)      { return os.Stat(name) }
+func (osFS) Lstat(name string) (fs.FileInfo, error)     { return os.Lstat(name) }
+func (osFS) EvalSymlinks(name string) (string, error)   { return filepath.EvalSymlinks(name) }
+
+func (osFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	return os.WriteFile(name, data, perm)
+}
+
+func (osFS) Create(name string, perm fs.FileMode) (io.WriteCloser, error) {
+	return os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+}
+
+func (osFS) MkdirAll(name string, perm fs.FileMode) error { return os.MkdirAll(name, perm) }
+func (osFS) Chmod(name string, mode fs.FileMode) error    { return os.Chmod(name, mode) }
+func (osFS) Rename(oldName, newName string) error         { return os.Rename(oldName, newName) }
+func (osFS) Remove(name string) error                     { return os.Remove(name) }
+
+// errReadOnly is why a read-only filesystem refuses a write
+var errReadOnly = errors.New("the workspace is read-only")
+
+// readOnlyFS passes reads through to another filesystem and refuses writes
+type readOnlyFS struct {
+	FS
+}
+
+func (readOnlyFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	return &fs.PathError{Op: "write", Path: name, Err: errReadOnly}
+}
+
+func (readOnlyFS) Create(name string, perm fs.FileMode) (io.WriteCloser, error) {
+	return nil, &fs.PathError{Op: "create", Path: name, Err: errReadOnly}
+}
+
+func (readOnlyFS) MkdirAll(name string, perm fs.FileMode) error {
+	return &fs.PathError{Op: "mkdir", Path: name, Err: errReadOnly}
+}
+
+func (readOnlyFS) Chmod(name string, mode fs.FileMode) error {
+	return &fs.PathError{Op: "chmod", Path: name, Err: errReadOnly}
+}
+
+func (readOnlyFS) Rename(oldName, newName string) error {
+	return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: errReadOnly}
+}
+
+func (readOnlyFS) Remove(name string) error {
+	return &fs.PathError{Op: "remove", Path: name, Err: errReadOnly}
+}
+
+// MemFS is a filesystem held in memory. It has regular files and
+// directories only, and modes are recorded but not enforced.
+type MemFS struct {
+	mu      sync.Mutex
+	entries map[string]*memEntry
+}
+
+type memEntry struct {
+	data    []byte
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+// NewMemFS makes an in-memory filesystem holding the directory dir, with
+// files in it given by their paths relative to dir
+func NewMemFS(dir string, files map[string]string) *MemFS {
+	m := &MemFS{entries: map[string]*memEntry{"/": {mode: fs.ModeDir | 0755}}}
+	m.MkdirAll(dir, 0755)
+	for path, content := range files {
+		fullPath := filepath.Join(dir, path)
+		m.MkdirAll(filepath.Dir(fullPath), 0755)
+		m.WriteFile(fullPath, []byte(content), 0644)
+	}
+	return m
+}
+
+func (m *MemFS) lookup(op, name string) (string, *memEntry, error) {
+	name = filepath.Clean("/" + name)
+	entry := m.entries[name]
+	if entry == nil {
+		return name, nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return name, entry, nil
+}
+
+func (m *MemFS) Open(name string) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name, entry, err := m.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return &memFile{bytes.NewReader(entry.data), entry.info(name)}, nil
+}
+
+func (m *MemFS) ReadFile(name string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name, entry, err := m.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if entry.mode.IsDir() {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: errors.New("is a directory")}
+	}
+	return bytes.Clone(entry.data), nil
+}
+
+func (m *MemFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name, entry, err := m.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if !entry.mode.IsDir() {
+		return nil, &fs.PathError{Op: "readdirent", Path: name, Err: errors.New("not a directory")}
+	}
+	var entries []fs.DirEntry
+	for path, child := range m.entries {
+		if path != name && filepath.Dir(path) == name {
+			entries = append(entries, fs.FileInfoToDirEntry(child.info(path)))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+func (m *MemFS) Stat(name string) (fs.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name, entry, err := m.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return entry.info(name), nil
+}
+
+func (m *MemFS) Lstat(name string) (fs.FileInfo, error) {
+	return m.Stat(name)
+}
+
+func (m *MemFS) EvalSymlinks(name string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name, _, err := m.lookup("lstat", name)
+	return name, err
+}
+
+func (m *MemFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean("/" + name)
+	if parent := m.entries[filepath.Dir(name)]; parent == nil || !parent.mode.IsDir() {
+		return &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	entry := m.entries[name]
+	if entry == nil {
+		entry = &memEntry{mode: perm.Perm()}
+		m.entries[name] = entry
+	} else if entry.mode.IsDir() {
+		return &fs.PathError{Op: "open", Path: name, Err: errors.New("is a directory")}
+	}
+	entry.data = bytes.Clone(data)
+	entry.modTime = time.Now()
+	return nil
+}
+
+func (m *MemFS) Create(name string, perm fs.FileMode) (io.WriteCloser, error) {
+	// Writing the empty file first reports a missing directory now rather
+	// than at Close
+	if err := m.WriteFile(name, nil, perm); err != nil {
+		return nil, err
+	}
+	return &memWriter{fs: m, name: name, perm: perm}, nil
+}
+
+func (m *MemFS) MkdirAll(name string, perm fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean("/" + name)
+	var path string
+	for _, component := range strings.Split(name, "/")[1:] {
+		if component == "" {
+			continue
+		}
+		path += "/" + component
+		entry := m.entries[path]
+		if entry == nil {
+			m.entries[path] = &memEntry{mode: fs.ModeDir | perm.Perm(), modTime: time.Now()}
+		} else if !entry.mode.IsDir() {
+			return &fs.PathError{Op: "mkdir", Path: path, Err: errors.New("not a directory")}
+		}
+	}
+	return nil
+}
+
+func (m *MemFS) Chmod(name string, mode fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, entry, err := m.lookup("chmod", name)
+	if err != nil {
+		return err
+	}
+	entry.mode = entry.mode.Type() | mode.Perm()
+	return nil
+}
+
+func (m *MemFS) Rename(oldName, newName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	oldName, entry, err := m.lookup("rename", oldName)
+	if err != nil {
+		return err
+	}
+	newName = filepath.Clean("/" + newName)
+	if parent := m.entries[filepath.Dir(newName)]; parent == nil || !parent.mode.IsDir() {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: fs.ErrNotExist}
+	}
+	delete(m.entries, oldName)
+	m.entries[newName] = entry
+	if entry.mode.IsDir() {
+		for path, child := range m.entries {
+			if strings.HasPrefix(path, oldName+"/") {
+				delete(m.entries, path)
+				m.entries[newName+strings.TrimPrefix(path, oldName)] = child
+			}
+		}
+	}
+	return nil
+}
+
+func (m *MemFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name, entry, err := m.lookup("remove", name)
+	if err != nil {
+		return err
+	}
+	if entry.mode.IsDir() {
+		for path := range m.entries {
+			if strings.HasPrefix(path, name+"/") {
+				return &fs.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
+			}
+		}
+	}
+	delete(m.entries, name)
+	return nil
+}
+
+func (e *memEntry) info(path string) memInfo {
+	return memInfo{filepath.Base(path), int64(len(e.data)), e.mode, e.modTime}
+}
+
+type memInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (i memInfo) Name() string       { return i.name }
+func (i memInfo) Size() int64        { return i.size }
+func (i memInfo) Mode() fs.FileMode  { return i.mode }
+func (i memInfo) ModTime() time.Time { return i.modTime }
+func (i memInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i memInfo) Sys() interface{}   { return nil }
+
+// memFile reads a snapshot of a file, taken when it was opened
+type memFile struct {
+	*bytes.Reader
+	info memInfo
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *memFile) Close() error               { return nil }
+
+// memWriter collects what is written, storing it on Close
+type memWriter struct {
+	bytes.Buffer
+	fs   *MemFS
+	name string
+	perm fs.FileMode
+}
+
+func (w *memWriter) Close() error {
+	return w.fs.WriteFile(w.name, w.Bytes(), w.perm)
+}
+
+// rootFS confines another filesystem to the directory root, as chroot
+// would: any path outside it, or leading outside it through a symbolic
+// link, is refused whatever the engine's symlink policy. It is the
+// isolation to rely on when workspaces belong to different users, since
+// it holds even if a tool resolves a path wrongly.
+type rootFS struct {
+	FS
+	root string
+}
+
+// errOutsideRoot is why a confined filesystem refuses a path
+var errOutsideRoot = errors.New("outside the workspace root")
+
+// check refuses a path outside the root, resolving links in as much of it
+// as exists
+func (r rootFS) check(op, name string) error {
+	name = filepath.Clean(name)
+	if !isWithin(r.root, name) {
+		return &fs.PathError{Op: op, Path: name, Err: errOutsideRoot}
+	}
+	root, err := r.FS.EvalSymlinks(r.root)
+	if err != nil {
+		return err
+	}
+	for p := name; ; p = filepath.Dir(p) {
+		if resolved, err := r.FS.EvalSymlinks(p); err == nil {
+			if !isWithin(root, resolved) {
+				return &fs.PathError{Op: op, Path: name, Err: errOutsideRoot}
+			}
+			return nil
+		}
+		if p == r.root || filepath.Dir(p) == p {
+			return nil
+		}
+	}
+}
+
+func (r rootFS) Open(name string) (File, error) {
+	if err := r.check("open", name); err != nil {
+		return nil, err
+	}
+	return r.FS.Open(name)
+}
+
+func (r rootFS) ReadFile(name string) ([]byte, error) {
+	if err := r.check("open", name); err != nil {
+		return nil, err
+	}
+	return r.FS.ReadFile(name)
+}
+
+func (r rootFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if err := r.check("open", name); err != nil {
+		return nil, err
+	}
+	return r.FS.ReadDir(name)
+}
+
+func (r rootFS) Stat(name string) (fs.FileInfo, error) {
+	if err := r.check("stat", name); err != nil {
+		return nil, err
+	}
+	return r.FS.Stat(name)
+}
+
+func (r rootFS) Lstat(name string) (fs.FileInfo, error) {
+	if err := r.check("lstat", name); err != nil {
+		return nil, err
+	}
+	return r.FS.Lstat(name)
+}
+
+func (r rootFS) EvalSymlinks(name string) (string, error) {
+	if err := r.check("lstat", name); err != nil {
+		return "", err
+	}
+	return r.FS.EvalSymlinks(name)
+}
+
+func (r rootFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	if err := r.check("open", name); err != nil {
+		return err
+	}
+	return r.FS.WriteFile(name, data, perm)
+}
+
+func (r rootFS) Create(name string, perm fs.FileMode) (io.WriteCloser, error) {
+	if err := r.check("open", name); err != nil {
+		return nil, err
+	}
+	return r.FS.Create(name, perm)
+}
+
+func (r rootFS) MkdirAll(name string, perm fs.FileMode) error {
+	if err := r.check("mkdir", name); err != nil {
+		return err
+	}
+	return r.FS.MkdirAll(name, perm)
+}
+
+func (r rootFS) Chmod(name string, mode fs.FileMode) error {
+	if err := r.check("chmod", name); err != nil {
+		return err
+	}
+	return r.FS.Chmod(name, mode)
+}
+
+func (r rootFS) Rename(oldName, newName string) error {
+	if err := r.check("rename", oldName); err != nil {
+		return err
+	}
+	if err := r.check("rename", newName); err != nil {
+		return err
+	}
+	return r.FS.Rename(oldName, newName)
+}
+
+func (r rootFS) Remove(name string) error {
+	if err := r.check("remove", name); err != nil {
+		return err
+	}
+	return r.FS.Remove(name)
+}
@@ -0,0 +1,242 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func newMemEngine(t *testing.T, files map[string]string) (*Engine, *MemFS) {
+	t.Helper()
+	m := NewMemFS("/workspace", files)
+	return &Engine{
+		workspace:     "/workspace",
+		filesystem:    m,
+		maxReadBytes:  defaultMaxReadBytes,
+		symlinkPolicy: symlinkWithin,
+	}, m
+}
+
+func TestMemFSFileTools(t *testing.T) {
+	e, m := newMemEngine(t, map[string]string{
+		"src/app.py": "import os\nprint(os.environ['API_KEY'])\n",
+		"data.csv":   "name,count\napple,3\npear,5\n",
+	})
+
+	if _, err := e.writeFile(args(t, map[string]string{"path": "notes/todo.txt", "content": "one\ntwo\n"})); err != nil {
+		t.Fatal(err)
+	}
+	data, err := m.ReadFile("/workspace/notes/todo.txt")
+	if err != nil || string(data) != "one\ntwo\n" {
+		t.Fatalf("MemFS has %q, %v", data, err)
+	}
+
+	tests := []struct {
+		tool string
+		args map[string]interface{}
+		want string
+	}{
+		{"read_file", map[string]interface{}{"path": "notes/todo.txt"}, "two"},
+		{"read_files", map[string]interface{}{"paths": []string{"notes/todo.txt", "src/app.py"}}, "==> src/app.py <=="},
+		{"diff_files", map[string]interface{}{"a": "notes/todo.txt", "b": "src/app.py"}, "+import os"},
+		{"hash_file", map[string]interface{}{"paths": []string{"data.csv"}}, "data.csv"},
+		{"preview_table", map[string]interface{}{"path": "data.csv"}, "| pear"},
+		{"find_env_vars", map[string]interface{}{"path": "."}, "API_KEY"},
+		{"create_archive", map[string]interface{}{"path": "out/src.zip", "sources": []string{"src"}}, "1 files"},
+		{"extract_archive", map[string]interface{}{"path": "out/src.zip", "destination": "copy"}, "copy"},
+	}
+	for _, test := range tests {
+		var toolCall ToolCall
+		toolCall.Function.Name = test.tool
+		toolCall.Function.Arguments = args(t, test.args)
+		out, err := e.callTool(toolCall)
+		if err != nil || !strings.Contains(out, test.want) {
+			t.Errorf("%s gave %q, %v; want it to contain %q", test.tool, out, err, test.want)
+		}
+	}
+
+	if data, err := m.ReadFile("/workspace/copy/src/app.py"); err != nil || !strings.Contains(string(data), "API_KEY") {
+		t.Errorf("extracted file has %q, %v", data, err)
+	}
+	if !strings.Contains(e.buildRepoMap(), "todo.txt") {
+		t.Error("repo map does not list files in MemFS")
+	}
+	if _, err := os.Stat("/workspace/notes/todo.txt"); err == nil {
+		t.Error("MemFS wrote to the disk")
+	}
+}
+
+func TestMemFSPathsStayInWorkspace(t *testing.T) {
+	e, m := newMemEngine(t, nil)
+	m.MkdirAll("/outside", 0755)
+	if _, err := e.writeFile(args(t, map[string]string{"path": "../outside/x.txt", "content": "x"})); err == nil {
+		t.Error("wrote outside the workspace")
+	}
+}
+
+func TestMemFS(t *testing.T) {
+	m := NewMemFS("/w", map[string]string{"a/b.txt": "b"})
+
+	if err := m.WriteFile("/w/missing/c.txt", nil, 0644); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("write into a missing directory gave %v", err)
+	}
+	if err := m.MkdirAll("/w/a/b.txt/c", 0755); err == nil {
+		t.Error("made a directory under a file")
+	}
+	if err := m.Remove("/w/a"); err == nil {
+		t.Error("removed a directory that is not empty")
+	}
+
+	entries, err := m.ReadDir("/w/a")
+	if err != nil || len(entries) != 1 || entries[0].Name() != "b.txt" || entries[0].IsDir() {
+		t.Errorf("ReadDir gave %v, %v", entries, err)
+	}
+
+	if err := m.Rename("/w/a", "/w/z"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := m.ReadFile("/w/z/b.txt"); err != nil || string(data) != "b" {
+		t.Errorf("renamed directory holds %q, %v", data, err)
+	}
+	if _, err := m.Stat("/w/a/b.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("old path still exists: %v", err)
+	}
+
+	w, err := m.Create("/w/z/c.txt", 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("streamed"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := m.Stat("/w/z/c.txt")
+	if err != nil || info.Size() != 8 || info.Mode().Perm() != 0600 {
+		t.Errorf("created file is %v, %v", info, err)
+	}
+
+	var walked []string
+	walkDir(m, "/w", func(path string, d fs.DirEntry, err error) error {
+		walked = append(walked, path)
+		return nil
+	})
+	if got := strings.Join(walked, " "); got != "/w /w/z /w/z/b.txt /w/z/c.txt" {
+		t.Errorf("walked %s", got)
+	}
+}
+
+func TestReadOnlyFS(t *testing.T) {
+	e := newToolEngine(t)
+	writeTestFile(t, e, "a.txt", "original")
+	e.filesystem = readOnlyFS{osFS{}}
+
+	if out, err := e.readFile(args(t, map[string]string{"path": "a.txt"})); err != nil || !strings.Contains(out, "original") {
+		t.Errorf("read gave %q, %v", out, err)
+	}
+	for _, path := range []string{"a.txt", "new/b.txt"} {
+		_, err := e.writeFile(args(t, map[string]string{"path": path, "content": "changed"}))
+		if !errors.Is(err, errReadOnly) && (err == nil || !strings.Contains(err.Error(), errReadOnly.Error())) {
+			t.Errorf("write to %s gave %v", path, err)
+		}
+	}
+	if data, _ := os.ReadFile(e.workspace + "/a.txt"); string(data) != "original" {
+		t.Errorf("file was changed to %q", data)
+	}
+}
+
+func TestRunWithMemFS(t *testing.T) {
+	m := NewMemFS("/project", map[string]string{"README.md": "# Demo\n"})
+	e, provider, _ := newTestEngine(t, []ChatResponse{
+		reply("", call("read_file", `{"path": "README.md"}`)),
+		reply("", call("write_file", `{"path": "README.md", "content": "# Demo\n\nMore.\n"}`)),
+		reply("Done."),
+	}, WithWorkspace("/project"), WithFS(m))
+
+	if _, err := e.Run(context.Background(), "Extend the README"); err != nil {
+		t.Fatal(err)
+	}
+	if results := toolResults(provider.lastMessages(t, 2)); len(results) != 1 || !strings.Contains(results[0].Content, "# Demo") {
+		t.Errorf("read gave %+v", results)
+	}
+	if data, _ := m.ReadFile("/project/README.md"); string(data) != "# Demo\n\nMore.\n" {
+		t.Errorf("README is %q", data)
+	}
+}
+
+func TestRootFS(t *testing.T) {
+	dir := t.TempDir()
+	for _, tenant := range []string{"a", "b"} {
+		if err := os.MkdirAll(dir+"/"+tenant, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(dir+"/b/secret.txt", []byte("b's secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(dir+"/b", dir+"/a/link"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Even with links followed anywhere, the confined filesystem holds
+	e, err := New(WithProvider(nil, "http://localhost:0", "m"), WithConfinedWorkspace(dir+"/a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.symlinkPolicy = symlinkFollow
+
+	if _, err := e.writeFile(args(t, map[string]string{"path": "own.txt", "content": "a's file"})); err != nil {
+		t.Errorf("write inside the root failed: %v", err)
+	}
+	if out, err := e.readFile(args(t, map[string]string{"path": "own.txt"})); err != nil || !strings.Contains(out, "a's file") {
+		t.Errorf("read inside the root gave %q, %v", out, err)
+	}
+	if out, err := e.readFile(args(t, map[string]string{"path": "link/secret.txt"})); err == nil {
+		t.Errorf("read through a link out of the root gave %q", out)
+	}
+	if _, err := e.writeFile(args(t, map[string]string{"path": "link/planted.txt", "content": "x"})); err == nil {
+		t.Error("wrote through a link out of the root")
+	}
+	if _, err := os.Stat(dir + "/b/planted.txt"); err == nil {
+		t.Error("file planted in another workspace")
+	}
+
+	r := rootFS{osFS{}, dir + "/a"}
+	if _, err := r.ReadFile(dir + "/b/secret.txt"); !errors.Is(err, errOutsideRoot) {
+		t.Errorf("direct read outside the root gave %v", err)
+	}
+	if err := r.Rename(dir+"/a/own.txt", dir+"/b/own.txt"); !errors.Is(err, errOutsideRoot) {
+		t.Errorf("rename out of the root gave %v", err)
+	}
+
+	// Commands would run outside the root, so none are offered or run
+	e.pythonTool, e.projectToolsEnabled = true, true
+	for _, tool := range e.getTools() {
+		if commandTools[tool.Function.Name] {
+			t.Errorf("%s offered in a confined workspace", tool.Function.Name)
+		}
+	}
+	for _, toolCall := range []ToolCall{call("run_command", `{"command": "cat `+dir+`/b/secret.txt"}`), call("run_python", `{"code": "print(1)"}`), call("go_test", `{}`)} {
+		if out, err := e.callTool(toolCall); err == nil || !strings.Contains(err.Error(), "runs no commands") {
+			t.Errorf("%s in a confined workspace gave %q, %v", toolCall.Function.Name, out, err)
+		}
+	}
+
+	// Unless they are allowed explicitly, whatever order the options come in
+	e, err = New(WithUnconfinedCommands(), WithProvider(nil, "http://localhost:0", "m"), WithConfinedWorkspace(dir+"/a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.ContainsFunc(e.getTools(), func(tool Tool) bool { return tool.Function.Name == "run_command" }) {
+		t.Error("run_command not offered with unconfined commands")
+	}
+	if err := WithoutCommands()(e); err != nil {
+		t.Fatal(err)
+	}
+	if slices.ContainsFunc(e.getTools(), func(tool Tool) bool { return tool.Function.Name == "run_command" }) {
+		t.Error("run_command offered without commands")
+	}
+}
@@ -0,0 +1,159 @@
+package agent
+
+import (
+	"fmt"
+	"strings"
+)
+
+// In generate mode the conversation is rendered to a single prompt in the
+// model's own chat format and sent to /api/generate in raw mode, bypassing
+// Ollama's chat template. Tools are described in the system prompt and
+// calls are parsed from the completion, so some models that mishandle
+// /api/chat's tool support do better this way.
+
+// chatTemplate is how a model family marks up a conversation. Each format
+// has one %s, for the message text; a family with no system format gets
+// the system prompt at the start of the first user message.
+type chatTemplate struct {
+	name      string
+	begin     string
+	system    string
+	user      string
+	assistant string
+	tool      string
+
+	// prompt opens the assistant turn the model is to complete
+	prompt string
+	stop   []string
+}
+
+var chatTemplates = map[string]*chatTemplate{
+	"chatml": {
+		name:      "chatml",
+		system:    "<|im_start|>system\n%s<|im_end|>\n",
+		user:      "<|im_start|>user\n%s<|im_end|>\n",
+		assistant: "<|im_start|>assistant\n%s<|im_end|>\n",
+		tool:      "<|im_start|>user\n<tool_response>\n%s\n</tool_response><|im_end|>\n",
+		prompt:    "<|im_start|>assistant\n",
+		stop:      []string{"<|im_end|>", "<|im_start|>"},
+	},
+	"llama3": {
+		name:      "llama3",
+		begin:     "<|begin_of_text|>",
+		system:    "<|start_header_id|>system<|end_header_id|>\n\n%s<|eot_id|>",
+		user:      "<|start_header_id|>user<|end_header_id|>\n\n%s<|eot_id|>",
+		assistant: "<|start_header_id|>assistant<|end_header_id|>\n\n%s<|eot_id|>",
+		tool:      "<|start_header_id|>ipython<|end_header_id|>\n\n%s<|eot_id|>",
+		prompt:    "<|start_header_id|>assistant<|end_header_id|>\n\n",
+		stop:      []string{"<|eot_id|>", "<|start_header_id|>"},
+	},
+	"mistral": {
+		name:      "mistral",
+		begin:     "<s>",
+		user:      "[INST] %s [/INST]",
+		assistant: "%s</s>",
+		tool:      "[TOOL_RESULTS] %s [/TOOL_RESULTS]",
+		stop:      []string{"</s>", "[INST]"},
+	},
+	"gemma": {
+		name:      "gemma",
+		begin:     "<bos>",
+		user:      "<start_of_turn>user\n%s<end_of_turn>\n",
+		assistant: "<start_of_turn>model\n%s<end_of_turn>\n",
+		tool:      "<start_of_turn>user\nTool result:\n%s<end_of_turn>\n",
+		prompt:    "<start_of_turn>model\n",
+		stop:      []string{"<end_of_turn>", "<start_of_turn>"},
+	},
+	"phi3": {
+		name:      "phi3",
+		system:    "<|system|>\n%s<|end|>\n",
+		user:      "<|user|>\n%s<|end|>\n",
+		assistant: "<|assistant|>\n%s<|end|>\n",
+		tool:      "<|user|>\nTool result:\n%s<|end|>\n",
+		prompt:    "<|assistant|>\n",
+		stop:      []string{"<|end|>", "<|user|>"},
+	},
+}
+
+// chatTemplatesByFamily maps model families to their template; others get
+// ChatML, which many fine-tunes use
+var chatTemplatesByFamily = map[string]string{
+	"llama":   "llama3",
+	"mistral": "mistral",
+	"mixtral": "mistral",
+	"gemma":   "gemma",
+	"phi":     "phi3",
+}
+
+// chatTemplateForModel returns the named template, or the one for the
+// model's family if name is empty
+func chatTemplateForModel(name, model string) (*chatTemplate, error) {
+	if name == "" {
+		name = chatTemplatesByFamily[modelFamily(model)]
+		if name == "" {
+			name = "chatml"
+		}
+	}
+	t, ok := chatTemplates[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown chat template: %s", name)
+	}
+	return t, nil
+}
+
+// generateAdapter is the prompt adapter to use in generate mode, where
+// there is no tools field: an adapter that relies on it is replaced by one
+// that describes tools in the system prompt
+func generateAdapter(adapter PromptAdapter, t *chatTemplate) PromptAdapter {
+	if a, ok := adapter.(*templateAdapter); !ok || !a.nativeTools {
+		return adapter
+	}
+	if t.name == "chatml" {
+		return adapters["hermes"]
+	}
+	return adapters["prompt"]
+}
+
+// render formats a conversation as a prompt ending with the opening of the
+// assistant's turn
+func (t *chatTemplate) render(messages []Message) string {
+	var b strings.Builder
+	b.WriteString(t.begin)
+	pendingSystem := ""
+	for _, message := range messages {
+		content := message.Content
+		switch message.Role {
+		case "system":
+			if t.system == "" {
+				pendingSystem = content
+				continue
+			}
+			fmt.Fprintf(&b, t.system, content)
+		case "assistant":
+			fmt.Fprintf(&b, t.assistant, content)
+		case "tool":
+			fmt.Fprintf(&b, t.tool, content)
+		default:
+			if pendingSystem != "" {
+				content = pendingSystem + "\n\n" + content
+				pendingSystem = ""
+			}
+			fmt.Fprintf(&b, t.user, content)
+		}
+	}
+	b.WriteString(t.prompt)
+	return b.String()
+}
+
+type GenerateRequest struct {
+	Model   string                 `json:"model"`
+	Prompt  string                 `json:"prompt"`
+	Raw     bool                   `json:"raw"`
+	Stream  bool                   `json:"stream"`
+	Options map[string]interface{} `json:"options,omitempty"`
+}
+
+type GenerateResponse struct {
+	Response string `json:"response"`
+	Done     bool   `json:"done"`
+}
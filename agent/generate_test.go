@@ -0,0 +1,103 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestChatTemplateRender(t *testing.T) {
+	messages := []Message{
+		{Role: "system", Content: "Be brief."},
+		{Role: "user", Content: "List files"},
+		{Role: "assistant", Content: `<tool_call>{"name": "run_command", "arguments": {"command": "ls"}}</tool_call>`},
+		{Role: "tool", Content: "a.txt"},
+	}
+
+	chatml := chatTemplates["chatml"].render(messages)
+	want := "<|im_start|>system\nBe brief.<|im_end|>\n" +
+		"<|im_start|>user\nList files<|im_end|>\n" +
+		"<|im_start|>assistant\n<tool_call>{\"name\": \"run_command\", \"arguments\": {\"command\": \"ls\"}}</tool_call><|im_end|>\n" +
+		"<|im_start|>user\n<tool_response>\na.txt\n</tool_response><|im_end|>\n" +
+		"<|im_start|>assistant\n"
+	if chatml != want {
+		t.Errorf("chatml rendered as\n%s\nwant\n%s", chatml, want)
+	}
+
+	// Mistral has no system turn, so the system prompt leads the first
+	// user message
+	mistral := chatTemplates["mistral"].render(messages[:2])
+	if mistral != "<s>[INST] Be brief.\n\nList files [/INST]" {
+		t.Errorf("mistral rendered as %q", mistral)
+	}
+}
+
+func TestChatTemplateForModel(t *testing.T) {
+	for model, want := range map[string]string{
+		"llama3.1:8b":       "llama3",
+		"mistral-nemo":      "mistral",
+		"gemma2:9b":         "gemma",
+		"phi3:mini":         "phi3",
+		"qwen2.5-coder:14b": "chatml",
+	} {
+		if got, err := chatTemplateForModel("", model); err != nil || got.name != want {
+			t.Errorf("template for %s is %v, %v; want %s", model, got, err, want)
+		}
+	}
+	if _, err := chatTemplateForModel("nope", "m"); err == nil {
+		t.Error("unknown template accepted")
+	}
+	if got := generateAdapter(adapters["qwen"], chatTemplates["chatml"]); got.Name() != "hermes" {
+		t.Errorf("generate mode uses the %s adapter for qwen", got.Name())
+	}
+}
+
+func TestRunGenerateMode(t *testing.T) {
+	completions := []string{
+		"<tool_call>\n{\"name\": \"write_file\", \"arguments\": {\"path\": \"g.txt\", \"content\": \"generated\"}}\n</tool_call>",
+		"Done.",
+	}
+	var prompts []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/generate" {
+			http.NotFound(w, r)
+			return
+		}
+		var req GenerateRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if !req.Raw || req.Options["stop"] == nil {
+			t.Errorf("request %+v", req)
+		}
+		prompts = append(prompts, req.Prompt)
+		json.NewEncoder(w).Encode(GenerateResponse{Response: completions[len(prompts)-1], Done: true})
+	}))
+	defer srv.Close()
+
+	e, err := New(WithWorkspace(t.TempDir()), WithProvider(srv.Client(), srv.URL, "qwen2.5"),
+		WithSystemPrompt("You are a test."), WithEvents(func(Event) {}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.generateTemplate = chatTemplates["chatml"]
+	e.adapter = generateAdapter(e.adapter, e.generateTemplate)
+	e.contentParsers, _ = newContentParsers("", "auto", e.adapter.ContentParsers())
+
+	result, err := e.Run(context.Background(), "Write g.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Reply != "Done." {
+		t.Errorf("reply %q", result.Reply)
+	}
+	if data, err := os.ReadFile(filepath.Join(e.workspace, "g.txt")); err != nil || string(data) != "generated" {
+		t.Errorf("file has %q, %v", data, err)
+	}
+	if len(prompts) != 2 || !strings.Contains(prompts[0], "<tools>") || !strings.Contains(prompts[1], "<tool_response>") {
+		t.Errorf("prompts %q", prompts)
+	}
+}
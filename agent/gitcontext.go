@@ -0,0 +1,39 @@
+package agent
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxGitDiffBytes caps the uncommitted diff included in the initial context
+const maxGitDiffBytes = 8000
+
+// buildGitContext describes recent commits and uncommitted changes, so that
+// requests like "fix the bug I just introduced" have something to go on
+func (e *Engine) buildGitContext(commits int) string {
+	if _, err := e.git("rev-parse", "--git-dir"); err != nil {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteString("Recent git activity in the workspace:\n")
+
+	if log, err := e.git("log", "--stat", "--format=commit %h %an %ad%n    %s", "--date=short", fmt.Sprintf("-%d", commits)); err == nil && log != "" {
+		fmt.Fprintf(&b, "\nLast %d commits:\n%s\n", commits, log)
+	}
+
+	status, err := e.git("status", "--short")
+	if err != nil || status == "" {
+		b.WriteString("\nThe working tree is clean.\n")
+		return b.String()
+	}
+	fmt.Fprintf(&b, "\nUncommitted changes:\n%s\n", status)
+
+	if diff, err := e.git("diff", "HEAD"); err == nil && diff != "" {
+		if len(diff) > maxGitDiffBytes {
+			diff = diff[:maxGitDiffBytes] + "\n... (diff truncated)"
+		}
+		fmt.Fprintf(&b, "\nDiff against HEAD:\n%s\n", diff)
+	}
+	return b.String()
+}
@@ -0,0 +1,119 @@
+package agent
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// ClientConfig holds the proxy, TLS and authentication settings for requests
+// to the model provider. Without an explicit proxy, HTTPS_PROXY, HTTP_PROXY
+// and NO_PROXY from the environment apply.
+type ClientConfig struct {
+	ProxyURL           string
+	CACertFile         string
+	ClientCertFile     string
+	ClientKeyFile      string
+	InsecureSkipVerify bool
+
+	// Authentication for Ollama behind a reverse proxy; BasicAuth is user:password
+	BearerToken string
+	BasicAuth   string
+	Headers     map[string]string
+}
+
+func newHTTPClient(cfg ClientConfig) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if cfg.ProxyURL != "" {
+		proxyURL, err := url.Parse(cfg.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL: %v", err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.InsecureSkipVerify}
+
+	if cfg.CACertFile != "" {
+		pem, err := os.ReadFile(cfg.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %v", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.CACertFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.ClientCertFile != "" || cfg.ClientKeyFile != "" {
+		if cfg.ClientCertFile == "" || cfg.ClientKeyFile == "" {
+			return nil, fmt.Errorf("client certificate and key must be given together")
+		}
+		cert, err := tls.LoadX509KeyPair(cfg.ClientCertFile, cfg.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	transport.TLSClientConfig = tlsConfig
+
+	if cfg.BearerToken == "" && cfg.BasicAuth == "" && len(cfg.Headers) == 0 {
+		return &http.Client{Transport: transport}, nil
+	}
+
+	headers := make(http.Header)
+	for name, value := range cfg.Headers {
+		headers.Set(name, value)
+	}
+	if cfg.BasicAuth != "" {
+		if !strings.Contains(cfg.BasicAuth, ":") {
+			return nil, fmt.Errorf("basic auth must be in the form user:password")
+		}
+		headers.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(cfg.BasicAuth)))
+	}
+	if cfg.BearerToken != "" {
+		headers.Set("Authorization", "Bearer "+cfg.BearerToken)
+	}
+	return &http.Client{Transport: &authTransport{base: transport, headers: headers}}, nil
+}
+
+// authTransport adds authentication headers to every request
+type authTransport struct {
+	base    http.RoundTripper
+	headers http.Header
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for name, values := range t.headers {
+		req.Header[name] = values
+	}
+	return t.base.RoundTrip(req)
+}
+
+// parseHeaders parses "Name: value" pairs separated by semicolons or newlines
+func parseHeaders(s string) (map[string]string, error) {
+	headers := make(map[string]string)
+	for _, field := range strings.FieldsFunc(s, func(r rune) bool { return r == ';' || r == '\n' }) {
+		if strings.TrimSpace(field) == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(field, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("invalid header %q: expected Name: value", strings.TrimSpace(field))
+		}
+		headers[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	return headers, nil
+}
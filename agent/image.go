@@ -0,0 +1,397 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// maxImagePixels bounds the size of an image the tools will create, so a
+// mistyped dimension can't exhaust memory
+const maxImagePixels = 8192 * 8192
+
+// ImageAPIConfig is an OpenAI-compatible image generation endpoint, such
+// as https://api.openai.com/v1/images/generations or a local server
+// offering the same API
+type ImageAPIConfig struct {
+	URL   string
+	Key   string
+	Model string
+}
+
+func imageTools(api ImageAPIConfig) []Tool {
+	tools := []Tool{
+		{
+			Type: "function",
+			Function: Function{
+				Name:        "transform_image",
+				Description: "Resize an image and/or convert it between PNG, JPEG and GIF, writing the result to a new path or over the original",
+				Parameters: map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"path": map[string]interface{}{
+							"type":        "string",
+							"description": "Source image path relative to workspace",
+						},
+						"output": map[string]interface{}{
+							"type":        "string",
+							"description": "Output path; its extension (.png, .jpg or .gif) sets the format (optional, default the source path)",
+						},
+						"width": map[string]interface{}{
+							"type":        "integer",
+							"description": "Width in pixels (optional; with only one of width and height, the other keeps the aspect ratio)",
+						},
+						"height": map[string]interface{}{
+							"type":        "integer",
+							"description": "Height in pixels (optional)",
+						},
+						"fit": map[string]interface{}{
+							"type":        "string",
+							"enum":        []string{"contain", "cover", "stretch"},
+							"description": "With both width and height: contain scales to fit inside, cover scales and crops to fill, stretch ignores the aspect ratio (optional, default contain)",
+						},
+					},
+					"required": []string{"path"},
+				},
+			},
+		},
+	}
+	if api.URL != "" {
+		tools = append(tools, Tool{
+			Type: "function",
+			Function: Function{
+				Name:        "generate_image",
+				Description: "Generate an image from a text description, such as an icon or placeholder artwork, and save it in the workspace",
+				Parameters: map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"prompt": map[string]interface{}{
+							"type":        "string",
+							"description": "Description of the image",
+						},
+						"path": map[string]interface{}{
+							"type":        "string",
+							"description": "Output path relative to workspace, ending in .png, .jpg or .gif",
+						},
+						"size": map[string]interface{}{
+							"type":        "string",
+							"description": "Size to request from the generator, e.g. 1024x1024 (optional)",
+						},
+						"width": map[string]interface{}{
+							"type":        "integer",
+							"description": "Width to resize the result to, e.g. 64 for an icon (optional)",
+						},
+						"height": map[string]interface{}{
+							"type":        "integer",
+							"description": "Height to resize the result to (optional)",
+						},
+					},
+					"required": []string{"prompt", "path"},
+				},
+			},
+		})
+	}
+	return tools
+}
+
+// imageFormat gets the output format from a file extension
+func imageFormat(path string) (string, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".png":
+		return "png", nil
+	case ".jpg", ".jpeg":
+		return "jpeg", nil
+	case ".gif":
+		return "gif", nil
+	}
+	return "", fmt.Errorf("%s: unsupported image format; use .png, .jpg or .gif", path)
+}
+
+func encodeImage(img image.Image, format string) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case "png":
+		err = png.Encode(&buf, img)
+	case "jpeg":
+		// JPEG has no transparency, so composite onto white rather than
+		// letting transparent areas come out black
+		rgba := image.NewRGBA(img.Bounds())
+		draw.Draw(rgba, rgba.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+		draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Over)
+		err = jpeg.Encode(&buf, rgba, &jpeg.Options{Quality: 90})
+	case "gif":
+		err = gif.Encode(&buf, img, nil)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %s: %v", format, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// targetSize works out the output size and the part of the source to use
+func targetSize(bounds image.Rectangle, width, height int, fit string) (image.Rectangle, int, int, error) {
+	sw, sh := bounds.Dx(), bounds.Dy()
+	if width < 0 || height < 0 {
+		return bounds, 0, 0, fmt.Errorf("width and height must be positive")
+	}
+	switch {
+	case width == 0 && height == 0:
+		return bounds, sw, sh, nil
+	case height == 0:
+		height = max(sh*width/sw, 1)
+	case width == 0:
+		width = max(sw*height/sh, 1)
+	default:
+		switch fit {
+		case "", "contain":
+			if sw*height > sh*width {
+				height = max(sh*width/sw, 1)
+			} else {
+				width = max(sw*height/sh, 1)
+			}
+		case "cover":
+			// Crop the source, about its centre, to the target's aspect ratio
+			if sw*height > sh*width {
+				cw := sh * width / height
+				bounds.Min.X += (sw - cw) / 2
+				bounds.Max.X = bounds.Min.X + cw
+			} else {
+				ch := sw * height / width
+				bounds.Min.Y += (sh - ch) / 2
+				bounds.Max.Y = bounds.Min.Y + ch
+			}
+		case "stretch":
+		default:
+			return bounds, 0, 0, fmt.Errorf("unknown fit %q", fit)
+		}
+	}
+	if width*height > maxImagePixels {
+		return bounds, 0, 0, fmt.Errorf("%dx%d is too large", width, height)
+	}
+	return bounds, width, height, nil
+}
+
+// resize scales the source rectangle of img to width by height, averaging
+// the source pixels that fall in each destination pixel
+func resize(img image.Image, src image.Rectangle, width, height int) image.Image {
+	if src == img.Bounds() && width == src.Dx() && height == src.Dy() {
+		return img
+	}
+	out := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := src.Min.Y + y*src.Dy()/height
+		y1 := max(src.Min.Y+(y+1)*src.Dy()/height, y0+1)
+		for x := 0; x < width; x++ {
+			x0 := src.Min.X + x*src.Dx()/width
+			x1 := max(src.Min.X+(x+1)*src.Dx()/width, x0+1)
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := img.At(sx, sy).RGBA()
+					r += uint64(pr)
+					g += uint64(pg)
+					b += uint64(pb)
+					a += uint64(pa)
+					n++
+				}
+			}
+			out.SetRGBA64(x, y, color.RGBA64{uint16(r / n), uint16(g / n), uint16(b / n), uint16(a / n)})
+		}
+	}
+	return out
+}
+
+func (e *Engine) transformImage(args json.RawMessage) (string, error) {
+	var params struct {
+		Path   string `json:"path"`
+		Output string `json:"output"`
+		Width  int    `json:"width"`
+		Height int    `json:"height"`
+		Fit    string `json:"fit"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return "", fmt.Errorf("invalid arguments: %v", err)
+	}
+	if params.Output == "" {
+		params.Output = params.Path
+	}
+	format, err := imageFormat(params.Output)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := e.readRaw(params.Path)
+	if err != nil {
+		return "", err
+	}
+	img, sourceFormat, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("failed to decode %s: %v", params.Path, err)
+	}
+	return e.saveImage(img, params.Output, format, params.Width, params.Height, params.Fit,
+		fmt.Sprintf("%s (%s, %dx%d)", params.Path, sourceFormat, img.Bounds().Dx(), img.Bounds().Dy()))
+}
+
+// saveImage resizes an image as asked and writes it in the given format
+func (e *Engine) saveImage(img image.Image, path, format string, width, height int, fit, source string) (string, error) {
+	src, width, height, err := targetSize(img.Bounds(), width, height, fit)
+	if err != nil {
+		return "", err
+	}
+	data, err := encodeImage(resize(img, src, width, height), format)
+	if err != nil {
+		return "", err
+	}
+	if err := e.saveBinary(path, data); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Wrote %s (%s, %dx%d, %d bytes) from %s", path, format, width, height, len(data), source), nil
+}
+
+// saveBinary writes data as is, unlike saveFile, which treats content as
+// text to be stored in the existing file's encoding
+func (e *Engine) saveBinary(path string, data []byte) error {
+	fullPath, err := e.resolvePath(path)
+	if err != nil {
+		return err
+	}
+	defer e.locks.write(fullPath)()
+	before, _ := e.files().ReadFile(fullPath)
+	if err := e.spendDiffBudget(budgetWrite{fullPath, string(before), string(data)}); err != nil {
+		return err
+	}
+	_, err = e.files().Stat(fullPath)
+	if err := e.quota.reserve(int64(len(data)), err != nil); err != nil {
+		return err
+	}
+	if err := e.files().MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %v", err)
+	}
+	if err := e.files().WriteFile(fullPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write file: %v", err)
+	}
+	e.invalidateCommandCache()
+	return nil
+}
+
+// imageResponse is the reply from an images/generations endpoint; an image
+// comes back either inline or as a URL to fetch
+type imageResponse struct {
+	Data []struct {
+		B64JSON string `json:"b64_json"`
+		URL     string `json:"url"`
+	} `json:"data"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (e *Engine) generateImage(args json.RawMessage) (string, error) {
+	var params struct {
+		Prompt string `json:"prompt"`
+		Path   string `json:"path"`
+		Size   string `json:"size"`
+		Width  int    `json:"width"`
+		Height int    `json:"height"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return "", fmt.Errorf("invalid arguments: %v", err)
+	}
+	if e.imageAPI.URL == "" {
+		return "", fmt.Errorf("no image generation endpoint is configured")
+	}
+	format, err := imageFormat(params.Path)
+	if err != nil {
+		return "", err
+	}
+
+	request := map[string]interface{}{
+		"prompt":          params.Prompt,
+		"n":               1,
+		"response_format": "b64_json",
+	}
+	if e.imageAPI.Model != "" {
+		request["model"] = e.imageAPI.Model
+	}
+	if params.Size != "" {
+		request["size"] = params.Size
+	}
+	body, _ := json.Marshal(request)
+
+	// Like notifications, this goes to a separate service, so it must not
+	// use the Ollama client, which may carry credentials
+	client := &http.Client{Timeout: 5 * time.Minute}
+	req, err := http.NewRequest("POST", e.imageAPI.URL, bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("invalid image endpoint: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if e.imageAPI.Key != "" {
+		req.Header.Set("Authorization", "Bearer "+e.imageAPI.Key)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("image generation failed: %v", err)
+	}
+	defer resp.Body.Close()
+	var result imageResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("image generation failed: %s: %v", resp.Status, err)
+	}
+	if result.Error != nil {
+		return "", fmt.Errorf("image generation failed: %s", result.Error.Message)
+	}
+	if resp.StatusCode != http.StatusOK || len(result.Data) == 0 {
+		return "", fmt.Errorf("image generation failed: %s", resp.Status)
+	}
+
+	var data []byte
+	if result.Data[0].B64JSON != "" {
+		data, err = base64.StdEncoding.DecodeString(result.Data[0].B64JSON)
+		if err != nil {
+			return "", fmt.Errorf("invalid image data: %v", err)
+		}
+	} else {
+		data, err = fetchImage(client, result.Data[0].URL)
+		if err != nil {
+			return "", err
+		}
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("failed to decode generated image: %v", err)
+	}
+	return e.saveImage(img, params.Path, format, params.Width, params.Height, "cover", "generated image")
+}
+
+func fetchImage(client *http.Client, url string) ([]byte, error) {
+	if url == "" {
+		return nil, fmt.Errorf("image generation returned no image")
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch generated image: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch generated image: %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 64<<20))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch generated image: %v", err)
+	}
+	return data, nil
+}
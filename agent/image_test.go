@@ -0,0 +1,155 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTargetSize(t *testing.T) {
+	bounds := image.Rect(0, 0, 400, 200)
+	for _, test := range []struct {
+		width, height int
+		fit           string
+		src           image.Rectangle
+		w, h          int
+	}{
+		{0, 0, "", bounds, 400, 200},
+		{100, 0, "", bounds, 100, 50},
+		{0, 100, "", bounds, 200, 100},
+		{100, 100, "", bounds, 100, 50},
+		{100, 100, "contain", bounds, 100, 50},
+		{100, 100, "cover", image.Rect(100, 0, 300, 200), 100, 100},
+		{100, 100, "stretch", bounds, 100, 100},
+		{1, 0, "", bounds, 1, 1},
+	} {
+		src, w, h, err := targetSize(bounds, test.width, test.height, test.fit)
+		if err != nil || src != test.src || w != test.w || h != test.h {
+			t.Errorf("%dx%d %q: got %v %dx%d, %v", test.width, test.height, test.fit, src, w, h, err)
+		}
+	}
+	for _, test := range []struct {
+		width, height int
+		fit           string
+	}{
+		{-1, 0, ""},
+		{100, 100, "squash"},
+		{100000, 100000, "stretch"},
+	} {
+		if _, _, _, err := targetSize(bounds, test.width, test.height, test.fit); err == nil {
+			t.Errorf("%dx%d %q: no error", test.width, test.height, test.fit)
+		}
+	}
+}
+
+func TestResize(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	img.Set(0, 0, color.RGBA{0, 0, 0, 255})
+	img.Set(1, 0, color.RGBA{200, 100, 50, 255})
+	got := color.RGBAModel.Convert(resize(img, img.Bounds(), 1, 1).At(0, 0)).(color.RGBA)
+	if got != (color.RGBA{100, 50, 25, 255}) {
+		t.Errorf("averaged pixel is %v", got)
+	}
+	if resize(img, img.Bounds(), 2, 1) != image.Image(img) {
+		t.Error("an image at its own size was copied")
+	}
+}
+
+// testPNG encodes a solid image of the given size
+func testPNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{255, 0, 0, 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// decodeTestImage reads an image from the workspace
+func decodeTestImage(t *testing.T, e *Engine, path string) (image.Image, string) {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(e.workspace, path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img, format
+}
+
+func TestTransformImage(t *testing.T) {
+	e := newToolEngine(t)
+	writeTestFile(t, e, "logo.png", string(testPNG(t, 64, 32)))
+
+	result, err := e.transformImage(args(t, map[string]interface{}{"path": "logo.png", "output": "icons/logo.jpg", "width": 16}))
+	if err != nil || !strings.Contains(result, "Wrote icons/logo.jpg (jpeg, 16x8") || !strings.Contains(result, "from logo.png (png, 64x32)") {
+		t.Fatalf("transform: %q, %v", result, err)
+	}
+	if img, format := decodeTestImage(t, e, "icons/logo.jpg"); format != "jpeg" || img.Bounds().Dx() != 16 || img.Bounds().Dy() != 8 {
+		t.Errorf("output is %s, %v", format, img.Bounds())
+	}
+
+	if _, err := e.transformImage(args(t, map[string]interface{}{"path": "logo.png", "output": "logo.bmp"})); err == nil {
+		t.Error("an unsupported format was written")
+	}
+	writeTestFile(t, e, "notes.png", "not an image")
+	if _, err := e.transformImage(args(t, map[string]interface{}{"path": "notes.png", "width": 8})); err == nil {
+		t.Error("a file that isn't an image was decoded")
+	}
+	if _, err := e.transformImage(args(t, map[string]interface{}{"path": "logo.png", "output": "../logo.gif"})); err == nil {
+		t.Error("an image was written outside the workspace")
+	}
+}
+
+func TestGenerateImage(t *testing.T) {
+	var request map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer key" {
+			http.Error(w, `{"error": {"message": "no key"}}`, http.StatusUnauthorized)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": []map[string]string{{"b64_json": base64.StdEncoding.EncodeToString(testPNG(t, 40, 20))}},
+		})
+	}))
+	defer srv.Close()
+
+	e := newToolEngine(t)
+	if _, err := e.generateImage(args(t, map[string]interface{}{"prompt": "a cat", "path": "cat.png"})); err == nil {
+		t.Error("an image was generated with no endpoint")
+	}
+	e.imageAPI = ImageAPIConfig{URL: srv.URL, Key: "key", Model: "painter"}
+	result, err := e.generateImage(args(t, map[string]interface{}{"prompt": "a cat", "path": "cat.gif", "width": 10, "height": 10}))
+	if err != nil || !strings.Contains(result, "Wrote cat.gif (gif, 10x10") {
+		t.Fatalf("generate: %q, %v", result, err)
+	}
+	if request["prompt"] != "a cat" || request["model"] != "painter" {
+		t.Errorf("request was %v", request)
+	}
+	if img, format := decodeTestImage(t, e, "cat.gif"); format != "gif" || img.Bounds().Dx() != 10 {
+		t.Errorf("output is %s, %v", format, img.Bounds())
+	}
+
+	e.imageAPI.Key = ""
+	if _, err := e.generateImage(args(t, map[string]interface{}{"prompt": "a cat", "path": "dog.png"})); err == nil || !strings.Contains(err.Error(), "no key") {
+		t.Errorf("error from the endpoint: %v", err)
+	}
+}
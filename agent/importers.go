@@ -0,0 +1,331 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Conversations from other tools can be resumed with --resume. A wex
+// session is taken as it is. Other formats are converted to plain user and
+// assistant messages: their tools are not wex's, so a tool call becomes a
+// note of what was called and its result a user message, which keeps the
+// context without inviting the model to call tools that don't exist.
+// System prompts are dropped, since wex has its own.
+
+// loadConversation reads a conversation to resume, returning its messages
+// and the format it was in. Other tools' conversations are plain whatever
+// the key, but a wex session must be encrypted if there is one, as
+// loadSession requires.
+func loadConversation(path string, key []byte) ([]Message, string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read conversation: %v", err)
+	}
+	sealed := isSealed(data)
+	if data, err = openSession(data, key); err != nil {
+		return nil, "", err
+	}
+	messages, format, err := parseConversation(data)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %v", path, err)
+	}
+	if format == "wex" && key != nil && !sealed {
+		return nil, "", fmt.Errorf("%s: %v", path, errNotSealed)
+	}
+	if len(messages) == 0 {
+		return nil, "", fmt.Errorf("%s: no messages to resume", path)
+	}
+	return messages, format, nil
+}
+
+// parseConversation recognizes a wex session, OpenAI chat messages, a
+// ChatGPT export, Anthropic messages or an Aider chat history
+func parseConversation(data []byte) ([]Message, string, error) {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 || (trimmed[0] != '{' && trimmed[0] != '[') {
+		if bytes.Contains(data, []byte("\n#### ")) || bytes.HasPrefix(data, []byte("#### ")) {
+			return parseAiderHistory(string(data)), "aider", nil
+		}
+		return nil, "", fmt.Errorf("not a JSON conversation or an Aider chat history")
+	}
+
+	var doc struct {
+		Adapter     string                 `json:"adapter"`
+		Turns       json.RawMessage        `json:"turns"`
+		Messages    []foreignMessage       `json:"messages"`
+		Mapping     map[string]chatGPTNode `json:"mapping"`
+		CurrentNode string                 `json:"current_node"`
+	}
+	if trimmed[0] == '[' {
+		var list []json.RawMessage
+		if err := json.Unmarshal(trimmed, &list); err != nil {
+			return nil, "", fmt.Errorf("invalid JSON: %v", err)
+		}
+		// A ChatGPT export holds every conversation; take the last
+		if len(list) > 0 && bytes.Contains(list[len(list)-1], []byte(`"mapping"`)) {
+			trimmed = list[len(list)-1]
+		} else if err := json.Unmarshal(trimmed, &doc.Messages); err != nil {
+			return nil, "", fmt.Errorf("invalid messages: %v", err)
+		}
+	}
+	if trimmed[0] == '{' {
+		if err := json.Unmarshal(trimmed, &doc); err != nil {
+			return nil, "", fmt.Errorf("invalid conversation: %v", err)
+		}
+	}
+
+	switch {
+	case doc.Adapter != "" && doc.Turns != nil:
+		var session Session
+		if err := json.Unmarshal(trimmed, &session); err != nil {
+			return nil, "", fmt.Errorf("invalid session: %v", err)
+		}
+		var messages []Message
+		for _, message := range session.Messages {
+			if message.Role != "system" {
+				messages = append(messages, message)
+			}
+		}
+		return messages, "wex", nil
+	case doc.Mapping != nil:
+		return chatGPTMessages(doc.Mapping, doc.CurrentNode), "chatgpt", nil
+	case doc.Messages != nil:
+		return convertMessages(doc.Messages)
+	}
+	return nil, "", fmt.Errorf("no messages found")
+}
+
+// foreignMessage is a message in either the OpenAI or the Anthropic
+// format; content is a string or a list of parts or blocks
+type foreignMessage struct {
+	Role       string          `json:"role"`
+	Name       string          `json:"name"`
+	Content    json.RawMessage `json:"content"`
+	ToolCallID string          `json:"tool_call_id"`
+	ToolCalls  []struct {
+		ID       string `json:"id"`
+		Function struct {
+			Name      string          `json:"name"`
+			Arguments json.RawMessage `json:"arguments"`
+		} `json:"function"`
+	} `json:"tool_calls"`
+	FunctionCall *struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	} `json:"function_call"`
+}
+
+// contentBlock is an Anthropic content block or an OpenAI content part
+type contentBlock struct {
+	Type      string          `json:"type"`
+	ID        string          `json:"id"`
+	Text      string          `json:"text"`
+	Name      string          `json:"name"`
+	Input     json.RawMessage `json:"input"`
+	ToolUseID string          `json:"tool_use_id"`
+	Content   json.RawMessage `json:"content"`
+	IsError   bool            `json:"is_error"`
+}
+
+// convertMessages converts OpenAI or Anthropic messages, telling them
+// apart by whether tools are used through content blocks
+func convertMessages(foreign []foreignMessage) ([]Message, string, error) {
+	format := "openai"
+	tools := make(map[string]string)
+	var messages []Message
+	add := func(role, content string) {
+		content = strings.TrimSpace(content)
+		if content == "" {
+			return
+		}
+		// Merge a tool result into the user message it came with
+		if n := len(messages); n > 0 && messages[n-1].Role == role {
+			messages[n-1].Content += "\n\n" + content
+			return
+		}
+		messages = append(messages, Message{Role: role, Content: content})
+	}
+
+	for i, m := range foreign {
+		var text string
+		var blocks []contentBlock
+		if len(m.Content) > 0 && m.Content[0] == '[' {
+			if err := json.Unmarshal(m.Content, &blocks); err != nil {
+				return nil, "", fmt.Errorf("message %d: invalid content: %v", i+1, err)
+			}
+		} else if len(m.Content) > 0 && string(m.Content) != "null" {
+			if err := json.Unmarshal(m.Content, &text); err != nil {
+				return nil, "", fmt.Errorf("message %d: invalid content: %v", i+1, err)
+			}
+		}
+
+		var parts []string
+		if text != "" {
+			parts = append(parts, text)
+		}
+		for _, block := range blocks {
+			switch block.Type {
+			case "text", "input_text", "output_text":
+				parts = append(parts, block.Text)
+			case "tool_use":
+				format = "anthropic"
+				tools[block.ID] = block.Name
+				parts = append(parts, toolCallNote(block.Name, block.Input))
+			case "tool_result":
+				format = "anthropic"
+				parts = append(parts, toolResultNote(tools[block.ToolUseID], blockText(block.Content), block.IsError))
+			case "image", "image_url", "input_image":
+				parts = append(parts, "[image]")
+			}
+		}
+		for _, call := range m.ToolCalls {
+			tools[call.ID] = call.Function.Name
+			parts = append(parts, toolCallNote(call.Function.Name, call.Function.Arguments))
+		}
+		if m.FunctionCall != nil {
+			parts = append(parts, toolCallNote(m.FunctionCall.Name, m.FunctionCall.Arguments))
+		}
+		content := strings.Join(parts, "\n\n")
+
+		switch m.Role {
+		case "user", "human":
+			add("user", content)
+		case "assistant", "ai", "model":
+			add("assistant", content)
+		case "tool":
+			add("user", toolResultNote(tools[m.ToolCallID], content, false))
+		case "function":
+			add("user", toolResultNote(m.Name, content, false))
+		case "system", "developer":
+		default:
+			return nil, "", fmt.Errorf("message %d: unknown role %q", i+1, m.Role)
+		}
+	}
+	return messages, format, nil
+}
+
+// blockText flattens a tool result's content, a string or text blocks
+func blockText(raw json.RawMessage) string {
+	var text string
+	if json.Unmarshal(raw, &text) == nil {
+		return text
+	}
+	var blocks []contentBlock
+	json.Unmarshal(raw, &blocks)
+	var parts []string
+	for _, block := range blocks {
+		if block.Type == "text" {
+			parts = append(parts, block.Text)
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+func toolCallNote(name string, arguments json.RawMessage) string {
+	// OpenAI sends arguments as a JSON string
+	var encoded string
+	if json.Unmarshal(arguments, &encoded) == nil {
+		arguments = json.RawMessage(encoded)
+	}
+	return fmt.Sprintf("[Called %s with %s]", name, strings.TrimSpace(string(arguments)))
+}
+
+func toolResultNote(name, result string, failed bool) string {
+	label := "Tool result"
+	if name != "" {
+		label = "Result of " + name
+	}
+	if failed {
+		label += " (error)"
+	}
+	return fmt.Sprintf("[%s]\n%s", label, result)
+}
+
+// chatGPTNode is a message in a ChatGPT export, which stores a
+// conversation as a tree of edits and regenerations
+type chatGPTNode struct {
+	Parent  string `json:"parent"`
+	Message *struct {
+		Author struct {
+			Role string `json:"role"`
+		} `json:"author"`
+		Content struct {
+			Parts []json.RawMessage `json:"parts"`
+		} `json:"content"`
+	} `json:"message"`
+}
+
+// chatGPTMessages follows the branch that ends at the current node, which
+// is the conversation as it was last shown
+func chatGPTMessages(mapping map[string]chatGPTNode, current string) []Message {
+	var messages []Message
+	seen := make(map[string]bool)
+	for id := current; id != "" && !seen[id]; id = mapping[id].Parent {
+		seen[id] = true
+		node := mapping[id]
+		if node.Message == nil {
+			continue
+		}
+		role := node.Message.Author.Role
+		if role != "user" && role != "assistant" {
+			continue
+		}
+		var parts []string
+		for _, raw := range node.Message.Content.Parts {
+			var text string
+			if json.Unmarshal(raw, &text) == nil && strings.TrimSpace(text) != "" {
+				parts = append(parts, text)
+			}
+		}
+		if len(parts) > 0 {
+			messages = append(messages, Message{Role: role, Content: strings.Join(parts, "\n\n")})
+		}
+	}
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages
+}
+
+// parseAiderHistory reads .aider.chat.history.md, where user messages are
+// lines starting with ####, and lines quoted with > are Aider's own output.
+// The file holds every chat in the repository; only the last is resumed.
+func parseAiderHistory(text string) []Message {
+	if i := strings.LastIndex(text, "# aider chat started at"); i >= 0 {
+		text = text[i:]
+	}
+	var messages []Message
+	var b strings.Builder
+	role := ""
+	flush := func() {
+		if content := strings.TrimSpace(b.String()); content != "" {
+			messages = append(messages, Message{Role: role, Content: content})
+		}
+		b.Reset()
+	}
+	for _, line := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n") {
+		switch {
+		case strings.HasPrefix(line, "# aider chat started at"), strings.HasPrefix(line, ">"):
+			continue
+		case strings.HasPrefix(line, "####"):
+			if role != "user" {
+				flush()
+				role = "user"
+			}
+			b.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, "####"), " ") + "\n")
+		default:
+			if role == "user" && strings.TrimSpace(line) != "" {
+				flush()
+				role = "assistant"
+			}
+			if role != "" {
+				b.WriteString(line + "\n")
+			}
+		}
+	}
+	flush()
+	return messages
+}
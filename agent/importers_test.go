@@ -0,0 +1,116 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseConversation(t *testing.T) {
+	tests := []struct {
+		name, data, format string
+		want               []string
+	}{
+		{"openai", `{"model": "gpt-4o", "messages": [
+			{"role": "system", "content": "Be brief."},
+			{"role": "user", "content": "What is in main.go?"},
+			{"role": "assistant", "content": null, "tool_calls": [{"id": "c1", "type": "function", "function": {"name": "read", "arguments": "{\"path\":\"main.go\"}"}}]},
+			{"role": "tool", "tool_call_id": "c1", "content": "package main"},
+			{"role": "assistant", "content": [{"type": "text", "text": "Just a package clause."}]}]}`,
+			"openai", []string{
+				"user: What is in main.go?",
+				`assistant: [Called read with {"path":"main.go"}]`,
+				"user: [Result of read]\npackage main",
+				"assistant: Just a package clause."}},
+
+		{"anthropic", `{"system": "Be brief.", "messages": [
+			{"role": "user", "content": "Run the tests"},
+			{"role": "assistant", "content": [{"type": "text", "text": "Running them."}, {"type": "tool_use", "id": "t1", "name": "bash", "input": {"command": "go test"}}]},
+			{"role": "user", "content": [{"type": "tool_result", "tool_use_id": "t1", "is_error": true, "content": [{"type": "text", "text": "FAIL"}]}, {"type": "text", "text": "Fix it"}]}]}`,
+			"anthropic", []string{
+				"user: Run the tests",
+				"assistant: Running them.\n\n[Called bash with {\"command\": \"go test\"}]",
+				"user: [Result of bash (error)]\nFAIL\n\nFix it"}},
+
+		{"chatgpt", `[{"title": "Old"}, {"title": "Sorting", "current_node": "c", "mapping": {
+			"root": {"parent": "", "message": null},
+			"a": {"parent": "root", "message": {"author": {"role": "user"}, "content": {"parts": ["Sort a list in Go"]}}},
+			"b": {"parent": "a", "message": {"author": {"role": "assistant"}, "content": {"parts": ["Use slices.Sort"]}}},
+			"x": {"parent": "a", "message": {"author": {"role": "assistant"}, "content": {"parts": ["Regenerated away"]}}},
+			"c": {"parent": "b", "message": {"author": {"role": "user"}, "content": {"parts": ["Thanks"]}}}}}]`,
+			"chatgpt", []string{"user: Sort a list in Go", "assistant: Use slices.Sort", "user: Thanks"}},
+
+		{"aider", "\n# aider chat started at 2024-05-01 09:00:00\n\n#### old chat\n\nOld reply\n\n" +
+			"# aider chat started at 2024-05-02 10:00:00\n\n> /usr/bin/aider --model gpt-4o\n> Added calc.py to the chat.\n\n" +
+			"#### add a sub function\n#### with tests\n\nHere is the change:\n\ncalc.py\n```python\ndef sub(a, b):\n    return a - b\n```\n\n> Applied edit to calc.py\n\n#### thanks\n",
+			"aider", []string{
+				"user: add a sub function\nwith tests",
+				"assistant: Here is the change:\n\ncalc.py\n```python\ndef sub(a, b):\n    return a - b\n```",
+				"user: thanks"}},
+	}
+	for _, test := range tests {
+		messages, format, err := parseConversation([]byte(test.data))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		var got []string
+		for _, m := range messages {
+			got = append(got, m.Role+": "+m.Content)
+		}
+		if format != test.format || strings.Join(got, "\n---\n") != strings.Join(test.want, "\n---\n") {
+			t.Errorf("%s: got %s:\n%s\nwant %s:\n%s", test.name, format, strings.Join(got, "\n---\n"), test.format, strings.Join(test.want, "\n---\n"))
+		}
+	}
+
+	for _, data := range []string{"", "just some notes", `{"messages": [{"role": "narrator", "content": "Once"}]}`, `{"title": "x"}`} {
+		if _, _, err := parseConversation([]byte(data)); err == nil {
+			t.Errorf("parsed %q", data)
+		}
+	}
+}
+
+func TestResume(t *testing.T) {
+	dir := t.TempDir()
+	sessionPath := filepath.Join(dir, "session.json")
+	first, _, _ := newTestEngine(t, []ChatResponse{
+		reply("", call("list_files", `{"path": "."}`)),
+		reply("The workspace is empty."),
+	})
+	first.sessionPath = sessionPath
+	if _, err := first.Run(context.Background(), "What files are there?"); err != nil {
+		t.Fatal(err)
+	}
+
+	history, format, err := loadConversation(sessionPath, nil)
+	if err != nil || format != "wex" || len(history) != 4 {
+		t.Fatalf("loaded %d messages as %s, %v", len(history), format, err)
+	}
+	if history[1].ToolCalls[0].Function.Name != "list_files" {
+		t.Errorf("tool call not kept: %+v", history[1])
+	}
+
+	second, provider, _ := newTestEngine(t, []ChatResponse{reply("Still empty.")}, WithHistory(history))
+	if _, err := second.Run(context.Background(), "And now?"); err != nil {
+		t.Fatal(err)
+	}
+	messages := provider.lastMessages(t, 1)
+	var roles []string
+	for _, m := range messages {
+		roles = append(roles, m.Role)
+	}
+	if fmt.Sprint(roles) != "[system user assistant tool assistant user]" || messages[5].Content != "And now?" {
+		t.Errorf("resumed request has roles %v", roles)
+	}
+
+	if _, err := New(WithHistory([]Message{{Role: "system", Content: "x"}})); err == nil {
+		t.Error("history with a system message was accepted")
+	}
+	os.WriteFile(filepath.Join(dir, "empty.json"), []byte(`{"messages": []}`), 0644)
+	if _, _, err := loadConversation(filepath.Join(dir, "empty.json"), nil); err == nil {
+		t.Error("resumed an empty conversation")
+	}
+}
@@ -0,0 +1,234 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// A request that asks for something destructive is exactly the one the
+// check model will wave a destructive command through for, since the
+// command fits it. So when the request, or the model's plan, reads as
+// meaning to wipe data, force-push, delete branches or discard changes,
+// commands that do that are disabled for the session until the user types
+// a confirmation phrase. A misread request then costs a question rather
+// than the data.
+
+// destructiveIntent is a kind of destructive change, recognized in text
+// by its patterns and in commands by commandIntents
+type destructiveIntent struct {
+	name        string
+	description string
+	patterns    []*regexp.Regexp
+}
+
+var destructiveIntents = []destructiveIntent{
+	{"wipe-data", "delete or wipe data", compilePatterns(
+		`\b(wipe|erase|purge|nuke|obliterate)\b`,
+		`\b(delete|remove)\s+everything\b`,
+		`\b(delete|remove)\s+(all|every|the\s+(whole|entire))\s+(\S+\s+){0,2}(data|files|records|rows|entries|users|accounts|logs|backups|uploads|databases?|tables?|directory|directories|folders?|contents)\b`,
+		`\b(drop|truncate)\s+(the\s+|all\s+)?(\w+\s+)?(tables?|databases?|schemas?|collections?)\b`,
+		`\brm\s+-\w*r`,
+		`\breset\s+the\s+(database|db)\b`,
+	)},
+	{"force-push", "force-push, overwriting remote history", compilePatterns(
+		`\bforce[- ]?push`,
+		`\bpush\b[^.\n]*\s(--force|-f)\b`,
+		`\brewrit(e|ing)\s+(the\s+)?(git\s+|commit\s+)?history\b`,
+	)},
+	{"delete-branch", "delete branches or tags", compilePatterns(
+		`\b(delete|remove|prune)\s+(\S+\s+){0,4}(branch|branches|tags?)\b`,
+		`\b(branch|tag)\s+(-d|-D|--delete)\b`,
+	)},
+	{"discard-changes", "discard uncommitted changes", compilePatterns(
+		`\breset\s+--hard\b`,
+		`\bhard\s+reset\b`,
+		`\b(discard|throw\s+away|drop)\s+(\S+\s+){0,3}changes\b`,
+		`\bgit\s+clean\b`,
+	)},
+}
+
+func compilePatterns(patterns ...string) []*regexp.Regexp {
+	var compiled []*regexp.Regexp
+	for _, pattern := range patterns {
+		compiled = append(compiled, regexp.MustCompile(`(?i)`+pattern))
+	}
+	return compiled
+}
+
+// detectIntents returns the names of the destructive intents text reads as
+// having
+func detectIntents(text string) []string {
+	var names []string
+	for _, intent := range destructiveIntents {
+		for _, pattern := range intent.patterns {
+			if pattern.MatchString(text) {
+				names = append(names, intent.name)
+				break
+			}
+		}
+	}
+	return names
+}
+
+// sqlClients take statements as arguments, which may drop or delete data
+var sqlClients = map[string]bool{
+	"psql": true, "mysql": true, "sqlite3": true, "mongo": true, "mongosh": true, "redis-cli": true,
+}
+
+var destructiveSQL = regexp.MustCompile(`(?i)\b(drop\s+(table|database|schema|collection)|truncate|delete\s+from|flushall|flushdb|dropDatabase)\b`)
+
+// commandIntents returns the destructive intents a command line carries out
+func commandIntents(line string) []string {
+	commands, err := parseShell(line)
+	if err != nil {
+		return nil
+	}
+	found := make(map[string]bool)
+	for _, command := range commands {
+		words, _ := programWords(command.words)
+		if len(words) == 0 {
+			continue
+		}
+		name := filepath.Base(words[0])
+		switch {
+		case sqlClients[name]:
+			if destructiveSQL.MatchString(strings.Join(words[1:], " ")) {
+				found["wipe-data"] = true
+			}
+		case name == "sh" || name == "bash" || name == "zsh" || name == "dash":
+			for i, arg := range words {
+				if arg == "-c" && i+1 < len(words) {
+					for _, intent := range commandIntents(words[i+1]) {
+						found[intent] = true
+					}
+				}
+			}
+		case classifySimpleCommand(command) != classDestructive:
+		case name == "rm" || name == "rmdir" || name == "shred" || name == "dd" || name == "truncate" || strings.HasPrefix(name, "mkfs"):
+			found["wipe-data"] = true
+		case name == "git":
+			if intent := gitIntent(words[1:]); intent != "" {
+				found[intent] = true
+			}
+		}
+	}
+	var names []string
+	for name := range found {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// gitIntent names the intent of a git command already classified as
+// destructive
+func gitIntent(args []string) string {
+	sub, rest := gitSubcommand(args)
+	switch sub {
+	case "push":
+		for _, arg := range rest {
+			if arg == "--delete" || arg == "-d" {
+				return "delete-branch"
+			}
+		}
+		return "force-push"
+	case "branch", "tag":
+		return "delete-branch"
+	case "reset", "clean", "checkout", "restore", "stash":
+		return "discard-changes"
+	}
+	return ""
+}
+
+func findIntent(name string) *destructiveIntent {
+	for i := range destructiveIntents {
+		if destructiveIntents[i].name == name {
+			return &destructiveIntents[i]
+		}
+	}
+	return nil
+}
+
+// parseIntentList reads --confirm, a comma-separated list of intents
+func parseIntentList(list string) (map[string]bool, error) {
+	confirmed := make(map[string]bool)
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if findIntent(name) == nil {
+			var names []string
+			for _, intent := range destructiveIntents {
+				names = append(names, intent.name)
+			}
+			return nil, fmt.Errorf("unknown intent %q: must be one of %s", name, strings.Join(names, ", "))
+		}
+		confirmed[name] = true
+	}
+	return confirmed, nil
+}
+
+// noteIntents looks for destructive intents in the request or the model's
+// plan, and asks the user to confirm each one the first time it is seen
+func (e *Engine) noteIntents(text, source string) {
+	for _, name := range detectIntents(text) {
+		if _, seen := e.intents[name]; seen {
+			continue
+		}
+		if e.intents == nil {
+			e.intents = make(map[string]bool)
+		}
+		if e.confirmedIntents[name] {
+			e.intents[name] = true
+			continue
+		}
+		e.intents[name] = e.confirmIntent(findIntent(name), source)
+		e.debugf("Destructive intent %s in the %s, confirmed: %v", name, source, e.intents[name])
+	}
+}
+
+// confirmIntent asks the user to type the confirmation phrase; an approver
+// answers for them
+func (e *Engine) confirmIntent(intent *destructiveIntent, source string) bool {
+	phrase := "confirm " + intent.name
+	action := fmt.Sprintf("The %s looks like it means to %s. Commands that do are disabled for this session unless you confirm it.", source, intent.description)
+	if e.approver != nil {
+		return e.approver(action)
+	}
+	if !isTerminal(os.Stdin) {
+		e.logf("%s\nThere is no terminal to confirm on; give --confirm %s to allow it", action, intent.name)
+		return false
+	}
+	e.notify("needs_approval", action)
+	answer, err := readLine(fmt.Sprintf("%s\nType %q to allow it, or press Enter to keep it disabled: ", action, phrase))
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(strings.Join(strings.Fields(answer), " "), phrase)
+}
+
+// checkCommandIntent refuses a command that carries out a destructive
+// intent seen in the session but not confirmed
+func (e *Engine) checkCommandIntent(command string) error {
+	if intent := e.unconfirmedIntent(commandIntents(command)); intent != nil {
+		return fmt.Errorf("command refused: it would %s, which this session's request or plan asked for but the user did not confirm. Do not look for another way to do it; say what you would have run instead",
+			intent.description)
+	}
+	return nil
+}
+
+// unconfirmedIntent returns the first of the named intents that was seen in
+// the session but not confirmed
+func (e *Engine) unconfirmedIntent(names []string) *destructiveIntent {
+	for _, name := range names {
+		if confirmed, seen := e.intents[name]; seen && !confirmed {
+			return findIntent(name)
+		}
+	}
+	return nil
+}
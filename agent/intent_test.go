@@ -0,0 +1,92 @@
+package agent
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDetectIntents(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"Wipe the staging database and reseed it", "wipe-data"},
+		{"delete all the user records older than a year", "wipe-data"},
+		{"Drop the users table", "wipe-data"},
+		{"Squash the last three commits and force-push", "force-push"},
+		{"then git push origin main --force", "force-push"},
+		{"Delete the merged feature branches", "delete-branch"},
+		{"git reset --hard to origin and discard my local changes", "discard-changes"},
+		{"Clean up, then force push and delete the old branch", "force-push delete-branch"},
+
+		{"Remove all unused imports", ""},
+		{"Delete the old helper function in utils.go", ""},
+		{"Improve branch coverage of the parser tests", ""},
+		{"Add a --force flag to the push command", ""},
+		{"Reset the form state after submit", ""},
+	}
+	for _, test := range tests {
+		if got := strings.Join(detectIntents(test.text), " "); got != test.want {
+			t.Errorf("detectIntents(%q) = %q, want %q", test.text, got, test.want)
+		}
+	}
+}
+
+func TestCommandIntents(t *testing.T) {
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{"rm -rf data/", "wipe-data"},
+		{`psql -c "DROP TABLE users"`, "wipe-data"},
+		{"git push --force origin main", "force-push"},
+		{"git push origin --delete old-feature", "delete-branch"},
+		{"git branch -D old-feature && git reset --hard origin/main", "delete-branch discard-changes"},
+		{`sh -c "git clean -fdx"`, "discard-changes"},
+		{"git -C repo push --force", "force-push"},
+		{"git -c core.pager=cat reset --hard", "discard-changes"},
+		{"git push origin main", ""},
+		{"git branch new-feature", ""},
+		{`psql -c "SELECT * FROM users"`, ""},
+		{"ls -la", ""},
+	}
+	for _, test := range tests {
+		if got := strings.Join(commandIntents(test.command), " "); got != test.want {
+			t.Errorf("commandIntents(%q) = %q, want %q", test.command, got, test.want)
+		}
+	}
+}
+
+func TestCheckCommandIntent(t *testing.T) {
+	e := newToolEngine(t)
+	var asked []string
+	e.approver = func(action string) bool {
+		asked = append(asked, action)
+		return strings.Contains(action, "branches")
+	}
+	e.noteIntents("Force-push the rebased branch, then delete the old branches", "request")
+	e.noteIntents("I will force-push now", "plan")
+	if len(asked) != 2 {
+		t.Errorf("asked %d times: %q", len(asked), asked)
+	}
+	if err := e.checkCommandIntent("git push -f origin main"); err == nil || !strings.Contains(err.Error(), "did not confirm") {
+		t.Errorf("unconfirmed force-push gave %v", err)
+	}
+	if err := e.checkCommandIntent("git branch -D old"); err != nil {
+		t.Errorf("confirmed branch deletion gave %v", err)
+	}
+	// Intents not in the request or plan are left to the command policy
+	if err := e.checkCommandIntent("rm -rf build"); err != nil {
+		t.Errorf("rm gave %v", err)
+	}
+
+	e.intents = nil
+	e.confirmedIntents, _ = parseIntentList("force-push")
+	e.noteIntents("force push it", "request")
+	if err := e.checkCommandIntent("git push --force"); err != nil || len(asked) != 2 {
+		t.Errorf("force-push confirmed with --confirm gave %v, asked %d times", err, len(asked))
+	}
+	if _, err := parseIntentList("force-push, nuke"); err == nil || !strings.Contains(err.Error(), "wipe-data") {
+		t.Errorf("unknown intent gave %v", err)
+	}
+}
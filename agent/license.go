@@ -0,0 +1,481 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A license policy has two parts. New source files get the license
+// header, in the comment syntax of their language. And after each tool
+// call, the manifests are compared with how they were; a dependency that
+// has appeared is looked up, and if its license isn't on the allowed
+// list, or can't be found, the manifests are put back and the tool call
+// fails, so the session can't add it, whether by editing a manifest or
+// with a package manager.
+
+// licensePolicy is the configured header and allowed licenses
+type licensePolicy struct {
+	// header is the header text without comment markers; {year} stands for
+	// the current year
+	header string
+
+	// allowed are SPDX license identifiers, such as MIT or Apache-2.0
+	allowed []string
+
+	// known are the dependencies in the manifests at the start of the
+	// session, or allowed since, by ecosystem and name
+	known map[string]bool
+
+	// manifests are the manifests' contents as of the last check that
+	// passed; nil for a file that didn't exist
+	manifests map[string][]byte
+}
+
+// dependencyManifests are the files that list dependencies, with the lock
+// files that go with them, which are put back together
+var dependencyManifests = []string{"package.json", "package-lock.json", "go.mod", "go.sum", "requirements.txt"}
+
+// dependency is a package a manifest lists
+type dependency struct {
+	ecosystem string // "npm", "go" or "pip"
+	name      string
+	version   string
+}
+
+func (d dependency) key() string {
+	return d.ecosystem + " " + d.name
+}
+
+// commentStyles gives each language's line comment, or for CSS the
+// opening and closing of a block comment
+var commentStyles = map[string][2]string{
+	".go": {"// "}, ".js": {"// "}, ".mjs": {"// "}, ".cjs": {"// "}, ".ts": {"// "}, ".jsx": {"// "}, ".tsx": {"// "},
+	".java": {"// "}, ".kt": {"// "}, ".scala": {"// "}, ".c": {"// "}, ".h": {"// "}, ".cc": {"// "}, ".cpp": {"// "},
+	".hpp": {"// "}, ".cs": {"// "}, ".rs": {"// "}, ".swift": {"// "}, ".dart": {"// "},
+	".py": {"# "}, ".rb": {"# "}, ".sh": {"# "}, ".bash": {"# "}, ".pl": {"# "}, ".r": {"# "},
+	".sql": {"-- "}, ".lua": {"-- "}, ".hs": {"-- "},
+	".css": {"/*", " */"}, ".scss": {"/*", " */"},
+}
+
+// headerText is the header for this year
+func (p *licensePolicy) headerText() string {
+	return strings.TrimSpace(strings.ReplaceAll(p.header, "{year}", strconv.Itoa(time.Now().Year())))
+}
+
+// commentedHeader is the header as a comment for the file, or "" if the
+// file isn't source code in a language with a known comment syntax
+func (p *licensePolicy) commentedHeader(path string) string {
+	style, ok := commentStyles[strings.ToLower(filepath.Ext(path))]
+	if !ok || strings.TrimSpace(p.header) == "" {
+		return ""
+	}
+	var b strings.Builder
+	lines := strings.Split(p.headerText(), "\n")
+	if style[1] != "" {
+		b.WriteString(style[0] + "\n")
+		for _, line := range lines {
+			b.WriteString(strings.TrimRight(" * "+line, " ") + "\n")
+		}
+		b.WriteString(style[1] + "\n")
+		return b.String()
+	}
+	for _, line := range lines {
+		b.WriteString(strings.TrimRight(style[0]+line, " ") + "\n")
+	}
+	return b.String()
+}
+
+// hasHeader reports whether the header's first line is near the top of
+// the content, with any year
+func (p *licensePolicy) hasHeader(content string) bool {
+	first, _, _ := strings.Cut(strings.TrimSpace(p.header), "\n")
+	pattern := strings.ReplaceAll(regexp.QuoteMeta(strings.TrimSpace(first)), regexp.QuoteMeta("{year}"), `\d{4}(\s*-\s*\d{4})?`)
+	re := regexp.MustCompile(pattern)
+	lines := strings.SplitN(content, "\n", 21)
+	if len(lines) > 20 {
+		lines = lines[:20]
+	}
+	return re.MatchString(strings.Join(lines, "\n"))
+}
+
+// addHeader puts the header at the top of source code that lacks it,
+// after any #! line
+func (p *licensePolicy) addHeader(path, content string) string {
+	header := p.commentedHeader(path)
+	if header == "" || p.hasHeader(content) {
+		return content
+	}
+	if strings.HasPrefix(content, "#!") {
+		shebang, rest, _ := strings.Cut(content, "\n")
+		return shebang + "\n" + header + "\n" + rest
+	}
+	return header + "\n" + content
+}
+
+// licenseAllowed reports whether an SPDX expression is allowed: one of
+// the alternatives joined by OR must be, with all the parts joined by AND
+func (p *licensePolicy) licenseAllowed(expression string) bool {
+	expression = strings.NewReplacer("(", " ", ")", " ").Replace(expression)
+	for _, alternative := range regexp.MustCompile(`(?i)\s+or\s+`).Split(expression, -1) {
+		ok := true
+		for _, part := range regexp.MustCompile(`(?i)\s+and\s+`).Split(alternative, -1) {
+			part = strings.TrimSpace(part)
+			allowed := false
+			for _, a := range p.allowed {
+				if strings.EqualFold(a, part) {
+					allowed = true
+				}
+			}
+			ok = ok && allowed && part != ""
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// licenseTexts recognize the common licenses from their text
+var licenseTexts = []struct {
+	id      string
+	pattern *regexp.Regexp
+}{
+	{"AGPL-3.0", regexp.MustCompile(`(?i)GNU AFFERO GENERAL PUBLIC LICENSE`)},
+	{"LGPL-2.1", regexp.MustCompile(`(?i)GNU LESSER GENERAL PUBLIC LICENSE\s+Version 2\.1`)},
+	{"LGPL-3.0", regexp.MustCompile(`(?i)GNU LESSER GENERAL PUBLIC LICENSE`)},
+	{"GPL-2.0", regexp.MustCompile(`(?i)GNU GENERAL PUBLIC LICENSE\s+Version 2`)},
+	{"GPL-3.0", regexp.MustCompile(`(?i)GNU GENERAL PUBLIC LICENSE`)},
+	{"MPL-2.0", regexp.MustCompile(`(?i)Mozilla Public License,? (Version|v\.) 2\.0`)},
+	{"Apache-2.0", regexp.MustCompile(`(?i)Apache License,?\s+Version 2\.0`)},
+	{"BSD-3-Clause", regexp.MustCompile(`(?is)Redistribution and use in source and binary forms.*Neither the name`)},
+	{"BSD-2-Clause", regexp.MustCompile(`(?i)Redistribution and use in source and binary forms`)},
+	{"ISC", regexp.MustCompile(`(?i)ISC License|Permission to use, copy, modify, and(/or)? distribute this software for any`)},
+	{"MIT", regexp.MustCompile(`(?i)MIT License|Permission is hereby granted, free of charge`)},
+	{"Unlicense", regexp.MustCompile(`(?i)free and unencumbered software released into the public domain`)},
+}
+
+// detectLicense names the license in a license file, or "" if it isn't
+// one of the common ones
+func detectLicense(text string) string {
+	for _, l := range licenseTexts {
+		if l.pattern.MatchString(text) {
+			return l.id
+		}
+	}
+	return ""
+}
+
+// dependencies lists what the manifests in the workspace depend on
+func (e *Engine) dependencies() []dependency {
+	var deps []dependency
+	var pkg struct {
+		Dependencies         map[string]string `json:"dependencies"`
+		DevDependencies      map[string]string `json:"devDependencies"`
+		OptionalDependencies map[string]string `json:"optionalDependencies"`
+	}
+	if json.Unmarshal([]byte(e.readWorkspaceFile("package.json")), &pkg) == nil {
+		for _, m := range []map[string]string{pkg.Dependencies, pkg.DevDependencies, pkg.OptionalDependencies} {
+			for name, version := range m {
+				deps = append(deps, dependency{"npm", name, version})
+			}
+		}
+	}
+
+	inRequire := false
+	for _, line := range strings.Split(e.readWorkspaceFile("go.mod"), "\n") {
+		line, _, _ = strings.Cut(line, "//")
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 2 && fields[0] == "require" && fields[1] == "(":
+			inRequire = true
+		case inRequire && len(fields) == 1 && fields[0] == ")":
+			inRequire = false
+		case inRequire && len(fields) == 2:
+			deps = append(deps, dependency{"go", fields[0], fields[1]})
+		case len(fields) == 3 && fields[0] == "require":
+			deps = append(deps, dependency{"go", fields[1], fields[2]})
+		}
+	}
+
+	for _, line := range strings.Split(e.readWorkspaceFile("requirements.txt"), "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "-") {
+			continue
+		}
+		name := regexp.MustCompile(`^[A-Za-z0-9._-]+`).FindString(line)
+		if name != "" {
+			deps = append(deps, dependency{"pip", strings.ToLower(name), strings.TrimSpace(line[len(name):])})
+		}
+	}
+
+	sort.Slice(deps, func(i, j int) bool { return deps[i].key() < deps[j].key() })
+	return deps
+}
+
+// dependencyLicense finds a dependency's license, from where it is
+// installed, or failing that and unless offline, from its registry. It
+// returns "" if there is none to be found.
+func (e *Engine) dependencyLicense(d dependency) string {
+	switch d.ecosystem {
+	case "npm":
+		var pkg struct {
+			License  json.RawMessage `json:"license"`
+			Licenses []struct {
+				Type string `json:"type"`
+			} `json:"licenses"`
+		}
+		data := e.readWorkspaceFile(filepath.Join("node_modules", filepath.FromSlash(d.name), "package.json"))
+		if json.Unmarshal([]byte(data), &pkg) == nil {
+			var license string
+			var object struct {
+				Type string `json:"type"`
+			}
+			if json.Unmarshal(pkg.License, &license) == nil && license != "" {
+				return license
+			}
+			if json.Unmarshal(pkg.License, &object) == nil && object.Type != "" {
+				return object.Type
+			}
+			if len(pkg.Licenses) > 0 {
+				return pkg.Licenses[0].Type
+			}
+		}
+		if !e.offline {
+			if output, err := outputIn(e.workspace, "npm", "view", d.name, "license"); err == nil {
+				return strings.Trim(strings.TrimSpace(string(output)), `"'`)
+			}
+		}
+	case "go":
+		args := []string{"list", "-m", "-json", d.name}
+		if !e.offline {
+			args = []string{"mod", "download", "-json", d.name + "@" + d.version}
+		}
+		output, _ := outputIn(e.workspace, "go", args...)
+		var module struct{ Dir string }
+		if json.Unmarshal(output, &module) != nil || module.Dir == "" {
+			return ""
+		}
+		entries, _ := os.ReadDir(module.Dir)
+		for _, entry := range entries {
+			name := strings.ToUpper(entry.Name())
+			if strings.HasPrefix(name, "LICENSE") || strings.HasPrefix(name, "LICENCE") || strings.HasPrefix(name, "COPYING") {
+				if data, err := os.ReadFile(filepath.Join(module.Dir, entry.Name())); err == nil {
+					if id := detectLicense(string(data)); id != "" {
+						return id
+					}
+				}
+			}
+		}
+	case "pip":
+		output, err := outputIn(e.workspace, "python3", "-m", "pip", "show", "--verbose", d.name)
+		if err != nil {
+			return ""
+		}
+		var license string
+		var classifiers []string
+		for _, line := range strings.Split(string(output), "\n") {
+			line = strings.TrimSpace(line)
+			if value, ok := strings.CutPrefix(line, "License:"); ok {
+				license = strings.TrimSpace(value)
+			} else if value, ok := strings.CutPrefix(line, "License-Expression:"); ok && strings.TrimSpace(value) != "" {
+				return strings.TrimSpace(value)
+			} else if value, ok := strings.CutPrefix(line, "License :: OSI Approved :: "); ok {
+				classifiers = append(classifiers, value)
+			}
+		}
+		// The License field is free text, so a short identifier is taken
+		// as it is, and anything else recognized as license text
+		if license != "" && license != "UNKNOWN" && !strings.Contains(license, " ") {
+			return license
+		}
+		for _, text := range append([]string{license}, classifiers...) {
+			if id := detectLicense(text); id != "" {
+				return id
+			}
+		}
+	}
+	return ""
+}
+
+// startLicenseCheck notes the dependencies there are at the start of a
+// session, which are not checked
+func (e *Engine) startLicenseCheck() {
+	p := e.licenses
+	if p == nil || len(p.allowed) == 0 {
+		return
+	}
+	p.known = make(map[string]bool)
+	for _, d := range e.dependencies() {
+		p.known[d.key()] = true
+	}
+	p.saveManifests(e)
+}
+
+func (p *licensePolicy) saveManifests(e *Engine) {
+	p.manifests = make(map[string][]byte)
+	for _, name := range dependencyManifests {
+		data, err := e.files().ReadFile(filepath.Join(e.workspace, name))
+		if err == nil {
+			p.manifests[name] = data
+		}
+	}
+}
+
+// checkNewDependencies looks up the license of each dependency added since
+// the last check, and if any is not allowed, puts the manifests back as
+// they were then and says why
+func (e *Engine) checkNewDependencies() error {
+	p := e.licenses
+	if p == nil || p.known == nil {
+		return nil
+	}
+	var problems []string
+	var added []dependency
+	for _, d := range e.dependencies() {
+		if p.known[d.key()] {
+			continue
+		}
+		license := e.dependencyLicense(d)
+		switch {
+		case license == "":
+			problems = append(problems, fmt.Sprintf("%s (%s) has no license that could be found", d.name, d.ecosystem))
+		case !p.licenseAllowed(license):
+			problems = append(problems, fmt.Sprintf("%s (%s) is licensed under %s", d.name, d.ecosystem, license))
+		default:
+			added = append(added, d)
+		}
+	}
+	if len(problems) == 0 {
+		for _, d := range added {
+			e.logf("Allowed new dependency %s, licensed under an allowed license", d.name)
+			p.known[d.key()] = true
+		}
+		p.saveManifests(e)
+		return nil
+	}
+
+	var failed []string
+	for _, name := range dependencyManifests {
+		path := filepath.Join(e.workspace, name)
+		var err error
+		if data, ok := p.manifests[name]; ok {
+			err = e.files().WriteFile(path, data, 0644)
+		} else if err = e.files().Remove(path); errors.Is(err, fs.ErrNotExist) {
+			err = nil
+		}
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+	e.invalidateCommandCache()
+	if len(failed) > 0 {
+		return fmt.Errorf("dependency not allowed: %s. Only dependencies licensed under %s may be added, but putting the dependency manifests back as they were failed (%s), so remove the dependency yourself, then find an alternative with an allowed license, or do without",
+			strings.Join(problems, "; "), strings.Join(p.allowed, ", "), strings.Join(failed, "; "))
+	}
+	return fmt.Errorf("dependency not allowed: %s. Only dependencies licensed under %s may be added, so the dependency manifests have been put back as they were; find an alternative with an allowed license, or do without",
+		strings.Join(problems, "; "), strings.Join(p.allowed, ", "))
+}
+
+// runLicenseCheck handles "wex license-check", which lists the source
+// files without the license header and the dependencies whose licenses
+// are not allowed, and with --fix, adds the missing headers
+func runLicenseCheck(engine *Engine, args []string, w io.Writer) error {
+	checkFlags := flag.NewFlagSet("license-check", flag.ExitOnError)
+	fix := checkFlags.Bool("fix", false, "Add the license header to the files without it")
+	checkFlags.Usage = func() {
+		fmt.Fprintf(checkFlags.Output(), "Usage: wex [flags] license-check [--fix]\n")
+		checkFlags.PrintDefaults()
+	}
+	checkFlags.Parse(args)
+	p := engine.licenses
+	if p == nil {
+		return fmt.Errorf("no license policy; set LICENSE_HEADER or ALLOWED_LICENSES")
+	}
+
+	problems := 0
+	if strings.TrimSpace(p.header) != "" {
+		var missing []string
+		err := walkDir(engine.files(), engine.workspace, func(fullPath string, d fs.DirEntry, err error) error {
+			if err != nil || fullPath == engine.workspace {
+				return nil
+			}
+			if d.IsDir() {
+				if skippedDirs[d.Name()] || strings.HasPrefix(d.Name(), ".") {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !d.Type().IsRegular() || p.commentedHeader(fullPath) == "" {
+				return nil
+			}
+			data, err := engine.files().ReadFile(fullPath)
+			if err != nil || p.hasHeader(string(data)) {
+				return nil
+			}
+			rel, _ := filepath.Rel(engine.workspace, fullPath)
+			missing = append(missing, filepath.ToSlash(rel))
+			if *fix {
+				info, _ := d.Info()
+				if err := engine.files().WriteFile(fullPath, []byte(p.addHeader(fullPath, string(data))), info.Mode().Perm()); err != nil {
+					return fmt.Errorf("failed to write %s: %v", rel, err)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		sort.Strings(missing)
+		switch {
+		case len(missing) == 0:
+			fmt.Fprintf(w, "Every source file has the license header\n")
+		case *fix:
+			fmt.Fprintf(w, "Added the license header to %s:\n", plural(len(missing), "file"))
+		default:
+			fmt.Fprintf(w, "%s without the license header:\n", plural(len(missing), "file"))
+			problems += len(missing)
+		}
+		for _, path := range missing {
+			fmt.Fprintf(w, "  %s\n", path)
+		}
+	}
+
+	if len(p.allowed) > 0 {
+		var disallowed []string
+		deps := engine.dependencies()
+		for _, d := range deps {
+			license := engine.dependencyLicense(d)
+			if license == "" {
+				disallowed = append(disallowed, fmt.Sprintf("%s (%s): no license found", d.name, d.ecosystem))
+			} else if !p.licenseAllowed(license) {
+				disallowed = append(disallowed, fmt.Sprintf("%s (%s): %s", d.name, d.ecosystem, license))
+			}
+		}
+		if len(disallowed) == 0 {
+			fmt.Fprintf(w, "Every dependency has an allowed license\n")
+		} else {
+			fmt.Fprintf(w, "Dependencies without an allowed license:\n")
+			for _, line := range disallowed {
+				fmt.Fprintf(w, "  %s\n", line)
+			}
+			problems += len(disallowed)
+		}
+	}
+
+	if problems > 0 {
+		return fmt.Errorf("%s", plural(problems, "problem"))
+	}
+	return nil
+}
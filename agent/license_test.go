@@ -0,0 +1,102 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDetectLicense(t *testing.T) {
+	for text, want := range map[string]string{
+		"MIT License\n\nCopyright (c) 2020 Someone\n\nPermission is hereby granted, free of charge, ...":        "MIT",
+		"                                 Apache License\n                           Version 2.0, January 2004": "Apache-2.0",
+		"Redistribution and use in source and binary forms, with or without\n...\n3. Neither the name of":       "BSD-3-Clause",
+		"                    GNU GENERAL PUBLIC LICENSE\n                       Version 3, 29 June 2007":        "GPL-3.0",
+		"This is free and unencumbered software released into the public domain.":                               "Unlicense",
+		"All rights reserved.": "",
+	} {
+		if got := detectLicense(text); got != want {
+			t.Errorf("detectLicense(%q) = %q, want %q", text, got, want)
+		}
+	}
+}
+
+func TestLicenseAllowed(t *testing.T) {
+	p := &licensePolicy{allowed: []string{"MIT", "Apache-2.0", "BSD-3-Clause"}}
+	for expression, want := range map[string]bool{
+		"MIT":                         true,
+		"mit":                         true,
+		"GPL-3.0":                     false,
+		"(MIT OR GPL-3.0)":            true,
+		"GPL-2.0 OR LGPL-2.1":         false,
+		"Apache-2.0 AND BSD-3-Clause": true,
+		"MIT AND GPL-3.0":             false,
+		"(MIT AND Apache-2.0) OR ISC": true,
+		"":                            false,
+	} {
+		if got := p.licenseAllowed(expression); got != want {
+			t.Errorf("licenseAllowed(%q) = %v", expression, got)
+		}
+	}
+}
+
+func TestLicenseHeader(t *testing.T) {
+	e, _, _ := newTestEngine(t, []ChatResponse{
+		reply("",
+			call("write_file", `{"path": "main.go", "content": "package main\n"}`),
+			call("write_file", `{"path": "run.sh", "content": "#!/bin/sh\necho hi\n"}`),
+			call("write_file", `{"path": "notes.txt", "content": "hi\n"}`),
+			call("write_file", `{"path": "old.py", "content": "print(1)\n"}`)),
+		reply("Done"),
+	}, WithLicensePolicy("Copyright {year} Example Ltd\nSPDX-License-Identifier: MIT\n", nil))
+	writeTestFile(t, e, "old.py", "pass\n")
+	if err := e.processRequest(t.Context(), "Write some files"); err != nil {
+		t.Fatal(err)
+	}
+
+	year := strconv.Itoa(time.Now().Year())
+	for path, want := range map[string]string{
+		"main.go":   "// Copyright " + year + " Example Ltd\n// SPDX-License-Identifier: MIT\n\npackage main\n",
+		"run.sh":    "#!/bin/sh\n# Copyright " + year + " Example Ltd\n# SPDX-License-Identifier: MIT\n\necho hi\n",
+		"notes.txt": "hi\n",
+		"old.py":    "print(1)\n",
+	} {
+		data, _ := os.ReadFile(filepath.Join(e.workspace, path))
+		if string(data) != want {
+			t.Errorf("%s has %q, want %q", path, data, want)
+		}
+	}
+
+	p := e.licenses
+	if !p.hasHeader("// Copyright 2019 Example Ltd\n// SPDX-License-Identifier: MIT\n") || p.hasHeader("// Copyright Someone Else\n") {
+		t.Error("hasHeader doesn't match the header with any year")
+	}
+}
+
+func TestDisallowedDependency(t *testing.T) {
+	e, provider, _ := newTestEngine(t, []ChatResponse{
+		reply("", call("write_file", `{"path": "package.json", "content": "{\"dependencies\": {\"left-pad\": \"1.0.0\", \"copyleft\": \"1.0.0\"}}\n"}`)),
+		reply("", call("write_file", `{"path": "package.json", "content": "{\"dependencies\": {\"left-pad\": \"1.0.0\", \"is-odd\": \"1.0.0\"}}\n"}`)),
+		reply("Done"),
+	}, WithLicensePolicy("", []string{"MIT", "ISC"}), WithOffline())
+	original := `{"dependencies": {"left-pad": "1.0.0"}}` + "\n"
+	writeTestFile(t, e, "package.json", original)
+	writeTestFile(t, e, "node_modules/left-pad/package.json", `{"license": "WTFPL"}`)
+	writeTestFile(t, e, "node_modules/copyleft/package.json", `{"license": "GPL-3.0-only"}`)
+	writeTestFile(t, e, "node_modules/is-odd/package.json", `{"license": {"type": "MIT"}}`)
+	if err := e.processRequest(t.Context(), "Add a dependency"); err != nil {
+		t.Fatal(err)
+	}
+
+	results := toolResults(provider.lastMessages(t, 2))
+	if len(results) != 1 || !strings.Contains(results[0].Content, "copyleft (npm) is licensed under GPL-3.0-only") {
+		t.Errorf("results %+v", results)
+	}
+	data, _ := os.ReadFile(filepath.Join(e.workspace, "package.json"))
+	if !strings.Contains(string(data), "is-odd") || strings.Contains(string(data), "copyleft") {
+		t.Errorf("package.json: %s", data)
+	}
+}
@@ -0,0 +1,308 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// A llama.cpp server is driven through its native /completion endpoint,
+// with the conversation rendered as in generate mode. Each request carries
+// a GBNF grammar built from the tool schemas, so that a reply is either
+// plain text or a tool call that is valid JSON with the right argument
+// names and types: models without tool training can't get the format wrong.
+
+// grammarAdapter asks for tool calls in the one form the grammar allows
+var grammarAdapter = &templateAdapter{
+	name: "grammar",
+	instructions: "You have access to the following tools, one JSON schema per line:\n%s\n\n" +
+		"To call a tool, reply with only a JSON object of the form " +
+		`{"name": <tool name>, "arguments": <arguments object>}` +
+		", with nothing before or after it, then wait for the result. To answer without calling a tool, reply in plain text.",
+	parsers: []string{"json"},
+}
+
+type CompletionRequest struct {
+	Prompt      string   `json:"prompt"`
+	Grammar     string   `json:"grammar,omitempty"`
+	Stop        []string `json:"stop,omitempty"`
+	NPredict    int      `json:"n_predict"`
+	CachePrompt bool     `json:"cache_prompt"`
+
+	// Sampling options, named as in Ollama where llama.cpp agrees
+	Options map[string]interface{} `json:"-"`
+}
+
+// MarshalJSON flattens the sampling options into the request, as the
+// server expects
+func (r CompletionRequest) MarshalJSON() ([]byte, error) {
+	type plain CompletionRequest
+	data, err := json.Marshal(plain(r))
+	if err != nil || len(r.Options) == 0 {
+		return data, err
+	}
+	fields := make(map[string]interface{})
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	for k, v := range r.Options {
+		fields[k] = v
+	}
+	return json.Marshal(fields)
+}
+
+type CompletionResponse struct {
+	Content string `json:"content"`
+	Stop    bool   `json:"stop"`
+}
+
+// completionOptions translates Ollama sampling options to llama.cpp's
+// names, dropping those that are set when the server starts
+func completionOptions(options map[string]interface{}) (map[string]interface{}, int) {
+	translated := make(map[string]interface{})
+	nPredict := -1
+	for k, v := range options {
+		switch k {
+		case "num_predict":
+			if n, ok := v.(float64); ok {
+				nPredict = int(n)
+			} else if n, ok := v.(int); ok {
+				nPredict = n
+			}
+		case "num_ctx", "num_gpu", "num_thread", "stop":
+		default:
+			translated[k] = v
+		}
+	}
+	return translated, nPredict
+}
+
+// llamaCppProvider talks to a llama.cpp server's /completion, with the
+// conversation rendered with a chat template and a grammar built from the
+// tools in the request
+type llamaCppProvider struct {
+	client   *http.Client
+	url      string
+	template *chatTemplate
+	debugf   func(format string, args ...interface{})
+}
+
+func (p *llamaCppProvider) SendChat(ctx context.Context, chatReq ChatRequest) (*ChatResponse, error) {
+	options, nPredict := completionOptions(chatReq.Options)
+	stop := p.template.stop
+	if s, ok := chatReq.Options["stop"].([]string); ok {
+		stop = append(append([]string{}, stop...), s...)
+	}
+	reqBody := CompletionRequest{
+		Prompt:      p.template.render(chatReq.Messages),
+		Stop:        stop,
+		NPredict:    nPredict,
+		CachePrompt: true,
+		Options:     options,
+	}
+	if len(chatReq.Tools) > 0 {
+		reqBody.Grammar = toolGrammar(chatReq.Tools)
+	}
+
+	jsonBody, err := json.Marshal(reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	p.debugf("Sending request to llama.cpp:\n%s", string(jsonBody))
+
+	var completion CompletionResponse
+	if err := postJSON(ctx, p.client, p.url+"/completion", nil, jsonBody, &completion); err != nil {
+		return nil, err
+	}
+
+	var chatResp ChatResponse
+	chatResp.Message.Role = "assistant"
+	chatResp.Message.Content = strings.TrimSpace(completion.Content)
+	chatResp.Done = completion.Stop
+	return &chatResp, nil
+}
+
+// ListModels asks the server which model it has loaded
+func (p *llamaCppProvider) ListModels(ctx context.Context) ([]Model, error) {
+	var models struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := getModels(ctx, p.client, p.url+"/v1/models", nil, &models); err != nil {
+		return nil, err
+	}
+	var list []Model
+	for _, m := range models.Data {
+		list = append(list, Model{Name: m.ID})
+	}
+	return list, nil
+}
+
+// llamaCppModel asks a llama.cpp server which model it has loaded; the
+// name is used to pick the chat template
+func llamaCppModel(client *http.Client, url string) (string, error) {
+	models, err := (&llamaCppProvider{client: client, url: url}).ListModels(context.Background())
+	if err != nil {
+		return "", err
+	}
+	if len(models) == 0 {
+		return "", fmt.Errorf("no model loaded on llama.cpp server")
+	}
+	return models[0].Name, nil
+}
+
+// grammarPrimitives are the JSON rules tool argument grammars build on
+const grammarPrimitives = `ws ::= [ \t\n]*
+string ::= "\"" ( [^"\\\x00-\x1f] | "\\" ( ["\\/bfnrt] | "u" [0-9a-fA-F] [0-9a-fA-F] [0-9a-fA-F] [0-9a-fA-F] ) )* "\""
+number ::= "-"? [0-9]+ ( "." [0-9]+ )? ( [eE] [-+]? [0-9]+ )?
+integer ::= "-"? [0-9]+
+boolean ::= "true" | "false"
+value ::= object | array | string | number | boolean | "null"
+object ::= "{" ws ( string ws ":" ws value ( ws "," ws string ws ":" ws value )* )? ws "}"
+array ::= "[" ws ( value ( ws "," ws value )* )? ws "]"
+`
+
+// toolGrammar builds a GBNF grammar for a reply that is either text not
+// starting with a brace, or one call to one of the tools
+func toolGrammar(tools []Tool) string {
+	var b strings.Builder
+	b.WriteString("root ::= ws call ws | text\n")
+	b.WriteString("text ::= [^{ \\t\\r\\n] [^\\x00]*\n")
+
+	var calls []string
+	var rules []string
+	for _, tool := range tools {
+		rule := "call-" + grammarName(tool.Function.Name)
+		calls = append(calls, rule)
+		args := schemaGrammar(tool.Function.Parameters)
+		rules = append(rules, fmt.Sprintf(`%s ::= %s ws "," ws "\"arguments\"" ws ":" ws %s`,
+			rule, gbnfLiteral(jsonString(tool.Function.Name)), args))
+	}
+	fmt.Fprintf(&b, "call ::= \"{\" ws \"\\\"name\\\"\" ws \":\" ws ( %s ) ws \"}\"\n", strings.Join(calls, " | "))
+	for _, rule := range rules {
+		b.WriteString(rule + "\n")
+	}
+	b.WriteString(grammarPrimitives)
+	return b.String()
+}
+
+// schemaGrammar returns a grammar expression for values matching a JSON
+// schema, as far as tool schemas use them
+func schemaGrammar(schema interface{}) string {
+	s, ok := schema.(map[string]interface{})
+	if !ok {
+		return "value"
+	}
+	if enum := stringList(s["enum"]); len(enum) > 0 {
+		alternatives := make([]string, len(enum))
+		for i, v := range enum {
+			alternatives[i] = gbnfLiteral(jsonString(v))
+		}
+		return "( " + strings.Join(alternatives, " | ") + " )"
+	}
+	switch s["type"] {
+	case "string":
+		return "string"
+	case "number":
+		return "number"
+	case "integer":
+		return "integer"
+	case "boolean":
+		return "boolean"
+	case "array":
+		item := schemaGrammar(s["items"])
+		return fmt.Sprintf(`( "[" ws ( %s ( ws "," ws %s )* )? ws "]" )`, item, item)
+	case "object":
+		properties, ok := s["properties"].(map[string]interface{})
+		if !ok {
+			return "object"
+		}
+		return objectGrammar(properties, stringList(s["required"]))
+	}
+	return "value"
+}
+
+// objectGrammar requires the required properties first, in order, then
+// allows the others in name order. Without required properties, any of
+// them may come in any order, which is looser but still keeps names and
+// types right.
+func objectGrammar(properties map[string]interface{}, required []string) string {
+	var names []string
+	for name := range properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	member := func(name string) string {
+		return fmt.Sprintf("%s ws \":\" ws %s", gbnfLiteral(jsonString(name)), schemaGrammar(properties[name]))
+	}
+
+	if len(required) == 0 {
+		if len(names) == 0 {
+			return `( "{" ws "}" )`
+		}
+		members := make([]string, len(names))
+		for i, name := range names {
+			members[i] = member(name)
+		}
+		either := "( " + strings.Join(members, " | ") + " )"
+		return fmt.Sprintf(`( "{" ws ( %s ( ws "," ws %s )* )? ws "}" )`, either, either)
+	}
+
+	isRequired := make(map[string]bool)
+	var parts []string
+	for i, name := range required {
+		isRequired[name] = true
+		if i > 0 {
+			parts = append(parts, `ws "," ws`)
+		}
+		parts = append(parts, member(name))
+	}
+	for _, name := range names {
+		if !isRequired[name] {
+			parts = append(parts, fmt.Sprintf(`( ws "," ws %s )?`, member(name)))
+		}
+	}
+	return `( "{" ws ` + strings.Join(parts, " ") + ` ws "}" )`
+}
+
+func stringList(v interface{}) []string {
+	switch v := v.(type) {
+	case []string:
+		return v
+	case []interface{}:
+		var list []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+func jsonString(s string) string {
+	data, _ := json.Marshal(s)
+	return string(data)
+}
+
+// gbnfLiteral quotes text as a GBNF string literal
+func gbnfLiteral(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+	return `"` + r.Replace(s) + `"`
+}
+
+// grammarName makes a tool name usable as a GBNF rule name
+func grammarName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '-'
+	}, name)
+}
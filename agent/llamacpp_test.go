@@ -0,0 +1,333 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// gbnf is a small GBNF interpreter, enough to check which replies a
+// grammar accepts without a llama.cpp server
+type gbnf struct {
+	rules map[string]gbnfNode
+}
+
+type gbnfNode struct {
+	kind     byte // 'l' literal, 'c' class, 'r' rule, 's' sequence, 'a' alternation, '?', '*', '+'
+	text     string
+	negated  bool
+	ranges   [][2]rune
+	children []gbnfNode
+}
+
+func parseGBNF(t *testing.T, grammar string) *gbnf {
+	t.Helper()
+	g := &gbnf{rules: make(map[string]gbnfNode)}
+	for _, line := range strings.Split(grammar, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		name, body, ok := strings.Cut(line, " ::= ")
+		if !ok {
+			t.Fatalf("bad rule %q", line)
+		}
+		p := &gbnfParser{src: []rune(body)}
+		node := p.alternation()
+		if p.pos != len(p.src) {
+			t.Fatalf("rule %s: unparsed %q", name, string(p.src[p.pos:]))
+		}
+		g.rules[name] = node
+	}
+	for name, node := range g.rules {
+		g.checkRefs(t, name, node)
+	}
+	return g
+}
+
+func (g *gbnf) checkRefs(t *testing.T, rule string, node gbnfNode) {
+	if node.kind == 'r' {
+		if _, ok := g.rules[node.text]; !ok {
+			t.Errorf("rule %s refers to undefined %s", rule, node.text)
+		}
+	}
+	for _, child := range node.children {
+		g.checkRefs(t, rule, child)
+	}
+}
+
+type gbnfParser struct {
+	src []rune
+	pos int
+}
+
+func (p *gbnfParser) space() {
+	for p.pos < len(p.src) && p.src[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+func (p *gbnfParser) alternation() gbnfNode {
+	alternatives := []gbnfNode{p.sequence()}
+	for p.space(); p.pos < len(p.src) && p.src[p.pos] == '|'; p.space() {
+		p.pos++
+		alternatives = append(alternatives, p.sequence())
+	}
+	return gbnfNode{kind: 'a', children: alternatives}
+}
+
+func (p *gbnfParser) sequence() gbnfNode {
+	var items []gbnfNode
+	for {
+		p.space()
+		if p.pos >= len(p.src) || p.src[p.pos] == '|' || p.src[p.pos] == ')' {
+			return gbnfNode{kind: 's', children: items}
+		}
+		item := p.item()
+		if p.pos < len(p.src) && strings.ContainsRune("?*+", p.src[p.pos]) {
+			item = gbnfNode{kind: byte(p.src[p.pos]), children: []gbnfNode{item}}
+			p.pos++
+		}
+		items = append(items, item)
+	}
+}
+
+func (p *gbnfParser) escape() rune {
+	p.pos++
+	c := p.src[p.pos]
+	p.pos++
+	switch c {
+	case 'n':
+		return '\n'
+	case 't':
+		return '\t'
+	case 'r':
+		return '\r'
+	case 'x':
+		n, _ := strconv.ParseUint(string(p.src[p.pos:p.pos+2]), 16, 32)
+		p.pos += 2
+		return rune(n)
+	}
+	return c
+}
+
+func (p *gbnfParser) char() rune {
+	if p.src[p.pos] == '\\' {
+		return p.escape()
+	}
+	p.pos++
+	return p.src[p.pos-1]
+}
+
+func (p *gbnfParser) item() gbnfNode {
+	switch c := p.src[p.pos]; {
+	case c == '"':
+		p.pos++
+		var b strings.Builder
+		for p.src[p.pos] != '"' {
+			b.WriteRune(p.char())
+		}
+		p.pos++
+		return gbnfNode{kind: 'l', text: b.String()}
+	case c == '[':
+		p.pos++
+		node := gbnfNode{kind: 'c'}
+		if p.src[p.pos] == '^' {
+			node.negated = true
+			p.pos++
+		}
+		for p.src[p.pos] != ']' {
+			lo := p.char()
+			hi := lo
+			if p.src[p.pos] == '-' && p.src[p.pos+1] != ']' {
+				p.pos++
+				hi = p.char()
+			}
+			node.ranges = append(node.ranges, [2]rune{lo, hi})
+		}
+		p.pos++
+		return node
+	case c == '(':
+		p.pos++
+		node := p.alternation()
+		p.pos++
+		return node
+	default:
+		start := p.pos
+		for p.pos < len(p.src) && (p.src[p.pos] == '-' || p.src[p.pos] >= 'a' && p.src[p.pos] <= 'z' || p.src[p.pos] >= '0' && p.src[p.pos] <= '9') {
+			p.pos++
+		}
+		return gbnfNode{kind: 'r', text: string(p.src[start:p.pos])}
+	}
+}
+
+// match returns the positions at which node can finish matching input
+// from pos
+func (g *gbnf) match(node gbnfNode, input []rune, pos int) map[int]bool {
+	ends := make(map[int]bool)
+	switch node.kind {
+	case 'l':
+		lit := []rune(node.text)
+		if pos+len(lit) <= len(input) && string(input[pos:pos+len(lit)]) == node.text {
+			ends[pos+len(lit)] = true
+		}
+	case 'c':
+		if pos < len(input) {
+			in := false
+			for _, r := range node.ranges {
+				if input[pos] >= r[0] && input[pos] <= r[1] {
+					in = true
+				}
+			}
+			if in != node.negated {
+				ends[pos+1] = true
+			}
+		}
+	case 'r':
+		return g.match(g.rules[node.text], input, pos)
+	case 's':
+		ends[pos] = true
+		for _, child := range node.children {
+			next := make(map[int]bool)
+			for p := range ends {
+				for q := range g.match(child, input, p) {
+					next[q] = true
+				}
+			}
+			ends = next
+		}
+	case 'a':
+		for _, child := range node.children {
+			for q := range g.match(child, input, pos) {
+				ends[q] = true
+			}
+		}
+	case '?', '*', '+':
+		if node.kind != '+' {
+			ends[pos] = true
+		}
+		frontier := map[int]bool{pos: true}
+		for len(frontier) > 0 {
+			next := make(map[int]bool)
+			for p := range frontier {
+				for q := range g.match(node.children[0], input, p) {
+					if !ends[q] {
+						ends[q] = true
+						if node.kind != '?' && q != p {
+							next[q] = true
+						}
+					}
+				}
+			}
+			frontier = next
+		}
+	}
+	return ends
+}
+
+func (g *gbnf) accepts(s string) bool {
+	input := []rune(s)
+	return g.match(g.rules["root"], input, 0)[len(input)]
+}
+
+func TestToolGrammar(t *testing.T) {
+	e := newToolEngine(t)
+	g := parseGBNF(t, toolGrammar(e.getTools()))
+
+	accepted := []string{
+		`{"name": "read_file", "arguments": {"path": "main.go"}}`,
+		`{"name": "read_file", "arguments": {"path": "main.go", "end_line": 20, "start_line": 1}}`,
+		`{"name":"run_command","arguments":{"command":"ls -la \"my dir\""}}`,
+		`{"name": "read_files", "arguments": {"paths": ["a.go", "b.go"]}}`,
+		`{"name": "change_directory", "arguments": {"path": "src"}}`,
+		"The tests pass now.",
+		"Done: {\"not\": \"a call\"}",
+	}
+	for _, s := range accepted {
+		if !g.accepts(s) {
+			t.Errorf("grammar rejects %s", s)
+		}
+	}
+
+	rejected := []string{
+		`{"name": "delete_everything", "arguments": {}}`,
+		`{"name": "read_file", "arguments": {}}`,
+		`{"name": "read_file", "arguments": {"path": 42}}`,
+		`{"name": "read_file", "arguments": {"path": "a", "colour": "red"}}`,
+		`{"name": "read_file", "arguments": {'path': 'a'}}`,
+		`{"name": "read_files", "arguments": {"paths": "a.go"}}`,
+		`{"name": "read_file" "arguments": {"path": "a"}}`,
+	}
+	for _, s := range rejected {
+		if g.accepts(s) {
+			t.Errorf("grammar accepts %s", s)
+		}
+	}
+}
+
+func TestToolGrammarEnum(t *testing.T) {
+	tools := []Tool{npmRunTool("npm", []string{"build", "test"})}
+	g := parseGBNF(t, toolGrammar(tools))
+	if !g.accepts(`{"name": "npm_run", "arguments": {"script": "test", "args": ["--watch"]}}`) {
+		t.Error("grammar rejects a listed script")
+	}
+	if g.accepts(`{"name": "npm_run", "arguments": {"script": "deploy"}}`) {
+		t.Error("grammar accepts a script not in package.json")
+	}
+}
+
+func TestRunLlamaCpp(t *testing.T) {
+	completions := []string{
+		`{"name": "write_file", "arguments": {"path": "l.txt", "content": "constrained"}}`,
+		"Done.",
+	}
+	var requests []map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/completion" {
+			http.NotFound(w, r)
+			return
+		}
+		var req map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&req)
+		requests = append(requests, req)
+		json.NewEncoder(w).Encode(CompletionResponse{Content: completions[len(requests)-1], Stop: true})
+	}))
+	defer srv.Close()
+
+	e, err := New(WithWorkspace(t.TempDir()), WithProvider(srv.Client(), srv.URL, "Qwen2.5-7B-Instruct-Q4_K_M.gguf"),
+		WithSystemPrompt("You are a test."), WithEvents(func(Event) {}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.llamaCpp = true
+	e.generateTemplate = chatTemplates["chatml"]
+	e.adapter = grammarAdapter
+	e.options = map[string]interface{}{"temperature": 0, "num_ctx": 8192, "num_predict": 512}
+
+	if _, err := e.Run(context.Background(), "Write l.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(e.workspace, "l.txt")); err != nil || string(data) != "constrained" {
+		t.Errorf("file has %q, %v", data, err)
+	}
+	if len(requests) != 2 {
+		t.Fatalf("sent %d requests", len(requests))
+	}
+	req := requests[0]
+	grammar, _ := req["grammar"].(string)
+	if !strings.Contains(grammar, "call-write-file ::=") {
+		t.Errorf("request has no tool grammar")
+	}
+	if req["temperature"] != float64(0) || req["n_predict"] != float64(512) || req["num_ctx"] != nil {
+		t.Errorf("options sent as %v", fmt.Sprint(req["temperature"], req["n_predict"], req["num_ctx"]))
+	}
+	if prompt, _ := req["prompt"].(string); !strings.Contains(prompt, "<|im_start|>user\nWrite l.txt") {
+		t.Errorf("prompt %q", prompt)
+	}
+}
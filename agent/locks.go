@@ -0,0 +1,39 @@
+package agent
+
+import "sync"
+
+// pathLocks holds a read/write lock per resolved file path, so that tool
+// calls running concurrently cannot interleave writes to the same file or
+// read one that is half written. The zero value is ready to use.
+type pathLocks struct {
+	mu    sync.Mutex
+	locks map[string]*sync.RWMutex
+}
+
+func (l *pathLocks) get(path string) *sync.RWMutex {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.locks == nil {
+		l.locks = make(map[string]*sync.RWMutex)
+	}
+	lock, ok := l.locks[path]
+	if !ok {
+		lock = new(sync.RWMutex)
+		l.locks[path] = lock
+	}
+	return lock
+}
+
+// read locks path for reading and returns the unlock function
+func (l *pathLocks) read(path string) func() {
+	lock := l.get(path)
+	lock.RLock()
+	return lock.RUnlock
+}
+
+// write locks path for writing and returns the unlock function
+func (l *pathLocks) write(path string) func() {
+	lock := l.get(path)
+	lock.Lock()
+	return lock.Unlock
+}
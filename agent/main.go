@@ -0,0 +1,1694 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Engine struct {
+	client       *http.Client
+	ollamaURL    string
+	model        string
+	workspace    string
+	systemPrompt string
+	callCount    int
+
+	// contentParsers extract tool calls written in the assistant's text
+	// rather than returned as native tool_calls
+	contentParsers []ContentParser
+	adapter        PromptAdapter
+
+	// options are Ollama sampling options sent with every request
+	options     map[string]interface{}
+	sessionPath string
+	sessionKey  []byte
+
+	// requireFinalAnswer makes the model finish by calling final_answer,
+	// whose validated arguments are stored in result
+	requireFinalAnswer bool
+	result             *FinalAnswer
+
+	// reviewing offers report_finding, for wex review, which collects
+	// findings
+	reviewing bool
+	findings  []Finding
+
+	// auditScanners, during wex audit, are offered through run_scanner
+	auditScanners []*auditScanner
+
+	// reply is the assistant's last message
+	reply string
+
+	// taskType picks guidance added to the system prompt: a type from
+	// task_prompts, auto to classify the request, or none
+	taskType string
+
+	// history is an earlier conversation to carry on from; see
+	// loadConversation
+	history []Message
+
+	// conversation is the last request's conversation, without the system
+	// prompt, for carrying it on
+	conversation []Message
+
+	// agentPeers are the wex servers start_agent may use, and agentToken
+	// the token for them, and for wex serve
+	agentPeers []agentPeer
+	agentToken string
+
+	// runCtx is the context of the request being carried out, for tools
+	// that make requests of their own
+	runCtx context.Context
+
+	notifyConfig NotifyConfig
+
+	// offline refuses anything that would connect anywhere but the model
+	// server
+	offline bool
+
+	// verbose adds debugging output to the log, such as each request sent
+	// to the model server
+	verbose bool
+
+	// maxAttempts is how many times a request to the model server is tried
+	// when it fails in a way that may not last; see retry.go
+	maxAttempts int
+
+	// noPull fails, instead of pulling a model the server doesn't have
+	noPull bool
+
+	// plan, with --plan-output, holds the changes the file tools make
+	// instead of the workspace
+	plan *overlayFS
+
+	// templateUserMessage expands template variables in the user message
+	// as well as the system prompt
+	templateUserMessage bool
+
+	// hostWorkspace is where the workspace is on the host, when running in
+	// a container; see relativePaths
+	hostWorkspace string
+
+	// symlinkPolicy is within, follow or deny; see resolvePath
+	symlinkPolicy string
+
+	// chunkedWrites are files being written with write_file_chunk, by
+	// cleaned path
+	chunkedWrites map[string]*chunkedWrite
+
+	// locks serializes file tool access to each path
+	locks pathLocks
+
+	quota      Quota
+	diffBudget DiffBudget
+
+	// cwd is the directory run_command runs in, relative to the workspace
+	cwd string
+
+	// persistentShell runs commands in one long-lived shell, started on
+	// first use
+	persistentShell bool
+	shell           *shellSession
+
+	// pythonTool offers run_python, with an interpreter started on first use
+	pythonTool bool
+	python     *pythonSession
+
+	// imageTools offers transform_image, and generate_image if imageAPI
+	// has an endpoint
+	imageTools bool
+	imageAPI   ImageAPIConfig
+
+	// projectToolsEnabled offers test and script runners for the kinds of
+	// project detected in the workspace
+	projectToolsEnabled bool
+
+	// toolFilter limits the tools offered, per --tools and --disable-tools
+	toolFilter ToolFilter
+
+	// toolExamples adds example arguments to tool descriptions
+	toolExamples bool
+
+	// renderer presents session events; nil means the plain log
+	renderer Renderer
+
+	// filesystem holds the workspace for the file tools; nil means the
+	// real disk
+	filesystem FS
+
+	// noCommands refuses the tools that run commands, which the
+	// filesystem, even confined to the workspace, doesn't reach
+	noCommands bool
+
+	// confined is whether the filesystem is confined to the workspace,
+	// which refuses commands too, unless unconfinedCommands allows them
+	confined, unconfinedCommands bool
+
+	// generateTemplate, if set, renders the conversation for /api/generate,
+	// which is used instead of /api/chat
+	generateTemplate *chatTemplate
+
+	// llamaCpp means ollamaURL is a llama.cpp server, sent conversations
+	// rendered with generateTemplate and a grammar for tool calls
+	llamaCpp bool
+
+	// anthropicKey, if set, means ollamaURL is Anthropic's Messages API,
+	// sent requests translated from /api/chat's form with this key
+	anthropicKey string
+
+	// provider, if set, is sent requests instead of the server at
+	// ollamaURL; see modelProvider
+	provider Provider
+
+	// approver, if set, decides on actions that need approval instead of
+	// asking at the terminal
+	approver func(action string) bool
+
+	// answerer, if set, answers ask_user instead of the user at the
+	// terminal; no answer pauses the session
+	answerer func(question string, choices []string) (string, bool)
+
+	// question is what ask_user asked with no one to answer, pausing the
+	// session until it is resumed with the answer, and choices the answers
+	// it may have, if it is not free text
+	question string
+	choices  []string
+
+	// answers are the answers given to ask_user this turn, which go to the
+	// model as user messages after the tool results
+	answers []string
+
+	// callApprover, if set, decides on tool calls that need approval, and
+	// may change their arguments
+	callApprover func(tool string, args json.RawMessage) (json.RawMessage, bool)
+
+	// images are sent with the next request's message
+	images [][]byte
+
+	// editedArguments are what the user changed the last tool call's
+	// arguments to when approving it, to be noted in its result
+	editedArguments json.RawMessage
+
+	// call is the tool call being made, so that approving something it
+	// does means approving the call, with the chance to change it first.
+	// rerunArguments are the arguments it was changed to, to make it again
+	// with, and approvedArguments those it is being made again with.
+	call              *ToolCall
+	rerunArguments    json.RawMessage
+	approvedArguments json.RawMessage
+
+	// checkModel, if set, is a small model asked whether each destructive
+	// command fits request, the user's message, before it runs
+	checkModel string
+	request    string
+
+	// intents are the destructive intents seen in the request or plan, and
+	// whether the user confirmed each; confirmedIntents are confirmed in
+	// advance with --confirm. See checkCommandIntent.
+	intents          map[string]bool
+	confirmedIntents map[string]bool
+
+	// ensembleModels, if any, are asked for their own version of each
+	// write_file, and judgeModel picks one when they disagree
+	ensembleModels []string
+	judgeModel     string
+
+	// toolPolicy, if set, decides on each tool call, and user is who the
+	// calls are made for
+	toolPolicy toolPolicy
+	user       string
+
+	// commandPolicy is the action, allow, ask or deny, for each class of
+	// command; classes without one are allowed
+	commandPolicy map[commandClass]string
+
+	// packagePolicy is allow, ask, deny or sandbox, for commands that
+	// install packages
+	packagePolicy string
+
+	// commandCache holds results of read-only commands, keyed by
+	// commandCacheKey, for up to commandCacheTurns turns
+	commandCache map[string]cachedCommand
+	turn         int
+
+	// commandAnswers are automatic replies to command prompts, and
+	// forwardInput asks the user to answer any others
+	commandAnswers []commandAnswer
+	forwardInput   bool
+
+	// readDedup answers a repeated read of an unchanged file with a note
+	// instead of the contents, which are already in the conversation
+	readDedup bool
+	reads     map[string]*readRecord
+
+	// maxReadBytes is the largest file read_file returns whole without
+	// force or a line range; 0 means no limit
+	maxReadBytes int64
+
+	// stream asks for the reply a piece at a time, shown as it comes;
+	// streamed is whether any of the last reply's text came that way
+	stream   bool
+	streamed bool
+
+	// licenses, if set, puts a license header on new source files and
+	// keeps dependencies without an allowed license from being added
+	licenses *licensePolicy
+
+	// repoMap adds a map of the workspace to the system prompt
+	repoMap bool
+
+	// gitContextCommits is how many recent commits, along with the current
+	// status and diff, to include in the system prompt; 0 disables it
+	gitContextCommits int
+}
+
+// defaultMaxReadBytes is the default size limit for reading a whole file
+const defaultMaxReadBytes = 100000
+
+// reproducibleSeed is the seed used by --reproducible when none is given
+const reproducibleSeed = 42
+
+type Message struct {
+	Role       string     `json:"role"`
+	Content    string     `json:"content"`
+	Images     []string   `json:"images,omitempty"` // base64, in a user message
+	ToolCalls  []ToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string     `json:"tool_call_id,omitempty"`
+}
+
+type ToolCall struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	} `json:"function"`
+}
+
+type ChatRequest struct {
+	Model    string                 `json:"model"`
+	Messages []Message              `json:"messages"`
+	Tools    []Tool                 `json:"tools,omitempty"`
+	Stream   bool                   `json:"stream"`
+	Options  map[string]interface{} `json:"options,omitempty"`
+
+	// OnText, with Stream, is called with each piece of the reply's text
+	// as it arrives, by providers that can stream
+	OnText func(text string) `json:"-"`
+}
+
+type ChatResponse struct {
+	Message struct {
+		Role      string     `json:"role"`
+		Content   string     `json:"content"`
+		ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+	} `json:"message"`
+	Done bool `json:"done"`
+}
+
+type Tool struct {
+	Type     string   `json:"type"`
+	Function Function `json:"function"`
+}
+
+type Function struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description"`
+	Parameters  map[string]interface{} `json:"parameters"`
+}
+
+type ToolResult struct {
+	ToolCallID string `json:"tool_call_id"`
+	Role       string `json:"role"`
+	Content    string `json:"content"`
+}
+
+type Model struct {
+	Name    string       `json:"name"`
+	Digest  string       `json:"digest"`
+	Size    int64        `json:"size"`
+	Details ModelDetails `json:"details"`
+}
+
+// ModelDetails describes a model in Ollama's list of models
+type ModelDetails struct {
+	Family            string `json:"family"`
+	ParameterSize     string `json:"parameter_size"`
+	QuantizationLevel string `json:"quantization_level"`
+}
+
+type ModelsResponse struct {
+	Models []Model `json:"models"`
+}
+
+func NewEngine(client *http.Client, ollamaURL, model, workspace string) (*Engine, error) {
+	engine := &Engine{
+		client:    client,
+		ollamaURL: ollamaURL,
+		workspace: workspace,
+		user:      currentUser(),
+
+		maxReadBytes:  defaultMaxReadBytes,
+		symlinkPolicy: symlinkWithin,
+		maxAttempts:   defaultMaxAttempts,
+	}
+
+	if model == "" {
+		firstModel, err := engine.getFirstAvailableModel()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get available model: %v", err)
+		}
+		engine.model = firstModel
+	} else {
+		engine.model = model
+	}
+
+	systemPromptBytes, err := os.ReadFile("system_prompt.txt")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read system_prompt.txt: %v", err)
+	}
+	engine.systemPrompt = string(systemPromptBytes)
+
+	return engine, nil
+}
+
+func (e *Engine) getFirstAvailableModel() (string, error) {
+	models, err := e.modelProvider().ListModels(context.Background())
+	if err != nil {
+		return "", err
+	}
+
+	if len(models) == 0 {
+		return "", fmt.Errorf("no models available on Ollama server")
+	}
+
+	return models[0].Name, nil
+}
+
+func (e *Engine) getTools() []Tool {
+	tools := []Tool{
+		{
+			Type: "function",
+			Function: Function{
+				Name:        "read_file",
+				Description: "Read the contents of a file",
+				Parameters: map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"path": map[string]interface{}{
+							"type":        "string",
+							"description": "Path to the file to read",
+						},
+						"start_line": map[string]interface{}{
+							"type":        "number",
+							"description": "First line to read, counting from 1 (optional)",
+						},
+						"end_line": map[string]interface{}{
+							"type":        "number",
+							"description": "Last line to read (optional, default end of file)",
+						},
+						"force": map[string]interface{}{
+							"type":        "boolean",
+							"description": "Read the whole file even if it is over the size limit, or unchanged since it was last read (optional)",
+						},
+					},
+					"required": []string{"path"},
+				},
+			},
+		},
+		{
+			Type: "function",
+			Function: Function{
+				Name:        "write_file",
+				Description: "Write content to a file",
+				Parameters: map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"path": map[string]interface{}{
+							"type":        "string",
+							"description": "Path to the file to write",
+						},
+						"content": map[string]interface{}{
+							"type":        "string",
+							"description": "Content to write to the file",
+						},
+						"mode": map[string]interface{}{
+							"type":        "string",
+							"description": "Octal permissions, e.g. \"0755\" for an executable script (optional; an existing file keeps its mode)",
+						},
+					},
+					"required": []string{"path", "content"},
+				},
+			},
+		},
+		{
+			Type: "function",
+			Function: Function{
+				Name:        "run_command",
+				Description: "Execute a shell command. Returns JSON with exit_code, stdout, stderr, duration_seconds, cwd, timed_out if the timeout was hit, and waiting_for_input if it stopped at a prompt nothing answered; run it again with input to answer",
+				Parameters: map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"command": map[string]interface{}{
+							"type":        "string",
+							"description": "Shell command to execute",
+						},
+						"timeout": map[string]interface{}{
+							"type":        "number",
+							"description": "Timeout in seconds (optional, default 30)",
+						},
+						"input": map[string]interface{}{
+							"type":        "string",
+							"description": "Text to send to the command's standard input, e.g. answers to its prompts, one per line (optional)",
+						},
+					},
+					"required": []string{"command"},
+				},
+			},
+		},
+		{
+			Type: "function",
+			Function: Function{
+				Name:        "change_directory",
+				Description: "Change the directory run_command runs in, for this and later commands. File tool paths stay relative to the workspace root",
+				Parameters: map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"path": map[string]interface{}{
+							"type":        "string",
+							"description": "Directory relative to the current one, or absolute from the workspace root, e.g. \"..\" or \"/\"",
+						},
+					},
+					"required": []string{"path"},
+				},
+			},
+		},
+	}
+
+	tools = append(tools, readFilesTool(), writeFileChunkTool())
+	tools = append(tools, outlineTools()...)
+	tools = append(tools, replaceAcrossFilesTool())
+	tools = append(tools, readJSONPathTool(), updateJSONPathTool())
+	tools = append(tools, envTools()...)
+	tools = append(tools, archiveTools()...)
+	tools = append(tools, compareTools()...)
+	tools = append(tools, previewTableTool())
+	tools = append(tools, calculateTool(), environmentTool(), scaffoldTool())
+	if e.projectToolsEnabled {
+		tools = append(tools, e.projectTools()...)
+	}
+	if e.pythonTool {
+		tools = append(tools, pythonTool())
+	}
+	if e.imageTools {
+		tools = append(tools, imageTools(e.imageAPI)...)
+	}
+	tools = append(tools, askUserTool())
+	if e.requireFinalAnswer {
+		tools = append(tools, finalAnswerTool())
+	}
+	if e.reviewing {
+		tools = append(tools, reportFindingTool())
+	}
+	if len(e.auditScanners) > 0 {
+		tools = append(tools, runScannerTool(e.auditScanners))
+	}
+	if len(e.agentPeers) > 0 {
+		tools = append(tools, agentTools(e.agentPeers)...)
+	}
+	if e.noCommands {
+		tools = slices.DeleteFunc(tools, func(tool Tool) bool { return commandTools[tool.Function.Name] })
+	}
+	tools = e.toolFilter.apply(tools)
+	if e.toolExamples {
+		tools = addToolExamples(tools)
+	}
+	return tools
+}
+
+func (e *Engine) callTool(toolCall ToolCall) (string, error) {
+	if !e.toolFilter.allows(toolCall.Function.Name) {
+		return "", fmt.Errorf("tool %s is not enabled for this session", toolCall.Function.Name)
+	}
+	if e.noCommands && commandTools[toolCall.Function.Name] {
+		return "", fmt.Errorf("tool %s is not available, since this session runs no commands", toolCall.Function.Name)
+	}
+	edited, err := e.checkToolPolicy(toolCall)
+	if err != nil {
+		return "", err
+	}
+	if edited != nil {
+		toolCall.Function.Arguments = edited
+		e.editedArguments = edited
+	}
+
+	e.call = &toolCall
+	defer func() { e.call, e.approvedArguments = nil, nil }()
+	for {
+		result, err := e.runTool(toolCall)
+		if e.rerunArguments == nil {
+			return result, err
+		}
+		// The user changed the arguments when asked to approve something
+		// the call does, which was refused, so make it again with them
+		toolCall.Function.Arguments = e.rerunArguments
+		e.editedArguments, e.approvedArguments, e.rerunArguments = e.rerunArguments, e.rerunArguments, nil
+	}
+}
+
+// runTool makes a tool call that has passed the tool policy
+func (e *Engine) runTool(toolCall ToolCall) (string, error) {
+	switch toolCall.Function.Name {
+	case "read_file":
+		return e.readFile(toolCall.Function.Arguments)
+	case "write_file":
+		return e.writeFile(toolCall.Function.Arguments)
+	case "run_command":
+		return e.runCommand(toolCall.Function.Arguments)
+	case "replace_across_files":
+		return e.replaceAcrossFiles(toolCall.Function.Arguments)
+	case "code_outline":
+		return e.codeOutline(toolCall.Function.Arguments)
+	case "edit_region":
+		return e.editRegion(toolCall.Function.Arguments)
+	case "write_file_chunk":
+		return e.writeFileChunk(toolCall.Function.Arguments)
+	case "read_files":
+		return e.readFiles(toolCall.Function.Arguments)
+	case "change_directory":
+		return e.changeDirectory(toolCall.Function.Arguments)
+	case "read_json_path":
+		return e.readJSONPath(toolCall.Function.Arguments)
+	case "update_json_path":
+		return e.updateJSONPath(toolCall.Function.Arguments)
+	case "read_env_file":
+		return e.readEnvFile(toolCall.Function.Arguments)
+	case "update_env_file":
+		return e.updateEnvFile(toolCall.Function.Arguments)
+	case "find_env_vars":
+		return e.findEnvVars(toolCall.Function.Arguments)
+	case "extract_archive":
+		return e.extractArchive(toolCall.Function.Arguments)
+	case "create_archive":
+		return e.createArchive(toolCall.Function.Arguments)
+	case "hash_file":
+		return e.hashFile(toolCall.Function.Arguments)
+	case "diff_files":
+		return e.diffFiles(toolCall.Function.Arguments)
+	case "preview_table":
+		return e.previewTable(toolCall.Function.Arguments)
+	case "calculate":
+		return e.calculate(toolCall.Function.Arguments)
+	case "get_environment":
+		return e.getEnvironment(toolCall.Function.Arguments)
+	case "scaffold_project":
+		return e.scaffoldProject(toolCall.Function.Arguments)
+	case "go_test":
+		return e.goTest(toolCall.Function.Arguments)
+	case "npm_run":
+		return e.npmRun(toolCall.Function.Arguments)
+	case "pytest":
+		return e.pytest(toolCall.Function.Arguments)
+	case "run_python":
+		if e.pythonTool {
+			return e.runPython(toolCall.Function.Arguments)
+		}
+		return "", fmt.Errorf("unknown tool: %s", toolCall.Function.Name)
+	case "transform_image":
+		if e.imageTools {
+			return e.transformImage(toolCall.Function.Arguments)
+		}
+		return "", fmt.Errorf("unknown tool: %s", toolCall.Function.Name)
+	case "generate_image":
+		if e.imageTools {
+			return e.generateImage(toolCall.Function.Arguments)
+		}
+		return "", fmt.Errorf("unknown tool: %s", toolCall.Function.Name)
+	case "ask_user":
+		return e.askUser(toolCall.Function.Arguments)
+	case "final_answer":
+		if e.requireFinalAnswer {
+			return e.recordFinalAnswer(toolCall.Function.Arguments)
+		}
+		return "", fmt.Errorf("unknown tool: %s", toolCall.Function.Name)
+	case "report_finding":
+		if e.reviewing {
+			return e.reportFinding(toolCall.Function.Arguments)
+		}
+		return "", fmt.Errorf("unknown tool: %s", toolCall.Function.Name)
+	case "run_scanner":
+		if len(e.auditScanners) > 0 {
+			return e.runScanner(toolCall.Function.Arguments)
+		}
+		return "", fmt.Errorf("unknown tool: %s", toolCall.Function.Name)
+	case "start_agent", "message_agent", "wait_agent":
+		if len(e.agentPeers) == 0 {
+			return "", fmt.Errorf("unknown tool: %s", toolCall.Function.Name)
+		}
+		switch toolCall.Function.Name {
+		case "start_agent":
+			return e.startAgent(toolCall.Function.Arguments)
+		case "message_agent":
+			return e.messageAgent(toolCall.Function.Arguments)
+		}
+		return e.waitAgent(toolCall.Function.Arguments)
+	default:
+		return "", fmt.Errorf("unknown tool: %s", toolCall.Function.Name)
+	}
+}
+
+func (e *Engine) readFile(args json.RawMessage) (string, error) {
+	var params struct {
+		Path      string `json:"path"`
+		StartLine int    `json:"start_line"`
+		EndLine   int    `json:"end_line"`
+		Force     bool   `json:"force"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return "", fmt.Errorf("invalid arguments: %v", err)
+	}
+
+	fullPath, err := e.resolvePath(params.Path)
+	if err != nil {
+		return "", err
+	}
+	defer e.locks.read(fullPath)()
+	lineRange := params.StartLine > 0 || params.EndLine > 0
+
+	// Protect the context window from accidentally reading something like
+	// package-lock.json whole
+	if info, err := e.files().Stat(fullPath); err == nil && e.maxReadBytes > 0 && info.Size() > e.maxReadBytes && !lineRange && !params.Force {
+		return "", fmt.Errorf("%s is %d bytes, over the limit of %d; read part of it with start_line and end_line, or pass force: true to read it all",
+			params.Path, info.Size(), e.maxReadBytes)
+	}
+
+	content, err := e.files().ReadFile(fullPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read file: %v", err)
+	}
+	if e.readDedup && !params.Force {
+		if digest, seen := e.alreadyRead(fullPath, content, params.StartLine, params.EndLine); seen {
+			return fmt.Sprintf("%s is unchanged since it was last read (sha256 %s), so its contents are as shown then; pass force: true to read it again",
+				params.Path, digest), nil
+		}
+	}
+	text, format := decodeText(content)
+	if lineRange {
+		text, err = selectLines(text, params.StartLine, params.EndLine)
+		if err != nil {
+			return "", err
+		}
+	}
+	if !format.isPlain() {
+		text = fmt.Sprintf("[Encoding: %s; kept when the file is written]\n%s", format, text)
+	}
+	return text, nil
+}
+
+// selectLines returns lines start to end inclusive, counting from 1; zero
+// means the start or end of the file
+func selectLines(content string, start, end int) (string, error) {
+	lines := strings.SplitAfter(content, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if start < 1 {
+		start = 1
+	}
+	if end < 1 || end > len(lines) {
+		end = len(lines)
+	}
+	if start > len(lines) {
+		return "", fmt.Errorf("start_line %d is past the end of the file, which has %d lines", start, len(lines))
+	}
+	if start > end {
+		return "", fmt.Errorf("start_line %d is after end_line %d", start, end)
+	}
+	return strings.Join(lines[start-1:end], ""), nil
+}
+
+func (e *Engine) writeFile(args json.RawMessage) (string, error) {
+	var params struct {
+		Path    string `json:"path"`
+		Content string `json:"content"`
+		Mode    string `json:"mode"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return "", fmt.Errorf("invalid arguments: %v", err)
+	}
+
+	if err := e.saveFile(params.Path, params.Content, params.Mode); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Successfully wrote to %s", params.Path), nil
+}
+
+// saveFile writes content to a workspace file for a tool, applying the
+// path policy, locking, the quota and the diff budget, and keeping the existing file's mode
+// and text format. mode, if not empty, is octal permissions.
+func (e *Engine) saveFile(path, content, mode string) error {
+	fullPath, err := e.resolvePath(path)
+	if err != nil {
+		return err
+	}
+	defer e.locks.write(fullPath)()
+
+	// Overwriting keeps the existing mode, notably the executable bit on
+	// scripts, unless a mode is given explicitly
+	perm := os.FileMode(0644)
+	format := textFormat{Encoding: "utf-8"}
+	before := ""
+	info, err := e.files().Stat(fullPath)
+	newFile := err != nil
+	if !newFile {
+		perm = info.Mode().Perm()
+		if existing, err := e.files().ReadFile(fullPath); err == nil {
+			before, format = decodeText(existing)
+		}
+	} else if e.licenses != nil {
+		content = e.licenses.addHeader(fullPath, content)
+	}
+	explicitMode := mode != ""
+	if explicitMode {
+		bits, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil || bits > 0777 {
+			return fmt.Errorf("invalid mode %q: expected octal permissions such as 0644 or 0755", mode)
+		}
+		perm = os.FileMode(bits)
+	}
+
+	if err := e.spendDiffBudget(budgetWrite{fullPath, before, content}); err != nil {
+		return err
+	}
+	data := encodeText(content, format)
+	if err := e.quota.reserve(int64(len(data)), newFile); err != nil {
+		return err
+	}
+
+	if err := e.files().MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %v", err)
+	}
+
+	if err := e.files().WriteFile(fullPath, data, perm); err != nil {
+		return fmt.Errorf("failed to write file: %v", err)
+	}
+	e.invalidateCommandCache()
+
+	// WriteFile only applies perm to new files, and then subject to umask
+	if explicitMode {
+		if err := e.files().Chmod(fullPath, perm); err != nil {
+			return fmt.Errorf("failed to set mode: %v", err)
+		}
+	}
+	return nil
+}
+
+func (e *Engine) extractToolCallsFromContent(content string) []ToolCall {
+	// The first parser that recognizes anything wins, so a call written in
+	// two formats at once is not picked up twice
+	for _, parser := range e.contentParsers {
+		toolCalls, warnings := parser.Parse(content)
+		for _, warning := range warnings {
+			e.logf("%s", warning)
+		}
+		if len(toolCalls) > 0 {
+			return toolCalls
+		}
+	}
+	return nil
+}
+
+// collectToolCalls merges native and content-extracted tool calls, dropping
+// duplicates (models sometimes emit the same call both ways) and giving each
+// call a unique ID that tool results can refer back to
+func (e *Engine) collectToolCalls(native []ToolCall, content string) []ToolCall {
+	var toolCalls []ToolCall
+	seen := make(map[string]bool)
+	usedIDs := make(map[string]bool)
+
+	candidates := append([]ToolCall{}, native...)
+	if content != "" {
+		candidates = append(candidates, e.extractToolCallsFromContent(content)...)
+	}
+
+	for _, toolCall := range candidates {
+		if args, repaired := repairArguments(toolCall.Function.Arguments); repaired {
+			e.logf("Repaired arguments for tool call: %s", toolCall.Function.Name)
+			toolCall.Function.Arguments = args
+		}
+		key := toolCall.Function.Name + "\x00" + canonicalArguments(toolCall.Function.Arguments)
+		if seen[key] {
+			e.logf("Skipping duplicate tool call: %s", toolCall.Function.Name)
+			continue
+		}
+		seen[key] = true
+
+		if toolCall.ID == "" || usedIDs[toolCall.ID] {
+			e.callCount++
+			toolCall.ID = fmt.Sprintf("call_%d", e.callCount)
+		}
+		usedIDs[toolCall.ID] = true
+		if toolCall.Type == "" {
+			toolCall.Type = "function"
+		}
+		toolCalls = append(toolCalls, toolCall)
+	}
+	return toolCalls
+}
+
+// canonicalArguments normalizes JSON arguments so that equivalent calls compare equal
+func canonicalArguments(args json.RawMessage) string {
+	var v interface{}
+	if err := json.Unmarshal(args, &v); err != nil {
+		return string(args)
+	}
+	canonical, err := json.Marshal(v)
+	if err != nil {
+		return string(args)
+	}
+	return string(canonical)
+}
+
+func (e *Engine) sendChatRequest(ctx context.Context, messages []Message) (*ChatResponse, error) {
+	tools := e.adapter.Tools(e.getTools())
+	if e.llamaCpp {
+		// The grammar is built from all the tools, which the adapter
+		// describes in the system prompt instead
+		tools = e.getTools()
+	}
+	reqBody := ChatRequest{
+		Model:    e.model,
+		Messages: messages,
+		Tools:    tools,
+		Stream:   e.stream,
+		Options:  e.options,
+	}
+	e.streamed = false
+	if e.stream {
+		reqBody.OnText = func(text string) {
+			e.streamed = true
+			e.emit(Event{Type: EventAssistantDelta, Turn: e.turn + 1, Text: text})
+		}
+	}
+	return e.postChat(ctx, reqBody)
+}
+
+// postChat sends a chat request to the model provider
+func (e *Engine) postChat(ctx context.Context, reqBody ChatRequest) (*ChatResponse, error) {
+	return e.modelProvider().SendChat(ctx, reqBody)
+}
+
+func (e *Engine) ProcessRequest(userMessage string) error {
+	return e.processRequest(context.Background(), userMessage)
+}
+
+func (e *Engine) processRequest(ctx context.Context, userMessage string) (err error) {
+	defer func() {
+		done := Event{Type: EventSessionDone, FinalAnswer: e.result}
+		if err != nil {
+			done.Error = err.Error()
+		}
+		e.emit(done)
+	}()
+	e.startLicenseCheck()
+	e.runCtx = ctx
+
+	promptContext := e.promptContext()
+	systemPrompt, err := expandTemplate("system_prompt.txt", e.systemPrompt, promptContext)
+	if err != nil {
+		return err
+	}
+	if e.templateUserMessage {
+		userMessage, err = expandTemplate("message", userMessage, promptContext)
+		if err != nil {
+			return err
+		}
+	}
+
+	if e.requireFinalAnswer {
+		systemPrompt = strings.TrimRight(systemPrompt, "\r\n") + "\n" + finalAnswerInstructions
+	}
+	if taskPrompt, taskType := e.taskPrompt(userMessage); taskPrompt != "" {
+		e.logf("Task type: %s", taskType)
+		systemPrompt = strings.TrimRight(systemPrompt, "\r\n") + "\n\n" + strings.TrimRight(taskPrompt, "\r\n")
+	}
+	if e.repoMap {
+		systemPrompt = strings.TrimRight(systemPrompt, "\r\n") + "\n\n" + e.buildRepoMap()
+	}
+	if e.gitContextCommits > 0 {
+		if gitContext := e.buildGitContext(e.gitContextCommits); gitContext != "" {
+			systemPrompt = strings.TrimRight(systemPrompt, "\r\n") + "\n\n" + gitContext
+		}
+	}
+
+	e.request = userMessage
+	e.intents = nil
+	e.noteIntents(userMessage, "request")
+	messages := []Message{{Role: "system", Content: e.adapter.SystemPrompt(systemPrompt, e.getTools())}}
+	messages = append(messages, e.history...)
+	messages = append(messages, Message{Role: "user", Content: userMessage, Images: encodeImages(e.images)})
+	e.images = nil
+	defer func() { e.conversation = messages[1:] }()
+	session := e.newSession()
+	reminders := 0
+	defer e.closeShell()
+	defer e.closePython()
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		e.emit(Event{Type: EventTurnStarted, Turn: e.turn + 1})
+		e.diffBudget.startTurn()
+		resp, err := e.sendChatRequest(ctx, messages)
+		if err != nil {
+			return fmt.Errorf("chat request failed: %v", err)
+		}
+		e.turn++
+		e.reply = resp.Message.Content
+		e.noteIntents(resp.Message.Content, "plan")
+		e.emit(Event{Type: EventAssistantText, Text: resp.Message.Content, ToolCalls: len(resp.Message.ToolCalls), Streamed: e.streamed})
+		e.debugf("Response content: %s", resp.Message.Content)
+		e.debugf("Tool calls count: %d", len(resp.Message.ToolCalls))
+
+		toolCalls := e.collectToolCalls(resp.Message.ToolCalls, resp.Message.Content)
+
+		reply := Message{
+			Role:      resp.Message.Role,
+			Content:   resp.Message.Content,
+			ToolCalls: toolCalls,
+		}
+		messages = append(messages, reply)
+
+		if len(toolCalls) == 0 {
+			if e.requireFinalAnswer && reminders < maxFinalAnswerReminders {
+				reminders++
+				messages = append(messages, Message{Role: "user", Content: finalAnswerReminder})
+				if err := e.recordTurn(session, messages, reply); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := e.recordTurn(session, messages, reply); err != nil {
+				return err
+			}
+			if e.requireFinalAnswer {
+				return fmt.Errorf("model finished without calling final_answer")
+			}
+			break
+		}
+
+		asked := messages[:len(messages)-1]
+		for _, toolCall := range toolCalls {
+			e.emit(Event{Type: EventToolStarted, Tool: toolCall.Function.Name, CallID: toolCall.ID, Arguments: toolCall.Function.Arguments})
+			start := time.Now()
+
+			result, err := e.callToolVoting(ctx, asked, toolCall)
+			if licenseErr := e.checkNewDependencies(); licenseErr != nil {
+				err = licenseErr
+			}
+			if err != nil {
+				result = fmt.Sprintf("Error: %v", err)
+			}
+			if err != nil || !contentTools[toolCall.Function.Name] {
+				result = e.relativePaths(result)
+			}
+			edited := e.editedArguments
+			e.editedArguments = nil
+			if edited != nil {
+				result = fmt.Sprintf("The user changed the arguments before approving the call, to: %s\n%s", edited, result)
+			}
+
+			messages = append(messages, Message{
+				Role:       "tool",
+				Content:    result,
+				ToolCallID: toolCall.ID,
+			})
+
+			e.emit(Event{
+				Type:     EventToolFinished,
+				Tool:     toolCall.Function.Name,
+				CallID:   toolCall.ID,
+				Result:   result,
+				Failed:   err != nil,
+				Duration: time.Since(start).Round(time.Millisecond).Seconds(),
+				Edited:   edited,
+			})
+		}
+		for _, answer := range e.answers {
+			messages = append(messages, Message{Role: "user", Content: answer})
+		}
+		e.answers = nil
+
+		if err := e.recordTurn(session, messages, reply); err != nil {
+			return err
+		}
+		if e.result != nil || e.question != "" {
+			break
+		}
+	}
+
+	return nil
+}
+
+// credentialVars are the environment variables holding secrets, which
+// are read once, at the start, and taken out of the environment, so that
+// commands the model runs can't print them
+var credentialVars = []string{
+	"AGENT_TOKEN", "ANTHROPIC_API_KEY", "OLLAMA_API_KEY", "OLLAMA_BASIC_AUTH", "IMAGE_API_KEY",
+	"SLACK_BOT_TOKEN", "SLACK_SIGNING_SECRET", "DISCORD_BOT_TOKEN", "DISCORD_PUBLIC_KEY",
+}
+
+// takeCredentials reads the credentialVars and removes them from the
+// environment
+func takeCredentials() map[string]string {
+	credentials := make(map[string]string)
+	for _, name := range credentialVars {
+		credentials[name] = os.Getenv(name)
+		os.Unsetenv(name)
+	}
+	return credentials
+}
+
+// Main runs the wex command line: flags, subcommands and a session, as
+// the wex binary does
+func Main() {
+	credentials := takeCredentials()
+	var (
+		seed         = flag.Int("seed", 0, "Sampling seed (default random, or fixed with --reproducible)")
+		temperature  = flag.Float64("temperature", 0, "Sampling temperature (default the model's own, or 0 with --reproducible)")
+		reproducible = flag.Bool("reproducible", false, "Use temperature 0 and a fixed seed unless overridden")
+		numCtx       = flag.Int("num-ctx", 0, "Context window in tokens (default the model's own)")
+		numPredict   = flag.Int("num-predict", 0, "Most tokens to generate in each reply (default the model's own; -1 for no limit)")
+		topP         = flag.Float64("top-p", 0, "Nucleus sampling probability (default the model's own)")
+		sessionPath  = flag.String("session", "", "Write the conversation and per-turn sampling options to this JSON file")
+		taskType     = flag.String("task-type", "auto", "Add guidance for this type of task to the system prompt: bug-fix, feature, refactor, test, review, auto to guess from the message, or none")
+		confirm      = flag.String("confirm", "", "Confirm these destructive intents in advance, comma-separated: wipe-data, force-push, delete-branch, discard-changes")
+		stdin        = flag.Bool("stdin", false, "Read the prompt and named files from standard input in wex-input/1 framing, for editor and CI integrations")
+		resume       = flag.String("resume", "", "Carry on the conversation in this wex session, OpenAI or Anthropic messages JSON, ChatGPT export or Aider chat history")
+		finalAnswer  = flag.Bool("final-answer", false, "Require a structured final answer, printed as JSON output")
+		templateMsg  = flag.Bool("template", false, "Expand template variables such as {{.GitBranch}} in the message")
+		noRepoMap    = flag.Bool("no-repo-map", false, "Do not include a map of the workspace in the system prompt")
+		gitContext   = flag.Int("git-context", 0, "Include the last N commits and uncommitted changes in the system prompt")
+		shellSession = flag.Bool("shell-session", false, "Run commands in one persistent shell, so environment variables and the directory carry over")
+		python       = flag.Bool("python", false, "Offer a run_python tool backed by a persistent Python interpreter")
+		images       = flag.Bool("images", false, "Offer tools to resize and convert images, and to generate them if IMAGE_API_URL is set")
+		noReadDedup  = flag.Bool("no-read-dedup", false, "Return the full contents when an unchanged file is read again")
+		ensemble     = flag.String("ensemble", "", "Also ask these models, comma-separated, for each write_file, and write only a version most models agree on")
+		judge        = flag.String("judge", "", "Model to pick a version when the --ensemble models disagree")
+		llamaCpp     = flag.String("llama-cpp", "", "Use the llama.cpp server at this URL instead of Ollama, with tool calls constrained by a grammar")
+		anthropic    = flag.Bool("anthropic", false, "Use Anthropic's Messages API instead of Ollama, with the key in ANTHROPIC_API_KEY")
+		stream       = flag.Bool("stream", false, "Show the model's reply as it is written, rather than waiting for the whole of it")
+		generate     = flag.Bool("generate", false, "Use /api/generate with the model's chat template instead of /api/chat, parsing tool calls from the reply")
+		readOnly     = flag.Bool("read-only", false, "Refuse writes by the file tools, for looking at a workspace without changing it")
+		verbose      = flag.Bool("verbose", false, "Log debugging output, such as each request to the model server and the check model's verdicts")
+		offline      = flag.Bool("offline", false, "Fail if anything would connect anywhere but the model server, and refuse network commands")
+		noPull       = flag.Bool("no-pull", false, "Fail if the model isn't on the Ollama server, rather than pulling it")
+		nonInteract  = flag.Bool("non-interactive", false, "Without OLLAMA_MODEL, use the server's first model rather than asking which")
+		planOutput   = flag.String("plan-output", "", "Write the changes the session proposes to this JSON file, without making them, for wex apply")
+		noProjTools  = flag.Bool("no-project-tools", false, "Do not offer test and script runners for the project types detected")
+		toolExamples = flag.Bool("tool-examples", false, "Add example arguments to tool descriptions, which helps smaller models call tools correctly")
+		enableTools  = flag.String("tools", "", "Offer only these tools, as a comma-separated list")
+		output       = flag.String("output", "plain", "How to show the session: plain, pretty, json or sse")
+		disableTools = flag.String("disable-tools", "", "Do not offer these tools, as a comma-separated list")
+	)
+	var stop []string
+	flag.Func("stop", "Stop generating at this text; may be given more than once", func(s string) error {
+		stop = append(stop, s)
+		return nil
+	})
+	var attached [][]byte
+	flag.Func("image", "Send this image with the message, for a multimodal model, or \"clipboard\" to paste one; may be given more than once", func(s string) error {
+		image, err := readImageArg(s)
+		if err != nil {
+			return err
+		}
+		attached = append(attached, image)
+		return nil
+	})
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: wex [flags] <message>\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "       wex [flags] --stdin [message] < INPUT\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "       wex [flags] fix [--from-stderr | --log FILE] [instructions]\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "       wex [flags] bench [--models LIST] [--tasks DIR] [--json FILE] [--keep] [-v] [task...]\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "       wex [flags] eval [--models LIST] [--predictions FILE] [--json FILE] [--keep] [-v] TASKS.jsonl [instance_id...]\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "       wex [flags] review [--diff REF] [--focus TEXT] [--sarif FILE] [--json FILE] [path...]\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "       wex [flags] migrate [--files GLOBS] [--verify CMD] [--batch N] [--batches N] [--commit] [--status] [instructions]\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "       wex [flags] resolve [--verify CMD] [--batch N] [--retries N] [path...]\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "       wex [flags] deflake --cmd CMD [--runs N] [--timeout D] [--since DATE] [--report] [instructions]\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "       wex [flags] optimize --bench CMD [--test CMD] [--profile CMD] [--metric REGEX] [--iterations N] [--min-gain PERCENT] [instructions]\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "       wex [flags] audit [--scanners LIST] [--severity LEVEL] [--max N] [--verify CMD] [--report FILE] [--scan-only] [instructions]\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "       wex [flags] upgrade-deps [--verify CMD] [--only PATTERNS] [--skip PATTERNS] [--latest] [--commit] [--dry-run] [instructions]\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "       wex [flags] serve [--listen ADDRESS]\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "       wex [flags] team [--config FILE] [--transcript FILE] [--rounds N] task\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "       wex [flags] license-check [--fix]\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "       wex [flags] commit-msg [--commit | --amend] [--changelog] [-o FILE] [hint]\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "       wex share [-o BUNDLE] [--workspace DIR] SESSION\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "       wex [--output FORMAT] import [--patch FILE] BUNDLE\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "       wex decrypt SESSION\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "       wex apply [--check] PLAN\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	setFlags := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
+
+	// Sharing and importing work on files, with no model involved
+	switch flag.Arg(0) {
+	case "share":
+		if err := runShare(flag.Args()[1:], os.Stdout); err != nil {
+			log.Fatalf("share: %v", err)
+		}
+		return
+	case "import":
+		if err := runImport(flag.Args()[1:], *output, os.Stdout); err != nil {
+			log.Fatalf("import: %v", err)
+		}
+		return
+	case "decrypt":
+		if err := runDecrypt(flag.Args()[1:], os.Stdout); err != nil {
+			log.Fatalf("decrypt: %v", err)
+		}
+		return
+	}
+
+	options, err := parseModelOptions(os.Getenv("OLLAMA_OPTIONS"))
+	if err != nil {
+		log.Fatalf("Invalid OLLAMA_OPTIONS: %v", err)
+	}
+	if *reproducible {
+		options["temperature"] = 0.0
+		options["seed"] = reproducibleSeed
+	}
+	if setFlags["temperature"] {
+		options["temperature"] = *temperature
+	}
+	if setFlags["seed"] {
+		options["seed"] = *seed
+	}
+	if setFlags["num-ctx"] {
+		if *numCtx <= 0 {
+			log.Fatalf("Invalid --num-ctx %d: must be a positive number of tokens", *numCtx)
+		}
+		options["num_ctx"] = *numCtx
+	}
+	if setFlags["num-predict"] {
+		options["num_predict"] = *numPredict
+	}
+	if setFlags["top-p"] {
+		if *topP <= 0 || *topP > 1 {
+			log.Fatalf("Invalid --top-p %g: must be more than 0 and at most 1", *topP)
+		}
+		options["top_p"] = *topP
+	}
+	if len(stop) > 0 {
+		options["stop"] = stop
+	}
+
+	ollamaURL := os.Getenv("OLLAMA_URL")
+	if ollamaURL == "" {
+		ollamaURL = "http://192.168.0.63:11434"
+	}
+
+	model := os.Getenv("OLLAMA_MODEL")
+
+	workspace := os.Getenv("WORKSPACE")
+	if workspace == "" {
+		workspace = "/workspace"
+	}
+
+	// Applying a plan only changes files, with no model involved
+	if flag.Arg(0) == "apply" {
+		if err := runApply(workspace, flag.Args()[1:], os.Stdout); err != nil {
+			log.Fatalf("apply: %v", err)
+		}
+		return
+	}
+
+	// Nor does editing the schedule of recurring tasks, which wex serve runs
+	if flag.Arg(0) == "schedule" {
+		if err := runSchedule(workspace, flag.Args()[1:], os.Stdout); err != nil {
+			log.Fatalf("schedule: %v", err)
+		}
+		return
+	}
+
+	contentToolCalls := os.Getenv("CONTENT_TOOL_CALLS")
+	switch contentToolCalls {
+	case "":
+		contentToolCalls = "auto"
+	case "auto", "sentinel", "off":
+	default:
+		log.Fatalf("Invalid CONTENT_TOOL_CALLS %q: must be auto, sentinel or off", contentToolCalls)
+	}
+
+	headers, err := parseHeaders(os.Getenv("OLLAMA_HEADERS"))
+	if err != nil {
+		log.Fatalf("Invalid OLLAMA_HEADERS: %v", err)
+	}
+	maxAttempts := defaultMaxAttempts
+	if value := os.Getenv("REQUEST_ATTEMPTS"); value != "" {
+		maxAttempts, err = strconv.Atoi(value)
+		if err != nil || maxAttempts < 1 {
+			log.Fatalf("Invalid REQUEST_ATTEMPTS %q: must be a number of attempts, or 1 not to try again", value)
+		}
+	}
+
+	client, err := newHTTPClient(ClientConfig{
+		ProxyURL:           os.Getenv("OLLAMA_PROXY"),
+		CACertFile:         os.Getenv("OLLAMA_CA_CERT"),
+		ClientCertFile:     os.Getenv("OLLAMA_CLIENT_CERT"),
+		ClientKeyFile:      os.Getenv("OLLAMA_CLIENT_KEY"),
+		InsecureSkipVerify: os.Getenv("OLLAMA_INSECURE_SKIP_VERIFY") == "1",
+		BearerToken:        credentials["OLLAMA_API_KEY"],
+		BasicAuth:          credentials["OLLAMA_BASIC_AUTH"],
+		Headers:            headers,
+	})
+	if err != nil {
+		log.Fatalf("Invalid HTTP client configuration: %v", err)
+	}
+	if os.Getenv("OLLAMA_INSECURE_SKIP_VERIFY") == "1" {
+		fmt.Fprintln(os.Stderr, "Warning: TLS certificate verification is disabled")
+	}
+
+	if *llamaCpp != "" {
+		ollamaURL = strings.TrimRight(*llamaCpp, "/")
+		if model == "" {
+			model, err = llamaCppModel(client, ollamaURL)
+			if err != nil {
+				log.Fatalf("Failed to get model from llama.cpp server: %v", err)
+			}
+		}
+	}
+
+	// Without a model named, ask which of the server's to use, unless there
+	// is no one to ask
+	if model == "" && *llamaCpp == "" && !*anthropic && !*nonInteract && !*stdin && isTerminal(os.Stdin) {
+		model, err = pickModel(client, ollamaURL)
+		if err != nil {
+			log.Fatalf("Failed to pick a model: %v", err)
+		}
+	}
+
+	anthropicKey := ""
+	if *anthropic {
+		if *llamaCpp != "" || *generate {
+			log.Fatal("--anthropic can't be used with --llama-cpp or --generate")
+		}
+		anthropicKey = credentials["ANTHROPIC_API_KEY"]
+		if anthropicKey == "" {
+			log.Fatal("--anthropic needs an API key in ANTHROPIC_API_KEY")
+		}
+		ollamaURL = strings.TrimRight(os.Getenv("ANTHROPIC_URL"), "/")
+		if ollamaURL == "" {
+			ollamaURL = defaultAnthropicURL
+		}
+		if model == "" {
+			model = defaultAnthropicModel
+		}
+		// The client set up for Ollama may carry its token, headers and
+		// certificates, which are not for Anthropic
+		client = &http.Client{}
+	}
+
+	engine, err := NewEngine(client, ollamaURL, model, workspace)
+	if err != nil {
+		log.Fatalf("Failed to create engine: %v", err)
+	}
+	engine.maxAttempts = maxAttempts
+	newRenderer, ok := renderers[*output]
+	if !ok {
+		log.Fatalf("Invalid --output %q: must be plain, pretty, json or sse", *output)
+	}
+	engine.renderer = newRenderer(os.Stdout)
+	engine.adapter, err = adapterForModel(os.Getenv("PROMPT_ADAPTER"), engine.model)
+	if err != nil {
+		log.Fatalf("Invalid PROMPT_ADAPTER: %v", err)
+	}
+	if *generate {
+		engine.generateTemplate, err = chatTemplateForModel(os.Getenv("GENERATE_TEMPLATE"), engine.model)
+		if err != nil {
+			log.Fatalf("Invalid GENERATE_TEMPLATE: %v", err)
+		}
+		engine.adapter = generateAdapter(engine.adapter, engine.generateTemplate)
+	}
+	engine.anthropicKey = anthropicKey
+	engine.stream = *stream
+	if *llamaCpp != "" {
+		engine.llamaCpp = true
+		engine.generateTemplate, err = chatTemplateForModel(os.Getenv("GENERATE_TEMPLATE"), engine.model)
+		if err != nil {
+			log.Fatalf("Invalid GENERATE_TEMPLATE: %v", err)
+		}
+		engine.adapter = grammarAdapter
+	}
+	engine.contentParsers, err = newContentParsers(os.Getenv("CONTENT_PARSERS"), contentToolCalls, engine.adapter.ContentParsers())
+	if err != nil {
+		log.Fatalf("Invalid CONTENT_PARSERS: %v", err)
+	}
+	engine.options = options
+	if value := os.Getenv("WRITE_QUOTA_BYTES"); value != "" {
+		engine.quota.MaxBytes, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || engine.quota.MaxBytes < 0 {
+			log.Fatalf("Invalid WRITE_QUOTA_BYTES %q: must be a number of bytes, or 0 for no limit", value)
+		}
+	}
+	if value := os.Getenv("FILE_QUOTA"); value != "" {
+		engine.quota.MaxFiles, err = strconv.Atoi(value)
+		if err != nil || engine.quota.MaxFiles < 0 {
+			log.Fatalf("Invalid FILE_QUOTA %q: must be a number of files, or 0 for no limit", value)
+		}
+	}
+	if value := os.Getenv("DIFF_BUDGET_LINES"); value != "" {
+		engine.diffBudget.MaxLines, err = strconv.Atoi(value)
+		if err != nil || engine.diffBudget.MaxLines < 0 {
+			log.Fatalf("Invalid DIFF_BUDGET_LINES %q: must be a number of lines, or 0 for no limit", value)
+		}
+	}
+	if value := os.Getenv("DIFF_BUDGET_FILES"); value != "" {
+		engine.diffBudget.MaxFiles, err = strconv.Atoi(value)
+		if err != nil || engine.diffBudget.MaxFiles < 0 {
+			log.Fatalf("Invalid DIFF_BUDGET_FILES %q: must be a number of files, or 0 for no limit", value)
+		}
+	}
+	if path := os.Getenv("COMMAND_ANSWERS"); path != "" {
+		engine.commandAnswers, err = loadCommandAnswers(path)
+		if err != nil {
+			log.Fatalf("Invalid COMMAND_ANSWERS: %v", err)
+		}
+	}
+	engine.forwardInput = os.Getenv("FORWARD_INPUT") == "1"
+	engine.checkModel = os.Getenv("CHECK_MODEL")
+	if engine.taskType, err = parseTaskType(*taskType); err != nil {
+		log.Fatalf("Invalid --task-type: %v", err)
+	}
+	if engine.confirmedIntents, err = parseIntentList(*confirm); err != nil {
+		log.Fatalf("Invalid --confirm: %v", err)
+	}
+	if path := os.Getenv("TOOL_POLICY"); path != "" {
+		engine.toolPolicy, err = loadToolPolicy(path)
+		if err != nil {
+			log.Fatalf("Invalid TOOL_POLICY: %v", err)
+		}
+	}
+	engine.commandPolicy, err = parseCommandPolicy(os.Getenv("COMMAND_POLICY"))
+	if err != nil {
+		log.Fatalf("Invalid COMMAND_POLICY: %v", err)
+	}
+	switch policy := os.Getenv("PACKAGE_POLICY"); policy {
+	case "", policyAllow, policyAsk, policyDeny, packageSandbox:
+		engine.packagePolicy = policy
+	default:
+		log.Fatalf("Invalid PACKAGE_POLICY %q: must be allow, ask, deny or sandbox", policy)
+	}
+	switch policy := os.Getenv("SYMLINK_POLICY"); policy {
+	case "":
+	case symlinkWithin, symlinkFollow, symlinkDeny:
+		engine.symlinkPolicy = policy
+	default:
+		log.Fatalf("Invalid SYMLINK_POLICY %q: must be within, follow or deny", policy)
+	}
+	if value := os.Getenv("MAX_READ_BYTES"); value != "" {
+		engine.maxReadBytes, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || engine.maxReadBytes < 0 {
+			log.Fatalf("Invalid MAX_READ_BYTES %q: must be a number of bytes, or 0 for no limit", value)
+		}
+	}
+	engine.agentPeers, err = parseAgentPeers(os.Getenv("AGENT_PEERS"))
+	if err != nil {
+		log.Fatalf("Invalid AGENT_PEERS: %v", err)
+	}
+	engine.agentToken = credentials["AGENT_TOKEN"]
+	if headerPath, allowed := os.Getenv("LICENSE_HEADER"), os.Getenv("ALLOWED_LICENSES"); headerPath != "" || allowed != "" {
+		engine.licenses = &licensePolicy{}
+		if headerPath != "" {
+			data, err := os.ReadFile(headerPath)
+			if err != nil {
+				log.Fatalf("Invalid LICENSE_HEADER: %v", err)
+			}
+			engine.licenses.header = string(data)
+		}
+		for _, id := range strings.Split(allowed, ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				engine.licenses.allowed = append(engine.licenses.allowed, id)
+			}
+		}
+	}
+	engine.sessionPath = *sessionPath
+	engine.hostWorkspace = os.Getenv("HOST_WORKSPACE")
+	if engine.sessionKey, err = sessionKeyFromEnv(); err != nil {
+		log.Fatalf("Invalid SESSION_KEY_FILE: %v", err)
+	}
+	if *resume != "" {
+		var format string
+		engine.history, format, err = loadConversation(*resume, engine.sessionKey)
+		if err != nil {
+			log.Fatalf("Failed to resume: %v", err)
+		}
+		engine.logf("Resuming %d messages from %s (%s)", len(engine.history), *resume, format)
+	}
+	engine.requireFinalAnswer = *finalAnswer
+	engine.templateUserMessage = *templateMsg
+	engine.repoMap = !*noRepoMap
+	engine.gitContextCommits = *gitContext
+	engine.persistentShell = *shellSession
+	engine.pythonTool = *python
+	engine.imageTools = *images
+	engine.images = attached
+	if len(attached) > 0 && (engine.llamaCpp || engine.generateTemplate != nil) {
+		log.Fatal("--image needs /api/chat or Anthropic, so can't be used with --llama-cpp or --generate")
+	}
+	engine.projectToolsEnabled = !*noProjTools
+	engine.toolExamples = *toolExamples
+	engine.readDedup = !*noReadDedup
+	if *readOnly {
+		engine.filesystem = readOnlyFS{osFS{}}
+	}
+	if *ensemble != "" {
+		if engine.llamaCpp || engine.generateTemplate != nil {
+			log.Fatal("--ensemble needs /api/chat, so can't be used with --llama-cpp or --generate")
+		}
+		for _, model := range strings.Split(*ensemble, ",") {
+			if model = strings.TrimSpace(model); model != "" {
+				engine.ensembleModels = append(engine.ensembleModels, model)
+			}
+		}
+	}
+	engine.judgeModel = *judge
+	engine.imageAPI = ImageAPIConfig{
+		URL:   os.Getenv("IMAGE_API_URL"),
+		Key:   credentials["IMAGE_API_KEY"],
+		Model: os.Getenv("IMAGE_MODEL"),
+	}
+	availableTools := engine.getTools()
+	if setFlags["tools"] {
+		engine.toolFilter.Enabled, err = parseToolList(*enableTools, availableTools)
+		if err != nil {
+			log.Fatalf("Invalid --tools: %v", err)
+		}
+	}
+	engine.toolFilter.Disabled, err = parseToolList(*disableTools, availableTools)
+	if err != nil {
+		log.Fatalf("Invalid --disable-tools: %v", err)
+	}
+	engine.notifyConfig = NotifyConfig{
+		WebhookURL: os.Getenv("NOTIFY_WEBHOOK"),
+		NtfyURL:    os.Getenv("NOTIFY_NTFY"),
+		Pushover:   os.Getenv("NOTIFY_PUSHOVER"),
+		Desktop:    os.Getenv("NOTIFY_DESKTOP") == "1",
+	}
+	engine.offline = *offline
+	engine.verbose = *verbose
+	if err := engine.checkOffline(); err != nil {
+		log.Fatal(err)
+	}
+	engine.noPull = *noPull
+	if err := engine.ensureModels(context.Background(), os.Stderr); err != nil {
+		log.Fatal(err)
+	}
+
+	// Only the message goes to standard output, for use in scripts
+	if flag.Arg(0) == "commit-msg" {
+		engine.renderer = newRenderer(os.Stderr)
+		if err := runCommitMsg(engine, flag.Args()[1:], os.Stdout); err != nil {
+			log.Fatalf("commit-msg: %v", err)
+		}
+		return
+	}
+
+	engine.logf("Using model: %s", engine.model)
+	engine.logf("Using prompt adapter: %s", engine.adapter.Name())
+
+	if flag.NArg() < 1 && !*stdin {
+		log.Fatal("Usage: wex [flags] <message>")
+	}
+
+	if flag.Arg(0) == "bench" {
+		if err := runBench(engine, flag.Args()[1:], os.Stdout); err != nil {
+			log.Fatalf("bench: %v", err)
+		}
+		return
+	}
+	if flag.Arg(0) == "review" {
+		if err := runCodeReview(engine, flag.Args()[1:], os.Stdout); err != nil {
+			log.Fatalf("review: %v", err)
+		}
+		return
+	}
+	if flag.Arg(0) == "migrate" {
+		if err := runMigrate(engine, flag.Args()[1:], os.Stdout); err != nil {
+			log.Fatalf("migrate: %v", err)
+		}
+		return
+	}
+	if flag.Arg(0) == "resolve" {
+		if err := runResolve(engine, flag.Args()[1:], os.Stdout); err != nil {
+			log.Fatalf("resolve: %v", err)
+		}
+		return
+	}
+	if flag.Arg(0) == "deflake" {
+		if err := runDeflake(engine, flag.Args()[1:], os.Stdout); err != nil {
+			log.Fatalf("deflake: %v", err)
+		}
+		return
+	}
+	if flag.Arg(0) == "optimize" {
+		if err := runOptimize(engine, flag.Args()[1:], os.Stdout); err != nil {
+			log.Fatalf("optimize: %v", err)
+		}
+		return
+	}
+	if flag.Arg(0) == "upgrade-deps" {
+		if err := runUpgradeDeps(engine, flag.Args()[1:], os.Stdout); err != nil {
+			log.Fatalf("upgrade-deps: %v", err)
+		}
+		return
+	}
+	if flag.Arg(0) == "audit" {
+		if err := runAudit(engine, flag.Args()[1:], os.Stdout); err != nil {
+			log.Fatalf("audit: %v", err)
+		}
+		return
+	}
+	if flag.Arg(0) == "serve" {
+		if err := runServe(engine, flag.Args()[1:], credentials, os.Stdout); err != nil {
+			log.Fatalf("serve: %v", err)
+		}
+		return
+	}
+	if flag.Arg(0) == "team" {
+		if err := runTeam(engine, flag.Args()[1:], os.Stdout); err != nil {
+			log.Fatalf("team: %v", err)
+		}
+		return
+	}
+	if flag.Arg(0) == "license-check" {
+		if err := runLicenseCheck(engine, flag.Args()[1:], os.Stdout); err != nil {
+			log.Fatalf("license-check: %v", err)
+		}
+		return
+	}
+	if flag.Arg(0) == "eval" {
+		if err := runEval(engine, flag.Args()[1:], os.Stdout); err != nil {
+			log.Fatalf("eval: %v", err)
+		}
+		return
+	}
+
+	userMessage := strings.Join(flag.Args(), " ")
+	if *stdin {
+		input, err := parseStdinInput(os.Stdin)
+		if err != nil {
+			log.Fatalf("Invalid --stdin input: %v", err)
+		}
+		if strings.TrimSpace(input.Prompt) == "" && userMessage == "" {
+			log.Fatal("No prompt: --stdin input has none, and no message was given")
+		}
+		userMessage = input.message(userMessage)
+	} else if flag.Arg(0) == "fix" {
+		userMessage, err = fixMessage(engine, flag.Args()[1:])
+		if err != nil {
+			log.Fatalf("fix: %v", err)
+		}
+		if engine.taskType == taskTypeAuto {
+			engine.taskType = "bug-fix"
+		}
+	}
+	if *planOutput != "" {
+		engine.startPlan()
+	}
+	if err := engine.ProcessRequest(userMessage); err != nil {
+		engine.notify("failed", err.Error())
+		log.Fatalf("Error processing request: %v", err)
+	}
+	if engine.question != "" {
+		engine.logf("Paused for an answer: %s", engine.question)
+		if len(engine.choices) > 0 {
+			engine.logf("Choices: %s", strings.Join(engine.choices, ", "))
+		}
+		if *sessionPath != "" {
+			engine.logf("Carry on with: wex --resume %s \"ANSWER\"", *sessionPath)
+		} else {
+			engine.logf("Run with --session to be able to carry on with --resume")
+		}
+		return
+	}
+	if *planOutput != "" {
+		plan, err := engine.writePlan(*planOutput, userMessage)
+		if err != nil {
+			log.Fatalf("Failed to write the plan: %v", err)
+		}
+		engine.logf("Wrote %s to %s; make them with: wex apply %s", plural(len(plan.Changes), "proposed change"), *planOutput, *planOutput)
+	}
+
+	summary := "Task finished"
+	if engine.result != nil {
+		summary = engine.result.Summary
+	}
+	engine.notify("completed", summary)
+}
+
+// fixMessage handles "wex fix", which reads a crash log from a file or
+// standard input and asks for a fix with the referenced code in context
+func fixMessage(engine *Engine, args []string) (string, error) {
+	fixFlags := flag.NewFlagSet("fix", flag.ExitOnError)
+	fromStderr := fixFlags.Bool("from-stderr", false, "Read the crash log from standard input, e.g. go test 2>&1 | wex fix --from-stderr")
+	logFile := fixFlags.String("log", "", "Read the crash log from this file")
+	fixFlags.Parse(args)
+
+	var crashLog []byte
+	var err error
+	switch {
+	case *logFile != "":
+		crashLog, err = os.ReadFile(*logFile)
+	case *fromStderr:
+		crashLog, err = io.ReadAll(os.Stdin)
+	default:
+		// Accept a piped log without --from-stderr, but never wait on a terminal
+		if info, statErr := os.Stdin.Stat(); statErr == nil && info.Mode()&os.ModeCharDevice == 0 {
+			crashLog, err = io.ReadAll(os.Stdin)
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read crash log: %v", err)
+	}
+	if strings.TrimSpace(string(crashLog)) == "" {
+		return "", fmt.Errorf("no crash log: pipe one in with --from-stderr or give --log FILE")
+	}
+	return engine.buildFixMessage(string(crashLog), strings.Join(fixFlags.Args(), " ")), nil
+}
\ No newline at end of file
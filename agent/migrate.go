@@ -0,0 +1,383 @@
+package agent
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A migration changes many files the same way, more than fit in one
+// session. The ledger, a JSON file in the workspace, lists the files and
+// how far each has got, and is rewritten after every batch, so a migration
+// can be stopped at any point and continued by running wex migrate again.
+// Files that were in the batch being worked on when a run stopped are
+// done again first.
+
+const defaultMigrationLedger = ".wex-migration.json"
+
+const (
+	migrationPending    = "pending"
+	migrationInProgress = "in-progress"
+	migrationDone       = "done"
+	migrationFailed     = "failed"
+)
+
+type migrationLedger struct {
+	Instructions string           `json:"instructions"`
+	Globs        []string         `json:"globs"`
+	Match        string           `json:"match,omitempty"`
+	Verify       string           `json:"verify,omitempty"`
+	Started      time.Time        `json:"started"`
+	Updated      time.Time        `json:"updated"`
+	Batches      int              `json:"batches"`
+	Files        []*migrationFile `json:"files"`
+}
+
+type migrationFile struct {
+	Path     string `json:"path"`
+	Status   string `json:"status"`
+	Batch    int    `json:"batch,omitempty"`
+	Changed  bool   `json:"changed,omitempty"`
+	Attempts int    `json:"attempts,omitempty"`
+	Note     string `json:"note,omitempty"`
+}
+
+func loadMigrationLedger(path string) (*migrationLedger, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var ledger migrationLedger
+	if err := json.Unmarshal(data, &ledger); err != nil {
+		return nil, fmt.Errorf("invalid ledger %s: %v", path, err)
+	}
+	return &ledger, nil
+}
+
+// save writes the ledger to a temporary file and renames it into place, so
+// an interruption leaves either the old ledger or the new one
+func (l *migrationLedger) save(path string) error {
+	l.Updated = time.Now()
+	data, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal ledger: %v", err)
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write ledger: %v", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write ledger: %v", err)
+	}
+	return nil
+}
+
+func (l *migrationLedger) count(status string) int {
+	n := 0
+	for _, f := range l.Files {
+		if f.Status == status {
+			n++
+		}
+	}
+	return n
+}
+
+// nextBatch picks up to n files to migrate, those interrupted first
+func (l *migrationLedger) nextBatch(n int) []*migrationFile {
+	var batch []*migrationFile
+	for _, status := range []string{migrationInProgress, migrationPending} {
+		for _, f := range l.Files {
+			if f.Status == status && len(batch) < n {
+				batch = append(batch, f)
+			}
+		}
+	}
+	return batch
+}
+
+func (l *migrationLedger) status() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Migration: %s\n", l.Instructions)
+	fmt.Fprintf(&b, "%d of %d files done, %d pending, %d failed, in %d batches\n",
+		l.count(migrationDone), len(l.Files), l.count(migrationPending)+l.count(migrationInProgress), l.count(migrationFailed), l.Batches)
+	for _, f := range l.Files {
+		if f.Status == migrationFailed {
+			note, _, _ := strings.Cut(f.Note, "\n")
+			fmt.Fprintf(&b, "  failed: %s: %s\n", f.Path, note)
+		}
+	}
+	return b.String()
+}
+
+// migrationFiles lists the files under the workspace matching any of the
+// globs and, if match is given, with content it matches
+func (e *Engine) migrationFiles(globs []string, match string) ([]string, error) {
+	var scopes []*regexp.Regexp
+	for _, glob := range globs {
+		scope, err := globRegexp(glob)
+		if err != nil {
+			return nil, err
+		}
+		scopes = append(scopes, scope)
+	}
+	var content *regexp.Regexp
+	if match != "" {
+		var err error
+		if content, err = regexp.Compile(match); err != nil {
+			return nil, fmt.Errorf("invalid --match: %v", err)
+		}
+	}
+
+	var paths []string
+	walkDir(e.files(), e.workspace, func(fullPath string, d fs.DirEntry, err error) error {
+		if err != nil || fullPath == e.workspace {
+			return nil
+		}
+		rel, _ := filepath.Rel(e.workspace, fullPath)
+		rel = filepath.ToSlash(rel)
+		if d.IsDir() {
+			if skippedDirs[d.Name()] || strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		for _, scope := range scopes {
+			if !scope.MatchString(rel) {
+				continue
+			}
+			if content != nil {
+				data, err := e.files().ReadFile(fullPath)
+				if err != nil || !content.Match(data) {
+					return nil
+				}
+			}
+			paths = append(paths, rel)
+			return nil
+		}
+		return nil
+	})
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// runMigrate handles "wex migrate", which carries out a migration over many
+// files in batches, keeping track of progress in a ledger
+func runMigrate(engine *Engine, args []string, w io.Writer) error {
+	migrateFlags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	ledgerPath := migrateFlags.String("ledger", defaultMigrationLedger, "Ledger file, relative to the workspace")
+	globs := migrateFlags.String("files", "", "Files to migrate, as comma-separated globs, e.g. \"handlers/**/*.go\"; needed to start a migration")
+	match := migrateFlags.String("match", "", "Only migrate files whose content matches this regular expression, e.g. the old framework's import")
+	verify := migrateFlags.String("verify", "", "Command that must pass after each batch, e.g. \"go build ./... && go test ./...\"")
+	batchSize := migrateFlags.Int("batch", 5, "Files per batch")
+	maxBatches := migrateFlags.Int("batches", 0, "Stop after this many batches (default all)")
+	retries := migrateFlags.Int("retries", 1, "Times the model may fix a batch that fails verification")
+	commit := migrateFlags.Bool("commit", false, "Commit each batch that passes verification")
+	retryFailed := migrateFlags.Bool("retry-failed", false, "Try failed files again")
+	status := migrateFlags.Bool("status", false, "Show progress and exit")
+	reset := migrateFlags.Bool("reset", false, "Discard the ledger and start a new migration")
+	migrateFlags.Usage = func() {
+		fmt.Fprintf(migrateFlags.Output(), "Usage: wex [flags] migrate --files GLOBS [--match REGEX] [--verify CMD] [--batch N] [--batches N] [--commit] INSTRUCTIONS\n")
+		fmt.Fprintf(migrateFlags.Output(), "       wex [flags] migrate [--batches N] [--retry-failed] [--status]   (continue)\n")
+		migrateFlags.PrintDefaults()
+	}
+	migrateFlags.Parse(args)
+	instructions := strings.Join(migrateFlags.Args(), " ")
+	if *batchSize < 1 {
+		return fmt.Errorf("--batch must be at least 1")
+	}
+
+	path := *ledgerPath
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(engine.workspace, path)
+	}
+	ledger, err := loadMigrationLedger(path)
+	switch {
+	case err == nil && *reset:
+		ledger = nil
+	case err == nil && instructions != "" && instructions != ledger.Instructions:
+		return fmt.Errorf("a migration is already under way in %s (%s); give no instructions to continue it, or --reset to start another", *ledgerPath, ledger.Instructions)
+	case err == nil && (*globs != "" || *match != ""):
+		return fmt.Errorf("the files of the migration under way can't be changed; use --reset to start another")
+	case err != nil && !os.IsNotExist(err):
+		return err
+	}
+
+	if ledger == nil {
+		if *status {
+			return fmt.Errorf("no migration under way")
+		}
+		if instructions == "" || *globs == "" {
+			return fmt.Errorf("no migration under way; start one with --files GLOBS and instructions")
+		}
+		ledger = &migrationLedger{Instructions: instructions, Match: *match, Started: time.Now()}
+		for _, glob := range strings.Split(*globs, ",") {
+			if glob = strings.TrimSpace(glob); glob != "" {
+				ledger.Globs = append(ledger.Globs, glob)
+			}
+		}
+		paths, err := engine.migrationFiles(ledger.Globs, ledger.Match)
+		if err != nil {
+			return err
+		}
+		if len(paths) == 0 {
+			return fmt.Errorf("no files match %s", *globs)
+		}
+		for _, p := range paths {
+			ledger.Files = append(ledger.Files, &migrationFile{Path: p, Status: migrationPending})
+		}
+		fmt.Fprintf(w, "Starting migration of %d files; progress is kept in %s\n", len(paths), *ledgerPath)
+	}
+	if *verify != "" {
+		ledger.Verify = *verify
+	}
+	if *status {
+		fmt.Fprint(w, ledger.status())
+		return nil
+	}
+	if *retryFailed {
+		for _, f := range ledger.Files {
+			if f.Status == migrationFailed {
+				f.Status = migrationPending
+			}
+		}
+	}
+	if err := ledger.save(path); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	for n := 0; *maxBatches == 0 || n < *maxBatches; n++ {
+		batch := ledger.nextBatch(*batchSize)
+		if len(batch) == 0 {
+			break
+		}
+		if err := engine.migrateBatch(ctx, ledger, path, batch, *retries, *commit, w); err != nil {
+			return err
+		}
+	}
+	fmt.Fprint(w, ledger.status())
+	if ledger.count(migrationFailed) > 0 {
+		return fmt.Errorf("some files failed; fix them, then run wex migrate --retry-failed")
+	}
+	return nil
+}
+
+// migrateBatch has the model migrate a batch of files, checks the result
+// with the verify command, and records the outcome in the ledger
+func (e *Engine) migrateBatch(ctx context.Context, ledger *migrationLedger, path string, batch []*migrationFile, retries int, commit bool, w io.Writer) error {
+	ledger.Batches++
+	var names []string
+	var interrupted []string
+	before := make(map[string][32]byte)
+	for _, f := range batch {
+		names = append(names, f.Path)
+		if f.Status == migrationInProgress {
+			interrupted = append(interrupted, f.Path)
+		}
+		f.Status = migrationInProgress
+		f.Batch = ledger.Batches
+		f.Attempts++
+		data, _ := os.ReadFile(filepath.Join(e.workspace, filepath.FromSlash(f.Path)))
+		before[f.Path] = sha256.Sum256(data)
+	}
+	// Saved before starting, so an interruption leaves the batch marked
+	if err := ledger.save(path); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Batch %d: %s\n", ledger.Batches, strings.Join(names, ", "))
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "This is one batch of a migration across the project: %s\n\n", ledger.Instructions)
+	fmt.Fprintf(&b, "Migrate these files in this batch:\n")
+	for _, name := range names {
+		fmt.Fprintf(&b, "- %s\n", name)
+	}
+	if len(interrupted) > 0 {
+		fmt.Fprintf(&b, "\nAn earlier run stopped partway through %s, so they may be partly migrated already.\n", strings.Join(interrupted, ", "))
+	}
+	fmt.Fprintf(&b, "\n%d of %d files are done; the rest will be migrated in later batches. Change other files only where these need it to build, and don't migrate them.",
+		ledger.count(migrationDone), len(ledger.Files))
+	if ledger.Verify != "" {
+		fmt.Fprintf(&b, " After this batch, `%s` must pass.", ledger.Verify)
+	}
+
+	message := b.String()
+	passed, output := true, ""
+	for attempt := 0; ; attempt++ {
+		if _, err := e.Run(ctx, message); err != nil {
+			// The batch stays in progress, to be done again on the next run
+			ledger.save(path)
+			return fmt.Errorf("batch %d: %v", ledger.Batches, err)
+		}
+		if ledger.Verify == "" {
+			break
+		}
+		passed, output = runCheck(e.workspace, ledger.Verify)
+		if passed || attempt >= retries {
+			break
+		}
+		e.logf("Batch %d failed verification, asking for a fix", ledger.Batches)
+		fence := codeFence(output)
+		message = fmt.Sprintf("This is one batch of a migration across the project: %s\n\nThe files in this batch are %s. After migrating them, `%s` fails:\n\n%s\n%s\n%s\n\nFix the problem.",
+			ledger.Instructions, strings.Join(names, ", "), ledger.Verify, fence, output, fence)
+	}
+
+	for _, f := range batch {
+		data, _ := os.ReadFile(filepath.Join(e.workspace, filepath.FromSlash(f.Path)))
+		f.Changed = f.Changed || sha256.Sum256(data) != before[f.Path]
+		if passed {
+			f.Status = migrationDone
+			f.Note = ""
+		} else {
+			f.Status = migrationFailed
+			f.Note = "verification failed"
+			if output != "" {
+				f.Note += ":\n" + output
+			}
+		}
+	}
+	if err := ledger.save(path); err != nil {
+		return err
+	}
+	if !passed {
+		fmt.Fprintf(w, "Batch %d failed verification:\n%s\n", ledger.Batches, output)
+		return fmt.Errorf("batch %d failed verification; fix it, then run wex migrate --retry-failed to continue", ledger.Batches)
+	}
+	fmt.Fprintf(w, "Batch %d done: %d of %d files\n", ledger.Batches, ledger.count(migrationDone), len(ledger.Files))
+
+	if commit {
+		// The ledger stays out of the commits
+		addArgs := []string{"add", "--all", "--", "."}
+		if rel, err := filepath.Rel(e.workspace, path); err == nil && !strings.HasPrefix(rel, "..") {
+			addArgs = append(addArgs, ":(exclude)"+filepath.ToSlash(rel))
+		}
+		if _, err := e.git(addArgs...); err != nil {
+			return fmt.Errorf("failed to stage batch %d: %v", ledger.Batches, err)
+		}
+		if staged, _ := e.git("diff", "--cached", "--name-only"); staged == "" {
+			return nil
+		}
+		subject := fmt.Sprintf("Migrate %s", strings.Join(names, ", "))
+		if len(subject) > 72 {
+			subject = fmt.Sprintf("Migrate %d files, batch %d", len(names), ledger.Batches)
+		}
+		if _, err := e.git("commit", "--quiet", "-m", subject, "-m", ledger.Instructions); err != nil {
+			return fmt.Errorf("failed to commit batch %d: %v", ledger.Batches, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package agent
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	e, provider, _ := newTestEngine(t, []ChatResponse{
+		reply("", call("write_file", `{"path": "a.go", "content": "package p\n\nimport \"newlib\"\n"}`)),
+		reply("Migrated a.go; b.go only mentions oldlib in a comment."),
+		reply("", call("write_file", `{"path": "broken", "content": "x\n"}`)),
+		reply("Migrated c.go."),
+		reply("I can't see what's wrong."),
+	})
+	git := func(args ...string) string {
+		out, err := gitIn(e.workspace, append([]string{"-c", "user.name=t", "-c", "user.email=t@t"}, args...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(out)
+	}
+	git("init", "--quiet")
+	git("config", "user.name", "t")
+	git("config", "user.email", "t@t")
+	writeTestFile(t, e, "a.go", "package p\n\nimport \"oldlib\"\n")
+	writeTestFile(t, e, "b.go", "package p\n\n// Was oldlib\n")
+	writeTestFile(t, e, "sub/c.go", "package sub\n\nimport \"oldlib\"\n")
+	writeTestFile(t, e, "d.go", "package p\n")
+	writeTestFile(t, e, "notes.txt", "oldlib\n")
+	git("add", "--all")
+	git("commit", "--quiet", "-m", "base")
+
+	var out strings.Builder
+	err := runMigrate(e, []string{"--files", "*.go", "--match", "oldlib", "--batch", "2", "--batches", "1",
+		"--verify", "test ! -e broken", "--commit", "Replace oldlib with newlib"}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := provider.lastMessages(t, 1)[1].Content
+	if !strings.Contains(request, "Replace oldlib with newlib") || !strings.Contains(request, "- a.go\n- b.go\n") || strings.Contains(request, "c.go") {
+		t.Errorf("batch request:\n%s", request)
+	}
+	if subject := git("log", "-1", "--format=%s"); subject != "Migrate a.go, b.go" {
+		t.Errorf("commit subject %q", subject)
+	}
+	if files := git("show", "--name-only", "--format=", "HEAD"); files != "a.go" {
+		t.Errorf("committed files: %q", files)
+	}
+
+	path := filepath.Join(e.workspace, defaultMigrationLedger)
+	ledger, err := loadMigrationLedger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, f := range ledger.Files {
+		got = append(got, f.Path+" "+f.Status)
+	}
+	if strings.Join(got, ", ") != "a.go done, b.go done, sub/c.go pending" || !ledger.Files[0].Changed || ledger.Files[1].Changed {
+		t.Errorf("ledger after the first batch: %v", got)
+	}
+
+	// As if a run had stopped partway through c.go
+	ledger.Files[2].Status = migrationInProgress
+	if err := ledger.save(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := runMigrate(e, []string{"Something else"}, &out); err == nil || !strings.Contains(err.Error(), "already under way") {
+		t.Errorf("different instructions: %v", err)
+	}
+
+	out.Reset()
+	err = runMigrate(e, nil, &out)
+	if err == nil || !strings.Contains(err.Error(), "failed verification") {
+		t.Fatalf("failing batch: %v", err)
+	}
+	request = provider.lastMessages(t, 3)[1].Content
+	if !strings.Contains(request, "- sub/c.go\n") || !strings.Contains(request, "stopped partway through sub/c.go") || !strings.Contains(request, "2 of 3 files are done") {
+		t.Errorf("resumed batch request:\n%s", request)
+	}
+	if retry := provider.lastMessages(t, 5)[1].Content; !strings.Contains(retry, "`test ! -e broken` fails") {
+		t.Errorf("retry request:\n%s", retry)
+	}
+
+	out.Reset()
+	if err := runMigrate(e, []string{"--status"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	want := "Migration: Replace oldlib with newlib\n2 of 3 files done, 0 pending, 1 failed, in 2 batches\n  failed: sub/c.go: verification failed\n"
+	if out.String() != want {
+		t.Errorf("status:\n%s\nwant:\n%s", out.String(), want)
+	}
+	if len(provider.requests) != 5 {
+		t.Errorf("%d requests", len(provider.requests))
+	}
+}
@@ -0,0 +1,116 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// NotifyConfig says where to send a notification when a session ends, so
+// long-running tasks can be left unattended. Pushover is token:user.
+type NotifyConfig struct {
+	WebhookURL string
+	NtfyURL    string
+	Pushover   string
+	Desktop    bool
+}
+
+// Notification is the JSON body posted to a webhook
+type Notification struct {
+	Event   string    `json:"event"`
+	Model   string    `json:"model"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+func (c NotifyConfig) enabled() bool {
+	return c.WebhookURL != "" || c.NtfyURL != "" || c.Pushover != "" || c.Desktop
+}
+
+// notify sends the event to every configured channel; failures are reported
+// but never affect the outcome of the session
+func (e *Engine) notify(event, message string) {
+	if !e.notifyConfig.enabled() {
+		return
+	}
+
+	// Notifications go to third parties, so they must not use the Ollama
+	// client, which may carry credentials
+	client := &http.Client{Timeout: 10 * time.Second}
+	title := fmt.Sprintf("wex: session %s", event)
+
+	if e.notifyConfig.WebhookURL != "" {
+		body, _ := json.Marshal(Notification{
+			Event:   event,
+			Model:   e.model,
+			Message: message,
+			Time:    time.Now(),
+		})
+		e.reportNotifyError("webhook", post(client, e.notifyConfig.WebhookURL, "application/json", body, nil))
+	}
+
+	if e.notifyConfig.NtfyURL != "" {
+		e.reportNotifyError("ntfy", post(client, e.notifyConfig.NtfyURL, "text/plain", []byte(message), map[string]string{"Title": title}))
+	}
+
+	if e.notifyConfig.Pushover != "" {
+		token, user, ok := strings.Cut(e.notifyConfig.Pushover, ":")
+		if !ok {
+			e.reportNotifyError("pushover", fmt.Errorf("expected token:user"))
+		} else {
+			form := url.Values{"token": {token}, "user": {user}, "title": {title}, "message": {message}}
+			e.reportNotifyError("pushover", post(client, "https://api.pushover.net/1/messages.json",
+				"application/x-www-form-urlencoded", []byte(form.Encode()), nil))
+		}
+	}
+
+	if e.notifyConfig.Desktop {
+		e.reportNotifyError("desktop", desktopNotification(title, message))
+	}
+}
+
+func post(client *http.Client, url, contentType string, body []byte, headers map[string]string) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func desktopNotification(title, message string) error {
+	switch runtime.GOOS {
+	case "linux":
+		return exec.Command("notify-send", title, message).Run()
+	case "darwin":
+		script := fmt.Sprintf("display notification %q with title %q", message, title)
+		return exec.Command("osascript", "-e", script).Run()
+	default:
+		return fmt.Errorf("not supported on %s", runtime.GOOS)
+	}
+}
+
+func (e *Engine) reportNotifyError(channel string, err error) {
+	if err != nil {
+		e.logf("Warning: %s notification failed: %v", channel, err)
+	}
+}
@@ -0,0 +1,66 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// checkOffline, with --offline, lists everything configured that would
+// connect anywhere but the model server, so a run that can't keep its
+// data local fails before it starts rather than partway through
+func (e *Engine) checkOffline() error {
+	if !e.offline {
+		return nil
+	}
+	var problems []string
+	if e.anthropicKey != "" {
+		problems = append(problems, "the model is on Anthropic's hosted API")
+	}
+	if e.imageTools && e.imageAPI.URL != "" {
+		problems = append(problems, "generate_image would call IMAGE_API_URL")
+	}
+	if e.notifyConfig.WebhookURL != "" {
+		problems = append(problems, "notifications would be posted to NOTIFY_WEBHOOK")
+	}
+	if e.notifyConfig.NtfyURL != "" {
+		problems = append(problems, "notifications would be published to NOTIFY_NTFY")
+	}
+	if e.notifyConfig.Pushover != "" {
+		problems = append(problems, "notifications would be sent to Pushover")
+	}
+	if len(e.agentPeers) > 0 {
+		problems = append(problems, "start_agent would connect to AGENT_PEERS")
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("--offline, but %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// checkOfflineCommand refuses commands that reach the network, including
+// package installs, which --offline can't otherwise vouch for
+func (e *Engine) checkOfflineCommand(command string) error {
+	if !e.offline {
+		return nil
+	}
+	if installers := commandInstallers(command); len(installers) > 0 {
+		return fmt.Errorf("command refused: installing packages with %s needs the network, and wex is running with --offline", installers[0])
+	}
+	if classifyCommand(command) == classNetwork {
+		return fmt.Errorf("command refused: network commands are not allowed with --offline")
+	}
+	return nil
+}
+
+// checkOfflineRepo refuses to clone a task's repository from anywhere but
+// the local disk
+func checkOfflineRepo(repo string) error {
+	if repo == "" {
+		return nil
+	}
+	if _, err := os.Stat(repo); err != nil {
+		return fmt.Errorf("--offline, but %s is not on the local disk", repo)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package agent
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestOffline(t *testing.T) {
+	e, _, _ := newTestEngine(t, nil, WithOffline())
+	for command, want := range map[string]string{
+		"curl -s https://example.com":    "network commands are not allowed",
+		"sudo pip install requests":      "installing packages with pip",
+		"git clone https://x.test/r.git": "network commands are not allowed",
+		"ls -la":                         "",
+	} {
+		_, err := e.callTool(call("run_command", `{"command": `+jsonString(command)+`}`))
+		switch {
+		case want == "" && err != nil:
+			t.Errorf("%s refused: %v", command, err)
+		case want != "" && (err == nil || !strings.Contains(err.Error(), want)):
+			t.Errorf("%s gave %v, want %q", command, err, want)
+		}
+	}
+
+	e.notifyConfig.NtfyURL = "https://ntfy.sh/topic"
+	e.notifyConfig.Desktop = true
+	if err := e.checkOffline(); err == nil || !strings.Contains(err.Error(), "NOTIFY_NTFY") {
+		t.Errorf("offline with ntfy gave %v", err)
+	}
+	e.notifyConfig = NotifyConfig{}
+	e.anthropicKey = "key"
+	if err := e.checkOffline(); err == nil || !strings.Contains(err.Error(), "Anthropic") {
+		t.Errorf("offline with Anthropic gave %v", err)
+	}
+	if err := checkOfflineRepo("https://github.com/psf/requests.git"); err == nil {
+		t.Error("offline clone from GitHub allowed")
+	}
+	if err := checkOfflineRepo(e.workspace); err != nil {
+		t.Errorf("offline clone from the local disk refused: %v", err)
+	}
+}
+
+func TestPythonPolicy(t *testing.T) {
+	e, _, _ := newTestEngine(t, nil, WithOffline())
+	e.intents = map[string]bool{"wipe-data": false}
+	for code, want := range map[string]string{
+		"import requests\nrequests.get('https://example.com')": "imports requests",
+		"from urllib.request import urlopen":                   "imports urllib",
+		`os.system("curl -s https://example.com")`:             "network commands are not allowed",
+		`subprocess.run("pip install numpy", shell=True)`:      "installing packages with pip",
+		"import shutil\nshutil.rmtree('build')":                "delete or wipe data",
+		`os.system('rm -rf data')`:                             "delete or wipe data",
+		`db.execute("DROP TABLE users")`:                       "delete or wipe data",
+		"print(sum(range(10)))":                                "",
+	} {
+		err := e.checkPythonPolicy(code)
+		switch {
+		case want == "" && err != nil:
+			t.Errorf("%q refused: %v", code, err)
+		case want != "" && (err == nil || !strings.Contains(err.Error(), want)):
+			t.Errorf("%q gave %v, want %q", code, err, want)
+		}
+	}
+
+	e.intents["wipe-data"] = true
+	if err := e.checkPythonPolicy("shutil.rmtree('build')"); err != nil {
+		t.Errorf("confirmed intent refused: %v", err)
+	}
+}
@@ -0,0 +1,377 @@
+package agent
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxHotSpots is how many functions from the profile the model is shown
+const maxHotSpots = 12
+
+// goBenchLine matches a result line of go test -bench
+var goBenchLine = regexp.MustCompile(`(?m)^(Benchmark\S+?)(?:-\d+)?\s+\d+\s+([\d.]+) ns/op`)
+
+// pprofTopLine matches a line of go tool pprof -top:
+// flat flat% sum% cum cum% name
+var pprofTopLine = regexp.MustCompile(`^\s*\S+\s+([\d.]+)%\s+[\d.]+%\s+\S+\s+([\d.]+)%\s+(.+)$`)
+
+// benchNumbers are the results of a benchmark run, by name; lower is better
+type benchNumbers map[string]float64
+
+// parseBenchOutput reads go test -bench results or, given a metric
+// pattern, its matches: with two groups, a name and a number, and with one,
+// just the number
+func parseBenchOutput(output string, metric *regexp.Regexp) benchNumbers {
+	numbers := make(benchNumbers)
+	pattern := goBenchLine
+	if metric != nil {
+		pattern = metric
+	}
+	for _, m := range pattern.FindAllStringSubmatch(output, -1) {
+		name, value := "result", m[len(m)-1]
+		if len(m) > 2 {
+			name = m[1]
+		}
+		if n, err := strconv.ParseFloat(value, 64); err == nil {
+			numbers[name] = n
+		}
+	}
+	return numbers
+}
+
+// medianNumbers combines samples, taking the median of each benchmark that
+// all of them have, so one noisy run doesn't decide
+func medianNumbers(samples []benchNumbers) benchNumbers {
+	median := make(benchNumbers)
+	for name := range samples[0] {
+		var values []float64
+		for _, sample := range samples {
+			if v, ok := sample[name]; ok {
+				values = append(values, v)
+			}
+		}
+		if len(values) < len(samples) {
+			continue
+		}
+		sort.Float64s(values)
+		if n := len(values); n%2 == 1 {
+			median[name] = values[n/2]
+		} else {
+			median[name] = (values[n/2-1] + values[n/2]) / 2
+		}
+	}
+	return median
+}
+
+// speedup compares two sets of numbers by the geometric mean of their
+// ratios over the benchmarks in both, as a percentage improvement
+func speedup(before, after benchNumbers) (float64, bool) {
+	sum, n := 0.0, 0
+	for name, b := range before {
+		if a, ok := after[name]; ok && a > 0 && b > 0 {
+			sum += math.Log(b / a)
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, false
+	}
+	return (1 - math.Exp(-sum/float64(n))) * 100, true
+}
+
+func formatBenchNumbers(numbers, baseline benchNumbers) string {
+	var names []string
+	for name := range numbers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "  %-40s %12.4g", name, numbers[name])
+		if base, ok := baseline[name]; ok && base > 0 {
+			fmt.Fprintf(&b, "  (%+.1f%%)", (numbers[name]-base)/base*100)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// hotSpot is a function from a CPU profile, with its share of the time
+// spent in itself and in what it calls
+type hotSpot struct {
+	name      string
+	flat, cum float64
+}
+
+// parseHotSpots reads go tool pprof -top output, leaving out the runtime
+// and testing framework, which the model can't change
+func parseHotSpots(output string) []hotSpot {
+	var spots []hotSpot
+	for _, line := range strings.Split(output, "\n") {
+		m := pprofTopLine.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		name := strings.TrimSpace(m[3])
+		if strings.HasPrefix(name, "runtime.") || strings.HasPrefix(name, "testing.") || strings.HasPrefix(name, "syscall.") {
+			continue
+		}
+		flat, _ := strconv.ParseFloat(m[1], 64)
+		cum, _ := strconv.ParseFloat(m[2], 64)
+		spots = append(spots, hotSpot{name, flat, cum})
+		if len(spots) == maxHotSpots {
+			break
+		}
+	}
+	return spots
+}
+
+// optimizer holds the settings of a wex optimize run
+type optimizer struct {
+	engine  *Engine
+	bench   string
+	profile string
+	test    string
+	metric  *regexp.Regexp
+	samples int
+
+	// checkpoint is what a change that isn't kept is undone back to
+	checkpoint
+}
+
+// measure runs the benchmark command the given number of times
+func (o *optimizer) measure() (benchNumbers, error) {
+	var samples []benchNumbers
+	for i := 0; i < o.samples; i++ {
+		run := runFlakeCommand(o.engine.workspace, o.bench, checkScriptTimeout)
+		if !run.passed {
+			return nil, fmt.Errorf("the benchmark failed:\n%s", lastLines(run.output, 20))
+		}
+		numbers := parseBenchOutput(run.output, o.metric)
+		if len(numbers) == 0 {
+			return nil, fmt.Errorf("no results in the benchmark output:\n%s", lastLines(run.output, 20))
+		}
+		samples = append(samples, numbers)
+	}
+	return medianNumbers(samples), nil
+}
+
+// hotSpots profiles the benchmark: with --profile, by running that
+// command, and for go test, by adding -cpuprofile and reading it with pprof
+func (o *optimizer) hotSpots() string {
+	var output string
+	if o.profile != "" {
+		output = runFlakeCommand(o.engine.workspace, o.profile, checkScriptTimeout).output
+	} else if strings.HasPrefix(strings.TrimSpace(o.bench), "go test") {
+		dir, err := os.MkdirTemp("", "wex-profile-")
+		if err != nil {
+			return ""
+		}
+		defer os.RemoveAll(dir)
+		profile := filepath.Join(dir, "cpu.out")
+		command := fmt.Sprintf("%s -cpuprofile %s -o %s", o.bench, shellQuote(profile), shellQuote(filepath.Join(dir, "bench.test")))
+		if run := runFlakeCommand(o.engine.workspace, command, checkScriptTimeout); !run.passed {
+			o.engine.debugf("Profiling failed: %s", command)
+			return ""
+		}
+		output = runFlakeCommand(o.engine.workspace, "go tool pprof -top -nodecount=50 "+shellQuote(profile), checkScriptTimeout).output
+	} else {
+		return ""
+	}
+
+	spots := parseHotSpots(output)
+	if len(spots) == 0 {
+		return lastLines(output, 30)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "  %6s %6s  %s\n", "self", "total", "function")
+	for _, s := range spots {
+		fmt.Fprintf(&b, "  %5.1f%% %5.1f%%  %s\n", s.flat, s.cum, s.name)
+	}
+	return b.String()
+}
+
+// runOptimize handles "wex optimize", which has the model speed up the code
+// a benchmark exercises, one change at a time, keeping only changes that
+// pass the tests and make the benchmark faster
+func runOptimize(engine *Engine, args []string, w io.Writer) error {
+	optimizeFlags := flag.NewFlagSet("optimize", flag.ExitOnError)
+	bench := optimizeFlags.String("bench", "", "Benchmark command, e.g. \"go test -run '^$' -bench . ./parser\"")
+	profile := optimizeFlags.String("profile", "", "Command printing the hot spots, e.g. in go tool pprof -top format (default profiling go test benchmarks with -cpuprofile)")
+	test := optimizeFlags.String("test", "", "Command that must pass after each change, e.g. \"go test ./...\"")
+	metric := optimizeFlags.String("metric", "", "Regular expression for the numbers in the benchmark output, lower being better: one group for the number, or two for a name and the number (default go test -bench ns/op)")
+	iterations := optimizeFlags.Int("iterations", 3, "Optimizations to try")
+	samples := optimizeFlags.Int("samples", 3, "Times to run the benchmark for each measurement, taking the median")
+	minGain := optimizeFlags.Float64("min-gain", 2, "Percentage improvement a change must make to be kept")
+	optimizeFlags.Usage = func() {
+		fmt.Fprintf(optimizeFlags.Output(), "Usage: wex [flags] optimize --bench CMD [--test CMD] [--profile CMD] [--metric REGEX] [--iterations N] [--samples N] [--min-gain PERCENT] [instructions]\n")
+		optimizeFlags.PrintDefaults()
+	}
+	optimizeFlags.Parse(args)
+	if *bench == "" {
+		return fmt.Errorf("no benchmark command; give it with --bench")
+	}
+	if *samples < 1 {
+		return fmt.Errorf("--samples must be at least 1")
+	}
+	o := &optimizer{engine: engine, bench: *bench, profile: *profile, test: *test, samples: *samples}
+	if *metric != "" {
+		re, err := regexp.Compile(*metric)
+		if err != nil {
+			return fmt.Errorf("invalid --metric: %v", err)
+		}
+		if re.NumSubexp() != 1 && re.NumSubexp() != 2 {
+			return fmt.Errorf("--metric must have one or two groups")
+		}
+		o.metric = re
+	}
+	if *test == "" {
+		fmt.Fprintf(w, "Warning: with no --test command, nothing checks that the changes keep the code working\n")
+	}
+
+	// Changes are kept by committing them and undone by going back to the
+	// last commit, which mustn't take the user's work with it
+	if status, err := engine.git("status", "--porcelain", "--untracked-files=no"); err != nil {
+		return fmt.Errorf("wex optimize needs a git repository: %v", err)
+	} else if status != "" {
+		return fmt.Errorf("there are uncommitted changes; commit or stash them first")
+	}
+	o.checkpoint = newCheckpoint(engine, true)
+	if *test != "" {
+		if passed, output := runCheck(engine.workspace, *test); !passed {
+			return fmt.Errorf("the tests fail before any change:\n%s", output)
+		}
+	}
+	baseline, err := o.measure()
+	if err != nil {
+		return err
+	}
+	start := baseline
+	fmt.Fprintf(w, "Baseline:\n%s", formatBenchNumbers(baseline, nil))
+
+	if engine.taskType == "" || engine.taskType == taskTypeAuto {
+		engine.taskType = taskTypeNone
+	}
+	instructions := strings.Join(optimizeFlags.Args(), " ")
+	var tried []string
+	kept := 0
+	ctx := context.Background()
+	for i := 1; i <= *iterations; i++ {
+		fmt.Fprintf(w, "\nIteration %d of %d\n", i, *iterations)
+		message := o.message(baseline, o.hotSpots(), tried, instructions, *minGain)
+		result, err := engine.Run(ctx, message)
+		if err != nil {
+			o.revert()
+			return err
+		}
+		summary := firstLine(result.Reply, "an optimization")
+		if result.FinalAnswer != nil && result.FinalAnswer.Summary != "" {
+			summary = firstLine(result.FinalAnswer.Summary, summary)
+		}
+
+		verdict, numbers := o.evaluate(baseline, *minGain)
+		if numbers == nil {
+			o.revert()
+			fmt.Fprintf(w, "Rejected: %s\n", verdict)
+			tried = append(tried, fmt.Sprintf("%s: rejected, %s", summary, firstLine(verdict, "no reason given")))
+			continue
+		}
+		fmt.Fprintf(w, "Kept: %s\n%s", verdict, formatBenchNumbers(numbers, baseline))
+		subject := "perf: " + summary
+		if len(subject) > 72 {
+			subject = subject[:69] + "..."
+		}
+		if _, err := engine.git("add", "--update"); err != nil {
+			return fmt.Errorf("failed to stage the change: %v", err)
+		}
+		if created := o.created(); len(created) > 0 {
+			if _, err := engine.git(append([]string{"add", "--"}, created...)...); err != nil {
+				return fmt.Errorf("failed to stage the change: %v", err)
+			}
+		}
+		if _, err := engine.git("commit", "--quiet", "-m", subject, "-m", verdict); err != nil {
+			return fmt.Errorf("failed to commit the change: %v", err)
+		}
+		tried = append(tried, fmt.Sprintf("%s: kept, %s", summary, verdict))
+		baseline = numbers
+		kept++
+	}
+
+	gain, _ := speedup(start, baseline)
+	fmt.Fprintf(w, "\nKept %d of %d changes, %.1f%% faster overall:\n%s", kept, *iterations, gain, formatBenchNumbers(baseline, start))
+	return nil
+}
+
+// evaluate checks the model's change: it must change something, pass the
+// tests, and make the benchmark faster by at least minGain percent. It
+// returns what was found, and the new numbers if the change is to be kept.
+func (o *optimizer) evaluate(baseline benchNumbers, minGain float64) (string, benchNumbers) {
+	if status, _ := o.engine.git("status", "--porcelain", "--untracked-files=no"); status == "" && len(o.created()) == 0 {
+		return "nothing was changed", nil
+	}
+	if o.test != "" {
+		if passed, output := runCheck(o.engine.workspace, o.test); !passed {
+			return strings.TrimSpace("the tests failed:\n" + output), nil
+		}
+	}
+	numbers, err := o.measure()
+	if err != nil {
+		return err.Error(), nil
+	}
+	gain, ok := speedup(baseline, numbers)
+	if !ok {
+		return "the benchmarks changed, so the results can't be compared", nil
+	}
+	verdict := fmt.Sprintf("%.1f%% faster", gain)
+	if gain < 0 {
+		verdict = fmt.Sprintf("%.1f%% slower", -gain)
+	}
+	if gain < minGain {
+		return fmt.Sprintf("%s, less than the %g%% needed", verdict, minGain), nil
+	}
+	return verdict, numbers
+}
+
+// message asks for one optimization, with the numbers, the hot spots, and
+// what was tried already
+func (o *optimizer) message(numbers benchNumbers, hotSpots string, tried []string, instructions string, minGain float64) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Make the code that the benchmark `%s` measures faster. Make one focused optimization, the one likely to gain the most, without changing what the code does. ", o.bench)
+	fmt.Fprintf(&b, "The change is kept only if it makes the benchmark at least %g%% faster", minGain)
+	if o.test != "" {
+		fmt.Fprintf(&b, " and `%s` still passes", o.test)
+	}
+	b.WriteString(". Don't change the benchmarks or the tests.\n")
+	if instructions != "" {
+		fmt.Fprintf(&b, "\n%s\n", instructions)
+	}
+	fmt.Fprintf(&b, "\nCurrent results, lower is better:\n%s", formatBenchNumbers(numbers, nil))
+	if hotSpots != "" {
+		fmt.Fprintf(&b, "\nWhere the time goes, as a percentage of the CPU profile:\n%s", hotSpots)
+	}
+	if len(tried) > 0 {
+		b.WriteString("\nAlready tried; don't repeat these:\n")
+		for _, t := range tried {
+			fmt.Fprintf(&b, "- %s\n", t)
+		}
+	}
+	return b.String()
+}
+
+// firstLine is the first line of text, or if it is blank, the fallback
+func firstLine(s, fallback string) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(s), "\n")
+	if line == "" {
+		return fallback
+	}
+	return line
+}
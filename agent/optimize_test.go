@@ -0,0 +1,94 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestParseBenchOutput(t *testing.T) {
+	output := "goos: linux\nBenchmarkParse-8   \t  50000\t     23456 ns/op\t  1024 B/op\nBenchmarkParse/small-8 1000000 1.5 ns/op\nPASS\n"
+	numbers := parseBenchOutput(output, nil)
+	if len(numbers) != 2 || numbers["BenchmarkParse"] != 23456 || numbers["BenchmarkParse/small"] != 1.5 {
+		t.Errorf("go test -bench: %v", numbers)
+	}
+	numbers = parseBenchOutput("parse: 120ms\nrender: 30ms\n", regexp.MustCompile(`(\w+): (\d+)ms`))
+	if len(numbers) != 2 || numbers["render"] != 30 {
+		t.Errorf("metric with a name: %v", numbers)
+	}
+
+	median := medianNumbers([]benchNumbers{{"a": 10, "b": 1}, {"a": 30}, {"a": 20, "b": 2}})
+	if len(median) != 1 || median["a"] != 20 {
+		t.Errorf("median: %v", median)
+	}
+	if gain, _ := speedup(benchNumbers{"a": 100, "b": 100}, benchNumbers{"a": 50, "b": 200}); gain > 0.001 || gain < -0.001 {
+		t.Errorf("speedup of a halving and a doubling: %v", gain)
+	}
+	if gain, _ := speedup(benchNumbers{"a": 100}, benchNumbers{"a": 80}); gain < 19.999 || gain > 20.001 {
+		t.Errorf("speedup: %v", gain)
+	}
+
+	top := "      flat  flat%   sum%        cum   cum%\n" +
+		"     1.20s 40.00% 40.00%      1.20s 40.00%  runtime.mallocgc\n" +
+		"     0.90s 30.00% 70.00%      2.50s 83.33%  example.com/parser.(*Lexer).next\n"
+	if spots := parseHotSpots(top); len(spots) != 1 || spots[0].name != "example.com/parser.(*Lexer).next" || spots[0].cum != 83.33 {
+		t.Errorf("hot spots: %+v", spots)
+	}
+}
+
+func TestOptimize(t *testing.T) {
+	e, provider, _ := newTestEngine(t, []ChatResponse{
+		reply("", call("write_file", `{"path": "cache.txt", "content": "cached\n"}`)),
+		reply("Cache the token table"),
+		reply("", call("write_file", `{"path": "fast", "content": "yes\n"}`)),
+		reply("Avoid copying the input\n\nIt was copied for every token."),
+	})
+	git := func(args ...string) string {
+		out, err := gitIn(e.workspace, append([]string{"-c", "user.name=t", "-c", "user.email=t@t"}, args...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(out)
+	}
+	writeTestFile(t, e, "parse.go", "package parse\n")
+	git("init", "--quiet")
+	git("config", "user.name", "t")
+	git("config", "user.email", "t@t")
+	git("add", "--all")
+	git("commit", "--quiet", "-m", "base")
+	writeTestFile(t, e, "notes.txt", "mine\n")
+
+	bench := `if [ -e fast ]; then echo "BenchmarkParse-8 100 500 ns/op"; else echo "BenchmarkParse-8 100 1000 ns/op"; fi`
+	profile := `printf '  flat  flat%%   sum%%   cum   cum%%\n 1s 60.00%% 60.00%% 1s 90.00%%  parse.Parse\n'`
+	var out strings.Builder
+	err := runOptimize(e, []string{"--bench", bench, "--profile", profile, "--test", "test ! -e cache.txt", "--iterations", "2", "--samples", "1"}, &out)
+	if err != nil {
+		t.Fatalf("%v\n%s", err, out.String())
+	}
+
+	first := provider.lastMessages(t, 1)[1].Content
+	if !strings.Contains(first, "BenchmarkParse") || !strings.Contains(first, " 60.0%  90.0%  parse.Parse") || !strings.Contains(first, "`test ! -e cache.txt` still passes") {
+		t.Errorf("first request:\n%s", first)
+	}
+	second := provider.lastMessages(t, 3)[1].Content
+	if !strings.Contains(second, "- Cache the token table: rejected, the tests failed:") {
+		t.Errorf("second request:\n%s", second)
+	}
+	if _, err := os.Stat(filepath.Join(e.workspace, "cache.txt")); err == nil {
+		t.Error("the rejected change was not undone")
+	}
+	if _, err := os.Stat(filepath.Join(e.workspace, "notes.txt")); err != nil {
+		t.Error("an untracked file was removed")
+	}
+	if log := git("log", "--format=%s"); log != "perf: Avoid copying the input\nbase" {
+		t.Errorf("commits:\n%s", log)
+	}
+	if files := git("show", "--name-only", "--format=", "HEAD"); files != "fast" {
+		t.Errorf("committed files: %q", files)
+	}
+	if !strings.Contains(out.String(), "Kept 1 of 2 changes, 50.0% faster overall") {
+		t.Errorf("output:\n%s", out.String())
+	}
+}
@@ -0,0 +1,504 @@
+package agent
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// codeRegion is a named part of a file, such as a function, class or
+// section, as lines start to end inclusive, counting from 1. Leading
+// comments, doc comments and decorators belong to it.
+type codeRegion struct {
+	kind  string
+	name  string
+	start int
+	end   int
+	depth int
+}
+
+// Files are outlined by parsing for Go, by indentation for Python, by
+// headings for Markdown, and by declarations and matching braces for the
+// other languages here
+var (
+	braceLanguages = map[string]bool{
+		".js": true, ".jsx": true, ".mjs": true, ".cjs": true, ".ts": true, ".tsx": true,
+		".java": true, ".kt": true, ".scala": true, ".cs": true, ".c": true, ".h": true,
+		".cc": true, ".cpp": true, ".hpp": true, ".rs": true, ".swift": true, ".php": true,
+		".dart": true,
+	}
+	braceDeclarations = []struct {
+		kind string
+		re   *regexp.Regexp
+	}{
+		{"class", regexp.MustCompile(`^(?:export\s+)?(?:default\s+)?(?:public\s+|private\s+|protected\s+|internal\s+)?(?:abstract\s+|final\s+|static\s+|sealed\s+|data\s+)*(class|interface|struct|enum|trait|impl|object|namespace)\s+(?:<[^>]*>\s*)?([\w:]+)`)},
+		{"function", regexp.MustCompile(`^(?:export\s+)?(?:default\s+)?(?:pub(?:\([\w:]+\))?\s+)?(?:async\s+)?(?:unsafe\s+)?(?:function\s*\*?|fn|func|fun)\s+(\w+)`)},
+		{"function", regexp.MustCompile(`^(?:export\s+)?(?:const|let|var)\s+(\w+)\s*=\s*(?:async\s+)?(?:function\b|\([^)]*\)\s*(?::[^=]+)?=>|\w+\s*=>)`)},
+		{"method", regexp.MustCompile(`^(?:[\w<>\[\],.*&:~?]+\s+)*?(\w+)\s*\([^;]*$`)},
+	}
+	notMethods = map[string]bool{
+		"if": true, "for": true, "while": true, "switch": true, "catch": true, "return": true,
+		"else": true, "do": true, "try": true, "new": true, "throw": true, "sizeof": true,
+		"typeof": true, "await": true, "yield": true, "match": true, "using": true, "lock": true,
+	}
+	pythonDeclaration = regexp.MustCompile(`^(\s*)(?:async\s+)?(def|class)\s+(\w+)`)
+	markdownHeading   = regexp.MustCompile(`^(#{1,6})\s+(.+?)\s*#*\s*$`)
+)
+
+// outlineRegions finds the named regions of a file
+func outlineRegions(path, text string) ([]codeRegion, error) {
+	lines := strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+	ext := strings.ToLower(filepath.Ext(path))
+	var regions []codeRegion
+	switch {
+	case ext == ".go":
+		var err error
+		if regions, err = outlineGo(text); err != nil {
+			regions = outlineBraces(lines)
+		}
+	case ext == ".py" || ext == ".pyi":
+		regions = outlinePython(lines)
+	case ext == ".md" || ext == ".markdown":
+		regions = outlineMarkdown(lines)
+	case braceLanguages[ext]:
+		regions = outlineBraces(lines)
+	default:
+		return nil, fmt.Errorf("can't outline %s files; use read_file with start_line and end_line", ext)
+	}
+
+	// Names are qualified by the regions they are in, and numbered if they
+	// are still not unique
+	seen := make(map[string]int)
+	for i := range regions {
+		if ext != ".go" {
+			for j := i - 1; j >= 0; j-- {
+				if regions[j].depth < regions[i].depth && regions[j].end >= regions[i].end {
+					regions[i].name = regions[j].name + "." + regions[i].name
+					break
+				}
+			}
+		}
+		if ext != ".md" && ext != ".markdown" {
+			regions[i].start = leadingComments(lines, regions[i].start)
+		}
+	}
+	for i := range regions {
+		seen[regions[i].name]++
+		if n := seen[regions[i].name]; n > 1 {
+			regions[i].name = fmt.Sprintf("%s#%d", regions[i].name, n)
+		}
+	}
+	return regions, nil
+}
+
+func outlineGo(text string) ([]codeRegion, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "", text, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	line := func(pos token.Pos) int {
+		return fset.Position(pos).Line
+	}
+	var regions []codeRegion
+	for _, decl := range file.Decls {
+		switch decl := decl.(type) {
+		case *ast.FuncDecl:
+			name := decl.Name.Name
+			kind := "func"
+			if decl.Recv != nil && len(decl.Recv.List) > 0 {
+				kind = "method"
+				recv := decl.Recv.List[0].Type
+				if star, ok := recv.(*ast.StarExpr); ok {
+					recv = star.X
+				}
+				if index, ok := recv.(*ast.IndexExpr); ok {
+					recv = index.X
+				}
+				if ident, ok := recv.(*ast.Ident); ok {
+					name = ident.Name + "." + name
+				}
+			}
+			regions = append(regions, codeRegion{kind: kind, name: name, start: line(decl.Pos()), end: line(decl.End())})
+		case *ast.GenDecl:
+			if decl.Tok == token.IMPORT {
+				continue
+			}
+			for _, spec := range decl.Specs {
+				var names []string
+				switch spec := spec.(type) {
+				case *ast.TypeSpec:
+					names = []string{spec.Name.Name}
+				case *ast.ValueSpec:
+					for _, ident := range spec.Names {
+						names = append(names, ident.Name)
+					}
+				}
+				start, end := line(spec.Pos()), line(spec.End())
+				if len(decl.Specs) == 1 {
+					start, end = line(decl.Pos()), line(decl.End())
+				}
+				regions = append(regions, codeRegion{kind: decl.Tok.String(), name: strings.Join(names, ", "), start: start, end: end})
+			}
+		}
+	}
+	return regions, nil
+}
+
+func outlinePython(lines []string) []codeRegion {
+	var regions []codeRegion
+	for i, line := range lines {
+		m := pythonDeclaration.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		indent := len(m[1])
+		end := i
+		for j := i + 1; j < len(lines); j++ {
+			trimmed := strings.TrimSpace(lines[j])
+			if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+				continue
+			}
+			if len(lines[j])-len(strings.TrimLeft(lines[j], " \t")) <= indent {
+				break
+			}
+			end = j
+		}
+		regions = append(regions, codeRegion{kind: m[2], name: m[3], start: i + 1, end: end + 1, depth: indent})
+	}
+	return regions
+}
+
+func outlineMarkdown(lines []string) []codeRegion {
+	var regions []codeRegion
+	var levels []int
+	fenced := false
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			fenced = !fenced
+		}
+		m := markdownHeading.FindStringSubmatch(line)
+		if fenced || m == nil {
+			continue
+		}
+		level := len(m[1])
+		for j := range regions {
+			if regions[j].end == 0 && levels[j] >= level {
+				regions[j].end = i
+			}
+		}
+		regions = append(regions, codeRegion{kind: "section", name: m[2], start: i + 1, depth: level})
+		levels = append(levels, level)
+	}
+	for j := range regions {
+		if regions[j].end == 0 {
+			regions[j].end = len(lines)
+		}
+	}
+	return regions
+}
+
+func outlineBraces(lines []string) []codeRegion {
+	var regions []codeRegion
+	depths := braceDepths(lines)
+
+	// Function bodies aren't searched, since calls in them look much like
+	// declarations
+	skipUntil := -1
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if i <= skipUntil || trimmed == "" || strings.HasPrefix(trimmed, "//") || strings.HasPrefix(trimmed, "*") || strings.HasPrefix(trimmed, "/*") {
+			continue
+		}
+		for _, decl := range braceDeclarations {
+			m := decl.re.FindStringSubmatch(trimmed)
+			if m == nil {
+				continue
+			}
+			name := m[len(m)-1]
+			kind := decl.kind
+			if kind == "class" {
+				kind = m[1]
+			}
+			if kind == "method" && notMethods[name] {
+				break
+			}
+			end := regionEnd(lines, depths, i)
+			if end < 0 {
+				break
+			}
+			regions = append(regions, codeRegion{kind: kind, name: name, start: i + 1, end: end + 1, depth: depths[i]})
+			if decl.kind != "class" {
+				skipUntil = end
+			}
+			break
+		}
+	}
+	return regions
+}
+
+// braceDepths gives the brace depth at the start of each line, skipping
+// braces in strings and comments
+func braceDepths(lines []string) []int {
+	depths := make([]int, len(lines)+1)
+	depth := 0
+	inComment := false
+	for i, line := range lines {
+		depths[i] = depth
+		var quote byte
+		for j := 0; j < len(line); j++ {
+			c := line[j]
+			switch {
+			case inComment:
+				if c == '*' && j+1 < len(line) && line[j+1] == '/' {
+					inComment = false
+					j++
+				}
+			case quote != 0:
+				if c == '\\' {
+					j++
+				} else if c == quote {
+					quote = 0
+				}
+			case c == '/' && j+1 < len(line) && line[j+1] == '/':
+				j = len(line)
+			case c == '/' && j+1 < len(line) && line[j+1] == '*':
+				inComment = true
+				j++
+			case c == '"' || c == '\'' || c == '`':
+				quote = c
+			case c == '{':
+				depth++
+			case c == '}':
+				depth--
+			}
+		}
+	}
+	depths[len(lines)] = depth
+	return depths
+}
+
+// regionEnd finds the line closing the block a declaration opens, or -1 if
+// it opens none, as with a prototype
+func regionEnd(lines []string, depths []int, start int) int {
+	for i := start; i < len(lines) && i < start+10; i++ {
+		if depths[i+1] > depths[start] {
+			for j := i + 1; j < len(lines); j++ {
+				if depths[j+1] <= depths[start] {
+					return j
+				}
+			}
+			return len(lines) - 1
+		}
+		if strings.Contains(lines[i], ";") || i > start && depths[i+1] < depths[start] {
+			return -1
+		}
+	}
+	return -1
+}
+
+// leadingComments moves a region's start up over the comments, doc
+// comments, decorators and attributes directly above it
+func leadingComments(lines []string, start int) int {
+	for start > 1 {
+		trimmed := strings.TrimSpace(lines[start-2])
+		if trimmed == "" {
+			break
+		}
+		isComment := false
+		for _, prefix := range []string{"//", "#", "/*", "*", "@", "--"} {
+			if strings.HasPrefix(trimmed, prefix) {
+				isComment = true
+			}
+		}
+		if !isComment || strings.HasPrefix(trimmed, "#include") || strings.HasPrefix(trimmed, "#define") {
+			break
+		}
+		start--
+	}
+	return start
+}
+
+// regionAnchor identifies a region's content, so a replacement can be
+// refused if the region has changed since it was read
+func regionAnchor(text string) string {
+	sum := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func outlineTools() []Tool {
+	return []Tool{
+		{
+			Type: "function",
+			Function: Function{
+				Name:        "code_outline",
+				Description: "List the functions, classes, types and sections of a file, with their line ranges, without reading it all. Use it with edit_region to work on files too large to read whole",
+				Parameters: map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"path": map[string]interface{}{
+							"type":        "string",
+							"description": "File path relative to workspace",
+						},
+					},
+					"required": []string{"path"},
+				},
+			},
+		},
+		{
+			Type: "function",
+			Function: Function{
+				Name:        "edit_region",
+				Description: "Get one function, class or section of a file by the name code_outline gives it, with an anchor; or replace it, passing that anchor and the complete new text of the region, including its comments. Only that region changes",
+				Parameters: map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"path": map[string]interface{}{
+							"type":        "string",
+							"description": "File path relative to workspace",
+						},
+						"name": map[string]interface{}{
+							"type":        "string",
+							"description": "Region name from code_outline, e.g. \"Server.start\"",
+						},
+						"action": map[string]interface{}{
+							"type":        "string",
+							"enum":        []string{"get", "replace"},
+							"description": "get (the default) or replace",
+						},
+						"anchor": map[string]interface{}{
+							"type":        "string",
+							"description": "With replace, the anchor from get",
+						},
+						"content": map[string]interface{}{
+							"type":        "string",
+							"description": "With replace, the new text of the whole region; empty to delete it",
+						},
+					},
+					"required": []string{"path", "name"},
+				},
+			},
+		},
+	}
+}
+
+// readRegions reads a file as text and outlines it
+func (e *Engine) readRegions(path string) (string, textFormat, []codeRegion, error) {
+	fullPath, err := e.resolvePath(path)
+	if err != nil {
+		return "", textFormat{}, nil, err
+	}
+	content, err := e.files().ReadFile(fullPath)
+	if err != nil {
+		return "", textFormat{}, nil, fmt.Errorf("failed to read file: %v", err)
+	}
+	text, format := decodeText(content)
+	regions, err := outlineRegions(path, text)
+	return text, format, regions, err
+}
+
+func (e *Engine) codeOutline(args json.RawMessage) (string, error) {
+	var params struct {
+		Path string `json:"path"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return "", fmt.Errorf("invalid arguments: %v", err)
+	}
+	text, _, regions, err := e.readRegions(params.Path)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: %d lines\n", params.Path, strings.Count(strings.TrimSuffix(text, "\n"), "\n")+1)
+	if len(regions) == 0 {
+		b.WriteString("No functions, classes or sections found\n")
+	}
+	for _, region := range regions {
+		indent := 0
+		for _, outer := range regions {
+			if outer.depth < region.depth && outer.start <= region.start && outer.end >= region.end {
+				indent++
+			}
+		}
+		fmt.Fprintf(&b, "%s%s %s  %d-%d\n", strings.Repeat("  ", indent), region.kind, region.name, region.start, region.end)
+	}
+	return b.String(), nil
+}
+
+func (e *Engine) editRegion(args json.RawMessage) (string, error) {
+	var params struct {
+		Path    string  `json:"path"`
+		Name    string  `json:"name"`
+		Action  string  `json:"action"`
+		Anchor  string  `json:"anchor"`
+		Content *string `json:"content"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return "", fmt.Errorf("invalid arguments: %v", err)
+	}
+	text, _, regions, err := e.readRegions(params.Path)
+	if err != nil {
+		return "", err
+	}
+	var region *codeRegion
+	for i := range regions {
+		if regions[i].name == params.Name {
+			region = &regions[i]
+		}
+	}
+	if region == nil {
+		var names []string
+		for _, r := range regions {
+			if strings.HasSuffix(r.name, "."+params.Name) || strings.HasPrefix(r.name, params.Name+"#") {
+				names = append(names, r.name)
+			}
+		}
+		if len(names) > 0 {
+			return "", fmt.Errorf("no region named %s in %s; did you mean %s?", params.Name, params.Path, strings.Join(names, " or "))
+		}
+		return "", fmt.Errorf("no region named %s in %s; use code_outline to list them", params.Name, params.Path)
+	}
+
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	current := strings.Join(lines[region.start-1:region.end], "")
+	anchor := regionAnchor(current)
+
+	switch params.Action {
+	case "", "get":
+		return fmt.Sprintf("%s %s, lines %d-%d of %s, anchor %s:\n%s", region.kind, region.name, region.start, region.end, params.Path, anchor, current), nil
+	case "replace":
+	default:
+		return "", fmt.Errorf("invalid action %q: must be get or replace", params.Action)
+	}
+
+	if params.Content == nil {
+		return "", fmt.Errorf("replace needs content")
+	}
+	if params.Anchor != anchor {
+		return "", fmt.Errorf("%s has changed since its anchor was given, or the anchor is wrong; get it again before replacing it", region.name)
+	}
+	replacement := *params.Content
+	if replacement != "" && !strings.HasSuffix(replacement, "\n") && strings.HasSuffix(current, "\n") {
+		replacement += "\n"
+	}
+	updated := strings.Join(lines[:region.start-1], "") + replacement + strings.Join(lines[region.end:], "")
+	if err := e.saveFile(params.Path, updated, ""); err != nil {
+		return "", err
+	}
+	newLines := strings.Count(replacement, "\n")
+	if replacement == "" {
+		return fmt.Sprintf("Deleted %s (lines %d-%d) from %s", region.name, region.start, region.end, params.Path), nil
+	}
+	return fmt.Sprintf("Replaced %s (lines %d-%d) in %s; it is now lines %d-%d, anchor %s", region.name, region.start, region.end,
+		params.Path, region.start, region.start+newLines-1, regionAnchor(replacement)), nil
+}
@@ -0,0 +1,133 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOutlineRegions(t *testing.T) {
+	tests := []struct {
+		path, text string
+		want       []string
+	}{
+		{"server.go", `package server
+
+import "net/http"
+
+// Server serves the API
+type Server struct {
+	mux *http.ServeMux
+}
+
+const (
+	port = 8080
+	host = "localhost"
+)
+
+// ServeHTTP dispatches a request
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+func main() {}
+`, []string{"type Server 5-8", "const port 11-11", "const host 12-12", "method Server.ServeHTTP 15-18", "func main 20-20"}},
+
+		{"app.py", `import os
+
+class App:
+    """An app"""
+
+    @property
+    def name(self):
+        return "app"
+
+    def run(self):
+        if True:
+            pass
+
+# Entry point
+def main():
+    App().run()
+`, []string{"class App 3-12", "def App.name 6-8", "def App.run 10-12", "def main 14-16"}},
+
+		{"app.js", `// Handles requests
+export class Router {
+  constructor() {
+    this.routes = {};
+  }
+
+  handle(path) {
+    if (path === "/") {
+      return "{";
+    }
+    return route(path, () => {});
+  }
+}
+
+const double = (x) => x * 2;
+
+function route(path, fn) {
+  return fn(path);
+}
+`, []string{"class Router 1-13", "method Router.constructor 3-5", "method Router.handle 7-12", "function route 17-19"}},
+
+		{"README.md", "# Title\n\nIntro\n\n## Install\n\n```\n# not a heading\n```\n\n## Usage\n\nText\n", []string{
+			"section Title 1-13", "section Title.Install 5-10", "section Title.Usage 11-13"}},
+	}
+	for _, test := range tests {
+		regions, err := outlineRegions(test.path, test.text)
+		if err != nil {
+			t.Errorf("%s: %v", test.path, err)
+			continue
+		}
+		var got []string
+		for _, r := range regions {
+			got = append(got, fmt.Sprintf("%s %s %d-%d", r.kind, r.name, r.start, r.end))
+		}
+		if strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+			t.Errorf("%s outline:\n%s\nwant:\n%s", test.path, strings.Join(got, "\n"), strings.Join(test.want, "\n"))
+		}
+	}
+	if _, err := outlineRegions("data.bin", ""); err == nil {
+		t.Error("outlined a binary file")
+	}
+}
+
+func TestEditRegion(t *testing.T) {
+	e := newToolEngine(t)
+	writeTestFile(t, e, "calc.py", "def add(a, b):\n    return a - b\n\n\ndef sub(a, b):\n    return a - b\n")
+
+	outline, err := e.codeOutline(args(t, map[string]string{"path": "calc.py"}))
+	if err != nil || !strings.Contains(outline, "calc.py: 6 lines") || !strings.Contains(outline, "def sub  5-6") {
+		t.Errorf("outline gave %v:\n%s", err, outline)
+	}
+
+	got, err := e.editRegion(args(t, map[string]string{"path": "calc.py", "name": "add"}))
+	if err != nil || !strings.HasSuffix(got, ":\ndef add(a, b):\n    return a - b\n") {
+		t.Fatalf("get gave %v:\n%s", err, got)
+	}
+	anchor := regionAnchor("def add(a, b):\n    return a - b\n")
+	if !strings.Contains(got, "lines 1-2 of calc.py, anchor "+anchor) {
+		t.Errorf("get header:\n%s", got)
+	}
+
+	if _, err := e.editRegion(args(t, map[string]string{"path": "calc.py", "name": "add", "action": "replace", "anchor": "stale", "content": "x"})); err == nil {
+		t.Error("replaced with a stale anchor")
+	}
+	result, err := e.editRegion(args(t, map[string]string{"path": "calc.py", "name": "add", "action": "replace", "anchor": anchor,
+		"content": "def add(a, b):\n    \"\"\"Adds\"\"\"\n    return a + b"}))
+	if err != nil || !strings.Contains(result, "now lines 1-3") {
+		t.Errorf("replace gave %q, %v", result, err)
+	}
+	data, _ := os.ReadFile(filepath.Join(e.workspace, "calc.py"))
+	if string(data) != "def add(a, b):\n    \"\"\"Adds\"\"\"\n    return a + b\n\n\ndef sub(a, b):\n    return a - b\n" {
+		t.Errorf("file after replace:\n%s", data)
+	}
+
+	if _, err := e.editRegion(args(t, map[string]string{"path": "calc.py", "name": "mul"})); err == nil || !strings.Contains(err.Error(), "code_outline") {
+		t.Errorf("unknown region gave %v", err)
+	}
+}
@@ -0,0 +1,94 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Package policies; with packageSandbox, installs are allowed when running
+// in a container and need approval otherwise
+const packageSandbox = "sandbox"
+
+// packageInstallers maps package managers to the subcommands that install
+// packages with them
+var packageInstallers = map[string][]string{
+	"pip": {"install"}, "pip3": {"install"}, "pipx": {"install"}, "uv": {"add"},
+	"poetry": {"add", "install"}, "npm": {"install", "i", "add", "ci"}, "yarn": {"add", "install", ""},
+	"pnpm": {"add", "install", "i"}, "go": {"get", "install"}, "cargo": {"install", "add"},
+	"gem": {"install"}, "bundle": {"install", "add"}, "composer": {"require", "install"},
+	"apt": {"install"}, "apt-get": {"install"}, "yum": {"install"}, "dnf": {"install"},
+	"apk": {"add"}, "brew": {"install"}, "conda": {"install"},
+}
+
+// packageInstaller returns the package manager if the program and
+// arguments install packages, looking inside sh -c and python -m pip
+func packageInstaller(words []string) string {
+	if len(words) == 0 {
+		return ""
+	}
+	name := filepath.Base(words[0])
+	args := words[1:]
+
+	switch name {
+	case "sh", "bash", "zsh", "dash":
+		for i, arg := range args {
+			if arg == "-c" && i+1 < len(args) {
+				if installers := commandInstallers(args[i+1]); len(installers) > 0 {
+					return installers[0]
+				}
+			}
+		}
+		return ""
+	case "python", "python3":
+		if len(args) >= 2 && args[0] == "-m" {
+			return packageInstaller(args[1:])
+		}
+		return ""
+	}
+
+	subcommands, ok := packageInstallers[name]
+	if !ok {
+		return ""
+	}
+	sub := ""
+	for _, arg := range args {
+		if len(arg) > 0 && arg[0] != '-' {
+			sub = arg
+			break
+		}
+	}
+	for _, s := range subcommands {
+		if s == sub {
+			return name
+		}
+	}
+	return ""
+}
+
+// commandInstallers returns the package managers a command line installs
+// packages with
+func commandInstallers(line string) []string {
+	commands, err := parseShell(line)
+	if err != nil {
+		return nil
+	}
+	var installers []string
+	for _, command := range commands {
+		words, _ := programWords(command.words)
+		if installer := packageInstaller(words); installer != "" {
+			installers = append(installers, installer)
+		}
+	}
+	return installers
+}
+
+// inContainer reports whether wex is running in a container, where
+// installing packages can't harm the host
+func inContainer() bool {
+	for _, path := range []string{"/.dockerenv", "/run/.containerenv"} {
+		if _, err := os.Stat(path); err == nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,322 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ContentParser extracts tool calls that a model wrote into its reply text
+// instead of returning them as native tool_calls, along with warnings about
+// what it skipped or repaired, for the caller to log
+type ContentParser interface {
+	Name() string
+	Parse(content string) (toolCalls []ToolCall, warnings []string)
+}
+
+// exampleMarkers are phrases that, on the line before a code block, suggest the
+// block is an illustration rather than a call the model wants executed
+var exampleMarkers = []string{"for example", "e.g.", "example:", "for instance", "such as", "would look like"}
+
+// newContentParsers builds the parser chain from a comma-separated list of
+// names, falling back to the prompt adapter's defaults when the list is empty.
+// mode is the CONTENT_TOOL_CALLS setting: auto, sentinel or off.
+func newContentParsers(names, mode string, defaults []string) ([]ContentParser, error) {
+	if mode == "off" {
+		return nil, nil
+	}
+
+	list := defaults
+	if names != "" {
+		list = strings.Split(names, ",")
+	}
+
+	var parsers []ContentParser
+	for _, name := range list {
+		switch strings.TrimSpace(name) {
+		case "json":
+			parsers = append(parsers, &jsonBlockParser{mode: mode})
+		case "xml":
+			parsers = append(parsers, &xmlTagParser{mode: mode})
+		case "mistral":
+			parsers = append(parsers, &mistralParser{})
+		default:
+			return nil, fmt.Errorf("unknown content parser: %s", name)
+		}
+	}
+	return parsers, nil
+}
+
+// modelFamily guesses the family of a model from its name, e.g.
+// "qwen2.5-coder:14b" -> "qwen", "hf.co/NousResearch/Hermes-3" -> "hermes"
+func modelFamily(model string) string {
+	name := strings.ToLower(model)
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	if i := strings.Index(name, ":"); i >= 0 {
+		name = name[:i]
+	}
+	for _, family := range []string{"qwen", "hermes", "llama", "mistral", "mixtral", "gemma", "phi", "deepseek", "command-r", "granite"} {
+		if strings.HasPrefix(name, family) {
+			return family
+		}
+	}
+	return name
+}
+
+// jsonBlockParser finds tool calls in ```json fenced blocks, or in sentinel
+// mode only in blocks fenced as ```tool_call
+type jsonBlockParser struct {
+	mode string
+}
+
+func (p *jsonBlockParser) Name() string {
+	return "json"
+}
+
+func (p *jsonBlockParser) Parse(content string) ([]ToolCall, []string) {
+	var toolCalls []ToolCall
+	var warnings []string
+
+	// In sentinel mode, only blocks explicitly fenced as tool calls count
+	fence := "```json"
+	if p.mode == "sentinel" {
+		fence = "```tool_call"
+	}
+
+	// Look for JSON code blocks containing tool calls
+	lines := strings.Split(content, "\n")
+	var jsonLines []string
+	inCodeBlock := false
+	isExample := false
+	prevLine := ""
+
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+
+		// Check for start of JSON code block
+		if line == fence && !inCodeBlock {
+			inCodeBlock = true
+			isExample = p.mode == "auto" && isExampleIntro(prevLine)
+			jsonLines = []string{}
+			continue
+		}
+		if line != "" {
+			prevLine = line
+		}
+
+		// Check for end of code block
+		if line == "```" && inCodeBlock {
+			inCodeBlock = false
+			if isExample {
+				warnings = append(warnings, "Skipping tool call block introduced as an example")
+				continue
+			}
+
+			// Parse the collected JSON, which may hold several calls
+			calls, callWarnings := parseToolCallJSON(strings.Join(jsonLines, "\n"))
+			toolCalls = append(toolCalls, calls...)
+			warnings = append(warnings, callWarnings...)
+			continue
+		}
+
+		// Collect lines inside code block
+		if inCodeBlock {
+			jsonLines = append(jsonLines, line)
+		}
+	}
+
+	// Fallback: try to parse the entire content as JSON if no code blocks found
+	if len(toolCalls) == 0 && p.mode != "sentinel" && strings.Contains(content, `"name":`) &&
+		(strings.Contains(content, `"arguments":`) || strings.Contains(content, `"parameters":`)) {
+		var callWarnings []string
+		toolCalls, callWarnings = parseToolCallJSON(content)
+		warnings = append(warnings, callWarnings...)
+	}
+
+	return toolCalls, warnings
+}
+
+var (
+	toolCallTagPattern  = regexp.MustCompile(`(?s)<tool_call>(.*?)</tool_call>`)
+	functionTagPattern  = regexp.MustCompile(`(?s)<function=([\w.-]+)>(.*?)</function>`)
+	parameterTagPattern = regexp.MustCompile(`(?s)<parameter=([\w.-]+)>(.*?)</parameter>`)
+)
+
+// xmlTagParser finds tool calls in the markup used by models trained on
+// Hermes-style <tool_call>{...}</tool_call> or <function=name>...</function>
+// formats. A function body is either a JSON object of arguments or a list of
+// <parameter=key>value</parameter> elements.
+type xmlTagParser struct {
+	mode string
+}
+
+func (p *xmlTagParser) Name() string {
+	return "xml"
+}
+
+func (p *xmlTagParser) Parse(content string) ([]ToolCall, []string) {
+	type match struct {
+		start     int
+		toolCalls []ToolCall
+	}
+	var matches []match
+	var warnings []string
+
+	for _, loc := range toolCallTagPattern.FindAllStringSubmatchIndex(content, -1) {
+		if p.isExample(content, loc[0]) {
+			warnings = append(warnings, "Skipping tool call tag introduced as an example")
+			continue
+		}
+		// A <function=...> body nested inside is handled below
+		body := strings.TrimSpace(content[loc[2]:loc[3]])
+		if strings.HasPrefix(body, "{") || strings.HasPrefix(body, "[") {
+			calls, callWarnings := parseToolCallJSON(body)
+			matches = append(matches, match{loc[0], calls})
+			warnings = append(warnings, callWarnings...)
+		}
+	}
+
+	for _, loc := range functionTagPattern.FindAllStringSubmatchIndex(content, -1) {
+		if p.isExample(content, loc[0]) {
+			warnings = append(warnings, "Skipping tool call tag introduced as an example")
+			continue
+		}
+		name := content[loc[2]:loc[3]]
+		body := strings.TrimSpace(content[loc[4]:loc[5]])
+
+		var args json.RawMessage
+		if strings.HasPrefix(body, "{") {
+			args = json.RawMessage(body)
+		} else {
+			params := make(map[string]string)
+			for _, param := range parameterTagPattern.FindAllStringSubmatch(body, -1) {
+				params[param[1]] = strings.Trim(param[2], "\n")
+			}
+			args, _ = json.Marshal(params)
+		}
+
+		toolCall := ToolCall{Type: "function"}
+		toolCall.Function.Name = name
+		toolCall.Function.Arguments = args
+		matches = append(matches, match{loc[0], []ToolCall{toolCall}})
+	}
+
+	// Execute in the order the calls appear in the text
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].start < matches[j].start
+	})
+	var toolCalls []ToolCall
+	for _, m := range matches {
+		toolCalls = append(toolCalls, m.toolCalls...)
+	}
+	return toolCalls, warnings
+}
+
+// isExample reports whether the tag at offset is introduced as an example
+func (p *xmlTagParser) isExample(content string, offset int) bool {
+	if p.mode != "auto" {
+		return false
+	}
+	before := strings.TrimSpace(content[:offset])
+	if i := strings.LastIndex(before, "\n"); i >= 0 {
+		before = before[i+1:]
+	}
+	return isExampleIntro(before)
+}
+
+// mistralParser finds calls in the [TOOL_CALLS][...] prefix Mistral models
+// emit when their output isn't converted to native tool_calls
+type mistralParser struct{}
+
+func (p *mistralParser) Name() string {
+	return "mistral"
+}
+
+func (p *mistralParser) Parse(content string) ([]ToolCall, []string) {
+	i := strings.Index(content, "[TOOL_CALLS]")
+	if i < 0 {
+		return nil, nil
+	}
+	return parseToolCallJSON(content[i+len("[TOOL_CALLS]"):])
+}
+
+// contentToolCall is the shape of a tool call written in assistant text;
+// Llama 3 style prompts name the arguments "parameters"
+type contentToolCall struct {
+	Name       string          `json:"name"`
+	Arguments  json.RawMessage `json:"arguments"`
+	Parameters json.RawMessage `json:"parameters"`
+}
+
+// parseToolCallJSON parses a sequence of JSON values, each either a single tool
+// call object or an array of them, returning the calls in order, and
+// warnings about what it repaired or couldn't parse
+func parseToolCallJSON(text string) ([]ToolCall, []string) {
+	var toolCalls []ToolCall
+	var warnings []string
+	decoder := json.NewDecoder(strings.NewReader(text))
+
+	for {
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err != nil {
+			if err == io.EOF {
+				break
+			}
+			// A single call written as loose JSON, with single quotes,
+			// trailing commas and so on
+			if len(toolCalls) == 0 {
+				if repaired, ok := repairJSON(text); ok {
+					toolCalls, warnings := parseToolCallJSON(repaired)
+					return toolCalls, append([]string{"Repaired tool call JSON"}, warnings...)
+				}
+			}
+			warnings = append(warnings, fmt.Sprintf("Could not parse tool call JSON: %v", err))
+			break
+		}
+
+		var calls []contentToolCall
+		if trimmed := bytes.TrimSpace(value); len(trimmed) > 0 && trimmed[0] == '[' {
+			if err := json.Unmarshal(value, &calls); err != nil {
+				warnings = append(warnings, fmt.Sprintf("Could not parse tool call array: %v", err))
+				continue
+			}
+		} else {
+			var call contentToolCall
+			if err := json.Unmarshal(value, &call); err != nil {
+				continue
+			}
+			calls = append(calls, call)
+		}
+
+		for _, call := range calls {
+			if call.Name == "" {
+				continue
+			}
+			toolCall := ToolCall{Type: "function"}
+			toolCall.Function.Name = call.Name
+			toolCall.Function.Arguments = call.Arguments
+			if len(call.Arguments) == 0 {
+				toolCall.Function.Arguments = call.Parameters
+			}
+			toolCalls = append(toolCalls, toolCall)
+		}
+	}
+	return toolCalls, warnings
+}
+
+// isExampleIntro reports whether a line of prose introduces an example
+func isExampleIntro(line string) bool {
+	line = strings.ToLower(line)
+	for _, marker := range exampleMarkers {
+		if strings.Contains(line, marker) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,44 @@
+package agent
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestContentParserWarnings(t *testing.T) {
+	for _, test := range []struct {
+		parser  ContentParser
+		content string
+		calls   int
+		warning string
+	}{
+		{&jsonBlockParser{mode: "auto"}, "For example:\n```json\n{\"name\": \"read_file\", \"arguments\": {}}\n```", 0, "introduced as an example"},
+		{&jsonBlockParser{mode: "auto"}, "```json\n{'name': 'read_file', 'arguments': {},}\n```", 1, "Repaired tool call JSON"},
+		{&jsonBlockParser{mode: "auto"}, "```json\n{\"name\": \"read_file\", \"arguments\": {}}\n```", 1, ""},
+		{&xmlTagParser{mode: "auto"}, "Such as:\n<tool_call>{\"name\": \"read_file\", \"arguments\": {}}</tool_call>", 0, "introduced as an example"},
+		{&mistralParser{}, "[TOOL_CALLS][{\"name\": \"read_file\", \"arguments\": {}}] [", 1, "Could not parse tool call JSON"},
+	} {
+		calls, warnings := test.parser.Parse(test.content)
+		if len(calls) != test.calls || (test.warning == "") != (len(warnings) == 0) ||
+			test.warning != "" && !strings.Contains(strings.Join(warnings, "\n"), test.warning) {
+			t.Errorf("%s parsing %q gave %d calls, warnings %q", test.parser.Name(), test.content, len(calls), warnings)
+		}
+	}
+}
+
+func TestContentParserWarningsLogged(t *testing.T) {
+	e, _, events := newTestEngine(t, []ChatResponse{
+		reply("For example:\n```json\n{\"name\": \"list_files\", \"arguments\": {}}\n```"),
+	})
+	e.contentParsers, _ = newContentParsers("json", "auto", nil)
+	if _, err := e.Run(context.Background(), "How do I list files?"); err != nil {
+		t.Fatal(err)
+	}
+	for _, event := range *events {
+		if event.Type == EventLog && strings.Contains(event.Text, "introduced as an example") {
+			return
+		}
+	}
+	t.Error("the skipped example was not logged")
+}
@@ -0,0 +1,160 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Symlink policies for file tools. With symlinkWithin, links are followed
+// only while they resolve inside the workspace.
+const (
+	symlinkWithin = "within"
+	symlinkFollow = "follow"
+	symlinkDeny   = "deny"
+)
+
+// resolvePath maps a path given to a file tool to a path on disk, applying
+// the symlink policy and refusing anything that would leave the workspace
+// or that is not a regular file or directory
+func (e *Engine) resolvePath(path string) (string, error) {
+	fullPath := filepath.Join(e.workspace, path)
+	if !isWithin(e.workspace, fullPath) {
+		return "", fmt.Errorf("%s is outside the workspace", path)
+	}
+
+	workspace, err := e.files().EvalSymlinks(e.workspace)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve workspace: %v", err)
+	}
+
+	// Walk the path a component at a time, so that a link anywhere along it
+	// is seen, and so that paths which do not exist yet can still be checked
+	rel, _ := filepath.Rel(e.workspace, fullPath)
+	resolved := workspace
+	components := strings.Split(rel, string(filepath.Separator))
+	for i, component := range components {
+		if component == "." {
+			continue
+		}
+		next := filepath.Join(resolved, component)
+		info, err := e.files().Lstat(next)
+		if err != nil {
+			// Nothing further exists, so there are no more links to follow
+			resolved = filepath.Join(append([]string{next}, components[i+1:]...)...)
+			break
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		if e.symlinkPolicy == symlinkDeny {
+			return "", fmt.Errorf("%s is a symbolic link, and symbolic links are not allowed", filepath.Join(components[:i+1]...))
+		}
+		target, err := e.files().EvalSymlinks(next)
+		if err != nil {
+			return "", fmt.Errorf("%s is a broken symbolic link: %v", filepath.Join(components[:i+1]...), err)
+		}
+		if e.symlinkPolicy != symlinkFollow && !isWithin(workspace, target) {
+			return "", fmt.Errorf("%s is a symbolic link to %s, outside the workspace", filepath.Join(components[:i+1]...), target)
+		}
+		resolved = target
+	}
+
+	if info, err := e.files().Stat(resolved); err == nil {
+		if kind := specialFileKind(info.Mode()); kind != "" {
+			return "", fmt.Errorf("%s is %s, not a regular file", path, kind)
+		}
+	}
+	return resolved, nil
+}
+
+// specialFileKind describes file types the file tools refuse to touch, or
+// returns "" for regular files and directories
+func specialFileKind(mode os.FileMode) string {
+	switch {
+	case mode&os.ModeDevice != 0:
+		return "a device file"
+	case mode&os.ModeNamedPipe != 0:
+		return "a named pipe"
+	case mode&os.ModeSocket != 0:
+		return "a socket"
+	case mode.IsRegular() || mode.IsDir():
+		return ""
+	default:
+		return "a special file"
+	}
+}
+
+// contentTools return file contents, in which paths must be left as they
+// are, since the model may write them back
+var contentTools = map[string]bool{
+	"read_file":      true,
+	"read_files":     true,
+	"read_json_path": true,
+	"read_env_file":  true,
+	"preview_table":  true,
+	"diff_files":     true,
+}
+
+// relativePaths rewrites absolute paths into the workspace as paths
+// relative to it, so that tool results and the log read the same wherever
+// the workspace is, and don't reveal where it is on the host. The
+// workspace is recognized as the engine sees it, with symbolic links
+// resolved, and, when running in a container, as the host sees it.
+func (e *Engine) relativePaths(text string) string {
+	roots := []string{e.workspace, e.hostWorkspace}
+	if resolved, err := filepath.EvalSymlinks(e.workspace); err == nil {
+		roots = append(roots, resolved)
+	}
+	sort.Slice(roots, func(i, j int) bool {
+		return len(roots[i]) > len(roots[j])
+	})
+	for _, root := range roots {
+		root = strings.TrimRight(filepath.ToSlash(root), "/")
+		if root != "" {
+			text = relativeTo(text, root)
+		}
+	}
+	return text
+}
+
+// relativeTo rewrites occurrences of root in text, which start a path and
+// aren't part of a longer name, as . or the relative path following it
+func relativeTo(text, root string) string {
+	var b strings.Builder
+	for {
+		i := strings.Index(text, root)
+		if i < 0 {
+			b.WriteString(text)
+			return b.String()
+		}
+		rest := text[i+len(root):]
+		switch {
+		case i > 0 && isPathByte(text[i-1]) || rest != "" && rest[0] != '/' && isPathByte(rest[0]):
+			// Part of some other path
+			b.WriteString(text[:i+len(root)])
+		case len(rest) > 1 && rest[0] == '/' && isPathByte(rest[1]) && rest[1] != '/':
+			b.WriteString(text[:i])
+			rest = rest[1:]
+		default:
+			b.WriteString(text[:i])
+			b.WriteString(".")
+		}
+		text = rest
+	}
+}
+
+func isPathByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		c == '.' || c == '_' || c == '-' || c == '~' || c == '/' || c >= 0x80
+}
+
+// isWithin reports whether path is dir or lies inside it
+func isWithin(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,645 @@
+package agent
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// In CI, --plan-output has a session propose its changes without making
+// them, so a pipeline can have a person approve them before wex apply
+// makes them in a later step. The file tools write to an overlay held in
+// memory, which they read back as if it were the workspace, and only
+// read-only commands from a short list run, since anything else, even a
+// build or a test, would run on the real disk without seeing the overlay.
+// The plan records each file's new content and mode, a hash of what it
+// replaces, and a diff to review, and is encrypted like a session with
+// SESSION_KEY_FILE; wex apply refuses a plan whose files have changed
+// since.
+
+// planVersion is the version of the plan format written
+const planVersion = 1
+
+// Plan is the set of changes a session proposed
+type Plan struct {
+	Version   int          `json:"version"`
+	Request   string       `json:"request"`
+	Model     string       `json:"model"`
+	Created   time.Time    `json:"created"`
+	GitCommit string       `json:"git_commit,omitempty"`
+	Reply     string       `json:"reply,omitempty"`
+	Diff      string       `json:"diff"`
+	Changes   []PlanChange `json:"changes"`
+}
+
+// PlanChange is a file the plan creates, modifies or deletes. Content is
+// the new text, or ContentBase64 the new bytes if they aren't UTF-8, and
+// Original the SHA-256 of the file being replaced.
+type PlanChange struct {
+	Path          string      `json:"path"`
+	Action        string      `json:"action"`
+	Mode          fs.FileMode `json:"mode,omitempty"`
+	Original      string      `json:"original_sha256,omitempty"`
+	Content       *string     `json:"content,omitempty"`
+	ContentBase64 string      `json:"content_base64,omitempty"`
+}
+
+// The actions of a plan change
+const (
+	planCreate = "create"
+	planModify = "modify"
+	planDelete = "delete"
+)
+
+// overlayFS reads from another filesystem, but keeps writes in memory
+// and records removals, so the changes can be seen, and read back, without
+// touching what is underneath
+type overlayFS struct {
+	base  FS
+	upper *MemFS
+
+	mu      sync.Mutex
+	deleted map[string]bool
+}
+
+func newOverlayFS(base FS) *overlayFS {
+	return &overlayFS{base: base, upper: NewMemFS("/", nil), deleted: make(map[string]bool)}
+}
+
+// inUpper reports whether the overlay has its own copy of a path
+func (o *overlayFS) inUpper(name string) bool {
+	_, err := o.upper.Lstat(name)
+	return err == nil
+}
+
+// isDeleted reports whether a path, or a directory it is in, was removed
+func (o *overlayFS) isDeleted(name string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for path := filepath.Clean(name); ; path = filepath.Dir(path) {
+		if o.deleted[path] {
+			return true
+		}
+		if path == filepath.Dir(path) {
+			return false
+		}
+	}
+}
+
+func notExist(op, name string) error {
+	return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+}
+
+func (o *overlayFS) Open(name string) (File, error) {
+	if o.inUpper(name) {
+		return o.upper.Open(name)
+	}
+	if o.isDeleted(name) {
+		return nil, notExist("open", name)
+	}
+	return o.base.Open(name)
+}
+
+func (o *overlayFS) ReadFile(name string) ([]byte, error) {
+	if o.inUpper(name) {
+		return o.upper.ReadFile(name)
+	}
+	if o.isDeleted(name) {
+		return nil, notExist("open", name)
+	}
+	return o.base.ReadFile(name)
+}
+
+func (o *overlayFS) Stat(name string) (fs.FileInfo, error) {
+	if o.inUpper(name) {
+		return o.upper.Stat(name)
+	}
+	if o.isDeleted(name) {
+		return nil, notExist("stat", name)
+	}
+	return o.base.Stat(name)
+}
+
+func (o *overlayFS) Lstat(name string) (fs.FileInfo, error) {
+	if o.inUpper(name) {
+		return o.upper.Lstat(name)
+	}
+	if o.isDeleted(name) {
+		return nil, notExist("lstat", name)
+	}
+	return o.base.Lstat(name)
+}
+
+func (o *overlayFS) EvalSymlinks(name string) (string, error) {
+	if o.inUpper(name) {
+		return filepath.Clean(name), nil
+	}
+	if o.isDeleted(name) {
+		return "", notExist("lstat", name)
+	}
+	return o.base.EvalSymlinks(name)
+}
+
+// ReadDir merges the directory underneath with the overlay's copy of it
+func (o *overlayFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	info, err := o.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, &fs.PathError{Op: "readdirent", Path: name, Err: errors.New("not a directory")}
+	}
+	merged := make(map[string]fs.DirEntry)
+	if base, err := o.base.ReadDir(name); err == nil && !o.isDeleted(name) {
+		for _, entry := range base {
+			if !o.isDeleted(filepath.Join(name, entry.Name())) {
+				merged[entry.Name()] = entry
+			}
+		}
+	}
+	if upper, err := o.upper.ReadDir(name); err == nil {
+		for _, entry := range upper {
+			merged[entry.Name()] = entry
+		}
+	}
+	entries := make([]fs.DirEntry, 0, len(merged))
+	for _, entry := range merged {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// prepare gives the overlay the directory a file is to be written in, if
+// it exists underneath, and forgets any removal of the file
+func (o *overlayFS) prepare(op, name string) error {
+	dir := filepath.Dir(name)
+	info, err := o.Stat(dir)
+	if err != nil {
+		return notExist(op, name)
+	}
+	if !info.IsDir() {
+		return &fs.PathError{Op: op, Path: name, Err: errors.New("not a directory")}
+	}
+	if err := o.upper.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	o.mu.Lock()
+	delete(o.deleted, filepath.Clean(name))
+	o.mu.Unlock()
+	return nil
+}
+
+func (o *overlayFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	if err := o.prepare("open", name); err != nil {
+		return err
+	}
+	return o.upper.WriteFile(name, data, perm)
+}
+
+func (o *overlayFS) Create(name string, perm fs.FileMode) (io.WriteCloser, error) {
+	if err := o.prepare("open", name); err != nil {
+		return nil, err
+	}
+	return o.upper.Create(name, perm)
+}
+
+func (o *overlayFS) MkdirAll(name string, perm fs.FileMode) error {
+	if info, err := o.Stat(name); err == nil && !info.IsDir() {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: errors.New("not a directory")}
+	}
+	o.mu.Lock()
+	for path := filepath.Clean(name); path != filepath.Dir(path); path = filepath.Dir(path) {
+		delete(o.deleted, path)
+	}
+	o.mu.Unlock()
+	return o.upper.MkdirAll(name, perm)
+}
+
+func (o *overlayFS) Chmod(name string, mode fs.FileMode) error {
+	if !o.inUpper(name) {
+		info, err := o.Stat(name)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return o.upper.MkdirAll(name, mode)
+		}
+		data, err := o.base.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		if err := o.WriteFile(name, data, info.Mode()); err != nil {
+			return err
+		}
+	}
+	return o.upper.Chmod(name, mode)
+}
+
+// Rename copies a file to its new name and removes the old one; renaming
+// a directory is refused, rather than copying everything in it
+func (o *overlayFS) Rename(oldName, newName string) error {
+	info, err := o.Stat(oldName)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: errors.New("renaming a directory is not supported while planning")}
+	}
+	data, err := o.ReadFile(oldName)
+	if err != nil {
+		return err
+	}
+	if err := o.WriteFile(newName, data, info.Mode()); err != nil {
+		return err
+	}
+	return o.Remove(oldName)
+}
+
+func (o *overlayFS) Remove(name string) error {
+	info, err := o.Stat(name)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		if entries, err := o.ReadDir(name); err != nil || len(entries) > 0 {
+			return &fs.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
+		}
+	}
+	if o.inUpper(name) {
+		if err := o.upper.Remove(name); err != nil {
+			return err
+		}
+	}
+	if _, err := o.base.Lstat(name); err == nil {
+		o.mu.Lock()
+		o.deleted[filepath.Clean(name)] = true
+		o.mu.Unlock()
+	}
+	return nil
+}
+
+// changes lists the files the overlay creates, modifies or deletes, by
+// their paths, leaving out those written with what they had and the mode
+// they had
+func (o *overlayFS) changes() (changed map[string][]byte, deleted []string) {
+	changed = make(map[string][]byte)
+	modes := make(map[string]fs.FileMode)
+	o.upper.mu.Lock()
+	for path, entry := range o.upper.entries {
+		if entry.mode.IsRegular() {
+			changed[path], modes[path] = entry.data, entry.mode.Perm()
+		}
+	}
+	o.upper.mu.Unlock()
+	for path, data := range changed {
+		info, err := o.base.Stat(path)
+		if err != nil || info.Mode().Perm() != modes[path] {
+			continue
+		}
+		if original, err := o.base.ReadFile(path); err == nil && bytes.Equal(original, data) {
+			delete(changed, path)
+		}
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for path := range o.deleted {
+		if info, err := o.base.Lstat(path); err == nil && !info.IsDir() {
+			deleted = append(deleted, path)
+		}
+	}
+	return changed, deleted
+}
+
+// startPlan has the session propose its changes rather than make them
+func (e *Engine) startPlan() {
+	e.plan = newOverlayFS(e.files())
+	e.filesystem = e.plan
+	if e.commandPolicy == nil {
+		e.commandPolicy = make(map[commandClass]string)
+	}
+	for class := range commandClassNames {
+		if commandClass(class) != classReadOnly {
+			e.commandPolicy[commandClass(class)] = policyDeny
+		}
+	}
+}
+
+// planPrograms are the only programs that run while planning, and
+// planGitSubcommands the only git subcommands. Being classified read-only
+// isn't enough, since the real disk is where commands run, and an option
+// the classifier doesn't know could write to it or run something else;
+// so each command must be one of these by name, with no wrapper or
+// variable assignment in front.
+var (
+	planPrograms = map[string]bool{
+		"ls": true, "cat": true, "head": true, "tail": true, "wc": true, "pwd": true,
+		"grep": true, "egrep": true, "tree": true, "file": true, "stat": true, "du": true,
+		"df": true, "which": true, "echo": true, "printf": true, "true": true, "false": true,
+		"test": true, "[": true, "date": true, "basename": true, "dirname": true,
+		"realpath": true, "readlink": true, "md5sum": true, "sha256sum": true, "nl": true,
+		"cut": true, "tr": true, "uniq": true, "diff": true, "cmp": true, "jq": true,
+		"cd": true, "git": true,
+	}
+	planGitSubcommands = map[string]bool{
+		"status": true, "log": true, "diff": true, "show": true, "ls-files": true,
+		"rev-parse": true, "blame": true, "describe": true, "shortlog": true,
+	}
+)
+
+// checkPlanCommand refuses a command while planning unless every part of
+// it is on the allowlist. Nothing that runs a command within a command, or
+// opens a file, is allowed either: no command substitution, here-document
+// or redirection.
+func checkPlanCommand(command string) error {
+	if strings.Contains(command, "$(") || strings.Contains(command, "`") {
+		return fmt.Errorf("command refused: command substitutions don't run while planning")
+	}
+	file, err := syntax.NewParser(syntax.Variant(syntax.LangBash)).Parse(strings.NewReader(command), "")
+	if err != nil {
+		return fmt.Errorf("command refused: %v", err)
+	}
+	syntax.Walk(file, func(node syntax.Node) bool {
+		switch node := node.(type) {
+		case *syntax.Redirect:
+			if node.Op == syntax.Hdoc || node.Op == syntax.DashHdoc {
+				err = fmt.Errorf("command refused: here-documents aren't allowed while planning")
+			} else {
+				err = fmt.Errorf("command refused: redirections aren't allowed while planning")
+			}
+		case *syntax.ProcSubst:
+			err = fmt.Errorf("command refused: process substitutions don't run while planning")
+		}
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+	commands, err := parseShell(command)
+	if err != nil {
+		return fmt.Errorf("command refused: %v", err)
+	}
+	for _, c := range commands {
+		if len(c.words) == 0 {
+			continue
+		}
+		name := c.words[0]
+		if !planPrograms[name] {
+			return fmt.Errorf("command refused: %s doesn't run while planning, which runs only a few read-only programs", name)
+		}
+		if name != "git" {
+			continue
+		}
+		args := c.words[1:]
+		if len(args) > 0 && args[0] == "--no-pager" {
+			args = args[1:]
+		}
+		if len(args) == 0 || !planGitSubcommands[args[0]] {
+			return fmt.Errorf("command refused: git doesn't run while planning except for %s", strings.Join(slices.Sorted(maps.Keys(planGitSubcommands)), ", "))
+		}
+	}
+	return nil
+}
+
+// buildPlan collects the changes the session proposed
+func (e *Engine) buildPlan(request string) (*Plan, error) {
+	plan := &Plan{
+		Version: planVersion,
+		Request: request,
+		Model:   e.model,
+		Created: time.Now(),
+		Reply:   e.reply,
+		Changes: []PlanChange{},
+	}
+	plan.GitCommit, _ = e.git("rev-parse", "HEAD")
+
+	changed, deleted := e.plan.changes()
+	var diff strings.Builder
+	addChange := func(fullPath, action string, data []byte) error {
+		rel, err := filepath.Rel(e.workspace, fullPath)
+		if err != nil || !filepath.IsLocal(rel) {
+			return fmt.Errorf("%s is outside the workspace", fullPath)
+		}
+		rel = filepath.ToSlash(rel)
+		change := PlanChange{Path: rel, Action: action}
+		before, from := "", "/dev/null"
+		var originalMode fs.FileMode
+		if info, err := e.plan.base.Stat(fullPath); err == nil {
+			originalMode = info.Mode().Perm()
+		}
+		if original, err := e.plan.base.ReadFile(fullPath); err == nil {
+			sum := sha256.Sum256(original)
+			change.Original = hex.EncodeToString(sum[:])
+			before, from = string(original), "a/"+rel
+		}
+		after, to := "", "/dev/null"
+		if action != planDelete {
+			info, err := e.plan.upper.Stat(fullPath)
+			if err != nil {
+				return err
+			}
+			change.Mode = info.Mode().Perm()
+			if utf8.Valid(data) {
+				content := string(data)
+				change.Content = &content
+			} else {
+				change.ContentBase64 = base64.StdEncoding.EncodeToString(data)
+			}
+			after, to = string(data), "b/"+rel
+		}
+		if action == planModify && change.Mode != originalMode {
+			fmt.Fprintf(&diff, "Mode of %s changes from %04o to %04o\n", rel, originalMode, change.Mode)
+		}
+		if utf8.ValidString(before) && utf8.ValidString(after) {
+			diff.WriteString(unifiedDiff(from, to, before, after, 3))
+		} else {
+			fmt.Fprintf(&diff, "Binary files %s and %s differ\n", from, to)
+		}
+		plan.Changes = append(plan.Changes, change)
+		return nil
+	}
+
+	paths := make([]string, 0, len(changed))
+	for path := range changed {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	sort.Strings(deleted)
+	for _, path := range paths {
+		action := planCreate
+		if _, err := e.plan.base.Lstat(path); err == nil {
+			action = planModify
+		}
+		if err := addChange(path, action, changed[path]); err != nil {
+			return nil, err
+		}
+	}
+	for _, path := range deleted {
+		if err := addChange(path, planDelete, nil); err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(plan.Changes, func(i, j int) bool { return plan.Changes[i].Path < plan.Changes[j].Path })
+	plan.Diff = diff.String()
+	return plan, nil
+}
+
+// writePlan saves the changes the session proposed, encrypted if there is
+// a session key, since they may hold the same secrets as a session
+func (e *Engine) writePlan(path, request string) (*Plan, error) {
+	plan, err := e.buildPlan(request)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal plan: %v", err)
+	}
+	if err := writeSealed(path, append(data, '\n'), e.sessionKey); err != nil {
+		return nil, fmt.Errorf("failed to write plan: %v", err)
+	}
+	return plan, nil
+}
+
+// runApply handles "wex apply", which makes the changes in a plan, after
+// checking that none of its files have changed since it was made. Files
+// are reached through the workspace confined, so a symbolic link can't
+// lead a change outside it.
+func runApply(workspace string, args []string, w io.Writer) error {
+	applyFlags := flag.NewFlagSet("apply", flag.ExitOnError)
+	check := applyFlags.Bool("check", false, "Only check that the plan still applies cleanly")
+	applyFlags.Usage = func() {
+		fmt.Fprintf(applyFlags.Output(), "Usage: wex apply [--check] PLAN\n")
+		applyFlags.PrintDefaults()
+	}
+	applyFlags.Parse(args)
+	if applyFlags.NArg() != 1 {
+		applyFlags.Usage()
+		return fmt.Errorf("expected a plan file")
+	}
+
+	key, err := sessionKeyFromEnv()
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(applyFlags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if data, err = openSealed(data, key); err != nil {
+		return fmt.Errorf("%s: %v", applyFlags.Arg(0), err)
+	}
+	var plan Plan
+	if err := json.Unmarshal(data, &plan); err != nil {
+		return fmt.Errorf("%s: invalid plan: %v", applyFlags.Arg(0), err)
+	}
+	if plan.Version != planVersion {
+		return fmt.Errorf("%s: plan version %d, but this wex reads version %d", applyFlags.Arg(0), plan.Version, planVersion)
+	}
+
+	if workspace, err = filepath.Abs(workspace); err != nil {
+		return fmt.Errorf("failed to resolve workspace: %v", err)
+	}
+	files := rootFS{osFS{}, workspace}
+
+	// Check everything before changing anything
+	contents := make([][]byte, len(plan.Changes))
+	var conflicts []string
+	for i, change := range plan.Changes {
+		if !filepath.IsLocal(filepath.FromSlash(change.Path)) {
+			return fmt.Errorf("%s: %s is outside the workspace", applyFlags.Arg(0), change.Path)
+		}
+		switch change.Action {
+		case planCreate, planModify:
+			if change.Content != nil {
+				contents[i] = []byte(*change.Content)
+			} else if contents[i], err = base64.StdEncoding.DecodeString(change.ContentBase64); err != nil {
+				return fmt.Errorf("%s: invalid content for %s: %v", applyFlags.Arg(0), change.Path, err)
+			}
+		case planDelete:
+		default:
+			return fmt.Errorf("%s: invalid action %q for %s", applyFlags.Arg(0), change.Action, change.Path)
+		}
+
+		current, err := files.ReadFile(filepath.Join(workspace, filepath.FromSlash(change.Path)))
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			if change.Original != "" {
+				conflicts = append(conflicts, fmt.Sprintf("%s: deleted", change.Path))
+			}
+		case err != nil:
+			return err
+		case change.Original == "":
+			conflicts = append(conflicts, fmt.Sprintf("%s: created", change.Path))
+		default:
+			if sum := sha256.Sum256(current); hex.EncodeToString(sum[:]) != change.Original {
+				conflicts = append(conflicts, fmt.Sprintf("%s: changed", change.Path))
+			}
+		}
+	}
+	if len(conflicts) > 0 {
+		return fmt.Errorf("the workspace has changed since the plan was made:\n  %s", strings.Join(conflicts, "\n  "))
+	}
+	if *check {
+		fmt.Fprintf(w, "The plan applies cleanly: %s\n", plural(len(plan.Changes), "change"))
+		return nil
+	}
+
+	for i, change := range plan.Changes {
+		fullPath := filepath.Join(workspace, filepath.FromSlash(change.Path))
+		if change.Action == planDelete {
+			err = files.Remove(fullPath)
+		} else {
+			err = applyChange(files, fullPath, contents[i], change.Mode)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to %s %s, after applying %s: %v", change.Action, change.Path, plural(i, "change"), err)
+		}
+		fmt.Fprintf(w, "%s %s\n", change.Action, change.Path)
+	}
+	fmt.Fprintf(w, "Applied %s\n", plural(len(plan.Changes), "change"))
+	return nil
+}
+
+// applyChange writes a file the plan creates or modifies, giving it the
+// mode the plan says even if it already existed with another. Only the
+// permission bits are taken, so a plan can't make a file setuid.
+func applyChange(files FS, fullPath string, data []byte, mode fs.FileMode) error {
+	mode &= fs.ModePerm
+	if mode == 0 {
+		mode = 0644
+	}
+	if err := files.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return err
+	}
+	if err := files.WriteFile(fullPath, data, mode); err != nil {
+		return err
+	}
+	info, err := files.Stat(fullPath)
+	if err != nil {
+		return err
+	}
+	if info.Mode().Perm() != mode {
+		return files.Chmod(fullPath, mode)
+	}
+	return nil
+}
@@ -0,0 +1,293 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOverlayFS(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "old"), 0755)
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("a\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "old", "b.txt"), []byte("b\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "same.txt"), []byte("same\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "run.sh"), []byte("make\n"), 0644)
+
+	o := newOverlayFS(osFS{})
+	if err := o.MkdirAll(filepath.Join(dir, "new", "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for path, content := range map[string]string{"a.txt": "A\n", "new/sub/c.txt": "c\n", "same.txt": "same\n"} {
+		if err := o.WriteFile(filepath.Join(dir, path), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := o.Remove(filepath.Join(dir, "old")); err == nil {
+		t.Errorf("removed a directory with a file in it")
+	}
+	if err := o.Rename(filepath.Join(dir, "old", "b.txt"), filepath.Join(dir, "b.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Remove(filepath.Join(dir, "old")); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Chmod(filepath.Join(dir, "run.sh"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.WriteFile(filepath.Join(dir, "missing", "d.txt"), nil, 0644); err == nil {
+		t.Errorf("wrote into a directory that doesn't exist")
+	}
+
+	if data, err := o.ReadFile(filepath.Join(dir, "a.txt")); err != nil || string(data) != "A\n" {
+		t.Errorf("a.txt reads back as %q, %v", data, err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "a.txt")); string(data) != "a\n" {
+		t.Errorf("a.txt on disk has %q", data)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "old", "b.txt")); err != nil {
+		t.Errorf("old/b.txt was removed from the disk: %v", err)
+	}
+	if _, err := o.Stat(filepath.Join(dir, "old", "b.txt")); err == nil {
+		t.Errorf("old/b.txt is still there")
+	}
+	entries, err := o.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if strings.Join(names, " ") != "a.txt b.txt new run.sh same.txt" {
+		t.Errorf("entries %v", names)
+	}
+
+	changed, deleted := o.changes()
+	var paths []string
+	for path := range changed {
+		rel, _ := filepath.Rel(dir, path)
+		paths = append(paths, rel)
+	}
+	if len(paths) != 4 || changed[filepath.Join(dir, "b.txt")] == nil || changed[filepath.Join(dir, "run.sh")] == nil || changed[filepath.Join(dir, "same.txt")] != nil {
+		t.Errorf("changed %v", paths)
+	}
+	if len(deleted) != 1 || deleted[0] != filepath.Join(dir, "old", "b.txt") {
+		t.Errorf("deleted %v", deleted)
+	}
+}
+
+func TestPlanAndApply(t *testing.T) {
+	e, provider, _ := newTestEngine(t, []ChatResponse{
+		reply("", call("write_file", `{"path": "main.go", "content": "package main\n\nfunc main() {}\n"}`), call("write_file", `{"path": "cmd/tool/tool.go", "content": "package tool\n"}`)),
+		reply("", call("read_file", `{"path": "cmd/tool/tool.go"}`), call("run_command", `{"command": "touch built"}`), call("run_command", `{"command": "go test ./..."}`)),
+		reply("Added a main function and a tool package"),
+	})
+	writeTestFile(t, e, "main.go", "package main\n")
+	e.startPlan()
+	if _, err := e.Run(t.Context(), "Add a tool"); err != nil {
+		t.Fatal(err)
+	}
+	results := toolResults(provider.lastMessages(t, 3))
+	if len(results) != 5 || !strings.Contains(results[2].Content, "package tool") || !strings.Contains(results[3].Content, "write commands are not allowed") ||
+		!strings.Contains(results[4].Content, "build commands are not allowed") {
+		t.Errorf("tool results %+v", results)
+	}
+	if data, _ := os.ReadFile(filepath.Join(e.workspace, "main.go")); string(data) != "package main\n" {
+		t.Errorf("planning changed main.go to %q", data)
+	}
+
+	path := filepath.Join(t.TempDir(), "plan.json")
+	plan, err := e.writePlan(path, "Add a tool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Changes) != 2 || plan.Changes[0].Path != "cmd/tool/tool.go" || plan.Changes[0].Action != planCreate || plan.Changes[1].Action != planModify || plan.Changes[1].Original == "" {
+		t.Errorf("changes %+v", plan.Changes)
+	}
+	if !strings.Contains(plan.Diff, "--- /dev/null\n+++ b/cmd/tool/tool.go\n") || !strings.Contains(plan.Diff, "+func main() {}\n") || plan.Reply != "Added a main function and a tool package" {
+		t.Errorf("plan %+v", plan)
+	}
+
+	var out strings.Builder
+	if err := runApply(e.workspace, []string{"--check", path}, &out); err != nil || out.String() != "The plan applies cleanly: 2 changes\n" {
+		t.Errorf("--check: %v\n%s", err, out.String())
+	}
+	out.Reset()
+	if err := runApply(e.workspace, []string{path}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "create cmd/tool/tool.go\nmodify main.go\nApplied 2 changes\n" {
+		t.Errorf("output:\n%s", out.String())
+	}
+	if data, _ := os.ReadFile(filepath.Join(e.workspace, "cmd", "tool", "tool.go")); string(data) != "package tool\n" {
+		t.Errorf("tool.go has %q", data)
+	}
+
+	// Once applied, the files no longer match the plan
+	if err := runApply(e.workspace, []string{path}, &out); err == nil || !strings.Contains(err.Error(), "cmd/tool/tool.go: created\n  main.go: changed") {
+		t.Errorf("applying twice gave %v", err)
+	}
+
+	plan.Changes = []PlanChange{{Path: "../escape.txt", Action: planCreate}}
+	data, _ := json.Marshal(plan)
+	os.WriteFile(path, data, 0644)
+	if err := runApply(e.workspace, []string{path}, &out); err == nil || !strings.Contains(err.Error(), "outside the workspace") {
+		t.Errorf("a path outside the workspace gave %v", err)
+	}
+}
+
+func TestApplyModesAndLinks(t *testing.T) {
+	e, _, _ := newTestEngine(t, nil)
+	writeTestFile(t, e, "run.sh", "make\n")
+	e.startPlan()
+	if err := e.files().Chmod(filepath.Join(e.workspace, "run.sh"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// With a session key, the plan is encrypted, and only its owner may read it
+	keyFile := filepath.Join(t.TempDir(), "key")
+	os.WriteFile(keyFile, []byte(strings.Repeat("k", 32)), 0600)
+	key, err := loadSessionKey(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.sessionKey = key
+	path := filepath.Join(t.TempDir(), "plan.json")
+	plan, err := e.writePlan(path, "Make run.sh executable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Changes) != 1 || plan.Changes[0].Mode != 0755 || !strings.Contains(plan.Diff, "Mode of run.sh changes from 0644 to 0755") {
+		t.Errorf("plan %+v", plan)
+	}
+	if data, _ := os.ReadFile(path); !strings.HasPrefix(string(data), encryptedHeader) {
+		t.Errorf("plan is not encrypted")
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("plan has mode %v, %v", info.Mode(), err)
+	}
+
+	var out strings.Builder
+	if err := runApply(e.workspace, []string{path}, &out); err == nil || !strings.Contains(err.Error(), "SESSION_KEY_FILE") {
+		t.Errorf("applying without the key gave %v", err)
+	}
+	t.Setenv("SESSION_KEY_FILE", keyFile)
+	if err := runApply(e.workspace, []string{path}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(filepath.Join(e.workspace, "run.sh")); err != nil || info.Mode().Perm() != 0755 {
+		t.Errorf("run.sh has mode %v, %v", info.Mode(), err)
+	}
+	t.Setenv("SESSION_KEY_FILE", "")
+
+	// A plan can give a file only permissions, not setuid or setgid
+	setuid := "#!/bin/sh\n"
+	data, _ := json.Marshal(Plan{Version: planVersion, Changes: []PlanChange{{Path: "setuid.sh", Action: planCreate, Content: &setuid, Mode: 0755 | fs.ModeSetuid | fs.ModeSetgid}}})
+	os.WriteFile(path, data, 0600)
+	if err := runApply(e.workspace, []string{path}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(filepath.Join(e.workspace, "setuid.sh")); err != nil || info.Mode() != 0755 {
+		t.Errorf("setuid.sh has mode %v, %v", info.Mode(), err)
+	}
+	t.Setenv("SESSION_KEY_FILE", keyFile)
+
+	// A symbolic link can't lead a change outside the workspace
+	outside := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(e.workspace, "link")); err != nil {
+		t.Fatal(err)
+	}
+	content := "escaped\n"
+	data, _ = json.Marshal(Plan{Version: planVersion, Changes: []PlanChange{{Path: "link/escape.txt", Action: planCreate, Content: &content}}})
+	os.WriteFile(path, data, 0600)
+	// With the key, a plan that isn't encrypted is refused, since anyone
+	// could have written it
+	if err := runApply(e.workspace, []string{path}, &out); err == nil || !strings.Contains(err.Error(), "not encrypted") {
+		t.Errorf("a plain plan with the key set gave %v", err)
+	}
+	t.Setenv("SESSION_KEY_FILE", "")
+	if err := runApply(e.workspace, []string{path}, &out); err == nil || !strings.Contains(err.Error(), "outside the workspace") {
+		t.Errorf("a path through a link gave %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "escape.txt")); err == nil {
+		t.Errorf("wrote through the link")
+	}
+}
+
+func TestPlanRefusesOutputOptions(t *testing.T) {
+	commands := []string{"sort -o sorted.txt names.txt", "tree -o tree.txt", "git diff --output=changes.patch", "git log --output=log.txt", "uniq names.txt unique.txt"}
+	var calls []ToolCall
+	for _, command := range commands {
+		calls = append(calls, call("run_command", fmt.Sprintf(`{"command": %q}`, command)))
+	}
+	e, provider, _ := newTestEngine(t, []ChatResponse{reply("", calls...), reply("Sorted the names")})
+	writeTestFile(t, e, "names.txt", "b\na\n")
+	e.startPlan()
+	if _, err := e.Run(t.Context(), "Sort the names"); err != nil {
+		t.Fatal(err)
+	}
+	for i, result := range toolResults(provider.lastMessages(t, 2)) {
+		if !strings.Contains(result.Content, "write commands are not allowed") {
+			t.Errorf("%s gave %s", commands[i], result.Content)
+		}
+	}
+	entries, _ := os.ReadDir(e.workspace)
+	if len(entries) != 1 {
+		t.Errorf("planning wrote to the workspace: %v", entries)
+	}
+}
+
+func TestCheckPlanCommand(t *testing.T) {
+	for command, want := range map[string]string{
+		"cat <<EOF\n$(touch pwned)\nEOF": "command substitutions",
+		"cat <<EOF\nhello\nEOF":          "here-documents",
+		"cat <<-'EOF'\n\thello\n\tEOF":   "here-documents",
+		"echo $(touch pwned)":            "command substitutions",
+		"echo `touch pwned`":             "command substitutions",
+		"echo hi > notes.txt":            "redirections",
+		"cat < names.txt":                "redirections",
+		"git log 2>&1":                   "redirections",
+		"diff <(ls) names.txt":           "process substitutions",
+		"sort names.txt":                 "doesn't run while planning",
+	} {
+		if err := checkPlanCommand(command); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q gave %v, want %q", command, err, want)
+		}
+	}
+	for _, command := range []string{"cat names.txt | grep a", "git status && git diff", "echo '>' x"} {
+		if err := checkPlanCommand(command); err != nil {
+			t.Errorf("%q gave %v", command, err)
+		}
+	}
+}
+
+func TestPlanRunsOnlyListedCommands(t *testing.T) {
+	commands := []string{"git -c core.pager='touch pwned' log", "sed -n p names.txt", "env ls", "FOO=1 cat names.txt", "git stash list", "cat $(sort names.txt)", "git --no-pager log --oneline"}
+	var calls []ToolCall
+	for _, command := range commands {
+		calls = append(calls, call("run_command", fmt.Sprintf(`{"command": %q}`, command)))
+	}
+	e, provider, _ := newTestEngine(t, []ChatResponse{reply("", calls...), reply("Looked")})
+	writeTestFile(t, e, "names.txt", "b\na\n")
+	e.startPlan()
+	if _, err := e.Run(t.Context(), "Look at the names"); err != nil {
+		t.Fatal(err)
+	}
+	results := toolResults(provider.lastMessages(t, 2))
+	for i, result := range results[:len(results)-1] {
+		if !strings.Contains(result.Content, "command refused") {
+			t.Errorf("%s gave %s", commands[i], result.Content)
+		}
+	}
+	if last := results[len(results)-1].Content; strings.Contains(last, "command refused") {
+		t.Errorf("%s gave %s", commands[len(commands)-1], last)
+	}
+	if _, err := os.Stat(filepath.Join(e.workspace, "pwned")); err == nil {
+		t.Error("planning ran the pager")
+	}
+}
@@ -0,0 +1,272 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/ext"
+)
+
+// A toolPolicy decides on each tool call from a description of it: allow
+// it, deny it, or ask the user. An organization can keep one policy file
+// for all its wex instances.
+type toolPolicy interface {
+	decide(input map[string]interface{}) (action, reason string, err error)
+}
+
+// policyRule is a line of a CEL policy: the action to take when the
+// expression is true
+type policyRule struct {
+	action  string
+	text    string
+	program cel.Program
+}
+
+type celPolicy []policyRule
+
+// regoPolicy is a Rego policy, evaluated by the opa command
+type regoPolicy string
+
+const opaTimeout = 30 * time.Second
+
+// loadToolPolicy loads TOOL_POLICY: a .rego file for opa, or otherwise
+// rules, one per line as action: expression, in CEL, where a line starting
+// with space continues the rule before it and # starts a comment
+func loadToolPolicy(path string) (toolPolicy, error) {
+	if filepath.Ext(path) == ".rego" {
+		if _, err := exec.LookPath("opa"); err != nil {
+			return nil, fmt.Errorf("Rego policies need opa installed: %v", err)
+		}
+		if output, err := exec.Command("opa", "check", path).CombinedOutput(); err != nil {
+			return nil, fmt.Errorf("%s: %s", path, strings.TrimSpace(string(output)))
+		}
+		return regoPolicy(path), nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy: %v", err)
+	}
+	var policy celPolicy
+	var lines []int
+	for i, line := range strings.Split(string(data), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			if len(policy) == 0 {
+				return nil, fmt.Errorf("%s:%d: continuation line with no rule before it", path, i+1)
+			}
+			policy[len(policy)-1].text += " " + trimmed
+			continue
+		}
+		action, text, ok := strings.Cut(trimmed, ":")
+		action = strings.TrimSpace(action)
+		if !ok || action != policyAllow && action != policyAsk && action != policyDeny {
+			return nil, fmt.Errorf("%s:%d: expected allow, ask or deny, then a colon and an expression", path, i+1)
+		}
+		policy = append(policy, policyRule{action: action, text: strings.TrimSpace(text)})
+		lines = append(lines, i+1)
+	}
+	env, err := policyEnv()
+	if err != nil {
+		return nil, err
+	}
+	for i := range policy {
+		if policy[i].program, err = compileRule(env, policy[i].text); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, lines[i], err)
+		}
+	}
+	return policy, nil
+}
+
+// policyEnv declares what rules see, the fields of policyInput, with the
+// CEL string extensions, and numbers of different types compared by value
+func policyEnv() (*cel.Env, error) {
+	return cel.NewEnv(
+		cel.Variable("tool", cel.StringType),
+		cel.Variable("args", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("path", cel.StringType),
+		cel.Variable("command", cel.StringType),
+		cel.Variable("class", cel.StringType),
+		cel.Variable("user", cel.StringType),
+		cel.Variable("model", cel.StringType),
+		cel.Variable("workspace", cel.StringType),
+		cel.Variable("hour", cel.IntType),
+		cel.Variable("weekday", cel.StringType),
+		cel.Variable("date", cel.StringType),
+		cel.CrossTypeNumericComparisons(true),
+		ext.Strings(),
+	)
+}
+
+// compileRule parses and type-checks a rule, which must be a bool
+func compileRule(env *cel.Env, text string) (cel.Program, error) {
+	ast, issues := env.Compile(text)
+	if issues != nil && issues.Err() != nil {
+		return nil, issues.Err()
+	}
+	if ast.OutputType() != cel.BoolType {
+		return nil, fmt.Errorf("result is %s, not bool", ast.OutputType())
+	}
+	return env.Program(ast)
+}
+
+// decide takes the action of the first rule that matches; if none does,
+// the call is allowed
+func (policy celPolicy) decide(input map[string]interface{}) (string, string, error) {
+	vars := make(map[string]interface{}, len(input))
+	for name, v := range input {
+		vars[name] = v
+	}
+	// The input is as JSON has it, for Rego, where the hour is a number
+	if hour, ok := input["hour"].(float64); ok {
+		vars["hour"] = int64(hour)
+	}
+	for _, rule := range policy {
+		v, _, err := rule.program.Eval(vars)
+		if err != nil {
+			return "", "", fmt.Errorf("%s: %v", rule.text, err)
+		}
+		if v == types.True {
+			return rule.action, rule.text, nil
+		}
+	}
+	return policyAllow, "", nil
+}
+
+// decide queries data.wex, whose deny and ask rules may be booleans or sets
+// of reasons; deny wins over ask, and with neither the call is allowed
+func (path regoPolicy) decide(input map[string]interface{}) (string, string, error) {
+	data, err := json.Marshal(input)
+	if err != nil {
+		return "", "", err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), opaTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "opa", "eval", "--format", "json", "--stdin-input", "--data", string(path), "data.wex")
+	cmd.Stdin = bytes.NewReader(data)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", "", fmt.Errorf("opa eval: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	var result struct {
+		Result []struct {
+			Expressions []struct {
+				Value map[string]interface{} `json:"value"`
+			} `json:"expressions"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal(output, &result); err != nil {
+		return "", "", fmt.Errorf("invalid output from opa: %v", err)
+	}
+	if len(result.Result) == 0 || len(result.Result[0].Expressions) == 0 {
+		return policyAllow, "", nil
+	}
+	value := result.Result[0].Expressions[0].Value
+	for _, action := range []string{policyDeny, policyAsk} {
+		if reasons, ok := regoReasons(value[action]); ok {
+			return action, reasons, nil
+		}
+	}
+	return policyAllow, "", nil
+}
+
+// regoReasons reads a rule's value: true, a reason, or a set of them
+func regoReasons(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case bool:
+		return "", v
+	case string:
+		return v, true
+	case []interface{}:
+		var reasons []string
+		for _, reason := range v {
+			reasons = append(reasons, fmt.Sprint(reason))
+		}
+		return strings.Join(reasons, "; "), len(v) > 0
+	}
+	return "", false
+}
+
+// policyInput describes a tool call to the policy: the tool, its
+// arguments, the path and command it acts on if any, who is running it,
+// and when
+func (e *Engine) policyInput(toolCall ToolCall, now time.Time) map[string]interface{} {
+	args := make(map[string]interface{})
+	json.Unmarshal(toolCall.Function.Arguments, &args)
+	path, _ := args["path"].(string)
+	if path != "" {
+		path = filepath.ToSlash(filepath.Clean(path))
+	}
+	command, _ := args["command"].(string)
+	class := ""
+	if command != "" {
+		class = classifyCommand(command).String()
+	}
+	return map[string]interface{}{
+		"tool":      toolCall.Function.Name,
+		"args":      args,
+		"path":      path,
+		"command":   command,
+		"class":     class,
+		"user":      e.user,
+		"model":     e.model,
+		"workspace": e.workspace,
+		"hour":      float64(now.Hour()),
+		"weekday":   now.Weekday().String(),
+		"date":      now.Format("2006-01-02"),
+	}
+}
+
+// checkToolPolicy applies the tool policy to a call, returning the
+// arguments the user changed it to when asked to approve it, if they did.
+// A policy that can't be evaluated refuses the call rather than letting it
+// through.
+func (e *Engine) checkToolPolicy(toolCall ToolCall) (json.RawMessage, error) {
+	if e.toolPolicy == nil {
+		return nil, nil
+	}
+	action, reason, err := e.toolPolicy.decide(e.policyInput(toolCall, time.Now()))
+	if err != nil {
+		return nil, fmt.Errorf("refused: the tool policy failed: %v", err)
+	}
+	if reason != "" {
+		reason = " (" + reason + ")"
+	}
+	switch action {
+	case policyDeny:
+		return nil, fmt.Errorf("refused by the tool policy%s", reason)
+	case policyAsk:
+		args, ok := e.approveToolCall(toolCall, "The tool policy asks about this call"+reason)
+		if !ok {
+			return nil, fmt.Errorf("refused: the user did not approve this %s call", toolCall.Function.Name)
+		}
+		if !bytes.Equal(args, toolCall.Function.Arguments) {
+			return args, nil
+		}
+	}
+	return nil, nil
+}
+
+// currentUser is who runs the tools, for the tool policy: WEX_USER, or the
+// login name
+func currentUser() string {
+	if user := os.Getenv("WEX_USER"); user != "" {
+		return user
+	}
+	return os.Getenv("USER")
+}
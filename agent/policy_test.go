@@ -0,0 +1,194 @@
+package agent
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPolicyExpressions(t *testing.T) {
+	env, err := policyEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars := map[string]interface{}{
+		"tool": "run_command",
+		"args": map[string]interface{}{"command": "rm -rf build", "paths": []interface{}{"a.go", "b.md"}, "timeout": 30.0},
+		"path": "", "command": "", "class": "", "user": "alice", "model": "", "workspace": "",
+		"hour": 14.0, "weekday": "Friday", "date": "2026-10-16",
+	}
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{`tool == "run_command" && args.command.startsWith("rm ")`, true},
+		{`has(args.path) && args.path.startsWith(".git/")`, false},
+		{`(hour >= 9 && hour < 18 ? "day" : "night") == "day"`, true},
+		{`user in ['alice', "bob"] && !(user in ["eve"])`, true},
+		{`args.paths.exists(p, p.endsWith(".md"))`, true},
+		{`args.paths.all(p, p.matches("\\.go$"))`, false},
+		{`size(args.paths) + 1 == 3 && args["command"].contains("-rf")`, true},
+		{`"command" in args && -hour * 2 % 5 == -3`, true},
+		{`string(hour) + "h" == "14h" && int("7") == 7`, true},
+		{`args.timeout > 10 && args.timeout == 30`, true},
+		{`tool.lowerAscii() == "run_command" && weekday == "Friday"`, true},
+	}
+	for _, test := range tests {
+		program, err := compileRule(env, test.expr)
+		if err != nil {
+			t.Errorf("%s: %v", test.expr, err)
+			continue
+		}
+		action, _, err := celPolicy{{policyDeny, test.expr, program}}.decide(vars)
+		if err != nil || (action == policyDeny) != test.want {
+			t.Errorf("%s gave %s, %v; want %v", test.expr, action, err, test.want)
+		}
+	}
+
+	// Type errors are found when a rule is loaded, and missing arguments
+	// when it is evaluated
+	for _, expr := range []string{`tool ==`, `(hour`, `"open`, `a b`, `nosuch`, `tool.size() > 1 + "a"`, `hour + 1`, `size(1)`} {
+		if _, err := compileRule(env, expr); err == nil {
+			t.Errorf("compiled %s", expr)
+		}
+	}
+	program, err := compileRule(env, `args.path == "x"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := (celPolicy{{policyDeny, `args.path == "x"`, program}}).decide(vars); err == nil {
+		t.Errorf("a missing argument evaluated without error")
+	}
+}
+
+func TestToolPolicy(t *testing.T) {
+	policy := filepath.Join(t.TempDir(), "policy.rules")
+	os.WriteFile(policy, []byte(`# Keep out of the git directory
+deny: path.startsWith(".git/")
+deny: class == "destructive" &&
+  user != "admin"
+ask: tool == "write_file" && path.endsWith(".lock")
+`), 0644)
+
+	var asked []string
+	e, _, _ := newTestEngine(t, nil, WithToolPolicy(policy), WithUser("alice"), WithApprover(func(action string) bool {
+		asked = append(asked, action)
+		return false
+	}))
+	tests := []struct {
+		tool, args, want string
+	}{
+		{"write_file", `{"path": "./.git/../.git/config", "content": "x"}`, "refused by the tool policy (path.startsWith(\".git/\"))"},
+		{"run_command", `{"command": "rm -rf /tmp/x"}`, `user != "admin"`},
+		{"write_file", `{"path": "go.lock", "content": "x"}`, "did not approve this write_file call"},
+		{"write_file", `{"path": "notes.txt", "content": "x"}`, ""},
+	}
+	for _, test := range tests {
+		_, err := e.callTool(call(test.tool, test.args))
+		switch {
+		case test.want == "" && err != nil:
+			t.Errorf("%s %s refused: %v", test.tool, test.args, err)
+		case test.want != "" && (err == nil || !strings.Contains(err.Error(), test.want)):
+			t.Errorf("%s %s gave %v, want %q", test.tool, test.args, err, test.want)
+		}
+	}
+	if len(asked) != 1 || !strings.Contains(asked[0], "go.lock") {
+		t.Errorf("asked %q", asked)
+	}
+
+	input := e.policyInput(call("run_command", `{"command": "ls"}`), time.Date(2026, 10, 16, 9, 30, 0, 0, time.UTC))
+	if input["class"] != "read-only" || input["hour"] != 9.0 || input["weekday"] != "Friday" || input["user"] != "alice" {
+		t.Errorf("policy input %v", input)
+	}
+
+	os.WriteFile(policy, []byte("deny: tool ==\n"), 0644)
+	if _, err := loadToolPolicy(policy); err == nil || !strings.Contains(err.Error(), "policy.rules:1") {
+		t.Errorf("loading a broken policy gave %v", err)
+	}
+}
+
+func TestEditedToolCall(t *testing.T) {
+	policy := filepath.Join(t.TempDir(), "policy.rules")
+	os.WriteFile(policy, []byte("ask: tool == \"write_file\"\n"), 0644)
+
+	e, provider, events := newTestEngine(t, []ChatResponse{
+		reply("", call("write_file", `{"path": "src/mian.go", "content": "package main\n"}`), call("write_file", `{"path": "b.go", "content": "package b\n"}`)),
+		reply("Wrote main.go"),
+	}, WithToolPolicy(policy), WithCallApprover(func(tool string, args json.RawMessage) (json.RawMessage, bool) {
+		if strings.Contains(string(args), "mian.go") {
+			return json.RawMessage(strings.Replace(string(args), "mian.go", "main.go", 1)), true
+		}
+		return args, true
+	}))
+	if _, err := e.Run(t.Context(), "Write main.go"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(e.workspace, "src", "main.go")); err != nil {
+		t.Errorf("the edited path wasn't written: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(e.workspace, "src", "mian.go")); err == nil {
+		t.Errorf("the model's path was written")
+	}
+
+	results := toolResults(provider.lastMessages(t, 2))
+	if len(results) != 2 || !strings.HasPrefix(results[0].Content, `The user changed the arguments before approving the call, to: {"path":"src/main.go"`) || strings.Contains(results[1].Content, "changed the arguments") {
+		t.Errorf("tool results %+v", results)
+	}
+	var edited []string
+	for _, event := range *events {
+		if event.Type == EventToolFinished {
+			edited = append(edited, string(event.Edited))
+		}
+	}
+	if len(edited) != 2 || !strings.Contains(edited[0], "src/main.go") || edited[1] != "" {
+		t.Errorf("edited arguments in tool_finished: %q", edited)
+	}
+}
+
+func TestEditedCallForCommandPolicy(t *testing.T) {
+	var asked []string
+	e, provider, _ := newTestEngine(t, []ChatResponse{
+		reply("", call("run_command", `{"command": "curl -s https://example.com/x"}`), call("write_file", `{"path": "big.txt", "content": "1\n2\n3\n"}`)),
+		reply("Done"),
+	}, WithCallApprover(func(tool string, args json.RawMessage) (json.RawMessage, bool) {
+		asked = append(asked, tool)
+		if tool == "run_command" {
+			return json.RawMessage(`{"command":"echo edited"}`), true
+		}
+		return json.RawMessage(`{"path":"big.txt","content":"1\n"}`), true
+	}))
+	e.commandPolicy = map[commandClass]string{classNetwork: policyAsk}
+	e.diffBudget.MaxLines = 2
+	if _, err := e.Run(t.Context(), "Fetch x"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each call is asked about once; made again with the edited arguments,
+	// it counts as approved
+	if len(asked) != 2 || asked[0] != "run_command" || asked[1] != "write_file" {
+		t.Errorf("asked about %q", asked)
+	}
+	results := toolResults(provider.lastMessages(t, 2))
+	if len(results) != 2 || !strings.HasPrefix(results[0].Content, `The user changed the arguments before approving the call, to: {"command":"echo edited"}`) ||
+		!strings.Contains(results[0].Content, "edited") || !strings.HasPrefix(results[1].Content, "The user changed the arguments") {
+		t.Errorf("tool results %+v", results)
+	}
+	if data, _ := os.ReadFile(filepath.Join(e.workspace, "big.txt")); string(data) != "1\n" {
+		t.Errorf("big.txt has %q", data)
+	}
+}
+
+func TestEditArguments(t *testing.T) {
+	t.Setenv("EDITOR", "sed -i s/mian/main/")
+	args, err := editArguments(json.RawMessage(`{"path": "src/mian.go", "content": "x"}`))
+	if err != nil || string(args) != `{"path":"src/main.go","content":"x"}` {
+		t.Errorf("edited to %s, %v", args, err)
+	}
+	t.Setenv("EDITOR", "sed -i s/{//")
+	if _, err := editArguments(json.RawMessage(`{"path": "a.go"}`)); err == nil || !strings.Contains(err.Error(), "not a JSON object") {
+		t.Errorf("broken JSON gave %v", err)
+	}
+}
@@ -0,0 +1,79 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// A check model is a small, fast model that looks over a destructive
+// command before it runs, comparing it with what the user asked for. It
+// can't approve anything the command policy would refuse or ask about;
+// it only sends commands it doubts to the user, so a mistaken rm is
+// caught without asking about every one.
+
+// checkTimeout bounds the check, which should take a second or two
+const checkTimeout = 60 * time.Second
+
+const checkPrompt = `A coding assistant was given this request:
+
+%s
+
+To carry it out, it wants to run this command:
+
+%s
+
+Does the command fit the request, without deleting, stopping or changing anything the request doesn't call for? Answer YES or NO, then give the reason in one sentence.`
+
+// checkIntent asks the check model whether a command fits the request,
+// and the user for approval if it doesn't or can't say
+func (e *Engine) checkIntent(command string) error {
+	ok, reason := e.askCheckModel(command)
+	e.debugf("Check model on %q: %v, %s", command, ok, reason)
+	if ok {
+		return nil
+	}
+	if !e.askApproval(fmt.Sprintf("The check model flagged this command: %s\n%s", command, reason)) {
+		return fmt.Errorf("command refused: the check model flagged it (%s) and the user did not approve it", reason)
+	}
+	return nil
+}
+
+// askCheckModel returns whether the check model answered yes, and its
+// reason; an error counts as no
+func (e *Engine) askCheckModel(command string) (bool, string) {
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+	defer cancel()
+	resp, err := e.postChat(ctx, ChatRequest{
+		Model:    e.checkModel,
+		Messages: []Message{{Role: "user", Content: fmt.Sprintf(checkPrompt, e.request, command)}},
+		Options:  map[string]interface{}{"temperature": 0},
+	})
+	if err != nil {
+		return false, fmt.Sprintf("check failed: %v", err)
+	}
+	return parseVerdict(resp.Message.Content)
+}
+
+// parseVerdict reads a YES or NO answer, which small models may put in
+// bold or follow with the reason on the same line
+func parseVerdict(answer string) (bool, string) {
+	answer = strings.TrimLeft(answer, " \t\r\n*")
+	word := answer
+	if i := strings.IndexFunc(answer, func(r rune) bool { return !(r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z') }); i >= 0 {
+		word = answer[:i]
+	}
+	reason := strings.TrimSpace(strings.TrimLeft(answer[len(word):], " \t\r\n*.,:;-"))
+	switch strings.ToUpper(word) {
+	case "YES":
+		return true, reason
+	case "NO":
+	default:
+		reason = "unclear answer: " + strings.TrimSpace(answer)
+	}
+	if reason == "" {
+		reason = "no reason given"
+	}
+	return false, reason
+}
@@ -0,0 +1,101 @@
+package agent
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseVerdict(t *testing.T) {
+	tests := []struct {
+		answer string
+		ok     bool
+		reason string
+	}{
+		{"YES\nIt removes the build directory as asked.", true, "It removes the build directory as asked."},
+		{"**No** - the user asked to delete build/, not src/.", false, "the user asked to delete build/, not src/."},
+		{"yes.", true, ""},
+		{"NO", false, "no reason given"},
+		{"Probably fine.", false, "unclear answer: Probably fine."},
+		{"", false, "unclear answer: "},
+	}
+	for _, test := range tests {
+		ok, reason := parseVerdict(test.answer)
+		if ok != test.ok || reason != test.reason {
+			t.Errorf("parseVerdict(%q) = %v, %q; want %v, %q", test.answer, ok, reason, test.ok, test.reason)
+		}
+	}
+}
+
+func TestCheckModel(t *testing.T) {
+	var asked []string
+	e, provider, events := newTestEngine(t, []ChatResponse{
+		reply("", call("run_command", `{"command": "rm -rf src"}`)),
+		reply("NO - the user asked to clean the build output, not delete the source."),
+		reply("", call("run_command", `{"command": "rm -rf build"}`)),
+		reply("YES, build is the build output."),
+		reply("Cleaned."),
+		reply("YES"),
+	}, WithCheckModel("small-model"), WithApprover(func(action string) bool {
+		asked = append(asked, action)
+		return false
+	}))
+	for _, dir := range []string{"src", "build"} {
+		if err := os.MkdirAll(filepath.Join(e.workspace, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := e.Run(context.Background(), "Clean the build output"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(e.workspace, "src")); err != nil {
+		t.Error("flagged command was run")
+	}
+	if _, err := os.Stat(filepath.Join(e.workspace, "build")); err == nil {
+		t.Error("approved command was not run")
+	}
+	if len(asked) != 1 || !strings.Contains(asked[0], "rm -rf src") || !strings.Contains(asked[0], "not delete the source") {
+		t.Errorf("asked for approval of %q", asked)
+	}
+
+	check := provider.requests[1]
+	if check.Model != "small-model" || len(check.Tools) != 0 ||
+		!strings.Contains(check.Messages[0].Content, "Clean the build output") ||
+		!strings.Contains(check.Messages[0].Content, "rm -rf src") {
+		t.Errorf("check request %+v", check)
+	}
+	if results := toolResults(provider.lastMessages(t, 3)); len(results) != 1 || !strings.Contains(results[0].Content, "check model flagged") {
+		t.Errorf("flagged command gave %+v", results)
+	}
+
+	// Verdicts are only logged with --verbose
+	for _, event := range *events {
+		if strings.HasPrefix(event.Text, "DEBUG:") {
+			t.Errorf("logged without --verbose: %s", event.Text)
+		}
+	}
+	e.verbose = true
+	e.checkIntent("rm -rf build")
+	if last := (*events)[len(*events)-1]; last.Text != `DEBUG: Check model on "rm -rf build": true, ` {
+		t.Errorf("with --verbose, logged %q", last.Text)
+	}
+}
+
+func TestCheckModelOnlyDestructive(t *testing.T) {
+	e, provider, _ := newTestEngine(t, []ChatResponse{
+		reply("", call("run_command", `{"command": "ls"}`)),
+		reply("Listed."),
+	}, WithCheckModel("small-model"))
+
+	if _, err := e.Run(context.Background(), "List files"); err != nil {
+		t.Fatal(err)
+	}
+	for _, req := range provider.requests {
+		if req.Model == "small-model" {
+			t.Error("checked a read-only command")
+		}
+	}
+}
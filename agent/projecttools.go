@@ -0,0 +1,291 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Project tools wrap a project's own test and script runners, and are
+// offered only when the workspace has the files that show it uses them.
+// They build a command line and run it as run_command would, so command
+// policy, timeouts and output limits apply as usual.
+
+// projectTools detects the project type afresh each time, so that tools
+// appear once, say, a scaffolded project has created its go.mod
+func (e *Engine) projectTools() []Tool {
+	var tools []Tool
+	if e.fileExists("go.mod") {
+		tools = append(tools, goTestTool())
+	}
+	if scripts := e.npmScripts(); len(scripts) > 0 {
+		tools = append(tools, npmRunTool(e.packageManager(), scripts))
+	}
+	if e.usesPytest() {
+		tools = append(tools, pytestTool())
+	}
+	return tools
+}
+
+func (e *Engine) fileExists(path string) bool {
+	_, err := e.files().Stat(filepath.Join(e.workspace, path))
+	return err == nil
+}
+
+func (e *Engine) readWorkspaceFile(path string) string {
+	data, err := e.files().ReadFile(filepath.Join(e.workspace, path))
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// npmScripts lists the scripts in package.json
+func (e *Engine) npmScripts() []string {
+	var pkg struct {
+		Scripts map[string]string `json:"scripts"`
+	}
+	if err := json.Unmarshal([]byte(e.readWorkspaceFile("package.json")), &pkg); err != nil {
+		return nil
+	}
+	var scripts []string
+	for name := range pkg.Scripts {
+		scripts = append(scripts, name)
+	}
+	sort.Strings(scripts)
+	return scripts
+}
+
+// packageManager picks the one whose lock file is present
+func (e *Engine) packageManager() string {
+	switch {
+	case e.fileExists("pnpm-lock.yaml"):
+		return "pnpm"
+	case e.fileExists("yarn.lock"):
+		return "yarn"
+	case e.fileExists("bun.lockb"), e.fileExists("bun.lock"):
+		return "bun"
+	}
+	return "npm"
+}
+
+func (e *Engine) usesPytest() bool {
+	if e.fileExists("pytest.ini") || e.fileExists("conftest.py") {
+		return true
+	}
+	for _, file := range []string{"pyproject.toml", "setup.cfg", "tox.ini", "requirements.txt", "requirements-dev.txt"} {
+		if strings.Contains(e.readWorkspaceFile(file), "pytest") {
+			return true
+		}
+	}
+	return false
+}
+
+func goTestTool() Tool {
+	return Tool{
+		Type: "function",
+		Function: Function{
+			Name:        "go_test",
+			Description: "Run Go tests with go test, from the workspace root",
+			Parameters: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"packages": map[string]interface{}{
+						"type":        "string",
+						"description": "Package pattern (optional, default ./...)",
+					},
+					"run": map[string]interface{}{
+						"type":        "string",
+						"description": "Run only tests matching this regular expression (optional)",
+					},
+					"verbose": map[string]interface{}{
+						"type":        "boolean",
+						"description": "Show each test's output (optional)",
+					},
+					"timeout": map[string]interface{}{
+						"type":        "number",
+						"description": "Timeout in seconds (optional, default 300)",
+					},
+				},
+			},
+		},
+	}
+}
+
+func npmRunTool(manager string, scripts []string) Tool {
+	return Tool{
+		Type: "function",
+		Function: Function{
+			Name:        "npm_run",
+			Description: fmt.Sprintf("Run a script from package.json with %s run, from the workspace root", manager),
+			Parameters: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"script": map[string]interface{}{
+						"type":        "string",
+						"enum":        scripts,
+						"description": "Script name",
+					},
+					"args": map[string]interface{}{
+						"type":        "array",
+						"items":       map[string]interface{}{"type": "string"},
+						"description": "Arguments to pass to the script (optional)",
+					},
+					"timeout": map[string]interface{}{
+						"type":        "number",
+						"description": "Timeout in seconds (optional, default 300)",
+					},
+				},
+				"required": []string{"script"},
+			},
+		},
+	}
+}
+
+func pytestTool() Tool {
+	return Tool{
+		Type: "function",
+		Function: Function{
+			Name:        "pytest",
+			Description: "Run Python tests with pytest, from the workspace root",
+			Parameters: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"path": map[string]interface{}{
+						"type":        "string",
+						"description": "Test file, directory or node ID such as tests/test_api.py::test_login (optional, default all tests)",
+					},
+					"keyword": map[string]interface{}{
+						"type":        "string",
+						"description": "Run only tests matching this -k expression (optional)",
+					},
+					"verbose": map[string]interface{}{
+						"type":        "boolean",
+						"description": "List each test (optional)",
+					},
+					"timeout": map[string]interface{}{
+						"type":        "number",
+						"description": "Timeout in seconds (optional, default 300)",
+					},
+				},
+			},
+		},
+	}
+}
+
+// defaultTestTimeout is longer than run_command's, since test suites
+// often take more than 30 seconds
+const defaultTestTimeout = 300
+
+// runProjectCommand runs a command line from the workspace root, with the
+// command policy applied as for run_command
+func (e *Engine) runProjectCommand(words []string, timeout float64) (string, error) {
+	if timeout <= 0 {
+		timeout = defaultTestTimeout
+	}
+	quoted := make([]string, len(words))
+	for i, word := range words {
+		quoted[i] = word
+		if word == "" || strings.ContainsAny(word, " \t\n'\"\\$`*?[]{}()<>|&;#~!") {
+			quoted[i] = shellQuote(word)
+		}
+	}
+	command := strings.Join(quoted, " ")
+	if err := e.checkCommandPolicy(command); err != nil {
+		return "", err
+	}
+	e.invalidateCommandCache()
+
+	// In the persistent shell, a subshell leaves the shell's own directory
+	// as it was
+	if e.cwd != "" {
+		command = "cd " + shellQuote(e.workspace) + " && " + command
+		if e.persistentShell {
+			command = "(" + command + ")"
+		}
+	}
+	var result CommandResult
+	var err error
+	if e.persistentShell {
+		result, err = e.runInShell(command, "", time.Duration(timeout*float64(time.Second)))
+	} else {
+		result, err = e.executeCommand(command, "", time.Duration(timeout*float64(time.Second)))
+	}
+	if err != nil {
+		return "", err
+	}
+	return marshalCommandResult(result)
+}
+
+func (e *Engine) goTest(args json.RawMessage) (string, error) {
+	var params struct {
+		Packages string  `json:"packages"`
+		Run      string  `json:"run"`
+		Verbose  bool    `json:"verbose"`
+		Timeout  float64 `json:"timeout"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return "", fmt.Errorf("invalid arguments: %v", err)
+	}
+	words := []string{"go", "test"}
+	if params.Verbose {
+		words = append(words, "-v")
+	}
+	if params.Run != "" {
+		words = append(words, "-run", params.Run)
+	}
+	if params.Packages == "" {
+		params.Packages = "./..."
+	}
+	words = append(words, strings.Fields(params.Packages)...)
+	return e.runProjectCommand(words, params.Timeout)
+}
+
+func (e *Engine) npmRun(args json.RawMessage) (string, error) {
+	var params struct {
+		Script  string   `json:"script"`
+		Args    []string `json:"args"`
+		Timeout float64  `json:"timeout"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return "", fmt.Errorf("invalid arguments: %v", err)
+	}
+	scripts := e.npmScripts()
+	if !slices.Contains(scripts, params.Script) {
+		return "", fmt.Errorf("package.json has no script %q; scripts are %s", params.Script, strings.Join(scripts, ", "))
+	}
+	words := []string{e.packageManager(), "run", params.Script}
+	if len(params.Args) > 0 {
+		words = append(append(words, "--"), params.Args...)
+	}
+	return e.runProjectCommand(words, params.Timeout)
+}
+
+func (e *Engine) pytest(args json.RawMessage) (string, error) {
+	var params struct {
+		Path    string  `json:"path"`
+		Keyword string  `json:"keyword"`
+		Verbose bool    `json:"verbose"`
+		Timeout float64 `json:"timeout"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return "", fmt.Errorf("invalid arguments: %v", err)
+	}
+	words := []string{"python3", "-m", "pytest"}
+	if params.Verbose {
+		words = append(words, "-v")
+	} else {
+		words = append(words, "-q")
+	}
+	if params.Keyword != "" {
+		words = append(words, "-k", params.Keyword)
+	}
+	if params.Path != "" {
+		words = append(words, params.Path)
+	}
+	return e.runProjectCommand(words, params.Timeout)
+}
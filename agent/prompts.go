@@ -0,0 +1,168 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// promptIdle is how long a command must be silent before it is taken to be
+// waiting for input
+const promptIdle = time.Second
+
+// commandAnswer is an automatic reply to a command prompt matching pattern
+type commandAnswer struct {
+	pattern *regexp.Regexp
+	answer  string
+}
+
+// loadCommandAnswers reads a JSON object mapping prompt regexps to answers,
+// e.g. {"package name:": "demo", "\\(y/n\\)": "y"}. Longer patterns are
+// tried first, as they tend to be the more specific.
+func loadCommandAnswers(path string) ([]commandAnswer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read answers: %v", err)
+	}
+	var raw map[string]string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse answers: %v", err)
+	}
+
+	var answers []commandAnswer
+	for pattern, answer := range raw {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+		answers = append(answers, commandAnswer{pattern: re, answer: answer})
+	}
+	sort.Slice(answers, func(i, j int) bool {
+		a, b := answers[i].pattern.String(), answers[j].pattern.String()
+		if len(a) != len(b) {
+			return len(a) > len(b)
+		}
+		return a < b
+	})
+	return answers, nil
+}
+
+// outputTracker collects a command's output, remembering the unfinished
+// last line, which is where a prompt would be, and when output last arrived
+type outputTracker struct {
+	mu        sync.Mutex
+	line      []byte
+	lastWrite time.Time
+	total     int
+}
+
+// writer returns a writer that appends to buf and updates the tracker
+func (t *outputTracker) writer(buf *bytes.Buffer) io.Writer {
+	return trackedWriter{t, buf}
+}
+
+// state returns the unfinished line, how long output has been idle, and the
+// total bytes seen, which identifies the point in the output
+func (t *outputTracker) state() (string, time.Duration, int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return strings.TrimSpace(string(t.line)), time.Since(t.lastWrite), t.total
+}
+
+type trackedWriter struct {
+	t   *outputTracker
+	buf *bytes.Buffer
+}
+
+func (w trackedWriter) Write(p []byte) (int, error) {
+	w.t.mu.Lock()
+	defer w.t.mu.Unlock()
+	w.buf.Write(p)
+	w.t.line = append(w.t.line, p...)
+	if i := bytes.LastIndexByte(w.t.line, '\n'); i >= 0 {
+		w.t.line = w.t.line[i+1:]
+	}
+	if len(w.t.line) > 1000 {
+		w.t.line = w.t.line[len(w.t.line)-1000:]
+	}
+	w.t.lastWrite = time.Now()
+	w.t.total += len(p)
+	return len(p), nil
+}
+
+// answerPrompts watches a running command, and whenever it goes quiet at a
+// prompt, answers from the configured answers or, if enabled, from the user.
+// Anything else gets end of input, as a command without a terminal would;
+// an unanswered prompt is reported in the result so that the model can run
+// the command again with input.
+func (e *Engine) answerPrompts(stdin io.WriteCloser, output *outputTracker, result *CommandResult, done <-chan struct{}) {
+	defer stdin.Close()
+	ticker := time.NewTicker(promptIdle / 5)
+	defer ticker.Stop()
+
+	handled := -1
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		prompt, idle, total := output.state()
+		if idle < promptIdle || total == handled {
+			continue
+		}
+		handled = total
+
+		if answer, ok := e.answerFor(prompt); ok {
+			result.AnsweredPrompts = append(result.AnsweredPrompts, prompt)
+			io.WriteString(stdin, answer+"\n")
+			continue
+		}
+		if e.forwardInput && prompt != "" {
+			answer, err := readLine(fmt.Sprintf("Command is waiting for input: %s\n> ", prompt))
+			if err == nil {
+				result.AnsweredPrompts = append(result.AnsweredPrompts, prompt)
+				io.WriteString(stdin, answer+"\n")
+				continue
+			}
+		}
+
+		result.WaitingForInput = prompt
+		return
+	}
+}
+
+func (e *Engine) answerFor(prompt string) (string, bool) {
+	if prompt == "" {
+		return "", false
+	}
+	for _, a := range e.commandAnswers {
+		if a.pattern.MatchString(prompt) {
+			return a.answer, true
+		}
+	}
+	return "", false
+}
+
+// stdinReader is shared by everything that asks the user for input
+var stdinReader = bufio.NewReader(os.Stdin)
+
+// readLine shows a prompt and reads a line from the user. The prompt goes
+// to standard error, so that it doesn't get mixed into --output json.
+func readLine(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	line, err := stdinReader.ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
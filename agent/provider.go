@@ -0,0 +1,243 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Provider is a model server. Requests are in /api/chat's form whatever
+// the server, and each implementation translates them as it needs to, so
+// the rest of wex, and tests with a scripted provider, see one interface.
+type Provider interface {
+	// SendChat sends a conversation, with the tools offered and sampling
+	// options, and returns the model's reply
+	SendChat(ctx context.Context, req ChatRequest) (*ChatResponse, error)
+
+	// ListModels lists the models the server has
+	ListModels(ctx context.Context) ([]Model, error)
+}
+
+// modelProvider returns the provider given to WithBackend, or else one for
+// the configured server, which tries failed requests again
+func (e *Engine) modelProvider() Provider {
+	if e.provider != nil {
+		return e.provider
+	}
+	var provider Provider
+	switch {
+	case e.anthropicKey != "":
+		provider = &anthropicProvider{client: e.client, url: e.ollamaURL, apiKey: e.anthropicKey, debugf: e.debugf}
+	case e.llamaCpp:
+		provider = &llamaCppProvider{client: e.client, url: e.ollamaURL, template: e.generateTemplate, debugf: e.debugf}
+	case e.generateTemplate != nil:
+		provider = &generateProvider{ollamaProvider{client: e.client, url: e.ollamaURL, debugf: e.debugf}, e.generateTemplate}
+	default:
+		provider = &ollamaProvider{client: e.client, url: e.ollamaURL, debugf: e.debugf}
+	}
+	if e.maxAttempts > 1 {
+		provider = &retryProvider{provider, e.maxAttempts, e.logf}
+	}
+	return provider
+}
+
+// postJSON posts a request body and decodes the JSON reply into out
+func postJSON(ctx context.Context, client *http.Client, url string, headers map[string]string, body []byte, out interface{}) error {
+	respBody, err := openPost(ctx, client, url, headers, body)
+	if err != nil {
+		return err
+	}
+	defer respBody.Close()
+
+	if err := json.NewDecoder(respBody).Decode(out); err != nil {
+		return decodeError("failed to decode response", err)
+	}
+	return nil
+}
+
+// openPost posts a request body and returns the body of a successful reply,
+// for the caller to read as it comes and close
+func openPost(ctx context.Context, client *http.Client, url string, headers map[string]string, body []byte) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, sendError(ctx, "failed to send request", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, statusError(resp.StatusCode, body)
+	}
+	return resp.Body, nil
+}
+
+// getModels gets a server's list of models and decodes it into out
+func getModels(ctx context.Context, client *http.Client, url string, headers map[string]string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return sendError(ctx, "failed to get models", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return statusError(resp.StatusCode, body)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return decodeError("failed to decode models response", err)
+	}
+	return nil
+}
+
+// ollamaProvider talks to an Ollama server's /api/chat
+type ollamaProvider struct {
+	client *http.Client
+	url    string
+	debugf func(format string, args ...interface{})
+}
+
+func (p *ollamaProvider) SendChat(ctx context.Context, reqBody ChatRequest) (*ChatResponse, error) {
+	jsonBody, err := json.Marshal(reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	p.debugf("Sending request to Ollama:\n%s", string(jsonBody))
+
+	if reqBody.Stream {
+		body, err := openPost(ctx, p.client, p.url+"/api/chat", nil, jsonBody)
+		if err != nil {
+			return nil, err
+		}
+		defer body.Close()
+		return readChatStream(body, reqBody.OnText)
+	}
+	var chatResp ChatResponse
+	if err := postJSON(ctx, p.client, p.url+"/api/chat", nil, jsonBody, &chatResp); err != nil {
+		return nil, err
+	}
+	return &chatResp, nil
+}
+
+func (p *ollamaProvider) ListModels(ctx context.Context) ([]Model, error) {
+	var modelsResp ModelsResponse
+	if err := getModels(ctx, p.client, p.url+"/api/tags", nil, &modelsResp); err != nil {
+		return nil, err
+	}
+	return modelsResp.Models, nil
+}
+
+// generateProvider sends conversations to Ollama's /api/generate in raw
+// mode, rendered with a chat template. The completion comes back as an
+// assistant message with no native tool calls.
+type generateProvider struct {
+	ollamaProvider
+	template *chatTemplate
+}
+
+func (p *generateProvider) SendChat(ctx context.Context, chatReq ChatRequest) (*ChatResponse, error) {
+	options := make(map[string]interface{})
+	for k, v := range chatReq.Options {
+		options[k] = v
+	}
+	// The template's stops end the turn, so the user's are added to them
+	stop := p.template.stop
+	if s, ok := options["stop"].([]string); ok {
+		stop = append(append([]string{}, stop...), s...)
+	}
+	options["stop"] = stop
+	reqBody := GenerateRequest{
+		Model:   chatReq.Model,
+		Prompt:  p.template.render(chatReq.Messages),
+		Raw:     true,
+		Stream:  false,
+		Options: options,
+	}
+
+	jsonBody, err := json.Marshal(reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	p.debugf("Sending request to Ollama:\n%s", string(jsonBody))
+
+	var genResp GenerateResponse
+	if err := postJSON(ctx, p.client, p.url+"/api/generate", nil, jsonBody, &genResp); err != nil {
+		return nil, err
+	}
+
+	var chatResp ChatResponse
+	chatResp.Message.Role = "assistant"
+	chatResp.Message.Content = strings.TrimSpace(genResp.Response)
+	chatResp.Done = genResp.Done
+	return &chatResp, nil
+}
+
+// wholeNumberOptions are the Ollama options that must be integers
+var wholeNumberOptions = map[string]bool{"num_ctx": true, "num_predict": true, "seed": true, "top_k": true, "num_keep": true, "repeat_last_n": true, "num_gpu": true, "num_thread": true, "num_batch": true}
+
+// parseModelOptions parses OLLAMA_OPTIONS, a JSON object of options to
+// send with every request, such as {"num_ctx": 8192, "top_p": 0.9}.
+// Options Ollama doesn't know are passed on for it to ignore, but the
+// common ones are checked, so a mistake doesn't go unnoticed.
+func parseModelOptions(s string) (map[string]interface{}, error) {
+	options := make(map[string]interface{})
+	if strings.TrimSpace(s) == "" {
+		return options, nil
+	}
+	if err := json.Unmarshal([]byte(s), &options); err != nil {
+		return nil, fmt.Errorf("expected a JSON object of options: %v", err)
+	}
+	for name, value := range options {
+		switch name {
+		case "stop":
+			switch value := value.(type) {
+			case string:
+				options[name] = []string{value}
+			case []interface{}:
+				var stop []string
+				for _, v := range value {
+					s, ok := v.(string)
+					if !ok {
+						return nil, fmt.Errorf("stop must be a string or a list of strings")
+					}
+					stop = append(stop, s)
+				}
+				options[name] = stop
+			default:
+				return nil, fmt.Errorf("stop must be a string or a list of strings")
+			}
+		case "temperature", "top_p", "min_p", "repeat_penalty", "num_ctx", "num_predict", "seed", "top_k":
+			n, ok := value.(float64)
+			if !ok {
+				return nil, fmt.Errorf("%s must be a number", name)
+			}
+			if wholeNumberOptions[name] && n != float64(int(n)) {
+				return nil, fmt.Errorf("%s must be a whole number", name)
+			}
+			if n < 0 && name != "seed" && name != "num_predict" {
+				return nil, fmt.Errorf("%s can't be negative", name)
+			}
+		}
+	}
+	return options, nil
+}
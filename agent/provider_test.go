@@ -0,0 +1,103 @@
+package agent
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// scriptedProvider is a Provider that gives replies from a list, with no
+// server at all
+type scriptedProvider struct {
+	models   []Model
+	replies  []ChatResponse
+	requests []ChatRequest
+}
+
+func (p *scriptedProvider) SendChat(ctx context.Context, req ChatRequest) (*ChatResponse, error) {
+	p.requests = append(p.requests, req)
+	resp := reply("Done")
+	if len(p.replies) > 0 {
+		resp = p.replies[0]
+		p.replies = p.replies[1:]
+	}
+	return &resp, nil
+}
+
+func (p *scriptedProvider) ListModels(ctx context.Context) ([]Model, error) {
+	return p.models, nil
+}
+
+func TestWithBackend(t *testing.T) {
+	provider := &scriptedProvider{
+		models: []Model{{Name: "scripted:1b"}, {Name: "other"}},
+		replies: []ChatResponse{
+			reply("", call("write_file", `{"path": "a.txt", "content": "hi\n"}`)),
+			reply("Wrote a.txt"),
+		},
+	}
+	e, err := New(WithWorkspace(t.TempDir()), WithBackend(provider, ""), WithSystemPrompt("Test."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.model != "scripted:1b" {
+		t.Errorf("model %q", e.model)
+	}
+	result, err := e.Run(context.Background(), "Write a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Reply != "Wrote a.txt" || result.Turns != 2 {
+		t.Errorf("result %+v", result)
+	}
+	if data, err := os.ReadFile(filepath.Join(e.workspace, "a.txt")); err != nil || string(data) != "hi\n" {
+		t.Errorf("a.txt has %q, %v", data, err)
+	}
+	if len(provider.requests) != 2 || provider.requests[0].Model != "scripted:1b" || len(provider.requests[0].Tools) == 0 {
+		t.Errorf("requests %+v", provider.requests)
+	}
+	if results := toolResults(provider.requests[1].Messages); len(results) != 1 {
+		t.Errorf("second request has %d tool results", len(results))
+	}
+}
+
+func TestParseModelOptions(t *testing.T) {
+	options, err := parseModelOptions(`{"num_ctx": 8192, "top_p": 0.9, "stop": "</s>", "mirostat": 2}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if options["num_ctx"] != 8192.0 || options["top_p"] != 0.9 || options["mirostat"] != 2.0 {
+		t.Errorf("options %v", options)
+	}
+	if stop, ok := options["stop"].([]string); !ok || len(stop) != 1 || stop[0] != "</s>" {
+		t.Errorf("stop %#v", options["stop"])
+	}
+	if options, err := parseModelOptions(""); err != nil || len(options) != 0 {
+		t.Errorf("no options gives %v, %v", options, err)
+	}
+	for s, want := range map[string]string{
+		`[1, 2]`:                 "expected a JSON object",
+		`{"num_ctx": 4096.5}`:    "num_ctx must be a whole number",
+		`{"temperature": "hot"}`: "temperature must be a number",
+		`{"top_p": -1}`:          "top_p can't be negative",
+		`{"stop": ["a", 1]}`:     "stop must be a string or a list of strings",
+	} {
+		if _, err := parseModelOptions(s); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s gives %v, want %q", s, err, want)
+		}
+	}
+
+	provider := &scriptedProvider{models: []Model{{Name: "m"}}}
+	e, err := New(WithWorkspace(t.TempDir()), WithBackend(provider, ""), WithModelOptions(options), WithSystemPrompt("Test."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Run(context.Background(), "Hello"); err != nil {
+		t.Fatal(err)
+	}
+	if len(provider.requests) != 1 || provider.requests[0].Options["num_ctx"] != 8192.0 {
+		t.Errorf("requests %+v", provider.requests)
+	}
+}
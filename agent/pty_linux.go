@@ -0,0 +1,62 @@
+//go:build linux
+
+package agent
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+	"unsafe"
+)
+
+// startWithTerminal starts cmd on a new pseudo-terminal, so that programs
+// behave as they would for a user, and returns its input and output
+func startWithTerminal(cmd *exec.Cmd) (io.WriteCloser, io.ReadCloser, bool, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR, 0)
+	if err != nil {
+		return nil, nil, false, fmt.Errorf("failed to open pseudo-terminal: %v", err)
+	}
+
+	var unlock int32
+	if err := ioctl(master, syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); err != nil {
+		master.Close()
+		return nil, nil, false, fmt.Errorf("failed to unlock pseudo-terminal: %v", err)
+	}
+	var n uint32
+	if err := ioctl(master, syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n))); err != nil {
+		master.Close()
+		return nil, nil, false, fmt.Errorf("failed to get pseudo-terminal number: %v", err)
+	}
+	slave, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, false, fmt.Errorf("failed to open pseudo-terminal: %v", err)
+	}
+	defer slave.Close()
+
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true}
+	if err := cmd.Start(); err != nil {
+		master.Close()
+		return nil, nil, false, err
+	}
+	return master, master, true, nil
+}
+
+func ioctl(f *os.File, request, arg uintptr) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), request, arg); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// isTerminal reports whether f is a terminal, as opposed to another
+// character device such as /dev/null
+func isTerminal(f *os.File) bool {
+	var termios syscall.Termios
+	return ioctl(f, syscall.TCGETS, uintptr(unsafe.Pointer(&termios))) == nil
+}
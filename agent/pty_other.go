@@ -0,0 +1,34 @@
+//go:build !linux
+
+package agent
+
+import (
+	"io"
+	"os"
+	"os/exec"
+)
+
+// startWithTerminal falls back to plain pipes where pseudo-terminals are
+// not supported; stdout and stderr share one pipe, as on a terminal
+func startWithTerminal(cmd *exec.Cmd) (io.WriteCloser, io.ReadCloser, bool, error) {
+	input, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, nil, false, err
+	}
+	output, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, false, err
+	}
+	cmd.Stderr = cmd.Stdout
+	if err := cmd.Start(); err != nil {
+		return nil, nil, false, err
+	}
+	return input, output, false, nil
+}
+
+// isTerminal reports whether f is a character device, which is as close
+// as the standard library gets to telling whether it is a terminal
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,165 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// A model that isn't on the Ollama server is pulled from the Ollama
+// library before the session starts, showing its progress, rather than
+// failing at the first request. --no-pull turns this off, for machines
+// with little disk or a metered connection, and --offline never pulls.
+// With no model named, at a terminal, the user picks one of the server's.
+
+// pullProgress is a line of /api/pull's streamed reply
+type pullProgress struct {
+	Status    string `json:"status"`
+	Digest    string `json:"digest"`
+	Total     int64  `json:"total"`
+	Completed int64  `json:"completed"`
+	Error     string `json:"error"`
+}
+
+// ensureModels pulls whichever of the session's models the server doesn't
+// have. Only Ollama can pull, so other providers are left alone.
+func (e *Engine) ensureModels(ctx context.Context, w io.Writer) error {
+	if e.provider != nil || e.anthropicKey != "" || e.llamaCpp {
+		return nil
+	}
+	// A server that can't be reached is reported by whatever needs it, so
+	// commands that don't, such as license-check, still work
+	installed, err := e.modelProvider().ListModels(ctx)
+	if err != nil {
+		return nil
+	}
+	have := make(map[string]bool)
+	for _, m := range installed {
+		have[m.Name] = true
+	}
+
+	for _, model := range append([]string{e.model}, e.ensembleModels...) {
+		if have[model] || have[model+":latest"] {
+			continue
+		}
+		switch {
+		case e.noPull:
+			return fmt.Errorf("model %s is not on the Ollama server; pull it with ollama pull %s, or leave out --no-pull", model, model)
+		case e.offline:
+			return fmt.Errorf("model %s is not on the Ollama server, and --offline stops it being pulled", model)
+		}
+		fmt.Fprintf(w, "Model %s is not on the Ollama server; pulling it\n", model)
+		if err := e.pullModel(ctx, model, w); err != nil {
+			return fmt.Errorf("failed to pull %s: %v", model, err)
+		}
+		have[model] = true
+	}
+	return nil
+}
+
+// pullModel has Ollama pull a model, writing its progress as it goes: each
+// step on a line, and downloads as a percentage rewritten in place
+func (e *Engine) pullModel(ctx context.Context, model string, w io.Writer) error {
+	body, _ := json.Marshal(map[string]interface{}{"model": model, "stream": true})
+	respBody, err := openPost(ctx, e.client, e.ollamaURL+"/api/pull", nil, body)
+	if err != nil {
+		return err
+	}
+	defer respBody.Close()
+
+	status, percent := "", -1
+	scanner := bufio.NewScanner(respBody)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var progress pullProgress
+		if err := json.Unmarshal(scanner.Bytes(), &progress); err != nil {
+			return fmt.Errorf("invalid progress %q: %v", scanner.Text(), err)
+		}
+		if progress.Error != "" {
+			if percent >= 0 {
+				fmt.Fprintln(w)
+			}
+			return fmt.Errorf("%s", progress.Error)
+		}
+
+		if progress.Status != status {
+			if percent >= 0 {
+				fmt.Fprintln(w)
+			}
+			status, percent = progress.Status, -1
+			if progress.Total == 0 {
+				fmt.Fprintln(w, status)
+			}
+		}
+		if progress.Total > 0 {
+			if p := int(progress.Completed * 100 / progress.Total); p != percent {
+				percent = p
+				fmt.Fprintf(w, "\r%s: %d%% of %s", status, percent, formatSize(progress.Total))
+			}
+		}
+		if progress.Status == "success" {
+			return nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if percent >= 0 {
+		fmt.Fprintln(w)
+	}
+	return fmt.Errorf("the pull ended before it succeeded")
+}
+
+// pickModel lists the models on the Ollama server, with their sizes and
+// families, and asks the user which to use; the first is the default, as
+// it is without a terminal
+func pickModel(client *http.Client, url string) (string, error) {
+	models, err := (&ollamaProvider{client: client, url: url}).ListModels(context.Background())
+	if err != nil {
+		return "", err
+	}
+	if len(models) == 0 {
+		return "", fmt.Errorf("no models available on Ollama server")
+	}
+	if len(models) == 1 {
+		return models[0].Name, nil
+	}
+
+	names := make([]string, len(models))
+	width := 0
+	for i, m := range models {
+		names[i] = m.Name
+		width = max(width, len(m.Name))
+	}
+	fmt.Fprintln(os.Stderr, "Models on the Ollama server:")
+	for i, m := range models {
+		var details []string
+		for _, s := range []string{m.Details.Family, m.Details.ParameterSize, m.Details.QuantizationLevel} {
+			if s != "" {
+				details = append(details, s)
+			}
+		}
+		line := fmt.Sprintf("%3d. %-*s  %8s  %s", i+1, width, m.Name, formatSize(m.Size), strings.Join(details, ", "))
+		fmt.Fprintln(os.Stderr, strings.TrimRight(line, " "))
+	}
+	for {
+		line, err := readLine(fmt.Sprintf("Model [1-%d, empty for 1] > ", len(models)))
+		if err != nil {
+			return "", err
+		}
+		if line = strings.TrimSpace(line); line == "" {
+			return models[0].Name, nil
+		}
+		if name, ok := pickChoice(line, names); ok {
+			return name, nil
+		}
+		fmt.Fprintf(os.Stderr, "%q is not one of the models\n", line)
+	}
+}
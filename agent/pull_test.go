@@ -0,0 +1,86 @@
+package agent
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEnsureModels(t *testing.T) {
+	var pulled []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/tags":
+			w.Write([]byte(`{"models": [{"name": "qwen3:latest"}]}`))
+		case "/api/pull":
+			var req struct {
+				Model string `json:"model"`
+			}
+			json.NewDecoder(r.Body).Decode(&req)
+			pulled = append(pulled, req.Model)
+			if req.Model == "missing" {
+				w.Write([]byte(`{"status": "pulling manifest"}` + "\n" + `{"error": "pull model manifest: file does not exist"}` + "\n"))
+				return
+			}
+			for _, line := range []string{
+				`{"status": "pulling manifest"}`,
+				`{"status": "pulling 8eeb52dfb3bb", "digest": "sha256:8eeb52dfb3bb", "total": 2000000000, "completed": 0}`,
+				`{"status": "pulling 8eeb52dfb3bb", "digest": "sha256:8eeb52dfb3bb", "total": 2000000000, "completed": 1000000000}`,
+				`{"status": "pulling 8eeb52dfb3bb", "digest": "sha256:8eeb52dfb3bb", "total": 2000000000, "completed": 1000000001}`,
+				`{"status": "pulling 8eeb52dfb3bb", "digest": "sha256:8eeb52dfb3bb", "total": 2000000000, "completed": 2000000000}`,
+				`{"status": "verifying sha256 digest"}`,
+				`{"status": "success"}`,
+			} {
+				w.Write([]byte(line + "\n"))
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	e, err := New(WithWorkspace(t.TempDir()), WithProvider(srv.Client(), srv.URL, "qwen3"), WithEnsemble("", "llama3.2:3b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	if err := e.ensureModels(t.Context(), &out); err != nil {
+		t.Fatal(err)
+	}
+	want := "Model llama3.2:3b is not on the Ollama server; pulling it\npulling manifest\n" +
+		"\rpulling 8eeb52dfb3bb: 0% of 1.9 GB\rpulling 8eeb52dfb3bb: 50% of 1.9 GB\rpulling 8eeb52dfb3bb: 100% of 1.9 GB\n" +
+		"verifying sha256 digest\nsuccess\n"
+	if out.String() != want || strings.Join(pulled, ",") != "llama3.2:3b" {
+		t.Errorf("pulled %v, output:\n%q", pulled, out.String())
+	}
+
+	e.model, e.ensembleModels = "missing", nil
+	if err := e.ensureModels(t.Context(), &out); err == nil || !strings.Contains(err.Error(), "failed to pull missing: pull model manifest: file does not exist") {
+		t.Errorf("error %v", err)
+	}
+	e.noPull = true
+	if err := e.ensureModels(t.Context(), &out); err == nil || !strings.Contains(err.Error(), "leave out --no-pull") || len(pulled) != 2 {
+		t.Errorf("with --no-pull, error %v, pulled %v", err, pulled)
+	}
+}
+
+func TestPickModel(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"models": [
+			{"name": "qwen2.5-coder:32b", "size": 19851349856, "details": {"family": "qwen2", "parameter_size": "32.8B", "quantization_level": "Q4_K_M"}},
+			{"name": "llama3.2:3b", "size": 2019393189, "details": {"family": "llama", "parameter_size": "3.2B"}},
+			{"name": "qwen3:8b", "size": 5225376047}
+		]}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	saved := stdinReader
+	t.Cleanup(func() { stdinReader = saved })
+	for input, want := range map[string]string{"\n": "qwen2.5-coder:32b", "lla\n": "llama3.2:3b", "qwen\n4\n3\n": "qwen3:8b"} {
+		stdinReader = bufio.NewReader(strings.NewReader(input))
+		if model, err := pickModel(srv.Client(), srv.URL); err != nil || model != want {
+			t.Errorf("%q picks %q, %v, want %q", input, model, err, want)
+		}
+	}
+}
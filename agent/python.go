@@ -0,0 +1,346 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pythonDriver runs in the interpreter, reading one JSON request per line
+// and answering with one JSON result per line. It keeps the protocol on
+// duplicates of stdin and stdout, and points the originals at /dev/null and
+// stderr, so that subprocesses run by the code cannot read or corrupt it.
+// As in a notebook cell, a final expression's value is returned as its repr.
+const pythonDriver = `
+import ast, contextlib, io, json, os, sys, traceback
+
+requests = os.fdopen(os.dup(0), "r", encoding="utf-8")
+responses = os.fdopen(os.dup(1), "w", encoding="utf-8")
+os.dup2(os.open(os.devnull, os.O_RDONLY), 0)
+os.dup2(2, 1)
+sys.stdin = io.StringIO()
+namespace = {"__name__": "__main__", "__builtins__": __builtins__}
+
+def run(code):
+    stdout, stderr = io.StringIO(), io.StringIO()
+    result = {}
+    with contextlib.redirect_stdout(stdout), contextlib.redirect_stderr(stderr):
+        try:
+            tree = ast.parse(code, "<run_python>", "exec")
+            last = None
+            if tree.body and isinstance(tree.body[-1], ast.Expr):
+                last = ast.Expression(tree.body.pop().value)
+            exec(compile(tree, "<run_python>", "exec"), namespace)
+            if last is not None:
+                value = eval(compile(last, "<run_python>", "eval"), namespace)
+                if value is not None:
+                    namespace["_"] = value
+                    result["value"] = repr(value)
+        except BaseException as e:
+            # Leave out this driver's frames, and the parser's
+            tb = e.__traceback__.tb_next if e.__traceback__ else None
+            if isinstance(e, SyntaxError):
+                tb = None
+            result["error"] = "".join(traceback.format_exception(type(e), e, tb))
+    result["stdout"] = stdout.getvalue()
+    result["stderr"] = stderr.getvalue()
+    return result
+
+for line in requests:
+    responses.write(json.dumps(run(json.loads(line)["code"])) + "\n")
+    responses.flush()
+`
+
+// PythonResult is what run_python returns to the model
+type PythonResult struct {
+	Stdout          string  `json:"stdout"`
+	Stderr          string  `json:"stderr"`
+	Value           string  `json:"value,omitempty"`
+	Error           string  `json:"error,omitempty"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	StdoutTruncated bool    `json:"stdout_truncated,omitempty"`
+	StderrTruncated bool    `json:"stderr_truncated,omitempty"`
+	TimedOut        bool    `json:"timed_out,omitempty"`
+	Note            string  `json:"note,omitempty"`
+}
+
+// pythonSession is a long-lived Python interpreter that code is run in one
+// piece after another, so that variables, imports and loaded data carry
+// over between calls
+type pythonSession struct {
+	cmd       *exec.Cmd
+	input     io.WriteCloser
+	responses chan []byte
+
+	// stderr collects output written straight to the process's stdout or
+	// stderr, e.g. by subprocesses, rather than through sys.stdout
+	mu     sync.Mutex
+	stderr bytes.Buffer
+}
+
+func startPythonSession(dir string) (*pythonSession, error) {
+	name := "python3"
+	if _, err := exec.LookPath(name); err != nil {
+		name = "python"
+	}
+	cmd := exec.Command(name, "-u", "-c", pythonDriver)
+	cmd.Dir = dir
+	cmd.Env = commandEnv()
+
+	input, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start Python: %v", err)
+	}
+	output, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start Python: %v", err)
+	}
+	s := &pythonSession{
+		cmd:       cmd,
+		input:     input,
+		responses: make(chan []byte, 1),
+	}
+	cmd.Stderr = lockedWriter{&s.mu, &s.stderr}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start Python: %v", err)
+	}
+
+	go func() {
+		defer close(s.responses)
+		reader := bufio.NewReader(output)
+		for {
+			line, err := reader.ReadBytes('\n')
+			if err != nil {
+				return
+			}
+			s.responses <- line
+		}
+	}()
+	return s, nil
+}
+
+type lockedWriter struct {
+	mu  *sync.Mutex
+	buf *bytes.Buffer
+}
+
+func (w lockedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.Write(p)
+}
+
+// run runs code in the interpreter and waits for its result. After a
+// timeout or error the session is no longer usable.
+func (s *pythonSession) run(code string, timeout time.Duration) (PythonResult, error) {
+	request, err := json.Marshal(map[string]string{"code": code})
+	if err != nil {
+		return PythonResult{}, fmt.Errorf("failed to marshal code: %v", err)
+	}
+	if _, err := s.input.Write(append(request, '\n')); err != nil {
+		return PythonResult{}, fmt.Errorf("failed to write to Python: %v", err)
+	}
+
+	var result PythonResult
+	select {
+	case response, ok := <-s.responses:
+		if !ok {
+			s.cmd.Wait()
+			return PythonResult{Stderr: s.takeStderr()}, fmt.Errorf("interpreter exited")
+		}
+		if err := json.Unmarshal(response, &result); err != nil {
+			return PythonResult{}, fmt.Errorf("invalid response from Python: %v", err)
+		}
+	case <-time.After(timeout):
+		return PythonResult{TimedOut: true, Stderr: s.takeStderr()}, errPythonTimeout
+	}
+	result.Stderr += s.takeStderr()
+	return result, nil
+}
+
+var errPythonTimeout = fmt.Errorf("timed out")
+
+// takeStderr returns and clears the output collected outside sys.stdout
+func (s *pythonSession) takeStderr() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	text := s.stderr.String()
+	s.stderr.Reset()
+	return text
+}
+
+func (s *pythonSession) close() {
+	s.input.Close()
+	s.cmd.Process.Kill()
+	s.cmd.Wait()
+}
+
+func pythonTool() Tool {
+	return Tool{
+		Type: "function",
+		Function: Function{
+			Name:        "run_python",
+			Description: "Run Python code in a persistent interpreter, like a notebook cell: variables, imports and loaded data are kept between calls. The value of a final expression is returned as its repr, along with printed output and any exception traceback. Prefer this to run_command for data analysis",
+			Parameters: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"code": map[string]interface{}{
+						"type":        "string",
+						"description": "Python code to run",
+					},
+					"timeout": map[string]interface{}{
+						"type":        "number",
+						"description": "Timeout in seconds (optional, default 30); on timeout the interpreter is restarted and its state lost",
+					},
+				},
+				"required": []string{"code"},
+			},
+		},
+	}
+}
+
+// runPython is the run_python tool. The interpreter is started on first use
+// in the current directory, and restarted if the code kills it or times out.
+// Since the code can do anything a command can, it goes through the same
+// checks as one; see checkPythonPolicy.
+func (e *Engine) runPython(args json.RawMessage) (string, error) {
+	var params struct {
+		Code    string  `json:"code"`
+		Timeout float64 `json:"timeout"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return "", fmt.Errorf("invalid arguments: %v", err)
+	}
+	if params.Timeout == 0 {
+		params.Timeout = 30
+	}
+	timeout := time.Duration(params.Timeout * float64(time.Second))
+
+	if err := e.checkPythonPolicy(params.Code); err != nil {
+		return "", err
+	}
+
+	if e.python == nil {
+		dir, err := e.resolvePath(e.cwd)
+		if err != nil {
+			return "", fmt.Errorf("current directory is no longer usable: %v", err)
+		}
+		e.python, err = startPythonSession(dir)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// The code may change any file
+	e.invalidateCommandCache()
+	start := time.Now()
+	result, err := e.python.run(params.Code, timeout)
+	switch {
+	case err == errPythonTimeout:
+		e.closePython()
+		result.Note = "the interpreter was restarted, so earlier variables and imports are gone"
+	case err != nil:
+		e.closePython()
+		if result.Stderr != "" {
+			err = fmt.Errorf("%v: %s", err, strings.TrimSpace(result.Stderr))
+		}
+		return "", fmt.Errorf("%v; a new interpreter will be started for the next call", err)
+	}
+	result.DurationSeconds = time.Since(start).Round(time.Millisecond).Seconds()
+	result.Stdout, result.StdoutTruncated = truncateOutput(result.Stdout)
+	result.Stderr, result.StderrTruncated = truncateOutput(result.Stderr)
+	result.Value, _ = truncateOutput(result.Value)
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal result: %v", err)
+	}
+	return string(data), nil
+}
+
+func (e *Engine) closePython() {
+	if e.python != nil {
+		e.python.close()
+		e.python = nil
+	}
+}
+
+// pythonNetworkModules are modules whose import means the code means to
+// connect somewhere
+var pythonNetworkModules = regexp.MustCompile(`(?m)^\s*(import|from)\s+(socket|ssl|urllib|urllib3|http|requests|httpx|aiohttp|ftplib|smtplib|poplib|imaplib|telnetlib|xmlrpc|paramiko|websocket|websockets)\b`)
+
+// pythonDeletes are calls that delete files
+var pythonDeletes = regexp.MustCompile(`\b(shutil\.rmtree|os\.(remove|unlink|rmdir|removedirs)|\.unlink|\.rmdir)\s*\(`)
+
+// pythonString matches a one-line string literal, whose contents may be a
+// command the code runs through os.system or subprocess
+var pythonString = regexp.MustCompile(`"((?:[^"\\\n]|\\.)*)"|'((?:[^'\\\n]|\\.)*)'`)
+
+// pythonCommands returns the string literals in code that parse as shell
+// command lines
+func pythonCommands(code string) []string {
+	var commands []string
+	for _, m := range pythonString.FindAllStringSubmatch(code, -1) {
+		if s := strings.TrimSpace(m[1] + m[2]); s != "" {
+			commands = append(commands, s)
+		}
+	}
+	return commands
+}
+
+// checkPythonPolicy puts run_python code through the checks a command gets.
+// Code can't be classified as a command line can, so it falls under the
+// policy for unknown commands; but with --offline, code that imports a
+// network module, or has a network command in a string, is refused, and
+// code that deletes files or runs a destructive command is checked against
+// the session's destructive intents.
+func (e *Engine) checkPythonPolicy(code string) error {
+	commands := pythonCommands(code)
+	if e.offline {
+		if m := pythonNetworkModules.FindStringSubmatch(code); m != nil {
+			return fmt.Errorf("code refused: it imports %s, which needs the network, and wex is running with --offline", m[2])
+		}
+		for _, command := range commands {
+			if err := e.checkOfflineCommand(command); err != nil {
+				return err
+			}
+		}
+	}
+
+	intents := make(map[string]bool)
+	if pythonDeletes.MatchString(code) || destructiveSQL.MatchString(code) {
+		intents["wipe-data"] = true
+	}
+	for _, command := range commands {
+		for _, name := range commandIntents(command) {
+			intents[name] = true
+		}
+	}
+	var names []string
+	for name := range intents {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if intent := e.unconfirmedIntent(names); intent != nil {
+		return fmt.Errorf("code refused: it would %s, which this session's request or plan asked for but the user did not confirm. Do not look for another way to do it; say what you would have run instead",
+			intent.description)
+	}
+
+	switch e.commandPolicy[classUnknown] {
+	case policyDeny:
+		return fmt.Errorf("code refused: Python code falls under the policy for %s commands, which are not allowed", classUnknown)
+	case policyAsk:
+		if !e.askApproval("Run Python code:\n" + code) {
+			return fmt.Errorf("code refused: the user did not approve this Python code")
+		}
+	}
+	return nil
+}
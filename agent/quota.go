@@ -0,0 +1,39 @@
+package agent
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Quota caps what file tools may write in one session, as protection
+// against runaway generation filling the disk. Zero limits mean unlimited.
+// Files written by run_command are not counted.
+type Quota struct {
+	MaxBytes int64
+	MaxFiles int
+
+	mu           sync.Mutex
+	bytesWritten int64
+	filesCreated int
+}
+
+// reserve accounts for a write of size bytes, or rejects it if it would
+// take the session over quota
+func (q *Quota) reserve(size int64, newFile bool) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.MaxBytes > 0 && q.bytesWritten+size > q.MaxBytes {
+		return fmt.Errorf("write quota exceeded: writing %d bytes would bring this session's total to %d, over the limit of %d",
+			size, q.bytesWritten+size, q.MaxBytes)
+	}
+	if newFile && q.MaxFiles > 0 && q.filesCreated+1 > q.MaxFiles {
+		return fmt.Errorf("file quota exceeded: this session has already created %d files, the limit", q.filesCreated)
+	}
+
+	q.bytesWritten += size
+	if newFile {
+		q.filesCreated++
+	}
+	return nil
+}
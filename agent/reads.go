@@ -0,0 +1,109 @@
+package agent
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// readRecord is what the conversation already holds of a file: the digest
+// of the version read, and the line ranges read from it, "" for the whole
+type readRecord struct {
+	digest string
+	ranges map[string]bool
+}
+
+// alreadyRead checks whether this read of a file would return what an
+// earlier one did, and records it if not. The file being unchanged since
+// the earlier read is what matters; a whole read covers any range of it.
+func (e *Engine) alreadyRead(fullPath string, content []byte, start, end int) (string, bool) {
+	sum := sha256.Sum256(content)
+	digest := hex.EncodeToString(sum[:])
+	span := ""
+	if start > 0 || end > 0 {
+		span = fmt.Sprintf("%d-%d", start, end)
+	}
+
+	if e.reads == nil {
+		e.reads = make(map[string]*readRecord)
+	}
+	record := e.reads[fullPath]
+	if record == nil || record.digest != digest {
+		record = &readRecord{digest: digest, ranges: make(map[string]bool)}
+		e.reads[fullPath] = record
+	}
+	if record.ranges[""] || record.ranges[span] {
+		return digest[:12], true
+	}
+	record.ranges[span] = true
+	return digest[:12], false
+}
+
+func readFilesTool() Tool {
+	return Tool{
+		Type: "function",
+		Function: Function{
+			Name:        "read_files",
+			Description: "Read several files at once, returned together with a header before each. Use this rather than several read_file calls when you need a handful of related files",
+			Parameters: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"paths": map[string]interface{}{
+						"type":        "array",
+						"items":       map[string]interface{}{"type": "string"},
+						"description": "File paths relative to workspace",
+					},
+				},
+				"required": []string{"paths"},
+			},
+		},
+	}
+}
+
+// maxReadFilesBytes is the most read_files returns in one call; files past
+// it are named, to be read separately
+const maxReadFilesBytes = 200000
+
+// readFiles reads each file as read_file would, so size limits, encoding
+// notes and read deduplication all apply per file
+func (e *Engine) readFiles(args json.RawMessage) (string, error) {
+	var params struct {
+		Paths []string `json:"paths"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return "", fmt.Errorf("invalid arguments: %v", err)
+	}
+	if len(params.Paths) == 0 {
+		return "", fmt.Errorf("no paths given")
+	}
+
+	var b strings.Builder
+	var omitted []string
+	for _, path := range params.Paths {
+		// Files are sized up before reading, since a file that is read is
+		// recorded as being in the conversation
+		if fullPath, err := e.resolvePath(path); err == nil && b.Len() > 0 {
+			if info, err := e.files().Stat(fullPath); err == nil && b.Len()+int(info.Size()) > maxReadFilesBytes {
+				omitted = append(omitted, path)
+				continue
+			}
+		}
+		fileArgs, _ := json.Marshal(map[string]string{"path": path})
+		text, err := e.readFile(fileArgs)
+		if err != nil {
+			text = "Error: " + err.Error() + "\n"
+		}
+		fmt.Fprintf(&b, "==> %s <==\n%s", path, text)
+		if !strings.HasSuffix(text, "\n") {
+			b.WriteByte('\n')
+		}
+		b.WriteByte('\n')
+	}
+	if len(omitted) > 0 {
+		fmt.Fprintf(&b, "Not included, to keep this result under %d bytes; read them separately: %s\n",
+			maxReadFilesBytes, strings.Join(omitted, ", "))
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,155 @@
+package agent
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// repairArguments fixes tool call arguments in the malformed shapes local
+// models commonly produce, reporting whether anything was changed. Arguments
+// that can't be repaired are returned as they were, for the tool to reject.
+func repairArguments(args json.RawMessage) (json.RawMessage, bool) {
+	text := strings.TrimSpace(string(args))
+	if text == "" {
+		return json.RawMessage("{}"), true
+	}
+
+	// An object encoded as a JSON string, sometimes twice over
+	changed := false
+	for i := 0; i < 2 && strings.HasPrefix(text, `"`); i++ {
+		var s string
+		if json.Unmarshal([]byte(text), &s) != nil {
+			break
+		}
+		s = strings.TrimSpace(s)
+		if !strings.HasPrefix(s, "{") {
+			break
+		}
+		text, changed = s, true
+	}
+	if json.Valid([]byte(text)) {
+		return json.RawMessage(text), changed
+	}
+	if repaired, ok := repairJSON(text); ok {
+		return json.RawMessage(repaired), true
+	}
+	return args, false
+}
+
+// repairJSON applies jsonrepair-style fixes: single-quoted strings, unquoted
+// keys, trailing commas, Python's True, False and None, raw control
+// characters in strings and missing closing brackets
+func repairJSON(text string) (string, bool) {
+	var b strings.Builder
+	var closers []byte
+	runes := []rune(text)
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+		switch {
+		case c == '"' || c == '\'':
+			i = writeString(&b, runes, i)
+		case c == '{':
+			closers = append(closers, '}')
+			b.WriteRune(c)
+		case c == '[':
+			closers = append(closers, ']')
+			b.WriteRune(c)
+		case c == '}' || c == ']':
+			trimTrailingComma(&b)
+			if len(closers) > 0 {
+				closers = closers[:len(closers)-1]
+			}
+			b.WriteRune(c)
+		case isIdentStart(c):
+			j := i
+			for j < len(runes) && (isIdentStart(runes[j]) || runes[j] >= '0' && runes[j] <= '9') {
+				j++
+			}
+			word := string(runes[i:j])
+			k := j
+			for k < len(runes) && (runes[k] == ' ' || runes[k] == '\t') {
+				k++
+			}
+			switch {
+			case k < len(runes) && runes[k] == ':':
+				// An unquoted key
+				data, _ := json.Marshal(word)
+				b.Write(data)
+			case word == "True" || word == "true":
+				b.WriteString("true")
+			case word == "False" || word == "false":
+				b.WriteString("false")
+			case word == "None" || word == "null":
+				b.WriteString("null")
+			default:
+				b.WriteString(word)
+			}
+			i = j - 1
+		default:
+			b.WriteRune(c)
+		}
+	}
+	trimTrailingComma(&b)
+	for i := len(closers) - 1; i >= 0; i-- {
+		b.WriteByte(closers[i])
+	}
+	result := b.String()
+	return result, json.Valid([]byte(result))
+}
+
+func isIdentStart(c rune) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// writeString writes the string literal starting at runes[start] as a valid
+// JSON string, and returns the index of its closing quote
+func writeString(b *strings.Builder, runes []rune, start int) int {
+	quote := runes[start]
+	var s strings.Builder
+	i := start + 1
+	for ; i < len(runes) && runes[i] != quote; i++ {
+		c := runes[i]
+		if c == '\\' && i+1 < len(runes) {
+			i++
+			switch next := runes[i]; next {
+			case 'n':
+				s.WriteRune('\n')
+			case 't':
+				s.WriteRune('\t')
+			case 'r':
+				s.WriteRune('\r')
+			case 'b':
+				s.WriteRune('\b')
+			case 'f':
+				s.WriteRune('\f')
+			case 'u':
+				var decoded string
+				if i+4 < len(runes) && json.Unmarshal([]byte(`"\u`+string(runes[i+1:i+5])+`"`), &decoded) == nil {
+					s.WriteString(decoded)
+					i += 4
+				} else {
+					s.WriteRune('u')
+				}
+			default:
+				// \", \', \\, \/ and unknown escapes stand for the character
+				s.WriteRune(next)
+			}
+			continue
+		}
+		s.WriteRune(c)
+	}
+	data, _ := json.Marshal(s.String())
+	b.Write(data)
+	return i
+}
+
+// trimTrailingComma removes a comma, and any whitespace after it, from the
+// end of what has been written
+func trimTrailingComma(b *strings.Builder) {
+	s := b.String()
+	trimmed := strings.TrimRight(s, " \t\r\n")
+	if strings.HasSuffix(trimmed, ",") {
+		b.Reset()
+		b.WriteString(trimmed[:len(trimmed)-1])
+	}
+}
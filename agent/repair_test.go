@@ -0,0 +1,37 @@
+package agent
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestRepairArguments(t *testing.T) {
+	tests := []struct {
+		in, want string
+		changed  bool
+	}{
+		{`{"path": "a.txt"}`, `{"path": "a.txt"}`, false},
+		{``, `{}`, true},
+		{`"{\"path\": \"a.txt\"}"`, `{"path": "a.txt"}`, true},
+		{`{'path': 'a.txt'}`, `{"path":"a.txt"}`, true},
+		{`{path: "a.txt", force: True}`, `{"path":"a.txt","force":true}`, true},
+		{`{"paths": ["a", "b",],}`, `{"paths":["a","b"]}`, true},
+		{`{"value": None}`, `{"value":null}`, true},
+		{"{\"content\": \"line 1\nline 2\"}", `{"content":"line 1\nline 2"}`, true},
+		{`{"path": "a.txt", "lines": [1, 2`, `{"path":"a.txt","lines":[1,2]}`, true},
+		{`{'quote': 'it\'s'}`, `{"quote":"it's"}`, true},
+	}
+	for _, test := range tests {
+		got, changed := repairArguments(json.RawMessage(test.in))
+		if changed != test.changed || canonicalArguments(got) != canonicalArguments(json.RawMessage(test.want)) {
+			t.Errorf("repairArguments(%s) = %s, %v; want %s, %v", test.in, got, changed, test.want, test.changed)
+		}
+	}
+}
+
+func TestRepairArgumentsGivesUp(t *testing.T) {
+	in := json.RawMessage(`{"path": }`)
+	if got, changed := repairArguments(in); changed || string(got) != string(in) {
+		t.Errorf("unrepairable arguments returned as %s, %v", got, changed)
+	}
+}
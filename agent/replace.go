@@ -0,0 +1,246 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// maxReplaceFileBytes skips files too large to be source code
+const maxReplaceFileBytes = 2 << 20
+
+// maxReplacePreviewLines limits the changed lines a dry run shows
+const maxReplacePreviewLines = 60
+
+func replaceAcrossFilesTool() Tool {
+	return Tool{
+		Type: "function",
+		Function: Function{
+			Name:        "replace_across_files",
+			Description: "Find and replace text in every matching file in the workspace at once, as for renaming a function or variable across a project. Returns the number of replacements in each file. Run it with dry_run first to see the changed lines",
+			Parameters: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"find": map[string]interface{}{
+						"type":        "string",
+						"description": "Text to find, or a Go regular expression with regex",
+					},
+					"replace": map[string]interface{}{
+						"type":        "string",
+						"description": "Replacement; with regex, $1 or ${name} insert groups",
+					},
+					"regex": map[string]interface{}{
+						"type":        "boolean",
+						"description": "Treat find as a regular expression",
+					},
+					"whole_word": map[string]interface{}{
+						"type":        "boolean",
+						"description": "Only match find where it is a whole word, so renaming get does not touch getAll",
+					},
+					"glob": map[string]interface{}{
+						"type":        "string",
+						"description": "Files to change, e.g. \"*.go\" for any Go file or \"src/**/*.ts\"; default all text files",
+					},
+					"dry_run": map[string]interface{}{
+						"type":        "boolean",
+						"description": "Show what would change without writing anything",
+					},
+				},
+				"required": []string{"find", "replace"},
+			},
+		},
+	}
+}
+
+// globRegexp compiles a glob to a regular expression over slash-separated
+// paths relative to the workspace. A glob without a slash matches file
+// names in any directory; ** matches any number of directories.
+func globRegexp(glob string) (*regexp.Regexp, error) {
+	if glob == "" {
+		glob = "*"
+	}
+	if !strings.Contains(glob, "/") {
+		glob = "**/" + glob
+	}
+	if _, err := path.Match(strings.ReplaceAll(glob, "**", "*"), ""); err != nil {
+		return nil, fmt.Errorf("invalid glob %q: %v", glob, err)
+	}
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case glob[i] == '*':
+			b.WriteString("[^/]*")
+		case glob[i] == '?':
+			b.WriteString("[^/]")
+		case glob[i] == '[':
+			end := strings.IndexByte(glob[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("invalid glob %q: no ] for [", glob)
+			}
+			class := glob[i : i+end+1]
+			if strings.HasPrefix(class, "[!") {
+				class = "[^" + class[2:]
+			}
+			b.WriteString(class)
+			i += end
+		default:
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+func (e *Engine) replaceAcrossFiles(args json.RawMessage) (string, error) {
+	var params struct {
+		Find      string `json:"find"`
+		Replace   string `json:"replace"`
+		Regex     bool   `json:"regex"`
+		WholeWord bool   `json:"whole_word"`
+		Glob      string `json:"glob"`
+		DryRun    bool   `json:"dry_run"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return "", fmt.Errorf("invalid arguments: %v", err)
+	}
+	if params.Find == "" {
+		return "", fmt.Errorf("nothing to find")
+	}
+
+	pattern := params.Find
+	replacement := params.Replace
+	if !params.Regex {
+		pattern = regexp.QuoteMeta(pattern)
+		replacement = strings.ReplaceAll(replacement, "$", "$$")
+	}
+	if params.WholeWord {
+		pattern = `\b(?:` + pattern + `)\b`
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return "", fmt.Errorf("invalid regular expression: %v", err)
+	}
+	scope, err := globRegexp(params.Glob)
+	if err != nil {
+		return "", err
+	}
+
+	type change struct {
+		path    string
+		before  string
+		count   int
+		text    string
+		preview []string
+	}
+	var changes []change
+	walkDir(e.files(), e.workspace, func(fullPath string, d fs.DirEntry, err error) error {
+		if err != nil || fullPath == e.workspace {
+			return nil
+		}
+		rel, _ := filepath.Rel(e.workspace, fullPath)
+		rel = filepath.ToSlash(rel)
+		if d.IsDir() {
+			if skippedDirs[d.Name()] || strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || !scope.MatchString(rel) {
+			return nil
+		}
+		if info, err := d.Info(); err != nil || info.Size() > maxReplaceFileBytes {
+			return nil
+		}
+		data, err := e.files().ReadFile(fullPath)
+		if err != nil {
+			return nil
+		}
+		text, _ := decodeText(data)
+		if strings.ContainsRune(text, 0) {
+			return nil
+		}
+		matches := re.FindAllStringIndex(text, -1)
+		if len(matches) == 0 {
+			return nil
+		}
+		c := change{path: rel, before: text, count: len(matches), text: re.ReplaceAllString(text, replacement)}
+		if params.DryRun {
+			c.preview = changedLines(text, c.text)
+		}
+		changes = append(changes, c)
+		return nil
+	})
+
+	if len(changes) == 0 {
+		return fmt.Sprintf("No matches for %q", params.Find), nil
+	}
+	// Check the budget for every file at once, rather than stopping partway
+	if !params.DryRun {
+		var writes []budgetWrite
+		for _, c := range changes {
+			fullPath, err := e.resolvePath(c.path)
+			if err != nil {
+				return "", err
+			}
+			writes = append(writes, budgetWrite{fullPath, c.before, c.text})
+		}
+		if err := e.spendDiffBudget(writes...); err != nil {
+			return "", err
+		}
+	}
+	var b strings.Builder
+	total, shown := 0, 0
+	for i, c := range changes {
+		total += c.count
+		fmt.Fprintf(&b, "%s: %d\n", c.path, c.count)
+		if !params.DryRun {
+			if err := e.saveFile(c.path, c.text, ""); err != nil {
+				return "", fmt.Errorf("failed to write %s, after changing %d of %d files: %v", c.path, i, len(changes), err)
+			}
+			continue
+		}
+		for _, line := range c.preview {
+			if shown < maxReplacePreviewLines {
+				b.WriteString(line)
+			}
+			shown++
+		}
+	}
+	if shown > maxReplacePreviewLines {
+		fmt.Fprintf(&b, "(%d more changed lines not shown)\n", shown-maxReplacePreviewLines)
+	}
+	verb := "Replaced"
+	if params.DryRun {
+		verb = "Would replace"
+	}
+	fmt.Fprintf(&b, "%s %d matches in %d files", verb, total, len(changes))
+	return b.String(), nil
+}
+
+// changedLines shows the lines that differ between two versions of a file
+// with the same number of lines, or else a note that the line count changes
+func changedLines(before, after string) []string {
+	old := strings.Split(before, "\n")
+	updated := strings.Split(after, "\n")
+	if len(old) != len(updated) {
+		return []string{fmt.Sprintf("  (the replacement changes the file from %d to %d lines)\n", len(old), len(updated))}
+	}
+	var lines []string
+	for i := range old {
+		if old[i] != updated[i] {
+			lines = append(lines, fmt.Sprintf("  %d- %s\n  %d+ %s\n", i+1, old[i], i+1, updated[i]))
+		}
+	}
+	return lines
+}
@@ -0,0 +1,157 @@
+package agent
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// maxRepoMapEntries caps the number of tree lines in the repository map
+const maxRepoMapEntries = 200
+
+// skippedDirs are not descended into when mapping the repository
+var skippedDirs = map[string]bool{
+	".git": true, "node_modules": true, "vendor": true, "target": true, "dist": true,
+	"build": true, "__pycache__": true, ".venv": true, "venv": true, ".idea": true,
+}
+
+// buildSystems maps key files to the build system they indicate
+var buildSystems = map[string]string{
+	"go.mod":           "Go modules (go build, go test)",
+	"package.json":     "npm",
+	"Cargo.toml":       "Cargo",
+	"pyproject.toml":   "Python (pyproject)",
+	"setup.py":         "Python (setuptools)",
+	"requirements.txt": "Python (pip)",
+	"Makefile":         "make",
+	"CMakeLists.txt":   "CMake",
+	"pom.xml":          "Maven",
+	"build.gradle":     "Gradle",
+	"Gemfile":          "Bundler",
+	"composer.json":    "Composer",
+}
+
+// languages maps file extensions to language names
+var languages = map[string]string{
+	".go": "Go", ".py": "Python", ".js": "JavaScript", ".ts": "TypeScript", ".tsx": "TypeScript",
+	".jsx": "JavaScript", ".rs": "Rust", ".java": "Java", ".kt": "Kotlin", ".c": "C", ".h": "C",
+	".cpp": "C++", ".cc": "C++", ".hpp": "C++", ".cs": "C#", ".rb": "Ruby", ".php": "PHP",
+	".swift": "Swift", ".scala": "Scala", ".sh": "Shell", ".lua": "Lua", ".zig": "Zig",
+}
+
+// buildRepoMap describes the workspace layout compactly, so the model does
+// not have to spend its first iterations listing directories
+func (e *Engine) buildRepoMap() string {
+	var tree []string
+	omitted := 0
+	languageCounts := make(map[string]int)
+	var keyFiles []string
+
+	walkDir(e.files(), e.workspace, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == e.workspace {
+			return nil
+		}
+		rel, _ := filepath.Rel(e.workspace, path)
+		depth := strings.Count(rel, string(filepath.Separator))
+		indent := strings.Repeat("  ", depth)
+
+		if d.IsDir() {
+			if skippedDirs[d.Name()] || strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			if len(tree) < maxRepoMapEntries {
+				tree = append(tree, indent+d.Name()+"/")
+			} else {
+				omitted++
+			}
+			return nil
+		}
+
+		if lang, ok := languages[strings.ToLower(filepath.Ext(path))]; ok {
+			languageCounts[lang]++
+		}
+		if _, ok := buildSystems[d.Name()]; ok && depth == 0 {
+			keyFiles = append(keyFiles, d.Name())
+		}
+		if strings.HasPrefix(strings.ToUpper(d.Name()), "README") && depth == 0 {
+			keyFiles = append(keyFiles, d.Name())
+		}
+
+		if len(tree) >= maxRepoMapEntries {
+			omitted++
+			return nil
+		}
+		size := int64(0)
+		if info, err := d.Info(); err == nil {
+			size = info.Size()
+		}
+		tree = append(tree, fmt.Sprintf("%s%s (%s)", indent, d.Name(), formatSize(size)))
+		return nil
+	})
+
+	var b strings.Builder
+	b.WriteString("Repository map of the workspace:\n")
+
+	if len(languageCounts) > 0 {
+		type count struct {
+			lang string
+			n    int
+		}
+		var counts []count
+		for lang, n := range languageCounts {
+			counts = append(counts, count{lang, n})
+		}
+		sort.Slice(counts, func(i, j int) bool {
+			if counts[i].n != counts[j].n {
+				return counts[i].n > counts[j].n
+			}
+			return counts[i].lang < counts[j].lang
+		})
+		var parts []string
+		for _, c := range counts {
+			parts = append(parts, fmt.Sprintf("%s (%d)", c.lang, c.n))
+		}
+		fmt.Fprintf(&b, "Languages (source files): %s\n", strings.Join(parts, ", "))
+	}
+
+	var systems []string
+	for _, name := range keyFiles {
+		if system, ok := buildSystems[name]; ok {
+			systems = append(systems, system)
+		}
+	}
+	if len(systems) > 0 {
+		fmt.Fprintf(&b, "Build system: %s\n", strings.Join(systems, ", "))
+	}
+	if len(keyFiles) > 0 {
+		fmt.Fprintf(&b, "Key files: %s\n", strings.Join(keyFiles, ", "))
+	}
+
+	if len(tree) == 0 {
+		b.WriteString("The workspace is empty.\n")
+		return b.String()
+	}
+	b.WriteString("Files:\n")
+	b.WriteString(strings.Join(tree, "\n"))
+	b.WriteString("\n")
+	if omitted > 0 {
+		fmt.Fprintf(&b, "... and %d more entries\n", omitted)
+	}
+	return b.String()
+}
+
+// formatSize renders a byte count in human-readable units
+func formatSize(size int64) string {
+	switch {
+	case size < 1024:
+		return fmt.Sprintf("%d B", size)
+	case size < 1024*1024:
+		return fmt.Sprintf("%.1f KB", float64(size)/1024)
+	case size < 1024*1024*1024:
+		return fmt.Sprintf("%.1f MB", float64(size)/(1024*1024))
+	default:
+		return fmt.Sprintf("%.1f GB", float64(size)/(1024*1024*1024))
+	}
+}
@@ -0,0 +1,268 @@
+package agent
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// conflictContextLines is how much of the file around a conflict the model
+// sees on each side
+const conflictContextLines = 30
+
+// conflict is a region of a file between git's conflict markers, as line
+// indexes of the <<<<<<< and >>>>>>> lines
+type conflict struct {
+	start, end  int
+	ours        string
+	base        string
+	theirs      string
+	oursLabel   string
+	theirsLabel string
+	hasBase     bool
+}
+
+// parseConflicts finds the conflicts in a file's lines, which keep their
+// line endings; base is there with merge.conflictStyle diff3 or zdiff3
+func parseConflicts(lines []string) ([]conflict, error) {
+	var conflicts []conflict
+	marker := func(line, m string) (string, bool) {
+		line = strings.TrimRight(line, "\r\n")
+		if line == m {
+			return "", true
+		}
+		if strings.HasPrefix(line, m+" ") {
+			return line[len(m)+1:], true
+		}
+		return "", false
+	}
+	for i := 0; i < len(lines); i++ {
+		label, ok := marker(lines[i], "<<<<<<<")
+		if !ok {
+			continue
+		}
+		c := conflict{start: i, oursLabel: label}
+		section := &c.ours
+		for i++; ; i++ {
+			if i == len(lines) {
+				return nil, fmt.Errorf("conflict at line %d has no end marker", c.start+1)
+			}
+			if _, ok := marker(lines[i], "|||||||"); ok && section == &c.ours {
+				section = &c.base
+				c.hasBase = true
+			} else if _, ok := marker(lines[i], "======="); ok && section != &c.theirs {
+				section = &c.theirs
+			} else if label, ok := marker(lines[i], ">>>>>>>"); ok && section == &c.theirs {
+				c.end = i
+				c.theirsLabel = label
+				break
+			} else if _, ok := marker(lines[i], "<<<<<<<"); ok {
+				return nil, fmt.Errorf("conflict at line %d has another starting inside it, at line %d", c.start+1, i+1)
+			} else {
+				*section += lines[i]
+			}
+		}
+		conflicts = append(conflicts, c)
+	}
+	return conflicts, nil
+}
+
+// hasConflictMarkers reports whether text still has a line that starts or
+// ends a conflict; ======= alone may be a Markdown heading's underline
+func hasConflictMarkers(text string) bool {
+	for _, line := range splitLines(text) {
+		for _, m := range []string{"<<<<<<<", ">>>>>>>"} {
+			if strings.HasPrefix(line, m) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// firstCodeBlock returns the content of the first fenced code block in a
+// reply, or the whole reply if it has none
+func firstCodeBlock(reply string) string {
+	lines := splitLines(reply)
+	for i, line := range lines {
+		trimmed := strings.TrimRight(line, "\r\n")
+		if !strings.HasPrefix(trimmed, "```") {
+			continue
+		}
+		fence := trimmed[:len(trimmed)-len(strings.TrimLeft(trimmed, "`"))]
+		var b strings.Builder
+		for _, line := range lines[i+1:] {
+			if strings.TrimRight(line, "\r\n") == fence {
+				return b.String()
+			}
+			b.WriteString(line)
+		}
+		return b.String()
+	}
+	return strings.TrimSpace(reply) + "\n"
+}
+
+// runResolve handles "wex resolve", which has the model resolve the
+// conflicts left by a merge, rebase or cherry-pick, file by file
+func runResolve(engine *Engine, args []string, w io.Writer) error {
+	resolveFlags := flag.NewFlagSet("resolve", flag.ExitOnError)
+	verify := resolveFlags.String("verify", "", "Command that must pass after each batch, e.g. \"go build ./...\"")
+	batchSize := resolveFlags.Int("batch", 0, "Files per batch (default all at once)")
+	retries := resolveFlags.Int("retries", 1, "Times to resolve a batch again when verification fails")
+	resolveFlags.Usage = func() {
+		fmt.Fprintf(resolveFlags.Output(), "Usage: wex [flags] resolve [--verify CMD] [--batch N] [--retries N] [path...]\n")
+		resolveFlags.PrintDefaults()
+	}
+	resolveFlags.Parse(args)
+
+	gitArgs := append([]string{"diff", "--name-only", "--diff-filter=U", "--relative", "--"}, resolveFlags.Args()...)
+	out, err := engine.git(gitArgs...)
+	if err != nil {
+		return fmt.Errorf("failed to list conflicted files: %v", err)
+	}
+	if out == "" {
+		return fmt.Errorf("no files have unresolved conflicts")
+	}
+	paths := strings.Split(out, "\n")
+	size := *batchSize
+	if size <= 0 {
+		size = len(paths)
+	}
+
+	ctx := context.Background()
+	var resolvedPaths []string
+	for len(paths) > 0 {
+		batch := paths[:min(size, len(paths))]
+		paths = paths[len(batch):]
+
+		// The conflicted files, kept to try again from
+		originals := make(map[string]string)
+		for _, path := range batch {
+			data, err := engine.readRaw(filepath.FromSlash(path))
+			if err != nil {
+				return err
+			}
+			originals[path], _ = decodeText(data)
+		}
+
+		feedback := ""
+		for attempt := 0; ; attempt++ {
+			for _, path := range batch {
+				text, n, err := engine.resolveFile(ctx, path, originals[path], feedback)
+				if err != nil {
+					return fmt.Errorf("%s: %v", path, err)
+				}
+				// Written as the file tools write, so the session's limits and
+				// policies apply
+				if err := engine.saveFile(filepath.FromSlash(path), text, ""); err != nil {
+					return fmt.Errorf("failed to write %s: %v", path, err)
+				}
+				plural := "s"
+				if n == 1 {
+					plural = ""
+				}
+				fmt.Fprintf(w, "Resolved %d conflict%s in %s\n", n, plural, path)
+			}
+			if *verify == "" {
+				break
+			}
+			passed, output := runCheck(engine.workspace, *verify)
+			if passed {
+				break
+			}
+			if attempt >= *retries {
+				fmt.Fprintf(w, "Verification failed:\n%s\n", output)
+				return fmt.Errorf("%s failed after resolving %s; the resolutions are left in place, unstaged, to be fixed by hand", *verify, strings.Join(batch, ", "))
+			}
+			fmt.Fprintf(w, "Verification failed; resolving %s again\n", strings.Join(batch, ", "))
+			feedback = fmt.Sprintf("`%s` failed after an earlier resolution of the conflicts in %s:\n\n%s\n%s\n%s\n",
+				*verify, strings.Join(batch, ", "), codeFence(output), output, codeFence(output))
+		}
+
+		if _, err := engine.git(append([]string{"add", "--"}, batch...)...); err != nil {
+			return fmt.Errorf("failed to mark %s resolved: %v", strings.Join(batch, ", "), err)
+		}
+		resolvedPaths = append(resolvedPaths, batch...)
+	}
+	fmt.Fprintf(w, "Resolved the conflicts in %s; review them with git diff --cached before continuing\n", strings.Join(resolvedPaths, ", "))
+	return nil
+}
+
+// resolveFile asks the model to resolve each conflict in a file in turn,
+// and returns the file with them resolved and how many there were
+func (e *Engine) resolveFile(ctx context.Context, path, text, feedback string) (string, int, error) {
+	lines := splitLines(text)
+	conflicts, err := parseConflicts(lines)
+	if err != nil {
+		return "", 0, err
+	}
+	if len(conflicts) == 0 {
+		return "", 0, fmt.Errorf("no conflict markers found")
+	}
+
+	var b strings.Builder
+	next := 0
+	for i, c := range conflicts {
+		e.logf("Resolving conflict %d of %d in %s, lines %d-%d", i+1, len(conflicts), path, c.start+1, c.end+1)
+		resolution, err := e.resolveConflict(ctx, path, lines, c, feedback)
+		if err != nil {
+			return "", 0, fmt.Errorf("conflict at line %d: %v", c.start+1, err)
+		}
+		for _, line := range lines[next:c.start] {
+			b.WriteString(line)
+		}
+		b.WriteString(resolution)
+		next = c.end + 1
+	}
+	for _, line := range lines[next:] {
+		b.WriteString(line)
+	}
+	return b.String(), len(conflicts), nil
+}
+
+// resolveConflict asks the model for the text to replace a conflict with,
+// asking once more if the reply still has conflict markers
+func (e *Engine) resolveConflict(ctx context.Context, path string, lines []string, c conflict, feedback string) (string, error) {
+	var region strings.Builder
+	for _, line := range lines[max(0, c.start-conflictContextLines):min(len(lines), c.end+1+conflictContextLines)] {
+		region.WriteString(line)
+	}
+	fence := codeFence(region.String())
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Resolve this merge conflict in %s, at lines %d to %d. ", path, c.start+1, c.end+1)
+	fmt.Fprintf(&b, "Between <<<<<<< and ======= is our side (%s), and between ======= and >>>>>>> is theirs (%s)", c.oursLabel, c.theirsLabel)
+	if c.hasBase {
+		b.WriteString("; between ||||||| and ======= is the common ancestor both sides changed")
+	}
+	fmt.Fprintf(&b, ". Here is the conflict with the code around it:\n\n%s\n%s%s\n\n", fence, region.String(), fence)
+	if feedback != "" {
+		b.WriteString(feedback + "\n")
+	}
+	b.WriteString("Keep the intent of both sides: combine the changes where they are independent, and where they really conflict, choose what fits the code around it. " +
+		"Reply with only the code that replaces the conflict, everything from the <<<<<<< line to the >>>>>>> line, in one code block, with no conflict markers.")
+
+	messages := []Message{{Role: "user", Content: b.String()}}
+	for attempt := 0; ; attempt++ {
+		reply, err := e.complete(ctx, messages)
+		if err != nil {
+			return "", err
+		}
+		resolution := firstCodeBlock(reply)
+		if strings.TrimSpace(resolution) == "" {
+			resolution = ""
+		}
+		if !hasConflictMarkers(resolution) {
+			return resolution, nil
+		}
+		if attempt == 1 {
+			return "", fmt.Errorf("the model's resolution still has conflict markers")
+		}
+		messages = append(messages,
+			Message{Role: "assistant", Content: reply},
+			Message{Role: "user", Content: "That still has conflict markers. Reply with only the resolved code, with no <<<<<<<, ======= or >>>>>>> lines."})
+	}
+}
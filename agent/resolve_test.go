@@ -0,0 +1,100 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseConflicts(t *testing.T) {
+	lines := splitLines("a\n<<<<<<< HEAD\nours\n||||||| base\nold\n=======\ntheirs\n>>>>>>> feature\nb\n<<<<<<< HEAD\n=======\nx\n>>>>>>> feature\n")
+	conflicts, err := parseConflicts(lines)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conflicts) != 2 {
+		t.Fatalf("%d conflicts", len(conflicts))
+	}
+	c := conflicts[0]
+	if c.start != 1 || c.end != 7 || c.ours != "ours\n" || c.base != "old\n" || c.theirs != "theirs\n" || !c.hasBase || c.oursLabel != "HEAD" || c.theirsLabel != "feature" {
+		t.Errorf("first conflict: %+v", c)
+	}
+	if c := conflicts[1]; c.start != 9 || c.ours != "" || c.theirs != "x\n" || c.hasBase {
+		t.Errorf("second conflict: %+v", c)
+	}
+
+	if _, err := parseConflicts(splitLines("<<<<<<< HEAD\nours\n=======\n")); err == nil {
+		t.Error("no error for a conflict with no end")
+	}
+	if got := firstCodeBlock("Here:\n\n````go\nx := 1\n```\n````\nDone."); got != "x := 1\n```\n" {
+		t.Errorf("firstCodeBlock = %q", got)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	e, provider, _ := newTestEngine(t, []ChatResponse{
+		reply("```\nlimit := 20\n```"),
+		reply("```\nlimit := 20 // bad\n```"),
+		reply("```\nlimit := 20\nretries := 3\n```"),
+	})
+	git := func(args ...string) string {
+		out, err := gitIn(e.workspace, append([]string{"-c", "user.name=t", "-c", "user.email=t@t"}, args...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(out)
+	}
+	git("init", "--quiet", "--initial-branch=main")
+	writeTestFile(t, e, "config.go", "package config\n\nfunc defaults() {\n\tlimit := 10\n}\n")
+	git("add", "--all")
+	git("commit", "--quiet", "-m", "base")
+	git("checkout", "--quiet", "-b", "feature")
+	writeTestFile(t, e, "config.go", "package config\n\nfunc defaults() {\n\tlimit := 20\n}\n")
+	git("commit", "--quiet", "-am", "Raise the limit")
+	git("checkout", "--quiet", "main")
+	writeTestFile(t, e, "config.go", "package config\n\nfunc defaults() {\n\tlimit := 10\n\tretries := 3\n}\n")
+	git("commit", "--quiet", "-am", "Add retries")
+	if _, err := gitIn(e.workspace, "-c", "user.name=t", "-c", "user.email=t@t", "merge", "--quiet", "feature"); err == nil {
+		t.Fatal("the merge did not conflict")
+	}
+
+	// Resolutions are written as the file tools write, so a read-only
+	// workspace is left alone
+	var out strings.Builder
+	files := e.filesystem
+	e.filesystem = readOnlyFS{e.files()}
+	if err := runResolve(e, nil, &out); err == nil || !strings.Contains(err.Error(), "read-only") {
+		t.Errorf("resolving in a read-only workspace gave %v", err)
+	}
+	e.filesystem = files
+	if unmerged := git("diff", "--name-only", "--diff-filter=U"); unmerged != "config.go" {
+		t.Errorf("unmerged after a read-only run: %q", unmerged)
+	}
+
+	out.Reset()
+	if err := runResolve(e, []string{"--verify", "! grep -q bad config.go"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	request := provider.lastMessages(t, 2)[0].Content
+	if !strings.Contains(request, "at lines 4 to 9") || !strings.Contains(request, "our side (HEAD)") || !strings.Contains(request, "theirs (feature)") ||
+		!strings.Contains(request, "\tretries := 3\n=======\n") {
+		t.Errorf("request:\n%s", request)
+	}
+	if retry := provider.lastMessages(t, 3)[0].Content; !strings.Contains(retry, "`! grep -q bad config.go` failed") {
+		t.Errorf("retry request:\n%s", retry)
+	}
+	data, err := os.ReadFile(filepath.Join(e.workspace, "config.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "package config\n\nfunc defaults() {\nlimit := 20\nretries := 3\n}\n"; string(data) != want {
+		t.Errorf("config.go:\n%s", data)
+	}
+	if unmerged := git("diff", "--name-only", "--diff-filter=U"); unmerged != "" {
+		t.Errorf("still unmerged: %q", unmerged)
+	}
+	if !strings.Contains(out.String(), "Verification failed; resolving config.go again") || !strings.Contains(out.String(), "Resolved the conflicts in config.go;") {
+		t.Errorf("output:\n%s", out.String())
+	}
+}
@@ -0,0 +1,129 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"time"
+)
+
+// A dropped connection or a 500 from the model server is usually over in a
+// moment, so rather than end the session, requests to the built-in
+// providers are tried again, waiting twice as long each time, with jitter
+// so that several sessions on one server don't all come back at once.
+// Errors the server means, such as a 404 for a model it doesn't have, are
+// returned at once.
+
+// defaultMaxAttempts is how many times a request is tried, unless
+// REQUEST_ATTEMPTS or WithMaxAttempts says otherwise
+const defaultMaxAttempts = 4
+
+// The first wait between attempts, and the longest; variables so tests
+// needn't wait
+var (
+	retryBaseDelay = time.Second
+	retryMaxDelay  = 30 * time.Second
+)
+
+// requestError is an error from a request to the model server, which may be
+// worth trying again
+type requestError struct {
+	msg       string
+	transient bool
+}
+
+func (e *requestError) Error() string {
+	return e.msg
+}
+
+// sendError is the error for a request that got no reply; unless it was
+// cancelled, the connection failed, which is worth trying again
+func sendError(ctx context.Context, msg string, err error) error {
+	return &requestError{msg: fmt.Sprintf("%s: %v", msg, err), transient: ctx.Err() == nil}
+}
+
+// statusError is the error for a reply with a status other than 200. Too
+// many requests, and the server's own errors, are worth trying again.
+func statusError(status int, body []byte) error {
+	return &requestError{
+		msg:       fmt.Sprintf("API request failed with status %d: %s", status, string(body)),
+		transient: status == http.StatusTooManyRequests || status >= 500 && status != http.StatusNotImplemented,
+	}
+}
+
+// decodeError is the error for a reply that couldn't be decoded; JSON that
+// is wrong is wrong every time, but a reply cut short may not be
+func decodeError(msg string, err error) error {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	return &requestError{
+		msg:       fmt.Sprintf("%s: %v", msg, err),
+		transient: !errors.As(err, &syntaxErr) && !errors.As(err, &typeErr),
+	}
+}
+
+// isTransient reports whether an error is worth trying again
+func isTransient(err error) bool {
+	var reqErr *requestError
+	return errors.As(err, &reqErr) && reqErr.transient
+}
+
+// retryDelay is how long to wait before another attempt, after the given
+// number of failed ones: a random time between half and all of the base
+// delay, doubled for each failure, up to the longest delay
+func retryDelay(failures int) time.Duration {
+	delay := retryMaxDelay
+	if failures <= 30 {
+		delay = min(retryBaseDelay<<(failures-1), retryMaxDelay)
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// retry calls f until it succeeds, fails for good, or has been tried
+// maxAttempts times
+func retry(ctx context.Context, maxAttempts int, logf func(format string, args ...interface{}), f func() error) error {
+	for failures := 1; ; failures++ {
+		err := f()
+		if err == nil || failures >= maxAttempts || !isTransient(err) {
+			return err
+		}
+		delay := retryDelay(failures)
+		logf("Request failed, trying again in %s (attempt %d of %d): %v", delay.Round(time.Millisecond), failures+1, maxAttempts, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// retryProvider tries a provider's requests again when they fail in a way
+// that may not last
+type retryProvider struct {
+	Provider
+	maxAttempts int
+	logf        func(format string, args ...interface{})
+}
+
+func (p *retryProvider) SendChat(ctx context.Context, req ChatRequest) (*ChatResponse, error) {
+	var resp *ChatResponse
+	err := retry(ctx, p.maxAttempts, p.logf, func() error {
+		var err error
+		resp, err = p.Provider.SendChat(ctx, req)
+		return err
+	})
+	return resp, err
+}
+
+func (p *retryProvider) ListModels(ctx context.Context) ([]Model, error) {
+	var models []Model
+	err := retry(ctx, p.maxAttempts, p.logf, func() error {
+		var err error
+		models, err = p.Provider.ListModels(ctx)
+		return err
+	})
+	return models, err
+}
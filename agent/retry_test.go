@@ -0,0 +1,81 @@
+package agent
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetry(t *testing.T) {
+	base, max := retryBaseDelay, retryMaxDelay
+	retryBaseDelay, retryMaxDelay = time.Millisecond, 4*time.Millisecond
+	t.Cleanup(func() { retryBaseDelay, retryMaxDelay = base, max })
+
+	// The server lists its models at the second try, and answers the chat
+	// after a dropped connection and a 500
+	var tags, chats int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/tags":
+			if tags++; tags == 1 {
+				http.Error(w, "starting up", http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte(`{"models": [{"name": "flaky:1b"}]}`))
+		case "/api/chat":
+			switch chats++; chats {
+			case 1:
+				conn, _, _ := w.(http.Hijacker).Hijack()
+				conn.Close()
+			case 2:
+				http.Error(w, "out of memory", http.StatusInternalServerError)
+			default:
+				w.Write([]byte(`{"message": {"role": "assistant", "content": "Hello"}, "done": true}`))
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	var logs []string
+	e, err := New(WithWorkspace(t.TempDir()), WithProvider(nil, srv.URL, ""), WithSystemPrompt("Test."),
+		WithEvents(func(event Event) {
+			if event.Type == EventLog && strings.HasPrefix(event.Text, "Request failed") {
+				logs = append(logs, event.Text)
+			}
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.model != "flaky:1b" {
+		t.Errorf("model %q", e.model)
+	}
+	result, err := e.Run(t.Context(), "Say hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Reply != "Hello" || chats != 3 || len(logs) != 3 || !strings.Contains(logs[2], "(attempt 3 of 4): API request failed with status 500") {
+		t.Errorf("reply %q after %d chats, logged:\n%s", result.Reply, chats, strings.Join(logs, "\n"))
+	}
+
+	// A model the server doesn't have is not tried again, and nor is anything
+	// after the last attempt
+	e.ollamaURL = srv.URL + "/missing"
+	if _, err := e.getFirstAvailableModel(); err == nil || !strings.Contains(err.Error(), "status 404") || len(logs) != 3 {
+		t.Errorf("404 gave %v, after %d retries", err, len(logs)-3)
+	}
+	e.ollamaURL, e.maxAttempts, tags = srv.URL, 1, 0
+	if _, err := e.getFirstAvailableModel(); err == nil || !strings.Contains(err.Error(), "status 503") {
+		t.Errorf("one attempt gave %v", err)
+	}
+
+	for failures := 1; failures <= 40; failures++ {
+		want := min(time.Millisecond<<min(failures-1, 30), 4*time.Millisecond)
+		if d := retryDelay(failures); d < want/2 || d > want {
+			t.Errorf("delay %s after %d failures, want %s to %s", d, failures, want/2, want)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A ReviewQueue lets a team approve actions for sessions running in a
+// shared server, such as wex serve. Each session's approver puts its
+// request in the queue and waits; any authorized reviewer can approve or
+// deny it, and every decision is kept with who made it. The queue is
+// driven from Go, or over HTTP through Handler.
+type ReviewQueue struct {
+	// Timeout, if set, denies a request nobody has decided in time
+	Timeout time.Duration
+
+	// OnRequest, if set, is called with each request as it is queued, such
+	// as to offer it to reviewers in a chat; it must not block
+	OnRequest func(ReviewRequest)
+
+	mu        sync.Mutex
+	nextID    int
+	pending   map[int]*pendingReview
+	audit     []ReviewDecision
+	reviewers map[string]bool
+}
+
+// ReviewRequest is an action waiting for a decision. A tool call, from
+// CallApprover, also has the tool and its arguments, which a reviewer may
+// change when approving it.
+type ReviewRequest struct {
+	ID        int             `json:"id"`
+	Session   string          `json:"session"`
+	Action    string          `json:"action"`
+	Tool      string          `json:"tool,omitempty"`
+	Args      json.RawMessage `json:"args,omitempty"`
+	Requested time.Time       `json:"requested"`
+}
+
+// ReviewDecision records who decided a request, and how; EditedArgs are
+// the arguments a tool call was approved with, if the reviewer changed them
+type ReviewDecision struct {
+	ReviewRequest
+	Reviewer   string          `json:"reviewer"`
+	Approved   bool            `json:"approved"`
+	EditedArgs json.RawMessage `json:"edited_args,omitempty"`
+	Decided    time.Time       `json:"decided"`
+}
+
+type pendingReview struct {
+	request  ReviewRequest
+	decision chan reviewOutcome
+}
+
+type reviewOutcome struct {
+	approved bool
+	args     json.RawMessage
+}
+
+// The reviewers recorded when a request times out, or its session stops
+// waiting for it
+const (
+	reviewTimeout   = "(timeout)"
+	reviewCancelled = "(cancelled)"
+)
+
+var (
+	errUnknownReview = errors.New("no pending request with that id")
+	errNotReviewer   = errors.New("not an authorized reviewer")
+	errNotToolCall   = errors.New("only a tool call's arguments can be changed")
+	errBadArgs       = errors.New("arguments must be a JSON object")
+)
+
+// NewReviewQueue makes a queue whose requests the named reviewers may
+// decide; with none named, anyone may
+func NewReviewQueue(reviewers ...string) *ReviewQueue {
+	q := &ReviewQueue{
+		pending:   make(map[int]*pendingReview),
+		reviewers: make(map[string]bool),
+	}
+	for _, reviewer := range reviewers {
+		q.reviewers[reviewer] = true
+	}
+	return q
+}
+
+// Approver returns an approver for WithApprover that queues the session's
+// requests and waits for a decision. When the context is cancelled, a
+// request still waiting is denied.
+func (q *ReviewQueue) Approver(ctx context.Context, session string) func(action string) bool {
+	return func(action string) bool {
+		return q.wait(ctx, ReviewRequest{Session: session, Action: action}).approved
+	}
+}
+
+// CallApprover returns a call approver for WithCallApprover that queues the
+// session's tool calls, with their arguments, and waits for a decision, as
+// Approver does. A reviewer may change the arguments when approving a call,
+// and the tool is called with theirs.
+func (q *ReviewQueue) CallApprover(ctx context.Context, session string) func(tool string, args json.RawMessage) (json.RawMessage, bool) {
+	return func(tool string, args json.RawMessage) (json.RawMessage, bool) {
+		outcome := q.wait(ctx, ReviewRequest{
+			Session: session,
+			Action:  fmt.Sprintf("Call %s: %s", tool, args),
+			Tool:    tool,
+			Args:    args,
+		})
+		if outcome.args != nil {
+			return outcome.args, outcome.approved
+		}
+		return args, outcome.approved
+	}
+}
+
+// wait queues a request and waits for its outcome
+func (q *ReviewQueue) wait(ctx context.Context, request ReviewRequest) reviewOutcome {
+	q.mu.Lock()
+	q.nextID++
+	request.ID = q.nextID
+	request.Requested = time.Now()
+	p := &pendingReview{request: request, decision: make(chan reviewOutcome, 1)}
+	q.pending[request.ID] = p
+	timeout, onRequest := q.Timeout, q.OnRequest
+	q.mu.Unlock()
+	if onRequest != nil {
+		onRequest(request)
+	}
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	reviewer := reviewTimeout
+	select {
+	case outcome := <-p.decision:
+		return outcome
+	case <-expired:
+	case <-ctx.Done():
+		reviewer = reviewCancelled
+	}
+	if q.decide(request.ID, reviewer, false, nil) == nil {
+		return reviewOutcome{}
+	}
+	// A reviewer got there first
+	return <-p.decision
+}
+
+// Pending returns the requests waiting for a decision, oldest first
+func (q *ReviewQueue) Pending() []ReviewRequest {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var requests []ReviewRequest
+	for _, p := range q.pending {
+		requests = append(requests, p.request)
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		return requests[i].ID < requests[j].ID
+	})
+	return requests
+}
+
+// Decide approves or denies a pending request on behalf of a reviewer
+func (q *ReviewQueue) Decide(id int, reviewer string, approve bool) error {
+	return q.DecideArgs(id, reviewer, approve, nil)
+}
+
+// DecideArgs is Decide, but approving a tool call with args, a JSON object,
+// in place of the arguments it was requested with; nil args leave them as
+// they were
+func (q *ReviewQueue) DecideArgs(id int, reviewer string, approve bool, args json.RawMessage) error {
+	if reviewer == "" || reviewer == reviewTimeout || reviewer == reviewCancelled || len(q.reviewers) > 0 && !q.reviewers[reviewer] {
+		return errNotReviewer
+	}
+	if args != nil {
+		var object map[string]interface{}
+		if json.Unmarshal(args, &object) != nil || object == nil {
+			return errBadArgs
+		}
+		var compact bytes.Buffer
+		json.Compact(&compact, args)
+		args = compact.Bytes()
+	}
+	return q.decide(id, reviewer, approve, args)
+}
+
+func (q *ReviewQueue) decide(id int, reviewer string, approve bool, args json.RawMessage) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	p, ok := q.pending[id]
+	if !ok {
+		return errUnknownReview
+	}
+	if args != nil && p.request.Tool == "" {
+		return errNotToolCall
+	}
+	if !approve || bytes.Equal(args, p.request.Args) {
+		args = nil
+	}
+	delete(q.pending, id)
+	q.audit = append(q.audit, ReviewDecision{
+		ReviewRequest: p.request,
+		Reviewer:      reviewer,
+		Approved:      approve,
+		EditedArgs:    args,
+		Decided:       time.Now(),
+	})
+	p.decision <- reviewOutcome{approve, args}
+	return nil
+}
+
+// Audit returns every decision made, in order
+func (q *ReviewQueue) Audit() []ReviewDecision {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]ReviewDecision(nil), q.audit...)
+}
+
+// Handler serves the queue over HTTP: GET /pending and GET /audit list
+// requests and decisions as JSON, and POST /decide takes
+// {"id": 1, "approve": true}, with "args" to approve a tool call with
+// changed arguments. identify says which reviewer made a request,
+// from whatever authentication the server uses, or false to refuse it.
+func (q *ReviewQueue) Handler(identify func(r *http.Request) (string, bool)) http.Handler {
+	mux := http.NewServeMux()
+	authorized := func(w http.ResponseWriter, r *http.Request) (string, bool) {
+		reviewer, ok := identify(r)
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+		}
+		return reviewer, ok
+	}
+	writeJSON := func(w http.ResponseWriter, v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	}
+
+	mux.HandleFunc("GET /pending", func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := authorized(w, r); ok {
+			writeJSON(w, q.Pending())
+		}
+	})
+	mux.HandleFunc("GET /audit", func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := authorized(w, r); ok {
+			writeJSON(w, q.Audit())
+		}
+	})
+	mux.HandleFunc("POST /decide", func(w http.ResponseWriter, r *http.Request) {
+		reviewer, ok := authorized(w, r)
+		if !ok {
+			return
+		}
+		var body struct {
+			ID      int             `json:"id"`
+			Approve *bool           `json:"approve"`
+			Args    json.RawMessage `json:"args"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Approve == nil {
+			http.Error(w, `expected {"id": N, "approve": true|false, "args": {...}}`, http.StatusBadRequest)
+			return
+		}
+		if string(body.Args) == "null" {
+			body.Args = nil
+		}
+		switch err := q.DecideArgs(body.ID, reviewer, *body.Approve, body.Args); {
+		case errors.Is(err, errNotReviewer):
+			http.Error(w, fmt.Sprintf("%s is %v", reviewer, err), http.StatusForbidden)
+		case errors.Is(err, errUnknownReview):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, errNotToolCall), errors.Is(err, errBadArgs):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			writeJSON(w, map[string]interface{}{"id": body.ID, "approved": *body.Approve, "reviewer": reviewer})
+		}
+	})
+	return mux
+}
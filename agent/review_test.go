@@ -0,0 +1,177 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReviewQueue(t *testing.T) {
+	q := NewReviewQueue("alice", "bob")
+	e, _, _ := newTestEngine(t, nil, WithApprover(q.Approver(t.Context(), "session-1")))
+	done := make(chan bool)
+	go func() {
+		done <- e.askApproval("Run rm -rf build")
+	}()
+
+	var pending []ReviewRequest
+	for deadline := time.Now().Add(10 * time.Second); len(pending) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("no request reached the queue")
+		}
+		time.Sleep(10 * time.Millisecond)
+		pending = q.Pending()
+	}
+	if pending[0].Session != "session-1" || !strings.Contains(pending[0].Action, "rm -rf build") {
+		t.Errorf("pending %+v", pending)
+	}
+
+	server := httptest.NewServer(q.Handler(func(r *http.Request) (string, bool) {
+		user := r.Header.Get("X-User")
+		return user, user != ""
+	}))
+	defer server.Close()
+	decide := func(user, body string) int {
+		req, _ := http.NewRequest("POST", server.URL+"/decide", strings.NewReader(body))
+		if user != "" {
+			req.Header.Set("X-User", user)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	id := `{"id": ` + strconv.Itoa(pending[0].ID) + `, "approve": false}`
+	for _, test := range []struct {
+		user, body string
+		want       int
+	}{
+		{"", id, http.StatusUnauthorized},
+		{"mallory", id, http.StatusForbidden},
+		{"bob", `{"id": 99, "approve": true}`, http.StatusNotFound},
+		{"bob", `{"id": 1}`, http.StatusBadRequest},
+		{"bob", id, http.StatusOK},
+		{"alice", id, http.StatusNotFound},
+	} {
+		if got := decide(test.user, test.body); got != test.want {
+			t.Errorf("%s posting %s got status %d, want %d", test.user, test.body, got, test.want)
+		}
+	}
+	if <-done {
+		t.Error("denied action was approved")
+	}
+
+	req, _ := http.NewRequest("GET", server.URL+"/audit", nil)
+	req.Header.Set("X-User", "alice")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var audit []ReviewDecision
+	json.NewDecoder(resp.Body).Decode(&audit)
+	if len(audit) != 1 || audit[0].Reviewer != "bob" || audit[0].Approved || audit[0].Session != "session-1" {
+		t.Errorf("audit %+v", audit)
+	}
+}
+
+func TestReviewQueueTimeout(t *testing.T) {
+	q := NewReviewQueue()
+	q.Timeout = 20 * time.Millisecond
+	if q.Approver(t.Context(), "s")("delete everything") {
+		t.Error("approved with nobody reviewing")
+	}
+	if audit := q.Audit(); len(audit) != 1 || audit[0].Reviewer != reviewTimeout || len(q.Pending()) != 0 {
+		t.Errorf("audit %+v", audit)
+	}
+	if err := q.Decide(1, reviewTimeout, true); err != errNotReviewer {
+		t.Errorf("deciding as the timeout returned %v", err)
+	}
+}
+
+func TestReviewQueueCancelled(t *testing.T) {
+	q := NewReviewQueue()
+	ctx, cancel := context.WithCancel(t.Context())
+	approved := make(chan bool)
+	go func() { approved <- q.Approver(ctx, "s")("delete everything") }()
+	for len(q.Pending()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if <-approved {
+		t.Error("approved after the session stopped waiting")
+	}
+	if audit := q.Audit(); len(audit) != 1 || audit[0].Reviewer != reviewCancelled || len(q.Pending()) != 0 {
+		t.Errorf("audit %+v", audit)
+	}
+}
+
+func TestReviewQueueEditedCall(t *testing.T) {
+	q := NewReviewQueue()
+	e, provider, _ := newTestEngine(t, []ChatResponse{
+		reply("", call("run_command", `{"command": "curl -s https://example.com/x"}`)),
+		reply("Done"),
+	}, WithApprover(q.Approver(t.Context(), "s1")), WithCallApprover(q.CallApprover(t.Context(), "s1")))
+	e.commandPolicy = map[commandClass]string{classNetwork: policyAsk}
+	done := make(chan error)
+	go func() {
+		_, err := e.Run(t.Context(), "Fetch x")
+		done <- err
+	}()
+	for len(q.Pending()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	request := q.Pending()[0]
+	if request.Tool != "run_command" || string(request.Args) != `{"command":"curl -s https://example.com/x"}` {
+		t.Errorf("request %+v", request)
+	}
+
+	server := httptest.NewServer(q.Handler(func(r *http.Request) (string, bool) { return "alice", true }))
+	defer server.Close()
+	decide := func(body string) int {
+		resp, err := http.Post(server.URL+"/decide", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	id := strconv.Itoa(request.ID)
+	if status := decide(`{"id": ` + id + `, "approve": true, "args": ["echo"]}`); status != http.StatusBadRequest {
+		t.Errorf("arguments that aren't an object got %d", status)
+	}
+	if status := decide(`{"id": ` + id + `, "approve": true, "args": {"command": "echo edited"}}`); status != http.StatusOK {
+		t.Errorf("edited arguments got %d", status)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	results := toolResults(provider.lastMessages(t, 2))
+	if len(results) != 1 || !strings.HasPrefix(results[0].Content, `The user changed the arguments before approving the call, to: {"command":"echo edited"}`) {
+		t.Errorf("tool results %+v", results)
+	}
+	if audit := q.Audit(); len(audit) != 1 || !audit[0].Approved || string(audit[0].EditedArgs) != `{"command":"echo edited"}` {
+		t.Errorf("audit %+v", audit)
+	}
+
+	// Only a tool call's arguments can be changed
+	approved := make(chan bool)
+	go func() { approved <- q.Approver(t.Context(), "s1")("run make") }()
+	for len(q.Pending()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	id = strconv.Itoa(q.Pending()[0].ID)
+	if status := decide(`{"id": ` + id + `, "approve": true, "args": {"command": "make"}}`); status != http.StatusBadRequest {
+		t.Errorf("arguments for an action got %d", status)
+	}
+	if status := decide(`{"id": ` + id + `, "approve": true}`); status != http.StatusOK || !<-approved {
+		t.Errorf("approving the action got %d", status)
+	}
+}
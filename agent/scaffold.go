@@ -0,0 +1,154 @@
+package agent
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// scaffolds holds a project skeleton per stack, as templates ending in
+// .tmpl; a directory named __package__ becomes the package name
+//
+//go:embed all:scaffolds
+var scaffolds embed.FS
+
+// scaffoldData holds the variables available to scaffold templates
+type scaffoldData struct {
+	Name    string // project name, e.g. my-tool
+	Module  string // Go module path
+	Package string // Python package name, e.g. my_tool
+}
+
+var projectName = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_.-]*$`)
+
+// scaffoldStacks lists the available stacks
+func scaffoldStacks() []string {
+	entries, _ := scaffolds.ReadDir("scaffolds")
+	var stacks []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			stacks = append(stacks, entry.Name())
+		}
+	}
+	sort.Strings(stacks)
+	return stacks
+}
+
+func scaffoldTool() Tool {
+	return Tool{
+		Type: "function",
+		Function: Function{
+			Name:        "scaffold_project",
+			Description: "Create a project skeleton with a standard layout, build file, README and a first test. Use this for requests to create a new project",
+			Parameters: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"stack": map[string]interface{}{
+						"type":        "string",
+						"enum":        scaffoldStacks(),
+						"description": "Kind of project",
+					},
+					"name": map[string]interface{}{
+						"type":        "string",
+						"description": "Project name, e.g. my-tool",
+					},
+					"path": map[string]interface{}{
+						"type":        "string",
+						"description": "Directory to create the project in (optional, default the project name; use \".\" for the workspace root)",
+					},
+					"module": map[string]interface{}{
+						"type":        "string",
+						"description": "Go module path (optional, default the project name)",
+					},
+				},
+				"required": []string{"stack", "name"},
+			},
+		},
+	}
+}
+
+func (e *Engine) scaffoldProject(args json.RawMessage) (string, error) {
+	var params struct {
+		Stack  string `json:"stack"`
+		Name   string `json:"name"`
+		Path   string `json:"path"`
+		Module string `json:"module"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return "", fmt.Errorf("invalid arguments: %v", err)
+	}
+
+	root := "scaffolds/" + params.Stack
+	if _, err := fs.Stat(scaffolds, root); err != nil || params.Stack == "" {
+		return "", fmt.Errorf("unknown stack %q: must be one of %s", params.Stack, strings.Join(scaffoldStacks(), ", "))
+	}
+	if !projectName.MatchString(params.Name) {
+		return "", fmt.Errorf("invalid project name %q: use letters, digits, '-', '_' and '.', starting with a letter", params.Name)
+	}
+	if params.Path == "" {
+		params.Path = params.Name
+	}
+	if params.Module == "" {
+		params.Module = params.Name
+	}
+	data := scaffoldData{
+		Name:    params.Name,
+		Module:  params.Module,
+		Package: strings.NewReplacer("-", "_", ".", "_").Replace(strings.ToLower(params.Name)),
+	}
+
+	// Render everything, and check nothing would be overwritten, before
+	// writing anything
+	files := make(map[string]string)
+	var names, existing []string
+	err := fs.WalkDir(scaffolds, root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		text, err := scaffolds.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		tmpl, err := template.New(p).Parse(string(text))
+		if err != nil {
+			return fmt.Errorf("invalid template %s: %v", p, err)
+		}
+		var b strings.Builder
+		if err := tmpl.Execute(&b, data); err != nil {
+			return fmt.Errorf("failed to expand %s: %v", p, err)
+		}
+
+		rel := strings.TrimSuffix(strings.TrimPrefix(p, root+"/"), ".tmpl")
+		rel = strings.ReplaceAll(rel, "__package__", data.Package)
+		name := path.Join(params.Path, rel)
+		files[name] = b.String()
+		names = append(names, name)
+
+		if fullPath, err := e.resolvePath(name); err == nil {
+			if _, err := e.files().Stat(fullPath); err == nil {
+				existing = append(existing, name)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(existing) > 0 {
+		return "", fmt.Errorf("not creating the project, since these files already exist: %s", strings.Join(existing, ", "))
+	}
+
+	sort.Strings(names)
+	for _, name := range names {
+		if err := e.saveFile(name, files[name], ""); err != nil {
+			return "", fmt.Errorf("failed to write %s: %v", name, err)
+		}
+	}
+	return fmt.Sprintf("Created %s project %s with these files:\n%s", params.Stack, params.Name, strings.Join(names, "\n")), nil
+}
@@ -0,0 +1,415 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Recurring tasks, such as updating dependencies every Monday, are kept in
+// the workspace's schedule, each with a cron expression for when it runs
+// and the request to run. wex schedule adds, lists and removes them, and
+// wex serve runs them, reading the schedule again each minute, so it takes
+// changes without being restarted. Each run is a session like those a
+// client starts, which can be followed and carried on over the API.
+
+// scheduleFile is where a workspace's recurring tasks are kept
+const scheduleFile = ".wex-schedule.json"
+
+// scheduledTask is a request run at the times its cron expression says
+type scheduledTask struct {
+	Name    string `json:"name"`
+	Cron    string `json:"cron"`
+	Message string `json:"message"`
+
+	// User is who the task runs as on a server with users
+	User string `json:"user,omitempty"`
+}
+
+type taskSchedule struct {
+	Tasks []*scheduledTask `json:"tasks"`
+}
+
+// loadSchedule reads a schedule file; a missing file is an empty schedule
+func loadSchedule(path string) (*taskSchedule, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &taskSchedule{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var schedule taskSchedule
+	if err := json.Unmarshal(data, &schedule); err != nil {
+		return nil, fmt.Errorf("invalid schedule %s: %v", path, err)
+	}
+	for _, task := range schedule.Tasks {
+		if _, err := parseCron(task.Cron); err != nil {
+			return nil, fmt.Errorf("invalid schedule %s: task %s: %v", path, task.Name, err)
+		}
+	}
+	return &schedule, nil
+}
+
+// save writes the schedule to a new temporary file beside it and renames
+// it into place, so a server reading it never sees half of it, and two
+// writers don't collide
+func (s *taskSchedule) save(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal schedule: %v", err)
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to write schedule: %v", err)
+	}
+	_, err = f.Write(append(data, '\n'))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to write schedule: %v", err)
+	}
+	return nil
+}
+
+func (s *taskSchedule) find(name string) int {
+	for i, task := range s.Tasks {
+		if task.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// runSchedule handles "wex schedule", which adds, lists and removes the
+// workspace's recurring tasks
+func runSchedule(workspace string, args []string, w io.Writer) error {
+	scheduleFlags := flag.NewFlagSet("schedule", flag.ExitOnError)
+	name := scheduleFlags.String("name", "", "Name of the task to add (default task1, task2 and so on)")
+	user := scheduleFlags.String("user", "", "User of wex serve --users the task runs as")
+	scheduleFlags.Usage = func() {
+		fmt.Fprintf(scheduleFlags.Output(), "Usage: wex schedule add [--name NAME] [--user USER] CRON REQUEST\n")
+		fmt.Fprintf(scheduleFlags.Output(), "       wex schedule list\n")
+		fmt.Fprintf(scheduleFlags.Output(), "       wex schedule remove NAME\n")
+		fmt.Fprintf(scheduleFlags.Output(), "CRON is five fields, minute hour day month weekday, such as \"0 9 * * mon\", or @hourly, @daily, @weekly, @monthly or @yearly\n")
+		scheduleFlags.PrintDefaults()
+	}
+	if len(args) == 0 {
+		scheduleFlags.Usage()
+		return fmt.Errorf("expected add, list or remove")
+	}
+	command := args[0]
+	scheduleFlags.Parse(args[1:])
+
+	path := filepath.Join(workspace, scheduleFile)
+	schedule, err := loadSchedule(path)
+	if err != nil {
+		return err
+	}
+	switch command {
+	case "add":
+		if scheduleFlags.NArg() < 2 {
+			return fmt.Errorf("expected a cron expression and a request")
+		}
+		cron := scheduleFlags.Arg(0)
+		if _, err := parseCron(cron); err != nil {
+			return err
+		}
+		message := strings.Join(scheduleFlags.Args()[1:], " ")
+		if *name == "" {
+			for i := 1; *name == "" || schedule.find(*name) >= 0; i++ {
+				*name = "task" + strconv.Itoa(i)
+			}
+		} else if schedule.find(*name) >= 0 {
+			return fmt.Errorf("there is already a task named %s", *name)
+		}
+		schedule.Tasks = append(schedule.Tasks, &scheduledTask{Name: *name, Cron: cron, Message: message, User: *user})
+		if err := schedule.save(path); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "Added %s, next run %s\n", *name, nextCronRun(cron, time.Now()))
+	case "list":
+		if len(schedule.Tasks) == 0 {
+			fmt.Fprintf(w, "No tasks are scheduled\n")
+		}
+		for _, task := range schedule.Tasks {
+			fmt.Fprintf(w, "%s  %s  next run %s", task.Name, task.Cron, nextCronRun(task.Cron, time.Now()))
+			if task.User != "" {
+				fmt.Fprintf(w, "  as %s", task.User)
+			}
+			fmt.Fprintf(w, "\n  %s\n", task.Message)
+		}
+	case "remove":
+		if scheduleFlags.NArg() != 1 {
+			return fmt.Errorf("expected the name of the task to remove")
+		}
+		i := schedule.find(scheduleFlags.Arg(0))
+		if i < 0 {
+			return fmt.Errorf("no task is named %s", scheduleFlags.Arg(0))
+		}
+		schedule.Tasks = append(schedule.Tasks[:i], schedule.Tasks[i+1:]...)
+		if err := schedule.save(path); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "Removed %s\n", scheduleFlags.Arg(0))
+	default:
+		scheduleFlags.Usage()
+		return fmt.Errorf("unknown schedule command %q; expected add, list or remove", command)
+	}
+	return nil
+}
+
+// nextCronRun describes when a cron expression next matches after a time
+func nextCronRun(expr string, after time.Time) string {
+	cron, err := parseCron(expr)
+	if err != nil {
+		return "never"
+	}
+	next, ok := cron.next(after)
+	if !ok {
+		return "never"
+	}
+	return next.Format("Mon 2006-01-02 15:04")
+}
+
+// runScheduled starts the workspace's tasks that are due, at the start of
+// each minute, until the server stops. A task whose last run is still
+// going is not started again.
+func (s *agentServer) runScheduled(ctx context.Context, path string) {
+	running := make(map[string]string)
+	for {
+		now := time.Now()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(now.Truncate(time.Minute).Add(time.Minute).Sub(now)):
+		}
+		s.startDue(time.Now().Truncate(time.Minute), path, running)
+	}
+}
+
+// startDue starts the tasks in the schedule that are due at a minute,
+// recording the session each runs as
+func (s *agentServer) startDue(minute time.Time, path string, running map[string]string) {
+	schedule, err := loadSchedule(path)
+	if err != nil {
+		s.logf("Scheduled tasks: %v", err)
+		return
+	}
+	for _, task := range schedule.Tasks {
+		cron, _ := parseCron(task.Cron)
+		if !cron.matches(minute) {
+			continue
+		}
+		s.mu.Lock()
+		session := s.sessions[running[task.Name]]
+		busy := session != nil && session.status.Status == agentRunning
+		s.mu.Unlock()
+		if busy {
+			s.logf("Scheduled task %s: still running as session %s, so not started again", task.Name, running[task.Name])
+			continue
+		}
+
+		var user *serveUser
+		if len(s.users) > 0 {
+			for i := range s.users {
+				if s.users[i].name == task.User {
+					user = &s.users[i]
+				}
+			}
+			if user == nil {
+				s.logf("Scheduled task %s: %q is not one of the users, so it can't run", task.Name, task.User)
+				continue
+			}
+		}
+		status, err := s.open(user, nil, task.Message)
+		if err != nil {
+			s.logf("Scheduled task %s: %v", task.Name, err)
+			continue
+		}
+		running[task.Name] = status.ID
+		s.logf("Scheduled task %s: started as session %s", task.Name, status.ID)
+	}
+}
+
+// logf logs for the server itself, between its sessions' events
+func (s *agentServer) logf(format string, args ...interface{}) {
+	s.renderMu.Lock()
+	defer s.renderMu.Unlock()
+	s.base.logf(format, args...)
+}
+
+// cronSchedule is the minutes, hours, days of the month, months and days
+// of the week a cron expression matches, as bit sets
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+
+	// domAll and dowAll are whether the day fields were *, as a day
+	// matches if either day field does, unless one of them is *
+	domAll, dowAll bool
+}
+
+// cronMacros are the shorthands for common schedules
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var (
+	cronMonths   = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+	cronWeekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+)
+
+// parseCron parses a cron expression of five fields, minute, hour, day of
+// the month, month and day of the week, each *, a number, a name for
+// months and days of the week, a range such as 1-5, any of these with a
+// step such as */15, or a list of them separated by commas
+func parseCron(expr string) (*cronSchedule, error) {
+	if macro, ok := cronMacros[strings.ToLower(strings.TrimSpace(expr))]; ok {
+		expr = macro
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid cron expression %q: expected 5 fields, minute hour day month weekday", expr)
+	}
+	var c cronSchedule
+	var err error
+	parse := func(field, what string, low, high int, names []string, nameBase int) uint64 {
+		if err != nil {
+			return 0
+		}
+		var bits uint64
+		bits, err = parseCronField(field, low, high, names, nameBase)
+		if err != nil {
+			err = fmt.Errorf("invalid cron expression %q: %s: %v", expr, what, err)
+		}
+		return bits
+	}
+	c.minute = parse(fields[0], "minute", 0, 59, nil, 0)
+	c.hour = parse(fields[1], "hour", 0, 23, nil, 0)
+	c.dom = parse(fields[2], "day of the month", 1, 31, nil, 0)
+	c.month = parse(fields[3], "month", 1, 12, cronMonths, 1)
+	c.dow = parse(fields[4], "day of the week", 0, 7, cronWeekdays, 0)
+	if err != nil {
+		return nil, err
+	}
+	// Sunday is 0 or 7
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	c.domAll, c.dowAll = fields[2] == "*", fields[4] == "*"
+	return &c, nil
+}
+
+func parseCronField(field string, low, high int, names []string, nameBase int) (uint64, error) {
+	value := func(s string) (int, error) {
+		for i, name := range names {
+			if strings.EqualFold(s, name) {
+				return nameBase + i, nil
+			}
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < low || n > high {
+			return 0, fmt.Errorf("%q is not from %d to %d", s, low, high)
+		}
+		return n, nil
+	}
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		part, stepText, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepText); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step %q", stepText)
+			}
+		}
+		start, end := low, high
+		switch from, to, isRange := strings.Cut(part, "-"); {
+		case part == "*":
+		case isRange:
+			var err error
+			if start, err = value(from); err != nil {
+				return 0, err
+			}
+			if end, err = value(to); err != nil {
+				return 0, err
+			}
+			if end < start {
+				return 0, fmt.Errorf("range %q goes backwards", part)
+			}
+		default:
+			n, err := value(part)
+			if err != nil {
+				return 0, err
+			}
+			start = n
+			if !hasStep {
+				end = n
+			}
+		}
+		for n := start; n <= end; n += step {
+			bits |= 1 << n
+		}
+	}
+	return bits, nil
+}
+
+// matches reports whether a time is in one of the minutes the schedule
+// says
+func (c *cronSchedule) matches(t time.Time) bool {
+	return c.minute&(1<<t.Minute()) != 0 && c.hour&(1<<t.Hour()) != 0 &&
+		c.month&(1<<int(t.Month())) != 0 && c.matchesDay(t)
+}
+
+func (c *cronSchedule) matchesDay(t time.Time) bool {
+	dom := c.dom&(1<<t.Day()) != 0
+	dow := c.dow&(1<<int(t.Weekday())) != 0
+	switch {
+	case c.domAll:
+		return dow
+	case c.dowAll:
+		return dom
+	}
+	return dom || dow
+}
+
+// next finds the first minute after a time that the schedule matches,
+// looking as far as five years ahead, long enough for the 29th of February
+func (c *cronSchedule) next(after time.Time) (time.Time, bool) {
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<int(t.Month())) == 0 || !c.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<t.Hour()) == 0:
+			t = t.Truncate(time.Hour).Add(time.Hour)
+		case c.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,168 @@
+package agent
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	// Friday 16 October 2026, 09:30
+	at := time.Date(2026, 10, 16, 9, 30, 0, 0, time.Local)
+	for expr, want := range map[string]string{
+		"* * * * *":          "2026-10-16 09:31",
+		"0 9 * * mon":        "2026-10-19 09:00",
+		"*/15 * * * *":       "2026-10-16 09:45",
+		"0 9-17/4 * * *":     "2026-10-16 13:00",
+		"0 0 1 jan *":        "2027-01-01 00:00",
+		"0 0 29 2 *":         "2028-02-29 00:00",
+		"30 9 20 * 7":        "2026-10-18 09:30",
+		"0 8,12 * * 1-5":     "2026-10-16 12:00",
+		"5 * * * *":          "2026-10-16 10:05",
+		"@weekly":            "2026-10-18 00:00",
+		"@DAILY":             "2026-10-17 00:00",
+		"0 0 31 2 *":         "never",
+		"0 12 * oct-dec fri": "2026-10-16 12:00",
+	} {
+		cron, err := parseCron(expr)
+		if err != nil {
+			t.Errorf("%q: %v", expr, err)
+			continue
+		}
+		got := "never"
+		if next, ok := cron.next(at); ok {
+			got = next.Format("2006-01-02 15:04")
+			if !cron.matches(next) {
+				t.Errorf("%q doesn't match its next run %s", expr, got)
+			}
+		}
+		if got != want {
+			t.Errorf("%q next runs %s, want %s", expr, got, want)
+		}
+	}
+
+	for expr, want := range map[string]string{
+		"* * * *":      "expected 5 fields",
+		"60 * * * *":   "minute",
+		"* 9-5 * * *":  "goes backwards",
+		"*/0 * * * *":  "invalid step",
+		"* * 0 * *":    "day of the month",
+		"* * * * fun":  "day of the week",
+		"@fortnightly": "expected 5 fields",
+	} {
+		if _, err := parseCron(expr); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q gave %v, want %q", expr, err, want)
+		}
+	}
+}
+
+func TestRunSchedule(t *testing.T) {
+	dir := t.TempDir()
+	run := func(args ...string) (string, error) {
+		var out bytes.Buffer
+		err := runSchedule(dir, args, &out)
+		return out.String(), err
+	}
+	if out, err := run("list"); err != nil || out != "No tasks are scheduled\n" {
+		t.Errorf("list gave %q, %v", out, err)
+	}
+	if out, err := run("add", "--name", "deps", "--user", "alice", "0 9 * * mon", "Update", "the dependencies"); err != nil || !strings.HasPrefix(out, "Added deps, next run Mon ") {
+		t.Errorf("add gave %q, %v", out, err)
+	}
+	if out, err := run("add", "@daily", "Fix the lint warnings"); err != nil || !strings.HasPrefix(out, "Added task1,") {
+		t.Errorf("add gave %q, %v", out, err)
+	}
+	if _, err := run("add", "--name", "deps", "@daily", "Again"); err == nil || !strings.Contains(err.Error(), "already a task named deps") {
+		t.Errorf("adding deps twice gave %v", err)
+	}
+	if _, err := run("add", "0 25 * * *", "Never"); err == nil || !strings.Contains(err.Error(), "hour") {
+		t.Errorf("adding a bad hour gave %v", err)
+	}
+
+	schedule, err := loadSchedule(filepath.Join(dir, scheduleFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(schedule.Tasks) != 2 || *schedule.Tasks[0] != (scheduledTask{"deps", "0 9 * * mon", "Update the dependencies", "alice"}) {
+		t.Errorf("schedule %+v", schedule.Tasks)
+	}
+	if out, _ := run("list"); !strings.Contains(out, "deps  0 9 * * mon  next run Mon ") || !strings.Contains(out, "as alice\n  Update the dependencies\n") {
+		t.Errorf("list gave %q", out)
+	}
+
+	if out, err := run("remove", "deps"); err != nil || out != "Removed deps\n" {
+		t.Errorf("remove gave %q, %v", out, err)
+	}
+	if _, err := run("remove", "deps"); err == nil {
+		t.Errorf("removing deps twice succeeded")
+	}
+	if schedule, _ := loadSchedule(filepath.Join(dir, scheduleFile)); len(schedule.Tasks) != 1 || schedule.Tasks[0].Name != "task1" {
+		t.Errorf("schedule after remove %+v", schedule.Tasks)
+	}
+	if left, _ := filepath.Glob(filepath.Join(dir, scheduleFile+".*.tmp")); len(left) != 0 {
+		t.Errorf("temporary files left behind: %q", left)
+	}
+}
+
+func TestScheduledTasks(t *testing.T) {
+	base, _, _ := newTestEngine(t, []ChatResponse{reply("Updated"), reply("Updated again")})
+	path := filepath.Join(t.TempDir(), scheduleFile)
+	schedule := &taskSchedule{Tasks: []*scheduledTask{
+		{Name: "deps", Cron: "0 9 * * mon", Message: "Update the dependencies"},
+		{Name: "later", Cron: "0 10 * * mon", Message: "Not yet"},
+	}}
+	if err := schedule.save(path); err != nil {
+		t.Fatal(err)
+	}
+	var log bytes.Buffer
+	base.renderer = &plainRenderer{&log}
+	s := newAgentServer(t.Context(), base, "secret", nil)
+	running := make(map[string]string)
+	monday := time.Date(2026, 10, 19, 9, 0, 0, 0, time.Local)
+
+	s.startDue(monday, path, running)
+	s.mu.Lock()
+	session := s.sessions["s1"]
+	s.mu.Unlock()
+	if session == nil || len(s.sessions) != 1 || running["deps"] != "s1" {
+		t.Fatalf("sessions %v, running %v", s.sessions, running)
+	}
+	t.Cleanup(func() { os.RemoveAll(session.engine.workspace) })
+	<-session.done
+	if session.status.Reply != "Updated" {
+		t.Errorf("session %+v", session.status)
+	}
+
+	// A task still running from last time isn't started again
+	s.mu.Lock()
+	session.status.Status = agentRunning
+	s.mu.Unlock()
+	s.startDue(monday.AddDate(0, 0, 7), path, running)
+	if len(s.sessions) != 1 || !strings.Contains(log.String(), "Scheduled task deps: still running as session s1") {
+		t.Errorf("sessions %v, log %q", s.sessions, log.String())
+	}
+	s.mu.Lock()
+	session.status.Status = agentIdle
+	s.mu.Unlock()
+
+	// With users, a task runs only as one of them
+	s.users = []serveUser{{name: "alice", token: strings.Repeat("a", 32)}}
+	s.startDue(monday.AddDate(0, 0, 14), path, running)
+	if len(s.sessions) != 1 || !strings.Contains(log.String(), `Scheduled task deps: "" is not one of the users`) {
+		t.Errorf("sessions %v, log %q", s.sessions, log.String())
+	}
+	schedule.Tasks[0].User = "alice"
+	schedule.save(path)
+	s.startDue(monday.AddDate(0, 0, 14), path, running)
+	s.mu.Lock()
+	session = s.sessions["s2"]
+	s.mu.Unlock()
+	if session == nil || session.owner != "alice" || running["deps"] != "s2" {
+		t.Fatalf("sessions %v, running %v", s.sessions, running)
+	}
+	t.Cleanup(func() { os.RemoveAll(session.engine.workspace) })
+	<-session.done
+}
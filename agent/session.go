@@ -0,0 +1,337 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Session is the on-disk record of a conversation, written after every turn
+// so that a run can be inspected, or approximately reproduced, afterwards
+type Session struct {
+	Model       string       `json:"model"`
+	Adapter     string       `json:"adapter"`
+	Started     time.Time    `json:"started"`
+	Workspace   string       `json:"workspace,omitempty"` // relative to the session file
+	Environment Environment  `json:"environment"`
+	Messages    []Message    `json:"messages"`
+	Turns       []Turn       `json:"turns"`
+	Result      *FinalAnswer `json:"result,omitempty"`
+
+	// Question is what ask_user asked with no one to answer, if the
+	// session is paused, with the answers it may have
+	Question string   `json:"question,omitempty"`
+	Choices  []string `json:"choices,omitempty"`
+}
+
+// Environment is a snapshot of what the session ran against, so that a
+// transcript can still be interpreted once the tools or the model change
+type Environment struct {
+	OS          string            `json:"os"`
+	Arch        string            `json:"arch"`
+	GitCommit   string            `json:"git_commit,omitempty"`
+	ModelDigest string            `json:"model_digest,omitempty"`
+	Tools       map[string]string `json:"tools,omitempty"`
+}
+
+// versionCommands are the tools whose versions are recorded in a session
+// and shown by get_environment
+var versionCommands = map[string][]string{
+	"go":     {"go", "version"},
+	"node":   {"node", "--version"},
+	"npm":    {"npm", "--version"},
+	"python": {"python3", "--version"},
+	"rustc":  {"rustc", "--version"},
+	"cargo":  {"cargo", "--version"},
+	"java":   {"java", "-version"},
+	"gcc":    {"gcc", "--version"},
+	"make":   {"make", "--version"},
+	"docker": {"docker", "--version"},
+	"git":    {"git", "--version"},
+}
+
+// Turn records one model response and the sampling options that produced it
+type Turn struct {
+	Time    time.Time              `json:"time"`
+	Options map[string]interface{} `json:"options,omitempty"`
+	Message Message                `json:"message"`
+}
+
+func (e *Engine) newSession() *Session {
+	session := &Session{
+		Model:   e.model,
+		Adapter: e.adapter.Name(),
+		Started: time.Now(),
+	}
+	if e.sessionPath != "" {
+		session.Workspace = sessionWorkspace(e.sessionPath, e.workspace)
+		session.Environment = e.environmentSnapshot()
+	}
+	return session
+}
+
+// sessionWorkspace gives the workspace relative to the session file's
+// directory, so the file doesn't hold an absolute host path; on another
+// drive, it is left out
+func sessionWorkspace(sessionPath, workspace string) string {
+	dir, err := filepath.Abs(filepath.Dir(sessionPath))
+	if err != nil {
+		return ""
+	}
+	rel, err := filepath.Rel(dir, workspace)
+	if err != nil {
+		return ""
+	}
+	return filepath.ToSlash(rel)
+}
+
+// environmentSnapshot records tool versions, the workspace commit and the
+// model digest; anything unavailable is left out
+func (e *Engine) environmentSnapshot() Environment {
+	env := Environment{
+		OS:    runtime.GOOS,
+		Arch:  runtime.GOARCH,
+		Tools: toolVersions(),
+	}
+	env.GitCommit, _ = e.git("rev-parse", "HEAD")
+
+	if models, err := e.modelProvider().ListModels(context.Background()); err == nil {
+		for _, model := range models {
+			if model.Name == e.model || model.Name == e.model+":latest" {
+				env.ModelDigest = model.Digest
+				break
+			}
+		}
+	}
+
+	return env
+}
+
+// toolVersions runs versionCommands, in parallel, and returns the first
+// line each printed; tools that are not installed are left out
+func toolVersions() map[string]string {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	versions := make(map[string]string)
+	for name, command := range versionCommands {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			// java prints its version to stderr
+			output, err := exec.CommandContext(ctx, command[0], command[1:]...).CombinedOutput()
+			if err != nil {
+				return
+			}
+			line, _, _ := strings.Cut(strings.TrimSpace(string(output)), "\n")
+			mu.Lock()
+			versions[name] = strings.TrimSpace(line)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return versions
+}
+
+// recordTurn adds a turn to the session and saves it, if a session file is configured
+func (e *Engine) recordTurn(session *Session, messages []Message, reply Message) error {
+	if e.sessionPath == "" {
+		return nil
+	}
+	session.Turns = append(session.Turns, Turn{
+		Time:    time.Now(),
+		Options: e.options,
+		Message: reply,
+	})
+	session.Messages = messages
+	session.Result = e.result
+	session.Question, session.Choices = e.question, e.choices
+	return saveSession(e.sessionPath, session, e.sessionKey)
+}
+
+// saveSession writes a session, encrypted if there is a key
+func saveSession(path string, session *Session, key []byte) error {
+	data, err := json.MarshalIndent(session, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal session: %v", err)
+	}
+	if err := writeSealed(path, data, key); err != nil {
+		return fmt.Errorf("failed to write session: %v", err)
+	}
+	return nil
+}
+
+// writeSealed writes a file that may hold the session's secrets, such as
+// the transcript and tool output. With a key, it is encrypted. Either way,
+// only its owner may read it, even if it already existed with a looser
+// mode. The file is written to a new temporary file beside it and renamed
+// into place, so an interruption leaves either the old file or the new
+// one, writers don't collide, and a link planted where the temporary file
+// would go isn't followed.
+func writeSealed(path string, data, key []byte) error {
+	if key != nil {
+		var err error
+		if data, err = sealSession(data, key); err != nil {
+			return err
+		}
+	}
+	// CreateTemp makes the file afresh, readable only by its owner
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+// loadSession reads a session file, decrypting it if need be
+func loadSession(path string, key []byte) (*Session, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read session: %v", err)
+	}
+	if data, err = openSealed(data, key); err != nil {
+		return nil, err
+	}
+	var session Session
+	if err := json.Unmarshal(data, &session); err != nil {
+		return nil, fmt.Errorf("invalid session file: %v", err)
+	}
+	return &session, nil
+}
+
+// encryptedHeader starts an encrypted session file, which goes on with a
+// nonce and the AES-256-GCM sealed JSON
+const encryptedHeader = "wex-encrypted/1\n"
+
+// loadSessionKey reads SESSION_KEY_FILE; the AES-256 key is the SHA-256
+// hash of the file, which must hold at least 32 random bytes
+func loadSessionKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key: %v", err)
+	}
+	if len(data) < 32 {
+		return nil, fmt.Errorf("%s is too short to be a key: it has %d bytes, and needs at least 32; make one with head -c 32 /dev/urandom", path, len(data))
+	}
+	key := sha256.Sum256(data)
+	return key[:], nil
+}
+
+func sessionCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid session key: %v", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+func sealSession(data, key []byte) ([]byte, error) {
+	gcm, err := sessionCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to make nonce: %v", err)
+	}
+	sealed := append([]byte(encryptedHeader), nonce...)
+	return gcm.Seal(sealed, nonce, data, []byte(encryptedHeader)), nil
+}
+
+// errNotSealed refuses a plain file where wex, with a key, would have
+// written an encrypted one
+var errNotSealed = errors.New("the file is not encrypted, though SESSION_KEY_FILE is set, so wex did not write it with the key; unset SESSION_KEY_FILE to read it anyway")
+
+// isSealed reports whether data is encrypted
+func isSealed(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(encryptedHeader))
+}
+
+// openSealed opens a file wex writes itself, such as a session or a plan.
+// What wex writes with a key is always encrypted, so with a key, a plain
+// file may have been put in its place, and is refused.
+func openSealed(data, key []byte) ([]byte, error) {
+	if key != nil && !isSealed(data) {
+		return nil, errNotSealed
+	}
+	return openSession(data, key)
+}
+
+// openSession decrypts an encrypted session, and passes anything else
+// through as it is
+func openSession(data, key []byte) ([]byte, error) {
+	if !isSealed(data) {
+		return data, nil
+	}
+	if key == nil {
+		return nil, errors.New("the session is encrypted; set SESSION_KEY_FILE to the key it was written with")
+	}
+	gcm, err := sessionCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	data = data[len(encryptedHeader):]
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("encrypted session is truncated")
+	}
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], []byte(encryptedHeader))
+	if err != nil {
+		return nil, errors.New("failed to decrypt session: wrong key, or the file is damaged")
+	}
+	return plain, nil
+}
+
+// runDecrypt handles "wex decrypt", which prints an encrypted session
+func runDecrypt(args []string, w io.Writer) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: wex decrypt SESSION")
+	}
+	key, err := sessionKeyFromEnv()
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(args[0])
+	if err != nil {
+		return fmt.Errorf("failed to read session: %v", err)
+	}
+	if data, err = openSealed(data, key); err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// sessionKeyFromEnv loads the key named by SESSION_KEY_FILE, if any
+func sessionKeyFromEnv() ([]byte, error) {
+	path := os.Getenv("SESSION_KEY_FILE")
+	if path == "" {
+		return nil, nil
+	}
+	return loadSessionKey(path)
+}
@@ -0,0 +1,154 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestEncryptedSession(t *testing.T) {
+	dir := t.TempDir()
+	keyPath := filepath.Join(dir, "session.key")
+	os.WriteFile(keyPath, []byte("0123456789abcdef0123456789abcdef"), 0600)
+	key, err := loadSessionKey(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shortPath := filepath.Join(dir, "short.key")
+	os.WriteFile(shortPath, []byte("0123456789abcdef0123"), 0600)
+	if _, err := loadSessionKey(shortPath); err == nil || !strings.Contains(err.Error(), "needs at least 32") {
+		t.Errorf("a 20-byte key gave %v", err)
+	}
+
+	e, _, _ := newTestEngine(t, []ChatResponse{reply("The secret sauce is ketchup.")})
+	e.sessionPath = filepath.Join(dir, "session.json")
+	e.sessionKey = key
+	// A session file that is already there keeps its mode unless changed
+	os.WriteFile(e.sessionPath, nil, 0644)
+	if _, err := e.Run(context.Background(), "What is the secret sauce?"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(e.sessionPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), encryptedHeader) || strings.Contains(string(data), "ketchup") {
+		t.Errorf("session is not encrypted:\n%s", data)
+	}
+	if info, _ := os.Stat(e.sessionPath); info.Mode().Perm() != 0600 {
+		t.Errorf("encrypted session has mode %v", info.Mode().Perm())
+	}
+
+	if _, err := loadSession(e.sessionPath, nil); err == nil || !strings.Contains(err.Error(), "SESSION_KEY_FILE") {
+		t.Errorf("loading without a key gave %v", err)
+	}
+	wrong := make([]byte, len(key))
+	if _, err := loadSession(e.sessionPath, wrong); err == nil || !strings.Contains(err.Error(), "wrong key") {
+		t.Errorf("loading with the wrong key gave %v", err)
+	}
+	session, err := loadSession(e.sessionPath, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := session.Messages[len(session.Messages)-1]; last.Content != "The secret sauce is ketchup." {
+		t.Errorf("decrypted session ends with %+v", last)
+	}
+
+	t.Setenv("SESSION_KEY_FILE", keyPath)
+	var out strings.Builder
+	if err := runDecrypt([]string{e.sessionPath}, &out); err != nil || !strings.Contains(out.String(), "ketchup") {
+		t.Errorf("decrypt gave %v:\n%s", err, out.String())
+	}
+	if err := runShare([]string{e.sessionPath}, &out); err != nil {
+		t.Errorf("sharing an encrypted session: %v", err)
+	}
+	if left, _ := filepath.Glob(e.sessionPath + ".*.tmp"); len(left) != 0 {
+		t.Errorf("temporary files left behind: %q", left)
+	}
+	if rel, _ := filepath.Rel(dir, e.workspace); session.Workspace != filepath.ToSlash(rel) {
+		t.Errorf("session records the workspace as %q", session.Workspace)
+	}
+
+	// With a key, a file that isn't encrypted may have been swapped in
+	plain := filepath.Join(dir, "plain.json")
+	os.WriteFile(plain, []byte(`{"messages": []}`), 0644)
+	if _, err := loadSession(plain, key); err == nil || !strings.Contains(err.Error(), "not encrypted") {
+		t.Errorf("loading a plain session with a key gave %v", err)
+	}
+	if err := runDecrypt([]string{plain}, &out); err == nil || !strings.Contains(err.Error(), "not encrypted") {
+		t.Errorf("decrypting a plain session gave %v", err)
+	}
+	if _, err := loadSession(plain, nil); err != nil {
+		t.Errorf("loading a plain session without a key gave %v", err)
+	}
+
+	// Other tools' conversations are never encrypted, so they can be
+	// resumed with the key set, but a plain wex session can't
+	anthropic := filepath.Join(dir, "claude.json")
+	os.WriteFile(anthropic, []byte(`{"messages": [{"role": "user", "content": [{"type": "text", "text": "Hi"}]}, {"role": "assistant", "content": [{"type": "text", "text": "Hello"}]}]}`), 0644)
+	if messages, format, err := loadConversation(anthropic, key); err != nil || format == "wex" || len(messages) != 2 {
+		t.Errorf("resuming a Claude conversation with a key gave %d messages as %s, %v", len(messages), format, err)
+	}
+	if messages, _, err := loadConversation(e.sessionPath, key); err != nil || len(messages) == 0 {
+		t.Errorf("resuming an encrypted session gave %v", err)
+	}
+	wexSession := filepath.Join(dir, "wex.json")
+	os.WriteFile(wexSession, []byte(`{"adapter": "ollama", "turns": [], "messages": [{"role": "user", "content": "Hi"}]}`), 0644)
+	if _, _, err := loadConversation(wexSession, key); err == nil || !strings.Contains(err.Error(), "not encrypted") {
+		t.Errorf("resuming a plain wex session with a key gave %v", err)
+	}
+
+	// Without a key, sessions are plain, but still only their owner's
+	if err := saveSession(plain, &Session{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := os.Stat(plain); info.Mode().Perm() != 0600 {
+		t.Errorf("plain session has mode %v", info.Mode().Perm())
+	}
+}
+
+func TestWriteSealed(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "session.json")
+
+	// A link planted where a fixed temporary file would go isn't followed
+	target := filepath.Join(dir, "target")
+	os.WriteFile(target, []byte("keep"), 0644)
+	if err := os.Symlink(target, path+".tmp"); err != nil {
+		t.Skip(err)
+	}
+	if err := writeSealed(path, []byte("secret"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(target); string(data) != "keep" {
+		t.Errorf("the link's target has %q", data)
+	}
+
+	// Writers at the same time don't collide
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- writeSealed(path, []byte(fmt.Sprint("secret ", i)), nil)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if data, _ := os.ReadFile(path); !strings.HasPrefix(string(data), "secret ") {
+		t.Errorf("session has %q", data)
+	}
+	if left, _ := filepath.Glob(path + ".*.tmp"); len(left) != 0 {
+		t.Errorf("temporary files left behind: %q", left)
+	}
+}
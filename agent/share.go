@@ -0,0 +1,417 @@
+package agent
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A share bundle is a session file made fit to hand to someone else: the
+// transcript and the changes the session made, as a diff, with secrets
+// redacted. Importing one replays it for reading; nothing is run.
+
+// shareFormat identifies bundles, in case the format changes
+const shareFormat = "wex-share/1"
+
+type ShareBundle struct {
+	Format  string    `json:"format"`
+	Created time.Time `json:"created"`
+	Session *Session  `json:"session"`
+
+	// DiffSource is git, for the diff from the commit the session started
+	// at, or transcript, for one rebuilt from write_file calls
+	Diff       string `json:"diff,omitempty"`
+	DiffSource string `json:"diff_source,omitempty"`
+	Redactions int    `json:"redactions"`
+}
+
+const redacted = "<redacted>"
+
+// secretPatterns match credentials in well-known formats, wherever they are
+var secretPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`),
+	regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`),
+	regexp.MustCompile(`\bgh[pousr]_[A-Za-z0-9]{36,}\b`),
+	regexp.MustCompile(`\bgithub_pat_[A-Za-z0-9_]{22,}\b`),
+	regexp.MustCompile(`\bsk-[A-Za-z0-9_-]{20,}\b`),
+	regexp.MustCompile(`\bxox[abposr]-[A-Za-z0-9-]{10,}\b`),
+	regexp.MustCompile(`\beyJ[A-Za-z0-9_-]{10,}\.[A-Za-z0-9_-]{10,}\.[A-Za-z0-9_-]{10,}`),
+}
+
+// secretAssignments match a value given to a name, as in .env files, shell,
+// YAML, JSON or code, including lines of a diff; the value is redacted if
+// the name looks like a secret's. Only literals count, so code such as
+// token = get_token() is left alone.
+var secretAssignments = []*regexp.Regexp{
+	regexp.MustCompile(`(?m)^([+ -]?\s*(?:export\s+)?([A-Za-z_][A-Za-z0-9_]*)=)([^\s"'#$(][^\s"'#()]*)$`),
+	regexp.MustCompile(`(["']?([A-Za-z_][A-Za-z0-9_.-]*)["']?\s*[:=]\s*)(?:"([^"\\\n]{4,})"|'([^'\\\n]{4,})')`),
+	regexp.MustCompile(`(?i)(\b(?:bearer|basic|token)\s+)([A-Za-z0-9._~+/=-]{16,})`),
+}
+
+// redactor replaces secrets in text, counting them
+type redactor struct {
+	// values are secrets from the environment, longest first, to be
+	// replaced wherever they appear
+	values []string
+	count  int
+}
+
+func newRedactor(environ []string) *redactor {
+	r := &redactor{}
+	for _, entry := range environ {
+		name, value, _ := strings.Cut(entry, "=")
+		if len(value) >= 8 && isSecret(name, value) {
+			r.values = append(r.values, value)
+		}
+	}
+	r.sortValues()
+	return r
+}
+
+func (r *redactor) sortValues() {
+	sort.Slice(r.values, func(i, j int) bool {
+		return len(r.values[i]) > len(r.values[j])
+	})
+}
+
+// learn adds values that text gives to secrets' names to those redacted
+// everywhere, so that a token written to a .env file is also caught where
+// it was pasted into a message
+func (r *redactor) learn(s string) {
+	var found []string
+	for _, g := range secretAssignments[0].FindAllStringSubmatch(s, -1) {
+		if secretName.MatchString(g[2]) {
+			found = append(found, g[3])
+		}
+	}
+	for _, g := range secretAssignments[1].FindAllStringSubmatch(s, -1) {
+		if secretName.MatchString(g[2]) {
+			found = append(found, g[3]+g[4])
+		}
+	}
+	for _, value := range found {
+		if len(value) >= 8 && value != redacted && !slices.Contains(r.values, value) {
+			r.values = append(r.values, value)
+		}
+	}
+	r.sortValues()
+}
+
+// learnValue learns from every string in a decoded JSON value
+func (r *redactor) learnValue(v interface{}) {
+	switch v := v.(type) {
+	case string:
+		r.learn(v)
+	case []interface{}:
+		for _, item := range v {
+			r.learnValue(item)
+		}
+	case map[string]interface{}:
+		for _, item := range v {
+			r.learnValue(item)
+		}
+	}
+}
+
+func (r *redactor) text(s string) string {
+	for _, value := range r.values {
+		if n := strings.Count(s, value); n > 0 {
+			r.count += n
+			s = strings.ReplaceAll(s, value, redacted)
+		}
+	}
+	for _, pattern := range secretPatterns {
+		s = pattern.ReplaceAllStringFunc(s, func(string) string {
+			r.count++
+			return redacted
+		})
+	}
+	s = secretAssignments[0].ReplaceAllStringFunc(s, func(m string) string {
+		g := secretAssignments[0].FindStringSubmatch(m)
+		if !secretName.MatchString(g[2]) || g[3] == redacted {
+			return m
+		}
+		r.count++
+		return g[1] + redacted
+	})
+	s = secretAssignments[1].ReplaceAllStringFunc(s, func(m string) string {
+		g := secretAssignments[1].FindStringSubmatch(m)
+		value, quote := g[3], `"`
+		if value == "" {
+			value, quote = g[4], "'"
+		}
+		if !secretName.MatchString(g[2]) || value == redacted {
+			return m
+		}
+		r.count++
+		return g[1] + quote + redacted + quote
+	})
+	s = secretAssignments[2].ReplaceAllStringFunc(s, func(m string) string {
+		g := secretAssignments[2].FindStringSubmatch(m)
+		r.count++
+		return g[1] + redacted
+	})
+	s = urlCredentials.ReplaceAllStringFunc(s, func(string) string {
+		r.count++
+		return "://" + redacted + "@"
+	})
+	return s
+}
+
+// value redacts every string in a decoded JSON value. An object with a
+// secret's name and a value, like the arguments of update_env_file, has
+// the value redacted whole.
+func (r *redactor) value(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		return r.text(v)
+	case []interface{}:
+		for i := range v {
+			v[i] = r.value(v[i])
+		}
+	case map[string]interface{}:
+		name, _ := v["name"].(string)
+		if value, ok := v["value"].(string); ok && value != "" && isSecret(name, value) {
+			v["value"] = redacted
+			r.count++
+		}
+		for k := range v {
+			v[k] = r.value(v[k])
+		}
+	}
+	return v
+}
+
+// session returns a copy of a session with secrets redacted
+func (r *redactor) session(session *Session) (*Session, error) {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return nil, err
+	}
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	r.learnValue(v)
+	if data, err = json.Marshal(r.value(v)); err != nil {
+		return nil, err
+	}
+	var clean Session
+	if err := json.Unmarshal(data, &clean); err != nil {
+		return nil, err
+	}
+	return &clean, nil
+}
+
+// sessionDiff returns the changes a session made: from git if the
+// workspace is still at, or after, the commit the session started at, or
+// else rebuilt from its write_file calls
+func sessionDiff(session *Session, workspace string) (string, string) {
+	if commit := session.Environment.GitCommit; commit != "" && workspace != "" {
+		if diff, err := gitIn(workspace, "diff", commit); err == nil {
+			if untracked, err := gitIn(workspace, "ls-files", "--others", "--exclude-standard", "-z"); err == nil {
+				for _, path := range strings.Split(untracked, "\x00") {
+					if path == "" {
+						continue
+					}
+					data, err := os.ReadFile(filepath.Join(workspace, path))
+					if err != nil || strings.IndexByte(string(data), 0) >= 0 {
+						continue
+					}
+					diff += unifiedDiff("/dev/null", "b/"+path, "", string(data), 3)
+				}
+			}
+			return diff, "git"
+		}
+	}
+
+	// Each write is diffed against the previous write of the same file;
+	// what a file held before the session isn't known
+	written := make(map[string]string)
+	var b strings.Builder
+	for _, message := range session.Messages {
+		for _, toolCall := range message.ToolCalls {
+			if toolCall.Function.Name != "write_file" {
+				continue
+			}
+			var params struct {
+				Path    string `json:"path"`
+				Content string `json:"content"`
+			}
+			if json.Unmarshal(toolCall.Function.Arguments, &params) != nil || params.Path == "" {
+				continue
+			}
+			before, seen := written[params.Path]
+			from := "a/" + params.Path
+			if !seen {
+				from = "/dev/null"
+			}
+			b.WriteString(unifiedDiff(from, "b/"+params.Path, before, params.Content, 3))
+			written[params.Path] = params.Content
+		}
+	}
+	if b.Len() == 0 {
+		return "", ""
+	}
+	return b.String(), "transcript"
+}
+
+// runShare handles "wex share", which makes a bundle from a session file
+func runShare(args []string, w io.Writer) error {
+	shareFlags := flag.NewFlagSet("share", flag.ExitOnError)
+	out := shareFlags.String("o", "", "Write the bundle to this file (default the session file's name with .share.json)")
+	workspace := shareFlags.String("workspace", "", "Workspace the session ran in, for the diff (default the one recorded in the session)")
+	shareFlags.Usage = func() {
+		fmt.Fprintf(shareFlags.Output(), "Usage: wex share [flags] SESSION\n")
+		shareFlags.PrintDefaults()
+	}
+	shareFlags.Parse(args)
+	if shareFlags.NArg() != 1 {
+		shareFlags.Usage()
+		return fmt.Errorf("no session file")
+	}
+	path := shareFlags.Arg(0)
+
+	key, err := sessionKeyFromEnv()
+	if err != nil {
+		return err
+	}
+	session, err := loadSession(path, key)
+	if err != nil {
+		return err
+	}
+	if *workspace == "" && session.Workspace != "" {
+		// Sessions record the workspace relative to themselves; older ones
+		// have it absolute
+		*workspace = session.Workspace
+		if !filepath.IsAbs(*workspace) {
+			*workspace = filepath.Join(filepath.Dir(path), filepath.FromSlash(*workspace))
+		}
+	}
+
+	r := newRedactor(os.Environ())
+	bundle := ShareBundle{Format: shareFormat, Created: time.Now().UTC()}
+	diff, source := sessionDiff(session, *workspace)
+	r.learn(diff)
+	if bundle.Session, err = r.session(session); err != nil {
+		return err
+	}
+	bundle.Diff, bundle.DiffSource = r.text(diff), source
+	bundle.Redactions = r.count
+
+	// The bundle doesn't say where the session ran
+	bundle.Session.Workspace = ""
+
+	if *out == "" {
+		*out = strings.TrimSuffix(path, filepath.Ext(path)) + ".share.json"
+	}
+	data, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal bundle: %v", err)
+	}
+	if err := os.WriteFile(*out, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write bundle: %v", err)
+	}
+	fmt.Fprintf(w, "Wrote %s: %d messages", *out, len(session.Messages))
+	if source != "" {
+		fmt.Fprintf(w, ", diff from %s", source)
+	}
+	fmt.Fprintf(w, ", %d secrets redacted\n", r.count)
+	return nil
+}
+
+// runImport handles "wex import", which shows a bundle as the session
+// would have been shown with the renderer named, then the diff
+func runImport(args []string, output string, w io.Writer) error {
+	importFlags := flag.NewFlagSet("import", flag.ExitOnError)
+	patch := importFlags.String("patch", "", "Also write the diff to this file, for git apply")
+	importFlags.Usage = func() {
+		fmt.Fprintf(importFlags.Output(), "Usage: wex [--output FORMAT] import [flags] BUNDLE\n")
+		importFlags.PrintDefaults()
+	}
+	importFlags.Parse(args)
+	if importFlags.NArg() != 1 {
+		importFlags.Usage()
+		return fmt.Errorf("no bundle")
+	}
+	newRenderer, ok := renderers[output]
+	if !ok {
+		return fmt.Errorf("invalid --output %q: must be plain, pretty, json or sse", output)
+	}
+
+	data, err := os.ReadFile(importFlags.Arg(0))
+	if err != nil {
+		return fmt.Errorf("failed to read bundle: %v", err)
+	}
+	var bundle ShareBundle
+	if err := json.Unmarshal(data, &bundle); err != nil {
+		return fmt.Errorf("invalid bundle: %v", err)
+	}
+	if bundle.Format != shareFormat || bundle.Session == nil {
+		return fmt.Errorf("not a wex share bundle, or from a newer version: format %q", bundle.Format)
+	}
+
+	replaySession(bundle.Session, newRenderer(w))
+	renderer := newRenderer(w)
+	if bundle.Diff != "" {
+		renderer.Render(Event{Type: EventLog, Time: bundle.Created, Text: fmt.Sprintf("Changes (from %s):\n%s", bundle.DiffSource, strings.TrimRight(bundle.Diff, "\n"))})
+	}
+	if *patch != "" && bundle.Diff != "" {
+		if err := os.WriteFile(*patch, []byte(bundle.Diff), 0644); err != nil {
+			return fmt.Errorf("failed to write patch: %v", err)
+		}
+	}
+	return nil
+}
+
+// replaySession renders a recorded session as the events it produced
+func replaySession(session *Session, renderer Renderer) {
+	emit := func(turn int, event Event) {
+		event.Turn = turn
+		event.Time = session.Started
+		if turn > 0 && turn <= len(session.Turns) {
+			event.Time = session.Turns[turn-1].Time
+		}
+		renderer.Render(event)
+	}
+
+	emit(0, Event{Type: EventLog, Text: fmt.Sprintf("Session with %s (%s adapter), started %s",
+		session.Model, session.Adapter, session.Started.Format(time.RFC3339))})
+	turn := 0
+	tools := make(map[string]string)
+	for _, message := range session.Messages {
+		switch message.Role {
+		case "user":
+			emit(turn, Event{Type: EventLog, Text: "User: " + message.Content})
+		case "assistant":
+			turn++
+			emit(turn, Event{Type: EventTurnStarted})
+			emit(turn, Event{Type: EventAssistantText, Text: message.Content, ToolCalls: len(message.ToolCalls)})
+			for _, toolCall := range message.ToolCalls {
+				tools[toolCall.ID] = toolCall.Function.Name
+				emit(turn, Event{Type: EventToolStarted, Tool: toolCall.Function.Name, CallID: toolCall.ID, Arguments: toolCall.Function.Arguments})
+			}
+		case "tool":
+			emit(turn, Event{
+				Type:   EventToolFinished,
+				Tool:   tools[message.ToolCallID],
+				CallID: message.ToolCallID,
+				Result: message.Content,
+				Failed: strings.HasPrefix(message.Content, "Error: "),
+			})
+		}
+	}
+	if session.Result != nil {
+		data, _ := json.MarshalIndent(session.Result, "", "  ")
+		emit(turn, Event{Type: EventLog, Text: "Final answer:\n" + string(data)})
+	}
+	emit(turn, Event{Type: EventSessionDone})
+}
@@ -0,0 +1,200 @@
+package agent
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// shellSession is a long-lived shell that commands are run in one after
+// another, so that environment variables, virtualenv activation and the
+// current directory carry over between them
+type shellSession struct {
+	cmd      *exec.Cmd
+	input    io.WriteCloser
+	output   chan []byte
+	terminal bool
+
+	// marker ends each command's output, followed by its exit status and
+	// the shell's directory. It is written in two halves, so the echo of
+	// the command that prints it cannot be mistaken for it.
+	marker       string
+	markerHalves [2]string
+	done         *regexp.Regexp
+	pending      []byte
+}
+
+func startShellSession(dir string) (*shellSession, error) {
+	name := "bash"
+	args := []string{"--noprofile", "--norc"}
+	if _, err := exec.LookPath(name); err != nil {
+		name, args = "sh", nil
+	}
+	cmd := exec.Command(name, args...)
+	cmd.Dir = dir
+	cmd.Env = commandEnv("TERM=dumb", "PS1=", "PS2=")
+
+	input, output, terminal, err := startWithTerminal(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start shell: %v", err)
+	}
+
+	random := make([]byte, 8)
+	rand.Read(random)
+	s := &shellSession{
+		cmd:          cmd,
+		input:        input,
+		output:       make(chan []byte, 64),
+		terminal:     terminal,
+		markerHalves: [2]string{"__WEX_DONE_", hex.EncodeToString(random) + "__"},
+	}
+	s.marker = s.markerHalves[0] + s.markerHalves[1]
+	s.done = regexp.MustCompile(`(?s)^(.*?)\n?` + regexp.QuoteMeta(s.marker) + ` (\d+) ([^\n]*)\n`)
+
+	go func() {
+		defer close(s.output)
+		for {
+			buf := make([]byte, 4096)
+			n, err := output.Read(buf)
+			if n > 0 {
+				s.output <- buf[:n]
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	// Turn off echo and prompts; this command's own echo is discarded
+	setup := "PS1=''; PS2=''; unset PROMPT_COMMAND"
+	if terminal {
+		setup = "stty -echo -onlcr </dev/tty 2>/dev/null; " + setup
+	}
+	if _, _, _, err := s.run(setup, "", 10*time.Second); err != nil {
+		s.close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// run runs a command in the session and waits for it to finish, returning
+// its output, exit status and the shell's directory afterwards. Standard
+// input is the given text, or empty, so the command cannot swallow what
+// follows it. After a timeout or error the session is no longer usable.
+func (s *shellSession) run(command, input string, timeout time.Duration) (string, int, string, error) {
+	stdin := "< /dev/null"
+	if input != "" {
+		delimiter := s.marker + "_INPUT"
+		stdin = fmt.Sprintf("<<'%s'\n%s\n%s", delimiter, strings.TrimSuffix(input, "\n"), delimiter)
+	}
+	script := fmt.Sprintf("{ %s\n} %s\nprintf '\\n%%s%%s %%d %%s\\n' %s %s \"$?\" \"$PWD\"\n",
+		command, stdin, s.markerHalves[0], s.markerHalves[1])
+	if _, err := io.WriteString(s.input, script); err != nil {
+		return "", 0, "", fmt.Errorf("failed to write to shell: %v", err)
+	}
+
+	deadline := time.After(timeout)
+	for {
+		if m := s.done.FindSubmatchIndex(s.pending); m != nil {
+			output := string(s.pending[m[2]:m[3]])
+			status, _ := strconv.Atoi(string(s.pending[m[4]:m[5]]))
+			dir := string(s.pending[m[6]:m[7]])
+			s.pending = s.pending[m[1]:]
+			return strings.ReplaceAll(output, "\r\n", "\n"), status, dir, nil
+		}
+
+		select {
+		case chunk, ok := <-s.output:
+			if !ok {
+				return string(s.pending), 0, "", fmt.Errorf("shell exited")
+			}
+			s.pending = append(s.pending, bytes.ReplaceAll(chunk, []byte("\r\n"), []byte("\n"))...)
+		case <-deadline:
+			return string(s.pending), 0, "", errShellTimeout
+		}
+	}
+}
+
+var errShellTimeout = fmt.Errorf("timed out")
+
+func (s *shellSession) close() {
+	s.input.Close()
+	s.cmd.Process.Kill()
+	s.cmd.Wait()
+}
+
+// runInShell is run_command for the persistent shell. The shell is started
+// on first use in the current directory, and restarted if a command kills
+// it or times out.
+func (e *Engine) runInShell(command, input string, timeout time.Duration) (CommandResult, error) {
+	if e.shell == nil {
+		dir, err := e.resolvePath(e.cwd)
+		if err != nil {
+			return CommandResult{}, fmt.Errorf("current directory is no longer usable: %v", err)
+		}
+		e.shell, err = startShellSession(dir)
+		if err != nil {
+			return CommandResult{}, err
+		}
+	}
+
+	start := time.Now()
+	output, status, dir, err := e.shell.run(command, input, timeout)
+	result := CommandResult{ExitCode: status}
+	switch {
+	case err == errShellTimeout:
+		result.TimedOut = true
+		result.ExitCode = -1
+		e.closeShell()
+	case err != nil:
+		e.closeShell()
+		return CommandResult{}, fmt.Errorf("%v; a new shell will be started for the next command", err)
+	default:
+		e.syncCwd(dir)
+	}
+	result.DurationSeconds = time.Since(start).Round(time.Millisecond).Seconds()
+	result.Cwd = e.displayCwd()
+	result.Stdout, result.StdoutTruncated = truncateOutput(output)
+	return result, nil
+}
+
+// syncCwd follows a directory change made by a command in the persistent
+// shell, as long as it stays within the workspace
+func (e *Engine) syncCwd(dir string) {
+	for _, root := range []string{e.workspace, evalSymlinks(e.workspace)} {
+		if rel, err := filepath.Rel(root, dir); err == nil && isWithin(root, dir) {
+			e.cwd = rel
+			if rel == "." {
+				e.cwd = ""
+			}
+			return
+		}
+	}
+}
+
+func evalSymlinks(path string) string {
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		return resolved
+	}
+	return path
+}
+
+func (e *Engine) closeShell() {
+	if e.shell != nil {
+		e.shell.close()
+		e.shell = nil
+	}
+}
+
+// shellQuote quotes s for use as a single shell word
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
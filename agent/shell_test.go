@@ -0,0 +1,108 @@
+package agent
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunInShell(t *testing.T) {
+	e := newToolEngine(t)
+	t.Cleanup(e.closeShell)
+	writeTestFile(t, e, "sub/file.txt", "x\n")
+	run := func(command, input string, timeout time.Duration) CommandResult {
+		t.Helper()
+		result, err := e.runInShell(command, input, timeout)
+		if err != nil {
+			t.Fatalf("%s: %v", command, err)
+		}
+		return result
+	}
+
+	run("export GREETING=hello", "", 10*time.Second)
+	if result := run("echo $GREETING", "", 10*time.Second); strings.TrimSpace(result.Stdout) != "hello" {
+		t.Errorf("environment didn't carry over: %q", result.Stdout)
+	}
+	if result := run("cd sub && ls", "", 10*time.Second); e.cwd != "sub" || result.Cwd != "/sub" || !strings.Contains(result.Stdout, "file.txt") {
+		t.Errorf("directory change: cwd %q, %+v", e.cwd, result)
+	}
+	if result := run("cd / && pwd", "", 10*time.Second); e.cwd != "sub" || result.Cwd != "/sub" {
+		t.Errorf("followed the shell out of the workspace: cwd %q, %+v", e.cwd, result)
+	}
+	run("cd "+shellQuote(e.workspace), "", 10*time.Second)
+	if result := run("cat", "line one\nline two", 10*time.Second); result.Stdout != "line one\nline two\n" {
+		t.Errorf("input: %q", result.Stdout)
+	}
+	if result := run("read answer; echo got ${answer:-nothing}", "", 10*time.Second); strings.TrimSpace(result.Stdout) != "got nothing" {
+		t.Errorf("without input, a read got %q", result.Stdout)
+	}
+	if result := run("(exit 3)", "", 10*time.Second); result.ExitCode != 3 {
+		t.Errorf("exit status %d", result.ExitCode)
+	}
+	if result := run("echo '__WEX_DONE_' 'x'", "", 10*time.Second); !strings.Contains(result.Stdout, "__WEX_DONE_ x") {
+		t.Errorf("output like the marker: %q", result.Stdout)
+	}
+
+	if result := run("sleep 10", "", 200*time.Millisecond); !result.TimedOut || result.ExitCode != -1 || e.shell != nil {
+		t.Errorf("timeout: %+v, shell %v", result, e.shell)
+	}
+	if result := run("echo ${GREETING:-gone}", "", 10*time.Second); strings.TrimSpace(result.Stdout) != "gone" {
+		t.Errorf("a new shell kept the old one's environment: %q", result.Stdout)
+	}
+	if _, err := e.runInShell("exit", "", 10*time.Second); err == nil || e.shell != nil {
+		t.Errorf("a command that killed the shell: %v", err)
+	}
+	if result := run("echo again", "", 10*time.Second); strings.TrimSpace(result.Stdout) != "again" {
+		t.Errorf("after the shell exited: %q", result.Stdout)
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	for s, want := range map[string]string{
+		"plain":        `'plain'`,
+		"two words":    `'two words'`,
+		"it's":         `'it'\''s'`,
+		"$HOME `x` \\": "'$HOME `x` \\'",
+	} {
+		if got := shellQuote(s); got != want {
+			t.Errorf("%s: got %s, want %s", s, got, want)
+		}
+	}
+}
+
+func TestCommandEnv(t *testing.T) {
+	t.Setenv("OLLAMA_API_KEY", "key")
+	t.Setenv("SOME_SERVICE_PASSWORD", "hunter2")
+	t.Setenv("LC_ALL", "C")
+	t.Setenv("GOFLAGS", "-mod=mod")
+
+	// The credentials wex knows of are taken out of the environment
+	credentials := takeCredentials()
+	if credentials["OLLAMA_API_KEY"] != "key" {
+		t.Errorf("credentials %v", credentials)
+	}
+	if _, ok := os.LookupEnv("OLLAMA_API_KEY"); ok {
+		t.Error("OLLAMA_API_KEY left in the environment")
+	}
+
+	// and commands the model runs see none but the variables allowed
+	e := newToolEngine(t)
+	t.Cleanup(e.closeShell)
+	fresh, err := e.executeCommand("env", "", 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shell, err := e.runInShell("env", "", 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, result := range []CommandResult{fresh, shell} {
+		if strings.Contains(result.Stdout, "hunter2") || strings.Contains(result.Stdout, "OLLAMA_API_KEY") {
+			t.Errorf("a command saw a secret:\n%s", result.Stdout)
+		}
+		if !strings.Contains(result.Stdout, "PATH=") || !strings.Contains(result.Stdout, "LC_ALL=C") || !strings.Contains(result.Stdout, "GOFLAGS=-mod=mod") {
+			t.Errorf("a command lost its tools' variables:\n%s", result.Stdout)
+		}
+	}
+}
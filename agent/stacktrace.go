@@ -0,0 +1,204 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// maxCrashLogBytes caps how much of the crash log goes into the prompt;
+	// the end is kept, since that is where most runtimes put the cause
+	maxCrashLogBytes = 8000
+
+	// maxTraceFiles caps how many referenced files are pulled into context
+	maxTraceFiles = 8
+
+	// traceContextLines is how many lines either side of a referenced line to show
+	traceContextLines = 10
+)
+
+// traceLocation is a file and line referenced by a stack trace or compiler error
+type traceLocation struct {
+	Path string
+	Line int
+}
+
+var (
+	// File "app/main.py", line 12, in handler
+	pythonFrame = regexp.MustCompile(`File "([^"]+)", line (\d+)`)
+
+	// main.go:12, src/lib.rs:12:5, at handler (/app/server.js:12:5),
+	// and Java's at com.example.Main.run(Main.java:12)
+	pathLineFrame = regexp.MustCompile(`([\w./\\~@+-]*\w\.\w+):(\d+)`)
+)
+
+// parseStackTrace extracts file references from Go panics, Python
+// tracebacks, Node, Java and Rust traces, and compiler errors, in order
+// of first appearance
+func parseStackTrace(crashLog string) []traceLocation {
+	var locations []traceLocation
+	seen := make(map[traceLocation]bool)
+	add := func(path, line string) {
+		n, err := strconv.Atoi(line)
+		if err != nil || n < 1 {
+			return
+		}
+		loc := traceLocation{Path: path, Line: n}
+		if !seen[loc] {
+			seen[loc] = true
+			locations = append(locations, loc)
+		}
+	}
+
+	for _, line := range strings.Split(crashLog, "\n") {
+		if m := pythonFrame.FindStringSubmatch(line); m != nil {
+			add(m[1], m[2])
+			continue
+		}
+		for _, m := range pathLineFrame.FindAllStringSubmatch(line, -1) {
+			add(m[1], m[2])
+		}
+	}
+	return locations
+}
+
+// resolveTracePath maps a path from a trace to one relative to the
+// workspace. Traces may come from another machine or a container with a
+// different root, so leading directories are dropped until the rest exists;
+// a bare file name, as in Java traces, is looked up anywhere in the workspace.
+// A path that would leave the workspace, such as ../../etc/passwd or a link
+// to outside it, is never resolved, as the file goes into the prompt.
+func (e *Engine) resolveTracePath(path string) (string, bool) {
+	path = filepath.ToSlash(path)
+	if filepath.IsAbs(path) {
+		if rel, err := filepath.Rel(e.workspace, path); err == nil && isWithin(e.workspace, path) {
+			path = filepath.ToSlash(rel)
+		}
+	}
+
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	for i := range parts {
+		candidate := filepath.ToSlash(filepath.Clean(strings.Join(parts[i:], "/")))
+		if e.isTraceFile(candidate) {
+			return candidate, true
+		}
+	}
+
+	if len(parts) == 1 {
+		var found string
+		walkDir(e.files(), e.workspace, func(p string, d os.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if d.IsDir() && (skippedDirs[d.Name()] || strings.HasPrefix(d.Name(), ".")) && p != e.workspace {
+				return filepath.SkipDir
+			}
+			if !d.IsDir() && d.Name() == parts[0] {
+				if rel, _ := filepath.Rel(e.workspace, p); e.isTraceFile(filepath.ToSlash(rel)) {
+					found = filepath.ToSlash(rel)
+					return filepath.SkipAll
+				}
+			}
+			return nil
+		})
+		if found != "" {
+			return found, true
+		}
+	}
+	return "", false
+}
+
+// isTraceFile reports whether a path relative to the workspace is a file
+// in it, as the file tools would see it
+func (e *Engine) isTraceFile(path string) bool {
+	if !filepath.IsLocal(filepath.FromSlash(path)) {
+		return false
+	}
+	fullPath, err := e.resolvePath(path)
+	if err != nil {
+		return false
+	}
+	info, err := e.files().Stat(fullPath)
+	return err == nil && !info.IsDir()
+}
+
+// buildFixMessage turns a crash log into a request to fix it, with the
+// workspace code around each referenced line included, so the model can
+// start on the fix instead of hunting for the failing code
+func (e *Engine) buildFixMessage(crashLog, instructions string) string {
+	lines := make(map[string][]int)
+	var files []string
+	for _, loc := range parseStackTrace(crashLog) {
+		path, ok := e.resolveTracePath(loc.Path)
+		if !ok {
+			continue
+		}
+		if _, ok := lines[path]; !ok {
+			if len(files) == maxTraceFiles {
+				continue
+			}
+			files = append(files, path)
+		}
+		lines[path] = append(lines[path], loc.Line)
+	}
+
+	crashLog = strings.TrimSpace(crashLog)
+	if len(crashLog) > maxCrashLogBytes {
+		crashLog = "... (truncated)\n" + crashLog[len(crashLog)-maxCrashLogBytes:]
+	}
+
+	var b strings.Builder
+	b.WriteString("The program failed with the error output below. Find the cause and fix it, then run the failing command again if you can tell what it was.\n")
+	if instructions != "" {
+		fmt.Fprintf(&b, "\n%s\n", instructions)
+	}
+	fmt.Fprintf(&b, "\nError output:\n```\n%s\n```\n", crashLog)
+
+	if len(files) > 0 {
+		b.WriteString("\nCode referenced by the error:\n")
+	}
+	for _, path := range files {
+		fullPath, err := e.resolvePath(path)
+		if err != nil {
+			continue
+		}
+		content, err := e.files().ReadFile(fullPath)
+		if err != nil {
+			continue
+		}
+		source := strings.Split(string(content), "\n")
+		for _, r := range lineRanges(lines[path], len(source)) {
+			fmt.Fprintf(&b, "\n%s (lines %d-%d):\n```\n", path, r[0], r[1])
+			for n := r[0]; n <= r[1]; n++ {
+				fmt.Fprintf(&b, "%5d  %s\n", n, source[n-1])
+			}
+			b.WriteString("```\n")
+		}
+	}
+	return b.String()
+}
+
+// lineRanges returns the merged ranges of context around the given lines,
+// clamped to a file of total lines
+func lineRanges(lineNumbers []int, total int) [][2]int {
+	sort.Ints(lineNumbers)
+	var ranges [][2]int
+	for _, n := range lineNumbers {
+		if n > total {
+			continue
+		}
+		start := max(1, n-traceContextLines)
+		end := min(total, n+traceContextLines)
+		if len(ranges) > 0 && start <= ranges[len(ranges)-1][1]+1 {
+			ranges[len(ranges)-1][1] = max(ranges[len(ranges)-1][1], end)
+			continue
+		}
+		ranges = append(ranges, [2]int{start, end})
+	}
+	return ranges
+}
@@ -0,0 +1,91 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseStackTrace(t *testing.T) {
+	for _, test := range []struct {
+		name, log string
+		want      []traceLocation
+	}{
+		{"go panic", "panic: runtime error: index out of range\n\ngoroutine 1 [running]:\nmain.parse(...)\n\t/app/parse.go:12 +0x1d\nmain.main()\n\t/app/main.go:8 +0x25\n",
+			[]traceLocation{{"/app/parse.go", 12}, {"/app/main.go", 8}}},
+		{"python", "Traceback (most recent call last):\n  File \"app/main.py\", line 3, in <module>\n  File \"app/util.py\", line 7, in f\nZeroDivisionError: division by zero\n",
+			[]traceLocation{{"app/main.py", 3}, {"app/util.py", 7}}},
+		{"node", "TypeError: x is undefined\n    at handler (/srv/server.js:14:5)\n    at Layer.handle (node_modules/express/lib/router/layer.js:95:5)\n",
+			[]traceLocation{{"/srv/server.js", 14}, {"node_modules/express/lib/router/layer.js", 95}}},
+		{"java", "Exception in thread \"main\" java.lang.NullPointerException\n\tat com.example.Main.run(Main.java:21)\n",
+			[]traceLocation{{"Main.java", 21}}},
+		{"rust", "thread 'main' panicked at src/lib.rs:42:9:\nattempt to divide by zero\n",
+			[]traceLocation{{"src/lib.rs", 42}}},
+		{"compiler errors, repeated", "./main.go:5:2: undefined: x\n./main.go:5:2: undefined: x\n./main.go:9:1: missing return\n",
+			[]traceLocation{{"./main.go", 5}, {"./main.go", 9}}},
+		{"line zero", "main.go:0: nothing\n", nil},
+		{"no locations", "Segmentation fault (core dumped)\n", nil},
+	} {
+		if got := parseStackTrace(test.log); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestResolveTracePath(t *testing.T) {
+	e := newToolEngine(t)
+	writeTestFile(t, e, "app/main.py", "print(1)\n")
+	writeTestFile(t, e, "src/com/example/Main.java", "class Main {}\n")
+	writeTestFile(t, e, "node_modules/lib/Main.java", "class Main {}\n")
+	outside := filepath.Join(t.TempDir(), "secret.py")
+	if err := os.WriteFile(outside, []byte("key = 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(e.workspace, "app", "link.py")); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, want := range map[string]string{
+		"app/main.py":   "app/main.py",
+		"./app/main.py": "app/main.py",
+		filepath.Join(e.workspace, "app/main.py"): "app/main.py",
+		"/usr/src/project/app/main.py":            "app/main.py",
+		"Main.java":                               "src/com/example/Main.java",
+		"app/missing.py":                          "",
+		"app":                                     "",
+		"../" + filepath.Base(filepath.Dir(outside)) + "/secret.py": "",
+		outside:                        "",
+		"app/link.py":                  "",
+		"../../../../../../etc/passwd": "",
+	} {
+		got, ok := e.resolveTracePath(path)
+		if got != want || ok != (want != "") {
+			t.Errorf("%s: got %q, %v, want %q", path, got, ok, want)
+		}
+	}
+}
+
+func TestBuildFixMessage(t *testing.T) {
+	e := newToolEngine(t)
+	var source []string
+	for i := 1; i <= 40; i++ {
+		source = append(source, "line "+strings.Repeat("x", i%3))
+	}
+	writeTestFile(t, e, "main.go", strings.Join(source, "\n"))
+
+	message := e.buildFixMessage("panic: boom\n\n/build/main.go:5 +0x1\n/build/main.go:30 +0x2\n../../etc/passwd:1\n", "Keep the API")
+	for _, want := range []string{"Keep the API", "panic: boom", "main.go (lines 1-15):", "main.go (lines 20-40):", "    5  line xx"} {
+		if !strings.Contains(message, want) {
+			t.Errorf("message doesn't include %q:\n%s", want, message)
+		}
+	}
+	if strings.Contains(message, "passwd (lines") {
+		t.Errorf("message includes a file outside the workspace:\n%s", message)
+	}
+
+	if got := lineRanges([]int{50, 12, 1}, 20); !reflect.DeepEqual(got, [][2]int{{1, 20}}) {
+		t.Errorf("line ranges: %v", got)
+	}
+}
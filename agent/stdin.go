@@ -0,0 +1,141 @@
+package agent
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// With --stdin, the request comes on standard input in one piece, so an
+// editor or CI job can send the prompt and files without temporary files:
+//
+//	wex-input/1
+//	file src/main.go 1234
+//	<1234 bytes>
+//	prompt 27
+//	<27 bytes>
+//
+// Each item is a line giving its kind and length in bytes, then that many
+// bytes, which may be followed by a newline for readability. A file's name
+// is everything between the kind and the length, so it may hold spaces.
+
+// stdinHeader is the first line of the input
+const stdinHeader = "wex-input/1"
+
+// maxStdinBytes limits the whole input, which all goes into the first message
+const maxStdinBytes = 16 << 20
+
+type stdinFile struct {
+	Name    string
+	Content string
+}
+
+type stdinInput struct {
+	Prompt string
+	Files  []stdinFile
+}
+
+func parseStdinInput(r io.Reader) (*stdinInput, error) {
+	br := bufio.NewReader(io.LimitReader(r, maxStdinBytes+1))
+	header, err := br.ReadString('\n')
+	if strings.TrimRight(header, "\r\n") != stdinHeader {
+		if err != nil && header == "" {
+			return nil, fmt.Errorf("no input")
+		}
+		return nil, fmt.Errorf("input does not start with %q", stdinHeader)
+	}
+
+	var in stdinInput
+	total := 0
+	for n := 2; ; n++ {
+		line, err := br.ReadString('\n')
+		if err == io.EOF && line == "" {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("failed to read input: %v", err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: want a kind and a length, got %q", n, line)
+		}
+		length, err := strconv.Atoi(fields[len(fields)-1])
+		if err != nil || length < 0 {
+			return nil, fmt.Errorf("line %d: invalid length %q", n, fields[len(fields)-1])
+		}
+		kind, name := fields[0], ""
+		switch kind {
+		case "prompt":
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("line %d: a prompt has no name", n)
+			}
+		case "file":
+			name = strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(line, kind), fields[len(fields)-1]))
+			if name == "" {
+				return nil, fmt.Errorf("line %d: a file needs a name", n)
+			}
+		default:
+			return nil, fmt.Errorf("line %d: unknown kind %q: must be file or prompt", n, kind)
+		}
+
+		total += length
+		if total > maxStdinBytes {
+			return nil, fmt.Errorf("input is over %d bytes", maxStdinBytes)
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(br, data); err != nil {
+			if errors.Is(err, io.ErrUnexpectedEOF) || err == io.EOF {
+				return nil, fmt.Errorf("line %d: input ends before the %d bytes given", n, length)
+			}
+			return nil, fmt.Errorf("failed to read input: %v", err)
+		}
+		n += strings.Count(string(data), "\n")
+
+		if kind == "file" {
+			in.Files = append(in.Files, stdinFile{Name: name, Content: string(data)})
+		} else if in.Prompt != "" {
+			in.Prompt += "\n\n" + string(data)
+		} else {
+			in.Prompt = string(data)
+		}
+	}
+	return &in, nil
+}
+
+// message makes the user message, with any instructions given as
+// arguments after the prompt, and the files after that
+func (in *stdinInput) message(instructions string) string {
+	var b strings.Builder
+	b.WriteString(strings.TrimSpace(in.Prompt))
+	if instructions != "" {
+		if b.Len() > 0 {
+			b.WriteString("\n\n")
+		}
+		b.WriteString(instructions)
+	}
+	if len(in.Files) > 0 {
+		b.WriteString("\n\nThese files were sent with the request, and may be newer than the copies in the workspace:\n")
+	}
+	for _, file := range in.Files {
+		fence := codeFence(file.Content)
+		fmt.Fprintf(&b, "\n%s:\n%s\n%s\n%s\n", file.Name, fence, strings.TrimRight(file.Content, "\n"), fence)
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// codeFence returns a Markdown fence longer than any run of backquotes in
+// text, so the text can't end the block early
+func codeFence(text string) string {
+	fence := "```"
+	for strings.Contains(text, fence) {
+		fence += "`"
+	}
+	return fence
+}
@@ -0,0 +1,50 @@
+package agent
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseStdinInput(t *testing.T) {
+	source := "package main\n\n// ```fenced``` in a comment\nfunc main() {}\n"
+	input := "wex-input/1\n" +
+		"file src/my main.go 58\n" + source + "\n" +
+		"file notes.txt 2\nhi" +
+		"prompt 24\nExplain main.go\nbriefly\n"
+	in, err := parseStdinInput(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(in.Files) != 2 || in.Files[0].Name != "src/my main.go" || in.Files[0].Content != source || in.Files[1].Content != "hi" {
+		t.Errorf("files: %+v", in.Files)
+	}
+	if in.Prompt != "Explain main.go\nbriefly\n" {
+		t.Errorf("prompt: %q", in.Prompt)
+	}
+
+	message := in.message("Mention the comment.")
+	for _, want := range []string{
+		"Explain main.go\nbriefly\n\nMention the comment.\n\nThese files",
+		"src/my main.go:\n````\npackage main",
+		"func main() {}\n````\n",
+		"notes.txt:\n```\nhi\n```",
+	} {
+		if !strings.Contains(message, want) {
+			t.Errorf("message lacks %q:\n%s", want, message)
+		}
+	}
+
+	for _, bad := range []string{
+		"",
+		"Explain main.go",
+		"wex-input/1\nprompt\n",
+		"wex-input/1\nprompt ten\n",
+		"wex-input/1\nfile 5\nhello",
+		"wex-input/1\nfolder src 0\n",
+		"wex-input/1\nprompt 100\ntoo short",
+	} {
+		if _, err := parseStdinInput(strings.NewReader(bad)); err == nil {
+			t.Errorf("parsed %q", bad)
+		}
+	}
+}
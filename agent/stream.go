@@ -0,0 +1,149 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// With stream:true, /api/chat sends its reply as newline-delimited JSON,
+// a chunk at a time, with the last marked done. Text is passed on as it
+// comes, so a slow model can be watched as it writes. Tool calls usually
+// come whole in one chunk, but some servers send them in pieces, in the
+// manner of OpenAI's deltas: a call's index or ID, and its name, come
+// first, and then its arguments as fragments of a JSON string, so the
+// pieces are put together as they arrive.
+
+// streamChunk is one line of a streamed reply
+type streamChunk struct {
+	Message struct {
+		Role      string           `json:"role"`
+		Content   string           `json:"content"`
+		ToolCalls []streamToolCall `json:"tool_calls,omitempty"`
+	} `json:"message"`
+	Done  bool   `json:"done"`
+	Error string `json:"error,omitempty"`
+}
+
+// streamToolCall is a tool call, or a piece of one; the index may be at
+// the top, as OpenAI has it, or in the function, as Ollama does
+type streamToolCall struct {
+	Index    *int   `json:"index,omitempty"`
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Index     *int            `json:"index,omitempty"`
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	} `json:"function"`
+}
+
+// partialToolCall is a tool call being put together
+type partialToolCall struct {
+	index     int
+	call      ToolCall
+	arguments strings.Builder
+}
+
+// streamAssembler builds a reply from its chunks
+type streamAssembler struct {
+	resp  ChatResponse
+	calls []*partialToolCall
+}
+
+func (a *streamAssembler) add(chunk *streamChunk) {
+	if chunk.Message.Role != "" {
+		a.resp.Message.Role = chunk.Message.Role
+	}
+	a.resp.Message.Content += chunk.Message.Content
+	for _, delta := range chunk.Message.ToolCalls {
+		a.addToolCall(delta)
+	}
+	if chunk.Done {
+		a.resp.Done = true
+	}
+}
+
+// addToolCall adds a piece of a tool call to the call it belongs to: the
+// one with its index or ID, or without either, the last one if the piece
+// has no name of its own
+func (a *streamAssembler) addToolCall(delta streamToolCall) {
+	index := delta.Index
+	if index == nil {
+		index = delta.Function.Index
+	}
+	var p *partialToolCall
+	for _, c := range a.calls {
+		if index != nil && c.index == *index || index == nil && delta.ID != "" && c.call.ID == delta.ID {
+			p = c
+		}
+	}
+	if p == nil && index == nil && delta.ID == "" && delta.Function.Name == "" && len(a.calls) > 0 {
+		p = a.calls[len(a.calls)-1]
+	}
+	if p == nil {
+		p = &partialToolCall{index: len(a.calls)}
+		if index != nil {
+			p.index = *index
+		}
+		a.calls = append(a.calls, p)
+	}
+
+	if delta.ID != "" {
+		p.call.ID = delta.ID
+	}
+	if delta.Type != "" {
+		p.call.Type = delta.Type
+	}
+	if delta.Function.Name != "" {
+		p.call.Function.Name = delta.Function.Name
+	}
+	args := delta.Function.Arguments
+	var fragment string
+	switch {
+	case len(args) == 0 || string(args) == "null":
+	case json.Unmarshal(args, &fragment) == nil:
+		p.arguments.WriteString(fragment)
+	default:
+		p.arguments.Write(args)
+	}
+}
+
+// response is the whole reply, once the stream has ended
+func (a *streamAssembler) response() *ChatResponse {
+	resp := a.resp
+	resp.Message.ToolCalls = nil
+	for _, p := range a.calls {
+		call := p.call
+		call.Function.Arguments = json.RawMessage(p.arguments.String())
+		if strings.TrimSpace(p.arguments.String()) == "" {
+			call.Function.Arguments = json.RawMessage("{}")
+		}
+		resp.Message.ToolCalls = append(resp.Message.ToolCalls, call)
+	}
+	return &resp
+}
+
+// readChatStream reads a streamed reply, calling onText, if not nil, with
+// each piece of text as it arrives
+func readChatStream(body io.Reader, onText func(text string)) (*ChatResponse, error) {
+	var a streamAssembler
+	decoder := json.NewDecoder(body)
+	for !a.resp.Done {
+		var chunk streamChunk
+		if err := decoder.Decode(&chunk); err == io.EOF {
+			return nil, fmt.Errorf("stream ended without a done chunk")
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to decode stream chunk: %v", err)
+		}
+		if chunk.Error != "" {
+			return nil, fmt.Errorf("model server failed during the reply: %s", chunk.Error)
+		}
+		if chunk.Message.Content != "" && onText != nil {
+			onText(chunk.Message.Content)
+		}
+		a.add(&chunk)
+	}
+	return a.response(), nil
+}
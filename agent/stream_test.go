@@ -0,0 +1,118 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadChatStream(t *testing.T) {
+	stream := `{"message": {"role": "assistant", "content": "Let me "}, "done": false}
+{"message": {"content": "write it."}, "done": false}
+{"message": {"tool_calls": [{"index": 0, "id": "call_1", "function": {"name": "write_file", "arguments": "{\"path\": \"a"}}]}, "done": false}
+{"message": {"tool_calls": [{"index": 0, "function": {"arguments": ".txt\", \"content\": \"x\"}"}}]}, "done": false}
+{"message": {"tool_calls": [{"function": {"index": 1, "name": "read_file", "arguments": {"path": "b.txt"}}}]}, "done": false}
+{"message": {"tool_calls": [{"function": {"name": "list_files"}}]}, "done": false}
+{"message": {"content": ""}, "done": true}
+`
+	var pieces []string
+	resp, err := readChatStream(strings.NewReader(stream), func(text string) { pieces = append(pieces, text) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(pieces, "|") != "Let me |write it." || resp.Message.Content != "Let me write it." || resp.Message.Role != "assistant" || !resp.Done {
+		t.Errorf("pieces %q, response %+v", pieces, resp)
+	}
+	calls := resp.Message.ToolCalls
+	if len(calls) != 3 {
+		t.Fatalf("calls %+v", calls)
+	}
+	for i, want := range []string{`write_file call_1 {"path": "a.txt", "content": "x"}`, `read_file  {"path": "b.txt"}`, `list_files  {}`} {
+		got := calls[i].Function.Name + " " + calls[i].ID + " " + string(calls[i].Function.Arguments)
+		if got != want {
+			t.Errorf("call %d is %s, want %s", i, got, want)
+		}
+	}
+	if !json.Valid(calls[0].Function.Arguments) {
+		t.Errorf("arguments %s", calls[0].Function.Arguments)
+	}
+
+	for stream, want := range map[string]string{
+		`{"message": {"content": "Hel"}, "done": false}`:                                       "stream ended without a done chunk",
+		`{"message": {"content": "Hel"}, "done": false}` + "\n" + `{"error": "out of memory"}`: "failed during the reply: out of memory",
+	} {
+		if _, err := readChatStream(strings.NewReader(stream), nil); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("error %v, want %q", err, want)
+		}
+	}
+}
+
+func TestStreaming(t *testing.T) {
+	replies := [][]string{
+		{
+			`{"message": {"role": "assistant", "content": "Writing"}, "done": false}`,
+			`{"message": {"role": "assistant", "content": " it.", "tool_calls": [{"function": {"name": "write_file", "arguments": {"path": "a.txt", "content": "hi\n"}}}]}, "done": false}`,
+			`{"message": {"role": "assistant", "content": ""}, "done": true}`,
+		},
+		{
+			`{"message": {"role": "assistant", "content": "Done"}, "done": false}`,
+			`{"message": {"role": "assistant", "content": "."}, "done": true}`,
+		},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req ChatRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !req.Stream || len(replies) == 0 {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		for _, line := range replies[0] {
+			w.Write([]byte(line + "\n"))
+			w.(http.Flusher).Flush()
+		}
+		replies = replies[1:]
+	}))
+	t.Cleanup(srv.Close)
+
+	var events []Event
+	e, err := New(
+		WithWorkspace(t.TempDir()),
+		WithProvider(srv.Client(), srv.URL, "test"),
+		WithStreaming(),
+		WithSystemPrompt("Test."),
+		WithEvents(func(event Event) { events = append(events, event) }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := e.Run(context.Background(), "Write a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Reply != "Done." || result.Turns != 2 {
+		t.Errorf("result %+v", result)
+	}
+	if data, err := os.ReadFile(filepath.Join(e.workspace, "a.txt")); err != nil || string(data) != "hi\n" {
+		t.Errorf("a.txt has %q, %v", data, err)
+	}
+
+	var shown []string
+	for _, event := range events {
+		switch event.Type {
+		case EventAssistantDelta:
+			shown = append(shown, event.Text)
+		case EventAssistantText:
+			if !event.Streamed {
+				t.Errorf("assistant_text not marked streamed: %+v", event)
+			}
+			shown = append(shown, "/")
+		}
+	}
+	if got := strings.Join(shown, "|"); got != "Writing| it.|/|Done|.|/" {
+		t.Errorf("shown %s", got)
+	}
+}
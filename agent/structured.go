@@ -0,0 +1,1454 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Configuration files are edited in place: the file is parsed only far
+// enough to find the span of text holding each value, and an update
+// replaces that span, or inserts a new member after the last one, so
+// comments, key order and formatting elsewhere are untouched.
+
+// docNode is a value in a JSON, YAML or TOML document
+type docNode struct {
+	kind       string // "object", "array" or "scalar"
+	start, end int    // span of the value's text, replaced by an update
+
+	// prefix goes before a replacement value, for a YAML block value whose
+	// span starts right after "key:"
+	prefix string
+
+	keys     []string // object member names, in order
+	children []*docNode
+
+	// insertAt is where a new member goes, or -1 if one can't be added
+	// here; indent is the indentation of members, or "" for members on
+	// one line. For flow collections, closeAt is the closing bracket.
+	insertAt int
+	indent   string
+	flow     bool
+	closeAt  int
+
+	// A TOML table defined by dotted keys gets new keys in the section
+	// that owns it, written with keyPrefix. header names a TOML table that
+	// has no place of its own, so a new key needs a new [header] at the end
+	// of the file.
+	owner     *docNode
+	keyPrefix string
+	header    string
+
+	// alias is the anchored value a YAML alias, *name, stands for
+	alias *docNode
+}
+
+func (n *docNode) member(key string) *docNode {
+	for i, k := range n.keys {
+		if k == key {
+			return n.children[i]
+		}
+	}
+	return nil
+}
+
+// pathSegment is an object key or an array index in a query
+type pathSegment struct {
+	key     string
+	index   int
+	isIndex bool
+}
+
+func (s pathSegment) String() string {
+	if s.isIndex {
+		return fmt.Sprintf("[%d]", s.index)
+	}
+	if bareKey.MatchString(s.key) {
+		return "." + s.key
+	}
+	return fmt.Sprintf("[%s]", strconv.Quote(s.key))
+}
+
+var bareKey = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// parseQuery parses a jq-style path such as .scripts.build, .items[0].name
+// or .dependencies["@types/node"]
+func parseQuery(query string) ([]pathSegment, error) {
+	q := strings.TrimSpace(query)
+	q = strings.TrimPrefix(q, "$")
+	var path []pathSegment
+	for i := 0; i < len(q); {
+		switch {
+		case q[i] == '.':
+			i++
+		case q[i] == '[':
+			end := strings.IndexByte(q[i:], ']')
+			if q[i+1:] != "" && (q[i+1] == '"' || q[i+1] == '\'') {
+				key, n, err := quotedKey(q[i+1:])
+				if err != nil || !strings.HasPrefix(q[i+1+n:], "]") {
+					return nil, fmt.Errorf("invalid query %q: unterminated [\"key\"]", query)
+				}
+				path = append(path, pathSegment{key: key})
+				i += n + 2
+				continue
+			}
+			if end < 0 {
+				return nil, fmt.Errorf("invalid query %q: missing ]", query)
+			}
+			index, err := strconv.Atoi(strings.TrimSpace(q[i+1 : i+end]))
+			if err != nil {
+				return nil, fmt.Errorf("invalid query %q: %q is not an index", query, q[i+1:i+end])
+			}
+			path = append(path, pathSegment{index: index, isIndex: true})
+			i += end + 1
+		case q[i] == '"' || q[i] == '\'':
+			key, n, err := quotedKey(q[i:])
+			if err != nil {
+				return nil, fmt.Errorf("invalid query %q: %v", query, err)
+			}
+			path = append(path, pathSegment{key: key})
+			i += n
+		default:
+			j := i
+			for j < len(q) && q[j] != '.' && q[j] != '[' {
+				j++
+			}
+			path = append(path, pathSegment{key: q[i:j]})
+			i = j
+		}
+	}
+	return path, nil
+}
+
+// quotedKey reads a quoted string at the start of s, returning it and its
+// length in s
+func quotedKey(s string) (string, int, error) {
+	quote := s[0]
+	for i := 1; i < len(s); i++ {
+		if s[i] == '\\' && quote == '"' {
+			i++
+			continue
+		}
+		if s[i] == quote {
+			if quote == '\'' {
+				// In single quotes, a quote is written twice
+				if i+1 < len(s) && s[i+1] == '\'' {
+					i++
+					continue
+				}
+				return strings.ReplaceAll(s[1:i], "''", "'"), i + 1, nil
+			}
+			key, err := strconv.Unquote(s[:i+1])
+			return key, i + 1, err
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string")
+}
+
+func formatQuery(path []pathSegment) string {
+	var b strings.Builder
+	for _, s := range path {
+		b.WriteString(s.String())
+	}
+	if b.Len() == 0 {
+		return "."
+	}
+	return b.String()
+}
+
+// documentFormat picks json, yaml or toml from the file extension, unless
+// given explicitly
+func documentFormat(path, format string) (string, error) {
+	if format == "" {
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".json":
+			format = "json"
+		case ".yaml", ".yml":
+			format = "yaml"
+		case ".toml":
+			format = "toml"
+		}
+	}
+	switch format {
+	case "json", "yaml", "toml":
+		return format, nil
+	case "":
+		return "", fmt.Errorf("cannot tell the format of %s from its extension; pass format", path)
+	}
+	return "", fmt.Errorf("unknown format %q: must be json, yaml or toml", format)
+}
+
+func parseDocument(format, text string) (*docNode, error) {
+	switch format {
+	case "json":
+		return parseJSONDocument(text)
+	case "yaml":
+		return parseYAMLDocument(text)
+	}
+	return parseTOMLDocument(text)
+}
+
+// lookup follows a path as far as it goes, returning the last node found
+// and how many segments that took. With follow, YAML aliases are read as
+// the values they stand for; without it, a path through an alias is
+// refused, since changing what it stands for would change every alias.
+func lookup(root *docNode, path []pathSegment, follow bool) (*docNode, int, error) {
+	n := root
+	for i, seg := range path {
+		if n.alias != nil {
+			if !follow {
+				return n, i, fmt.Errorf("%s is a YAML alias; change the anchored value it stands for, which every alias shares", formatQuery(path[:i]))
+			}
+			n = n.alias
+		}
+		var next *docNode
+		switch {
+		case seg.isIndex:
+			if n.kind != "array" {
+				return n, i, fmt.Errorf("%s is not an array", formatQuery(path[:i]))
+			}
+			index := seg.index
+			if index < 0 {
+				index += len(n.children)
+			}
+			if index >= 0 && index < len(n.children) {
+				next = n.children[index]
+			}
+		default:
+			if n.kind != "object" {
+				return n, i, fmt.Errorf("%s is not an object", formatQuery(path[:i]))
+			}
+			next = n.member(seg.key)
+		}
+		if next == nil {
+			return n, i, nil
+		}
+		n = next
+	}
+	if follow && n.alias != nil {
+		n = n.alias
+	}
+	return n, len(path), nil
+}
+
+func readJSONPathTool() Tool {
+	return Tool{
+		Type: "function",
+		Function: Function{
+			Name:        "read_json_path",
+			Description: "Read one value from a JSON, YAML or TOML file by path, e.g. .scripts.build in package.json, .image.tag in values.yaml or .dependencies.serde in Cargo.toml",
+			Parameters: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"path": map[string]interface{}{
+						"type":        "string",
+						"description": "File path relative to workspace",
+					},
+					"query": map[string]interface{}{
+						"type":        "string",
+						"description": "Path to the value, e.g. .a.b, .items[0].name or .deps[\"@types/node\"]; \".\" for the whole document",
+					},
+					"format": map[string]interface{}{
+						"type":        "string",
+						"enum":        []string{"json", "yaml", "toml"},
+						"description": "File format (optional, default from the extension)",
+					},
+				},
+				"required": []string{"path", "query"},
+			},
+		},
+	}
+}
+
+func updateJSONPathTool() Tool {
+	return Tool{
+		Type: "function",
+		Function: Function{
+			Name:        "update_json_path",
+			Description: "Set one value in a JSON, YAML or TOML file by path, changing only that value's text, so comments and formatting are kept. Missing keys are added; use an index one past the end of an array to append. Prefer this to rewriting configuration files with write_file",
+			Parameters: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"path": map[string]interface{}{
+						"type":        "string",
+						"description": "File path relative to workspace",
+					},
+					"query": map[string]interface{}{
+						"type":        "string",
+						"description": "Path to the value, e.g. .scripts.test or .tool.ruff[\"line-length\"]",
+					},
+					"value": map[string]interface{}{
+						"description": "New value, as JSON: a string, number, boolean, array or object",
+					},
+					"format": map[string]interface{}{
+						"type":        "string",
+						"enum":        []string{"json", "yaml", "toml"},
+						"description": "File format (optional, default from the extension)",
+					},
+				},
+				"required": []string{"path", "query", "value"},
+			},
+		},
+	}
+}
+
+// loadDocument reads and parses a structured file
+func (e *Engine) loadDocument(path, format string) (string, string, *docNode, error) {
+	format, err := documentFormat(path, format)
+	if err != nil {
+		return "", "", nil, err
+	}
+	fullPath, err := e.resolvePath(path)
+	if err != nil {
+		return "", "", nil, err
+	}
+	unlock := e.locks.read(fullPath)
+	content, err := e.files().ReadFile(fullPath)
+	unlock()
+	if err != nil {
+		return "", "", nil, fmt.Errorf("failed to read file: %v", err)
+	}
+	text, _ := decodeText(content)
+	root, err := parseDocument(format, text)
+	if err != nil {
+		return "", "", nil, fmt.Errorf("failed to parse %s as %s: %v", path, strings.ToUpper(format), err)
+	}
+	return text, format, root, nil
+}
+
+func (e *Engine) readJSONPath(args json.RawMessage) (string, error) {
+	var params struct {
+		Path   string `json:"path"`
+		Query  string `json:"query"`
+		Format string `json:"format"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return "", fmt.Errorf("invalid arguments: %v", err)
+	}
+	path, err := parseQuery(params.Query)
+	if err != nil {
+		return "", err
+	}
+	text, format, root, err := e.loadDocument(params.Path, params.Format)
+	if err != nil {
+		return "", err
+	}
+
+	n, found, err := lookup(root, path, true)
+	if err != nil {
+		return "", err
+	}
+	if found < len(path) {
+		return "", notFound(n, path[:found+1])
+	}
+	value := text[n.start:n.end]
+	switch {
+	case format == "json":
+		var b bytes.Buffer
+		if json.Indent(&b, []byte(value), "", "  ") == nil {
+			value = b.String()
+		}
+	case format == "toml" && !n.flow && n.kind != "scalar":
+		// Tables are spread across the file, so list their keys
+		var lines []string
+		tomlLines(text, n, "", &lines)
+		value = strings.Join(lines, "\n")
+	case strings.TrimSpace(value) == "":
+		value = "null"
+	case n.prefix != "":
+		value = dedent(value)
+	}
+	return value, nil
+}
+
+// tomlLines lists the values in a table as dotted keys, e.g.
+// tool.ruff.line-length = 88
+func tomlLines(text string, n *docNode, prefix string, lines *[]string) {
+	for i, child := range n.children {
+		name := prefix
+		if n.kind == "object" {
+			name += quoteTOMLKeys(n.keys[i : i+1])[0]
+		} else {
+			name = fmt.Sprintf("%s[%d]", strings.TrimSuffix(name, "."), i)
+		}
+		if child.flow || child.kind == "scalar" {
+			*lines = append(*lines, name+" = "+text[child.start:child.end])
+		} else {
+			tomlLines(text, child, name+".", lines)
+		}
+	}
+}
+
+// notFound explains a missing key or index, listing what is there instead
+func notFound(n *docNode, path []pathSegment) error {
+	last := path[len(path)-1]
+	if last.isIndex {
+		return fmt.Errorf("%s not found: the array has %d items", formatQuery(path), len(n.children))
+	}
+	return fmt.Errorf("%s not found; keys of %s are: %s", formatQuery(path), formatQuery(path[:len(path)-1]), strings.Join(n.keys, ", "))
+}
+
+func (e *Engine) updateJSONPath(args json.RawMessage) (string, error) {
+	var params struct {
+		Path   string          `json:"path"`
+		Query  string          `json:"query"`
+		Value  json.RawMessage `json:"value"`
+		Format string          `json:"format"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return "", fmt.Errorf("invalid arguments: %v", err)
+	}
+	if len(params.Value) == 0 {
+		return "", fmt.Errorf("missing value")
+	}
+	path, err := parseQuery(params.Query)
+	if err != nil {
+		return "", err
+	}
+	if len(path) == 0 {
+		return "", fmt.Errorf("cannot replace the whole document; use write_file")
+	}
+	text, format, root, err := e.loadDocument(params.Path, params.Format)
+	if err != nil {
+		return "", err
+	}
+
+	n, found, err := lookup(root, path, false)
+	if err != nil {
+		return "", err
+	}
+	var updated, action string
+	if found == len(path) {
+		if format == "toml" && !n.flow && n.kind != "scalar" {
+			return "", fmt.Errorf("%s is a table; update its keys one at a time", formatQuery(path))
+		}
+		value, err := encodeValue(format, params.Value, lineIndent(text, n.start), text)
+		if err != nil {
+			return "", err
+		}
+		updated = text[:n.start] + n.prefix + value + text[n.end:]
+		old := strings.TrimSpace(text[n.start:n.end])
+		if len(old) > 200 {
+			old = old[:200] + "..."
+		}
+		action = fmt.Sprintf("Changed %s from %s to %s", formatQuery(path), old, value)
+	} else {
+		updated, err = addMember(format, text, n, path[:found], path[found:], params.Value)
+		if err != nil {
+			return "", err
+		}
+		action = fmt.Sprintf("Added %s", formatQuery(path))
+	}
+
+	// Make sure the edit left a document that still parses
+	if _, err := parseDocument(format, updated); err != nil {
+		return "", fmt.Errorf("the update would leave %s unparseable (%v); edit it with write_file instead", params.Path, err)
+	}
+	if format == "json" && !json.Valid([]byte(updated)) {
+		return "", fmt.Errorf("the update would leave %s invalid JSON; edit it with write_file instead", params.Path)
+	}
+	if err := e.saveFile(params.Path, updated, ""); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s in %s", action, params.Path), nil
+}
+
+// addMember adds the missing part of a path under n, the deepest node
+// that exists. Missing objects along the way are created around the value.
+func addMember(format, text string, n *docNode, have, missing []pathSegment, value json.RawMessage) (string, error) {
+	first := missing[0]
+	if first.isIndex {
+		if len(missing) > 1 || first.index != len(n.children) {
+			return "", fmt.Errorf("%s not found: the array has %d items; use index %d to append", formatQuery(append(have, first)), len(n.children), len(n.children))
+		}
+	} else {
+		for _, seg := range missing[1:] {
+			if seg.isIndex {
+				return "", fmt.Errorf("%s not found, and only objects are created for missing keys", formatQuery(append(have, missing...)))
+			}
+		}
+	}
+
+	if format == "toml" {
+		return addTOMLMember(text, n, have, missing, value)
+	}
+
+	// Wrap the value in objects for the keys after the first
+	for i := len(missing) - 1; i > 0; i-- {
+		key, _ := json.Marshal(missing[i].key)
+		value = json.RawMessage(fmt.Sprintf("{%s: %s}", key, value))
+	}
+	if n.insertAt < 0 {
+		return "", fmt.Errorf("cannot add to %s here; edit it with write_file", formatQuery(have))
+	}
+
+	indent := n.indent
+	encoded, err := encodeValue(format, value, indent, text)
+	if err != nil {
+		return "", err
+	}
+	var member string
+	if format == "json" {
+		member = encoded
+		if !first.isIndex {
+			key, _ := json.Marshal(first.key)
+			member = string(key) + ": " + encoded
+		}
+	} else if first.isIndex {
+		member = "- " + encoded
+	} else {
+		member = yamlKey(first.key) + ": " + encoded
+	}
+
+	switch {
+	case format == "json" && len(n.children) == 0:
+		return text[:n.insertAt] + member + text[n.insertAt:], nil
+	case format == "json" && n.indent == "" && !strings.Contains(text[n.start:n.end], "\n"):
+		return text[:n.insertAt] + ", " + member + text[n.insertAt:], nil
+	case format == "json":
+		return text[:n.insertAt] + ",\n" + indent + member + text[n.insertAt:], nil
+	case n.flow:
+		sep := ", "
+		if len(n.children) == 0 {
+			sep = ""
+		}
+		if !first.isIndex {
+			member = yamlKey(first.key) + ": " + encoded
+		} else {
+			member = encoded
+		}
+		return text[:n.insertAt] + sep + member + text[n.insertAt:], nil
+	case n.insertAt == 0 && strings.TrimSpace(text) == "":
+		return member + "\n", nil
+	}
+	return text[:n.insertAt] + "\n" + indent + member + text[n.insertAt:], nil
+}
+
+// encodeValue writes a JSON value in a file's format; indent is that of
+// the line the value starts on
+func encodeValue(format string, value json.RawMessage, indent, text string) (string, error) {
+	switch format {
+	case "json":
+		var b bytes.Buffer
+		if !strings.Contains(text, "\n") {
+			err := json.Compact(&b, value)
+			return b.String(), err
+		}
+		if err := json.Indent(&b, value, indent, indentUnit(text)); err != nil {
+			return "", fmt.Errorf("invalid value: %v", err)
+		}
+		return b.String(), nil
+	case "yaml":
+		var s string
+		if err := json.Unmarshal(value, &s); err == nil && plainYAML.MatchString(s) && !yamlReserved[strings.ToLower(s)] && !numeric(s) {
+			return s, nil
+		}
+		var b bytes.Buffer
+		if err := json.Compact(&b, value); err != nil {
+			return "", fmt.Errorf("invalid value: %v", err)
+		}
+		return b.String(), nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(value))
+	dec.UseNumber()
+	return tomlValue(dec)
+}
+
+var (
+	plainYAML    = regexp.MustCompile(`^[A-Za-z0-9_/][A-Za-z0-9_ ./@+=-]*$`)
+	yamlReserved = map[string]bool{"true": true, "false": true, "null": true, "yes": true, "no": true, "on": true, "off": true, "y": true, "n": true, "~": true}
+)
+
+func numeric(s string) bool {
+	_, err := strconv.ParseFloat(s, 64)
+	return err == nil
+}
+
+func yamlKey(key string) string {
+	if plainYAML.MatchString(key) && !strings.HasSuffix(key, " ") {
+		return key
+	}
+	return strconv.Quote(key)
+}
+
+// indentUnit is the smallest indentation used in a file, or two spaces
+func indentUnit(text string) string {
+	unit := ""
+	for _, line := range strings.Split(text, "\n") {
+		indent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+		if indent != "" && indent != line && (unit == "" || len(indent) < len(unit)) {
+			unit = indent
+		}
+	}
+	if unit == "" {
+		return "  "
+	}
+	return unit
+}
+
+// lineIndent is the indentation of the line containing pos
+func lineIndent(text string, pos int) string {
+	start := strings.LastIndexByte(text[:pos], '\n') + 1
+	line := text[start:pos]
+	return line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+}
+
+// dedent removes a leading line break and the common indentation
+func dedent(s string) string {
+	s = strings.TrimLeft(strings.TrimLeft(s, " "), "\r\n")
+	lines := strings.Split(strings.TrimRight(s, "\r\n"), "\n")
+	common := -1
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		n := len(line) - len(strings.TrimLeft(line, " "))
+		if common < 0 || n < common {
+			common = n
+		}
+	}
+	for i, line := range lines {
+		if len(line) >= common && common > 0 {
+			lines[i] = line[common:]
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// JSON
+
+type jsonParser struct {
+	text string
+	pos  int
+}
+
+func parseJSONDocument(text string) (*docNode, error) {
+	p := &jsonParser{text: text}
+	p.space()
+	n, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+	p.space()
+	if p.pos < len(text) {
+		return nil, p.errorf("unexpected text after the document")
+	}
+	return n, nil
+}
+
+func (p *jsonParser) errorf(format string, args ...interface{}) error {
+	line := strings.Count(p.text[:p.pos], "\n") + 1
+	return fmt.Errorf("line %d: %s", line, fmt.Sprintf(format, args...))
+}
+
+func (p *jsonParser) space() {
+	for p.pos < len(p.text) && strings.IndexByte(" \t\r\n", p.text[p.pos]) >= 0 {
+		p.pos++
+	}
+}
+
+func (p *jsonParser) value() (*docNode, error) {
+	if p.pos >= len(p.text) {
+		return nil, p.errorf("unexpected end of document")
+	}
+	n := &docNode{start: p.pos, insertAt: -1}
+	switch p.text[p.pos] {
+	case '{', '[':
+		close := byte('}')
+		n.kind = "object"
+		if p.text[p.pos] == '[' {
+			close = ']'
+			n.kind = "array"
+		}
+		p.pos++
+		p.space()
+		n.insertAt = p.pos
+		for p.pos < len(p.text) && p.text[p.pos] != close {
+			if len(n.children) > 0 {
+				if p.text[p.pos] != ',' {
+					return nil, p.errorf("expected ',' or '%c'", close)
+				}
+				p.pos++
+				p.space()
+			}
+			memberStart := p.pos
+			if n.kind == "object" {
+				keyNode, err := p.value()
+				if err != nil {
+					return nil, err
+				}
+				var key string
+				if err := json.Unmarshal([]byte(p.text[keyNode.start:keyNode.end]), &key); err != nil {
+					return nil, p.errorf("invalid key")
+				}
+				p.space()
+				if p.pos >= len(p.text) || p.text[p.pos] != ':' {
+					return nil, p.errorf("expected ':'")
+				}
+				p.pos++
+				p.space()
+				n.keys = append(n.keys, key)
+			}
+			child, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			n.children = append(n.children, child)
+			n.insertAt = child.end
+			n.indent = lineIndent(p.text, memberStart)
+			if strings.TrimSpace(p.text[strings.LastIndexByte(p.text[:memberStart], '\n')+1:memberStart]) != "" {
+				n.indent = ""
+			}
+			p.space()
+		}
+		if p.pos >= len(p.text) {
+			return nil, p.errorf("missing '%c'", close)
+		}
+		n.closeAt = p.pos
+		p.pos++
+	case '"':
+		n.kind = "scalar"
+		p.pos++
+		for p.pos < len(p.text) && p.text[p.pos] != '"' {
+			if p.text[p.pos] == '\\' {
+				p.pos++
+			}
+			p.pos++
+		}
+		if p.pos >= len(p.text) {
+			return nil, p.errorf("unterminated string")
+		}
+		p.pos++
+	default:
+		n.kind = "scalar"
+		for p.pos < len(p.text) && strings.IndexByte(",]} \t\r\n", p.text[p.pos]) < 0 {
+			p.pos++
+		}
+		if p.pos == n.start {
+			return nil, p.errorf("unexpected %q", p.text[p.pos])
+		}
+	}
+	n.end = p.pos
+	return n, nil
+}
+
+// YAML, the block style used by configuration files: mappings, sequences
+// and scalars, with one-line flow collections, anchors and aliases. A file
+// holding several documents is refused, rather than reading or changing
+// only the first.
+
+type yamlLine struct {
+	start   int // offset of the line
+	content int // offset of the first character after the indentation
+	end     int // offset of the end of the line
+	indent  int
+}
+
+type yamlParser struct {
+	text    string
+	lines   []yamlLine
+	anchors map[string]*docNode
+	err     error
+}
+
+func parseYAMLDocument(text string) (*docNode, error) {
+	p := &yamlParser{text: text, anchors: make(map[string]*docNode)}
+	ended := false
+	for start := 0; start < len(text); {
+		end := strings.IndexByte(text[start:], '\n')
+		if end < 0 {
+			end = len(text)
+		} else {
+			end += start
+		}
+		line := strings.TrimRight(text[start:end], "\r")
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "---" && len(p.lines) == 0 && !ended, strings.HasPrefix(trimmed, "%"):
+		case trimmed == "---" || trimmed == "...":
+			ended = true
+		case trimmed != "" && !strings.HasPrefix(trimmed, "#"):
+			if ended {
+				return nil, fmt.Errorf("line %d: the file holds more than one YAML document; edit it with write_file", strings.Count(text[:start], "\n")+1)
+			}
+			indent := len(line) - len(strings.TrimLeft(line, " "))
+			p.lines = append(p.lines, yamlLine{start, start + indent, start + len(line), indent})
+		}
+		start = end + 1
+	}
+
+	if len(p.lines) == 0 {
+		return &docNode{kind: "object", start: 0, end: len(text), insertAt: len(strings.TrimRight(text, "\n"))}, nil
+	}
+	n, _ := p.node(0)
+	return n, p.err
+}
+
+// anchor reads an anchor, &name, at pos, returning its name, or "" if
+// there is none, and where the value after it starts
+func (p *yamlParser) anchor(pos, lineEnd int) (string, int) {
+	if pos >= lineEnd || p.text[pos] != '&' {
+		return "", pos
+	}
+	end := pos
+	for end < lineEnd && p.text[end] != ' ' && p.text[end] != '\t' {
+		end++
+	}
+	name := p.text[pos+1 : end]
+	for end < lineEnd && (p.text[end] == ' ' || p.text[end] == '\t') {
+		end++
+	}
+	return name, end
+}
+
+// lineErrorf records the first error, at the line containing pos
+func (p *yamlParser) lineErrorf(pos int, format string, args ...interface{}) {
+	if p.err == nil {
+		p.err = fmt.Errorf("line %d: %s", strings.Count(p.text[:pos], "\n")+1, fmt.Sprintf(format, args...))
+	}
+}
+
+func (p *yamlParser) content(i int) string {
+	return p.text[p.lines[i].content:p.lines[i].end]
+}
+
+func isSequenceItem(s string) bool {
+	return s == "-" || strings.HasPrefix(s, "- ")
+}
+
+// mappingKey splits a "key: value" line, returning the key and the offset
+// in s just after the colon
+func mappingKey(s string) (string, int, bool) {
+	if s == "" || strings.ContainsRune("[{#&*!|>%@`", rune(s[0])) || isSequenceItem(s) {
+		return "", 0, false
+	}
+	if s[0] == '"' || s[0] == '\'' {
+		key, n, err := quotedKey(s)
+		if err != nil || !strings.HasPrefix(s[n:], ":") {
+			return "", 0, false
+		}
+		if rest := s[n+1:]; rest != "" && rest[0] != ' ' {
+			return "", 0, false
+		}
+		return key, n + 1, true
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] == '#' && i > 0 && s[i-1] == ' ' {
+			return "", 0, false
+		}
+		if s[i] == ':' && (i+1 == len(s) || s[i+1] == ' ') {
+			return strings.TrimSpace(s[:i]), i + 1, true
+		}
+	}
+	return "", 0, false
+}
+
+// scalarEnd is the end of a scalar starting at pos, before any comment
+func (p *yamlParser) scalarEnd(pos, lineEnd int) int {
+	s := p.text[pos:lineEnd]
+	if s != "" && (s[0] == '"' || s[0] == '\'') {
+		if _, n, err := quotedKey(s); err == nil {
+			return pos + n
+		}
+	}
+	if i := strings.Index(s, " #"); i >= 0 {
+		s = s[:i]
+	}
+	return pos + len(strings.TrimRight(s, " \t"))
+}
+
+// node parses the block starting at line i, returning it and the line
+// after it
+func (p *yamlParser) node(i int) (*docNode, int) {
+	indent := p.lines[i].indent
+	c := p.content(i)
+	n := &docNode{start: p.lines[i].content, insertAt: -1, indent: strings.Repeat(" ", indent)}
+
+	switch {
+	case isSequenceItem(c):
+		n.kind = "array"
+		for i < len(p.lines) && p.lines[i].indent == indent && isSequenceItem(p.content(i)) {
+			dash := p.lines[i].content
+			rest := strings.TrimLeft(p.text[dash+1:p.lines[i].end], " ")
+			anchor, after := p.anchor(p.lines[i].end-len(rest), p.lines[i].end)
+			if anchor == "" {
+				after = dash + 1
+			}
+			rest = strings.TrimLeft(p.text[after:p.lines[i].end], " ")
+			var child *docNode
+			if rest == "" || strings.HasPrefix(rest, "#") {
+				child, i = p.blockValue(i, indent, after, false)
+			} else {
+				// The item starts on the dash's line, e.g. "- name: x"; treat
+				// it as a line of its own, indented to where it starts
+				p.lines[i].content = p.lines[i].end - len(rest)
+				p.lines[i].indent = p.lines[i].content - p.lines[i].start
+				if _, _, ok := mappingKey(rest); ok || isSequenceItem(rest) {
+					child, i = p.node(i)
+				} else {
+					child, i = p.scalar(i, indent, p.lines[i].content)
+				}
+			}
+			if anchor != "" {
+				p.anchors[anchor] = child
+			}
+			n.children = append(n.children, child)
+			n.end = max(child.end, p.lines[i-1].end)
+		}
+	default:
+		if _, _, ok := mappingKey(c); !ok {
+			return p.scalar(i, indent-1, p.lines[i].content)
+		}
+		n.kind = "object"
+		for i < len(p.lines) && p.lines[i].indent == indent {
+			key, colon, ok := mappingKey(p.content(i))
+			if !ok {
+				break
+			}
+			colon += p.lines[i].content
+			rest := strings.TrimLeft(p.text[colon:p.lines[i].end], " ")
+			anchor, after := p.anchor(p.lines[i].end-len(rest), p.lines[i].end)
+			if anchor == "" {
+				after = colon
+			}
+			rest = strings.TrimLeft(p.text[after:p.lines[i].end], " ")
+			var child *docNode
+			if rest == "" || strings.HasPrefix(rest, "#") {
+				child, i = p.blockValue(i, indent, after, true)
+			} else {
+				child, i = p.scalar(i, indent, p.lines[i].end-len(rest))
+			}
+			if anchor != "" {
+				p.anchors[anchor] = child
+			}
+			n.keys = append(n.keys, key)
+			n.children = append(n.children, child)
+			n.end = max(child.end, p.lines[i-1].end)
+		}
+	}
+	n.insertAt = n.end
+	return n, i
+}
+
+// blockValue parses the value of "key:" or "-" with nothing after it on
+// the line, or only an anchor: a nested block on the following lines, or
+// null. A mapping's value may be a sequence at the key's own indentation.
+func (p *yamlParser) blockValue(i, indent, after int, mapping bool) (*docNode, int) {
+	if i+1 < len(p.lines) {
+		next := p.lines[i+1]
+		if next.indent > indent || next.indent == indent && isSequenceItem(p.content(i+1)) && mapping {
+			child, j := p.node(i + 1)
+			child.start, child.prefix = after, " "
+			return child, j
+		}
+	}
+	return &docNode{kind: "scalar", start: after, end: after, prefix: " ", insertAt: -1}, i + 1
+}
+
+// scalar parses a scalar starting at pos on line i, including block
+// scalars and continuation lines indented further than the parent
+func (p *yamlParser) scalar(i, indent, pos int) (*docNode, int) {
+	n := &docNode{kind: "scalar", start: pos, insertAt: -1}
+	s := p.text[pos:p.lines[i].end]
+	if s[0] == '{' || s[0] == '[' {
+		n.kind = map[byte]string{'{': "object", '[': "array"}[s[0]]
+		n.flow = true
+		if flow, err := parseFlowYAML(p.text, pos); err == nil {
+			return flow, i + 1
+		}
+		n.kind = "scalar"
+	}
+	n.end = p.scalarEnd(pos, p.lines[i].end)
+	if s[0] == '*' {
+		name := p.text[pos+1 : n.end]
+		if n.alias = p.anchors[name]; n.alias == nil {
+			p.lineErrorf(pos, "alias *%s has no anchor &%s before it", name, name)
+		}
+		return n, i + 1
+	}
+	for i++; i < len(p.lines) && p.lines[i].indent > indent; i++ {
+		n.end = p.lines[i].end
+	}
+	return n, i
+}
+
+// parseFlowYAML parses a one-line flow collection such as [a, b] or
+// {a: 1}, so that its members can be read and changed
+func parseFlowYAML(text string, pos int) (*docNode, error) {
+	lineEnd := strings.IndexByte(text[pos:], '\n')
+	if lineEnd < 0 {
+		lineEnd = len(text) - pos
+	}
+	p := &flowParser{text: text[:pos+lineEnd], pos: pos, sep: ':'}
+	return p.value()
+}
+
+// TOML
+
+type tomlParser struct {
+	text string
+	pos  int
+	root *docNode
+}
+
+func parseTOMLDocument(text string) (*docNode, error) {
+	p := &tomlParser{text: text, root: &docNode{kind: "object", insertAt: 0}}
+	section := p.root
+	for {
+		p.skip(true)
+		if p.pos >= len(text) {
+			break
+		}
+		if text[p.pos] == '[' {
+			lineStart := p.pos
+			array := strings.HasPrefix(text[p.pos:], "[[")
+			if array {
+				p.pos += 2
+			} else {
+				p.pos++
+			}
+			p.skip(false)
+			keys, err := p.key()
+			if err != nil {
+				return nil, err
+			}
+			p.skip(false)
+			closing := "]"
+			if array {
+				closing = "]]"
+			}
+			if !strings.HasPrefix(text[p.pos:], closing) {
+				return nil, p.errorf("expected %s", closing)
+			}
+			p.pos += len(closing)
+			section, err = p.table(keys, array)
+			if err != nil {
+				return nil, err
+			}
+			section.start = lineStart
+			section.header = ""
+		} else if err := p.keyValue(section, section); err != nil {
+			return nil, err
+		}
+		section.insertAt = p.lineEnd()
+		section.end = section.insertAt
+		p.skip(false)
+		if p.pos < len(text) && text[p.pos] == '#' {
+			for p.pos < len(text) && text[p.pos] != '\n' {
+				p.pos++
+			}
+		}
+		if p.pos < len(text) && text[p.pos] != '\n' && text[p.pos] != '\r' {
+			return nil, p.errorf("expected end of line")
+		}
+	}
+	p.root.end = len(text)
+	return p.root, nil
+}
+
+func (p *tomlParser) errorf(format string, args ...interface{}) error {
+	line := strings.Count(p.text[:p.pos], "\n") + 1
+	return fmt.Errorf("line %d: %s", line, fmt.Sprintf(format, args...))
+}
+
+// lineEnd is the end of the current line, before any comment
+func (p *tomlParser) lineEnd() int {
+	end := p.pos
+	for end < len(p.text) && p.text[end] != '\n' && p.text[end] != '\r' && p.text[end] != '#' {
+		end++
+	}
+	return p.pos + len(strings.TrimRight(p.text[p.pos:end], " \t"))
+}
+
+// skip skips spaces and tabs, and also comments and line breaks if lines
+func (p *tomlParser) skip(lines bool) {
+	for p.pos < len(p.text) {
+		switch c := p.text[p.pos]; {
+		case c == ' ' || c == '\t':
+			p.pos++
+		case lines && (c == '\n' || c == '\r'):
+			p.pos++
+		case lines && c == '#':
+			for p.pos < len(p.text) && p.text[p.pos] != '\n' {
+				p.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+// key parses a possibly dotted key
+func (p *tomlParser) key() ([]string, error) {
+	var keys []string
+	for {
+		p.skip(false)
+		if p.pos >= len(p.text) {
+			return nil, p.errorf("expected a key")
+		}
+		if c := p.text[p.pos]; c == '"' || c == '\'' {
+			key, n, err := quotedKey(p.text[p.pos:])
+			if err != nil {
+				return nil, p.errorf("invalid key: %v", err)
+			}
+			keys = append(keys, key)
+			p.pos += n
+		} else {
+			start := p.pos
+			for p.pos < len(p.text) && bareKey.MatchString(p.text[p.pos:p.pos+1]) {
+				p.pos++
+			}
+			if p.pos == start {
+				return nil, p.errorf("expected a key")
+			}
+			keys = append(keys, p.text[start:p.pos])
+		}
+		p.skip(false)
+		if p.pos >= len(p.text) || p.text[p.pos] != '.' {
+			return keys, nil
+		}
+		p.pos++
+	}
+}
+
+// table finds or creates the table for a [header] or [[header]]
+func (p *tomlParser) table(keys []string, array bool) (*docNode, error) {
+	n := p.root
+	for i, key := range keys {
+		child := n.member(key)
+		last := i == len(keys)-1
+		switch {
+		case child == nil && last && array:
+			child = &docNode{kind: "array", insertAt: -1}
+			n.keys = append(n.keys, key)
+			n.children = append(n.children, child)
+		case child == nil:
+			child = &docNode{kind: "object", insertAt: -1, header: strings.Join(quoteTOMLKeys(keys[:i+1]), ".")}
+			n.keys = append(n.keys, key)
+			n.children = append(n.children, child)
+		}
+		if child.kind == "array" && !child.flow {
+			if last && array {
+				table := &docNode{kind: "object", insertAt: -1}
+				child.children = append(child.children, table)
+				return table, nil
+			}
+			child = child.children[len(child.children)-1]
+		}
+		if child.kind != "object" {
+			return nil, p.errorf("%s is not a table", strings.Join(keys[:i+1], "."))
+		}
+		n = child
+	}
+	return n, nil
+}
+
+// keyValue parses "key = value" into table, whose place new keys of
+// tables created by dotted keys are added in
+func (p *tomlParser) keyValue(table, section *docNode) error {
+	keys, err := p.key()
+	if err != nil {
+		return err
+	}
+	if p.pos >= len(p.text) || p.text[p.pos] != '=' {
+		return p.errorf("expected '='")
+	}
+	p.pos++
+	p.skip(false)
+
+	n := table
+	for i, key := range keys[:len(keys)-1] {
+		child := n.member(key)
+		if child == nil {
+			child = &docNode{kind: "object", insertAt: -1}
+			if table == section {
+				child.owner = section
+				child.keyPrefix = strings.Join(quoteTOMLKeys(keys[:i+1]), ".") + "."
+			}
+			n.keys = append(n.keys, key)
+			n.children = append(n.children, child)
+		}
+		if child.kind != "object" {
+			return p.errorf("%s is not a table", strings.Join(keys[:i+1], "."))
+		}
+		n = child
+	}
+	value, err := p.value()
+	if err != nil {
+		return err
+	}
+	n.keys = append(n.keys, keys[len(keys)-1])
+	n.children = append(n.children, value)
+	return nil
+}
+
+func (p *tomlParser) value() (*docNode, error) {
+	n := &docNode{kind: "scalar", start: p.pos, insertAt: -1}
+	rest := p.text[p.pos:]
+	switch {
+	case strings.HasPrefix(rest, `"""`), strings.HasPrefix(rest, "'''"):
+		i := 3
+		for i < len(rest) && !strings.HasPrefix(rest[i:], rest[:3]) {
+			if rest[0] == '"' && rest[i] == '\\' {
+				i++
+			}
+			i++
+		}
+		if i >= len(rest) {
+			return nil, p.errorf("unterminated string")
+		}
+		// Up to two quotes can end the content, just before the delimiter
+		i += 3
+		for j := 0; j < 2 && i < len(rest) && rest[i] == rest[0]; j++ {
+			i++
+		}
+		p.pos += i
+	case strings.HasPrefix(rest, `"`), strings.HasPrefix(rest, "'"):
+		_, length, err := quotedKey(rest)
+		if err != nil {
+			return nil, p.errorf("invalid string: %v", err)
+		}
+		p.pos += length
+	case strings.HasPrefix(rest, "["):
+		n.kind, n.flow = "array", true
+		p.pos++
+		for {
+			p.skip(true)
+			if p.pos >= len(p.text) {
+				return nil, p.errorf("missing ']'")
+			}
+			if p.text[p.pos] == ']' {
+				break
+			}
+			child, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			n.children = append(n.children, child)
+			p.skip(true)
+			if p.pos < len(p.text) && p.text[p.pos] == ',' {
+				p.pos++
+			}
+		}
+		n.closeAt, n.insertAt = p.pos, p.pos
+		if len(n.children) > 0 {
+			n.insertAt = n.children[len(n.children)-1].end
+		}
+		p.pos++
+	case strings.HasPrefix(rest, "{"):
+		n.kind, n.flow = "object", true
+		p.pos++
+		for {
+			p.skip(false)
+			if p.pos >= len(p.text) {
+				return nil, p.errorf("missing '}'")
+			}
+			if p.text[p.pos] == '}' {
+				break
+			}
+			if err := p.keyValue(n, nil); err != nil {
+				return nil, err
+			}
+			p.skip(false)
+			if p.pos < len(p.text) && p.text[p.pos] == ',' {
+				p.pos++
+			}
+		}
+		n.closeAt = p.pos
+		n.insertAt = strings.LastIndexFunc(p.text[:p.pos], func(r rune) bool { return r != ' ' }) + 1
+		p.pos++
+	default:
+		for p.pos < len(p.text) && strings.IndexByte(",]}#\r\n", p.text[p.pos]) < 0 {
+			p.pos++
+		}
+		p.pos = n.start + len(strings.TrimRight(p.text[n.start:p.pos], " \t"))
+		if p.pos == n.start {
+			return nil, p.errorf("expected a value")
+		}
+	}
+	n.end = p.pos
+	return n, nil
+}
+
+func quoteTOMLKeys(keys []string) []string {
+	quoted := make([]string, len(keys))
+	for i, key := range keys {
+		quoted[i] = key
+		if !bareKey.MatchString(key) {
+			quoted[i] = strconv.Quote(key)
+		}
+	}
+	return quoted
+}
+
+// addTOMLMember adds a key, as a dotted key if tables along the path are
+// missing, or appends to an inline array
+func addTOMLMember(text string, n *docNode, have, missing []pathSegment, value json.RawMessage) (string, error) {
+	dec := json.NewDecoder(bytes.NewReader(value))
+	dec.UseNumber()
+	encoded, err := tomlValue(dec)
+	if err != nil {
+		return "", err
+	}
+
+	if n.flow {
+		member := encoded
+		if !missing[0].isIndex {
+			var keys []string
+			for _, seg := range missing {
+				keys = append(keys, seg.key)
+			}
+			member = strings.Join(quoteTOMLKeys(keys), ".") + " = " + encoded
+		}
+		if len(n.children) > 0 {
+			member = ", " + member
+		} else if n.kind == "object" {
+			member = " " + member + " "
+		}
+		return text[:n.insertAt] + member + text[n.insertAt:], nil
+	}
+	if missing[0].isIndex {
+		return "", fmt.Errorf("cannot append to the array of tables %s; edit it with write_file", formatQuery(have))
+	}
+
+	var keys []string
+	for _, seg := range missing {
+		keys = append(keys, seg.key)
+	}
+	line := n.keyPrefix + strings.Join(quoteTOMLKeys(keys), ".") + " = " + encoded
+	if n.owner != nil {
+		n = n.owner
+	}
+	switch {
+	case n.header != "":
+		return strings.TrimRight(text, "\n") + "\n\n[" + n.header + "]\n" + line + "\n", nil
+	case n.insertAt < 0:
+		return "", fmt.Errorf("cannot add to %s here; edit it with write_file", formatQuery(have))
+	case n.insertAt == 0:
+		return line + "\n" + text, nil
+	}
+	return text[:n.insertAt] + "\n" + line + text[n.insertAt:], nil
+}
+
+// tomlValue writes the next JSON value from dec as a TOML value, keeping
+// the order of object keys
+func tomlValue(dec *json.Decoder) (string, error) {
+	token, err := dec.Token()
+	if err != nil {
+		return "", fmt.Errorf("invalid value: %v", err)
+	}
+	switch t := token.(type) {
+	case json.Delim:
+		var items []string
+		for dec.More() {
+			item := ""
+			if t == '{' {
+				key, err := dec.Token()
+				if err != nil {
+					return "", fmt.Errorf("invalid value: %v", err)
+				}
+				item = quoteTOMLKeys([]string{key.(string)})[0] + " = "
+			}
+			v, err := tomlValue(dec)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, item+v)
+		}
+		dec.Token()
+		if t == '{' {
+			if len(items) == 0 {
+				return "{}", nil
+			}
+			return "{ " + strings.Join(items, ", ") + " }", nil
+		}
+		return "[" + strings.Join(items, ", ") + "]", nil
+	case string:
+		data, _ := json.Marshal(t)
+		return string(data), nil
+	case json.Number:
+		return t.String(), nil
+	case bool:
+		return strconv.FormatBool(t), nil
+	}
+	return "", fmt.Errorf("TOML has no null; remove the key with write_file instead")
+}
+
+// flowParser parses one-line YAML flow collections
+type flowParser struct {
+	text string
+	pos  int
+	sep  byte
+}
+
+func (p *flowParser) space() {
+	for p.pos < len(p.text) && (p.text[p.pos] == ' ' || p.text[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+func (p *flowParser) value() (*docNode, error) {
+	p.space()
+	n := &docNode{kind: "scalar", start: p.pos, insertAt: -1, flow: true}
+	if p.pos >= len(p.text) {
+		return nil, fmt.Errorf("unexpected end of line")
+	}
+	switch c := p.text[p.pos]; c {
+	case '[', '{':
+		close := map[byte]byte{'[': ']', '{': '}'}[c]
+		n.kind = map[byte]string{'[': "array", '{': "object"}[c]
+		p.pos++
+		p.space()
+		n.insertAt = p.pos
+		for p.pos < len(p.text) && p.text[p.pos] != close {
+			if c == '{' {
+				keyStart := p.pos
+				for p.pos < len(p.text) && p.text[p.pos] != ':' && p.text[p.pos] != close {
+					p.pos++
+				}
+				key := strings.TrimSpace(p.text[keyStart:p.pos])
+				if k, length, err := quotedKey(key); err == nil && length == len(key) {
+					key = k
+				}
+				if p.pos >= len(p.text) || p.text[p.pos] != ':' {
+					return nil, fmt.Errorf("expected ':'")
+				}
+				p.pos++
+				n.keys = append(n.keys, key)
+			}
+			child, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			n.children = append(n.children, child)
+			n.insertAt = child.end
+			p.space()
+			if p.pos < len(p.text) && p.text[p.pos] == ',' {
+				p.pos++
+				p.space()
+			}
+		}
+		if p.pos >= len(p.text) {
+			return nil, fmt.Errorf("missing '%c'", close)
+		}
+		n.closeAt = p.pos
+		p.pos++
+	case '"', '\'':
+		_, length, err := quotedKey(p.text[p.pos:])
+		if err != nil {
+			return nil, err
+		}
+		p.pos += length
+	default:
+		for p.pos < len(p.text) && strings.IndexByte(",]}", p.text[p.pos]) < 0 && !strings.HasPrefix(p.text[p.pos:], " #") {
+			p.pos++
+		}
+		p.pos = n.start + len(strings.TrimRight(p.text[n.start:p.pos], " \t"))
+	}
+	n.end = p.pos
+	return n, nil
+}
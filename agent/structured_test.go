@@ -0,0 +1,170 @@
+package agent
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// structuredCase reads query from a file, or with value set, updates it.
+// want is what the read returns, or the whole file after the update.
+type structuredCase struct {
+	name    string
+	content string
+	query   string
+	value   string
+	want    string
+	err     string
+}
+
+func runStructuredCases(t *testing.T, file string, cases []structuredCase) {
+	t.Helper()
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			e := newToolEngine(t)
+			writeTestFile(t, e, file, c.content)
+			var got string
+			var err error
+			if c.value == "" {
+				got, err = e.readJSONPath(args(t, map[string]string{"path": file, "query": c.query}))
+			} else {
+				_, err = e.updateJSONPath(args(t, map[string]interface{}{"path": file, "query": c.query, "value": json.RawMessage(c.value)}))
+				data, readErr := os.ReadFile(filepath.Join(e.workspace, file))
+				if readErr != nil {
+					t.Fatal(readErr)
+				}
+				got = string(data)
+			}
+			switch {
+			case c.err != "":
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("got error %v, want %q", err, c.err)
+				}
+				if c.value != "" && got != c.content {
+					t.Errorf("a failed update changed the file to\n%s", got)
+				}
+			case err != nil:
+				t.Fatal(err)
+			case got != c.want:
+				t.Errorf("got\n%s\nwant\n%s", got, c.want)
+			}
+		})
+	}
+}
+
+func TestJSONPath(t *testing.T) {
+	pkg := `{
+  "name": "app",
+  "scripts": {"build": "tsc", "test": "jest"},
+  "dependencies": {
+    "@types/node": "^20.0.0"
+  },
+  "files": ["dist", "lib"]
+}
+`
+	runStructuredCases(t, "package.json", []structuredCase{
+		{name: "read scalar", content: pkg, query: ".name", want: `"app"`},
+		{name: "read quoted key", content: pkg, query: `.dependencies["@types/node"]`, want: `"^20.0.0"`},
+		{name: "read index", content: pkg, query: ".files[1]", want: `"lib"`},
+		{name: "read object", content: pkg, query: ".scripts", want: "{\n  \"build\": \"tsc\",\n  \"test\": \"jest\"\n}"},
+		{name: "missing key", content: pkg, query: ".scripts.lint", err: ".scripts.lint not found; keys of .scripts are: build, test"},
+		{name: "index past end", content: pkg, query: ".files[2]", err: "the array has 2 items"},
+		{name: "replace keeps layout", content: pkg, query: ".scripts.build", value: `"tsc -b"`,
+			want: strings.Replace(pkg, `"tsc"`, `"tsc -b"`, 1)},
+		{name: "replace quoted key", content: pkg, query: `.dependencies["@types/node"]`, value: `"^22.0.0"`,
+			want: strings.Replace(pkg, "^20.0.0", "^22.0.0", 1)},
+		{name: "add missing key", content: pkg, query: ".scripts.lint", value: `"eslint ."`,
+			want: strings.Replace(pkg, `"test": "jest"}`, `"test": "jest", "lint": "eslint ."}`, 1)},
+		{name: "append to array", content: pkg, query: ".files[2]", value: `"bin"`,
+			want: strings.Replace(pkg, `"lib"]`, `"lib", "bin"]`, 1)},
+		{name: "not an object", content: pkg, query: ".name.first", value: `1`, err: ".name is not an object"},
+	})
+}
+
+func TestYAMLPath(t *testing.T) {
+	config := `# Service settings
+name: api   # the service name
+replicas: 2
+env:
+  - name: PORT
+    value: "8080"
+tags: [web, public]
+limits: {cpu: 1, memory: 512Mi}
+script: |
+  make build
+  make test
+`
+	anchors := `defaults: &defaults
+  retries: 3
+prod:
+  base: *defaults
+  timeout: &t 30
+other: *t
+`
+	runStructuredCases(t, "config.yaml", []structuredCase{
+		{name: "read scalar with comment", content: config, query: ".name", want: "api"},
+		{name: "read nested sequence", content: config, query: ".env[0].value", want: `"8080"`},
+		{name: "read flow sequence", content: config, query: ".tags[1]", want: "public"},
+		{name: "read flow mapping", content: config, query: ".limits.memory", want: "512Mi"},
+		{name: "read block scalar", content: config, query: ".script", want: "|\n  make build\n  make test"},
+		{name: "replace keeps comment", content: config, query: ".name", value: `"web"`,
+			want: strings.Replace(config, "name: api   #", "name: web   #", 1)},
+		{name: "replace in flow mapping", content: config, query: ".limits.cpu", value: `2`,
+			want: strings.Replace(config, "{cpu: 1,", "{cpu: 2,", 1)},
+		{name: "quote ambiguous string", content: config, query: ".replicas", value: `"3"`,
+			want: strings.Replace(config, "replicas: 2", `replicas: "3"`, 1)},
+		{name: "add missing key", content: config, query: ".env[0].secret", value: `false`,
+			want: strings.Replace(config, "    value: \"8080\"\n", "    value: \"8080\"\n    secret: false\n", 1)},
+		{name: "add missing object", content: config, query: ".probe.path", value: `"/health"`,
+			want: config + "probe: {\"path\":\"/health\"}\n"},
+		{name: "append to sequence", content: config, query: ".env[1]", value: `{"name": "HOST"}`,
+			want: strings.Replace(config, "    value: \"8080\"\n", "    value: \"8080\"\n  - {\"name\":\"HOST\"}\n", 1)},
+		{name: "read through alias", content: anchors, query: ".prod.base.retries", want: "3"},
+		{name: "read alias", content: anchors, query: ".other", want: "30"},
+		{name: "update through alias", content: anchors, query: ".prod.base.retries", value: `5`, err: ".prod.base is a YAML alias"},
+		{name: "update anchored value", content: anchors, query: ".defaults.retries", value: `5`,
+			want: strings.Replace(anchors, "retries: 3", "retries: 5", 1)},
+		{name: "replace anchored scalar", content: anchors, query: ".prod.timeout", value: `60`,
+			want: strings.Replace(anchors, "&t 30", "&t 60", 1)},
+		{name: "unknown alias", content: "a: *nowhere\n", query: ".a", err: "alias *nowhere has no anchor"},
+		{name: "several documents", content: "---\na: 1\n---\nb: 2\n", query: ".b", value: `3`, err: "more than one YAML document"},
+		{name: "document end marker", content: "a: 1\n...\n", query: ".a", want: "1"},
+	})
+}
+
+func TestTOMLPath(t *testing.T) {
+	pyproject := `[project]
+name = "app" # the distribution name
+dependencies = ["requests", "rich"]
+
+[tool.ruff]
+line-length = 88
+lint.select = ["E", "F"]
+
+[[tool.mypy.overrides]]
+module = "tests.*"
+
+[[tool.mypy.overrides]]
+module = "vendor.*"
+`
+	runStructuredCases(t, "pyproject.toml", []structuredCase{
+		{name: "read scalar with comment", content: pyproject, query: ".project.name", want: `"app"`},
+		{name: "read array", content: pyproject, query: ".project.dependencies[1]", want: `"rich"`},
+		{name: "read dotted key", content: pyproject, query: ".tool.ruff.lint.select[0]", want: `"E"`},
+		{name: "read array of tables", content: pyproject, query: ".tool.mypy.overrides[1].module", want: `"vendor.*"`},
+		{name: "read table", content: pyproject, query: ".tool.ruff", want: "line-length = 88\nlint.select = [\"E\", \"F\"]"},
+		{name: "replace keeps comment", content: pyproject, query: ".project.name", value: `"web"`,
+			want: strings.Replace(pyproject, `"app" #`, `"web" #`, 1)},
+		{name: "replace dotted key", content: pyproject, query: ".tool.ruff.lint.select", value: `["E"]`,
+			want: strings.Replace(pyproject, `["E", "F"]`, `["E"]`, 1)},
+		{name: "replace in array of tables", content: pyproject, query: ".tool.mypy.overrides[0].module", value: `"test.*"`,
+			want: strings.Replace(pyproject, `"tests.*"`, `"test.*"`, 1)},
+		{name: "add missing key", content: pyproject, query: ".tool.ruff.fix", value: `true`,
+			want: strings.Replace(pyproject, "lint.select = [\"E\", \"F\"]\n", "lint.select = [\"E\", \"F\"]\nfix = true\n", 1)},
+		{name: "add quoted key", content: pyproject, query: `.project.urls["home page"]`, value: `"https://example.com"`,
+			want: strings.Replace(pyproject, "\"rich\"]\n", "\"rich\"]\nurls.\"home page\" = \"https://example.com\"\n", 1)},
+		{name: "table is not a value", content: pyproject, query: ".tool.ruff", value: `{}`, err: "is a table"},
+	})
+}
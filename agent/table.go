@@ -0,0 +1,650 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPreviewRows = 10
+	maxPreviewRows     = 100
+
+	// maxCellChars is the longest cell value shown before it is cut short
+	maxCellChars = 80
+
+	// maxCountRows bounds the scan that counts rows and infers column
+	// types, so previewing a huge file stays quick
+	maxCountRows = 1000000
+)
+
+func previewTableTool() Tool {
+	return Tool{
+		Type: "function",
+		Function: Function{
+			Name:        "preview_table",
+			Description: "Preview a CSV, TSV or Parquet file: its columns and their types, the row count, and a sample of rows. Use this rather than reading a whole dataset",
+			Parameters: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"path": map[string]interface{}{
+						"type":        "string",
+						"description": "File path relative to workspace",
+					},
+					"rows": map[string]interface{}{
+						"type":        "integer",
+						"description": fmt.Sprintf("Number of rows to show (optional, default %d, at most %d)", defaultPreviewRows, maxPreviewRows),
+					},
+					"offset": map[string]interface{}{
+						"type":        "integer",
+						"description": "Data rows to skip before the sample, for paging through a file (optional)",
+					},
+					"delimiter": map[string]interface{}{
+						"type":        "string",
+						"description": "Field delimiter for delimited text (optional, default from the extension, or guessed from the first line)",
+					},
+				},
+				"required": []string{"path"},
+			},
+		},
+	}
+}
+
+func (e *Engine) previewTable(args json.RawMessage) (string, error) {
+	var params struct {
+		Path      string `json:"path"`
+		Rows      *int   `json:"rows"`
+		Offset    int    `json:"offset"`
+		Delimiter string `json:"delimiter"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return "", fmt.Errorf("invalid arguments: %v", err)
+	}
+	rows := defaultPreviewRows
+	if params.Rows != nil {
+		rows = min(max(*params.Rows, 0), maxPreviewRows)
+	}
+	offset := max(params.Offset, 0)
+
+	fullPath, err := e.resolvePath(params.Path)
+	if err != nil {
+		return "", err
+	}
+	defer e.locks.read(fullPath)()
+	f, err := e.files().Open(fullPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file: %v", err)
+	}
+	defer f.Close()
+
+	if strings.EqualFold(filepath.Ext(params.Path), ".parquet") {
+		return previewParquet(f, fullPath, params.Path, rows, offset)
+	}
+	return previewDelimited(f, params.Path, params.Delimiter, rows, offset)
+}
+
+// columnType infers a column's type from its values; each value can only
+// narrow the type towards string
+type columnType struct {
+	name    string
+	kind    string // "", boolean, integer, number, date, datetime or string
+	empty   int
+	longest int
+}
+
+var typeOrder = map[string]int{"": 0, "boolean": 1, "integer": 2, "number": 3, "date": 2, "datetime": 3, "string": 4}
+
+func (c *columnType) add(value string) {
+	c.longest = max(c.longest, len(value))
+	value = strings.TrimSpace(value)
+	if value == "" {
+		c.empty++
+		return
+	}
+	kind := valueKind(value)
+	switch {
+	case c.kind == "" || c.kind == kind:
+		c.kind = kind
+	case numericKind(c.kind) && numericKind(kind), temporalKind(c.kind) && temporalKind(kind):
+		if typeOrder[kind] > typeOrder[c.kind] {
+			c.kind = kind
+		}
+	default:
+		c.kind = "string"
+	}
+}
+
+func numericKind(kind string) bool  { return kind == "integer" || kind == "number" }
+func temporalKind(kind string) bool { return kind == "date" || kind == "datetime" }
+
+func valueKind(value string) string {
+	switch strings.ToLower(value) {
+	case "true", "false":
+		return "boolean"
+	}
+	if _, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return "integer"
+	}
+	if _, err := strconv.ParseFloat(value, 64); err == nil {
+		return "number"
+	}
+	if _, err := time.Parse("2006-01-02", value); err == nil {
+		return "date"
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02T15:04:05"} {
+		if _, err := time.Parse(layout, value); err == nil {
+			return "datetime"
+		}
+	}
+	return "string"
+}
+
+// guessDelimiter picks the delimiter that appears most in the first line
+func guessDelimiter(path string, head []byte) rune {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".tsv", ".tab":
+		return '\t'
+	}
+	line, _, _ := bytes.Cut(head, []byte("\n"))
+	best, count := ',', 0
+	for _, d := range []rune{',', '\t', ';', '|'} {
+		if n := bytes.Count(line, []byte(string(d))); n > count {
+			best, count = d, n
+		}
+	}
+	return best
+}
+
+func previewDelimited(f File, path, delimiter string, rows, offset int) (string, error) {
+	head := make([]byte, 4096)
+	n, _ := io.ReadFull(f, head)
+	head = head[:n]
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", fmt.Errorf("failed to read file: %v", err)
+	}
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	r.ReuseRecord = true
+	switch {
+	case delimiter == `\t`:
+		r.Comma = '\t'
+	case delimiter != "":
+		r.Comma = []rune(delimiter)[0]
+	default:
+		r.Comma = guessDelimiter(path, head)
+	}
+
+	record, err := r.Read()
+	if err == io.EOF {
+		return fmt.Sprintf("%s is empty", path), nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	columns := make([]columnType, len(record))
+	for i, name := range record {
+		columns[i].name = strings.TrimPrefix(name, "\ufeff")
+	}
+
+	var sample [][]string
+	count, ragged := 0, 0
+	complete := true
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to parse %s at row %d: %v", path, count+2, err)
+		}
+		if count == maxCountRows {
+			complete = false
+			break
+		}
+		if len(record) != len(columns) {
+			ragged++
+		}
+		for i, value := range record {
+			if i < len(columns) {
+				columns[i].add(value)
+			}
+		}
+		if count >= offset && len(sample) < rows {
+			sample = append(sample, append([]string(nil), record...))
+		}
+		count++
+	}
+
+	var b strings.Builder
+	name := "CSV"
+	if r.Comma != ',' {
+		name = fmt.Sprintf("delimited text (%q)", r.Comma)
+	}
+	rowCount := strconv.Itoa(count)
+	if !complete {
+		rowCount = "over " + rowCount
+	}
+	fmt.Fprintf(&b, "%s: %s, %d columns, %s rows\n", path, name, len(columns), rowCount)
+	if ragged > 0 {
+		fmt.Fprintf(&b, "Rows with a different number of fields from the header: %d\n", ragged)
+	}
+	b.WriteString("\nColumns:\n")
+	for _, c := range columns {
+		kind := c.kind
+		if kind == "" {
+			kind = "empty"
+		}
+		fmt.Fprintf(&b, "  %s: %s", c.name, kind)
+		if c.empty > 0 && c.kind != "" {
+			fmt.Fprintf(&b, " (%d empty)", c.empty)
+		}
+		if c.kind == "string" && c.longest > maxCellChars {
+			fmt.Fprintf(&b, " (up to %d characters)", c.longest)
+		}
+		b.WriteByte('\n')
+	}
+
+	names := make([]string, len(columns))
+	for i, c := range columns {
+		names[i] = c.name
+	}
+	writeSample(&b, names, sample, offset)
+	return b.String(), nil
+}
+
+// writeSample writes rows as a Markdown table, with long cells cut short
+func writeSample(b *strings.Builder, names []string, sample [][]string, offset int) {
+	if len(sample) == 0 {
+		if offset > 0 {
+			fmt.Fprintf(b, "\nNo rows after offset %d\n", offset)
+		}
+		return
+	}
+	if len(sample) == 1 {
+		fmt.Fprintf(b, "\nRow %d:\n", offset+1)
+	} else {
+		fmt.Fprintf(b, "\nRows %d-%d:\n", offset+1, offset+len(sample))
+	}
+	cell := func(s string) string {
+		s = strings.ReplaceAll(strings.ReplaceAll(s, "\n", `\n`), "|", `\|`)
+		if r := []rune(s); len(r) > maxCellChars {
+			s = string(r[:maxCellChars]) + "..."
+		}
+		return s
+	}
+	row := func(values []string) {
+		b.WriteString("|")
+		for i, v := range values {
+			if i == len(names) {
+				break
+			}
+			b.WriteString(" " + cell(v) + " |")
+		}
+		b.WriteString(strings.Repeat("  |", max(len(names)-len(values), 0)))
+		b.WriteByte('\n')
+	}
+	row(names)
+	b.WriteString("|" + strings.Repeat(" --- |", len(names)) + "\n")
+	for _, record := range sample {
+		row(record)
+	}
+}
+
+// Parquet files end with their metadata, Thrift-encoded, then its length
+// and the magic number. Decoding the schema and row count needs only that;
+// decoding rows means handling compression codecs and page encodings, so
+// sample rows come from pyarrow or DuckDB, if Python has either.
+
+var parquetTypes = []string{"boolean", "int32", "int64", "int96", "float", "double", "binary", "fixed_len_byte_array"}
+
+var parquetConvertedTypes = []string{"string", "map", "map_key_value", "list", "enum", "decimal", "date",
+	"time_millis", "time_micros", "timestamp_millis", "timestamp_micros", "uint8", "uint16", "uint32", "uint64",
+	"int8", "int16", "int32", "int64", "json", "bson", "interval"}
+
+// parquetLogicalTypes names the members of the LogicalType union
+var parquetLogicalTypes = map[int16]string{1: "string", 2: "map", 3: "list", 4: "enum", 5: "decimal", 6: "date",
+	7: "time", 8: "timestamp", 10: "integer", 11: "null", 12: "json", 13: "bson", 14: "uuid", 15: "float16"}
+
+func previewParquet(f File, fullPath, path string, rows, offset int) (string, error) {
+	meta, err := readParquetMetadata(f)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", path, err)
+	}
+	schema, _ := meta[2].([]interface{})
+	if len(schema) == 0 {
+		return "", fmt.Errorf("%s: metadata has no schema", path)
+	}
+	numRows, _ := meta[3].(int64)
+	rowGroups, _ := meta[4].([]interface{})
+
+	var b strings.Builder
+	var names []string
+	var columns strings.Builder
+	index := 1
+	var walk func(prefix string, children int)
+	walk = func(prefix string, children int) {
+		for ; children > 0 && index < len(schema); children-- {
+			element, _ := schema[index].(map[int16]interface{})
+			index++
+			name, _ := element[4].(string)
+			if prefix != "" {
+				name = prefix + "." + name
+			}
+			if n, ok := element[5].(int32); ok && n > 0 {
+				walk(name, int(n))
+				continue
+			}
+			names = append(names, name)
+			fmt.Fprintf(&columns, "  %s: %s\n", name, parquetColumnType(element))
+		}
+	}
+	root, _ := schema[0].(map[int16]interface{})
+	rootChildren, _ := root[5].(int32)
+	walk("", int(rootChildren))
+
+	fmt.Fprintf(&b, "%s: Parquet, %d columns, %d rows in %d row groups\n", path, len(names), numRows, len(rowGroups))
+	if createdBy, ok := meta[6].(string); ok {
+		fmt.Fprintf(&b, "Created by %s\n", createdBy)
+	}
+	b.WriteString("\nColumns:\n")
+	b.WriteString(columns.String())
+
+	if rows > 0 {
+		sample, err := parquetRows(fullPath, rows, offset)
+		if err != nil {
+			fmt.Fprintf(&b, "\nRows not shown: %v\n", err)
+		} else {
+			writeSample(&b, sample.Columns, sample.Rows, offset)
+		}
+	}
+	return b.String(), nil
+}
+
+func parquetColumnType(element map[int16]interface{}) string {
+	var kind string
+	if t, ok := element[1].(int32); ok && int(t) < len(parquetTypes) {
+		kind = parquetTypes[t]
+	}
+	if logical, ok := element[10].(map[int16]interface{}); ok {
+		for id := range logical {
+			if name, ok := parquetLogicalTypes[id]; ok {
+				kind = name
+			}
+		}
+	} else if t, ok := element[6].(int32); ok && int(t) < len(parquetConvertedTypes) {
+		kind = parquetConvertedTypes[t]
+	}
+	if kind == "decimal" {
+		precision, _ := element[8].(int32)
+		scale, _ := element[7].(int32)
+		kind = fmt.Sprintf("decimal(%d,%d)", precision, scale)
+	}
+	switch r, _ := element[3].(int32); r {
+	case 1:
+		kind += " (nullable)"
+	case 2:
+		kind += " (repeated)"
+	}
+	return kind
+}
+
+func readParquetMetadata(f File) (map[int16]interface{}, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	tail := make([]byte, 8)
+	if info.Size() < 12 {
+		return nil, errors.New("not a Parquet file")
+	}
+	if _, err := f.ReadAt(tail, info.Size()-8); err != nil {
+		return nil, err
+	}
+	if string(tail[4:]) != "PAR1" {
+		return nil, errors.New("not a Parquet file")
+	}
+	length := int64(binary.LittleEndian.Uint32(tail))
+	if length > info.Size()-12 {
+		return nil, errors.New("invalid metadata length")
+	}
+	data := make([]byte, length)
+	if _, err := f.ReadAt(data, info.Size()-8-length); err != nil {
+		return nil, err
+	}
+	d := &thriftDecoder{data: data}
+	meta, err := d.readStruct()
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata: %v", err)
+	}
+	return meta, nil
+}
+
+// thriftDecoder reads the Thrift compact protocol generically, giving
+// structs as maps from field ID to value
+type thriftDecoder struct {
+	data  []byte
+	pos   int
+	depth int
+}
+
+var errThriftTruncated = errors.New("truncated")
+
+func (d *thriftDecoder) byte() (byte, error) {
+	if d.pos >= len(d.data) {
+		return 0, errThriftTruncated
+	}
+	d.pos++
+	return d.data[d.pos-1], nil
+}
+
+func (d *thriftDecoder) varint() (uint64, error) {
+	v, n := binary.Uvarint(d.data[d.pos:])
+	if n <= 0 {
+		return 0, errThriftTruncated
+	}
+	d.pos += n
+	return v, nil
+}
+
+func (d *thriftDecoder) zigzag() (int64, error) {
+	v, err := d.varint()
+	return int64(v>>1) ^ -int64(v&1), err
+}
+
+func (d *thriftDecoder) readStruct() (map[int16]interface{}, error) {
+	d.depth++
+	defer func() { d.depth-- }()
+	if d.depth > 64 {
+		return nil, errors.New("nested too deeply")
+	}
+	fields := make(map[int16]interface{})
+	var id int16
+	for {
+		header, err := d.byte()
+		if err != nil {
+			return nil, err
+		}
+		if header == 0 {
+			return fields, nil
+		}
+		if delta := header >> 4; delta != 0 {
+			id += int16(delta)
+		} else {
+			v, err := d.zigzag()
+			if err != nil {
+				return nil, err
+			}
+			id = int16(v)
+		}
+		kind := header & 0x0f
+		var value interface{}
+		switch kind {
+		case 1, 2:
+			value = kind == 1
+		default:
+			value, err = d.readValue(kind)
+			if err != nil {
+				return nil, err
+			}
+		}
+		fields[id] = value
+	}
+}
+
+func (d *thriftDecoder) readValue(kind byte) (interface{}, error) {
+	switch kind {
+	case 1, 2:
+		// Booleans in lists take a byte each
+		b, err := d.byte()
+		return b == 1, err
+	case 3:
+		b, err := d.byte()
+		return int8(b), err
+	case 4:
+		v, err := d.zigzag()
+		return int16(v), err
+	case 5:
+		v, err := d.zigzag()
+		return int32(v), err
+	case 6:
+		return d.zigzag()
+	case 7:
+		if d.pos+8 > len(d.data) {
+			return nil, errThriftTruncated
+		}
+		d.pos += 8
+		return math.Float64frombits(binary.LittleEndian.Uint64(d.data[d.pos-8:])), nil
+	case 8:
+		n, err := d.varint()
+		if err != nil {
+			return nil, err
+		}
+		if n > uint64(len(d.data)-d.pos) {
+			return nil, errThriftTruncated
+		}
+		d.pos += int(n)
+		return string(d.data[d.pos-int(n) : d.pos]), nil
+	case 9, 10:
+		header, err := d.byte()
+		if err != nil {
+			return nil, err
+		}
+		size := uint64(header >> 4)
+		if size == 15 {
+			if size, err = d.varint(); err != nil {
+				return nil, err
+			}
+		}
+		if size > uint64(len(d.data)-d.pos) {
+			return nil, errThriftTruncated
+		}
+		list := make([]interface{}, size)
+		for i := range list {
+			if list[i], err = d.readValue(header & 0x0f); err != nil {
+				return nil, err
+			}
+		}
+		return list, nil
+	case 11:
+		size, err := d.varint()
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return map[interface{}]interface{}{}, nil
+		}
+		types, err := d.byte()
+		if err != nil {
+			return nil, err
+		}
+		if size > uint64(len(d.data)-d.pos) {
+			return nil, errThriftTruncated
+		}
+		m := make(map[interface{}]interface{})
+		for ; size > 0; size-- {
+			key, err := d.readValue(types >> 4)
+			if err != nil {
+				return nil, err
+			}
+			value, err := d.readValue(types & 0x0f)
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := key.(map[int16]interface{}); !ok {
+				m[key] = value
+			}
+		}
+		return m, nil
+	case 12:
+		return d.readStruct()
+	}
+	return nil, fmt.Errorf("unknown type %d", kind)
+}
+
+// parquetSampler prints rows of a Parquet file as JSON, with whichever
+// library is installed
+const parquetSampler = `
+import json, sys
+path, offset, limit = sys.argv[1], int(sys.argv[2]), int(sys.argv[3])
+try:
+    import pyarrow.parquet as pq
+    pf = pq.ParquetFile(path)
+    columns, rows, seen = pf.schema_arrow.names, [], 0
+    for batch in pf.iter_batches(batch_size=1024):
+        for row in batch.to_pylist():
+            if seen >= offset and len(rows) < limit:
+                rows.append([row[c] for c in columns])
+            seen += 1
+        if len(rows) >= limit:
+            break
+except ImportError:
+    import duckdb
+    rel = duckdb.sql("select * from read_parquet(?) limit ? offset ?", params=[path, limit, offset])
+    columns, rows = rel.columns, rel.fetchall()
+print(json.dumps({"columns": columns, "rows": [["" if v is None else str(v) for v in r] for r in rows]}))
+`
+
+type parquetSample struct {
+	Columns []string   `json:"columns"`
+	Rows    [][]string `json:"rows"`
+}
+
+func parquetRows(fullPath string, rows, offset int) (*parquetSample, error) {
+	python, err := exec.LookPath("python3")
+	if err != nil {
+		if python, err = exec.LookPath("python"); err != nil {
+			return nil, errors.New("needs Python with pyarrow or duckdb")
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, python, "-c", parquetSampler, fullPath, strconv.Itoa(offset), strconv.Itoa(rows))
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		if strings.Contains(stderr.String(), "ModuleNotFoundError") {
+			return nil, errors.New("needs Python with pyarrow or duckdb")
+		}
+		lines := strings.Split(strings.TrimSpace(stderr.String()), "\n")
+		return nil, errors.New(lines[len(lines)-1])
+	}
+	var sample parquetSample
+	if err := json.Unmarshal(output, &sample); err != nil {
+		return nil, fmt.Errorf("failed to read rows: %v", err)
+	}
+	return &sample, nil
+}
@@ -0,0 +1,143 @@
+package agent
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestGuessDelimiter(t *testing.T) {
+	tests := []struct {
+		path, head string
+		want       rune
+	}{
+		{"a.csv", "id,name,price\n1,a,2\n", ','},
+		{"a.tsv", "id,name\n", '\t'},
+		{"a.TAB", "a b\n", '\t'},
+		{"a.txt", "id\tname\tprice\n", '\t'},
+		{"a.txt", "id;name;price\n1,5;a;2,5\n", ';'},
+		{"a.txt", "id|name\n", '|'},
+		{"a.txt", "only\n", ','},
+	}
+	for _, test := range tests {
+		if got := guessDelimiter(test.path, []byte(test.head)); got != test.want {
+			t.Errorf("guessDelimiter(%q, %q) = %q, want %q", test.path, test.head, got, test.want)
+		}
+	}
+}
+
+func TestPreviewTable(t *testing.T) {
+	e := newToolEngine(t)
+	writeTestFile(t, e, "a.csv", "id,name,price,when\n1,ann,2.5,2024-01-01\n2,\"bob, jr\",,2024-01-02\n3,cy,4,2024-01-03T10:00:00Z,extra\n")
+	writeTestFile(t, e, "b.txt", "a;b\n1;x\n")
+	writeTestFile(t, e, "c.tsv", "a\tb\n"+strings.Repeat("x", 100)+"\ttrue\n")
+	writeTestFile(t, e, "empty.csv", "")
+
+	tests := []struct {
+		args map[string]interface{}
+		want string
+	}{
+		{map[string]interface{}{"path": "a.csv", "rows": 2, "offset": 1}, `a.csv: CSV, 4 columns, 3 rows
+Rows with a different number of fields from the header: 1
+
+Columns:
+  id: integer
+  name: string
+  price: number (1 empty)
+  when: datetime
+
+Rows 2-3:
+| id | name | price | when |
+| --- | --- | --- | --- |
+| 2 | bob, jr |  | 2024-01-02 |
+| 3 | cy | 4 | 2024-01-03T10:00:00Z |
+`},
+		{map[string]interface{}{"path": "a.csv", "offset": 5}, "\nNo rows after offset 5\n"},
+		{map[string]interface{}{"path": "b.txt"}, `b.txt: delimited text (';'), 2 columns, 1 rows
+
+Columns:
+  a: integer
+  b: string
+
+Row 1:
+| a | b |
+| --- | --- |
+| 1 | x |
+`},
+		{map[string]interface{}{"path": "b.txt", "delimiter": ",", "rows": 0}, "b.txt: CSV, 1 columns, 1 rows\n\nColumns:\n  a;b: string\n"},
+		{map[string]interface{}{"path": "c.tsv"}, "  a: string (up to 100 characters)\n  b: boolean\n\nRow 1:\n| a | b |\n| --- | --- |\n| " + strings.Repeat("x", maxCellChars) + "... | true |\n"},
+		{map[string]interface{}{"path": "empty.csv"}, "empty.csv is empty"},
+	}
+	for _, test := range tests {
+		got, err := e.previewTable(args(t, test.args))
+		if err != nil {
+			t.Errorf("%v: %v", test.args, err)
+		} else if !strings.HasSuffix(got, test.want) {
+			t.Errorf("%v gives\n%s\nwant it to end\n%s", test.args, got, test.want)
+		}
+	}
+}
+
+func TestPreviewTableRowCap(t *testing.T) {
+	e := newToolEngine(t)
+	writeTestFile(t, e, "big.csv", "n\n"+strings.Repeat("1\n", maxCountRows+10))
+	got, err := e.previewTable(args(t, map[string]interface{}{"path": "big.csv", "rows": 1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(got, "big.csv: CSV, 1 columns, over 1000000 rows\n") {
+		t.Errorf("got\n%s", got)
+	}
+
+	got, err = e.previewTable(args(t, map[string]interface{}{"path": "big.csv", "rows": maxPreviewRows + 50}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(got, "Rows 1-100:") {
+		t.Errorf("rows were not capped at %d:\n%s", maxPreviewRows, got[:200])
+	}
+}
+
+// testdata/sample.parquet holds only metadata: a schema with a required
+// int64, a UTF-8 string, a decimal and a repeated string in a group
+func TestPreviewParquet(t *testing.T) {
+	e := newToolEngine(t)
+	data, err := os.ReadFile("testdata/sample.parquet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, e, "sample.parquet", string(data))
+	got, err := e.previewTable(args(t, map[string]interface{}{"path": "sample.parquet", "rows": 0}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `sample.parquet: Parquet, 4 columns, 3 rows in 0 row groups
+Created by wex test fixture
+
+Columns:
+  id: int64
+  name: string (nullable)
+  price: decimal(9,2) (nullable)
+  address.city: string (repeated)
+`
+	if got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+
+	// Damaged files are reported rather than misread
+	broken := []struct {
+		name, content, want string
+	}{
+		{"short.parquet", "PAR1", "not a Parquet file"},
+		{"magic.parquet", string(data[:len(data)-1]) + "2", "not a Parquet file"},
+		{"length.parquet", string(data[:len(data)-8]) + "\xff\xff\x00\x00PAR1", "invalid metadata length"},
+		{"truncated.parquet", "PAR1" + string(data[len(data)-60:]), "invalid metadata"},
+	}
+	for _, test := range broken {
+		writeTestFile(t, e, test.name, test.content)
+		_, err := e.previewTable(args(t, map[string]interface{}{"path": test.name, "rows": 0}))
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: got error %v, want %q", test.name, err, test.want)
+		}
+	}
+}
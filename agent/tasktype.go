@@ -0,0 +1,92 @@
+package agent
+
+import (
+	"embed"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// taskPrompts holds guidance for each type of task, added to the system
+// prompt, named for the task type
+//
+//go:embed task_prompts/*.txt
+var taskPrompts embed.FS
+
+const (
+	taskTypeAuto = "auto"
+	taskTypeNone = "none"
+)
+
+// taskTypes lists the types there is a prompt for
+func taskTypes() []string {
+	entries, _ := taskPrompts.ReadDir("task_prompts")
+	var types []string
+	for _, entry := range entries {
+		types = append(types, strings.TrimSuffix(entry.Name(), ".txt"))
+	}
+	sort.Strings(types)
+	return types
+}
+
+func parseTaskType(name string) (string, error) {
+	if name == taskTypeAuto || name == taskTypeNone {
+		return name, nil
+	}
+	for _, t := range taskTypes() {
+		if t == name {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("unknown task type %q: must be auto, none or one of %s", name, strings.Join(taskTypes(), ", "))
+}
+
+// taskTypePatterns recognize a request's type; whichever matches earliest
+// in the request wins, since the request usually says what to do first
+var taskTypePatterns = []struct {
+	taskType string
+	pattern  *regexp.Regexp
+}{
+	{"review", regexp.MustCompile(`(?i)\b(review|audit|critique|look over|check over)\b`)},
+	{"test", regexp.MustCompile(`(?i)\b((write|add|create|generate)\s+(\S+\s+){0,3}(tests?|test cases|specs)|(test\s+)?coverage)\b`)},
+	{"bug-fix", regexp.MustCompile(`(?i)\b(fix\w*|bugs?|crash\w*|fail\w*|broken|panics?|regression|doesn't work|not working)\b`)},
+	{"refactor", regexp.MustCompile(`(?i)\b(refactor\w*|rename|extract|restructure|reorgani[sz]e|simplify|clean\s*up|deduplicate|split\s+(\S+\s+){0,3}into)\b`)},
+}
+
+// featurePattern recognizes a feature, only if nothing more specific does
+var featurePattern = regexp.MustCompile(`(?i)\b(add|implement|create|build|introduce|support|make)\b`)
+
+// classifyTask guesses a request's type, or returns "" if it doesn't
+// look like any, as for a question
+func classifyTask(request string) string {
+	best, at := "", len(request)+1
+	for _, p := range taskTypePatterns {
+		if loc := p.pattern.FindStringIndex(request); loc != nil && loc[0] < at {
+			best, at = p.taskType, loc[0]
+		}
+	}
+	if best == "" && featurePattern.MatchString(request) {
+		best = "feature"
+	}
+	return best
+}
+
+// taskPrompt returns the guidance for a request, by the engine's task type
+// or else the request's own, along with the type
+func (e *Engine) taskPrompt(request string) (string, string) {
+	taskType := e.taskType
+	switch taskType {
+	case taskTypeNone:
+		return "", ""
+	case "", taskTypeAuto:
+		if taskType = classifyTask(request); taskType == "" {
+			return "", ""
+		}
+	}
+	data, err := taskPrompts.ReadFile("task_prompts/" + taskType + ".txt")
+	if err != nil {
+		return "", ""
+	}
+	return string(data), taskType
+}
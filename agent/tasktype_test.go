@@ -0,0 +1,58 @@
+package agent
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestClassifyTask(t *testing.T) {
+	tests := []struct {
+		request, want string
+	}{
+		{"Fix the panic in the config loader", "bug-fix"},
+		{"The server crashes when the port is in use", "bug-fix"},
+		{"Make the failing tests pass", "bug-fix"},
+		{"Add tests for the CSV parser", "test"},
+		{"Increase test coverage of the cache package", "test"},
+		{"Refactor the handler into smaller functions", "refactor"},
+		{"Rename getUser to fetchUser everywhere", "refactor"},
+		{"Review the changes on this branch", "review"},
+		{"Add a --verbose flag that logs each request", "feature"},
+		{"Implement pagination for the list endpoint", "feature"},
+		{"What does the scheduler do?", ""},
+	}
+	for _, test := range tests {
+		if got := classifyTask(test.request); got != test.want {
+			t.Errorf("classifyTask(%q) = %q, want %q", test.request, got, test.want)
+		}
+	}
+	for _, taskType := range taskTypes() {
+		if _, err := parseTaskType(taskType); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err := parseTaskType("debug"); err == nil || !strings.Contains(err.Error(), "bug-fix") {
+		t.Errorf("unknown type gave %v", err)
+	}
+}
+
+func TestTaskPrompt(t *testing.T) {
+	systemPrompt := func(request string, opts ...Option) string {
+		t.Helper()
+		e, provider, _ := newTestEngine(t, []ChatResponse{reply("Done.")}, opts...)
+		if _, err := e.Run(context.Background(), request); err != nil {
+			t.Fatal(err)
+		}
+		return provider.lastMessages(t, 1)[0].Content
+	}
+	if got := systemPrompt("Fix the off-by-one in paging"); !strings.Contains(got, "This task is a bug fix") {
+		t.Errorf("guessed system prompt:\n%s", got)
+	}
+	if got := systemPrompt("Fix the off-by-one in paging", WithTaskType("test")); !strings.Contains(got, "This task is writing tests") {
+		t.Errorf("chosen system prompt:\n%s", got)
+	}
+	if got := systemPrompt("Fix the off-by-one in paging", WithTaskType("none")); strings.Contains(got, "This task") {
+		t.Errorf("system prompt without a task type:\n%s", got)
+	}
+}
@@ -0,0 +1,376 @@
+package agent
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// A team is a pipeline of roles, each a session of its own with its own
+// system prompt, and possibly its own model and tools, that hand work on
+// to each other: by default a planner, a coder, a reviewer and a fixer.
+// Each role is given the task and the latest reply of every role before
+// it. A role with approve ends the pipeline when its reply starts or ends
+// with that word, and a role with then goes back to the role it names,
+// which is how the fixer hands its work back to the reviewer.
+
+// teamConfigFile is where a workspace's team is configured
+const teamConfigFile = ".wex-team.yaml"
+
+// defaultTeamConfig is the team used when the workspace has none
+const defaultTeamConfig = `# The roles of wex team, in order. Each has a name and a prompt, which is
+# added to the system prompt, and may have:
+#   model: the model for this role, if not the usual one
+#   tools: the only tools it is offered, e.g. [read_file, code_outline]
+#   read_only: true to keep it from changing the workspace
+#   approve: a word that, starting or ending its reply, ends the pipeline
+#   then: the role to go back to after this one
+# rounds is how many times a role may go back, as the fixer does to the
+# reviewer.
+rounds: 2
+roles:
+  - name: planner
+    read_only: true
+    prompt: |
+      You are the planner. Read the code the task concerns, then write a plan: the files to change, what to change in each, and how to check the result. Don't change anything; your plan is handed to the coder.
+  - name: coder
+    prompt: |
+      You are the coder. Carry out the plan you are given, following the style of the code around it, and run the tests. Finish with a summary of what you changed.
+  - name: reviewer
+    read_only: true
+    approve: APPROVED
+    prompt: |
+      You are the reviewer. Look over the changes made for the task, with git diff, and run the tests. If the changes carry out the task correctly and completely, reply with just APPROVED. Otherwise list each problem, with the file and line, for the fixer to fix. Don't change anything.
+  - name: fixer
+    then: reviewer
+    prompt: |
+      You are the fixer. Fix each problem the reviewer found, and nothing else, then run the tests. Finish with a summary of what you changed.
+`
+
+// agentRole is one role in a team
+type agentRole struct {
+	name     string
+	model    string
+	prompt   string
+	tools    []string
+	readOnly bool
+	approve  string
+	then     string
+}
+
+type teamConfig struct {
+	roles  []*agentRole
+	rounds int
+}
+
+// parseTeamConfig parses a team's YAML
+func parseTeamConfig(text string) (*teamConfig, error) {
+	root, err := parseYAMLDocument(text)
+	if err != nil {
+		return nil, err
+	}
+	if root.kind != "object" {
+		return nil, fmt.Errorf("expected a mapping with roles")
+	}
+	config := &teamConfig{rounds: 2}
+	for i, key := range root.keys {
+		value := root.children[i]
+		switch key {
+		case "rounds":
+			n, err := strconv.Atoi(yamlScalar(text, value))
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("rounds must be a number, not %q", yamlScalar(text, value))
+			}
+			config.rounds = n
+		case "roles":
+			if value.kind != "array" {
+				return nil, fmt.Errorf("roles must be a list")
+			}
+			for j, item := range value.children {
+				role, err := parseAgentRole(text, item)
+				if err != nil {
+					return nil, fmt.Errorf("role %d: %v", j+1, err)
+				}
+				config.roles = append(config.roles, role)
+			}
+		default:
+			return nil, fmt.Errorf("unknown key %q", key)
+		}
+	}
+
+	if len(config.roles) == 0 {
+		return nil, fmt.Errorf("no roles")
+	}
+	seen := make(map[string]bool)
+	for _, role := range config.roles {
+		if seen[role.name] {
+			return nil, fmt.Errorf("two roles are named %s", role.name)
+		}
+		seen[role.name] = true
+		if role.then != "" && !seen[role.then] {
+			return nil, fmt.Errorf("role %s goes back to %s, which is not a role before it", role.name, role.then)
+		}
+	}
+	return config, nil
+}
+
+func parseAgentRole(text string, n *docNode) (*agentRole, error) {
+	if n.kind != "object" {
+		return nil, fmt.Errorf("expected a mapping with a name and a prompt")
+	}
+	role := &agentRole{}
+	for i, key := range n.keys {
+		value := n.children[i]
+		switch key {
+		case "name":
+			role.name = yamlScalar(text, value)
+		case "model":
+			role.model = yamlScalar(text, value)
+		case "prompt":
+			role.prompt = yamlScalar(text, value)
+		case "tools":
+			role.tools = yamlList(text, value)
+		case "read_only":
+			switch yamlScalar(text, value) {
+			case "true", "yes", "on":
+				role.readOnly = true
+			case "false", "no", "off", "":
+			default:
+				return nil, fmt.Errorf("read_only must be true or false")
+			}
+		case "approve":
+			role.approve = yamlScalar(text, value)
+		case "then":
+			role.then = yamlScalar(text, value)
+		default:
+			return nil, fmt.Errorf("unknown key %q", key)
+		}
+	}
+	if role.name == "" {
+		return nil, fmt.Errorf("no name")
+	}
+	if strings.TrimSpace(role.prompt) == "" {
+		return nil, fmt.Errorf("%s has no prompt", role.name)
+	}
+	return role, nil
+}
+
+// yamlScalar is the value of a scalar: unquoted, a block scalar with its
+// indentation removed, or a plain scalar with its lines joined
+func yamlScalar(text string, n *docNode) string {
+	s := strings.TrimSpace(text[n.start:n.end])
+	switch {
+	case s == "" || s == "~" || s == "null":
+		return ""
+	case s[0] == '|' || s[0] == '>':
+		header, body, _ := strings.Cut(s, "\n")
+		body = dedent(body)
+		if header[0] == '>' {
+			var paragraphs []string
+			for _, paragraph := range strings.Split(body, "\n\n") {
+				paragraphs = append(paragraphs, strings.Join(strings.Fields(paragraph), " "))
+			}
+			body = strings.Join(paragraphs, "\n")
+		}
+		if !strings.Contains(header, "-") {
+			body += "\n"
+		}
+		return body
+	case s[0] == '"' || s[0] == '\'':
+		if value, _, err := quotedKey(s); err == nil {
+			return value
+		}
+	}
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(line)
+	}
+	return strings.Join(lines, " ")
+}
+
+// yamlList is the values of a list, or of a scalar of comma-separated
+// values
+func yamlList(text string, n *docNode) []string {
+	var values []string
+	if n.kind == "array" {
+		for _, child := range n.children {
+			values = append(values, yamlScalar(text, child))
+		}
+		return values
+	}
+	for _, value := range strings.Split(yamlScalar(text, n), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// approved reports whether a reply starts or ends with the approval word
+func approved(reply, word string) bool {
+	reply = strings.Trim(reply, " \t\r\n.!*`")
+	return strings.HasPrefix(reply, word) || strings.HasSuffix(reply, word)
+}
+
+// teamMessage is what a role is asked: the task, and what each role has
+// handed on so far, in the order they first spoke
+func teamMessage(task string, spoke []string, replies map[string]string) string {
+	var b strings.Builder
+	b.WriteString(task)
+	for _, name := range spoke {
+		fmt.Fprintf(&b, "\n\n## From the %s\n\n%s", name, strings.TrimSpace(replies[name]))
+	}
+	return b.String()
+}
+
+// runRole runs a session as a role, putting the engine back as it was
+// afterwards
+func (e *Engine) runRole(ctx context.Context, role *agentRole, message string) (*Result, error) {
+	model, systemPrompt, taskType := e.model, e.systemPrompt, e.taskType
+	enabled, filesystem, commandPolicy := e.toolFilter.Enabled, e.filesystem, e.commandPolicy
+	defer func() {
+		e.model, e.systemPrompt, e.taskType = model, systemPrompt, taskType
+		e.toolFilter.Enabled, e.filesystem, e.commandPolicy = enabled, filesystem, commandPolicy
+	}()
+
+	if role.model != "" {
+		e.model = role.model
+	}
+	e.systemPrompt = strings.TrimRight(e.systemPrompt, "\r\n") + "\n\n## Your role: " + role.name + "\n\n" + strings.TrimRight(role.prompt, "\r\n")
+	e.taskType = taskTypeNone
+	if len(role.tools) > 0 {
+		e.toolFilter.Enabled = make(map[string]bool)
+		for _, name := range role.tools {
+			e.toolFilter.Enabled[name] = true
+		}
+	}
+	if role.readOnly {
+		e.filesystem = readOnlyFS{e.files()}
+		e.commandPolicy = make(map[commandClass]string)
+		for class, action := range commandPolicy {
+			e.commandPolicy[class] = action
+		}
+		for _, class := range []commandClass{classWrite, classUnknown, classNetwork, classDestructive} {
+			e.commandPolicy[class] = policyDeny
+		}
+	}
+	return e.Run(ctx, message)
+}
+
+// runTeam handles "wex team", which has a team of roles work on a task in
+// turn
+func runTeam(engine *Engine, args []string, w io.Writer) error {
+	teamFlags := flag.NewFlagSet("team", flag.ExitOnError)
+	configPath := teamFlags.String("config", "", "The team's YAML (default "+teamConfigFile+" in the workspace, or else the built-in team)")
+	transcriptPath := teamFlags.String("transcript", "", "Write what each role was asked and replied to this Markdown file")
+	rounds := teamFlags.Int("rounds", -1, "How many times a role may go back, overriding the configuration")
+	printConfig := teamFlags.Bool("print-config", false, "Print the built-in team's YAML, to start a configuration from, and exit")
+	teamFlags.Usage = func() {
+		fmt.Fprintf(teamFlags.Output(), "Usage: wex [flags] team [--config FILE] [--transcript FILE] [--rounds N] task\n")
+		teamFlags.PrintDefaults()
+	}
+	teamFlags.Parse(args)
+	if *printConfig {
+		fmt.Fprint(w, defaultTeamConfig)
+		return nil
+	}
+	task := strings.TrimSpace(strings.Join(teamFlags.Args(), " "))
+	if task == "" {
+		return fmt.Errorf("no task given")
+	}
+
+	text := defaultTeamConfig
+	switch {
+	case *configPath != "":
+		data, err := os.ReadFile(*configPath)
+		if err != nil {
+			return fmt.Errorf("failed to read the team: %v", err)
+		}
+		text = string(data)
+	case engine.fileExists(teamConfigFile):
+		text = engine.readWorkspaceFile(teamConfigFile)
+	}
+	config, err := parseTeamConfig(text)
+	if err != nil {
+		return fmt.Errorf("invalid team: %v", err)
+	}
+	if *rounds >= 0 {
+		config.rounds = *rounds
+	}
+	gated := false
+	for _, role := range config.roles {
+		for _, name := range role.tools {
+			if !hasTool(engine.getTools(), name) {
+				return fmt.Errorf("role %s: unknown tool: %s", role.name, name)
+			}
+		}
+		gated = gated || role.approve != ""
+	}
+
+	ctx := context.Background()
+	replies := make(map[string]string)
+	var spoke []string
+	var transcript strings.Builder
+	fmt.Fprintf(&transcript, "# Team transcript\n\n%s\n", task)
+	done := false
+	went := 0
+	for i, step := 0, 1; i < len(config.roles); step++ {
+		role := config.roles[i]
+		message := teamMessage(task, spoke, replies)
+		model := role.model
+		if model == "" {
+			model = engine.model
+		}
+		engine.emit(Event{Type: EventRoleStarted, Role: role.name, Text: message})
+		result, err := engine.runRole(ctx, role, message)
+		if err != nil {
+			return fmt.Errorf("%s: %v", role.name, err)
+		}
+		fmt.Fprintf(w, "%d. %s (%s): %s\n", step, role.name, model, plural(result.Turns, "turn"))
+		fmt.Fprintf(&transcript, "\n## %d. %s (%s)\n\n%s\n", step, role.name, model, strings.TrimSpace(result.Reply))
+
+		if _, ok := replies[role.name]; !ok {
+			spoke = append(spoke, role.name)
+		}
+		replies[role.name] = result.Reply
+		if role.approve != "" {
+			if approved(result.Reply, role.approve) {
+				fmt.Fprintf(w, "Approved by the %s\n", role.name)
+				done = true
+				break
+			}
+			// With no rounds left, there's no point fixing what would
+			// not be reviewed
+			if went == config.rounds {
+				break
+			}
+		}
+		if role.then == "" {
+			i++
+			continue
+		}
+		if went == config.rounds {
+			break
+		}
+		went++
+		for j, r := range config.roles {
+			if r.name == role.then {
+				i = j
+			}
+		}
+	}
+
+	if *transcriptPath != "" {
+		if err := writeSealed(*transcriptPath, []byte(transcript.String()), engine.sessionKey); err != nil {
+			return fmt.Errorf("failed to write the transcript: %v", err)
+		}
+	}
+	if gated && !done {
+		return fmt.Errorf("not approved after %s of fixes", plural(went, "round"))
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseTeamConfig(t *testing.T) {
+	config, err := parseTeamConfig(defaultTeamConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, role := range config.roles {
+		names = append(names, role.name)
+	}
+	if strings.Join(names, " ") != "planner coder reviewer fixer" || config.rounds != 2 {
+		t.Errorf("roles %v, rounds %d", names, config.rounds)
+	}
+	planner, reviewer, fixer := config.roles[0], config.roles[2], config.roles[3]
+	if !planner.readOnly || !strings.HasPrefix(planner.prompt, "You are the planner.") || !strings.HasSuffix(planner.prompt, "handed to the coder.\n") {
+		t.Errorf("planner %+v", planner)
+	}
+	if reviewer.approve != "APPROVED" || fixer.then != "reviewer" || config.roles[1].readOnly {
+		t.Errorf("reviewer %+v, fixer %+v", reviewer, fixer)
+	}
+
+	config, err = parseTeamConfig(`rounds: 0
+roles:
+  - name: "architect"   # plans
+    model: qwen2.5-coder:32b
+    tools: [read_file, code_outline]
+    prompt: >
+      Design it,
+      then stop.
+  - name: builder
+    tools: write_file, run_command
+    prompt: 'Build what''s designed'
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	architect, builder := config.roles[0], config.roles[1]
+	if architect.name != "architect" || architect.model != "qwen2.5-coder:32b" || strings.Join(architect.tools, ",") != "read_file,code_outline" || architect.prompt != "Design it, then stop.\n" {
+		t.Errorf("architect %+v", architect)
+	}
+	if strings.Join(builder.tools, ",") != "write_file,run_command" || builder.prompt != "Build what's designed" || config.rounds != 0 {
+		t.Errorf("builder %+v", builder)
+	}
+
+	for text, want := range map[string]string{
+		"roles:\n  - name: a\n":                                            "role 1: a has no prompt",
+		"roles:\n  - name: a\n    prompt: x\n    colour: red\n":            `unknown key "colour"`,
+		"roles:\n  - name: a\n    prompt: x\n    then: b\n":                "goes back to b, which is not a role before it",
+		"roles:\n  - name: a\n    prompt: x\n  - name: a\n    prompt: y\n": "two roles are named a",
+		"rounds: many\nroles:\n  - name: a\n    prompt: x\n":               "rounds must be a number",
+	} {
+		if _, err := parseTeamConfig(text); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q gives %v, want %q", text, err, want)
+		}
+	}
+}
+
+func TestTeam(t *testing.T) {
+	e, provider, events := newTestEngine(t, []ChatResponse{
+		reply("", call("write_file", `{"path": "a.txt", "content": "early"}`)),
+		reply("Plan: write hello to a.txt"),
+		reply("", call("write_file", `{"path": "a.txt", "content": "hello"}`)),
+		reply("Wrote a.txt"),
+		reply("a.txt:1 is missing its newline"),
+		reply("", call("write_file", `{"path": "a.txt", "content": "hello\n"}`)),
+		reply("Added the newline"),
+		reply("APPROVED."),
+	})
+	transcript := filepath.Join(t.TempDir(), "team.md")
+	var out strings.Builder
+	if err := runTeam(e, []string{"--transcript", transcript, "Put hello in a.txt"}, &out); err != nil {
+		t.Fatalf("%v\n%s", err, out.String())
+	}
+
+	if data, _ := os.ReadFile(filepath.Join(e.workspace, "a.txt")); string(data) != "hello\n" {
+		t.Errorf("a.txt has %q", data)
+	}
+	if results := toolResults(provider.lastMessages(t, 2)); len(results) != 1 || !strings.Contains(results[0].Content, "read-only") {
+		t.Errorf("the planner could write: %+v", results)
+	}
+	if system := provider.lastMessages(t, 3)[0].Content; !strings.Contains(system, "## Your role: coder\n\nYou are the coder.") || strings.Contains(system, "planner") {
+		t.Errorf("coder's system prompt:\n%s", system)
+	}
+	fixerMessage := provider.lastMessages(t, 6)[1].Content
+	for _, want := range []string{"Put hello in a.txt\n\n## From the planner\n\nPlan: write hello", "## From the coder\n\nWrote a.txt", "## From the reviewer\n\na.txt:1 is missing its newline"} {
+		if !strings.Contains(fixerMessage, want) {
+			t.Errorf("fixer's message is missing %q:\n%s", want, fixerMessage)
+		}
+	}
+	if want := "1. planner (test-model): 2 turns\n2. coder (test-model): 2 turns\n3. reviewer (test-model): 1 turn\n4. fixer (test-model): 2 turns\n5. reviewer (test-model): 1 turn\nApproved by the reviewer\n"; out.String() != want {
+		t.Errorf("output:\n%s", out.String())
+	}
+
+	var roles []string
+	for _, event := range *events {
+		if event.Type == EventRoleStarted {
+			roles = append(roles, event.Role)
+		}
+	}
+	if strings.Join(roles, " ") != "planner coder reviewer fixer reviewer" {
+		t.Errorf("role_started events for %v", roles)
+	}
+	data, err := os.ReadFile(transcript)
+	if err != nil || !strings.Contains(string(data), "## 4. fixer (test-model)\n\nAdded the newline\n\n## 5. reviewer (test-model)\n\nAPPROVED.") {
+		t.Errorf("transcript:\n%s", data)
+	}
+}
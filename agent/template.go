@@ -0,0 +1,95 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// PromptContext holds the variables available to the system prompt, and to
+// the user message with --template, e.g. {{.GitBranch}} or {{.Env.HOME}}
+type PromptContext struct {
+	OS           string
+	Arch         string
+	Date         string
+	Workspace    string
+	RepoName     string
+	GitBranch    string
+	GitCommit    string
+	ChangedFiles fileList
+	Env          map[string]string
+}
+
+// fileList prints as a comma-separated list but can still be ranged over
+type fileList []string
+
+func (f fileList) String() string {
+	return strings.Join(f, ", ")
+}
+
+// promptContext gathers template variables; git details are left empty when
+// the workspace is not a repository
+func (e *Engine) promptContext() PromptContext {
+	ctx := PromptContext{
+		OS:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+		Date:      time.Now().Format("2006-01-02"),
+		Workspace: e.workspace,
+		RepoName:  filepath.Base(e.workspace),
+		Env:       make(map[string]string),
+	}
+
+	for _, kv := range os.Environ() {
+		if name, value, ok := strings.Cut(kv, "="); ok {
+			ctx.Env[name] = value
+		}
+	}
+
+	if top, err := e.git("rev-parse", "--show-toplevel"); err == nil {
+		ctx.RepoName = filepath.Base(top)
+	}
+	ctx.GitBranch, _ = e.git("rev-parse", "--abbrev-ref", "HEAD")
+	ctx.GitCommit, _ = e.git("rev-parse", "--short", "HEAD")
+
+	if status, err := e.git("status", "--porcelain"); err == nil {
+		for _, line := range strings.Split(status, "\n") {
+			if len(line) > 3 {
+				ctx.ChangedFiles = append(ctx.ChangedFiles, line[3:])
+			}
+		}
+	}
+	return ctx
+}
+
+// git runs a git command in the workspace and returns its trimmed output
+func (e *Engine) git(args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = e.workspace
+	output, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// expandTemplate expands template variables in text; text without any
+// template actions is returned unchanged
+func expandTemplate(name, text string, ctx PromptContext) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+	tmpl, err := template.New(name).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("invalid template in %s: %v", name, err)
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, ctx); err != nil {
+		return "", fmt.Errorf("failed to expand %s: %v", name, err)
+	}
+	return b.String(), nil
+}
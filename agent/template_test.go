@@ -0,0 +1,57 @@
+package agent
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestExpandTemplate(t *testing.T) {
+	ctx := PromptContext{
+		OS:           "linux",
+		GitBranch:    "main",
+		ChangedFiles: fileList{"a.go", "b.go"},
+		Env:          map[string]string{"HOME": "/home/t"},
+	}
+	for text, want := range map[string]string{
+		"No variables, {not a template}":                       "No variables, {not a template}",
+		"On {{.OS}}, branch {{.GitBranch}}":                    "On linux, branch main",
+		"Changed: {{.ChangedFiles}}":                           "Changed: a.go, b.go",
+		"{{range .ChangedFiles}}[{{.}}]{{end}}":                "[a.go][b.go]",
+		"Home {{.Env.HOME}}, unset {{.Env.NOT_SET}}.":          "Home /home/t, unset .",
+		"{{if .GitCommit}}at {{.GitCommit}}{{else}}new{{end}}": "new",
+	} {
+		if got, err := expandTemplate("prompt", text, ctx); err != nil || got != want {
+			t.Errorf("%s: got %q, %v, want %q", text, got, err, want)
+		}
+	}
+	if _, err := expandTemplate("prompt", "{{.OS", ctx); err == nil || !strings.Contains(err.Error(), "invalid template in prompt") {
+		t.Errorf("unclosed action: %v", err)
+	}
+	if _, err := expandTemplate("prompt", "{{.Nothing}}", ctx); err == nil {
+		t.Error("an unknown field was expanded")
+	}
+}
+
+func TestPromptContext(t *testing.T) {
+	e := newToolEngine(t)
+	t.Setenv("WEX_TEMPLATE_TEST", "set")
+	ctx := e.promptContext()
+	if ctx.OS != runtime.GOOS || ctx.Workspace != e.workspace || ctx.Env["WEX_TEMPLATE_TEST"] != "set" || ctx.GitBranch != "" || len(ctx.ChangedFiles) != 0 {
+		t.Errorf("outside a repository: %+v", ctx)
+	}
+
+	writeTestFile(t, e, "main.go", "package main\n")
+	for _, args := range [][]string{
+		{"init", "--quiet", "--initial-branch", "trunk"},
+		{"-c", "user.name=t", "-c", "user.email=t@t", "commit", "--quiet", "--allow-empty", "-m", "base"},
+	} {
+		if _, err := gitIn(e.workspace, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx = e.promptContext()
+	if ctx.GitBranch != "trunk" || ctx.GitCommit == "" || ctx.ChangedFiles.String() != "main.go" {
+		t.Errorf("in a repository: %+v", ctx)
+	}
+}
@@ -0,0 +1,345 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newToolEngine(t *testing.T) *Engine {
+	t.Helper()
+	return &Engine{
+		workspace:     t.TempDir(),
+		maxReadBytes:  defaultMaxReadBytes,
+		symlinkPolicy: symlinkWithin,
+		readDedup:     true,
+	}
+}
+
+func args(t *testing.T, v interface{}) json.RawMessage {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func writeTestFile(t *testing.T, e *Engine, path, content string) {
+	t.Helper()
+	fullPath := filepath.Join(e.workspace, path)
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fullPath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTruncateOutput(t *testing.T) {
+	short := strings.Repeat("a", maxCommandOutputBytes)
+	if got, truncated := truncateOutput(short); got != short || truncated {
+		t.Errorf("output at the limit was truncated")
+	}
+
+	long := strings.Repeat("a", maxCommandOutputBytes) + strings.Repeat("b", 5000) + strings.Repeat("c", maxCommandOutputBytes)
+	got, truncated := truncateOutput(long)
+	if !truncated {
+		t.Fatal("long output was not truncated")
+	}
+	if !strings.HasPrefix(got, "aaa") || !strings.HasSuffix(got, "ccc") {
+		t.Errorf("truncation lost the start or end")
+	}
+	if !strings.Contains(got, "(25000 bytes omitted)") {
+		t.Errorf("truncation note missing: %q", got[maxCommandOutputBytes/2:maxCommandOutputBytes/2+40])
+	}
+	if len(got) > maxCommandOutputBytes+100 {
+		t.Errorf("truncated output is %d bytes", len(got))
+	}
+}
+
+func TestWriteQuota(t *testing.T) {
+	e := newToolEngine(t)
+	e.quota.MaxBytes = 10
+	e.quota.MaxFiles = 2
+
+	if _, err := e.writeFile(args(t, map[string]string{"path": "a.txt", "content": "12345"})); err != nil {
+		t.Fatal(err)
+	}
+	_, err := e.writeFile(args(t, map[string]string{"path": "b.txt", "content": "123456"}))
+	if err == nil || !strings.Contains(err.Error(), "write quota exceeded") {
+		t.Errorf("got error %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(e.workspace, "b.txt")); err == nil {
+		t.Error("file over quota was written")
+	}
+
+	// Overwriting counts bytes but not files
+	if _, err := e.writeFile(args(t, map[string]string{"path": "a.txt", "content": "1"})); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.writeFile(args(t, map[string]string{"path": "b.txt", "content": "1"})); err != nil {
+		t.Fatal(err)
+	}
+	_, err = e.writeFile(args(t, map[string]string{"path": "c.txt", "content": ""}))
+	if err == nil || !strings.Contains(err.Error(), "file quota exceeded") {
+		t.Errorf("got error %v", err)
+	}
+}
+
+func TestDiffBudget(t *testing.T) {
+	e := newToolEngine(t)
+	e.diffBudget.MaxLines = 4
+	e.diffBudget.MaxFiles = 2
+	var asked []string
+	approve := false
+	e.approver = func(action string) bool {
+		asked = append(asked, action)
+		return approve
+	}
+	write := func(path, content string) error {
+		_, err := e.writeFile(args(t, map[string]string{"path": path, "content": content}))
+		return err
+	}
+
+	writeTestFile(t, e, "a.txt", "1\n2\n3\n")
+	e.diffBudget.startTurn()
+	if err := write("a.txt", "1\ntwo\n3\n"); err != nil {
+		t.Fatal(err)
+	}
+	// Against the start of the turn, this is still one line changed
+	if err := write("a.txt", "1\nTWO\n3\n"); err != nil {
+		t.Fatal(err)
+	}
+	err := write("b.txt", "x\ny\nz\n")
+	if err == nil || !strings.Contains(err.Error(), "smaller steps") || len(asked) != 1 {
+		t.Errorf("over budget gave %v, asked %q", err, asked)
+	}
+	if _, err := os.Stat(filepath.Join(e.workspace, "b.txt")); err == nil {
+		t.Error("file over budget was written")
+	}
+
+	// A dry run costs nothing, but a replacement over budget writes nothing
+	writeTestFile(t, e, "c.txt", "x\n")
+	writeTestFile(t, e, "d.txt", "x\n")
+	if _, err := e.replaceAcrossFiles(args(t, map[string]interface{}{"find": "x", "replace": "y", "dry_run": true})); err != nil {
+		t.Errorf("dry run gave %v", err)
+	}
+	if _, err := e.replaceAcrossFiles(args(t, map[string]interface{}{"find": "x", "replace": "y"})); err == nil {
+		t.Error("replacement over the file budget was allowed")
+	}
+	if data, _ := os.ReadFile(filepath.Join(e.workspace, "c.txt")); string(data) != "x\n" {
+		t.Errorf("c.txt was changed to %q", data)
+	}
+
+	// Approved, the rest of the turn can go over without asking again
+	approve = true
+	if err := write("b.txt", "x\ny\nz\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := write("c.txt", "y\n"); err != nil || len(asked) != 3 {
+		t.Errorf("after approval got %v, asked %d times", err, len(asked))
+	}
+
+	e.diffBudget.startTurn()
+	approve = false
+	if err := write("b.txt", "x\n"); err != nil {
+		t.Errorf("a new turn is still over budget: %v", err)
+	}
+}
+
+func TestReadSizeLimit(t *testing.T) {
+	e := newToolEngine(t)
+	e.maxReadBytes = 100
+	writeTestFile(t, e, "big.txt", strings.Repeat("line\n", 50))
+
+	_, err := e.readFile(args(t, map[string]interface{}{"path": "big.txt"}))
+	if err == nil || !strings.Contains(err.Error(), "over the limit of 100") {
+		t.Errorf("got error %v", err)
+	}
+	if _, err := e.readFile(args(t, map[string]interface{}{"path": "big.txt", "start_line": 1, "end_line": 3})); err != nil {
+		t.Errorf("line range refused: %v", err)
+	}
+	if _, err := e.readFile(args(t, map[string]interface{}{"path": "big.txt", "force": true})); err != nil {
+		t.Errorf("forced read refused: %v", err)
+	}
+}
+
+func TestReadDedup(t *testing.T) {
+	e := newToolEngine(t)
+	writeTestFile(t, e, "a.txt", "one\ntwo\n")
+	read := func(v map[string]interface{}) string {
+		t.Helper()
+		out, err := e.readFile(args(t, v))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+
+	if out := read(map[string]interface{}{"path": "a.txt"}); !strings.Contains(out, "two") {
+		t.Fatalf("first read gave %q", out)
+	}
+	if out := read(map[string]interface{}{"path": "a.txt", "start_line": 2, "end_line": 2}); !strings.Contains(out, "unchanged since it was last read") {
+		t.Errorf("range of a file already read gave %q", out)
+	}
+	if out := read(map[string]interface{}{"path": "a.txt", "force": true}); !strings.Contains(out, "two") {
+		t.Errorf("forced read gave %q", out)
+	}
+
+	writeTestFile(t, e, "a.txt", "one\nthree\n")
+	if out := read(map[string]interface{}{"path": "a.txt"}); !strings.Contains(out, "three") {
+		t.Errorf("read after a change gave %q", out)
+	}
+}
+
+func TestReadFilesBudget(t *testing.T) {
+	e := newToolEngine(t)
+	e.maxReadBytes = 0
+	writeTestFile(t, e, "small.txt", "small\n")
+	writeTestFile(t, e, "large.txt", strings.Repeat("x", maxReadFilesBytes))
+
+	out, err := e.readFiles(args(t, map[string]interface{}{"paths": []string{"small.txt", "missing.txt", "large.txt"}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "==> small.txt <==\nsmall\n") {
+		t.Errorf("small file missing from %q", out)
+	}
+	if !strings.Contains(out, "==> missing.txt <==\nError: ") {
+		t.Errorf("missing file not reported in %q", out)
+	}
+	if !strings.Contains(out, "read them separately: large.txt") {
+		t.Errorf("large file not listed as omitted in %q", out)
+	}
+
+	// The omitted file was not recorded as read
+	if out, err := e.readFile(args(t, map[string]string{"path": "large.txt"})); err != nil || strings.Contains(out, "unchanged") {
+		t.Errorf("omitted file then read as %.60q, %v", out, err)
+	}
+}
+
+func TestPathsStayInWorkspace(t *testing.T) {
+	e := newToolEngine(t)
+	for _, path := range []string{"../outside.txt", "a/../../outside.txt"} {
+		if _, err := e.writeFile(args(t, map[string]string{"path": path, "content": "x"})); err == nil {
+			t.Errorf("wrote %s", path)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(e.workspace), "outside.txt")); err == nil {
+		t.Error("file written outside the workspace")
+	}
+}
+
+func TestRelativePaths(t *testing.T) {
+	e := &Engine{workspace: "/workspace", hostWorkspace: "/home/ann/project"}
+	for text, want := range map[string]string{
+		`File "/workspace/src/app.py", line 3`:           `File "src/app.py", line 3`,
+		"cd /workspace && make\n/workspace: done":        "cd . && make\n.: done",
+		"/home/ann/project/main.go:12: undefined: x":     "main.go:12: undefined: x",
+		"/workspace2/a /data/workspace/b /workspace.bak": "/workspace2/a /data/workspace/b /workspace.bak",
+		"open /workspace/: is a directory":               "open ./: is a directory",
+	} {
+		if got := e.relativePaths(text); got != want {
+			t.Errorf("relativePaths(%q) = %q, want %q", text, got, want)
+		}
+	}
+
+	e, provider, _ := newTestEngine(t, []ChatResponse{
+		reply("", call("run_command", `{"command": "pwd"}`), call("read_file", `{"path": "config"}`)),
+		reply("Done."),
+	})
+	writeTestFile(t, e, "config", "root = "+e.workspace+"/data\n")
+	if _, err := e.Run(context.Background(), "Where am I?"); err != nil {
+		t.Fatal(err)
+	}
+	results := toolResults(provider.lastMessages(t, 2))
+	if strings.Contains(results[0].Content, e.workspace) || !strings.Contains(results[1].Content, e.workspace+"/data") {
+		t.Errorf("tool results\n%s\n%s", results[0].Content, results[1].Content)
+	}
+}
+
+func TestWriteFileChunk(t *testing.T) {
+	e := newToolEngine(t)
+	chunk := func(v map[string]string) (string, error) {
+		return e.writeFileChunk(args(t, v))
+	}
+	if _, err := chunk(map[string]string{"path": "data.csv", "action": "append", "content": "x"}); err == nil {
+		t.Error("appended before begin")
+	}
+	if _, err := chunk(map[string]string{"path": "../data.csv", "action": "begin"}); err == nil {
+		t.Error("began a file outside the workspace")
+	}
+
+	chunk(map[string]string{"path": "data.csv", "action": "begin", "content": "stale\n"})
+	result, err := chunk(map[string]string{"path": "./data.csv", "action": "begin", "content": "a,b\n", "mode": "0600"})
+	if err != nil || !strings.Contains(result, "discarded 6 bytes") {
+		t.Errorf("begin again gave %q, %v", result, err)
+	}
+	result, err = chunk(map[string]string{"path": "data.csv", "action": "append", "content": "1,2\n"})
+	if err != nil || !strings.Contains(result, `2 chunks`) || !strings.Contains(result, `ending with "1,2\n"`) {
+		t.Errorf("append gave %q, %v", result, err)
+	}
+	if _, err := os.Stat(filepath.Join(e.workspace, "data.csv")); err == nil {
+		t.Error("file written before commit")
+	}
+	if _, err := chunk(map[string]string{"path": "data.csv", "action": "commit", "content": "3,4\n"}); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(filepath.Join(e.workspace, "data.csv"))
+	info, _ := os.Stat(filepath.Join(e.workspace, "data.csv"))
+	if string(data) != "a,b\n1,2\n3,4\n" || info.Mode().Perm() != 0600 {
+		t.Errorf("committed %q with mode %v", data, info.Mode().Perm())
+	}
+	if _, err := chunk(map[string]string{"path": "data.csv", "action": "commit"}); err == nil {
+		t.Error("committed twice")
+	}
+
+	chunk(map[string]string{"path": "big.bin", "action": "begin", "content": "x"})
+	if _, err := chunk(map[string]string{"path": "big.bin", "action": "abort"}); err != nil || len(e.chunkedWrites) != 0 {
+		t.Errorf("abort gave %v, leaving %d staged", err, len(e.chunkedWrites))
+	}
+}
+
+func TestReplaceAcrossFiles(t *testing.T) {
+	e := newToolEngine(t)
+	writeTestFile(t, e, "src/user.ts", "export function fetchUser() {}\nexport function fetchUsers() {}\n")
+	writeTestFile(t, e, "src/api/client.ts", "import { fetchUser } from '../user'\nfetchUser()\n")
+	writeTestFile(t, e, "docs/notes.md", "Call fetchUser to get one\n")
+	writeTestFile(t, e, "node_modules/x/index.ts", "fetchUser()\n")
+	replace := func(v map[string]interface{}) (string, error) {
+		return e.replaceAcrossFiles(args(t, v))
+	}
+
+	result, err := replace(map[string]interface{}{"find": "fetchUser", "replace": "loadUser", "whole_word": true, "glob": "src/**/*.ts", "dry_run": true})
+	if err != nil || !strings.Contains(result, "src/api/client.ts: 2\n") || !strings.Contains(result, "src/user.ts: 1\n") ||
+		!strings.Contains(result, "  2- fetchUser()\n  2+ loadUser()\n") || !strings.HasSuffix(result, "Would replace 3 matches in 2 files") {
+		t.Errorf("dry run gave %v:\n%s", err, result)
+	}
+	data, _ := os.ReadFile(filepath.Join(e.workspace, "src/user.ts"))
+	if strings.Contains(string(data), "loadUser") {
+		t.Error("dry run wrote a file")
+	}
+
+	if _, err := replace(map[string]interface{}{"find": "fetchUser", "replace": "loadUser", "whole_word": true, "glob": "src/**/*.ts"}); err != nil {
+		t.Fatal(err)
+	}
+	data, _ = os.ReadFile(filepath.Join(e.workspace, "src/user.ts"))
+	notes, _ := os.ReadFile(filepath.Join(e.workspace, "docs/notes.md"))
+	vendored, _ := os.ReadFile(filepath.Join(e.workspace, "node_modules/x/index.ts"))
+	if string(data) != "export function loadUser() {}\nexport function fetchUsers() {}\n" ||
+		strings.Contains(string(notes), "loadUser") || strings.Contains(string(vendored), "loadUser") {
+		t.Errorf("after replacing:\n%s\n%s\n%s", data, notes, vendored)
+	}
+
+	result, err = replace(map[string]interface{}{"find": `function (\w+)\(\)`, "replace": "const $1 = () =>", "regex": true, "glob": "*.ts"})
+	if err != nil || !strings.HasSuffix(result, "Replaced 2 matches in 1 files") {
+		t.Errorf("regex replace gave %v:\n%s", err, result)
+	}
+	if result, err := replace(map[string]interface{}{"find": "$x", "replace": "$1"}); err != nil || !strings.HasPrefix(result, "No matches") {
+		t.Errorf("literal $ gave %q, %v", result, err)
+	}
+}
@@ -0,0 +1,71 @@
+package agent
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ToolFilter narrows the tools offered to the model. Enabled, if not nil,
+// lists the only tools to offer; Disabled lists tools to withhold.
+type ToolFilter struct {
+	Enabled  map[string]bool
+	Disabled map[string]bool
+}
+
+// parseToolList parses a comma-separated list of tool names, checking each
+// against the tools available
+func parseToolList(s string, available []Tool) (map[string]bool, error) {
+	known := make(map[string]bool)
+	for _, tool := range available {
+		known[tool.Function.Name] = true
+	}
+	names := make(map[string]bool)
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !known[name] {
+			list := make([]string, 0, len(known))
+			for name := range known {
+				list = append(list, name)
+			}
+			sort.Strings(list)
+			return nil, fmt.Errorf("unknown tool %q; available tools are %s", name, strings.Join(list, ", "))
+		}
+		names[name] = true
+	}
+	return names, nil
+}
+
+// commandTools are the tools that run commands, or code, on the host
+var commandTools = map[string]bool{
+	"run_command": true, "change_directory": true, "run_python": true,
+	"go_test": true, "npm_run": true, "pytest": true, "run_scanner": true,
+}
+
+// allows reports whether a tool passes the filter. final_answer always
+// does, since the session can't finish without it when it is required.
+func (f ToolFilter) allows(name string) bool {
+	if name == "final_answer" {
+		return true
+	}
+	if f.Enabled != nil && !f.Enabled[name] {
+		return false
+	}
+	return !f.Disabled[name]
+}
+
+func (f ToolFilter) apply(tools []Tool) []Tool {
+	if f.Enabled == nil && len(f.Disabled) == 0 {
+		return tools
+	}
+	var kept []Tool
+	for _, tool := range tools {
+		if f.allows(tool.Function.Name) {
+			kept = append(kept, tool)
+		}
+	}
+	return kept
+}
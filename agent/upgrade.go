@@ -0,0 +1,354 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os/exec"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// dependencyUpdate is a dependency with a newer version to go to
+type dependencyUpdate struct {
+	ecosystem string // "go" or "npm"
+	name      string
+	current   string
+	latest    string
+
+	// outcome and detail say what came of the upgrade, for the summary
+	outcome string
+	detail  string
+}
+
+// command is the shell command that upgrades the dependency
+func (d *dependencyUpdate) command(npmLatest bool) string {
+	if d.ecosystem == "go" {
+		return fmt.Sprintf("go get %s && go mod tidy", shellQuote(d.name+"@"+d.latest))
+	}
+	if npmLatest {
+		return "npm install " + shellQuote(d.name+"@latest")
+	}
+	return "npm update " + shellQuote(d.name)
+}
+
+// outputIn runs a program in dir and returns what it printed. Some, like
+// npm outdated, exit with an error status to say they found something, so
+// the output is returned whatever the status, along with any error.
+func outputIn(dir, name string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), checkScriptTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Dir = dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		err = fmt.Errorf("%s %s: %v: %s", name, args[0], err, strings.TrimSpace(lastLines(stderr.String(), 5)))
+	}
+	return output, err
+}
+
+// goUpdates lists the direct dependencies in go.mod with newer versions
+func goUpdates(dir string) ([]*dependencyUpdate, error) {
+	output, err := outputIn(dir, "go", "list", "-m", "-u", "-json", "all")
+	if err != nil {
+		return nil, err
+	}
+	var updates []*dependencyUpdate
+	decoder := json.NewDecoder(bytes.NewReader(output))
+	for decoder.More() {
+		var module struct {
+			Path     string
+			Version  string
+			Main     bool
+			Indirect bool
+			Update   *struct{ Version string }
+		}
+		if err := decoder.Decode(&module); err != nil {
+			return nil, fmt.Errorf("failed to read go list output: %v", err)
+		}
+		if module.Main || module.Indirect || module.Update == nil {
+			continue
+		}
+		updates = append(updates, &dependencyUpdate{ecosystem: "go", name: module.Path, current: module.Version, latest: module.Update.Version})
+	}
+	return updates, nil
+}
+
+// npmUpdates lists the dependencies in package.json with newer versions:
+// those their ranges allow, or with latest, any newer version
+func npmUpdates(dir string, latest bool) ([]*dependencyUpdate, error) {
+	output, err := outputIn(dir, "npm", "outdated", "--json")
+	var outdated map[string]struct {
+		Current string `json:"current"`
+		Wanted  string `json:"wanted"`
+		Latest  string `json:"latest"`
+	}
+	if jsonErr := json.Unmarshal(output, &outdated); jsonErr != nil {
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to read npm outdated output: %v", jsonErr)
+	}
+	var updates []*dependencyUpdate
+	for name, v := range outdated {
+		target := v.Wanted
+		if latest {
+			target = v.Latest
+		}
+		if target == "" || target == v.Current {
+			continue
+		}
+		updates = append(updates, &dependencyUpdate{ecosystem: "npm", name: name, current: v.Current, latest: target})
+	}
+	sort.Slice(updates, func(i, j int) bool { return updates[i].name < updates[j].name })
+	return updates, nil
+}
+
+// upgrader holds what runUpgradeDeps needs to check and undo each upgrade
+type upgrader struct {
+	engine *Engine
+	verify string
+
+	// checkpoint is what an upgrade that isn't kept is undone back to
+	checkpoint
+}
+
+// runUpgradeDeps handles "wex upgrade-deps", which upgrades dependencies
+// one at a time, keeping each upgrade that passes the verification
+// command, if need be once the model has adapted the code, and undoing
+// the rest
+func runUpgradeDeps(engine *Engine, args []string, w io.Writer) error {
+	upgradeFlags := flag.NewFlagSet("upgrade-deps", flag.ExitOnError)
+	verify := upgradeFlags.String("verify", "", "Command that must pass after each upgrade (default go build and go test for Go modules, npm test for npm packages with a test script)")
+	only := upgradeFlags.String("only", "", "Upgrade only dependencies matching these patterns, comma-separated, e.g. \"golang.org/x/*,@types/*\"")
+	skip := upgradeFlags.String("skip", "", "Leave dependencies matching these patterns alone, comma-separated")
+	latest := upgradeFlags.Bool("latest", false, "Upgrade npm packages to their latest versions, even past the ranges in package.json")
+	retries := upgradeFlags.Int("retries", 1, "Times to ask the model to fix the code when an upgrade breaks it; 0 means undo it straight away")
+	commit := upgradeFlags.Bool("commit", false, "Commit each upgrade that is kept, rather than staging it")
+	dryRun := upgradeFlags.Bool("dry-run", false, "Only list the dependencies that would be upgraded")
+	upgradeFlags.Usage = func() {
+		fmt.Fprintf(upgradeFlags.Output(), "Usage: wex [flags] upgrade-deps [--verify CMD] [--only PATTERNS] [--skip PATTERNS] [--latest] [--retries N] [--commit] [--dry-run] [instructions]\n")
+		upgradeFlags.PrintDefaults()
+	}
+	upgradeFlags.Parse(args)
+	if engine.offline {
+		return fmt.Errorf("upgrading dependencies needs the network, and wex is running with --offline")
+	}
+
+	if !engine.fileExists("go.mod") && !engine.fileExists("package.json") {
+		return fmt.Errorf("no go.mod or package.json in the workspace")
+	}
+	var updates []*dependencyUpdate
+	var defaultVerify []string
+	if engine.fileExists("go.mod") {
+		found, err := goUpdates(engine.workspace)
+		if err != nil {
+			return err
+		}
+		updates = append(updates, found...)
+		defaultVerify = append(defaultVerify, "go build ./... && go test ./...")
+	}
+	if engine.fileExists("package.json") {
+		found, err := npmUpdates(engine.workspace, *latest)
+		if err != nil {
+			return err
+		}
+		updates = append(updates, found...)
+		if slices.Contains(engine.npmScripts(), "test") {
+			defaultVerify = append(defaultVerify, "npm test")
+		}
+	}
+	updates = filterUpdates(updates, *only, *skip)
+	if len(updates) == 0 {
+		fmt.Fprintf(w, "Everything is up to date\n")
+		return nil
+	}
+	fmt.Fprintf(w, "Dependencies to upgrade:\n")
+	for _, d := range updates {
+		fmt.Fprintf(w, "  %s %s -> %s\n", d.name, d.current, d.latest)
+	}
+	if *dryRun {
+		return nil
+	}
+
+	u := &upgrader{engine: engine, verify: *verify}
+	if u.verify == "" {
+		if len(defaultVerify) == 0 {
+			return fmt.Errorf("no way to check the upgrades; give a command with --verify")
+		}
+		u.verify = strings.Join(defaultVerify, " && ")
+	}
+	// Kept upgrades are staged or committed, and the rest undone by going
+	// back to the index, which mustn't take the user's work with it
+	if status, err := engine.git("status", "--porcelain", "--untracked-files=no"); err != nil {
+		return fmt.Errorf("wex upgrade-deps needs a git repository: %v", err)
+	} else if status != "" {
+		return fmt.Errorf("there are uncommitted changes; commit or stash them first")
+	}
+	u.checkpoint = newCheckpoint(engine, false)
+	if passed, output := runCheck(engine.workspace, u.verify); !passed {
+		return fmt.Errorf("`%s` fails before any upgrade:\n%s", u.verify, output)
+	}
+
+	if engine.taskType == "" || engine.taskType == taskTypeAuto {
+		engine.taskType = "bug-fix"
+	}
+	instructions := strings.Join(upgradeFlags.Args(), " ")
+	for i, d := range updates {
+		fmt.Fprintf(w, "\nUpgrade %d of %d: %s %s -> %s\n", i+1, len(updates), d.name, d.current, d.latest)
+		if err := u.upgrade(d, *latest, *retries, instructions); err != nil {
+			u.revert()
+			return err
+		}
+		if d.outcome == "reverted" {
+			u.revert()
+			fmt.Fprintf(w, "Reverted: %s\n", firstLine(d.detail, "the check failed"))
+			continue
+		}
+		if err := u.keep(d, *commit); err != nil {
+			return err
+		}
+		if d.outcome == "adapted" {
+			fmt.Fprintf(w, "Kept, with the code adapted\n")
+		} else {
+			fmt.Fprintf(w, "Kept\n")
+		}
+	}
+
+	fmt.Fprintf(w, "\n%s", upgradeSummary(updates))
+	if !*commit {
+		fmt.Fprintf(w, "Review the kept upgrades with git diff --cached\n")
+	}
+	return nil
+}
+
+// filterUpdates keeps the updates matching only, if given, and not skip
+func filterUpdates(updates []*dependencyUpdate, only, skip string) []*dependencyUpdate {
+	matches := func(patterns, name string) bool {
+		for _, pattern := range strings.Split(patterns, ",") {
+			pattern = strings.TrimSpace(pattern)
+			if ok, _ := path.Match(pattern, name); ok && pattern != "" {
+				return true
+			}
+		}
+		return false
+	}
+	var kept []*dependencyUpdate
+	for _, d := range updates {
+		if (only == "" || matches(only, d.name)) && !matches(skip, d.name) {
+			kept = append(kept, d)
+		}
+	}
+	return kept
+}
+
+// upgrade runs the upgrade command and the verification command, asking
+// the model to adapt the code if it fails, and sets the outcome: upgraded,
+// adapted, or reverted with what went wrong
+func (u *upgrader) upgrade(d *dependencyUpdate, npmLatest bool, retries int, instructions string) error {
+	e := u.engine
+	command := d.command(npmLatest)
+	if passed, output := runCheck(e.workspace, command); !passed {
+		d.outcome, d.detail = "reverted", strings.TrimSpace(fmt.Sprintf("`%s` failed:\n%s", command, output))
+		return nil
+	}
+	passed, output := runCheck(e.workspace, u.verify)
+	if passed {
+		d.outcome = "upgraded"
+		return nil
+	}
+	for attempt := 0; attempt < retries; attempt++ {
+		e.logf("The upgrade of %s broke the build, asking for a fix", d.name)
+		if _, err := e.Run(context.Background(), u.message(d, output, instructions)); err != nil {
+			return err
+		}
+		if passed, output = runCheck(e.workspace, u.verify); passed {
+			d.outcome = "adapted"
+			return nil
+		}
+	}
+	d.outcome, d.detail = "reverted", strings.TrimSpace(fmt.Sprintf("`%s` failed:\n%s", u.verify, output))
+	return nil
+}
+
+// keep stages the upgrade, and commits it if asked
+func (u *upgrader) keep(d *dependencyUpdate, commit bool) error {
+	e := u.engine
+	if _, err := e.git("add", "--update"); err != nil {
+		return fmt.Errorf("failed to stage the upgrade: %v", err)
+	}
+	if created := u.created(); len(created) > 0 {
+		if _, err := e.git(append([]string{"add", "--"}, created...)...); err != nil {
+			return fmt.Errorf("failed to stage the upgrade: %v", err)
+		}
+	}
+	if !commit {
+		return nil
+	}
+	if staged, _ := e.git("diff", "--cached", "--name-only"); staged == "" {
+		return nil
+	}
+	subject := fmt.Sprintf("Upgrade %s from %s to %s", d.name, d.current, d.latest)
+	args := []string{"commit", "--quiet", "-m", subject}
+	if d.outcome == "adapted" {
+		args = append(args, "-m", "The code is adapted to the new version.")
+	}
+	if _, err := e.git(args...); err != nil {
+		return fmt.Errorf("failed to commit the upgrade: %v", err)
+	}
+	return nil
+}
+
+// message asks for the code to be adapted to an upgrade that broke it
+func (u *upgrader) message(d *dependencyUpdate, output, instructions string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Upgrading the dependency %s from %s to %s made `%s` fail:\n\n", d.name, d.current, d.latest, u.verify)
+	fence := codeFence(output)
+	fmt.Fprintf(&b, "%s\n%s\n%s\n\n", fence, output, fence)
+	b.WriteString("Adapt the code to the new version, following its changelog or migration guide where there is one, so that the command passes again. " +
+		"Keep the new version: don't downgrade or pin it, and don't upgrade other dependencies. Don't weaken or skip tests to make them pass.\n")
+	if instructions != "" {
+		fmt.Fprintf(&b, "\n%s\n", instructions)
+	}
+	return b.String()
+}
+
+// upgradeSummary lists what was upgraded, and the breakages that were
+// undone, with the end of the failing output of each
+func upgradeSummary(updates []*dependencyUpdate) string {
+	var b strings.Builder
+	var kept, reverted []*dependencyUpdate
+	for _, d := range updates {
+		if d.outcome == "reverted" {
+			reverted = append(reverted, d)
+		} else {
+			kept = append(kept, d)
+		}
+	}
+	fmt.Fprintf(&b, "Upgraded %d of %d:\n", len(kept), len(updates))
+	for _, d := range kept {
+		note := ""
+		if d.outcome == "adapted" {
+			note = " (code adapted)"
+		}
+		fmt.Fprintf(&b, "  %s %s -> %s%s\n", d.name, d.current, d.latest, note)
+	}
+	if len(reverted) == 0 {
+		return b.String()
+	}
+	fmt.Fprintf(&b, "\nReverted, because they broke the build in ways that couldn't be fixed automatically:\n")
+	for _, d := range reverted {
+		fmt.Fprintf(&b, "\n  %s %s -> %s\n", d.name, d.current, d.latest)
+		for _, line := range strings.Split(lastLines(d.detail, 10), "\n") {
+			fmt.Fprintf(&b, "    %s\n", line)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,91 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFilterUpdates(t *testing.T) {
+	var updates []*dependencyUpdate
+	for _, name := range []string{"golang.org/x/net", "golang.org/x/text", "github.com/spf13/cobra", "@types/node"} {
+		updates = append(updates, &dependencyUpdate{name: name})
+	}
+	names := func(updates []*dependencyUpdate) string {
+		var names []string
+		for _, d := range updates {
+			names = append(names, d.name)
+		}
+		return strings.Join(names, " ")
+	}
+	if got := names(filterUpdates(updates, "golang.org/x/*, @types/*", "")); got != "golang.org/x/net golang.org/x/text @types/node" {
+		t.Errorf("only: %s", got)
+	}
+	if got := names(filterUpdates(updates, "", "golang.org/x/text,@types/*")); got != "golang.org/x/net github.com/spf13/cobra" {
+		t.Errorf("skip: %s", got)
+	}
+}
+
+func TestUpgradeDeps(t *testing.T) {
+	e, provider, _ := newTestEngine(t, []ChatResponse{
+		reply("", call("write_file", `{"path": "shim.js", "content": "module.exports = {}\n"}`)),
+		reply("Added a shim"),
+	})
+
+	// A stand-in for npm, where upgrading breaker breaks the build
+	bin := t.TempDir()
+	script := `#!/bin/sh
+case "$1" in
+outdated)
+	echo '{"left-pad": {"current": "1.0.0", "wanted": "1.3.0", "latest": "2.0.0"}, "breaker": {"current": "1.0.0", "wanted": "1.1.0", "latest": "1.1.0"}, "pinned": {"current": "1.0.0", "wanted": "1.0.0", "latest": "3.0.0"}}'
+	exit 1;;
+update)
+	sed -i "s/\"$2\": \"1.0.0\"/\"$2\": \"1.9.0\"/" package.json;;
+esac
+`
+	if err := os.WriteFile(filepath.Join(bin, "npm"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	git := func(args ...string) string {
+		out, err := gitIn(e.workspace, append([]string{"-c", "user.name=t", "-c", "user.email=t@t"}, args...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(out)
+	}
+	writeTestFile(t, e, "package.json", `{"dependencies": {"breaker": "1.0.0", "left-pad": "1.0.0", "pinned": "1.0.0"}}`+"\n")
+	git("init", "--quiet")
+	git("config", "user.name", "t")
+	git("config", "user.email", "t@t")
+	git("add", "--all")
+	git("commit", "--quiet", "-m", "base")
+
+	var out strings.Builder
+	err := runUpgradeDeps(e, []string{"--verify", `! grep -q '"breaker": "1.9' package.json`, "--commit"}, &out)
+	if err != nil {
+		t.Fatalf("%v\n%s", err, out.String())
+	}
+
+	request := provider.lastMessages(t, 1)[1].Content
+	if !strings.Contains(request, "Upgrading the dependency breaker from 1.0.0 to 1.1.0 made") || !strings.Contains(request, "don't downgrade or pin it") {
+		t.Errorf("request:\n%s", request)
+	}
+	if _, err := os.Stat(filepath.Join(e.workspace, "shim.js")); err == nil {
+		t.Error("the failed fix was not undone")
+	}
+	if log := git("log", "--format=%s"); log != "Upgrade left-pad from 1.0.0 to 1.3.0\nbase" {
+		t.Errorf("commits:\n%s", log)
+	}
+	data, _ := os.ReadFile(filepath.Join(e.workspace, "package.json"))
+	if string(data) != `{"dependencies": {"breaker": "1.0.0", "left-pad": "1.9.0", "pinned": "1.0.0"}}`+"\n" {
+		t.Errorf("package.json: %s", data)
+	}
+	for _, want := range []string{"Upgraded 1 of 2:\n  left-pad 1.0.0 -> 1.3.0\n", "couldn't be fixed automatically:\n\n  breaker 1.0.0 -> 1.1.0\n    `! grep"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output is missing %q:\n%s", want, out.String())
+		}
+	}
+}
@@ -0,0 +1,20 @@
+package agent
+
+import (
+	"embed"
+	"net/http"
+)
+
+// webUI is the page wex serve offers at /, for those who would rather use
+// a browser than a terminal: it starts sessions and carries them on, shows
+// their output as it streams in and the changes they made, and lets
+// reviewers approve or deny what sessions ask to do. It is static, and
+// uses the API with the tokens it is given, so serving it needs none.
+//
+//go:embed webui
+var webUI embed.FS
+
+func serveWebUI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
+	http.ServeFileFS(w, r, webUI, "webui/index.html")
+}
@@ -89,12 +89,27 @@ class WexEngine:
         """Get list of files that should trigger image rebuild."""
         base_path = Path(__file__).parent
         relevant_files = [
-            "main.go",
             "go.mod",
             "go.sum",
             "Dockerfile",
             "system_prompt.txt"
         ]
+        # Engine sources; the standalone tool call tester is not part of the image
+        relevant_files += sorted(
+            p.name for p in base_path.glob("*.go") if p.name != "test_tool_calls.go"
+        )
+        # Project scaffold templates embedded in the engine
+        relevant_files += sorted(
+            str(p.relative_to(base_path)) for p in base_path.glob("scaffolds/**/*.tmpl")
+        )
+        # Task type prompts embedded in the engine
+        relevant_files += sorted(
+            str(p.relative_to(base_path)) for p in base_path.glob("task_prompts/*.txt")
+        )
+        # The wex serve page embedded in the engine
+        relevant_files += sorted(
+            str(p.relative_to(base_path)) for p in base_path.glob("webui/*")
+        )
         
         existing_files = []
         for file_name in relevant_files:
@@ -182,7 +197,8 @@ class WexEngine:
             "--rm",
             "-v", f"{workspace_path}:/workspace",
             "-e", f"OLLAMA_URL={self.ollama_url}",
-            "-e", f"WORKSPACE=/workspace"
+            "-e", f"WORKSPACE=/workspace",
+            "-e", f"HOST_WORKSPACE={workspace_path}"
         ]
         
         # Add model environment variable if specified
@@ -242,6 +258,7 @@ class WexEngine:
             "-v", f"{workspace_path}:/workspace",
             "-e", f"OLLAMA_URL={self.ollama_url}",
             "-e", f"WORKSPACE=/workspace",
+            "-e", f"HOST_WORKSPACE={workspace_path}",
             "--entrypoint", "/bin/sh",
             self.image_name
         ]
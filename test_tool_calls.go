@@ -1,3 +1,8 @@
+//go:build ignore
+
+// The tool call tester is a standalone program built from this file alone
+// (see build_tool_tester.bat), so it is kept out of the engine package.
+
 package main
 
 import (
@@ -5,6 +10,8 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"html/template"
+	"io"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -22,15 +29,26 @@ const (
 	TestStatusSkip    TestStatus = "SKIP"
 )
 
+// FollowUp is a scripted user message injected partway through a test
+type FollowUp struct {
+	// AfterTool is the tool whose result triggers the message; empty means
+	// after the assistant finishes its turn without calling a tool
+	AfterTool string `json:"after_tool,omitempty"`
+	Message   string `json:"message"`
+}
+
 // TestCase represents a single test case
 type TestCase struct {
-	Name            string   `json:"name"`
-	Description     string   `json:"description"`
-	SystemPrompt    string   `json:"system_prompt"`
-	UserMessage     string   `json:"user_message"`
-	ExpectedTools   []string `json:"expected_tools"`
-	SuccessCriteria string   `json:"success_criteria"`
-	Timeout         int      `json:"timeout"`
+	Name            string     `json:"name"`
+	Category        string     `json:"category"`
+	Description     string     `json:"description"`
+	SystemPrompt    string     `json:"system_prompt"`
+	UserMessage     string     `json:"user_message"`
+	ExpectedTools   []string   `json:"expected_tools"`
+	SuccessCriteria string     `json:"success_criteria"`
+	Timeout         int        `json:"timeout"`
+	Stream          bool       `json:"stream,omitempty"`
+	FollowUps       []FollowUp `json:"follow_ups,omitempty"`
 }
 
 // ToolCallResult represents the result of a tool call execution
@@ -49,6 +67,7 @@ type TestResult struct {
 	ResponseContent string           `json:"response_content"`
 	Duration        float64          `json:"duration"`
 	Notes           string           `json:"notes,omitempty"`
+	Transcript      []Message        `json:"transcript,omitempty"`
 }
 
 // Tool represents a function tool definition
@@ -100,6 +119,9 @@ type LLMToolCallTester struct {
 	OllamaURL string
 	Model     string
 	Tools     []Tool
+
+	// TestStreaming adds a stream=true variant of every test case
+	TestStreaming bool
 }
 
 // NewLLMToolCallTester creates a new tester instance
@@ -354,12 +376,12 @@ func (t *LLMToolCallTester) parseToolCallsFromContent(content string) []struct {
 }
 
 // sendChatRequest sends a chat request to the Ollama API
-func (t *LLMToolCallTester) sendChatRequest(messages []Message) (*ChatResponse, error) {
+func (t *LLMToolCallTester) sendChatRequest(messages []Message, stream bool) (*ChatResponse, error) {
 	requestData := ChatRequest{
 		Model:    t.Model,
 		Messages: messages,
 		Tools:    t.Tools,
-		Stream:   false,
+		Stream:   stream,
 	}
 
 	jsonData, err := json.Marshal(requestData)
@@ -382,6 +404,10 @@ func (t *LLMToolCallTester) sendChatRequest(messages []Message) (*ChatResponse,
 		return nil, fmt.Errorf("API error: %d", resp.StatusCode)
 	}
 
+	if stream {
+		return assembleStreamedResponse(resp.Body)
+	}
+
 	var chatResp ChatResponse
 	if err := json.NewDecoder(resp.Body).Decode(&chatResp); err != nil {
 		return nil, fmt.Errorf("failed to decode response: %v", err)
@@ -390,6 +416,37 @@ func (t *LLMToolCallTester) sendChatRequest(messages []Message) (*ChatResponse,
 	return &chatResp, nil
 }
 
+// assembleStreamedResponse combines streamed NDJSON chunks into a single response
+func assembleStreamedResponse(body io.Reader) (*ChatResponse, error) {
+	var chatResp ChatResponse
+	decoder := json.NewDecoder(body)
+
+	for {
+		var chunk ChatResponse
+		if err := decoder.Decode(&chunk); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to decode stream chunk: %v", err)
+		}
+
+		if chunk.Message.Role != "" {
+			chatResp.Message.Role = chunk.Message.Role
+		}
+		chatResp.Message.Content += chunk.Message.Content
+		chatResp.Message.ToolCalls = append(chatResp.Message.ToolCalls, chunk.Message.ToolCalls...)
+
+		if chunk.Done {
+			chatResp.Done = true
+			break
+		}
+	}
+
+	if !chatResp.Done {
+		return nil, fmt.Errorf("stream ended without a done chunk")
+	}
+	return &chatResp, nil
+}
+
 // runTest executes a single test case
 func (t *LLMToolCallTester) runTest(testCase TestCase) TestResult {
 	fmt.Printf("\n🧪 Running test: %s\n", testCase.Name)
@@ -403,10 +460,11 @@ func (t *LLMToolCallTester) runTest(testCase TestCase) TestResult {
 	}
 
 	var toolCalls []ToolCallResult
-	maxIterations := 10
+	maxIterations := 10 * (len(testCase.FollowUps) + 1)
+	delivered := 0
 
 	for iteration := 0; iteration < maxIterations; iteration++ {
-		response, err := t.sendChatRequest(messages)
+		response, err := t.sendChatRequest(messages, testCase.Stream)
 		if err != nil {
 			duration := time.Since(startTime).Seconds()
 			return TestResult{
@@ -416,6 +474,7 @@ func (t *LLMToolCallTester) runTest(testCase TestCase) TestResult {
 				ResponseContent: "",
 				Duration:        duration,
 				Notes:           fmt.Sprintf("Failed to get response from API: %v", err),
+				Transcript:      messages,
 			}
 		}
 
@@ -450,6 +509,11 @@ func (t *LLMToolCallTester) runTest(testCase TestCase) TestResult {
 					Role:    "tool",
 					Content: fmt.Sprintf("Tool %s %s", toolName, toolResult),
 				})
+
+				if followUp, ok := nextFollowUp(testCase, delivered, toolName); ok {
+					messages = append(messages, Message{Role: "user", Content: followUp})
+					delivered++
+				}
 			}
 		} else if content != "" {
 			// Handle content-embedded tool calls
@@ -468,11 +532,24 @@ func (t *LLMToolCallTester) runTest(testCase TestCase) TestResult {
 						Role:    "tool",
 						Content: fmt.Sprintf("Tool %s %s", call.Name, toolResult),
 					})
+
+					if followUp, ok := nextFollowUp(testCase, delivered, call.Name); ok {
+						messages = append(messages, Message{Role: "user", Content: followUp})
+						delivered++
+					}
 				}
+			} else if followUp, ok := nextFollowUp(testCase, delivered, ""); ok {
+				// Turn complete, continue the scripted dialogue
+				messages = append(messages, Message{Role: "user", Content: followUp})
+				delivered++
 			} else {
 				// No tool calls found, conversation complete
 				break
 			}
+		} else if followUp, ok := nextFollowUp(testCase, delivered, ""); ok {
+			// Turn complete, continue the scripted dialogue
+			messages = append(messages, Message{Role: "user", Content: followUp})
+			delivered++
 		} else {
 			// No content or tool calls, conversation complete
 			break
@@ -482,13 +559,31 @@ func (t *LLMToolCallTester) runTest(testCase TestCase) TestResult {
 	duration := time.Since(startTime).Seconds()
 	result := t.evaluateTestResult(testCase, toolCalls, messages[len(messages)-1].Content)
 
+	notes := ""
+	if delivered < len(testCase.FollowUps) {
+		notes = fmt.Sprintf("Only %d of %d follow-up messages were reached", delivered, len(testCase.FollowUps))
+		if result == TestStatusPass {
+			result = TestStatusPartial
+		}
+	}
+
 	return TestResult{
 		TestName:        testCase.Name,
 		Result:          result,
 		ToolCalls:       toolCalls,
 		ResponseContent: messages[len(messages)-1].Content,
 		Duration:        duration,
+		Notes:           notes,
+		Transcript:      messages,
+	}
+}
+
+// nextFollowUp returns the next scripted follow-up if it is due after the given tool
+func nextFollowUp(testCase TestCase, delivered int, afterTool string) (string, bool) {
+	if delivered >= len(testCase.FollowUps) || testCase.FollowUps[delivered].AfterTool != afterTool {
+		return "", false
 	}
+	return testCase.FollowUps[delivered].Message, true
 }
 
 // evaluateTestResult evaluates whether the test passed
@@ -542,9 +637,10 @@ func (t *LLMToolCallTester) evaluateTestResult(testCase TestCase, toolCalls []To
 
 // getTestCases returns the test cases
 func (t *LLMToolCallTester) getTestCases() []TestCase {
-	return []TestCase{
+	testCases := []TestCase{
 		{
 			Name:            "basic_tool_call",
+			Category:        "single_call",
 			Description:     "Test basic tool call recognition and execution",
 			SystemPrompt:    "You are a helpful assistant that can use tools to complete tasks.",
 			UserMessage:     "Calculate 2 + 2",
@@ -554,6 +650,7 @@ func (t *LLMToolCallTester) getTestCases() []TestCase {
 		},
 		{
 			Name:            "sequential_tool_calls",
+			Category:        "multi_step",
 			Description:     "Test multiple tool calls in sequence",
 			SystemPrompt:    "You are a helpful assistant that can use tools to complete tasks.",
 			UserMessage:     "Write 'Hello World' to a file called hello.txt, then read it back",
@@ -563,6 +660,7 @@ func (t *LLMToolCallTester) getTestCases() []TestCase {
 		},
 		{
 			Name:            "complex_workflow",
+			Category:        "multi_step",
 			Description:     "Test complex multi-step workflow with conditional logic",
 			SystemPrompt:    "You are a helpful assistant that can use tools to complete tasks.",
 			UserMessage:     "Create a Python script that prints 'Hello World', save it as hello.py, then run it",
@@ -572,6 +670,7 @@ func (t *LLMToolCallTester) getTestCases() []TestCase {
 		},
 		{
 			Name:            "error_handling",
+			Category:        "error_handling",
 			Description:     "Test how the LLM handles tool call errors",
 			SystemPrompt:    "You are a helpful assistant that can use tools to complete tasks.",
 			UserMessage:     "Read a file that doesn't exist: /nonexistent/file.txt",
@@ -581,6 +680,7 @@ func (t *LLMToolCallTester) getTestCases() []TestCase {
 		},
 		{
 			Name:            "parameter_validation",
+			Category:        "error_handling",
 			Description:     "Test tool call parameter validation",
 			SystemPrompt:    "You are a helpful assistant that can use tools to complete tasks.",
 			UserMessage:     "Calculate the result of an invalid expression: 'not_a_number + 5'",
@@ -590,6 +690,7 @@ func (t *LLMToolCallTester) getTestCases() []TestCase {
 		},
 		{
 			Name:            "no_tools_needed",
+			Category:        "no_tools",
 			Description:     "Test response when no tools are needed",
 			SystemPrompt:    "You are a helpful assistant that can use tools to complete tasks.",
 			UserMessage:     "What is the capital of France?",
@@ -597,7 +698,52 @@ func (t *LLMToolCallTester) getTestCases() []TestCase {
 			SuccessCriteria: "Should respond directly without using tools",
 			Timeout:         3600,
 		},
+		{
+			Name:          "multi_turn_follow_up",
+			Category:      "multi_turn",
+			Description:   "Test that tool context is kept when the user follows up after a tool result",
+			SystemPrompt:  "You are a helpful assistant that can use tools to complete tasks.",
+			UserMessage:   "Write the text 'version 1' to a file called notes.txt",
+			ExpectedTools: []string{"write_file", "read_file"},
+			FollowUps: []FollowUp{
+				{AfterTool: "write_file", Message: "Now read back the file you just wrote"},
+			},
+			SuccessCriteria: "Should write notes.txt, then read the same path after the follow-up",
+			Timeout:         3600,
+		},
+		{
+			Name:          "multi_turn_after_answer",
+			Category:      "multi_turn",
+			Description:   "Test that a later request can build on an earlier answer",
+			SystemPrompt:  "You are a helpful assistant that can use tools to complete tasks.",
+			UserMessage:   "Calculate 12 * 7",
+			ExpectedTools: []string{"calculate", "write_file"},
+			FollowUps: []FollowUp{
+				{Message: "Save that result to a file called answer.txt"},
+			},
+			SuccessCriteria: "Should calculate, answer, then write the earlier result to answer.txt",
+			Timeout:         3600,
+		},
 	}
+
+	if t.TestStreaming {
+		testCases = append(testCases, streamingVariants(testCases)...)
+	}
+	return testCases
+}
+
+// streamingVariants returns copies of the test cases that run with stream=true,
+// so tool calls assembled from streamed chunks are checked as well
+func streamingVariants(testCases []TestCase) []TestCase {
+	variants := make([]TestCase, len(testCases))
+	for i, testCase := range testCases {
+		testCase.Name += "_stream"
+		testCase.Description += " (streaming)"
+		testCase.Category = "streaming"
+		testCase.Stream = true
+		variants[i] = testCase
+	}
+	return variants
 }
 
 // runAllTests executes all test cases
@@ -761,6 +907,325 @@ func (t *LLMToolCallTester) saveResults(results map[string]TestResult) error {
 	return nil
 }
 
+// resultsBaseName returns the results file name for the model, without extension
+func (t *LLMToolCallTester) resultsBaseName() string {
+	modelName := strings.ReplaceAll(t.Model, ":", "_")
+	modelName = strings.ReplaceAll(modelName, "/", "_")
+	return filepath.Join("results", modelName)
+}
+
+// saveJSONResults saves test results as plain JSON, suitable for use as a baseline
+func (t *LLMToolCallTester) saveJSONResults(results map[string]TestResult) error {
+	if err := os.MkdirAll("results", 0755); err != nil {
+		return fmt.Errorf("failed to create results directory: %v", err)
+	}
+
+	jsonData, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to serialize results: %v", err)
+	}
+
+	path := t.resultsBaseName() + ".json"
+	if err := os.WriteFile(path, jsonData, 0644); err != nil {
+		return fmt.Errorf("failed to write results file: %v", err)
+	}
+
+	fmt.Printf("📄 JSON results saved to: %s\n", path)
+	return nil
+}
+
+// htmlReportTemplate renders a self-contained HTML report; charts are inline SVG
+const htmlReportTemplate = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>LLM Tool Call Test Results - {{.Model}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; max-width: 960px; }
+summary { cursor: pointer; font-weight: bold; padding: 0.3em 0; }
+details { border-bottom: 1px solid #ddd; padding: 0.3em 0; }
+pre { background: #f6f6f6; padding: 0.5em; white-space: pre-wrap; word-wrap: break-word; }
+.msg { margin: 0.5em 0; }
+.role { font-size: 0.85em; color: #555; text-transform: uppercase; }
+.PASS summary { color: #1a7f37; }
+.FAIL summary { color: #cf222e; }
+.PARTIAL summary { color: #9a6700; }
+</style>
+</head>
+<body>
+<h1>LLM Tool Call Test Results</h1>
+<p>
+<b>Model:</b> {{.Model}}<br>
+<b>Ollama URL:</b> {{.OllamaURL}}<br>
+<b>Test Date:</b> {{.Date}}<br>
+<b>Passed:</b> {{.Passed}} / {{.Total}} ({{printf "%.1f" .SuccessRate}}%)
+</p>
+
+<h2>Pass Rate by Category</h2>
+<svg width="640" height="{{.CategoryChartHeight}}" xmlns="http://www.w3.org/2000/svg">
+{{range .Categories}}<text x="0" y="{{.TextY}}" font-size="13">{{.Name}}</text>
+<rect x="160" y="{{.Y}}" width="400" height="18" fill="#eee"/>
+<rect x="160" y="{{.Y}}" width="{{.Width}}" height="18" fill="#2da44e"/>
+<text x="570" y="{{.TextY}}" font-size="13">{{.Passed}}/{{.Total}}</text>
+{{end}}</svg>
+
+<h2>Latency Distribution</h2>
+<svg width="640" height="200" xmlns="http://www.w3.org/2000/svg">
+{{range .Latency}}<rect x="{{.X}}" y="{{.Y}}" width="80" height="{{.Height}}" fill="#0969da"/>
+<text x="{{.TextX}}" y="{{.CountY}}" font-size="12" text-anchor="middle">{{.Count}}</text>
+<text x="{{.TextX}}" y="195" font-size="12" text-anchor="middle">{{.Label}}</text>
+{{end}}</svg>
+
+<h2>Tests</h2>
+{{range .Tests}}<details class="{{.Status}}">
+<summary>{{.Name}} - {{.Status}} ({{printf "%.2f" .Duration}}s)</summary>
+<p>{{.Description}}</p>
+<p><b>Success Criteria:</b> {{.SuccessCriteria}}</p>
+{{if .Notes}}<p><b>Notes:</b> {{.Notes}}</p>{{end}}
+{{if .ToolCalls}}<h4>Tool Calls</h4>
+<ol>{{range .ToolCalls}}<li>{{if .Success}}&#10003;{{else}}&#10007;{{end}} <code>{{.Name}}</code> {{.Arguments}}{{if .Error}} - Error: {{.Error}}{{end}}</li>{{end}}</ol>{{end}}
+<h4>Transcript</h4>
+{{range .Transcript}}<div class="msg"><div class="role">{{.Role}}</div><pre>{{.Content}}</pre></div>
+{{end}}</details>
+{{end}}
+</body>
+</html>
+`
+
+// latencyBuckets are the upper bounds, in seconds, of the latency histogram buckets
+var latencyBuckets = []float64{5, 15, 30, 60, 120}
+
+// saveHTMLReport saves test results as a self-contained HTML report
+func (t *LLMToolCallTester) saveHTMLReport(results map[string]TestResult) error {
+	if err := os.MkdirAll("results", 0755); err != nil {
+		return fmt.Errorf("failed to create results directory: %v", err)
+	}
+
+	type categoryRow struct {
+		Name          string
+		Passed, Total int
+		Y, TextY      int
+		Width         int
+	}
+	type latencyBar struct {
+		Label                       string
+		Count                       int
+		X, Y, Height, TextX, CountY int
+	}
+	type toolCallRow struct {
+		Name      string
+		Arguments string
+		Success   bool
+		Error     string
+	}
+	type testRow struct {
+		Name            string
+		Description     string
+		SuccessCriteria string
+		Status          TestStatus
+		Duration        float64
+		Notes           string
+		ToolCalls       []toolCallRow
+		Transcript      []Message
+	}
+
+	data := struct {
+		Model               string
+		OllamaURL           string
+		Date                string
+		Passed, Total       int
+		SuccessRate         float64
+		Categories          []categoryRow
+		CategoryChartHeight int
+		Latency             []latencyBar
+		Tests               []testRow
+	}{
+		Model:     t.Model,
+		OllamaURL: t.OllamaURL,
+		Date:      time.Now().Format("2006-01-02 15:04:05"),
+	}
+
+	counts := make([]int, len(latencyBuckets)+1)
+	categoryIndex := make(map[string]int)
+
+	for _, testCase := range t.getTestCases() {
+		result, exists := results[testCase.Name]
+		if !exists {
+			continue
+		}
+
+		data.Total++
+		if result.Result == TestStatusPass {
+			data.Passed++
+		}
+
+		i, seen := categoryIndex[testCase.Category]
+		if !seen {
+			i = len(data.Categories)
+			categoryIndex[testCase.Category] = i
+			data.Categories = append(data.Categories, categoryRow{Name: testCase.Category})
+		}
+		data.Categories[i].Total++
+		if result.Result == TestStatusPass {
+			data.Categories[i].Passed++
+		}
+
+		bucket := len(latencyBuckets)
+		for j, bound := range latencyBuckets {
+			if result.Duration < bound {
+				bucket = j
+				break
+			}
+		}
+		counts[bucket]++
+
+		row := testRow{
+			Name:            testCase.Name,
+			Description:     testCase.Description,
+			SuccessCriteria: testCase.SuccessCriteria,
+			Status:          result.Result,
+			Duration:        result.Duration,
+			Notes:           result.Notes,
+			Transcript:      result.Transcript,
+		}
+		for _, tc := range result.ToolCalls {
+			args, _ := json.Marshal(tc.Arguments)
+			row.ToolCalls = append(row.ToolCalls, toolCallRow{
+				Name:      tc.ToolName,
+				Arguments: string(args),
+				Success:   tc.Success,
+				Error:     tc.Error,
+			})
+		}
+		data.Tests = append(data.Tests, row)
+	}
+
+	if data.Total > 0 {
+		data.SuccessRate = float64(data.Passed) / float64(data.Total) * 100
+	}
+
+	for i := range data.Categories {
+		c := &data.Categories[i]
+		c.Y = i*26 + 4
+		c.TextY = c.Y + 14
+		c.Width = 400 * c.Passed / c.Total
+	}
+	data.CategoryChartHeight = len(data.Categories)*26 + 8
+
+	maxCount := 1
+	for _, count := range counts {
+		if count > maxCount {
+			maxCount = count
+		}
+	}
+	for i, count := range counts {
+		label := fmt.Sprintf(">%gs", latencyBuckets[len(latencyBuckets)-1])
+		if i < len(latencyBuckets) {
+			label = fmt.Sprintf("<%gs", latencyBuckets[i])
+		}
+		height := 150 * count / maxCount
+		x := i*100 + 10
+		data.Latency = append(data.Latency, latencyBar{
+			Label:  label,
+			Count:  count,
+			X:      x,
+			Y:      170 - height,
+			Height: height,
+			TextX:  x + 40,
+			CountY: 165 - height,
+		})
+	}
+
+	tmpl, err := template.New("report").Parse(htmlReportTemplate)
+	if err != nil {
+		return fmt.Errorf("failed to parse report template: %v", err)
+	}
+
+	path := t.resultsBaseName() + ".html"
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create report file: %v", err)
+	}
+	defer file.Close()
+
+	if err := tmpl.Execute(file, data); err != nil {
+		return fmt.Errorf("failed to render report: %v", err)
+	}
+
+	fmt.Printf("📄 HTML report saved to: %s\n", path)
+	return nil
+}
+
+// loadBaseline loads previously saved JSON results
+func loadBaseline(path string) (map[string]TestResult, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read baseline: %v", err)
+	}
+
+	var baseline map[string]TestResult
+	if err := json.Unmarshal(data, &baseline); err != nil {
+		return nil, fmt.Errorf("failed to parse baseline: %v", err)
+	}
+	return baseline, nil
+}
+
+// statusRank orders test statuses from worst to best
+func statusRank(status TestStatus) int {
+	switch status {
+	case TestStatusPass:
+		return 2
+	case TestStatusPartial:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// compareWithBaseline prints per-test changes against a baseline and returns the number of regressions
+func (t *LLMToolCallTester) compareWithBaseline(results, baseline map[string]TestResult) int {
+	fmt.Println("\n" + strings.Repeat("=", 60))
+	fmt.Println("📈 BASELINE COMPARISON")
+	fmt.Println(strings.Repeat("=", 60))
+
+	regressions := 0
+	improvements := 0
+
+	for _, testCase := range t.getTestCases() {
+		result, exists := results[testCase.Name]
+		if !exists {
+			continue
+		}
+
+		old, inBaseline := baseline[testCase.Name]
+		if !inBaseline {
+			fmt.Printf("🆕 %s: %s (not in baseline)\n", testCase.Name, result.Result)
+			continue
+		}
+
+		switch {
+		case statusRank(result.Result) < statusRank(old.Result):
+			regressions++
+			fmt.Printf("🔻 %s: %s -> %s (regression)\n", testCase.Name, old.Result, result.Result)
+		case statusRank(result.Result) > statusRank(old.Result):
+			improvements++
+			fmt.Printf("🔺 %s: %s -> %s (improvement)\n", testCase.Name, old.Result, result.Result)
+		default:
+			fmt.Printf("   %s: %s (unchanged)\n", testCase.Name, result.Result)
+		}
+	}
+
+	for name := range baseline {
+		if _, exists := results[name]; !exists {
+			fmt.Printf("❓ %s: in baseline but not run\n", name)
+		}
+	}
+
+	fmt.Printf("\nRegressions: %d\n", regressions)
+	fmt.Printf("Improvements: %d\n", improvements)
+	return regressions
+}
+
 // printSummary prints a summary of test results
 func (t *LLMToolCallTester) printSummary(results map[string]TestResult) {
 	fmt.Println("\n" + strings.Repeat("=", 60))
@@ -839,6 +1304,9 @@ func main() {
 		ollamaURL = flag.String("ollama-url", "http://localhost:11434", "Ollama server URL")
 		model     = flag.String("model", "", "Model name to test (required)")
 		verbose   = flag.Bool("verbose", false, "Enable verbose output")
+		baseline  = flag.String("baseline", "", "JSON results file to compare against; exit code 3 on regression")
+		stream    = flag.Bool("stream", false, "Also run every test with stream=true")
+		report    = flag.String("report", "markdown", "Report format: markdown or html")
 	)
 	flag.Parse()
 
@@ -850,15 +1318,47 @@ func main() {
 
 	_ = verbose // For future use
 
+	if *report != "markdown" && *report != "html" {
+		fmt.Printf("Error: unknown report format %q\n", *report)
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	var baselineResults map[string]TestResult
+	if *baseline != "" {
+		var err error
+		baselineResults, err = loadBaseline(*baseline)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
 	tester := NewLLMToolCallTester(*ollamaURL, *model)
+	tester.TestStreaming = *stream
 
 	results := tester.runAllTests()
 	tester.printSummary(results)
 	
 	// Save results to file
-	if err := tester.saveResults(results); err != nil {
+	if *report == "html" {
+		if err := tester.saveHTMLReport(results); err != nil {
+			fmt.Printf("Warning: Failed to save HTML report: %v\n", err)
+		}
+	} else if err := tester.saveResults(results); err != nil {
 		fmt.Printf("Warning: Failed to save results: %v\n", err)
 	}
+	if err := tester.saveJSONResults(results); err != nil {
+		fmt.Printf("Warning: Failed to save JSON results: %v\n", err)
+	}
+
+	// When gating against a baseline, only regressions matter
+	if baselineResults != nil {
+		if tester.compareWithBaseline(results, baselineResults) > 0 {
+			os.Exit(3)
+		}
+		os.Exit(0)
+	}
 
 	// Exit with appropriate code
 	totalTests := len(results)